@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/luxgen"
+)
+
+// explore searches for inputs that take every branch of a word with a
+// declared stack effect and prints a table of them and what the word did,
+// for getting to know a word without reading all of it
+func explore(args []string) error {
+	fs := flag.NewFlagSet("explore", flag.ExitOnError)
+	runs := fs.Int("runs", 2000, "Input stacks to try at most")
+	seed := fs.Int64("seed", 1, "Seed for the random inputs; the same seed finds the same cases")
+	steps := fs.Int64("max-steps", 100_000, "Instructions each run may take")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: lux explore [-runs N] [-seed N] [-max-steps N] <file.lux> <word>")
+	}
+	file, word := fs.Arg(0), strings.ToUpper(fs.Arg(1))
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	effects, err := lux.StackEffects(string(source))
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	effect, ok := effects[word[strings.LastIndex(word, "::")+1:]]
+	if !ok {
+		return fmt.Errorf("%s declares no stack effect for %s; write one after its name, e.g. @%s ( a b -- c )",
+			file, word, strings.ToLower(word))
+	}
+	prog, err := lux.CompileProgram(string(source), lux.CompileOptions{LibPath: lux.DefaultLibPath(), NoEntry: true})
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	ex, err := luxgen.Explore(prog, word, effect, luxgen.ExploreOptions{Seed: *seed, Runs: *runs, MaxSteps: *steps})
+	if err != nil {
+		return err
+	}
+	return ex.WriteTable(os.Stdout)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+)
+
+// LockFile records every installed package so a checkout can be restored
+// with exactly the same bytes
+const LockFile = "lux.lock"
+
+// Package is one entry in the lockfile
+type Package struct {
+	File    string   `json:"file"`    // Name inside lux.PackagesDir
+	Source  string   `json:"source"`  // URL or path it was fetched from
+	SHA256  string   `json:"sha256"`  // Content hash, the package's version
+	Modules []string `json:"modules"` // Modules the package provides
+}
+
+type lockFile struct {
+	Packages []Package `json:"packages"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "get":
+		if err := get(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "notebook":
+		if err := notebook(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "explore":
+		if err := explore(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Println("Usage: lux get <url-or-path>...   Fetch .lux sources or .nuxlib archives into " + lux.PackagesDir)
+	fmt.Println("       lux get                    Restore the packages recorded in " + LockFile)
+	fmt.Println("       lux notebook [-check] <file.md>...  Run the ```lux blocks of Markdown files and record their output")
+	fmt.Println("       lux explore [options] <file.lux> <word>  Find inputs that take every branch of a word, and what it does with them")
+	os.Exit(1)
+}
+
+// get installs the named packages, or every locked package when none are named
+func get(sources []string) error {
+	lock, err := readLock()
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		if len(lock.Packages) == 0 {
+			return fmt.Errorf("%s lists no packages", LockFile)
+		}
+		for _, pkg := range lock.Packages {
+			if _, err := install(pkg.Source, pkg.SHA256); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, source := range sources {
+		pkg, err := install(source, "")
+		if err != nil {
+			return err
+		}
+		lock.put(pkg)
+	}
+	return writeLock(lock)
+}
+
+// install fetches source into the packages directory after checking that it
+// compiles. A non-empty wantHash must match the fetched content.
+func install(source, wantHash string) (Package, error) {
+	data, err := fetch(source)
+	if err != nil {
+		return Package{}, fmt.Errorf("fetching %s: %v", source, err)
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if wantHash != "" && hash != wantHash {
+		return Package{}, fmt.Errorf("%s changed since it was locked (sha256 %s, locked %s)", source, hash, wantHash)
+	}
+	pkg := Package{Source: source, SHA256: hash}
+	switch ext := strings.ToLower(filepath.Ext(baseName(source))); ext {
+	case ".nuxlib":
+		lib, err := lux.ParseLibrary(data)
+		if err != nil {
+			return Package{}, fmt.Errorf("%s: %v", source, err)
+		}
+		for _, mod := range lib.Modules {
+			pkg.Modules = append(pkg.Modules, mod.Name)
+		}
+		pkg.File = baseName(source)
+	case ".lux":
+		lib, err := lux.BuildLibrary([]lux.LibrarySource{{Path: source, Source: string(data)}}, lux.CompileOptions{LibPath: lux.DefaultLibPath()})
+		if err != nil {
+			return Package{}, err
+		}
+		name := lib.Modules[0].Name
+		pkg.Modules = []string{name}
+		pkg.File = strings.ToLower(name) + ".lux" // The name IMPORT looks for
+	default:
+		return Package{}, fmt.Errorf("%s: expected a .lux source or .nuxlib archive, got %q", source, ext)
+	}
+	if err := os.MkdirAll(lux.PackagesDir, 0755); err != nil {
+		return Package{}, err
+	}
+	if err := os.WriteFile(filepath.Join(lux.PackagesDir, pkg.File), data, 0644); err != nil {
+		return Package{}, err
+	}
+	fmt.Printf("Installed: %s (%s) %s\n", pkg.File, strings.Join(pkg.Modules, ", "), hash[:12])
+	return pkg, nil
+}
+
+// fetch reads an http(s) URL or a local path
+func fetch(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	resp, err := http.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// baseName returns the last path element of a URL or file path
+func baseName(source string) string {
+	if i := strings.IndexAny(source, "?#"); i >= 0 {
+		source = source[:i]
+	}
+	return source[strings.LastIndexAny(source, `/\`)+1:]
+}
+
+func readLock() (*lockFile, error) {
+	lock := &lockFile{}
+	data, err := os.ReadFile(LockFile)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("%s: %v", LockFile, err)
+	}
+	return lock, nil
+}
+
+// put adds or replaces the entry for pkg.File
+func (l *lockFile) put(pkg Package) {
+	for i := range l.Packages {
+		if l.Packages[i].File == pkg.File {
+			l.Packages[i] = pkg
+			return
+		}
+	}
+	l.Packages = append(l.Packages, pkg)
+	sort.Slice(l.Packages, func(i, j int) bool { return l.Packages[i].File < l.Packages[j].File })
+}
+
+func writeLock(lock *lockFile) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(LockFile, append(data, '\n'), 0644)
+}
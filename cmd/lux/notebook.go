@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// outputFence opens the block that notebook writes under each ```lux block
+const outputFence = "```lux-output"
+
+// notebookMaxSteps bounds each block, so a runaway loop fails the block
+// instead of hanging the tool
+const notebookMaxSteps = 10_000_000
+
+// notebook runs the ```lux blocks of each Markdown file and writes what each
+// printed, and the stack it left, in a ```lux-output block under it. With
+// -check the files are left alone and stale outputs are reported instead.
+func notebook(args []string) error {
+	fs := flag.NewFlagSet("notebook", flag.ExitOnError)
+	check := fs.Bool("check", false, "Report blocks whose recorded output is out of date instead of rewriting the files")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: lux notebook [-check] <file.md>...")
+	}
+	stale := 0
+	for _, file := range fs.Args() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		text, staleLines := runNotebook(string(data))
+		if *check {
+			for _, line := range staleLines {
+				fmt.Printf("%s:%d: output is out of date\n", file, line)
+			}
+			stale += len(staleLines)
+			continue
+		}
+		if text != string(data) {
+			if err := os.WriteFile(file, []byte(text), 0644); err != nil {
+				return err
+			}
+			fmt.Printf("Updated %s (%d blocks changed)\n", file, len(staleLines))
+		}
+	}
+	if stale > 0 {
+		return fmt.Errorf("%d notebook outputs are out of date; run lux notebook to update them", stale)
+	}
+	return nil
+}
+
+// runNotebook evaluates every ```lux block of a Markdown document in one
+// session and returns the document with fresh output blocks, along with
+// the line of each block whose output changed
+func runNotebook(text string) (string, []int) {
+	lines := strings.SplitAfter(text, "\n")
+	session := newNotebookSession()
+	var out strings.Builder
+	var stale []int
+	for i := 0; i < len(lines); i++ {
+		out.WriteString(lines[i])
+		if strings.TrimSpace(lines[i]) != "```lux" {
+			continue
+		}
+		start := i + 1
+		var block strings.Builder
+		for i++; i < len(lines) && strings.TrimSpace(lines[i]) != "```"; i++ {
+			block.WriteString(lines[i])
+			out.WriteString(lines[i])
+		}
+		if i == len(lines) {
+			break // Unclosed fence: leave the rest as it is
+		}
+		out.WriteString(lines[i])
+
+		// Replace the output block left by an earlier run, if there is one
+		old := ""
+		next := i + 1
+		if next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+			next++
+		}
+		if next < len(lines) && strings.TrimSpace(lines[next]) == outputFence {
+			end := next + 1
+			for end < len(lines) && strings.TrimSpace(lines[end]) != "```" {
+				end++
+			}
+			if end < len(lines) {
+				old = strings.Join(lines[next+1:end], "")
+				i = end
+			}
+		}
+		result := session.run(block.String())
+		if result != old {
+			stale = append(stale, start)
+		}
+		if !strings.HasSuffix(lines[i], "\n") {
+			out.WriteString("\n")
+		}
+		out.WriteString("\n" + outputFence + "\n" + result + "```\n")
+	}
+	return out.String(), stale
+}
+
+// notebookSession carries definitions, the stack and data memory from one
+// block to the next, as the REPL does from line to line
+type notebookSession struct {
+	definitions string
+	stack       []int32
+	memory      []byte // Reserved and device memory
+	build       *lux.Incremental
+}
+
+func newNotebookSession() *notebookSession {
+	return &notebookSession{build: lux.NewIncremental(lux.CompileOptions{NoEntry: true, LibPath: lux.DefaultLibPath()})}
+}
+
+// run evaluates one block and describes the result: what it printed, then
+// the stack. A block that fails leaves the session as it was.
+func (s *notebookSession) run(block string) string {
+	defs, _, err := lux.SplitSource(block)
+	if err != nil {
+		return fmt.Sprintf("Error: %v\n", err)
+	}
+	prog, err := s.build.Compile(s.definitions + block)
+	if err != nil {
+		return fmt.Sprintf("Error: %v\n", err)
+	}
+	machine := vm.NewVM(prog.Code)
+	if s.memory != nil {
+		copy(machine.Memory(), s.memory)
+	}
+	for _, val := range s.stack {
+		machine.Push(val)
+	}
+	var printed strings.Builder
+	machine.OutputHandler = func(value, format int32) {
+		printed.WriteString(vm.FormatOutput(value, format))
+	}
+	err = machine.RunLimited(vm.Limits{MaxSteps: notebookMaxSteps})
+	result := printed.String()
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	var limit *vm.LimitError
+	if errors.As(err, &limit) {
+		return result + fmt.Sprintf("Error: stopped after %d instructions\n", limit.Steps)
+	}
+	if err != nil {
+		return result + fmt.Sprintf("Error: %v\n", err)
+	}
+	s.definitions += defs
+	s.stack = machine.Stack()
+	s.memory = append(s.memory[:0], machine.Memory()[:vm.UserMemoryOffset]...)
+	return result + fmt.Sprintf("Stack: %v\n", s.stack)
+}
@@ -4,31 +4,301 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
 )
 
+var (
+	layoutFlag = flag.Bool("layout", false, "Print where each word, quotation, string and table was placed")
+	asmFlag    = flag.Bool("emit-asm", false, "Print the compiled code as a listing labelled with words and quotations, which vm.Assemble reads back")
+	entryFlag  = flag.String("entry", "", "Word to call after the toplevel code (default MAIN, if defined)")
+	rawFlag    = flag.Bool("raw", false, "Write bare bytecode (.bin) instead of a .nux image")
+	libFlag    = flag.Bool("lib", false, "Build a .nuxlib archive from one or more module sources")
+	outFlag    = flag.String("o", "", "Output file (default: first input with its extension replaced)")
+	signFlag   = flag.String("sign", "", "Sign the image with the Ed25519 private key in this file")
+	genkeyFlag = flag.String("genkey", "", "Write a new signing key pair to NAME.key and NAME.pub, then exit")
+	watchFlag  = flag.Bool("watch", false, "Recompile whenever the source changes, reusing unchanged words")
+	symbolFlag = flag.Bool("g", false, "Include a symbol table of word names and addresses for nux --entry, --disasm, profiling and debugging")
+	stripFlag  = flag.Bool("strip", false, "Remove the symbol table from the given .nux images, then exit")
+	baseFlag   = flag.Int("base", 0, "Address the code will load at, e.g. 0x5000 (default: where user memory starts)")
+	resFlag    = flag.Int("reserved", 0, "Reserved memory the target VM has (default 4096)")
+	rulesFlag  = flag.String("disable-rules", "", "Turn off these peephole rewrite rules, e.g. fold-div,swap-gt, or all to turn off every one")
+	listFlag   = flag.Bool("list-rules", false, "List the peephole rewrite rules, then exit")
+	o3Flag     = flag.Bool("O3", false, "Whole-program mode: inline small words across modules once linked, fold their constants and report the savings")
+	keepFlag   = flag.Bool("keep-all", false, "Keep every word, even those the program can never run (always so with -g)")
+	inlineFlag = flag.Bool("no-inline", false, "Call every quotation through its address instead of inlining the ones a combinator runs in place")
+	wrapFlag   = flag.Bool("wrap-hex", false, "Read hex literals from 0x80000000 to 0xFFFFFFFF as the negative numbers with the same bits, e.g. 0xFFFFFFFF as -1")
+	logFlag    = flag.String("log", "warn", "Print compiler diagnostics at this level and above to stderr: trace, debug, info or warn")
+	lowerFlag  = flag.Bool("explain-lowering", false, "Print the instructions each number, word, string and bracket compiled to, with their addresses")
+)
+
+// watchInterval is how often --watch checks the source for changes
+const watchInterval = 250 * time.Millisecond
+
 func main() {
 	flag.Parse()
 
+	if *genkeyFlag != "" {
+		generateKey(*genkeyFlag)
+		return
+	}
+
+	if *listFlag {
+		for _, rule := range lux.Rules {
+			replace := rule.Replace
+			switch {
+			case rule.Fold != nil:
+				replace = "(folded constant)"
+			case replace == "":
+				replace = "(nothing)"
+			}
+			fmt.Printf("%-14s %-12s -> %s\n", rule.Name, rule.Pattern, replace)
+		}
+		return
+	}
+
 	if len(flag.Args()) < 1 {
-		fmt.Println("Usage: luxc <file.lux>")
+		fmt.Println("Usage: luxc [options] <file.lux>")
+		fmt.Println("       luxc -lib [-o name.nuxlib] <module.lux>...")
+		fmt.Println("       luxc -watch [options] <file.lux>")
+		fmt.Println("       luxc -strip <file.nux>...")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *stripFlag {
+		if err := stripImages(flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *libFlag {
+		if *watchFlag {
+			fmt.Fprintf(os.Stderr, "Error: --watch cannot be combined with --lib\n")
+			os.Exit(1)
+		}
+		buildLibrary(flag.Args())
+		return
+	}
+
+	opts := lux.CompileOptions{Entry: *entryFlag, LibPath: lux.DefaultLibPath(), BaseAddr: int32(*baseFlag), ReservedSize: int32(*resFlag), NoInline: *inlineFlag,
+		DropUnused: !*symbolFlag && !*keepFlag, WholeProgram: *o3Flag, ExplainLowering: *lowerFlag, WrapHex: *wrapFlag}
+	if *rulesFlag != "" {
+		opts.DisabledRules = strings.Split(*rulesFlag, ",")
+	}
+	level, err := lux.ParseLevel(*logFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	opts.Logger = lux.NewLogger(os.Stderr, level)
+	if *watchFlag {
+		watch(flag.Args()[0], opts)
+		return
+	}
 
 	// Read source
 	source, _ := os.ReadFile(flag.Args()[0])
 
 	// Compile to bytecode
-	bytecode, err := lux.Compile(string(source))
+	prog, err := lux.CompileProgram(string(source), opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Write bytecode
-	outFile := flag.Args()[0][:len(flag.Args()[0])-4] + ".bin"
-	os.WriteFile(outFile, bytecode, 0644)
+	outFile, err := writeProgram(prog)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	fmt.Printf("Compiled: %s\n", outFile)
+	if prog.Entry != "" {
+		fmt.Printf("Entry: %s\n", prog.Entry)
+	}
+	if len(prog.Dropped) > 0 {
+		fmt.Printf("Dropped %d unused words: %s\n", len(prog.Dropped), strings.Join(prog.Dropped, " "))
+	}
+	if *o3Flag {
+		reportWholeProgram(string(source), opts, prog)
+	}
+
+	if *layoutFlag {
+		fmt.Println()
+		prog.Layout.WriteTo(os.Stdout)
+	}
+	if *asmFlag {
+		fmt.Println()
+		prog.WriteAsm(os.Stdout)
+	}
+	if *lowerFlag {
+		fmt.Println()
+		prog.WriteLowering(os.Stdout)
+	}
+}
+
+// reportWholeProgram compares prog, compiled with -O3, to the program
+// compiled without it
+func reportWholeProgram(source string, opts lux.CompileOptions, prog *lux.Program) {
+	opts.WholeProgram, opts.Logger = false, nil
+	plain, err := lux.CompileProgram(source, opts)
+	if err != nil {
+		return
+	}
+	before, after := len(plain.Code), len(prog.Code)
+	fmt.Printf("Whole-program: %d -> %d bytes (%+.1f%%), %d calls inlined, each a CALL and RET fewer every time it runs\n",
+		before, after, 100*float64(after-before)/float64(before), prog.Inlined)
+}
+
+// writeProgram writes the image, or bare bytecode with --raw, and returns
+// the file name
+func writeProgram(prog *lux.Program) (string, error) {
+	image := prog.Image()
+	if !*symbolFlag {
+		image.Symbols, image.Tables = nil, nil
+	}
+	outFile, out := outputName(".nux"), vm.EncodeImage(image)
+	if *signFlag != "" {
+		if *rawFlag {
+			return "", fmt.Errorf("--sign needs a .nux image and cannot be combined with --raw")
+		}
+		keyText, err := os.ReadFile(*signFlag)
+		if err != nil {
+			return "", err
+		}
+		key, err := vm.ParsePrivateKey(string(keyText))
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", *signFlag, err)
+		}
+		out = vm.EncodeSignedImage(image, key)
+	}
+	if *rawFlag {
+		outFile, out = outputName(".bin"), prog.Code
+	}
+	return outFile, os.WriteFile(outFile, out, 0644)
+}
+
+// stripImages rewrites each image without its symbol and table names. A signed image
+// is refused, since removing the symbols would break its signature.
+func stripImages(files []string) error {
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if !vm.IsImage(data) {
+			return fmt.Errorf("%s: not a .nux image", file)
+		}
+		image, err := vm.ParseImage(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if image.Signature != nil {
+			return fmt.Errorf("%s: image is signed; rebuild it without -g and sign it again", file)
+		}
+		count := len(image.Symbols) + len(image.Tables)
+		image.Symbols, image.Tables = nil, nil
+		if err := os.WriteFile(file, vm.EncodeImage(image), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Stripped: %s (%d symbols removed)\n", file, count)
+	}
+	return nil
+}
+
+// watch rebuilds file each time it changes, until interrupted. Only the
+// words that changed, and the words that use them, are recompiled.
+func watch(file string, opts lux.CompileOptions) {
+	build := lux.NewIncremental(opts)
+	var modTime time.Time
+	fmt.Printf("Watching %s (Ctrl-C to stop)\n", file)
+	for ; ; time.Sleep(watchInterval) {
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		source, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+		start := time.Now()
+		prog, err := build.Compile(string(source))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+		outFile, err := writeProgram(prog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+		stats := build.Stats()
+		fmt.Printf("Compiled: %s (%d words recompiled, %d reused) in %v\n",
+			outFile, len(stats.Recompiled), stats.Reused, time.Since(start).Round(time.Microsecond))
+		if *layoutFlag {
+			prog.Layout.WriteTo(os.Stdout)
+		}
+	}
+}
+
+// outputName returns -o, or the first input file with its extension replaced
+func outputName(ext string) string {
+	if *outFlag != "" {
+		return *outFlag
+	}
+	input := flag.Args()[0]
+	return strings.TrimSuffix(input, filepath.Ext(input)) + ext
+}
+
+// buildLibrary compiles each module source and writes them as one archive
+func buildLibrary(files []string) {
+	var sources []lux.LibrarySource
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		sources = append(sources, lux.LibrarySource{Path: file, Source: string(source)})
+	}
+	lib, err := lux.BuildLibrary(sources, lux.CompileOptions{LibPath: lux.DefaultLibPath()})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	outFile := outputName(".nuxlib")
+	os.WriteFile(outFile, lux.EncodeLibrary(lib), 0644)
+
+	fmt.Printf("Compiled: %s\n", outFile)
+	for _, mod := range lib.Modules {
+		fmt.Printf("  %-16s %d words, %d bytes\n", mod.Name, len(mod.Image.Symbols), len(mod.Image.Code))
+	}
+}
+
+// generateKey writes a signing key pair; the .pub file is what nux --trusted-key reads
+func generateKey(name string) {
+	private, public, err := vm.GenerateSigningKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(name+".key", []byte(private), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(name+".pub", []byte(public), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s.key (keep private) and %s.pub\n", name, name)
 }
@@ -2,35 +2,138 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/rmay/nuxvm/pkg/lux"
 	"github.com/rmay/nuxvm/pkg/vm"
 )
 
+var (
+	scriptFlag = flag.String("script", "", "Run the REPL commands in this file instead of reading them from the terminal, then exit")
+	echoFlag   = flag.Bool("echo", false, "With --script or piped input, print each command before its result")
+	rcFlag     = flag.String("rc", "", "Startup file to run first (default ~/.luxreplrc, skipped for scripts)")
+	noRCFlag   = flag.Bool("norc", false, "Do not run a startup file")
+)
+
 type REPL struct {
 	history     string
 	scanner     *bufio.Scanner
-	stack       []int32  // Persistent stack across commands
-	definitions []string // Track defined words
+	input       *scannerReader // ACCEPT reads the lines after the one running
+	stack       []int32        // Persistent stack across commands
+	notes       []stackNote    // Name and type hint of each stack value
+	definitions []string       // Track defined words
+	machine     *vm.VM         // VM of the last line that ran; its data memory carries over
+	// Each line is compiled together with every definition so far; the
+	// incremental build recompiles only what changed since the last line
+	build *lux.Incremental
+	// Each line runs under these limits, so a runaway loop cannot hang
+	// the session; Ctrl-C sends on interrupt
+	limits     vm.Limits
+	interrupt  chan struct{}
+	evaluating atomic.Bool
+	explain    bool // Describe each instruction as a line runs
+	// A script, or input that is not a terminal, runs without the banner
+	// and prompts, echoing each line first when echo is set
+	script bool
+	echo   bool
+	failed bool // A line of the script failed to compile or run
+	// Settings changed with :set, usually from the startup file
+	prompt  string
+	base    int      // 10 or 16, for numbers on the stack
+	imports []string // IMPORT lines at the head of the history
 }
 
-func NewREPL() *REPL {
-	return &REPL{
+// Default limits for one line
+const (
+	defaultMaxSteps  = 10_000_000
+	defaultMaxTime   = 10 * time.Second
+	defaultMaxOutput = 1 << 20
+)
+
+func NewREPL(in io.Reader) *REPL {
+	r := &REPL{
 		history:     "",
-		scanner:     bufio.NewScanner(os.Stdin),
+		scanner:     bufio.NewScanner(in),
 		stack:       []int32{},
+		notes:       []stackNote{},
 		definitions: []string{},
+		build:       newBuild(),
+		interrupt:   make(chan struct{}, 1),
+		prompt:      defaultPrompt,
+		base:        10,
 	}
+	r.input = &scannerReader{scanner: r.scanner}
+	r.limits = vm.Limits{MaxSteps: defaultMaxSteps, MaxTime: defaultMaxTime, MaxOutput: defaultMaxOutput, Interrupt: r.interrupt}
+	return r
+}
+
+// scannerReader gives a program the REPL's input one line per Read, so
+// whatever a line's ACCEPTs leave unread stays for the REPL
+type scannerReader struct {
+	scanner *bufio.Scanner
+	pending []byte
+}
+
+func (s *scannerReader) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		if !s.scanner.Scan() {
+			if err := s.scanner.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		s.pending = append(append([]byte(nil), s.scanner.Bytes()...), '\n')
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// catchInterrupts makes Ctrl-C stop the line being evaluated instead of
+// killing the REPL
+func (r *REPL) catchInterrupts() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			if !r.evaluating.Load() {
+				fmt.Print("\n(type exit to quit)\n" + r.prompt)
+				continue
+			}
+			select {
+			case r.interrupt <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// newBuild starts an incremental build for the session. Each line is
+// compiled as a whole program, so a word named MAIN must not be called
+// implicitly after every line.
+func newBuild() *lux.Incremental {
+	return lux.NewIncremental(lux.CompileOptions{NoEntry: true, LibPath: lux.DefaultLibPath()})
 }
 
 func (r *REPL) Run() {
-	r.printBanner()
+	if !r.script {
+		r.printBanner()
+	}
+	r.catchInterrupts()
 
 	for {
-		fmt.Print("lux> ")
+		if !r.script {
+			fmt.Print(r.prompt)
+		}
 
 		if !r.scanner.Scan() {
 			break
@@ -41,6 +144,9 @@ func (r *REPL) Run() {
 		if line == "" {
 			continue
 		}
+		if r.echo {
+			fmt.Println(r.prompt + line)
+		}
 
 		if r.handleCommand(line) {
 			continue
@@ -52,7 +158,7 @@ func (r *REPL) Run() {
 
 func (r *REPL) printBanner() {
 	fmt.Println("╔═══════════════════════════════╗")
-	fmt.Println("║       LUX REPL 300K           ║")
+	fmt.Printf("║       LUX REPL %-15s║\n", lux.Version)
 	fmt.Println("║  Stack-based Language REPL    ║")
 	fmt.Println("╚═══════════════════════════════╝")
 	fmt.Println()
@@ -61,9 +167,47 @@ func (r *REPL) printBanner() {
 }
 
 func (r *REPL) handleCommand(line string) bool {
+	if fields := strings.Fields(line); fields[0] == "name" || fields[0] == "unname" {
+		r.nameValue(fields)
+		return true
+	} else if fields[0] == ":limit" {
+		r.setLimit(fields[1:])
+		return true
+	} else if fields[0] == ":set" {
+		r.set(strings.TrimPrefix(line, ":set"))
+		return true
+	} else if fields[0] == ":explain" {
+		r.setExplain(fields[1:])
+		return true
+	} else if fields[0] == "forget" {
+		r.forget(fields[1:])
+		return true
+	} else if fields[0] == ":save-image" || fields[0] == ":load-image" {
+		if len(fields) != 2 {
+			fmt.Printf("Usage: %s FILE.nuximg\n", fields[0])
+			return true
+		}
+		if fields[0] == ":save-image" {
+			if err := r.saveImage(fields[1]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			} else {
+				fmt.Printf("Saved session to %s\n", fields[1])
+			}
+		} else if err := r.loadImage(fields[1]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Loaded session from %s (%d words)\n", fields[1], len(r.definitions))
+			r.printStack()
+		}
+		return true
+	}
+
 	switch line {
 	case "exit", "quit", "q":
 		fmt.Println("Goodbye!")
+		if r.failed {
+			os.Exit(1)
+		}
 		os.Exit(0)
 		return true
 
@@ -71,33 +215,33 @@ func (r *REPL) handleCommand(line string) bool {
 		r.printHelp()
 		return true
 
-	case "clear", "reset":
-		r.history = ""
-		r.definitions = []string{}
-		fmt.Println("History cleared")
+	case ":reset-words", "clear", "reset":
+		r.resetWords()
 		return true
 
-	case "clearstack", "cs":
-		r.stack = []int32{}
-		fmt.Println("Stack cleared")
+	case ":reset-stack", "clearstack", "cs":
+		r.resetStack()
+		return true
+
+	case ":reset-vm":
+		r.resetVM()
+		return true
+
+	case ":reset":
+		r.resetWords()
+		r.resetStack()
+		r.resetVM()
 		return true
 
 	case "stack", ".s":
-		if len(r.stack) == 0 {
-			fmt.Println("  Stack: []")
-		} else {
-			fmt.Printf("  \nStack: %v\n", r.stack)
-		}
+		r.printStack()
 		return true
 
 	case "drop":
 		if len(r.stack) > 0 {
 			r.stack = r.stack[:len(r.stack)-1]
-			if len(r.stack) > 0 {
-				fmt.Printf("  Stack: %v\n", r.stack)
-			} else {
-				fmt.Println("  Stack: []")
-			}
+			r.notes = r.notes[:len(r.notes)-1]
+			r.printStack()
 		} else {
 			fmt.Println("Stack is empty")
 		}
@@ -143,49 +287,180 @@ func (r *REPL) evaluate(line string) {
 		return
 	}
 
-	// Build source with current stack state + new line
-	source := r.history
-
-	// Restore stack by pushing all current values
-	for _, val := range r.stack {
-		source += fmt.Sprintf("%d ", val)
-	}
-
-	// Add the new line
-	source += line
-
 	// Compile and run
-	bytecode, err := lux.Compile(source)
+	prog, err := r.build.Compile(r.history + line)
 	if err != nil {
 		fmt.Printf("Compile error: %v\n", err)
+		r.failed = true
 		return
 	}
 
-	// Execute
-	machine := vm.NewVM(bytecode, false)
-	if err := machine.Run(); err != nil {
+	// Execute on the current stack and data memory, following each value's notes
+	machine := vm.NewVM(prog.Code, false)
+	machine.Locate = func(addr uint32) (string, int) {
+		word, _ := prog.Locate(addr) // Lines count from the start of the session, not this input
+		return word, 0
+	}
+	if r.machine != nil {
+		copy(machine.Memory()[:vm.UserMemoryOffset], r.machine.Memory())
+	}
+	for _, val := range r.stack {
+		machine.Push(val)
+	}
+	machine.Stdin = r.input
+	tracker := newNoteTracker(prog, r.notes)
+	tracker.explain, tracker.base = r.explain, r.base
+	select {
+	case <-r.interrupt: // A Ctrl-C from before this line started
+	default:
+	}
+	output := machine.CaptureOutput()
+	r.evaluating.Store(true)
+	err = tracker.run(machine, r.limits)
+	r.evaluating.Store(false)
+	printOutput(output)
+	var limit *vm.LimitError
+	if errors.As(err, &limit) {
+		switch limit.Reason {
+		case vm.LimitOutput:
+			fmt.Printf("Stopped after %d bytes of output\n", r.limits.MaxOutput)
+		case vm.LimitInterrupt:
+			fmt.Printf("Interrupted after %d instructions\n", limit.Steps)
+		case vm.LimitTime:
+			fmt.Printf("Interrupted after %v (%d instructions; use :limit to change)\n", r.limits.MaxTime, limit.Steps)
+		default:
+			fmt.Printf("Interrupted after %d instructions (use :limit to change)\n", limit.Steps)
+		}
+		r.failed = true
+		return
+	}
+	if err != nil {
 		fmt.Printf("Runtime error: %v\n", err)
+		r.failed = true
+		return
+	}
+	if machine.ExitStatus() == vm.ExitAborted {
+		fmt.Println("Aborted")
+		r.failed = true
 		return
 	}
 
 	// Save the resulting stack
 	r.stack = machine.Stack()
+	r.notes = tracker.data
+	r.machine = machine
+
+	r.printStack()
+}
 
-	// Show stack
-	if len(r.stack) > 0 {
-		fmt.Printf("  Stack: %v\n", r.stack)
+// setLimit handles `:limit` (show), `:limit 5000000` (instructions),
+// `:limit 2s` (time) and `:limit off`
+func (r *REPL) setLimit(args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: :limit [INSTRUCTIONS | DURATION | off]")
+		return
+	}
+	if len(args) == 1 {
+		if args[0] == "off" {
+			r.limits.MaxSteps, r.limits.MaxTime = 0, 0
+		} else if n, err := strconv.ParseInt(args[0], 10, 64); err == nil && n >= 0 {
+			r.limits.MaxSteps = n
+		} else if d, err := time.ParseDuration(args[0]); err == nil && d >= 0 {
+			r.limits.MaxTime = d
+		} else {
+			fmt.Printf("Error: %q is not an instruction count, a duration such as 2s, or off\n", args[0])
+			return
+		}
+	}
+	steps, limit := "none", "none"
+	if r.limits.MaxSteps > 0 {
+		steps = fmt.Sprintf("%d instructions", r.limits.MaxSteps)
+	}
+	if r.limits.MaxTime > 0 {
+		limit = r.limits.MaxTime.String()
+	}
+	fmt.Printf("Limits per line: %s, %s\n", steps, limit)
+}
+
+// setExplain handles `:explain` (toggle), `:explain on` and `:explain off`
+func (r *REPL) setExplain(args []string) {
+	switch {
+	case len(args) == 0:
+		r.explain = !r.explain
+	case len(args) == 1 && args[0] == "on":
+		r.explain = true
+	case len(args) == 1 && args[0] == "off":
+		r.explain = false
+	default:
+		fmt.Println("Usage: :explain [on|off]")
+		return
+	}
+	if r.explain {
+		fmt.Println("Explaining each instruction")
 	} else {
-		fmt.Println("  Stack: []")
+		fmt.Println("Explanations off")
 	}
 }
 
+// printOutput shows what a line printed, apart from the stack and ending
+// in a newline; error output is marked as such
+func printOutput(output *vm.Capture) {
+	if text := output.Stdout(); text != "" {
+		fmt.Print(text)
+		if !strings.HasSuffix(text, "\n") {
+			fmt.Println()
+		}
+	}
+	if text := output.Stderr(); text != "" {
+		for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			fmt.Println("  stderr: " + line)
+		}
+	}
+}
+
+// printStack shows the stack with its names and quotation addresses
+func (r *REPL) printStack() {
+	fmt.Printf("  Stack: %s\n", formatStack(r.stack, r.notes, r.base))
+}
+
+// nameValue handles `name top as counter`, `name 1 as limit` and `unname top`.
+// The name follows the value through DUP, SWAP, >R and the like.
+func (r *REPL) nameValue(fields []string) {
+	if fields[0] == "name" && (len(fields) != 4 || fields[2] != "as") ||
+		fields[0] == "unname" && len(fields) != 2 {
+		fmt.Println("Usage: name top as NAME, name DEPTH as NAME, unname top")
+		return
+	}
+	i, err := stackPosition(fields[1], len(r.stack))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if fields[0] == "name" {
+		r.notes[i].name = fields[3]
+	} else {
+		r.notes[i].name = ""
+	}
+	r.printStack()
+}
+
 func (r *REPL) printHelp() {
 	fmt.Println("\n═══ LUX REPL Commands ═══")
 	fmt.Println("  help, ?          - Show this help")
 	fmt.Println("  exit, quit, q    - Exit REPL")
-	fmt.Println("  clear, reset     - Clear word definitions")
-	fmt.Println("  clearstack, cs   - Clear the stack")
+	fmt.Println("  forget NAME      - Forget one word, unless another word uses it")
+	fmt.Println("  :reset-words     - Forget every word (also clear, reset)")
+	fmt.Println("  :reset-stack     - Clear the stack (also clearstack, cs)")
+	fmt.Println("  :reset-vm        - Give the next line fresh VM memory")
+	fmt.Println("  :reset           - All three: start the session over")
 	fmt.Println("  stack, .s        - Show current stack")
+	fmt.Println("  name top as NAME - Name a stack value (or name DEPTH as NAME, 0 is the top)")
+	fmt.Println("  unname top       - Remove a value's name")
+	fmt.Println("  :limit [N|2s|off]- Show or set the instruction and time limits per line")
+	fmt.Println("  :explain [on|off]- Describe each instruction in English as lines run")
+	fmt.Println("  :set [NAME VALUE]- Show settings, or set prompt, base, steps, time or import")
+	fmt.Println("  :save-image FILE - Save the session (words, stack, memory) to a .nuximg file")
+	fmt.Println("  :load-image FILE - Resume a saved session")
 	fmt.Println("  drop             - Drop top stack value")
 	fmt.Println("  words            - List defined words")
 	fmt.Println("  history          - Show definition history")
@@ -219,6 +494,40 @@ func (r *REPL) printHelp() {
 }
 
 func main() {
-	repl := NewREPL()
+	flag.Parse()
+	in := io.Reader(os.Stdin)
+	script := !isTerminal(os.Stdin)
+	if *scriptFlag != "" {
+		file, err := os.Open(*scriptFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in, script = file, true
+	}
+	repl := NewREPL(in)
+	repl.script, repl.echo = script, *echoFlag && script
+	if rc := *rcFlag; !*noRCFlag && (rc != "" || !script) {
+		required := rc != ""
+		if !required {
+			rc = defaultStartupPath()
+		}
+		if rc != "" {
+			if err := repl.loadStartup(rc, required); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
 	repl.Run()
+	if repl.failed {
+		os.Exit(1)
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// stackNote is what the REPL knows about a stack value besides the number
+type stackNote struct {
+	name string // Given with `name ... as`
+	quot bool   // Pushed as the address of a quotation
+}
+
+// noteTracker follows stack values through a run, so that names and type
+// hints stay with a value as it is shuffled
+type noteTracker struct {
+	quots map[int32]bool // Start address of every quotation in the program
+	data  []stackNote    // One note per data stack value
+	ret   []stackNote    // One note per return stack value
+
+	explain bool        // Describe each instruction as it runs
+	base    int         // Of the numbers in explanations, 10 or 16
+	symbols []vm.Symbol // Names call targets in explanations
+}
+
+func newNoteTracker(prog *lux.Program, notes []stackNote) *noteTracker {
+	t := &noteTracker{quots: make(map[int32]bool), data: append([]stackNote{}, notes...), symbols: prog.Symbols}
+	for _, r := range prog.Layout.Regions {
+		if r.Kind == lux.RegionQuotation {
+			t.quots[r.Start] = true
+		}
+	}
+	return t
+}
+
+// run steps machine until it halts or reaches a limit, moving the notes as
+// each instruction moves values
+func (t *noteTracker) run(machine *vm.VM, limits vm.Limits) error {
+	meter := limits.Start()
+	defer meter.Stop()
+	for machine.Running() {
+		if err := meter.TickVM(machine); err != nil {
+			return err
+		}
+		text := ""
+		if t.explain {
+			text = machine.Explain(t.symbols)
+		}
+		if err := t.step(machine); err != nil {
+			if t.explain {
+				fmt.Println("  " + text)
+			}
+			return fmt.Errorf("error at PC=%d: %v", machine.PC(), err)
+		}
+		if t.explain {
+			fmt.Printf("  %s → stack is now %s\n", text, formatStack(machine.Stack(), t.data, t.base))
+		}
+	}
+	return nil
+}
+
+func (t *noteTracker) step(machine *vm.VM) error {
+	pc := machine.PC()
+	mem := machine.Memory()
+	var op byte
+	if int(pc) < len(mem) {
+		op = mem[pc]
+	}
+	before := machine.Stack()
+	if _, err := machine.Step(); err != nil {
+		return err
+	}
+	after := machine.Stack()
+
+	n := len(t.data)
+	switch {
+	case n != len(before):
+		t.follow(before, after) // Out of step; fall back to matching values
+	case op == vm.OpDup:
+		t.data = append(t.data, t.data[n-1])
+	case op == vm.OpRoll:
+		t.data = append(t.data, t.data[n-2])
+	case op == vm.OpSwap:
+		t.data[n-2], t.data[n-1] = t.data[n-1], t.data[n-2]
+	case op == vm.OpRot:
+		t.data[n-3], t.data[n-2], t.data[n-1] = t.data[n-2], t.data[n-1], t.data[n-3]
+	case op == vm.OpPop:
+		t.data = t.data[:n-1]
+	case op == vm.OpToR:
+		t.ret = append(t.ret, t.data[n-1])
+		t.data = t.data[:n-1]
+	case op == vm.OpFromR && len(t.ret) > 0:
+		t.data = append(t.data, t.ret[len(t.ret)-1])
+		t.ret = t.ret[:len(t.ret)-1]
+	case op == vm.OpRFetch && len(t.ret) > 0:
+		t.data = append(t.data, t.ret[len(t.ret)-1])
+	default:
+		t.follow(before, after)
+		if op == vm.OpPush && len(after) == n+1 && int(pc)+5 <= len(mem) {
+			t.data[n].quot = t.quots[int32(binary.BigEndian.Uint32(mem[pc+1:]))]
+		}
+	}
+
+	// CALL and RET move return addresses, which carry no notes
+	depth := len(machine.ReturnStack())
+	for len(t.ret) < depth {
+		t.ret = append(t.ret, stackNote{})
+	}
+	t.ret = t.ret[:depth]
+	return nil
+}
+
+// follow keeps the notes of the values an instruction left in place, and
+// gives every value it produced an empty note
+func (t *noteTracker) follow(before, after []int32) {
+	keep := 0
+	for keep < len(before) && keep < len(after) && keep < len(t.data) && before[keep] == after[keep] {
+		keep++
+	}
+	t.data = t.data[:keep]
+	for len(t.data) < len(after) {
+		t.data = append(t.data, stackNote{})
+	}
+}
+
+// formatStack shows the stack bottom first, with each value's name and
+// quotation addresses in brackets: [5 counter=3 body=[0x4020]]. In base 16
+// numbers are shown as their 32 bits in hex.
+func formatStack(stack []int32, notes []stackNote, base int) string {
+	parts := make([]string, len(stack))
+	for i, v := range stack {
+		s := strconv.Itoa(int(v))
+		if base == 16 {
+			s = fmt.Sprintf("0x%X", uint32(v))
+		}
+		if i < len(notes) {
+			if notes[i].quot {
+				s = fmt.Sprintf("[0x%X]", v)
+			}
+			if notes[i].name != "" {
+				s = notes[i].name + "=" + s
+			}
+		}
+		parts[i] = s
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// stackPosition turns "top" or a depth from the top (0 is the top) into
+// an index into a stack of n values
+func stackPosition(pos string, n int) (int, error) {
+	depth := 0
+	if pos != "top" {
+		var err error
+		if depth, err = strconv.Atoi(pos); err != nil || depth < 0 {
+			return 0, fmt.Errorf("expected top or a depth from the top, got %q", pos)
+		}
+	}
+	if depth >= n {
+		return 0, fmt.Errorf("stack has only %d values", n)
+	}
+	return n - 1 - depth, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+)
+
+// resetStack empties the stack and its names
+func (r *REPL) resetStack() {
+	r.stack = []int32{}
+	r.notes = []stackNote{}
+	fmt.Println("Stack cleared")
+}
+
+// resetWords forgets every definition, keeping the stack, memory and the
+// modules imported with :set
+func (r *REPL) resetWords() {
+	r.history = strings.Join(r.imports, "")
+	r.definitions = []string{}
+	r.build = newBuild()
+	fmt.Println("Words cleared")
+}
+
+// resetVM gives the next line a new VM's memory, keeping the stack and
+// the words
+func (r *REPL) resetVM() {
+	r.machine = nil
+	fmt.Println("VM memory reset")
+}
+
+// forget handles `forget NAME`: it removes every definition of the word
+// from the history, unless a word still defined uses it
+func (r *REPL) forget(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: forget NAME")
+		return
+	}
+	history, found, err := withoutWord(r.history, args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if !found {
+		fmt.Printf("No word '%s' defined\n", args[0])
+		return
+	}
+	if history != "" {
+		if _, err := newBuild().Compile(history); err != nil {
+			fmt.Printf("Cannot forget '%s', another word uses it: %v\n", args[0], err)
+			return
+		}
+	}
+	r.history = history
+	r.definitions = slices.DeleteFunc(r.definitions, func(word string) bool { return strings.EqualFold(word, args[0]) })
+	fmt.Printf("Forgot word '%s'\n", args[0])
+}
+
+// withoutWord returns history with each @NAME ... ; definition of name cut
+// out, and whether there was one. Lines left blank are dropped, and
+// trailing spaces with them.
+func withoutWord(history, name string) (string, bool, error) {
+	stream := lux.NewTokenStream(history)
+	var cut []lux.Span
+	var def *lux.Span // The definition being read
+	depth, naming := 0, false
+	for {
+		lx, err := stream.Next()
+		if err != nil {
+			return "", false, err
+		}
+		if lx.Type == lux.TokenEOF {
+			break
+		}
+		switch {
+		case lx.Type == lux.TokenAtSign:
+			def, naming, depth = &lux.Span{Start: lx.Span.Start}, true, 0
+		case naming:
+			naming = false
+			if !strings.EqualFold(lx.Value, name) {
+				def = nil
+			}
+		case def == nil:
+		case lx.Type == lux.TokenLBracket:
+			depth++
+		case lx.Type == lux.TokenRBracket:
+			depth--
+		case lx.Type == lux.TokenSemicolon && depth == 0:
+			def.End = lx.Span.End
+			cut = append(cut, *def)
+			def = nil
+		}
+	}
+	if len(cut) == 0 {
+		return history, false, nil
+	}
+	var out strings.Builder
+	at := 0
+	for _, span := range cut {
+		out.WriteString(history[at:span.Start.Offset])
+		at = span.End.Offset
+	}
+	out.WriteString(history[at:])
+	var lines []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line = strings.TrimRight(line, " \t"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return "", true, nil
+	}
+	return strings.Join(lines, "\n") + "\n", true, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPrompt is shown before each line until `:set prompt` changes it
+const defaultPrompt = "lux> "
+
+// startupFile is read from the home directory when the REPL starts
+const startupFile = ".luxreplrc"
+
+// defaultStartupPath returns ~/.luxreplrc, or "" if there is no home
+// directory
+func defaultStartupPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, startupFile)
+}
+
+// set handles `:set` (show every setting) and `:set NAME VALUE`. rest is
+// the line after :set, so a prompt keeps its inner spaces.
+func (r *REPL) set(rest string) {
+	name, value, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	value = strings.TrimSpace(value)
+	if name == "" {
+		r.printSettings()
+		return
+	}
+	if value == "" {
+		r.setFailed("Usage: :set NAME VALUE (prompt, base, steps, time or import)")
+		return
+	}
+	switch name {
+	case "prompt":
+		if strings.HasPrefix(value, `"`) {
+			text, err := strconv.Unquote(value)
+			if err != nil {
+				r.setFailed(fmt.Sprintf("Error: bad quoted prompt %s", value))
+				return
+			}
+			r.prompt = text
+		} else {
+			r.prompt = value + " "
+		}
+	case "base":
+		switch value {
+		case "10", "dec":
+			r.base = 10
+		case "16", "hex":
+			r.base = 16
+		default:
+			r.setFailed(fmt.Sprintf("Error: base must be 10 or 16, got %q", value))
+			return
+		}
+	case "steps":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if value == "off" {
+			n, err = 0, nil
+		}
+		if err != nil || n < 0 {
+			r.setFailed(fmt.Sprintf("Error: steps must be an instruction count or off, got %q", value))
+			return
+		}
+		r.limits.MaxSteps = n
+	case "time":
+		d, err := time.ParseDuration(value)
+		if value == "off" {
+			d, err = 0, nil
+		}
+		if err != nil || d < 0 {
+			r.setFailed(fmt.Sprintf("Error: time must be a duration such as 2s, or off, got %q", value))
+			return
+		}
+		r.limits.MaxTime = d
+	case "import":
+		if err := r.addImport(value); err != nil {
+			r.setFailed(fmt.Sprintf("Error: %v", err))
+			return
+		}
+	default:
+		r.setFailed(fmt.Sprintf("Error: no setting %q (prompt, base, steps, time or import)", name))
+		return
+	}
+	fmt.Printf("Set %s\n", name)
+}
+
+// setFailed reports a bad :set, which fails a script or startup file as a
+// line that does not compile does
+func (r *REPL) setFailed(message string) {
+	fmt.Println(message)
+	r.failed = true
+}
+
+// addImport makes module, written as after IMPORT (MATH or MATH AS M),
+// available to every line. The IMPORT heads the history, so it is saved in
+// images and outlives :reset-words.
+func (r *REPL) addImport(module string) error {
+	fields := strings.Fields(module)
+	if len(fields) != 1 && (len(fields) != 3 || !strings.EqualFold(fields[1], "AS")) {
+		return fmt.Errorf("expected MODULE or MODULE AS ALIAS, got %q", module)
+	}
+	line := "IMPORT " + strings.Join(fields, " ") + "\n"
+	if _, err := newBuild().Compile(line + r.history); err != nil {
+		return err
+	}
+	r.history = line + r.history
+	r.imports = append(r.imports, line)
+	return nil
+}
+
+// printSettings shows each setting as the :set line that would restore it
+func (r *REPL) printSettings() {
+	steps, limit := "off", "off"
+	if r.limits.MaxSteps > 0 {
+		steps = strconv.FormatInt(r.limits.MaxSteps, 10)
+	}
+	if r.limits.MaxTime > 0 {
+		limit = r.limits.MaxTime.String()
+	}
+	fmt.Printf(":set prompt %q\n", r.prompt)
+	fmt.Printf(":set base %d\n", r.base)
+	fmt.Printf(":set steps %s\n", steps)
+	fmt.Printf(":set time %s\n", limit)
+	for _, line := range r.imports {
+		fmt.Printf(":set import %s\n", strings.TrimPrefix(strings.TrimSpace(line), "IMPORT "))
+	}
+}
+
+// loadStartup runs the lines of a startup file as if typed, without
+// showing what they print. A line that fails is reported on stderr with
+// what it printed, and the rest still run. A missing file is not an error
+// unless required.
+func (r *REPL) loadStartup(path string, required bool) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Each line's output goes to a scratch file, read back if it failed
+	sink, err := os.CreateTemp("", "luxreplrc")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sink.Name())
+	defer sink.Close()
+	stdout := os.Stdout
+	os.Stdout = sink
+	defer func() { os.Stdout = stdout }()
+
+	failed := r.failed
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		sink.Truncate(0)
+		sink.Seek(0, io.SeekStart)
+		r.failed = false
+		if !r.handleCommand(line) {
+			r.evaluate(line)
+		}
+		if r.failed {
+			sink.Seek(0, io.SeekStart)
+			printed, _ := io.ReadAll(sink)
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n%s", path, n, line, printed)
+		}
+	}
+	r.failed = failed
+	return scanner.Err()
+}
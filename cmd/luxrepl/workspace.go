@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// workspaceMagic marks a saved REPL session (.nuximg)
+const workspaceMagic = "NUXW"
+
+// workspaceVersion is the layout written by saveImage
+const workspaceVersion = 1
+
+// saveImage writes the whole session: the definitions, the names on the
+// stack, and a snapshot of the VM with its memory and stack.
+//
+//	magic "NUXW" | version uint16 | history (uint32 length + bytes)
+//	word count uint16, then each word (uint16 length + bytes)
+//	note count uint32, then each note: name (uint16 length + bytes) | quotation uint8
+//	VM snapshot (uint32 length + vm.EncodeSnapshot bytes)
+func (r *REPL) saveImage(file string) error {
+	machine := r.machine
+	if machine == nil {
+		machine = vm.NewVM(nil)
+		for _, val := range r.stack {
+			machine.Push(val)
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString(workspaceMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(workspaceVersion))
+	binary.Write(&buf, binary.BigEndian, uint32(len(r.history)))
+	buf.WriteString(r.history)
+	binary.Write(&buf, binary.BigEndian, uint16(len(r.definitions)))
+	for _, word := range r.definitions {
+		writeString(&buf, word)
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(r.notes)))
+	for _, note := range r.notes {
+		writeString(&buf, note.name)
+		quot := byte(0)
+		if note.quot {
+			quot = 1
+		}
+		buf.WriteByte(quot)
+	}
+	snapshot := vm.EncodeSnapshot(machine.Snapshot())
+	binary.Write(&buf, binary.BigEndian, uint32(len(snapshot)))
+	buf.Write(snapshot)
+	return os.WriteFile(file, buf.Bytes(), 0644)
+}
+
+// loadImage replaces the session with one written by saveImage
+func (r *REPL) loadImage(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(workspaceMagic) || string(data[:len(workspaceMagic)]) != workspaceMagic {
+		return fmt.Errorf("%s is not a REPL image", file)
+	}
+	rd := bytes.NewReader(data[len(workspaceMagic):])
+	var version uint16
+	if err := binary.Read(rd, binary.BigEndian, &version); err != nil {
+		return fmt.Errorf("%s: image truncated", file)
+	}
+	if version > workspaceVersion {
+		return fmt.Errorf("%s: image format version %d is newer than supported version %d", file, version, workspaceVersion)
+	}
+	history, err := readChunk(rd, 4)
+	if err != nil {
+		return fmt.Errorf("%s: history: %v", file, err)
+	}
+	var count uint16
+	if err := binary.Read(rd, binary.BigEndian, &count); err != nil {
+		return fmt.Errorf("%s: image truncated", file)
+	}
+	definitions := make([]string, count)
+	for i := range definitions {
+		word, err := readChunk(rd, 2)
+		if err != nil {
+			return fmt.Errorf("%s: words: %v", file, err)
+		}
+		definitions[i] = string(word)
+	}
+	var noteCount uint32
+	if err := binary.Read(rd, binary.BigEndian, &noteCount); err != nil || int64(noteCount) > int64(rd.Len()) {
+		return fmt.Errorf("%s: image truncated", file)
+	}
+	notes := make([]stackNote, noteCount)
+	for i := range notes {
+		name, err := readChunk(rd, 2)
+		if err != nil {
+			return fmt.Errorf("%s: stack names: %v", file, err)
+		}
+		quot, err := rd.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%s: image truncated", file)
+		}
+		notes[i] = stackNote{name: string(name), quot: quot != 0}
+	}
+	snapData, err := readChunk(rd, 4)
+	if err != nil {
+		return fmt.Errorf("%s: VM snapshot: %v", file, err)
+	}
+	snapshot, err := vm.ParseSnapshot(snapData)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	if len(notes) != len(snapshot.Stack) {
+		return fmt.Errorf("%s: %d stack names for %d stack values", file, len(notes), len(snapshot.Stack))
+	}
+
+	// Check the definitions still compile before replacing anything
+	build := newBuild()
+	if _, err := build.Compile(string(history)); err != nil {
+		return fmt.Errorf("%s: definitions no longer compile: %v", file, err)
+	}
+	machine := vm.NewVM(nil)
+	machine.Restore(snapshot)
+	r.history = string(history)
+	r.definitions = definitions
+	r.notes = notes
+	r.stack = snapshot.Stack
+	r.machine = machine
+	r.build = build
+	return nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+// readChunk reads a byte string with a 2 or 4 byte length prefix
+func readChunk(r *bytes.Reader, lengthSize int) ([]byte, error) {
+	var n uint32
+	if lengthSize == 2 {
+		var n16 uint16
+		if err := binary.Read(r, binary.BigEndian, &n16); err != nil {
+			return nil, fmt.Errorf("truncated")
+		}
+		n = uint32(n16)
+	} else if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("truncated")
+	}
+	if int64(n) > int64(r.Len()) {
+		return nil, fmt.Errorf("length %d exceeds file size", n)
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b, nil
+}
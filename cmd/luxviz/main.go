@@ -0,0 +1,95 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+var (
+	addrFlag     = flag.String("addr", "localhost:8080", "Address to serve the visualizer on")
+	maxStepsFlag = flag.Int64("max-steps", 100_000, "Stop the trace after this many instructions")
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: luxviz [options] <program.lux|program.nux>")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	file := flag.Arg(0)
+	image, err := lux.LoadImage(file, lux.CompileOptions{LibPath: lux.DefaultLibPath()})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(indexHTML)
+	})
+	http.HandleFunc("/program", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"file":    filepath.Base(file),
+			"size":    len(image.Program()),
+			"symbols": image.Symbols,
+		})
+	})
+	http.HandleFunc("/trace", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := writeTrace(w, image); err != nil {
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		}
+	})
+
+	fmt.Printf("Visualizing %s at http://%s\n", file, *addrFlag)
+	if err := http.ListenAndServe(*addrFlag, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// writeTrace runs the program from the start and streams a JSON frame for
+// every instruction. Output goes into the frames rather than to stdout.
+func writeTrace(w http.ResponseWriter, image *vm.Image) error {
+	machine, err := vm.NewVMForImage(image)
+	if err != nil {
+		return err
+	}
+	machine.OutputHandler = func(value, format int32) {}
+	tracer := vm.NewTracer(w)
+	tracer.Level = vm.TraceJSON
+	tracer.Symbols = image.Symbols
+	meter := vm.Limits{MaxSteps: *maxStepsFlag}.Start()
+	for machine.Running() {
+		if err := meter.Tick(); err != nil {
+			var limit *vm.LimitError
+			if errors.As(err, &limit) {
+				return fmt.Errorf("stopped after %d instructions (raise -max-steps to see more)", limit.Steps)
+			}
+			return err
+		}
+		if _, err := tracer.Step(machine); err != nil {
+			return fmt.Errorf("error at PC=%d: %v", machine.PC(), err)
+		}
+	}
+	return nil
+}
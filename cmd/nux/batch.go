@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// batchResult is how one program of a batch ran
+type batchResult struct {
+	File   string `json:"file"`
+	Passed bool   `json:"passed"`
+	Exit   int    `json:"exit"` // The status nux would have exited with
+	Error  string `json:"error,omitempty"`
+	Steps  int64  `json:"steps"`
+	TimeNS int64  `json:"time_ns"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// batch handles `nux batch [options] DIR...`: it runs every program under
+// the directories whose name matches the pattern, each under limits and
+// with no input, and reports which halted cleanly
+func batch(args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	pattern := flags.String("pattern", "*.nux", "Run the files whose name matches this pattern")
+	maxSteps := flags.Int64("max-steps", 10_000_000, "Stop each program after this many instructions (0 = no limit)")
+	timeout := flags.Duration("timeout", 10*time.Second, "Stop each program after this much time (0 = no limit)")
+	maxOutput := flags.Int64("max-output", 1<<20, "Stop each program once it has printed this many bytes (0 = no limit)")
+	junit := flags.String("junit", "", "Write a JUnit XML report to this file")
+	jsonOut := flags.String("json", "", "Write a JSON report to this file (- prints it to stdout instead of the table)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nux batch [options] <dir>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if _, err := filepath.Match(*pattern, ""); err != nil {
+		return fmt.Errorf("--pattern %q: %v", *pattern, err)
+	}
+
+	files, err := findPrograms(flags.Args(), *pattern)
+	if err != nil {
+		return err
+	}
+
+	limits := vm.Limits{MaxSteps: *maxSteps, MaxTime: *timeout, MaxOutput: *maxOutput}
+	results := make([]batchResult, len(files))
+	for i, file := range files {
+		results[i], _ = runBatchProgram(file, nil, limits)
+	}
+
+	if *jsonOut != "-" {
+		writeBatchTable(os.Stdout, results)
+	}
+	if *jsonOut != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeReport(*jsonOut, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	if *junit != "" {
+		if err := writeReport(*junit, junitReport(results)); err != nil {
+			return err
+		}
+	}
+	failed := 0
+	for _, r := range results {
+		if !r.Passed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d programs failed", failed, len(results))
+	}
+	return nil
+}
+
+// findPrograms returns, sorted, the files under the directories whose name
+// matches pattern, which has been checked
+func findPrograms(dirs []string, pattern string) ([]string, error) {
+	var files []string
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if match, _ := filepath.Match(pattern, d.Name()); match && !d.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files match %s", pattern)
+	}
+	return files, nil
+}
+
+// runBatchProgram runs one program as nux would on input, capturing its
+// output, and returns the machine it ran on, or nil if it did not load. It
+// passes when it halts with exit status 0.
+func runBatchProgram(file string, input []byte, limits vm.Limits) (result batchResult, machine *vm.VM) {
+	result = batchResult{File: file, Exit: 1}
+	start := time.Now()
+	defer func() { result.TimeNS = time.Since(start).Nanoseconds() }()
+	image, err := readImage(file)
+	if err == nil {
+		err = image.CheckISA()
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	machine, err = vm.NewVMForImage(image)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	machine.Stdin = bytes.NewReader(input)
+	output := machine.CaptureOutput()
+	meter := limits.Start()
+	err = machine.RunMetered(meter)
+	result.Steps = meter.Steps()
+	result.Stdout, result.Stderr = output.Stdout(), output.Stderr()
+	var limit *vm.LimitError
+	switch {
+	case errors.As(err, &limit):
+		result.Exit, result.Error = exitLimit, limit.Error()
+	case err != nil:
+		result.Error = err.Error()
+	default:
+		result.Exit = machine.ExitStatus()
+		if result.Exit == vm.ExitAborted {
+			result.Error = "aborted"
+		}
+	}
+	result.Passed = result.Exit == 0
+	return result, machine
+}
+
+func writeBatchTable(w io.Writer, results []batchResult) {
+	width := len("PROGRAM")
+	for _, r := range results {
+		width = max(width, len(r.File))
+	}
+	fmt.Fprintf(w, "%-*s  %-6s %4s %12s %10s  %s\n", width, "PROGRAM", "RESULT", "EXIT", "STEPS", "TIME", "ERROR")
+	passed := 0
+	for _, r := range results {
+		verdict := "FAIL"
+		if r.Passed {
+			verdict = "pass"
+			passed++
+		}
+		elapsed := time.Duration(r.TimeNS).Round(time.Microsecond)
+		message, _, _ := strings.Cut(r.Error, "\n") // A stack diagram stays in the JSON
+		line := fmt.Sprintf("%-*s  %-6s %4d %12d %10v  %s", width, r.File, verdict, r.Exit, r.Steps, elapsed, message)
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+	fmt.Fprintf(w, "\n%d programs: %d passed, %d failed\n", len(results), passed, len(results)-passed)
+}
+
+// junitReport renders results as a JUnit XML test suite, one test case
+// per program
+func junitReport(results []batchResult) []byte {
+	type failure struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+	type testCase struct {
+		Name      string   `xml:"name,attr"`
+		ClassName string   `xml:"classname,attr"`
+		Time      string   `xml:"time,attr"`
+		Failure   *failure `xml:"failure,omitempty"`
+		SystemOut string   `xml:"system-out,omitempty"`
+		SystemErr string   `xml:"system-err,omitempty"`
+	}
+	type testSuite struct {
+		XMLName  xml.Name   `xml:"testsuite"`
+		Name     string     `xml:"name,attr"`
+		Tests    int        `xml:"tests,attr"`
+		Failures int        `xml:"failures,attr"`
+		Time     string     `xml:"time,attr"`
+		Cases    []testCase `xml:"testcase"`
+	}
+	suite := testSuite{Name: "nux batch", Tests: len(results)}
+	var total int64
+	for _, r := range results {
+		c := testCase{
+			Name:      r.File,
+			ClassName: filepath.Dir(r.File),
+			Time:      fmt.Sprintf("%.6f", time.Duration(r.TimeNS).Seconds()),
+			SystemOut: r.Stdout,
+			SystemErr: r.Stderr,
+		}
+		if !r.Passed {
+			suite.Failures++
+			c.Failure = &failure{Message: fmt.Sprintf("exit status %d", r.Exit), Text: r.Error}
+		}
+		total += r.TimeNS
+		suite.Cases = append(suite.Cases, c)
+	}
+	suite.Time = fmt.Sprintf("%.6f", time.Duration(total).Seconds())
+	data, _ := xml.MarshalIndent(suite, "", "  ")
+	return append([]byte(xml.Header), append(data, '\n')...)
+}
+
+// writeReport writes data to the named file, or to stdout when it is -
+func writeReport(name string, data []byte) error {
+	if name == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
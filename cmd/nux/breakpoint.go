@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// breakpoint stops a continuing debugger when PC reaches addr and its
+// condition, if it has one, is not 0
+type breakpoint struct {
+	name string // As the user wrote it
+	addr uint32
+	cond string
+	eval evaluator
+}
+
+// String names the breakpoint and its address, or its address alone when
+// that is how it was set
+func (b *breakpoint) String() string {
+	if _, err := strconv.ParseUint(b.name, 0, 32); err == nil {
+		return fmt.Sprintf("0x%04X", b.addr)
+	}
+	return fmt.Sprintf("%s at 0x%04X", b.name, b.addr)
+}
+
+// evaluator computes an expression over the VM's state
+type evaluator func(machine *vm.VM) (int32, error)
+
+// setBreak handles the debugger's break command: with no arguments it lists
+// the breakpoints, and otherwise sets one on ADDR, with the condition after
+// "if", replacing any already there
+func setBreak(image *vm.Image, breaks []*breakpoint, args []string) ([]*breakpoint, error) {
+	if len(args) == 0 {
+		if len(breaks) == 0 {
+			fmt.Println("No breakpoints")
+		}
+		for _, b := range breaks {
+			fmt.Printf("%s%s\n", b, ifCondition(b.cond))
+		}
+		return breaks, nil
+	}
+	if len(args) == 2 || len(args) > 1 && args[1] != "if" {
+		return breaks, fmt.Errorf("usage: break [ADDR|NAME [if CONDITION]]")
+	}
+	addr, _, err := debugAddress(image, args[0])
+	if err != nil {
+		return breaks, err
+	}
+	b := &breakpoint{name: args[0], addr: addr}
+	if len(args) > 2 {
+		b.cond = strings.Join(args[2:], " ")
+		if b.eval, err = parseCondition(image, b.cond); err != nil {
+			return breaks, fmt.Errorf("bad condition %q: %v", b.cond, err)
+		}
+	}
+	breaks = slices.DeleteFunc(breaks, func(old *breakpoint) bool { return old.addr == addr })
+	fmt.Printf("Breakpoint on %s%s\n", b, ifCondition(b.cond))
+	return append(breaks, b), nil
+}
+
+// deleteBreak handles the debugger's delete command, which removes the
+// breakpoint on ADDR or NAME, or with no argument all of them
+func deleteBreak(image *vm.Image, breaks []*breakpoint, args []string) ([]*breakpoint, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	addr, _, err := debugAddress(image, args[0])
+	if err != nil {
+		return breaks, err
+	}
+	kept := slices.DeleteFunc(breaks, func(b *breakpoint) bool { return b.addr == addr })
+	if len(kept) == len(breaks) {
+		fmt.Printf("No breakpoint on %s\n", args[0])
+	}
+	return kept, nil
+}
+
+// checkBreaks reports whether a breakpoint stops the VM where it is. A
+// condition that cannot be evaluated, such as top with the stack empty,
+// stops it too, with the reason.
+func checkBreaks(machine *vm.VM, image *vm.Image, breaks []*breakpoint) bool {
+	pc := machine.PC()
+	for _, b := range breaks {
+		if b.addr != pc {
+			continue
+		}
+		if b.eval != nil {
+			v, err := b.eval(machine)
+			if err != nil {
+				fmt.Printf("Breakpoint on %s: cannot evaluate %q: %v\n", b, b.cond, err)
+				return true
+			}
+			if v == 0 {
+				continue
+			}
+		}
+		fmt.Printf("Breakpoint on %s%s%s\n", b, wordIn(image, pc), ifCondition(b.cond))
+		return true
+	}
+	return false
+}
+
+func ifCondition(cond string) string {
+	if cond == "" {
+		return ""
+	}
+	return " if " + cond
+}
+
+// parseCondition compiles a breakpoint condition: numbers, the names of
+// DATA tables and words, which stand for their addresses, and
+//
+//	pc depth rdepth     the PC and the depths of the data and return stacks
+//	top second          the values on top of the data stack and under it
+//	cell(ADDR)          the cell stored at ADDR
+//
+// combined with + - * / % == != < <= > >= ! && || and parentheses, with
+// Go's precedence. Comparisons give 1 or 0, and && and || stop early, so
+// "depth > 0 && top == 0" is safe on an empty stack.
+func parseCondition(image *vm.Image, text string) (evaluator, error) {
+	p := &condParser{image: image, tokens: condTokens(text)}
+	eval, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return eval, nil
+}
+
+// condOps are the binary operators by precedence, loosest first
+var condOps = [][]string{{"||"}, {"&&"}, {"==", "!=", "<", "<=", ">", ">="}, {"+", "-"}, {"*", "/", "%"}}
+
+type condParser struct {
+	image  *vm.Image
+	tokens []string
+	pos    int
+}
+
+// condTokens splits a condition into numbers, names, parentheses and
+// operators
+func condTokens(text string) []string {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case nameChar(c):
+			j := i
+			for j < len(text) && nameChar(rune(text[j])) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		default:
+			n := 1
+			if i+1 < len(text) && slices.Contains([]string{"==", "!=", "<=", ">=", "&&", "||"}, text[i:i+2]) {
+				n = 2
+			}
+			tokens = append(tokens, text[i:i+n])
+			i += n
+		}
+	}
+	return tokens
+}
+
+// nameChar reports whether c belongs to a number or name, gfx::draw's
+// included
+func nameChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == ':'
+}
+
+func (p *condParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// binary parses operators of level and tighter
+func (p *condParser) binary(level int) (evaluator, error) {
+	if level == len(condOps) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for slices.Contains(condOps[level], p.peek()) {
+		op := p.tokens[p.pos]
+		p.pos++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = condOp(op, left, right)
+	}
+	return left, nil
+}
+
+func (p *condParser) unary() (evaluator, error) {
+	switch p.peek() {
+	case "-", "!":
+		op := p.tokens[p.pos]
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(machine *vm.VM) (int32, error) {
+			v, err := operand(machine)
+			if op == "-" {
+				return -v, err
+			}
+			return truth(v == 0), err
+		}, nil
+	case "(":
+		p.pos++
+		inner, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return inner, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	}
+	return p.operand()
+}
+
+// operand parses a number, a name or cell(ADDR)
+func (p *condParser) operand() (evaluator, error) {
+	token := p.tokens[p.pos]
+	p.pos++
+	if n, err := strconv.ParseInt(token, 0, 64); err == nil {
+		v := int32(n)
+		return func(*vm.VM) (int32, error) { return v, nil }, nil
+	}
+	switch strings.ToLower(token) {
+	case "pc":
+		return func(machine *vm.VM) (int32, error) { return int32(machine.PC()), nil }, nil
+	case "depth":
+		return func(machine *vm.VM) (int32, error) { return int32(len(machine.Stack())), nil }, nil
+	case "rdepth":
+		return func(machine *vm.VM) (int32, error) { return int32(len(machine.ReturnStack())), nil }, nil
+	case "top", "second":
+		below := 0
+		if strings.EqualFold(token, "second") {
+			below = 1
+		}
+		return func(machine *vm.VM) (int32, error) {
+			stack := machine.Stack()
+			if len(stack) <= below {
+				return 0, fmt.Errorf("%s of a stack %d deep", strings.ToLower(token), len(stack))
+			}
+			return stack[len(stack)-1-below], nil
+		}, nil
+	case "cell":
+		if p.peek() != "(" {
+			return nil, fmt.Errorf("cell needs an address in parentheses")
+		}
+		addr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(machine *vm.VM) (int32, error) {
+			a, err := addr(machine)
+			if err != nil {
+				return 0, err
+			}
+			cells, err := machine.Cells(a, 1)
+			if err != nil {
+				return 0, err
+			}
+			return cells[0], nil
+		}, nil
+	}
+	if !unicode.IsLetter(rune(token[0])) && token[0] != '_' {
+		return nil, fmt.Errorf("unexpected %q", token)
+	}
+	addr, _, err := debugAddress(p.image, token)
+	if err != nil {
+		return nil, err
+	}
+	return func(*vm.VM) (int32, error) { return int32(addr), nil }, nil
+}
+
+// condOp combines two operands with a binary operator
+func condOp(op string, left, right evaluator) evaluator {
+	return func(machine *vm.VM) (int32, error) {
+		a, err := left(machine)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case op == "&&" && a == 0:
+			return 0, nil
+		case op == "||" && a != 0:
+			return 1, nil
+		}
+		b, err := right(machine)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "&&", "||":
+			return truth(b != 0), nil
+		case "==":
+			return truth(a == b), nil
+		case "!=":
+			return truth(a != b), nil
+		case "<":
+			return truth(a < b), nil
+		case "<=":
+			return truth(a <= b), nil
+		case ">":
+			return truth(a > b), nil
+		case ">=":
+			return truth(a >= b), nil
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		case "*":
+			return a * b, nil
+		}
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		if op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	}
+}
+
+func truth(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// diffRun is what one program did with one input
+type diffRun struct {
+	batchResult
+	Stack []int32
+}
+
+// diff handles `nux diff [options] A B`: it runs both programs on the same
+// inputs and reports where their output, exit status or final stack differ,
+// and how their instruction counts compare, to check that a compiler or
+// optimizer change kept a program's behavior
+func diff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	var inputs []string
+	flags.Func("input", "Run both programs on this file as stdin; repeat for more inputs (default: no input)", func(name string) error {
+		inputs = append(inputs, name)
+		return nil
+	})
+	maxSteps := flags.Int64("max-steps", 10_000_000, "Stop each run after this many instructions (0 = no limit)")
+	timeout := flags.Duration("timeout", 10*time.Second, "Stop each run after this much time (0 = no limit)")
+	maxOutput := flags.Int64("max-output", 1<<20, "Stop each run once it has printed this many bytes (0 = no limit)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nux diff [options] <a.nux> <b.nux>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	a, b := flags.Arg(0), flags.Arg(1)
+	if len(inputs) == 0 {
+		inputs = []string{""}
+	}
+
+	limits := vm.Limits{MaxSteps: *maxSteps, MaxTime: *timeout, MaxOutput: *maxOutput}
+	differ := 0
+	for _, name := range inputs {
+		var input []byte
+		label := "no input"
+		if name != "" {
+			data, err := readFile(name)
+			if err != nil {
+				return err
+			}
+			input, label = data, "input "+name
+		}
+		runA, runB := runDiffProgram(a, input, limits), runDiffProgram(b, input, limits)
+		if !writeDiff(os.Stdout, label, a, b, runA, runB) {
+			differ++
+		}
+	}
+	if differ > 0 {
+		return fmt.Errorf("%s and %s differ on %d of %d inputs", a, b, differ, len(inputs))
+	}
+	fmt.Printf("%s and %s agree on %d inputs\n", a, b, len(inputs))
+	return nil
+}
+
+func runDiffProgram(file string, input []byte, limits vm.Limits) diffRun {
+	result, machine := runBatchProgram(file, input, limits)
+	run := diffRun{batchResult: result}
+	if machine != nil {
+		run.Stack = machine.Stack()
+	}
+	return run
+}
+
+// writeDiff writes how runs a and b of one input compare, and reports
+// whether they behaved the same. Instruction counts may differ and still
+// agree: making them differ is what an optimizer is for.
+func writeDiff(w io.Writer, label, nameA, nameB string, a, b diffRun) bool {
+	same := true
+	fmt.Fprintf(w, "%s:\n", label)
+	differs := func(what, valueA, valueB string) {
+		same = false
+		fmt.Fprintf(w, "  %s differs\n    %s: %s\n    %s: %s\n", what, nameA, valueA, nameB, valueB)
+	}
+	if a.Stdout != b.Stdout {
+		at := firstDifference(a.Stdout, b.Stdout)
+		line := strings.Count(a.Stdout[:at], "\n") + 1
+		differs(fmt.Sprintf("stdout (at byte %d, line %d)", at, line), excerpt(a.Stdout, at), excerpt(b.Stdout, at))
+	}
+	if a.Stderr != b.Stderr {
+		at := firstDifference(a.Stderr, b.Stderr)
+		differs(fmt.Sprintf("stderr (at byte %d)", at), excerpt(a.Stderr, at), excerpt(b.Stderr, at))
+	}
+	if a.Exit != b.Exit || a.Error != b.Error {
+		differs("exit status", exitDescription(a), exitDescription(b))
+	}
+	if !slices.Equal(a.Stack, b.Stack) {
+		differs("final stack", fmt.Sprint(a.Stack), fmt.Sprint(b.Stack))
+	}
+	if same {
+		fmt.Fprintf(w, "  same output, exit status %d and final stack %v\n", a.Exit, a.Stack)
+	}
+	change := ""
+	if a.Steps > 0 {
+		change = fmt.Sprintf(" (%+.1f%%)", float64(b.Steps-a.Steps)*100/float64(a.Steps))
+	}
+	fmt.Fprintf(w, "  instructions: %s %d, %s %d%s\n", nameA, a.Steps, nameB, b.Steps, change)
+	return same
+}
+
+// firstDifference returns the offset of the first byte where a and b
+// differ, or the length of the shorter if one begins the other
+func firstDifference(a, b string) int {
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// excerpt quotes s from a little before offset at, so a difference shows
+// in context
+func excerpt(s string, at int) string {
+	const before, after = 20, 40
+	start, end := max(at-before, 0), min(at+after, len(s))
+	text := fmt.Sprintf("%q", s[start:end])
+	if start > 0 {
+		text = "..." + text
+	}
+	if end < len(s) {
+		text += "..."
+	}
+	return text
+}
+
+func exitDescription(r diffRun) string {
+	if r.Error != "" {
+		return fmt.Sprintf("%d (%s)", r.Exit, r.Error)
+	}
+	return fmt.Sprint(r.Exit)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// opcodeCounts is how often each opcode, and each opcode followed by
+// another, appears in code or runs
+type opcodeCounts struct {
+	ops   [256]int64
+	pairs map[[2]byte]int64
+	total int64
+}
+
+func (c *opcodeCounts) add(prev, op byte, first bool) {
+	if c.pairs == nil {
+		c.pairs = make(map[[2]byte]int64)
+	}
+	c.ops[op]++
+	c.total++
+	if !first {
+		c.pairs[[2]byte{prev, op}]++
+	}
+}
+
+// histogram handles `nux histogram [options] DIR...`: how often each
+// opcode and each pair of adjacent opcodes appears in the programs, and
+// with --dynamic how often each runs, to show which superinstructions and
+// encodings would pay for themselves
+func histogram(args []string) error {
+	flags := flag.NewFlagSet("histogram", flag.ExitOnError)
+	pattern := flags.String("pattern", "*.nux", "Count the files whose name matches this pattern")
+	dynamic := flags.Bool("dynamic", false, "Also run each program with no input and count the instructions it executes")
+	maxSteps := flags.Int64("max-steps", 10_000_000, "Stop each --dynamic run after this many instructions (0 = no limit)")
+	timeout := flags.Duration("timeout", 10*time.Second, "Stop each --dynamic run after this much time (0 = no limit)")
+	top := flags.Int("top", 20, "Show this many of the most frequent opcode pairs")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nux histogram [options] <dir>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if _, err := filepath.Match(*pattern, ""); err != nil {
+		return fmt.Errorf("--pattern %q: %v", *pattern, err)
+	}
+	files, err := findPrograms(flags.Args(), *pattern)
+	if err != nil {
+		return err
+	}
+
+	var static, executed opcodeCounts
+	var runs *opcodeCounts
+	if *dynamic {
+		runs = &executed
+	}
+	limits := vm.Limits{MaxSteps: *maxSteps, MaxTime: *timeout}
+	for _, file := range files {
+		image, err := readImage(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		countStatic(&static, image.Code)
+		if runs != nil {
+			if err := countDynamic(runs, image, limits); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v (counted up to there)\n", file, err)
+			}
+		}
+	}
+	writeHistogram(os.Stdout, len(files), &static, runs, *top)
+	return nil
+}
+
+// countStatic counts the instructions of code as the disassembler reads
+// them, so data placed between words counts as the opcodes it spells
+func countStatic(c *opcodeCounts, code []byte) {
+	var prev byte
+	for at := 0; at < len(code); {
+		_, size := vm.FormatInstruction(code, at, nil)
+		if size == 0 {
+			break
+		}
+		c.add(prev, code[at], at == 0)
+		prev = code[at]
+		at += size
+	}
+}
+
+// countDynamic runs the program and counts each instruction as it executes.
+// A run that fails or reaches the limits is counted up to where it stopped.
+func countDynamic(c *opcodeCounts, image *vm.Image, limits vm.Limits) error {
+	if err := image.CheckISA(); err != nil {
+		return err
+	}
+	machine, err := vm.NewVMForImage(image)
+	if err != nil {
+		return err
+	}
+	machine.Stdin = bytes.NewReader(nil)
+	machine.CaptureOutput()
+	first, prev := true, byte(0)
+	machine.Hook = func(_ *vm.VM, ins vm.Instruction) error {
+		c.add(prev, ins.Opcode, first)
+		first, prev = false, ins.Opcode
+		return nil
+	}
+	return machine.RunLimited(limits)
+}
+
+func writeHistogram(w io.Writer, programs int, static, dynamic *opcodeCounts, top int) {
+	rank := static
+	if dynamic != nil {
+		rank = dynamic
+	}
+	fmt.Fprintf(w, "%d programs, %d instructions", programs, static.total)
+	if dynamic != nil {
+		fmt.Fprintf(w, ", %d executed", dynamic.total)
+	}
+	fmt.Fprintln(w)
+
+	var ops []byte
+	for op := range 256 {
+		if static.ops[op] > 0 || (dynamic != nil && dynamic.ops[op] > 0) {
+			ops = append(ops, byte(op))
+		}
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return rank.ops[ops[i]] > rank.ops[ops[j]] })
+	fmt.Fprintf(w, "\n%-14s %10s %7s", "OPCODE", "STATIC", "%")
+	if dynamic != nil {
+		fmt.Fprintf(w, " %12s %7s", "DYNAMIC", "%")
+	}
+	fmt.Fprintln(w)
+	for _, op := range ops {
+		fmt.Fprintf(w, "%-14s %10d %6.2f%%", vm.OpcodeName(op), static.ops[op], share(static.ops[op], static.total))
+		if dynamic != nil {
+			fmt.Fprintf(w, " %12d %6.2f%%", dynamic.ops[op], share(dynamic.ops[op], dynamic.total))
+		}
+		fmt.Fprintln(w)
+	}
+
+	var pairs [][2]byte
+	for pair := range rank.pairs {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		a, b := rank.pairs[pairs[i]], rank.pairs[pairs[j]]
+		if a != b {
+			return a > b
+		}
+		return pairs[i][0] < pairs[j][0] || pairs[i][0] == pairs[j][0] && pairs[i][1] < pairs[j][1]
+	})
+	pairs = pairs[:min(top, len(pairs))]
+	if len(pairs) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%-24s %10s", "PAIR", "STATIC")
+	if dynamic != nil {
+		fmt.Fprintf(w, " %12s", "DYNAMIC")
+	}
+	fmt.Fprintln(w)
+	for _, pair := range pairs {
+		name := vm.OpcodeName(pair[0]) + " " + vm.OpcodeName(pair[1])
+		fmt.Fprintf(w, "%-24s %10d", name, static.pairs[pair])
+		if dynamic != nil {
+			fmt.Fprintf(w, " %12d", dynamic.pairs[pair])
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// share is n as a percentage of total
+func share(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// inspect handles `nux inspect [-d] prog.nux`: the header, sections and
+// symbols of an image, and with -d its code disassembled
+func inspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	disasm := flags.Bool("d", false, "Also disassemble the code")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nux inspect [-d] <program.nux>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	filename := flags.Arg(0)
+	image, err := readImage(filename)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	writeInspection(os.Stdout, filename, image)
+	if *disasm {
+		fmt.Println("\nDisassembly:")
+		base := image.BaseAddr
+		if base == 0 {
+			base = vm.UserMemoryOffset
+		}
+		vm.DisassembleAt(os.Stdout, image.Code, base, image.Symbols)
+	}
+	return nil
+}
+
+// writeInspection writes everything the header and sections of image say
+func writeInspection(w io.Writer, filename string, image *vm.Image) {
+	if image.FormatVersion == 0 {
+		fmt.Fprintf(w, "%s: bare bytecode, %d bytes, no header\n", filename, len(image.Code))
+		return
+	}
+	fmt.Fprintf(w, "%s: NUX image, format version %d\n", filename, image.FormatVersion)
+	unknown := func(s string, known bool) string {
+		if !known {
+			return "unknown"
+		}
+		return s
+	}
+	fmt.Fprintf(w, "  ISA version:     %s\n", unknown(fmt.Sprint(image.ISAVersion), image.ISAVersion != 0))
+	fmt.Fprintf(w, "  Compiler:        %s\n", unknown("luxc "+image.CompilerVersion, image.CompilerVersion != ""))
+	fmt.Fprintf(w, "  Built:           %s\n", unknown(time.Unix(image.BuildTime, 0).UTC().Format(time.RFC3339), image.BuildTime != 0))
+	base, reserved := image.BaseAddr, image.ReservedSize
+	if base == 0 {
+		base = vm.UserMemoryOffset
+	}
+	if reserved == 0 {
+		reserved = vm.ReservedMemorySize
+	}
+	fmt.Fprintf(w, "  Loads at:        0x%04X\n", base)
+	fmt.Fprintf(w, "  Reserved memory: %d bytes\n", reserved)
+	fmt.Fprintf(w, "  Code:            %d bytes, 0x%04X-0x%04X\n", len(image.Code), base, base+uint32(len(image.Code)))
+	if len(image.Data) > 0 {
+		end := base + uint32(len(image.Code))
+		fmt.Fprintf(w, "  Data:            %d bytes, 0x%04X-0x%04X\n", len(image.Data), end, end+uint32(len(image.Data)))
+	}
+	fmt.Fprintf(w, "  Relocations:     %d\n", len(image.Relocs))
+	fmt.Fprintf(w, "  Signed:          %t\n", image.Signature != nil)
+
+	fmt.Fprintln(w, "\nSections:")
+	fmt.Fprintf(w, "  %-14s %-8s %s\n", "KIND", "OFFSET", "SIZE")
+	for _, s := range image.Sections {
+		fmt.Fprintf(w, "  %-14s 0x%04X   %d\n", vm.SectionName(s.Kind), s.Offset, s.Size)
+	}
+
+	fmt.Fprintf(w, "\nSymbols (%d):\n", len(image.Symbols))
+	if len(image.Symbols) == 0 {
+		fmt.Fprintln(w, "  none (compile with luxc -g to include them)")
+	}
+	for _, sym := range image.Symbols {
+		fmt.Fprintf(w, "  0x%04X  %s\n", sym.Address, sym.Name)
+	}
+	if len(image.Tables) > 0 {
+		fmt.Fprintf(w, "\nTables (%d):\n", len(image.Tables))
+	}
+	for _, t := range image.Tables {
+		fmt.Fprintf(w, "  0x%04X  %-16s %d bytes\n", t.Address, t.Name, t.Size)
+	}
+}
+
+// verify handles `nux verify [-trusted-key FILE] prog.nux...`: each image
+// must parse with a matching checksum, target an instruction set this VM
+// runs and fit its memory; with a key, it must also be signed by it
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	key := flags.String("trusted-key", "", "Also check each image is signed by the Ed25519 public key in this file")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nux verify [-trusted-key FILE] <program.nux>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	failed := 0
+	for _, filename := range flags.Args() {
+		if err := verifyImage(filename, *key); err != nil {
+			fmt.Printf("%s: FAIL: %v\n", filename, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: OK\n", filename)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed verification", failed, flags.NArg())
+	}
+	return nil
+}
+
+func verifyImage(filename, key string) error {
+	image, err := readImage(filename)
+	if err != nil {
+		return err
+	}
+	if image.FormatVersion == 0 {
+		return fmt.Errorf("bare bytecode has no header or checksum to verify")
+	}
+	checksum := false
+	for _, s := range image.Sections {
+		checksum = checksum || s.Kind == vm.SectionChecksum
+	}
+	if !checksum {
+		return fmt.Errorf("image has no checksum")
+	}
+	if err := image.CheckISA(); err != nil {
+		return err
+	}
+	if _, err := vm.NewVMForImage(image); err != nil {
+		return err
+	}
+	if key != "" {
+		return verifySignature(image, key)
+	}
+	return nil
+}
+
+// readImage reads and parses the image in filename
+func readImage(filename string) (*vm.Image, error) {
+	data, err := readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return vm.ParseImage(data)
+}
@@ -1,106 +1,714 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rmay/nuxvm/pkg/vm"
 )
 
 var (
-	debugFlag = flag.Bool("debug", false, "Enable step-by-step debugging")
-	traceFlag = flag.Bool("trace", false, "Show execution trace")
+	debugFlag     = flag.Bool("debug", false, "Enable step-by-step debugging")
+	disasmFlag    = flag.Bool("disasm", false, "Print the program's instructions, labelled with word names when it has symbols, and exit")
+	memMapFlag    = flag.Bool("memory-map", false, "Print the regions of the program's address space and their permissions, and exit")
+	traceFlag     = flag.Bool("trace", false, "Show execution trace")
+	traceLevel    = flag.String("trace-level", "all", "Trace every instruction (all) or only calls and returns as a call tree (calls)")
+	traceFileFlag = flag.String("trace-file", "", "Write the trace to this file instead of stderr")
+	traceOpsFlag  = flag.String("trace-ops", "", "Trace only these opcodes, e.g. CALL,RET")
+	traceFromFlag = flag.String("trace-from", "", "Start tracing when PC reaches this address or word")
+	traceMaxFlag  = flag.Int("trace-max", 0, "Stop tracing after this many lines (0 = no limit)")
+	poisonFlag    = flag.String("poison", "", "Fail when arithmetic takes one of these comma-separated sentinel values, e.g. -2147483648, and say which instruction produced it")
+	explainFlag   = flag.Bool("explain", false, "Describe each instruction in English as it runs (same as --trace-level explain)")
+	profileFlag   = flag.Bool("profile", false, "Print per-word call counts and instruction counts after the run")
+	foldedFlag    = flag.String("flamegraph", "", "Profile the run and write folded stacks for flamegraph tools to this file")
+	pprofFlag     = flag.String("pprof", "", "Profile the run and write a pprof profile to this file")
+	recordFlag    = flag.String("record", "", "Record every step of the run to this file, for time-travel queries with nuxtrace")
+	entryFlag     = flag.String("entry", "", "Run the named word instead of the program's toplevel code")
+	keyFlag       = flag.String("trusted-key", "", "Only run images signed by the Ed25519 public key in this file")
+	journalFlag   = flag.String("journal", "", "Record the run's output, memory writes, host calls and limits to this file as JSON (- prints a summary to stderr)")
+	maxStepsFlag  = flag.Int64("max-steps", 0, "Stop after this many instructions (0 = no limit)")
+	maxTimeFlag   = flag.Duration("max-time", 0, "Stop after this much time, e.g. 5s (0 = no limit)")
+	maxCostFlag   = flag.Int64("max-cost", 0, "Stop when the weighted cost of the instructions run would exceed this (0 = no limit)")
+	maxOutputFlag = flag.Int64("max-output", 0, "Stop once the program has printed this many bytes (0 = no limit)")
+	storageFlag   = flag.String("storage", "", "Let the program keep state in this file with KV-GET, KV-PUT and KV-DEL")
+	storageKeys   = flag.Int("storage-keys", 1024, "Most keys the --storage file may hold (0 = no limit)")
+	networkFlag   = flag.Bool("network", false, "Let the program make HTTP requests and TCP connections")
+	servicesFlag  = flag.Bool("services", false, "Install the standard service routines in reserved memory for the program to CALL")
+	determFlag    = flag.Bool("deterministic", false, "Stub host input and refuse clock limits so every run is identical; prints the final state hash")
+	hashEveryFlag = flag.Int64("hash-every", 0, "Print a digest of the VM's state to stderr every this many instructions, for comparing replicas (0 = never)")
+	commandsFlag  = flag.String("commands", "", "Run the debugger commands in this file first, one a line, then read more from stdin")
+	hexFlag       = flag.Bool("hex", false, "Show stack values in hex in the debugger and error reports")
+	unsignedFlag  = flag.Bool("unsigned", false, "Show stack values as unsigned numbers in the debugger and error reports")
+	statsFlag     = flag.Bool("stats", false, "Print instructions run, wall time, speed, stack depth, memory used and output size to stderr after the run")
+	statsJSONFlag = flag.String("stats-json", "", "Write the --stats figures to this file as JSON (- prints them to stderr)")
 )
 
+// exitLimit is nux's exit status when --max-steps, --max-time,
+// --max-cost or --max-output stopped the run
+const exitLimit = 3
+
+func init() {
+	flag.DurationVar(maxTimeFlag, "timeout", 0, "Same as --max-time")
+}
+
 func main() {
-	flag.Parse()
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "run", "debug", "trace", "inspect", "verify", "batch", "diff", "minimize", "histogram", "op":
+			command, args = args[0], args[1:]
+		}
+	}
+	switch command {
+	case "inspect", "verify", "batch", "diff", "minimize", "histogram", "op":
+		run := map[string]func([]string) error{
+			"inspect": inspect, "verify": verify, "batch": batch, "diff": diff, "minimize": minimize,
+			"histogram": histogram, "op": op,
+		}[command]
+		if err := run(args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "debug":
+		*debugFlag = true
+	case "trace":
+		*traceFlag = true
+	}
+	flag.CommandLine.Parse(args)
 
 	if len(flag.Args()) < 1 {
-		fmt.Println("Usage: nux [options] <program.nux>")
-		fmt.Println("\nOptions:")
-		flag.PrintDefaults()
-		os.Exit(1)
+		usage()
 	}
 
 	filename := flag.Args()[0]
-	program, err := os.ReadFile(filename)
+	if filename == "-" && *debugFlag {
+		fmt.Fprintf(os.Stderr, "Error: the debugger reads its commands from stdin, so the program cannot come from there too\n")
+		os.Exit(1)
+	}
+	data, err := readFile(filename)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
 		os.Exit(1)
 	}
+	image, err := vm.ParseImage(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	if err := image.CheckISA(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	if *keyFlag != "" {
+		if err := verifySignature(image, *keyFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", filename, err)
+			os.Exit(1)
+		}
+	}
+
+	if *disasmFlag {
+		vm.Disassemble(os.Stdout, image.Code, image.Symbols)
+		return
+	}
 
-	machine := vm.NewVM(program)
+	machine, err := vm.NewVMForImage(image)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	if *journalFlag != "" {
+		machine.Journal = vm.NewJournal()
+	}
+	machine.Deterministic = *determFlag
+	if *hashEveryFlag > 0 {
+		machine.Hook = vm.HashEvery(*hashEveryFlag, func(step int64, digest uint64) {
+			fmt.Fprintf(os.Stderr, "step %d: %016x\n", step, digest)
+		})
+	}
+	if *storageFlag != "" {
+		store, err := vm.OpenFileStore(*storageFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening storage: %v\n", err)
+			os.Exit(1)
+		}
+		machine.RegisterStorage(store, *storageKeys)
+	}
+	if *networkFlag {
+		machine.RegisterNetwork(vm.NetworkOptions{})
+	}
+	if *servicesFlag {
+		if err := machine.InstallServices(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error installing services: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *memMapFlag {
+		vm.WriteMemoryMap(os.Stdout, machine.MemoryMap())
+		return
+	}
+	// exit closes connections the program left open and writes the journal
+	// and stats, which matter most when the run failed
+	var start time.Time
+	exit := func(code int) {
+		machine.Close()
+		if !start.IsZero() {
+			if err := writeStats(machine, time.Since(start)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				code = 1
+			}
+		}
+		if *determFlag {
+			fmt.Fprintf(os.Stderr, "\nState hash: %x\n", machine.StateHash())
+		}
+		if err := writeJournal(machine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			code = 1
+		}
+		os.Exit(code)
+	}
+	if *explainFlag {
+		*traceLevel = "explain"
+	}
+	// Any --trace-* option turns tracing on
+	if *traceLevel != "all" || *traceFileFlag != "" || *traceOpsFlag != "" || *traceFromFlag != "" || *traceMaxFlag > 0 {
+		*traceFlag = true
+	}
 
-	if *debugFlag {
-		runDebug(machine)
-	} else if *traceFlag {
-		runTrace(machine)
+	if *determFlag && *maxTimeFlag != 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-time and --timeout depend on the clock and cannot be combined with --deterministic; use --max-steps\n")
+		os.Exit(1)
+	}
+	poison, err := parsePoison(*poisonFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *commandsFlag != "" && !*debugFlag {
+		fmt.Fprintf(os.Stderr, "Error: --commands needs --debug\n")
+		os.Exit(1)
+	}
+	if poison != nil && (*debugFlag || *recordFlag != "" || profiling()) {
+		fmt.Fprintf(os.Stderr, "Error: --poison cannot be combined with --debug, --record or profiling\n")
+		os.Exit(1)
+	}
+	if (*maxStepsFlag != 0 || *maxTimeFlag != 0 || *maxCostFlag != 0 || *maxOutputFlag != 0) && (*entryFlag != "" || *debugFlag || *traceFlag || poison != nil || *recordFlag != "" || profiling()) {
+		fmt.Fprintf(os.Stderr, "Error: --max-steps, --max-time, --max-cost and --max-output cannot be combined with --entry, --debug, --trace, --poison, --record or profiling\n")
+		exit(1)
+	}
+
+	start = time.Now()
+	if *entryFlag != "" {
+		if *debugFlag || *traceFlag || poison != nil || *recordFlag != "" || profiling() {
+			fmt.Fprintf(os.Stderr, "Error: --entry cannot be combined with --debug, --trace, --poison, --record or profiling\n")
+			exit(1)
+		}
+		sym, ok := image.Lookup(strings.ToUpper(*entryFlag))
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: %s has no word named %s (compile with luxc -g to include symbols)\n", filename, *entryFlag)
+			exit(1)
+		}
+		if err := machine.CallWord(uint32(sym.Address)); err != nil {
+			fmt.Fprintf(os.Stderr, "---Runtime error---\n")
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "%s\n", machine.DebugState(debugOptions(image)).String())
+			exit(1)
+		}
+	} else if profiling() {
+		if err := runProfile(machine, image); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	} else if *recordFlag != "" {
+		if err := runRecord(machine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	} else if *debugFlag {
+		var commands io.Reader
+		if *commandsFlag != "" {
+			f, err := os.Open(*commandsFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer f.Close()
+			commands = f
+		}
+		runDebug(machine, image, commands)
+	} else if *traceFlag || poison != nil {
+		if err := runTrace(machine, image, poison); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
 	} else {
-		if err := machine.Run(); err != nil {
+		limits := vm.Limits{MaxSteps: *maxStepsFlag, MaxTime: *maxTimeFlag, MaxCost: *maxCostFlag, MaxOutput: *maxOutputFlag}
+		var err error
+		if limits == (vm.Limits{}) {
+			err = machine.Run()
+		} else {
+			meter := limits.Start()
+			err = machine.RunMetered(meter)
+			if *maxCostFlag > 0 {
+				fmt.Fprintf(os.Stderr, "\nCost: %d of %d\n", meter.Cost(), *maxCostFlag)
+			}
+		}
+		var limit *vm.LimitError
+		if errors.As(err, &limit) {
+			fmt.Fprintf(os.Stderr, "\nStopped: %v (%s)\n", limit, limitHint(limit))
+			exit(exitLimit)
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "---Runtime error---\n")
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			fmt.Fprintf(os.Stderr, "%s\n", machine.DebugInfo())
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "%s\n", machine.DebugState(debugOptions(image)).String())
+			exit(1)
 		}
 	}
+	exit(machine.ExitStatus())
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: nux [run] [options] <program.nux>   Run a program (- reads it from stdin)")
+	fmt.Fprintln(os.Stderr, "       nux debug [options] <program.nux>   Step through it (same as --debug)")
+	fmt.Fprintln(os.Stderr, "       nux trace [options] <program.nux>   Trace its instructions (same as --trace)")
+	fmt.Fprintln(os.Stderr, "       nux inspect [-d] <program.nux>      Show its header, sections and symbols, and with -d its code")
+	fmt.Fprintln(os.Stderr, "       nux verify [-trusted-key FILE] <program.nux>...  Check images are intact and runnable here")
+	fmt.Fprintln(os.Stderr, "       nux batch [options] <dir>...         Run every program in the directories and report which failed")
+	fmt.Fprintln(os.Stderr, "       nux diff [options] <a.nux> <b.nux>   Run both on the same inputs and compare what they did")
+	fmt.Fprintln(os.Stderr, "       nux minimize [options] <program.nux> Shrink a failing program to a small reproducer")
+	fmt.Fprintln(os.Stderr, "       nux histogram [options] <dir>...     Count the opcodes and opcode pairs the programs use")
+	fmt.Fprintln(os.Stderr, "       nux op <instruction>... <value>...   Run instructions on a stack of values and show each step")
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+// readFile reads the named file, or all of stdin when the name is -
+func readFile(filename string) ([]byte, error) {
+	if filename == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(filename)
+}
+
+// limitHint names the flag that set the limit a run reached
+func limitHint(limit *vm.LimitError) string {
+	switch limit.Reason {
+	case vm.LimitSteps:
+		return fmt.Sprintf("--max-steps %d", *maxStepsFlag)
+	case vm.LimitTime:
+		return fmt.Sprintf("--max-time %v", *maxTimeFlag)
+	case vm.LimitCost:
+		return fmt.Sprintf("--max-cost %d", *maxCostFlag)
+	case vm.LimitOutput:
+		return fmt.Sprintf("--max-output %d", *maxOutputFlag)
+	}
+	return limit.Reason
+}
+
+// writeJournal saves the --journal report, if one was asked for
+func writeJournal(machine *vm.VM) error {
+	if machine.Journal == nil {
+		return nil
+	}
+	report := machine.Journal.Report()
+	if *journalFlag == "-" {
+		fmt.Fprintln(os.Stderr, "\n=== Effects ===")
+		report.WriteReport(os.Stderr)
+		return nil
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*journalFlag, append(data, '\n'), 0644)
+}
+
+// profiling reports whether any profile output was requested
+func profiling() bool {
+	return *profileFlag || *foldedFlag != "" || *pprofFlag != ""
+}
+
+// runProfile runs the program under a Profiler and writes the requested outputs
+func runProfile(machine *vm.VM, image *vm.Image) error {
+	profiler := vm.NewProfiler(image.Symbols)
+	runErr := profiler.Run(machine)
+	if *profileFlag {
+		fmt.Fprintln(os.Stderr)
+		profiler.WriteReport(os.Stderr)
+	}
+	if *foldedFlag != "" {
+		if err := writeProfile(*foldedFlag, profiler.WriteFolded); err != nil {
+			return err
+		}
+	}
+	if *pprofFlag != "" {
+		if err := writeProfile(*pprofFlag, profiler.WritePprof); err != nil {
+			return err
+		}
+	}
+	return runErr
+}
+
+// runRecord runs the program under a Recorder and saves the trace, even
+// when the run fails, since that is when it is wanted
+func runRecord(machine *vm.VM) error {
+	recorder := vm.NewRecorder(0)
+	runErr := recorder.Run(machine)
+	data := vm.EncodeTimeTrace(recorder.Trace(machine))
+	if err := os.WriteFile(*recordFlag, data, 0644); err != nil {
+		return err
+	}
+	return runErr
+}
+
+func writeProfile(name string, write func(io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// verifySignature checks the image against the public key in keyFile
+func verifySignature(image *vm.Image, keyFile string) error {
+	keyText, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := vm.ParsePublicKey(string(keyText))
+	if err != nil {
+		return fmt.Errorf("%s: %v", keyFile, err)
+	}
+	return image.Verify(key)
 }
 
-func runDebug(machine *vm.VM) {
+// runDebug steps through the program at the user's commands, reading them
+// from commands, when it is not nil, until it runs out and then from stdin
+func runDebug(machine *vm.VM, image *vm.Image, commands io.Reader) {
 	fmt.Println("=== NUX Debugger ===")
-	fmt.Println("Press Enter to step, 'q' to quit, 'c' to continue")
+	fmt.Println("Press Enter to step, 'q' to quit, 'c' to continue, 'w' to list words,")
+	fmt.Println("'m' to show the memory map, 'dump ADDR [LEN]' to show memory,")
+	fmt.Println("'cells ADDR [N]' to show the values stored there, 'watch ADDR' to stop")
+	fmt.Println("when an instruction changes them and 'unwatch [ADDR]' to stop watching;")
+	fmt.Println("ADDR may name a DATA table or word of a program compiled with luxc -g;")
+	fmt.Println("'redefine WORD FILE' recompiles WORD from the edited source and runs it from now on;")
+	fmt.Println("'break ADDR [if CONDITION]' stops 'c' there, 'delete [ADDR]' removes breakpoints")
 	fmt.Println()
 
+	// The program's ACCEPT reads from the same input as the commands
+	in := bufio.NewReader(os.Stdin)
+	machine.Stdin = in
+	var script *bufio.Reader
+	if commands != nil {
+		script = bufio.NewReader(commands)
+	}
+	var watches []*watchpoint
+	var breaks []*breakpoint
+	refs := image.RelocAddresses()
 	for {
-		fmt.Printf("PC: %d, Stack: %v\n", machine.PC(), machine.Stack())
+		fmt.Printf("PC: %d%s, Stack: %s\n", machine.PC(), wordAt(image, int32(machine.PC())), debugOptions(image).FormatStack(machine.Stack()))
 		fmt.Print("> ")
 
-		var input string
-		fmt.Scanln(&input)
+		line, err := readCommand(&script, in)
+		if err != nil && line == "" {
+			break
+		}
+		fields := strings.Fields(line)
+		input := ""
+		if len(fields) > 0 {
+			input = fields[0]
+		}
 
 		if input == "q" {
 			break
 		}
 
-		if input == "c" {
+		if input == "dump" || input == "d" {
+			if err := dumpMemory(machine, image, fields[1:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			continue
+		}
+
+		if input == "cells" {
+			if err := showCells(machine, image, fields[1:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			continue
+		}
+
+		if input == "watch" {
+			if watches, err = watch(machine, image, watches, fields[1:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			continue
+		}
+
+		if input == "unwatch" {
+			watches = unwatch(watches, fields[1:])
+			continue
+		}
+
+		if input == "break" || input == "b" {
+			if breaks, err = setBreak(image, breaks, fields[1:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			continue
+		}
+
+		if input == "delete" {
+			if breaks, err = deleteBreak(image, breaks, fields[1:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			continue
+		}
+
+		if input == "redefine" {
+			if refs, err = redefine(machine, image, refs, fields[1:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			continue
+		}
+
+		if input == "m" {
+			vm.WriteMemoryMap(os.Stdout, machine.MemoryMap())
+			continue
+		}
+
+		if input == "w" {
+			if len(image.Symbols) == 0 {
+				fmt.Println("The program has no symbol table (compile with luxc -g)")
+			}
+			for _, sym := range image.Symbols {
+				fmt.Printf("0x%04X %s\n", sym.Address, sym.Name)
+			}
+			continue
+		}
+
+		if input == "c" && len(watches) == 0 && len(breaks) == 0 {
 			if err := machine.Run(); err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			}
 			break
 		}
 
-		cont, err := machine.Step()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			break
+		// Step once, or continue until a watchpoint changes or a breakpoint
+		// stops it
+		stopped := false
+		for !stopped {
+			pc := machine.PC()
+			cont, err := machine.Step()
+			machine.Flush()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				finishDebug(machine, image)
+				return
+			}
+			if !cont {
+				fmt.Println("Program halted")
+				finishDebug(machine, image)
+				return
+			}
+			stopped = checkWatches(machine, image, watches, pc) || checkBreaks(machine, image, breaks) || input != "c"
 		}
-		if !cont {
-			fmt.Println("Program halted")
+	}
+	finishDebug(machine, image)
+}
+
+// readCommand reads the next command line from the script, echoing it
+// after the prompt and skipping # comments, and once the script runs out
+// from in
+func readCommand(script **bufio.Reader, in *bufio.Reader) (string, error) {
+	for *script != nil {
+		line, err := (*script).ReadString('\n')
+		if line == "" && err != nil {
+			*script = nil
 			break
 		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fmt.Println(strings.TrimRight(line, "\r\n"))
+		return line, nil
 	}
+	return in.ReadString('\n')
+}
 
-	fmt.Printf("\nFinal stack: %v\n", machine.Stack())
+// finishDebug shows the stack the debugging session ended with
+func finishDebug(machine *vm.VM, image *vm.Image) {
+	fmt.Printf("\nFinal stack: %s\n", debugOptions(image).FormatStack(machine.Stack()))
 }
 
-func runTrace(machine *vm.VM) {
-	fmt.Println("=== Execution Trace ===")
-	fmt.Println()
+// debugOptions returns how the --hex and --unsigned flags show values
+func debugOptions(image *vm.Image) vm.DebugOptions {
+	return vm.DebugOptions{Hex: *hexFlag, Unsigned: *unsignedFlag, Symbols: image.Symbols}
+}
 
-	for {
-		pc := machine.PC()
-		stack := machine.Stack()
-		fmt.Printf("PC=%d Stack=%v\n", pc, stack)
+// dumpMemory handles the debugger's dump command: a hex dump of LEN bytes
+// from ADDR, both decimal or 0x hex, or ADDR a name. LEN defaults to a
+// DATA table's size, and otherwise to 64.
+func dumpMemory(machine *vm.VM, image *vm.Image, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: dump ADDR [LEN]")
+	}
+	start, size, err := debugAddress(image, args[0])
+	if err != nil {
+		return err
+	}
+	addr, n := uint64(start), uint64(64)
+	if size > 0 {
+		n = uint64(size)
+	}
+	if len(args) == 2 {
+		if n, err = strconv.ParseUint(args[1], 0, 32); err != nil {
+			return fmt.Errorf("bad length %q", args[1])
+		}
+	}
+	mem := machine.Memory()
+	if addr >= uint64(len(mem)) {
+		return fmt.Errorf("address 0x%X is past the end of memory (0x%X)", addr, len(mem))
+	}
+	if region, ok := machine.RegionAt(uint32(addr)); ok {
+		fmt.Printf("%s (%s)\n", region.Name, region.Perm)
+	}
+	vm.HexDump(os.Stdout, uint32(addr), mem[addr:min(addr+n, uint64(len(mem)))])
+	return nil
+}
 
-		cont, err := machine.Step()
+// showCells handles the debugger's cells command: the N cells (a DATA
+// table's, or else 8, by default) from ADDR, as OUTCELLS prints them but in the --hex and
+// --unsigned style
+func showCells(machine *vm.VM, image *vm.Image, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: cells ADDR [N]")
+	}
+	start, size, err := debugAddress(image, args[0])
+	if err != nil {
+		return err
+	}
+	addr, n := int64(start), int64(8)
+	if size > 0 {
+		n = int64(size / 4)
+	}
+	if len(args) == 2 {
+		if n, err = strconv.ParseInt(args[1], 0, 32); err != nil {
+			return fmt.Errorf("bad count %q", args[1])
+		}
+	}
+	values, err := machine.Cells(int32(addr), int32(n))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("0x%04X: %s\n", addr, debugOptions(image).FormatStack(values))
+	return nil
+}
+
+// wordAt returns " <NAME>" when pc is the start of a word in the image's
+// symbol table, or "" otherwise
+func wordAt(image *vm.Image, pc int32) string {
+	if sym, ok := image.SymbolAt(pc); ok {
+		return " <" + sym.Name + ">"
+	}
+	return ""
+}
+
+// runTrace runs the program under a Tracer configured from the --trace-*
+// flags, checking for the --poison values. The trace goes to stderr unless
+// --trace-file names a file, leaving stdout to the program. With --poison
+// but not --trace, nothing is traced.
+func runTrace(machine *vm.VM, image *vm.Image, poison []int32) error {
+	if !*traceFlag {
+		tracer := vm.NewTracer(io.Discard)
+		tracer.Symbols = image.Symbols
+		tracer.Ops = map[byte]bool{}
+		tracer.Poison = poison
+		return tracer.Run(machine)
+	}
+	out := io.Writer(os.Stderr)
+	if *traceFileFlag != "" {
+		f, err := os.Create(*traceFileFlag)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error at PC=%d: %v\n", pc, err)
-			os.Exit(1)
+			return err
 		}
-		if !cont {
-			break
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		defer w.Flush()
+		out = w
+	}
+	tracer := vm.NewTracer(out)
+	level, err := vm.ParseTraceLevel(*traceLevel)
+	if err != nil {
+		return err
+	}
+	tracer.Level = level
+	tracer.Symbols = image.Symbols
+	if *traceOpsFlag != "" {
+		ops, err := vm.ParseTraceOps(*traceOpsFlag)
+		if err != nil {
+			return err
+		}
+		tracer.Ops = ops
+	}
+	if *traceFromFlag != "" {
+		from, err := traceAddress(*traceFromFlag, image)
+		if err != nil {
+			return err
+		}
+		tracer.From = from
+	}
+	tracer.Max = *traceMaxFlag
+	tracer.Poison = poison
+
+	fmt.Fprintln(out, "=== Execution Trace ===")
+	fmt.Fprintln(out)
+	if err := tracer.Run(machine); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nFinal stack: %v\n", machine.Stack())
+	return nil
+}
+
+// parsePoison reads --poison: comma-separated values, decimal or 0x hex,
+// where hex up to 0xFFFFFFFF gives the int32 with those bits
+func parsePoison(list string) ([]int32, error) {
+	var values []int32
+	for _, text := range strings.Split(list, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(text, 0, 64)
+		if err != nil || v < math.MinInt32 || v > math.MaxUint32 {
+			return nil, fmt.Errorf("--poison value %q is not a 32-bit number", text)
 		}
+		values = append(values, int32(v))
 	}
+	return values, nil
+}
 
-	fmt.Printf("\nFinal stack: %v\n", machine.Stack())
+// traceAddress resolves --trace-from: a number (decimal or 0x hex) or a word
+// name from the image's symbol table
+func traceAddress(text string, image *vm.Image) (uint32, error) {
+	if addr, err := strconv.ParseUint(text, 0, 32); err == nil {
+		return uint32(addr), nil
+	}
+	if sym, ok := image.Lookup(strings.ToUpper(text)); ok {
+		return uint32(sym.Address), nil
+	}
+	return 0, fmt.Errorf("--trace-from %s is neither an address nor a word in the symbol table", text)
 }
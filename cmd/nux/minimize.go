@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// minimize handles `nux minimize [options] prog.nux`: it shrinks a program
+// that fails to the smallest it can find that still fails the same way, and
+// writes that as a reproducer
+func minimize(args []string) error {
+	flags := flag.NewFlagSet("minimize", flag.ExitOnError)
+	out := flags.String("o", "", "Write the reproducer to this file (default: the program's name ending .min.nux)")
+	maxSteps := flags.Int64("max-steps", 1_000_000, "Stop each trial run after this many instructions; one that reaches it does not count as failing")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nux minimize [options] <program.nux>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	filename := flags.Arg(0)
+	image, err := readImage(filename)
+	if err == nil {
+		err = image.CheckISA()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if *out == "" {
+		if filename == "-" {
+			return fmt.Errorf("name the reproducer with -o when the program comes from stdin")
+		}
+		*out = strings.TrimSuffix(filename, ".nux") + ".min.nux"
+	}
+
+	limits := vm.Limits{MaxSteps: *maxSteps}
+	signature := failureSignature(image, limits)
+	if signature == "" {
+		return fmt.Errorf("%s does not fail within %d instructions, so there is nothing to reproduce", filename, *maxSteps)
+	}
+	fmt.Printf("%s fails with: %s\n", filename, signature)
+	trials := 0
+	small := vm.Minimize(image, func(candidate *vm.Image) bool {
+		trials++
+		return failureSignature(candidate, limits) == signature
+	})
+	if err := os.WriteFile(*out, vm.EncodeImage(small), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s: %d bytes of code, down from %d, after %d trial runs\n", *out, len(small.Code), len(image.Code), trials)
+	return nil
+}
+
+// failureSignature runs the program deterministically with no input and
+// returns how it failed: the error without the address it happened at,
+// which a shrunken program changes, and the last instruction run, or the
+// message it aborted with. It is "" if the program ran cleanly or reached
+// the limits.
+func failureSignature(image *vm.Image, limits vm.Limits) string {
+	machine, err := vm.NewVMForImage(image)
+	if err != nil {
+		return ""
+	}
+	machine.Deterministic = true
+	machine.Stdin = bytes.NewReader(nil)
+	output := machine.CaptureOutput()
+	err = machine.RunLimited(limits)
+	var limit *vm.LimitError
+	switch {
+	case err == nil && machine.ExitStatus() == vm.ExitAborted:
+		return fmt.Sprintf("aborted: %s", strings.TrimSpace(output.Stderr()))
+	case err == nil || errors.As(err, &limit):
+		return ""
+	}
+	if inner := errors.Unwrap(err); inner != nil {
+		err = inner
+	}
+	if underflow, ok := err.(*vm.StackUnderflowError); ok {
+		err = underflow.Err // Without the stack, which shrinking changes
+	}
+	return fmt.Sprintf("%v (in %s)", err, machine.LastOpcode())
+}
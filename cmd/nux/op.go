@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// opSteps bounds a sequence that jumps back on itself
+const opSteps = 100
+
+// op handles `nux op INSTRUCTION... VALUE...`, e.g. `nux op ADD 3 4`: it
+// runs the instructions on a stack holding the values, bottom first, and
+// shows the stack after each, to check what an opcode does without
+// writing a program. An instruction's operand follows its name.
+func op(args []string) error {
+	flags := flag.NewFlagSet("op", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nux op <instruction> [operand]... [value]...")
+		fmt.Fprintln(os.Stderr, "  e.g. nux op ADD 3 4, nux op SWAP SUB 3 4, nux op PUSH8 5 MUL 6")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	listing, values, err := splitOpArgs(flags.Args())
+	if err != nil {
+		return err
+	}
+	code, err := vm.Assemble(strings.Join(listing, "\n"))
+	if err != nil {
+		return err
+	}
+	machine := vm.NewVM(append(code, vm.OpHalt))
+	output := machine.CaptureOutput()
+	end := machine.UserMemoryStart() + uint32(len(code))
+	for _, v := range values {
+		if err := machine.Push(v); err != nil {
+			return err
+		}
+	}
+
+	shown := 0
+	fmt.Printf("%-24s %v\n", "", machine.Stack())
+	for steps := 0; machine.PC() < end; steps++ {
+		if steps == opSteps {
+			return fmt.Errorf("stopped after %d instructions", opSteps)
+		}
+		text, _ := vm.FormatInstruction(machine.Memory(), int(machine.PC()), nil)
+		if _, err := machine.Step(); err != nil {
+			fmt.Printf("%-24s %v\n", text, err)
+			return fmt.Errorf("%s failed", text)
+		}
+		line := fmt.Sprintf("%-24s %v", text, machine.Stack())
+		if r := machine.ReturnStack(); len(r) > 0 {
+			line += fmt.Sprintf("  R: %v", r)
+		}
+		if printed := output.Stdout()[shown:]; printed != "" {
+			line += fmt.Sprintf("  printed %q", printed)
+			shown += len(printed)
+		}
+		fmt.Println(line)
+		if !machine.Running() {
+			break
+		}
+	}
+	return nil
+}
+
+// splitOpArgs reads the instructions, each with the operands its opcode
+// takes, up to the first argument that is not an opcode's name, and the
+// stack values after them
+func splitOpArgs(args []string) (listing []string, values []int32, err error) {
+	i := 0
+	for i < len(args) {
+		op, ok := vm.OpcodeByName(strings.ToUpper(args[i]))
+		if !ok {
+			break
+		}
+		info, _ := vm.LookupOpcode(op)
+		n := 0
+		switch info.Operand {
+		case vm.OperandNone:
+		case vm.OperandTable:
+			return nil, nil, fmt.Errorf("%s needs a program to jump into", info.Name)
+		default:
+			n = 1
+		}
+		if i+1+n > len(args) {
+			return nil, nil, fmt.Errorf("%s takes an operand", info.Name)
+		}
+		listing = append(listing, strings.Join(args[i:i+1+n], " "))
+		i += 1 + n
+	}
+	if len(listing) == 0 {
+		return nil, nil, fmt.Errorf("%q is not an instruction", args[0])
+	}
+	for _, arg := range args[i:] {
+		v, err := strconv.ParseInt(arg, 0, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%q is neither an instruction nor a 32-bit number", arg)
+		}
+		values = append(values, int32(v))
+	}
+	return listing, values, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// redefine handles the debugger's redefine command: it compiles WORD's
+// definition from FILE, the program's edited source, loads it after the
+// program and points the calls of WORD at it, so the run continues with
+// the fix. refs are the addresses of the code's address operands, which
+// grow with each new body's own.
+func redefine(machine *vm.VM, image *vm.Image, refs []uint32, args []string) ([]uint32, error) {
+	if len(args) != 2 {
+		return refs, fmt.Errorf("usage: redefine WORD FILE")
+	}
+	if image.Relocs == nil {
+		return refs, fmt.Errorf("the program has no relocation section; recompile it with this toolchain")
+	}
+	source, err := os.ReadFile(args[1])
+	if err != nil {
+		return refs, err
+	}
+	at := int32(len(machine.Memory()))
+	redef, err := lux.CompileRedefinition(string(source), args[0], image, at, lux.CompileOptions{})
+	if err != nil {
+		return refs, err
+	}
+	patched, err := machine.Redefine(uint32(redef.Old), uint32(redef.Address), redef.Code, refs)
+	if err != nil {
+		return refs, err
+	}
+	for _, off := range redef.Relocs {
+		refs = append(refs, uint32(at)+off)
+	}
+	for i := range image.Symbols {
+		if image.Symbols[i].Name == redef.Name {
+			image.Symbols[i].Address = redef.Address
+		}
+	}
+	slices.SortStableFunc(image.Symbols, func(a, b vm.Symbol) int { return int(a.Address - b.Address) })
+	fmt.Printf("Redefined %s at 0x%04X, %d references patched\n", redef.Name, redef.Address, patched)
+	return refs, nil
+}
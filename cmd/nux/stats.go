@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// runStats is the --stats-json report
+type runStats struct {
+	Instructions          int64   `json:"instructions"`
+	WallTimeNS            int64   `json:"wall_time_ns"`
+	InstructionsPerSecond float64 `json:"instructions_per_second"`
+	MaxStackDepth         int     `json:"max_stack_depth"`
+	MaxReturnDepth        int     `json:"max_return_depth"`
+	MemoryHighWater       uint32  `json:"memory_high_water"` // End of the highest word stored to, 0 if none
+	OutputBytes           int64   `json:"output_bytes"`
+	ExitStatus            int     `json:"exit_status"`
+}
+
+func newRunStats(machine *vm.VM, elapsed time.Duration) runStats {
+	stats := machine.State().Stats
+	s := runStats{
+		Instructions:    stats.Steps,
+		WallTimeNS:      elapsed.Nanoseconds(),
+		MaxStackDepth:   stats.MaxStackDepth,
+		MaxReturnDepth:  stats.MaxReturnDepth,
+		MemoryHighWater: stats.MemoryHighWater,
+		OutputBytes:     stats.OutputBytes,
+		ExitStatus:      stats.ExitStatus,
+	}
+	if elapsed > 0 {
+		s.InstructionsPerSecond = float64(stats.Steps) / elapsed.Seconds()
+	}
+	return s
+}
+
+// writeStats prints the --stats summary to stderr and saves the
+// --stats-json report, if they were asked for
+func writeStats(machine *vm.VM, elapsed time.Duration) error {
+	if !*statsFlag && *statsJSONFlag == "" {
+		return nil
+	}
+	s := newRunStats(machine, elapsed)
+	if *statsFlag {
+		fmt.Fprintln(os.Stderr, "\n=== Stats ===")
+		s.writeSummary(os.Stderr)
+	}
+	if *statsJSONFlag == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *statsJSONFlag == "-" {
+		_, err := os.Stderr.Write(append(data, '\n'))
+		return err
+	}
+	return os.WriteFile(*statsJSONFlag, append(data, '\n'), 0644)
+}
+
+func (s runStats) writeSummary(w io.Writer) {
+	high := "none stored"
+	if s.MemoryHighWater > 0 {
+		high = fmt.Sprintf("0x%04X", s.MemoryHighWater)
+	}
+	fmt.Fprintf(w, "Instructions:       %d\n", s.Instructions)
+	fmt.Fprintf(w, "Wall time:          %v\n", time.Duration(s.WallTimeNS))
+	fmt.Fprintf(w, "Instructions/s:     %.0f\n", s.InstructionsPerSecond)
+	fmt.Fprintf(w, "Max stack depth:    %d (return stack %d)\n", s.MaxStackDepth, s.MaxReturnDepth)
+	fmt.Fprintf(w, "Memory high-water:  %s\n", high)
+	fmt.Fprintf(w, "Output:             %d bytes\n", s.OutputBytes)
+}
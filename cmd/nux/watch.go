@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// watchpoint is memory the debugger stops at when an instruction changes it
+type watchpoint struct {
+	name  string // As the user wrote it
+	addr  uint32
+	value []byte // What it held after the last check
+}
+
+// debugAddress resolves a debugger command's address: a number, decimal or
+// 0x hex, or the name of a DATA table or word from the image's debug info.
+// size is a table's size in bytes, and 0 for the others.
+func debugAddress(image *vm.Image, text string) (addr, size uint32, err error) {
+	if n, err := strconv.ParseUint(text, 0, 32); err == nil {
+		return uint32(n), 0, nil
+	}
+	name := strings.ToUpper(text)
+	if t, ok := image.LookupTable(name); ok {
+		return uint32(t.Address), uint32(t.Size), nil
+	}
+	if sym, ok := image.Lookup(name); ok {
+		return uint32(sym.Address), 0, nil
+	}
+	if len(image.Symbols) == 0 && len(image.Tables) == 0 {
+		return 0, 0, fmt.Errorf("bad address %q (compile with luxc -g to use names)", text)
+	}
+	return 0, 0, fmt.Errorf("%q is neither an address nor a table or word of the program", text)
+}
+
+// watch handles the debugger's watch command: with no arguments it lists
+// the watchpoints, and otherwise adds one on ADDR, a cell, or on a whole
+// DATA table by name
+func watch(machine *vm.VM, image *vm.Image, watches []*watchpoint, args []string) ([]*watchpoint, error) {
+	if len(args) == 0 {
+		if len(watches) == 0 {
+			fmt.Println("No watchpoints")
+		}
+		for _, w := range watches {
+			fmt.Printf("%s at 0x%04X: %s\n", w.name, w.addr, formatWatched(w.value))
+		}
+		return watches, nil
+	}
+	if len(args) != 1 {
+		return watches, fmt.Errorf("usage: watch [ADDR|NAME]")
+	}
+	addr, size, err := debugAddress(image, args[0])
+	if err != nil {
+		return watches, err
+	}
+	if size == 0 {
+		size = 4
+	}
+	mem := machine.Memory()
+	if uint64(addr)+uint64(size) > uint64(len(mem)) {
+		return watches, fmt.Errorf("%d bytes at 0x%X run past the end of memory (0x%X)", size, addr, len(mem))
+	}
+	w := &watchpoint{name: args[0], addr: addr, value: bytes.Clone(mem[addr : addr+size])}
+	fmt.Printf("Watching %s at 0x%04X: %s\n", w.name, w.addr, formatWatched(w.value))
+	return append(watches, w), nil
+}
+
+// unwatch handles the debugger's unwatch command, which removes the
+// watchpoints on ADDR or NAME, or with no argument all of them
+func unwatch(watches []*watchpoint, args []string) []*watchpoint {
+	if len(args) == 0 {
+		return nil
+	}
+	var kept []*watchpoint
+	for _, w := range watches {
+		if !strings.EqualFold(w.name, args[0]) {
+			kept = append(kept, w)
+		}
+	}
+	if len(kept) == len(watches) {
+		fmt.Printf("No watchpoint on %s\n", args[0])
+	}
+	return kept
+}
+
+// checkWatches reports each watchpoint whose memory the instruction at pc
+// changed, and whether there was one
+func checkWatches(machine *vm.VM, image *vm.Image, watches []*watchpoint, pc uint32) bool {
+	mem := machine.Memory()
+	hit := false
+	for _, w := range watches {
+		now := mem[w.addr : w.addr+uint32(len(w.value))]
+		if bytes.Equal(now, w.value) {
+			continue
+		}
+		fmt.Printf("%s changed: %s → %s by %s at 0x%04X%s\n", w.name, formatWatched(w.value), formatWatched(now),
+			vm.OpcodeName(mem[pc]), pc, wordIn(image, pc))
+		w.value = bytes.Clone(now)
+		hit = true
+	}
+	return hit
+}
+
+// wordIn returns " in NAME" for the word containing pc, the last one in the
+// image's symbol table starting at or before it, or "" without symbols
+func wordIn(image *vm.Image, pc uint32) string {
+	var found *vm.Symbol
+	for i, sym := range image.Symbols {
+		if uint32(sym.Address) <= pc && (found == nil || sym.Address > found.Address) {
+			found = &image.Symbols[i]
+		}
+	}
+	if found == nil {
+		return ""
+	}
+	return " in " + found.Name
+}
+
+// formatWatched shows watched memory as the cells it holds
+func formatWatched(value []byte) string {
+	cells := make([]int32, len(value)/4)
+	for i := range cells {
+		cells[i] = int32(binary.BigEndian.Uint32(value[4*i:]))
+	}
+	if len(cells) == 1 {
+		return vm.FormatValues(cells)
+	}
+	return "[" + vm.FormatValues(cells) + "]"
+}
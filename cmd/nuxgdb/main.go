@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+var (
+	addrFlag = flag.String("addr", "localhost:1234", "Address to wait for the debugger on")
+	verbose  = flag.Bool("v", false, "Log every packet to stderr")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: nuxgdb [options] <program.lux|program.nux>")
+		fmt.Println("\nThen attach with: target remote localhost:1234")
+		fmt.Println("\nOptions:")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	file := flag.Arg(0)
+	image, err := lux.LoadImage(file, lux.CompileOptions{LibPath: lux.DefaultLibPath()})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	machine, err := vm.NewVMForImage(image)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", *addrFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Debugging %s; waiting for a debugger on %s\n", file, listener.Addr())
+	conn, err := listener.Accept()
+	listener.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Debugger attached from %s\n", conn.RemoteAddr())
+	stub := newStub(conn, image, machine)
+	if err := stub.serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Debugger detached")
+}
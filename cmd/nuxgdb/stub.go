@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// targetXML describes the registers the stub reports, in order. The VM has
+// no stack pointer in memory: sp and rsp are the depths of the data and
+// return stacks, and tos is the top of the data stack (0 when empty).
+const targetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.nuxvm.core">
+    <reg name="pc" bitsize="32" type="code_ptr" regnum="0"/>
+    <reg name="sp" bitsize="32" type="uint32"/>
+    <reg name="rsp" bitsize="32" type="uint32"/>
+    <reg name="tos" bitsize="32" type="int32"/>
+  </feature>
+</target>
+`
+
+// Stop signals reported to the debugger
+const (
+	sigInt  = 0x02 // Interrupted with Ctrl-C
+	sigIll  = 0x04 // The VM raised an error
+	sigTrap = 0x05 // Breakpoint or single step
+)
+
+// interruptCheckInterval is how many instructions continue runs between
+// checks for a Ctrl-C from the debugger
+const interruptCheckInterval = 1024
+
+// stub speaks the GDB remote serial protocol for one debugger session
+type stub struct {
+	conn        net.Conn
+	out         *bufio.Writer
+	image       *vm.Image
+	machine     *vm.VM
+	breakpoints map[uint32]bool
+	noAck       bool
+	packets     chan string   // Packets read from the debugger, in order
+	interrupt   chan struct{} // Ctrl-C bytes read from the debugger
+	readErr     error         // Why the debugger stopped sending
+}
+
+func newStub(conn net.Conn, image *vm.Image, machine *vm.VM) *stub {
+	return &stub{
+		conn:        conn,
+		out:         bufio.NewWriter(conn),
+		image:       image,
+		machine:     machine,
+		breakpoints: make(map[uint32]bool),
+		packets:     make(chan string),
+		interrupt:   make(chan struct{}, 1),
+	}
+}
+
+// serve answers packets until the debugger detaches, kills the program or
+// hangs up
+func (s *stub) serve() error {
+	defer s.conn.Close()
+	received := make(chan string)
+	go s.read(received)
+	go queue(received, s.packets)
+	for packet := range s.packets {
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "<- %s\n", packet)
+		}
+		reply, done := s.handle(packet)
+		if err := s.send(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	if s.readErr == io.EOF {
+		return nil
+	}
+	return s.readErr
+}
+
+// read splits the byte stream into packets, acknowledging each one, and
+// turns a bare 0x03 into an interrupt
+func (s *stub) read(packets chan<- string) {
+	defer close(packets)
+	in := bufio.NewReader(s.conn)
+	for {
+		b, err := in.ReadByte()
+		if err != nil {
+			s.readErr = err
+			return
+		}
+		switch b {
+		case 0x03:
+			select {
+			case s.interrupt <- struct{}{}:
+			default:
+			}
+			continue
+		case '$':
+		default:
+			continue // Acks, and noise between packets
+		}
+		data, err := in.ReadString('#')
+		if err != nil {
+			s.readErr = err
+			return
+		}
+		data = data[:len(data)-1]
+		var sum [2]byte
+		if _, err := io.ReadFull(in, sum[:]); err != nil {
+			s.readErr = err
+			return
+		}
+		want, err := strconv.ParseUint(string(sum[:]), 16, 8)
+		if err != nil || byte(want) != checksum(data) {
+			if !s.noAck {
+				s.conn.Write([]byte("-"))
+			}
+			continue
+		}
+		if !s.noAck {
+			s.conn.Write([]byte("+"))
+		}
+		packets <- data
+	}
+}
+
+// queue passes packets from in to out, holding any that arrive while the
+// previous one is still being handled. read never waits on serve, so a
+// Ctrl-C that follows a packet sent during a continue still stops it.
+func queue(in <-chan string, out chan<- string) {
+	defer close(out)
+	var pending []string
+	for in != nil || len(pending) > 0 {
+		var send chan<- string
+		var next string
+		if len(pending) > 0 {
+			send, next = out, pending[0]
+		}
+		select {
+		case packet, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, packet)
+		case send <- next:
+			pending = pending[1:]
+		}
+	}
+}
+
+func checksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// send writes a reply packet. Acks from the debugger are not waited for:
+// TCP already delivers the bytes intact.
+func (s *stub) send(reply string) error {
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "-> %s\n", reply)
+	}
+	fmt.Fprintf(s.out, "$%s#%02x", reply, checksum(reply))
+	return s.out.Flush()
+}
+
+// handle answers one packet; done reports that the session is over
+func (s *stub) handle(packet string) (reply string, done bool) {
+	if packet == "" {
+		return "", false
+	}
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return s.stopReply(sigTrap), false
+	case 'g':
+		return s.registers(), false
+	case 'G':
+		return s.writeRegisters(args), false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 32)
+		if err != nil || n > 3 {
+			return "E01", false
+		}
+		return s.registers()[n*8 : n*8+8], false
+	case 'P':
+		return s.writeRegister(args), false
+	case 'm':
+		return s.readMemory(args), false
+	case 'M':
+		return s.writeMemory(args), false
+	case 'Z', 'z':
+		return s.breakpoint(packet[0] == 'Z', args), false
+	case 's':
+		return s.step(), false
+	case 'c':
+		return s.cont(), false
+	case 'H', 'T':
+		return "OK", false // A single thread
+	case 'D':
+		return "OK", true
+	case 'k':
+		return "OK", true
+	case 'q':
+		return s.query(args), false
+	case 'Q':
+		if args == "StartNoAckMode" {
+			s.noAck = true
+			return "OK", false
+		}
+	}
+	return "", false // Not supported
+}
+
+// query answers the general queries debuggers send while attaching
+func (s *stub) query(args string) string {
+	switch {
+	case strings.HasPrefix(args, "Supported"):
+		return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+"
+	case args == "Attached":
+		return "1"
+	case args == "C":
+		return "QC1"
+	case args == "fThreadInfo":
+		return "m1"
+	case args == "sThreadInfo":
+		return "l"
+	case strings.HasPrefix(args, "Xfer:features:read:target.xml:"):
+		var offset, length int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(args, "Xfer:features:read:target.xml:"), "%x,%x", &offset, &length); err != nil {
+			return "E01"
+		}
+		if offset >= len(targetXML) {
+			return "l"
+		}
+		end := min(offset+length, len(targetXML))
+		if end == len(targetXML) {
+			return "l" + targetXML[offset:end]
+		}
+		return "m" + targetXML[offset:end]
+	case strings.HasPrefix(args, "Rcmd,"):
+		command, err := hex.DecodeString(strings.TrimPrefix(args, "Rcmd,"))
+		if err != nil {
+			return "E01"
+		}
+		return hex.EncodeToString([]byte(s.monitor(string(command))))
+	}
+	return ""
+}
+
+// monitor runs a `monitor` command typed into the debugger
+func (s *stub) monitor(command string) string {
+	switch strings.TrimSpace(command) {
+	case "stack":
+		return fmt.Sprintf("Stack: %v\nReturn stack: %v\n", s.machine.Stack(), s.machine.ReturnStack())
+	case "words":
+		var b strings.Builder
+		for _, sym := range s.image.Symbols {
+			fmt.Fprintf(&b, "0x%04X %s\n", sym.Address, sym.Name)
+		}
+		if b.Len() == 0 {
+			return "The program has no symbol table\n"
+		}
+		return b.String()
+	case "explain":
+		return s.machine.Explain(s.image.Symbols) + "\n"
+	}
+	return "Monitor commands: stack, words, explain\n"
+}
+
+// registers encodes pc, sp, rsp and tos as little-endian hex
+func (s *stub) registers() string {
+	stack := s.machine.Stack()
+	var tos int32
+	if len(stack) > 0 {
+		tos = stack[len(stack)-1]
+	}
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint32(buf[0:], s.machine.PC())
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(stack)))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(s.machine.ReturnStack())))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(tos))
+	return hex.EncodeToString(buf)
+}
+
+// writeRegisters accepts a new pc; the other registers describe the
+// stacks and cannot be written
+func (s *stub) writeRegisters(args string) string {
+	if len(args) < 8 {
+		return "E01"
+	}
+	return s.writeRegister("0=" + args[:8])
+}
+
+func (s *stub) writeRegister(args string) string {
+	n, value, ok := strings.Cut(args, "=")
+	if !ok || n != "0" {
+		return "E01"
+	}
+	buf, err := hex.DecodeString(value)
+	if err != nil || len(buf) != 4 {
+		return "E01"
+	}
+	snap := s.machine.Snapshot()
+	snap.PC = binary.LittleEndian.Uint32(buf)
+	s.machine.Restore(snap)
+	return "OK"
+}
+
+// memoryRange parses "addr,length" and checks it lies inside memory
+func (s *stub) memoryRange(args string) (int, int, bool) {
+	addr, length, ok := strings.Cut(args, ",")
+	start, err1 := strconv.ParseUint(addr, 16, 32)
+	n, err2 := strconv.ParseUint(length, 16, 32)
+	if !ok || err1 != nil || err2 != nil || start+n > uint64(len(s.machine.Memory())) {
+		return 0, 0, false
+	}
+	return int(start), int(n), true
+}
+
+func (s *stub) readMemory(args string) string {
+	start, n, ok := s.memoryRange(args)
+	if !ok {
+		return "E01"
+	}
+	return hex.EncodeToString(s.machine.Memory()[start : start+n])
+}
+
+func (s *stub) writeMemory(args string) string {
+	where, data, ok := strings.Cut(args, ":")
+	start, n, inside := s.memoryRange(where)
+	bytes, err := hex.DecodeString(data)
+	if !ok || !inside || err != nil || len(bytes) != n {
+		return "E01"
+	}
+	copy(s.machine.Memory()[start:], bytes)
+	return "OK"
+}
+
+// breakpoint sets or clears a software (Z0) or hardware (Z1) breakpoint;
+// both stop before the instruction at the address runs
+func (s *stub) breakpoint(set bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) < 2 || (parts[0] != "0" && parts[0] != "1") {
+		return "" // Watchpoints are not supported
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return "E01"
+	}
+	if set {
+		s.breakpoints[uint32(addr)] = true
+	} else {
+		delete(s.breakpoints, uint32(addr))
+	}
+	return "OK"
+}
+
+// step runs one instruction
+func (s *stub) step() string {
+	if !s.machine.Running() {
+		return "W00"
+	}
+	_, err := s.machine.Step()
+	s.machine.Flush()
+	if err != nil {
+		return s.fault(err)
+	}
+	return s.stopReply(sigTrap)
+}
+
+// cont runs until a breakpoint, the end of the program, an error or a
+// Ctrl-C from the debugger. A breakpoint at the current PC does not stop
+// the first instruction, so continuing from a breakpoint moves on.
+func (s *stub) cont() string {
+	select {
+	case <-s.interrupt: // A Ctrl-C sent while stopped
+	default:
+	}
+	defer s.machine.Flush()
+	for steps := 0; s.machine.Running(); steps++ {
+		if steps > 0 && s.breakpoints[s.machine.PC()] {
+			return s.stopReply(sigTrap)
+		}
+		if steps%interruptCheckInterval == 0 {
+			select {
+			case <-s.interrupt:
+				return s.stopReply(sigInt)
+			default:
+			}
+		}
+		if _, err := s.machine.Step(); err != nil {
+			return s.fault(err)
+		}
+	}
+	return "W00"
+}
+
+// fault reports a VM error: the message goes to the debugger's console,
+// then the program stops as if it had hit an illegal instruction
+func (s *stub) fault(err error) string {
+	message := fmt.Sprintf("VM error at PC=0x%X: %v\n", s.machine.PC(), err)
+	s.send("O" + hex.EncodeToString([]byte(message)))
+	return s.stopReply(sigIll)
+}
+
+// stopReply tells the debugger why the program stopped, with the pc so it
+// need not ask
+func (s *stub) stopReply(signal int) string {
+	if !s.machine.Running() {
+		return "W00"
+	}
+	return fmt.Sprintf("T%02xthread:1;00:%s;", signal, s.registers()[:8])
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// client is the debugger's end of a pipe to a serving stub. A goroutine
+// reads everything the stub sends, checking each reply's checksum, so the
+// stub never blocks writing an ack while the test is writing a packet.
+type client struct {
+	t       *testing.T
+	conn    net.Conn
+	replies chan string
+	acks    chan byte
+	served  chan error
+}
+
+// attach starts a stub for code loaded at the start of user memory
+func attach(t *testing.T, code []byte) *client {
+	t.Helper()
+	image := &vm.Image{Code: code}
+	machine, err := vm.NewVMForImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugger, target := net.Pipe()
+	c := &client{
+		t:       t,
+		conn:    debugger,
+		replies: make(chan string, 16),
+		acks:    make(chan byte, 16),
+		served:  make(chan error, 1),
+	}
+	go func() { c.served <- newStub(target, image, machine).serve() }()
+	go c.receive()
+	t.Cleanup(func() { debugger.Close() })
+	return c
+}
+
+func (c *client) receive() {
+	defer close(c.replies)
+	in := bufio.NewReader(c.conn)
+	for {
+		b, err := in.ReadByte()
+		if err != nil {
+			return
+		}
+		if b == '+' || b == '-' {
+			c.acks <- b
+			continue
+		}
+		if b != '$' {
+			c.t.Errorf("stray byte %q between packets", b)
+			continue
+		}
+		data, err := in.ReadString('#')
+		if err != nil {
+			return
+		}
+		data = data[:len(data)-1]
+		var sum [2]byte
+		if _, err := io.ReadFull(in, sum[:]); err != nil {
+			return
+		}
+		if want := fmt.Sprintf("%02x", checksum(data)); string(sum[:]) != want {
+			c.t.Errorf("reply %q has checksum %s, want %s", data, sum[:], want)
+		}
+		c.replies <- data
+	}
+}
+
+// write sends raw bytes to the stub
+func (c *client) write(raw string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(raw)); err != nil {
+		c.t.Fatalf("write %q: %v", raw, err)
+	}
+}
+
+// send frames a packet with its checksum
+func (c *client) send(packet string) {
+	c.t.Helper()
+	c.write(fmt.Sprintf("$%s#%02x", packet, checksum(packet)))
+}
+
+func (c *client) reply() string {
+	c.t.Helper()
+	select {
+	case reply, ok := <-c.replies:
+		if !ok {
+			c.t.Fatal("stub hung up")
+		}
+		return reply
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no reply from the stub")
+	}
+	return ""
+}
+
+func (c *client) ask(packet string) string {
+	c.t.Helper()
+	c.send(packet)
+	return c.reply()
+}
+
+func (c *client) expect(packet, want string) {
+	c.t.Helper()
+	if got := c.ask(packet); got != want {
+		c.t.Errorf("%s: got %q, want %q", packet, got, want)
+	}
+}
+
+// le encodes a register value the way g and p report it
+func le(value uint32) string {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, value)
+	return hex.EncodeToString(buf)
+}
+
+func stopAt(signal int, pc uint32) string {
+	return fmt.Sprintf("T%02xthread:1;00:%s;", signal, le(pc))
+}
+
+const base = uint32(vm.UserMemoryOffset)
+
+func program(parts ...[]byte) []byte {
+	var code []byte
+	for _, part := range parts {
+		code = append(code, part...)
+	}
+	return code
+}
+
+func TestPacketFraming(t *testing.T) {
+	if sum := checksum("qSupported"); sum != 0x37 {
+		t.Errorf("checksum(qSupported) = %02x, want 37", sum)
+	}
+	c := attach(t, []byte{vm.OpHalt})
+
+	c.write("+$?#3f")
+	if ack := <-c.acks; ack != '+' {
+		t.Errorf("ack = %q, want '+'", ack)
+	}
+	if got := c.reply(); got != stopAt(sigTrap, base) {
+		t.Errorf("? = %q, want %q", got, stopAt(sigTrap, base))
+	}
+
+	// A corrupt packet is refused and not answered; the next is handled
+	c.write("$?#00")
+	if ack := <-c.acks; ack != '-' {
+		t.Errorf("ack for a bad checksum = %q, want '-'", ack)
+	}
+	c.expect("qAttached", "1")
+	<-c.acks
+	c.expect("vMustReplyEmpty", "")
+	<-c.acks
+
+	c.expect("QStartNoAckMode", "OK")
+	<-c.acks
+	c.expect("qC", "QC1")
+	select {
+	case ack := <-c.acks:
+		t.Errorf("got ack %q after QStartNoAckMode", ack)
+	default:
+	}
+
+	c.expect("D", "OK")
+	if err := <-c.served; err != nil {
+		t.Errorf("serve after detach: %v", err)
+	}
+}
+
+func TestRegistersAndMemory(t *testing.T) {
+	push5 := vm.PushInstruction(5)
+	c := attach(t, program(push5, []byte{vm.OpHalt}))
+	c.expect("QStartNoAckMode", "OK")
+	<-c.acks
+
+	c.expect("g", le(base)+le(0)+le(0)+le(0))
+	c.expect("p0", le(base))
+	c.expect("p4", "E01")
+
+	c.expect(fmt.Sprintf("m%x,%x", base, len(push5)), hex.EncodeToString(push5))
+	c.expect(fmt.Sprintf("m%x,4", base+uint32(len(push5))), "E01") // Past the end of memory
+	c.expect("mzz,1", "E01")
+
+	c.expect("s", stopAt(sigTrap, base+uint32(len(push5))))
+	c.expect("g", le(base+uint32(len(push5)))+le(1)+le(0)+le(5))
+	c.expect("p3", le(5))
+
+	// Writing pc moves execution; the stack registers are read-only
+	c.expect("P0="+le(base), "OK")
+	c.expect("p0", le(base))
+	c.expect("P1="+le(0), "E01")
+	c.expect("P0=12", "E01")
+	c.expect("G"+le(base+1)+le(0)+le(0)+le(0), "OK")
+	c.expect("p0", le(base+1))
+	c.expect("G12", "E01")
+
+	// Memory writes must match their length and stay inside memory
+	c.expect(fmt.Sprintf("M%x,2:abcd", base+1), "OK")
+	c.expect(fmt.Sprintf("m%x,3", base), hex.EncodeToString([]byte{vm.OpPush, 0xab, 0xcd}))
+	c.expect(fmt.Sprintf("M%x,2:ab", base), "E01")
+	c.expect(fmt.Sprintf("M%x,2:abcd", base+uint32(len(push5))), "E01")
+}
+
+func TestTargetXMLInChunks(t *testing.T) {
+	c := attach(t, []byte{vm.OpHalt})
+	c.expect("QStartNoAckMode", "OK")
+	<-c.acks
+
+	var xml strings.Builder
+	for offset := 0; ; offset += 0x40 {
+		reply := c.ask(fmt.Sprintf("qXfer:features:read:target.xml:%x,40", offset))
+		if reply == "" || (reply[0] != 'm' && reply[0] != 'l') {
+			t.Fatalf("qXfer at %d: got %q", offset, reply)
+		}
+		xml.WriteString(reply[1:])
+		if reply[0] == 'l' {
+			break
+		}
+		if len(reply) != 0x41 {
+			t.Fatalf("qXfer at %d: got %d bytes, want 64", offset, len(reply)-1)
+		}
+	}
+	if xml.String() != targetXML {
+		t.Errorf("target.xml read in chunks = %q, want %q", xml.String(), targetXML)
+	}
+	c.expect(fmt.Sprintf("qXfer:features:read:target.xml:%x,10", len(targetXML)), "l")
+	c.expect("qXfer:features:read:target.xml:10", "E01")
+}
+
+func TestBreakpoints(t *testing.T) {
+	push := vm.PushInstruction(1)
+	step := uint32(len(push))
+	c := attach(t, program(push, push, push, push, []byte{vm.OpHalt}))
+	c.expect("QStartNoAckMode", "OK")
+	<-c.acks
+
+	c.expect(fmt.Sprintf("Z0,%x,1", base+step), "OK")
+	c.expect(fmt.Sprintf("Z1,%x,1", base+3*step), "OK")
+	c.expect(fmt.Sprintf("Z1,%x,1", base+2*step), "OK")
+	c.expect(fmt.Sprintf("z1,%x,1", base+2*step), "OK")
+	c.expect(fmt.Sprintf("Z2,%x,4", base), "") // Watchpoints are not supported
+	c.expect("Z0,zz,1", "E01")
+
+	// Each continue leaves the breakpoint it starts on
+	c.expect("c", stopAt(sigTrap, base+step))
+	c.expect("c", stopAt(sigTrap, base+3*step))
+	c.expect("c", "W00")
+	c.expect("s", "W00")
+}
+
+func TestFaultIsReported(t *testing.T) {
+	c := attach(t, []byte{vm.OpAdd, vm.OpHalt})
+	c.expect("QStartNoAckMode", "OK")
+	<-c.acks
+
+	c.send("c")
+	console, err := hex.DecodeString(strings.TrimPrefix(c.reply(), "O"))
+	if err != nil || !strings.Contains(string(console), "VM error at PC=") {
+		t.Errorf("console output = %q, %v; want the VM error", console, err)
+	}
+	if got := c.reply(); !strings.HasPrefix(got, fmt.Sprintf("T%02x", sigIll)) {
+		t.Errorf("stop reply = %q, want signal %02x", got, sigIll)
+	}
+}
+
+// A packet sent while the program runs must not hide a later Ctrl-C
+func TestInterruptAfterPacketDuringContinue(t *testing.T) {
+	c := attach(t, vm.JmpInstruction(int32(base)))
+	c.expect("QStartNoAckMode", "OK")
+	<-c.acks
+
+	c.send("c")
+	c.send(fmt.Sprintf("m%x,1", base))
+	interrupted := make(chan struct{})
+	defer close(interrupted)
+	go func() {
+		// Ctrl-C until the stub stops: one sent before the continue
+		// starts running is discarded as stale
+		for {
+			select {
+			case <-interrupted:
+				return
+			case <-time.After(10 * time.Millisecond):
+				if _, err := c.conn.Write([]byte{0x03}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	if got := c.reply(); got != stopAt(sigInt, base) {
+		t.Errorf("continue: got %q, want %q", got, stopAt(sigInt, base))
+	}
+	if got, want := c.reply(), hex.EncodeToString([]byte{vm.OpJmp}); got != want {
+		t.Errorf("memory read sent during continue: got %q, want %q", got, want)
+	}
+
+	c.expect("k", "OK")
+	if err := <-c.served; err != nil {
+		t.Errorf("serve after kill: %v", err)
+	}
+}
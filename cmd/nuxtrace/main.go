@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+var programFlag = flag.String("program", "", "The program the trace was recorded from, to name words from its symbols")
+
+func usage() {
+	fmt.Println("Usage: nuxtrace [options] <trace> <query>")
+	fmt.Println("\nQueries (numbers may be hex, e.g. 0x1040, and use _, e.g. 1_000_000):")
+	fmt.Println("  info                 Steps and checkpoints in the trace")
+	fmt.Println("  state STEP           The VM's state before STEP ran")
+	fmt.Println("  step STEP            The instruction STEP ran and the words it stored")
+	fmt.Println("  last-write ADDR [STEP]")
+	fmt.Println("                       The last store to ADDR before STEP (default: the end)")
+	fmt.Println("  dump STEP ADDR [LEN] Memory before STEP ran")
+	fmt.Println("\nRecord a trace with: nux --record trace.nuxt program.nux")
+	fmt.Println("\nOptions:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading trace: %v\n", err)
+		os.Exit(1)
+	}
+	trace, err := vm.ParseTimeTrace(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	var opts vm.DebugOptions
+	if *programFlag != "" {
+		image, err := loadImage(*programFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", *programFlag, err)
+			os.Exit(1)
+		}
+		opts.Symbols = image.Symbols
+	}
+	if err := query(trace, opts, flag.Arg(1), flag.Args()[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func loadImage(name string) (*vm.Image, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return vm.ParseImage(data)
+}
+
+// numbers parses the query's arguments, of which the first required are needed
+func numbers(args []string, required int, usage string) ([]int64, error) {
+	if len(args) < required || len(args) > strings.Count(usage, " ") {
+		return nil, fmt.Errorf("usage: %s", usage)
+	}
+	nums := make([]int64, len(args))
+	for i, arg := range args {
+		n, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", arg)
+		}
+		nums[i] = n
+	}
+	return nums, nil
+}
+
+func query(trace *vm.TimeTrace, opts vm.DebugOptions, name string, args []string) error {
+	switch name {
+	case "info":
+		fmt.Printf("Steps: %d\n", trace.Steps())
+		fmt.Printf("Checkpoint every: %d steps\n", trace.Interval)
+		return nil
+	case "state":
+		nums, err := numbers(args, 1, "state STEP")
+		if err != nil {
+			return err
+		}
+		snap, err := trace.StateAt(nums[0])
+		if err != nil {
+			return err
+		}
+		machine := vm.NewVM(nil)
+		machine.Restore(snap)
+		fmt.Printf("Before step %d:\n%s", nums[0], machine.DebugState(opts))
+		return nil
+	case "step":
+		nums, err := numbers(args, 1, "step STEP")
+		if err != nil {
+			return err
+		}
+		s, err := trace.StepAt(nums[0])
+		if err != nil {
+			return err
+		}
+		printStep(s)
+		return nil
+	case "last-write":
+		nums, err := numbers(args, 1, "last-write ADDR [STEP]")
+		if err != nil {
+			return err
+		}
+		before := trace.Steps()
+		if len(nums) > 1 {
+			before = nums[1]
+		}
+		s, ok, err := trace.LastWrite(uint32(nums[0]), before)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Printf("Nothing stored to 0x%X before step %d\n", nums[0], before)
+			return nil
+		}
+		printStep(s)
+		return nil
+	case "dump":
+		nums, err := numbers(args, 2, "dump STEP ADDR [LEN]")
+		if err != nil {
+			return err
+		}
+		length := int64(64)
+		if len(nums) > 2 {
+			length = nums[2]
+		}
+		snap, err := trace.StateAt(nums[0])
+		if err != nil {
+			return err
+		}
+		addr := nums[1]
+		if addr < 0 || addr >= int64(len(snap.Memory)) {
+			return fmt.Errorf("address 0x%X is outside memory (0x%X)", addr, len(snap.Memory))
+		}
+		vm.HexDump(os.Stdout, uint32(addr), snap.Memory[addr:min(addr+max(length, 0), int64(len(snap.Memory)))])
+		return nil
+	}
+	return fmt.Errorf("unknown query %q (want info, state, step, last-write or dump)", name)
+}
+
+func printStep(s vm.TraceStep) {
+	fmt.Printf("Step %d: PC 0x%X %s\n", s.Step, s.PC, vm.OpcodeName(s.Op))
+	for _, w := range s.Writes {
+		fmt.Printf("  stored %d (0x%X) at 0x%X\n", w.Value, uint32(w.Value), w.Addr)
+	}
+}
@@ -0,0 +1,223 @@
+// Package actors runs many isolated VMs of one program as actors. Each
+// actor has its own memory and stacks and a mailbox of cells; actors share
+// nothing and talk only by sending messages. A supervisor restarts actors
+// that crash from the state they started in.
+//
+// LUX code uses the actor system through host functions, under the
+// "actors" capability:
+//
+//	SPAWN   ( quotation -- id )   start an actor running the quotation
+//	SEND    ( msg id -- )         put msg in the mailbox of actor id
+//	RECEIVE ( -- msg )            wait for the next message
+//	SELF    ( -- id )
+package actors
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// CapabilityActors is the capability the actor host functions need
+const CapabilityActors = "actors"
+
+// Policy says what the supervisor does when an actor crashes
+type Policy int
+
+const (
+	Stop    Policy = iota // A crashed actor stays down
+	Restart               // A crashed actor starts again from its first state
+)
+
+// Options configures a System
+type Options struct {
+	Policy      Policy
+	MaxRestarts int          // Restarts allowed per actor under Restart; 0 means 3
+	MailboxSize int          // Messages a mailbox holds before SEND waits; 0 means 64
+	Setup       func(*vm.VM) // Called on each actor's VM before it starts, e.g. to set OutputHandler
+}
+
+// Failure records an actor that crashed
+type Failure struct {
+	Actor     int32
+	Err       error
+	Restarted bool
+}
+
+// System is a set of actors running one program
+type System struct {
+	program []byte
+	opts    Options
+
+	mu       sync.Mutex
+	actors   map[int32]*actor
+	next     int32
+	failures []Failure
+
+	wg       sync.WaitGroup
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type actor struct {
+	id       int32
+	entry    uint32 // 0 for the program's toplevel code
+	machine  *vm.VM
+	initial  *vm.Snapshot
+	mailbox  chan int32
+	restarts int
+}
+
+// errStopped ends an actor waiting in RECEIVE or SEND when the system stops
+var errStopped = errors.New("actor system stopped")
+
+// NewSystem returns a System for program with no actors yet
+func NewSystem(program []byte, opts Options) *System {
+	if opts.MaxRestarts == 0 {
+		opts.MaxRestarts = 3
+	}
+	if opts.MailboxSize == 0 {
+		opts.MailboxSize = 64
+	}
+	return &System{
+		program: program,
+		opts:    opts,
+		actors:  make(map[int32]*actor),
+		done:    make(chan struct{}),
+	}
+}
+
+// Spawn starts an actor running the word or quotation at entry, or the
+// program's toplevel code if entry is 0, and returns its id
+func (s *System) Spawn(entry uint32) (int32, error) {
+	if entry != 0 && (entry < vm.UserMemoryOffset || int(entry) >= vm.UserMemoryOffset+len(s.program)) {
+		return 0, fmt.Errorf("spawn: address %d is outside the program", entry)
+	}
+	machine := vm.NewVMWithCapabilities(s.program, CapabilityActors)
+	if s.opts.Setup != nil {
+		s.opts.Setup(machine)
+	}
+
+	s.mu.Lock()
+	s.next++
+	a := &actor{
+		id:      s.next,
+		entry:   entry,
+		machine: machine,
+		mailbox: make(chan int32, s.opts.MailboxSize),
+	}
+	s.actors[a.id] = a
+	s.mu.Unlock()
+
+	s.register(a)
+	a.initial = machine.Snapshot()
+	s.wg.Add(1)
+	go s.run(a)
+	return a.id, nil
+}
+
+// Send puts msg in the mailbox of actor to, waiting while the mailbox is
+// full. Sending to an actor that has finished is an error.
+func (s *System) Send(to, msg int32) error {
+	s.mu.Lock()
+	a, ok := s.actors[to]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no actor %d", to)
+	}
+	select {
+	case a.mailbox <- msg:
+		return nil
+	case <-s.done:
+		return errStopped
+	}
+}
+
+// Wait waits for every actor to finish and returns the crashes seen. Actors
+// waiting for messages never finish on their own; Stop ends them.
+func (s *System) Wait() []Failure {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Failure{}, s.failures...)
+}
+
+// Stop ends every actor waiting in RECEIVE or SEND. Actors still computing
+// finish what they are doing first.
+func (s *System) Stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// run runs an actor to the end, restarting it after crashes as the policy
+// allows
+func (s *System) run(a *actor) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.actors, a.id)
+		s.mu.Unlock()
+	}()
+	for {
+		var err error
+		if a.entry == 0 {
+			err = a.machine.Run()
+		} else {
+			err = a.machine.CallWord(a.entry)
+		}
+		if err == nil || errors.Is(err, errStopped) {
+			return
+		}
+		restart := s.opts.Policy == Restart && a.restarts < s.opts.MaxRestarts
+		s.mu.Lock()
+		s.failures = append(s.failures, Failure{Actor: a.id, Err: err, Restarted: restart})
+		s.mu.Unlock()
+		if !restart {
+			return
+		}
+		a.restarts++
+		a.machine.Restore(a.initial)
+	}
+}
+
+// register gives an actor's VM the LUX actor API. Messages to actors that
+// have finished are dropped, as a finished actor would never read them.
+func (s *System) register(a *actor) {
+	a.machine.RegisterHost("SPAWN", CapabilityActors, func(m *vm.VM) error {
+		entry, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		id, err := s.Spawn(uint32(entry))
+		if err != nil {
+			return err
+		}
+		return m.Push(id)
+	})
+	a.machine.RegisterHost("SEND", CapabilityActors, func(m *vm.VM) error {
+		to, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		msg, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		if err := s.Send(to, msg); err == errStopped {
+			return err
+		}
+		return nil
+	})
+	a.machine.RegisterHost("RECEIVE", CapabilityActors, func(m *vm.VM) error {
+		select {
+		case msg := <-a.mailbox:
+			return m.Push(msg)
+		case <-s.done:
+			return errStopped
+		}
+	})
+	a.machine.RegisterHost("SELF", CapabilityActors, func(m *vm.VM) error {
+		return m.Push(a.id)
+	})
+}
@@ -0,0 +1,134 @@
+package actors
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// output collects what every actor prints, one line per number
+type output struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (o *output) setup(m *vm.VM) {
+	m.OutputHandler = func(value, format int32) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		fmt.Fprintf(&o.b, "%d\n", value)
+	}
+}
+
+func (o *output) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.b.String()
+}
+
+func compile(t *testing.T, source string) []byte {
+	t.Helper()
+	code, err := lux.Compile(source)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	return code
+}
+
+func TestSpawnSendReceive(t *testing.T) {
+	// The toplevel actor (1) spawns a worker (2), which doubles the
+	// number it receives and sends it back
+	program := compile(t, `
+		@worker host:receive 2 * 1 host:send ;
+		[ worker ] host:spawn
+		21 swap host:send
+		host:receive .
+		host:self .
+	`)
+	var out output
+	system := NewSystem(program, Options{Setup: out.setup})
+	if _, err := system.Spawn(0); err != nil {
+		t.Fatalf("Spawn failed: %v", err)
+	}
+	if failures := system.Wait(); len(failures) != 0 {
+		t.Fatalf("Unexpected failures: %v", failures)
+	}
+	if got := out.String(); got != "42\n1\n" {
+		t.Errorf("Expected 42 then 1, got %q", got)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	// Dividing by a message of 0 crashes the actor; it restarts with its
+	// mailbox intact and handles the next message
+	program := compile(t, "host:receive 10 swap / .")
+	var out output
+	system := NewSystem(program, Options{Policy: Restart, Setup: out.setup})
+	id, _ := system.Spawn(0)
+	system.Send(id, 0)
+	system.Send(id, 5)
+	failures := system.Wait()
+	if len(failures) != 1 || !failures[0].Restarted || failures[0].Actor != id {
+		t.Fatalf("Expected one restarted failure, got %v", failures)
+	}
+	if got := out.String(); got != "2\n" {
+		t.Errorf("Expected the restarted actor to print 2, got %q", got)
+	}
+}
+
+// fakeClock is a simulated clock: Sleep moves it forward instantly
+type fakeClock struct {
+	now time.Duration
+}
+
+func (c *fakeClock) Now() time.Duration    { return c.now }
+func (c *fakeClock) Sleep(d time.Duration) { c.now += d }
+
+func TestRestartCancelsTimers(t *testing.T) {
+	// The timer set before the crash is dropped with the rest of the
+	// actor's state, so only the restarted run's timer prints 7
+	program := compile(t, "50 [ 7 . ] AFTER host:receive 10 swap / .")
+	var out output
+	setup := func(m *vm.VM) {
+		out.setup(m)
+		m.Clock = &fakeClock{}
+	}
+	system := NewSystem(program, Options{Policy: Restart, Setup: setup})
+	id, _ := system.Spawn(0)
+	system.Send(id, 0)
+	system.Send(id, 5)
+	if failures := system.Wait(); len(failures) != 1 || !failures[0].Restarted {
+		t.Fatalf("Expected one restarted failure, got %v", failures)
+	}
+	if got := out.String(); got != "2\n7\n" {
+		t.Errorf("Expected 2 then one 7, got %q", got)
+	}
+}
+
+func TestStopPolicy(t *testing.T) {
+	program := compile(t, "host:receive 10 swap / .")
+	system := NewSystem(program, Options{Policy: Stop})
+	id, _ := system.Spawn(0)
+	system.Send(id, 0)
+	failures := system.Wait()
+	if len(failures) != 1 || failures[0].Restarted {
+		t.Fatalf("Expected one failure without a restart, got %v", failures)
+	}
+	if err := system.Send(id, 5); err == nil {
+		t.Error("Expected sending to a stopped actor to fail")
+	}
+}
+
+func TestStopEndsReceive(t *testing.T) {
+	system := NewSystem(compile(t, "host:receive ."), Options{})
+	system.Spawn(0)
+	system.Stop()
+	if failures := system.Wait(); len(failures) != 0 {
+		t.Errorf("Expected Stop to end the waiting actor quietly, got %v", failures)
+	}
+}
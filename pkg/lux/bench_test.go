@@ -0,0 +1,39 @@
+package lux
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// syntheticSource generates a program of n words. Each word branches with
+// quotations and calls the word before it, so the compiler exercises word
+// definitions, quotation layout and call patching at scale.
+func syntheticSource(n int) string {
+	var sb strings.Builder
+	sb.WriteString("@w0 1 + ;\n")
+	for i := 1; i < n; i++ {
+		fmt.Fprintf(&sb, "@w%d dup %d > [ w%d ] [ %d * ] ?: ;\n", i, i, i-1, i)
+	}
+	fmt.Fprintf(&sb, "5 w%d .\n", n-1)
+	return sb.String()
+}
+
+func benchmarkCompile(b *testing.B, words int) {
+	source := syntheticSource(words)
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Compile(source); err != nil {
+			b.Fatalf("Compile failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkCompile1000Words(b *testing.B) {
+	benchmarkCompile(b, 1000)
+}
+
+func BenchmarkCompile10000Words(b *testing.B) {
+	benchmarkCompile(b, 10000)
+}
@@ -3,8 +3,11 @@ package lux
 import (
 	"encoding/binary"
 	"fmt"
-	"os"
+	"math"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/rmay/nuxvm/pkg/vm"
 )
@@ -37,10 +40,63 @@ var builtins = map[string]byte{
 	// Memory (indirect / dynamic address)
 	"LOADI":  vm.OpLoadI,
 	"STOREI": vm.OpStoreI,
+	// Return stack
+	">R":     vm.OpToR,
+	"R>":     vm.OpFromR,
+	"RDEPTH": vm.OpRDepth,
 	// Control flow
 	"EXIT":  vm.OpRet,
 	"HALT":  vm.OpHalt,
 	"YIELD": vm.OpYield,
+	"AFTER": vm.OpAfter,
+	"EVERY": vm.OpEvery,
+	// Input and output
+	"FLUSH":   vm.OpFlush,
+	"ACCEPT":  vm.OpAccept,
+	">NUMBER": vm.OpToNumber,
+	"DUMP":    vm.OpDump,
+	".N":      vm.OpOutN,
+	".CELLS":  vm.OpOutCells,
+	// Checks
+	"ASSERT": vm.OpAssert,
+	// Introspection
+	"PC@":     vm.OpPCFetch,
+	"MEMSIZE": vm.OpMemSize,
+}
+
+// Output words and the OUT format each compiles to
+var outputWords = map[string]int32{
+	".":        vm.FormatNumber,
+	"EMIT":     vm.FormatChar,
+	".ERR":     vm.FormatNumber | vm.FormatError,
+	"EMIT-ERR": vm.FormatChar | vm.FormatError,
+}
+
+// Output words that take a field width from the stack, ( n width -- ), and
+// the OUT format each adds it to
+var fieldWords = map[string]int32{
+	".R": vm.FormatNumber,
+	".Z": vm.FormatNumber | vm.FormatZero,
+}
+
+// appendFieldOutput appends the code of a field word printing in format:
+// the width moves into its place in the format, OUT prints
+func appendFieldOutput(dst []byte, format int32) []byte {
+	dst = vm.AppendShortPush(dst, 8)
+	dst = append(dst, vm.OpShl)
+	if format != 0 {
+		dst = vm.AppendShortPush(dst, format)
+		dst = append(dst, vm.OpOr)
+	}
+	return append(dst, vm.OpOut)
+}
+
+// Words that push a device register's address, and the code each compiles
+// to, the same in the main code and in quotations
+var deviceWords = map[string][]byte{
+	"RND":      append(vm.AppendShortPush(nil, int32(vm.RNGDataAddr)), vm.OpLoadI),
+	"ON-FRAME": append(vm.AppendShortPush(nil, int32(vm.FrameVectorAddr)), vm.OpStoreI),
+	"SND":      vm.AppendShortPush(nil, int32(vm.AudioSampleBufferAddr)),
 }
 
 // Control flow combinators
@@ -53,52 +109,207 @@ var combinators = map[string]bool{
 	"CALL": true,
 	"DIP":  true,
 	"KEEP": true,
+	"CASE": true,
 }
 
 // Word represents a user-defined word
 type Word struct {
 	Name    string
-	Address int32
+	Address int32 // For a DATA table, its offset in the data section
 	Module  string
+	Data    bool // A DATA table, which pushes its address instead of being called
 }
 
 // Quotation represents a compiled code block
 type Quotation struct {
-	Address  int32  // Where the quotation code starts
-	EndAddr  int32  // Where it ends
-	Code     []byte // Compiled bytecode
-	TempAddr int32  // Temporary address for patching
+	Address   int32  // Where the quotation code starts
+	EndAddr   int32  // Where it ends
+	Code      []byte // Compiled bytecode
+	TempAddr  int32  // Placeholder operand pushed until the quotation is placed
+	Line      int    // Source line of the opening [
+	tailJmp   bool   // Ends in a JMP from tail-call optimization instead of RET
+	transfers uint8  // Bit 1<<kind for each EXIT, LEAVE or CONTINUE, which land past its combinator's CALLSTACK
+
+	relocStart int // Length of c.relocs when the quotation was started
 }
 
-// UnresolvedReference tracks a word in a quotation that needs resolution
-type UnresolvedReference struct {
-	Word      string // Word name (e.g., "fib")
-	Offset    int32  // Bytecode offset where address needs patching
-	Quotation int    // Index of quotation in c.quotations
-	Line      int    // For error reporting
-	Column    int
+// reloc marks a PUSH operand that must be patched with a quotation's final
+// address. Every such operand, in the main code or inside a quotation, goes
+// in the compiler's one relocation list, which is applied in a single pass
+// once the quotations are placed. Patching by recorded offset (rather than
+// by scanning for the placeholder value) keeps operands such as LOAD 0x1900
+// from being mistaken for quotation references.
+type reloc struct {
+	owner  int   // Quotation whose code holds the operand, or mainCode
+	offset int32 // Operand offset within the owner's code
+	quot   int   // Index into c.quotations of the quotation whose address goes there, dataTarget or mainTarget
+	data   int32 // Data section offset for dataTarget, else an offset into the quotation
 }
 
-// UnresolvedJmp tracks a jump instruction that needs address patching
-type UnresolvedJmp struct {
-	Offset   int32 // Bytecode offset where the address placeholder starts (after the opcode)
-	TempAddr int32 // Temporary address key (to look up the real address in addrMap)
-}
+// mainCode is the reloc owner for operands in c.bytecode
+const mainCode = -1
+
+// Buffer sizing. A token compiles to at most a 5-byte instruction, apart
+// from strings and combinators, whose buffers simply grow when needed.
+const (
+	maxBytesPerToken = 5
+	arenaChunk       = 64 << 10 // Quotation code is carved from arena chunks of this size
+)
+
+// maxNesting bounds how deep quotations and ( ) comments may nest, so a
+// pathological source gets an error instead of exhausting the stack
+const maxNesting = 256
 
 // Compiler compiles LUX source to bytecode
 type Compiler struct {
-	tokens         []Token
-	pos            int
-	bytecode       []byte
-	dictionary     map[string]Word
-	quotations     []Quotation
-	currentModule  string
-	imports        map[string]string
-	baseAddr       int32                 // Added for address calculations
-	tempAlloc      int32                 // Added for temporary memory allocation in reserved area
-	unresolved     []UnresolvedReference // Track words to resolve after definitions
-	unresolvedJmps []UnresolvedJmp       // To handle recursion
-	trace          bool                  // Trace compilation steps, defaults to false
+	tokens        []Token
+	pos           int
+	bytecode      []byte
+	dictionary    map[string]Word
+	quotations    []Quotation
+	currentModule string
+	imports       map[string]string
+	baseAddr      int32            // Added for address calculations
+	reservedSize  int32            // Size of reserved memory the program is compiled for
+	trace         bool             // log wants every step traced
+	log           Logger           // Where diagnostics go, nil for nowhere
+	layout        *Layout          // Placement record, nil when not wanted
+	quotStrings   []quotString     // String literals inside quotations, placed later
+	relocs        []reloc          // Quotation address operands awaiting placement
+	addrPushes    []uint32         // Offsets of those operands in the final code
+	dataBytes     []byte           // The data section, placed after the code
+	dataTables    []dataTable      // Where each DATA table is in dataBytes
+	dataPool      map[string]int32 // Offset in dataBytes of each distinct table's contents
+	dataRefs      []dataRef        // Operands holding table addresses, in the final code
+	closing       []int            // Token index of the ] matching each [, -1 elsewhere
+	arena         []byte           // Preallocated backing store for quotation code
+	entry         string           // Word called after the toplevel code, "" for MAIN if defined
+	noEntry       bool             // Never call an entry word
+	programStart  int              // Token position after the linked library modules
+	defining      string           // Word whose body is being compiled, "" at toplevel
+	definingAddr  int32            // Address of that word
+	openQuots     []int            // Quotations written in that word's body or the toplevel, not yet given to a combinator
+	lookups       map[string]int32 // Result of each resolveWord, -1 if not found; nil unless wanted
+	noInline      bool             // Call every quotation instead of inlining those used in place
+	joinAt        int              // Offset in bytecode where inlined branches last met
+	explain       bool             // Record what each construct compiled to
+	lowered       []lowered        // Those records, when explain is set
+	removed       int32            // Bytes of main code inlining has taken out so far
+	nesting       int              // Quotations open around the one being compiled
+	padUsed       bool             // The program uses the pad, so its layout shows it
+}
+
+// quotString is a string literal emitted into a quotation's code,
+// recorded relative to the quotation until the quotation is placed
+type quotString struct {
+	quot       int
+	start, end int32
+	value      string
+	line       int
+}
+
+// CompileOptions controls a compilation
+type CompileOptions struct {
+	Trace bool // Trace compilation steps to stderr, when Logger is nil
+	// Logger receives the lexer's and compiler's diagnostics; nil, without
+	// Trace, discards them
+	Logger Logger
+	// Entry names the word called once the toplevel code has run. When empty,
+	// a word named MAIN is used if the source defines one.
+	Entry string
+	// NoEntry disables the MAIN convention, e.g. for the REPL where each line
+	// is compiled as a whole program
+	NoEntry bool
+	// LibPath lists directories searched for .nuxlib archives when the source
+	// IMPORTs a module it does not define
+	LibPath []string
+	// Libraries are already-loaded archives, searched before LibPath
+	Libraries []*Library
+	// ReservedSize is the reserved memory the VM will have; 0 means
+	// vm.ReservedMemorySize
+	ReservedSize int32
+	// BaseAddr is where the code will be loaded; 0 means where a VM with
+	// ReservedSize bytes reserved starts user memory
+	BaseAddr int32
+	// DisabledRules names the Rules not to apply; "all" turns off every
+	// one, for telling a miscompile from a bug in the program
+	DisabledRules []string
+	// NoInline calls every quotation through its address, as a combinator
+	// does with one it is handed, instead of inlining the ones written
+	// right before it
+	NoInline bool
+	// DropUnused leaves out the words that neither the toplevel code nor
+	// the entry word can reach, directly or through other words, so a
+	// program importing a large module carries only what it uses. Keep
+	// every word when the symbols are wanted, e.g. for nux --entry.
+	DropUnused bool
+	// WholeProgram inlines small words, library modules' included, at
+	// every call once everything is linked, so constants and short helpers
+	// from other modules fold into the code that uses them
+	WholeProgram bool
+	// WrapHex reads hex literals from 0x80000000 to 0xFFFFFFFF as the
+	// negative numbers with the same 32 bits, so 0xFFFFFFFF is -1, instead
+	// of rejecting them as out of range
+	WrapHex bool
+	// ExplainLowering records the code each construct of the program
+	// compiled to, in Program.Lowered
+	ExplainLowering bool
+}
+
+// memoryLayout returns the base address and reserved size opts compile for
+func (opts CompileOptions) memoryLayout() (base, reserved int32, err error) {
+	reserved = opts.ReservedSize
+	if reserved == 0 {
+		reserved = vm.ReservedMemorySize
+	}
+	if reserved < 0 {
+		return 0, 0, fmt.Errorf("reserved size %d is negative", reserved)
+	}
+	userStart := reserved + vm.DeviceMemorySize
+	base = opts.BaseAddr
+	if base == 0 {
+		base = userStart
+	}
+	if base < userStart {
+		return 0, 0, fmt.Errorf("base address 0x%X is below user memory, which starts at 0x%X with %d bytes reserved",
+			base, userStart, reserved)
+	}
+	return base, reserved, nil
+}
+
+// Program is the result of a compilation
+type Program struct {
+	Code     []byte      // Bytecode, loaded at Layout.BaseAddr
+	Layout   *Layout     // Where each word, quotation, string and table was placed
+	Symbols  []vm.Symbol // Every defined word, sorted by address
+	Tables   []vm.Table  // Every DATA table, sorted by address
+	Relocs   []uint32    // Offsets in Code of every absolute code address, sorted
+	DataSize int32       // Bytes at the end of Code holding DATA tables, not instructions
+	Entry    string      // Entry word called after the toplevel code, "" if none
+	Dropped  []string    // Words left out by CompileOptions.DropUnused, in source order
+	Inlined  int         // Calls CompileOptions.WholeProgram replaced with the word's code
+	Lowered  []Lowered   // What each construct compiled to, when CompileOptions.ExplainLowering is set
+}
+
+// Version is the compiler release, in the project's Kelvin versioning
+const Version = "300K"
+
+// Image packages the program for writing to a .nux file, stamped with the
+// toolchain versions and the current time
+func (p *Program) Image() *vm.Image {
+	code := p.Code[:int32(len(p.Code))-p.DataSize]
+	return &vm.Image{
+		Code:            code,
+		Data:            p.Code[len(code):],
+		Symbols:         p.Symbols,
+		Tables:          p.Tables,
+		Relocs:          p.Relocs,
+		BaseAddr:        uint32(p.Layout.BaseAddr),
+		ReservedSize:    uint32(p.Layout.ReservedSize),
+		ISAVersion:      vm.ISAVersion,
+		CompilerVersion: Version,
+		BuildTime:       time.Now().Unix(),
+	}
 }
 
 // Compile converts LUX source to NUXVM bytecode
@@ -107,53 +318,225 @@ func Compile(source string, trace ...bool) ([]byte, error) {
 	if len(trace) > 0 {
 		traceEnabled = trace[0]
 	}
+	prog, err := CompileProgram(source, CompileOptions{Trace: traceEnabled})
+	if err != nil {
+		return nil, err
+	}
+	return prog.Code, nil
+}
+
+// CompileProgram converts LUX source to a Program, recording its memory layout
+func CompileProgram(source string, opts CompileOptions) (*Program, error) {
+	log := opts.logger()
+	tokens, err := NewLexer(source).WithLogger(log).Tokenize()
+	if err != nil {
+		return nil, err
+	}
+	tokens, programStart, err := linkLibraries(tokens, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.WrapHex {
+		wrapHex(tokens)
+	}
+	tokens, programStart, err = compileTime(tokens, programStart)
+	if err != nil {
+		return nil, err
+	}
+	inlined := 0
+	if opts.WholeProgram {
+		tokens, programStart, inlined = inlineWords(tokens, programStart)
+		if log != nil {
+			log.Logf(LevelInfo, "whole-program: inlined %d calls", inlined)
+		}
+	}
+	tokens, programStart, err = rewrite(tokens, programStart, opts.DisabledRules)
+	if err != nil {
+		return nil, err
+	}
 
-	lexer := NewLexer(source, traceEnabled)
-	tokens, err := lexer.Tokenize()
+	prog, err := link(tokens, programStart, opts)
 	if err != nil {
 		return nil, err
 	}
+	prog.Inlined = inlined
+	if !opts.DropUnused {
+		return prog, nil
+	}
+	entry := opts.Entry
+	if entry == "" && !opts.NoEntry {
+		entry = "MAIN"
+	}
+	tokens, programStart, dropped := dropUnused(tokens, programStart, entry)
+	if len(dropped) == 0 {
+		return prog, nil
+	}
+	if prog, err = link(tokens, programStart, opts); err != nil {
+		return nil, err
+	}
+	prog.Dropped, prog.Inlined = dropped, inlined
+	if log != nil {
+		log.Logf(LevelInfo, "dropped %d unused words: %s", len(dropped), strings.Join(dropped, " "))
+	}
+	return prog, nil
+}
+
+// link compiles the tokens of a program and the library modules linked
+// before programStart into its final code
+func link(tokens []Token, programStart int, opts CompileOptions) (*Program, error) {
+	base, _, err := opts.memoryLayout()
+	if err != nil {
+		return nil, err
+	}
+	compiler := newCompiler(tokens, base, opts)
+	compiler.programStart = programStart
+	code, err := compiler.compile()
+	if err != nil {
+		return nil, err
+	}
+	compiler.layout.CodeSize = int32(len(code))
+	compiler.layout.sort()
+	dataSize := int32(len(compiler.dataBytes))
+	return &Program{Code: code, Layout: compiler.layout, Symbols: compiler.symbols(), Tables: compiler.layout.tables(),
+		Relocs: relocations(code, dataSize, compiler.addrPushes), DataSize: dataSize, Entry: compiler.entry,
+		Lowered: compiler.placeLowered()}, nil
+}
+
+// relocations lists every absolute code address in code, which ends with
+// dataSize bytes of data: the jump and call targets, which the instructions
+// identify, and the quotation and table addresses the compiler pushed at
+// pushes
+func relocations(code []byte, dataSize int32, pushes []uint32) []uint32 {
+	relocs := append(vm.AddressOperands(code[:int32(len(code))-dataSize]), pushes...)
+	slices.Sort(relocs)
+	return relocs
+}
+
+// newCompiler prepares a compiler for tokens whose code will be loaded at baseAddr
+func newCompiler(tokens []Token, baseAddr int32, opts CompileOptions) *Compiler {
+	closing, words, quotations := scanStructure(tokens)
+	_, reserved, _ := opts.memoryLayout()
+	log := opts.logger()
+	return &Compiler{
+		tokens:        tokens,
+		pos:           0,
+		bytecode:      make([]byte, 0, len(tokens)*maxBytesPerToken/2+16),
+		dictionary:    make(map[string]Word, words),
+		quotations:    make([]Quotation, 0, quotations),
+		closing:       closing,
+		currentModule: "",
+		imports:       make(map[string]string),
+		baseAddr:      baseAddr,
+		log:           log,
+		trace:         log != nil && log.Enabled(LevelTrace),
+		reservedSize:  reserved,
+		layout:        &Layout{BaseAddr: baseAddr, ReservedSize: reserved, Regions: make([]Region, 0, words+quotations+3)},
+		entry:         strings.ToUpper(opts.Entry),
+		noEntry:       opts.NoEntry,
+		noInline:      opts.NoInline,
+		explain:       opts.ExplainLowering,
+	}
+}
+
+// scanStructure pairs each [ with its ] and counts word definitions and
+// quotations, so the compiler can size its buffers up front
+func scanStructure(tokens []Token) (closing []int, words, quotations int) {
+	closing = make([]int, len(tokens))
+	var open []int
+	for i, tok := range tokens {
+		closing[i] = -1
+		switch tok.Type {
+		case TokenAtSign:
+			words++
+		case TokenLBracket:
+			quotations++
+			open = append(open, i)
+		case TokenRBracket:
+			if len(open) > 0 {
+				closing[open[len(open)-1]] = i
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	return closing, words, quotations
+}
+
+// symbols lists the dictionary sorted by address
+func (c *Compiler) symbols() []vm.Symbol {
+	symbols := make([]vm.Symbol, 0, len(c.dictionary))
+	for _, word := range c.dictionary {
+		if word.Data {
+			continue
+		}
+		symbols = append(symbols, vm.Symbol{Name: word.Name, Address: word.Address, Module: word.Module})
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Address != symbols[j].Address {
+			return symbols[i].Address < symbols[j].Address
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols
+}
 
-	compiler := &Compiler{
-		tokens:         tokens,
-		pos:            0,
-		bytecode:       []byte{},
-		dictionary:     make(map[string]Word),
-		quotations:     []Quotation{},
-		currentModule:  "",
-		imports:        make(map[string]string),
-		baseAddr:       int32(vm.UserMemoryOffset),
-		tempAlloc:      0,
-		unresolved:     []UnresolvedReference{},
-		unresolvedJmps: []UnresolvedJmp{},
-		trace:          traceEnabled,
-	}
-	return compiler.compile()
+// emitEntryCall emits a CALL to the entry word, if there is one
+func (c *Compiler) emitEntryCall() error {
+	if c.noEntry {
+		c.entry = ""
+		return nil
+	}
+	var word Word
+	if c.entry == "" {
+		main, ok := c.dictionary["MAIN"]
+		if !ok {
+			return nil
+		}
+		word = main
+	} else {
+		var ok bool
+		c.currentModule = ""
+		if word, ok = c.resolveWord(c.entry); !ok {
+			return fmt.Errorf("entry word '%s' is not defined", c.entry)
+		}
+	}
+	if word.Data {
+		return fmt.Errorf("entry word '%s' is a DATA table", word.Name)
+	}
+	c.entry = word.Name
+	if c.trace {
+		c.logf(LevelTrace, "compile: Emitting CALL to entry word %s at addr=%d", word.Name, word.Address)
+	}
+	c.emit(vm.OpCall)
+	c.emitInt32(word.Address)
+	return nil
 }
 
 // compile is the main compilation loop
 func (c *Compiler) compile() ([]byte, error) {
+	c.logf(LevelDebug, "compile: Starting, %d tokens", len(c.tokens))
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compile: Starting, tokens=%v\n", c.tokens)
+		c.logf(LevelTrace, "compile: tokens=%v", c.tokens)
 	}
 	jmpAddr := int32(len(c.bytecode))
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compile: Emitting initial JMP at offset=%d\n", jmpAddr)
+		c.logf(LevelTrace, "compile: Emitting initial JMP at offset=%d", jmpAddr)
 	}
 	c.emit(vm.OpJmp)
 	c.emit(0, 0, 0, 0)
+	c.layout.add(RegionEntry, "JMP main", c.baseAddr+jmpAddr, c.currentAddress(), 0)
+	if err := c.collectData(); err != nil {
+		return nil, err
+	}
 	startPos := c.pos
-	maxIterations := len(c.tokens) * 2
-	iterations := 0
-	// First pass: Handle directives and word definitions
+	// First pass: Handle directives and word definitions. Every branch
+	// consumes at least the token it starts at.
 	for c.pos < len(c.tokens) && c.peek().Type != TokenEOF {
-		iterations++
-		if iterations > maxIterations {
-			return nil, fmt.Errorf("infinite loop detected in first pass at pos=%d, token=%v", c.pos, c.peek())
-		}
 		token := c.peek()
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "compile: First pass, pos=%d, token=%v\n", c.pos, token)
+			c.logf(LevelTrace, "compile: First pass, pos=%d, token=%v", c.pos, token)
+		}
+		if c.pos == c.programStart {
+			c.currentModule = "" // A linked library's MODULE does not extend into the program
 		}
 		if token.Type == TokenWord && strings.ToUpper(token.Value) == "MODULE" {
 			if err := c.handleModuleDirective(); err != nil {
@@ -171,38 +554,22 @@ func (c *Compiler) compile() ([]byte, error) {
 			c.advance()
 		}
 	}
-	// Resolve unresolved word references
-	for _, unresolved := range c.unresolved {
-		word, found := c.resolveWord(unresolved.Word)
-		if !found {
-			return nil, fmt.Errorf("unknown word '%s' in quotation at line %d, column %d", unresolved.Word, unresolved.Line, unresolved.Column)
-		}
-		// Patch placeholder with CALL to word address
-		c.bytecode[unresolved.Offset] = vm.OpCall
-		copy(c.bytecode[unresolved.Offset+1:unresolved.Offset+5], vm.EncodeInt32(word.Address))
-		if c.trace {
-			fmt.Fprintf(os.Stderr, "compile: Patched unresolved word %s at offset %d to CALL addr %d\n", unresolved.Word, unresolved.Offset, word.Address)
-		}
-	}
-	c.unresolved = nil // Clear resolved references
 	mainStart := c.currentAddress()
+	c.logf(LevelDebug, "compile: Main code starts at addr=%d", mainStart)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compile: Main code starts at addr=%d\n", mainStart)
-	}
-	mainStartBytes := vm.EncodeInt32(mainStart)
-	if c.trace {
-		fmt.Fprintf(os.Stderr, "compile: Patching JMP at %d with addr=%d\n", jmpAddr+1, mainStart)
+		c.logf(LevelTrace, "compile: Patching JMP at %d with addr=%d", jmpAddr+1, mainStart)
 	}
-	copy(c.bytecode[jmpAddr+1:jmpAddr+5], mainStartBytes)
+	c.patchInt32(jmpAddr+1, mainStart)
 	c.pos = startPos
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compile: Starting second pass, pos=%d\n", c.pos)
+		c.logf(LevelTrace, "compile: Starting second pass, pos=%d", c.pos)
 	}
+	c.openQuots = c.openQuots[:0]
 	// Second pass: Compile main code and quotations
 	for c.pos < len(c.tokens) && c.peek().Type != TokenEOF {
 		token := c.peek()
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "compile: Second pass, pos=%d, token=%v\n", c.pos, token)
+			c.logf(LevelTrace, "compile: Second pass, pos=%d, token=%v", c.pos, token)
 		}
 		if token.Type == TokenWord {
 			upperVal := strings.ToUpper(token.Value)
@@ -210,7 +577,7 @@ func (c *Compiler) compile() ([]byte, error) {
 				c.advance()
 				c.advance()
 				if c.trace {
-					fmt.Fprintf(os.Stderr, "compile: Skipped MODULE directive\n")
+					c.logf(LevelTrace, "compile: Skipped MODULE directive")
 				}
 				continue
 			} else if upperVal == "IMPORT" {
@@ -221,115 +588,98 @@ func (c *Compiler) compile() ([]byte, error) {
 					c.advance()
 				}
 				if c.trace {
-					fmt.Fprintf(os.Stderr, "compile: Skipped IMPORT directive\n")
+					c.logf(LevelTrace, "compile: Skipped IMPORT directive")
 				}
 				continue
 			}
 		}
 		if token.Type == TokenAtSign {
 			if c.trace {
-				fmt.Fprintf(os.Stderr, "compile: Skipping word definition\n")
+				c.logf(LevelTrace, "compile: Skipping word definition")
 			}
 			c.skipWordDefinition()
-		} else if token.Type == TokenLBracket {
-			// Initialize quotation and emit PUSH
-			if err := c.compileToken(token); err != nil {
-				return nil, err
-			}
-			c.advance() // Skip [
-			// Compile quotation code
-			if err := c.compileQuotation(); err != nil {
-				return nil, err
-			}
+		} else if isData(token) {
+			c.skipData()
 		} else if token.Type != TokenEOF {
 			if c.trace {
-				fmt.Fprintf(os.Stderr, "compile: Compiling token %v\n", token)
+				c.logf(LevelTrace, "compile: Compiling token %v", token)
 			}
-			if err := c.compileToken(token); err != nil {
+			if err := c.compileNext(); err != nil {
 				return nil, err
 			}
-			c.advance()
 		} else {
 			break
 		}
 	}
+	if err := c.checkTransfers(c.openQuots); err != nil {
+		return nil, err
+	}
+	// The toplevel code acts as initialisation; the entry word runs after it
+	if err := c.emitEntryCall(); err != nil {
+		return nil, err
+	}
 	// After main code completes, emit JMP to skip quotation storage area
 	skipQuotationsLabel := len(c.bytecode)
 	c.emit(vm.OpJmp)
 	c.emit(0, 0, 0, 0) // Placeholder, will be patched to point to HALT
 	// Store the position where main code ends (before quotations)
-	mainEndPos := len(c.bytecode)
-	// Build a map of temp addresses to real addresses as we place quotations
-	addrMap := make(map[int32]int32)
-	// Append quotations at the end and record their real addresses
+	c.layout.add(RegionMain, "toplevel", mainStart, c.currentAddress(), 0)
+	// Append quotations at the end and record their real addresses, growing
+	// the bytecode once to its final size
+	quotBytes := 0
+	for i := range c.quotations {
+		quotBytes += len(c.quotations[i].Code)
+	}
+	c.bytecode = slices.Grow(c.bytecode, quotBytes+1)
 	for i := range c.quotations {
 		c.quotations[i].Address = c.currentAddress()
-		addrMap[c.quotations[i].TempAddr] = c.quotations[i].Address
-		if c.trace {
-			fmt.Fprintf(os.Stderr, "compile: Placing quotation %d at addr=%d (was temp %d)\n",
-				i, c.quotations[i].Address, c.quotations[i].TempAddr)
-		}
+		c.logf(LevelDebug, "compile: Placing quotation %d at addr=%d (was temp %d)",
+			i, c.quotations[i].Address, c.quotations[i].TempAddr)
 		c.bytecode = append(c.bytecode, c.quotations[i].Code...)
 		c.quotations[i].EndAddr = c.currentAddress()
-	}
-	// Now patch all PUSH instructions that reference quotation addresses
-	// First patch addresses in the main code section
-	for j := 0; j < mainEndPos; j++ {
-		if c.bytecode[j] == vm.OpPush && j+4 < mainEndPos {
-			addr := int32(binary.BigEndian.Uint32(c.bytecode[j+1 : j+5]))
-			if realAddr, ok := addrMap[addr]; ok {
-				binary.BigEndian.PutUint32(c.bytecode[j+1:j+5], uint32(realAddr))
-				if c.trace {
-					fmt.Fprintf(os.Stderr, "compile: Patched PUSH at %d with addr=%d (was %d)\n",
-						j+1, realAddr, addr)
-				}
-			}
+		if len(c.quotations[i].Code) == 0 {
+			continue // Inlined
 		}
-	}
-	// Also patch addresses within the quotation bytecode itself
-	// This handles nested quotations that reference other quotations
-	currentPos := mainEndPos
-	for i := range c.quotations {
-		quotCode := c.bytecode[currentPos : currentPos+len(c.quotations[i].Code)]
-		for j := 0; j < len(quotCode); j++ {
-			if quotCode[j] == vm.OpPush && j+4 < len(quotCode) {
-				addr := int32(binary.BigEndian.Uint32(quotCode[j+1 : j+5]))
-				if realAddr, ok := addrMap[addr]; ok {
-					binary.BigEndian.PutUint32(quotCode[j+1:j+5], uint32(realAddr))
-					if c.trace {
-						fmt.Fprintf(os.Stderr, "compile: Patched nested PUSH in quotation %d at bytecode pos %d with addr=%d (was %d)\n",
-							i, currentPos+j+1, realAddr, addr)
-					}
-				}
-			}
+		c.layout.add(RegionQuotation, fmt.Sprintf("#%d", i), c.quotations[i].Address, c.quotations[i].EndAddr, c.quotations[i].Line)
+	}
+	for _, qs := range c.quotStrings {
+		addr := c.quotations[qs.quot].Address
+		c.layout.add(RegionString, fmt.Sprintf("%q", qs.value), addr+qs.start, addr+qs.end, qs.line)
+	}
+	// Patch every quotation and table address operand, in the main code
+	// and in the quotations themselves, in one pass over the relocation list.
+	// The data section follows the HALT.
+	dataStart := c.currentAddress() + 1
+	for _, r := range c.relocs {
+		offset := r.offset
+		if r.owner != mainCode {
+			offset += c.quotations[r.owner].Address - c.baseAddr
 		}
-		currentPos += len(c.quotations[i].Code)
-	}
-	// Patch unresolved jumps
-	for _, uj := range c.unresolvedJmps {
-		realAddr, ok := addrMap[uj.TempAddr]
-		if !ok {
-			return nil, fmt.Errorf("unresolved jump for temp addr %d not found", uj.TempAddr)
+		if r.quot == mainTarget {
+			// A jump within an inlined quotation, found again as one
+			c.patchInt32(offset, c.baseAddr+r.data)
+			continue
 		}
-		copy(c.bytecode[uj.Offset:uj.Offset+4], vm.EncodeInt32(realAddr))
-		if c.trace {
-			fmt.Fprintf(os.Stderr, "compile: Patched JMP at offset %d with addr=%d (was temp %d)\n", uj.Offset, realAddr, uj.TempAddr)
+		if r.quot == dataTarget {
+			c.patchInt32(offset, dataStart+r.data)
+			c.dataRefs = append(c.dataRefs, dataRef{offset: uint32(offset), data: r.data})
+		} else {
+			c.patchQuotRef(c.bytecode[offset:offset+4], r.quot, r.data)
 		}
+		c.addrPushes = append(c.addrPushes, uint32(offset))
 	}
-	c.unresolvedJmps = nil
 	// Emit HALT and patch the skip quotations JMP
 	haltAddr := c.currentAddress()
-	if c.trace {
-		fmt.Fprintf(os.Stderr, "compile: Emitting HALT at addr=%d, bytecode length=%d\n", haltAddr, len(c.bytecode))
-	}
+	c.logf(LevelDebug, "compile: Emitting HALT at addr=%d, bytecode length=%d", haltAddr, len(c.bytecode))
 	c.emit(vm.OpHalt)
+	c.layout.add(RegionHalt, "HALT", haltAddr, c.currentAddress(), 0)
+	c.placeData()
 	// Patch the JMP that skips quotations to jump to HALT
-	haltAddrBytes := vm.EncodeInt32(haltAddr)
-	copy(c.bytecode[skipQuotationsLabel+1:skipQuotationsLabel+5], haltAddrBytes)
+	c.patchInt32(int32(skipQuotationsLabel+1), haltAddr)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compile: Patched skip-quotations JMP at %d to jump to HALT at %d\n",
+		c.logf(LevelTrace, "compile: Patched skip-quotations JMP at %d to jump to HALT at %d",
 			skipQuotationsLabel+1, haltAddr)
-		fmt.Fprintf(os.Stderr, "compile: Final bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "compile: Final bytecode=%v", c.bytecode)
 	}
 	return c.bytecode, nil
 }
@@ -370,6 +720,20 @@ func (c *Compiler) handleImportDirective() error {
 
 // resolveWord resolves a word reference
 func (c *Compiler) resolveWord(wordName string) (Word, bool) {
+	word, ok := c.lookupWord(wordName)
+	if c.lookups != nil {
+		addr := int32(-1)
+		if ok {
+			addr = word.Address
+		}
+		c.lookups[strings.ToUpper(wordName)] = addr
+	}
+	return word, ok
+}
+
+// lookupWord finds a word by its name as written, trying the current
+// module and IMPORT ... AS shorthands
+func (c *Compiler) lookupWord(wordName string) (Word, bool) {
 	upperName := strings.ToUpper(wordName)
 	if word, ok := c.dictionary[upperName]; ok {
 		return word, true
@@ -393,10 +757,16 @@ func (c *Compiler) resolveWord(wordName string) (Word, bool) {
 	return Word{}, false
 }
 
+// hostCall recognizes HOST:NAME, which calls the host function NAME
+func hostCall(word string) (string, bool) {
+	name, ok := strings.CutPrefix(word, "HOST:")
+	return name, ok && name != ""
+}
+
 // compileToken compiles a single token
 func (c *Compiler) compileToken(token Token) error {
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compileToken: Processing token=%v\n", token)
+		c.logf(LevelTrace, "compileToken: Processing token=%v", token)
 	}
 	switch token.Type {
 	case TokenNumber:
@@ -405,46 +775,60 @@ func (c *Compiler) compileToken(token Token) error {
 			return err
 		}
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "compileToken: Emitting PUSH %d\n", value)
+			c.logf(LevelTrace, "compileToken: Emitting PUSH %d", value)
 		}
-		c.emit(vm.OpPush)
-		c.emit(vm.EncodeInt32(value)...)
+		c.emitPush(value)
 	case TokenString:
+		start := c.currentAddress()
 		for _, ch := range token.Value {
-			c.emit(vm.OpPush)
-			c.emit(vm.EncodeInt32(int32(ch))...)
-			c.emit(vm.OpPush)
-			c.emit(vm.EncodeInt32(1)...)
+			c.emitPush(int32(ch))
+			c.emitPush(1)
 			c.emit(vm.OpOut)
 		}
+		c.layout.add(RegionString, fmt.Sprintf("%q", token.Value), start, c.currentAddress(), token.Line)
 	case TokenWord:
 		wordName := strings.ToUpper(token.Value)
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "compileToken: Word '%s' (upper='%s')\n", token.Value, wordName)
+			c.logf(LevelTrace, "compileToken: Word '%s' (upper='%s')", token.Value, wordName)
 		}
-		if wordName == "." {
-			c.emit(vm.OpPush)
-			c.emit(vm.EncodeInt32(0)...)
+		if format, ok := outputWords[wordName]; ok {
+			c.emitPush(format)
 			c.emit(vm.OpOut)
 			return nil
 		}
-		if wordName == "EMIT" {
-			c.emit(vm.OpPush)
-			c.emit(vm.EncodeInt32(1)...)
-			c.emit(vm.OpOut)
+		if format, ok := fieldWords[wordName]; ok {
+			c.emit(appendFieldOutput(nil, format)...)
+			return nil
+		}
+		if name, ok := hostCall(wordName); ok {
+			c.emit(vm.HostInstruction(name)...)
+			return nil
+		}
+		if isMessageWord(token) {
+			word, length, op, err := c.messageWord()
+			if err != nil {
+				return err
+			}
+			c.emitDataRef(word)
+			c.emitPush(length)
+			c.emit(op)
 			return nil
 		}
 		if word, ok := c.resolveWord(wordName); ok {
+			if word.Data {
+				c.emitDataRef(word)
+				return nil
+			}
 			if c.trace {
-				fmt.Fprintf(os.Stderr, "compileToken: Emitting CALL to word '%s' at addr=%d\n", word.Name, word.Address)
+				c.logf(LevelTrace, "compileToken: Emitting CALL to word '%s' at addr=%d", word.Name, word.Address)
 			}
 			c.emit(vm.OpCall)
-			c.emit(vm.EncodeInt32(word.Address)...)
+			c.emitInt32(word.Address)
 			return nil
 		}
 		if combinators[wordName] {
 			if c.trace {
-				fmt.Fprintf(os.Stderr, "compileToken: Dispatching to combinator '%s'\n", wordName)
+				c.logf(LevelTrace, "compileToken: Dispatching to combinator '%s'", wordName)
 			}
 			return c.compileCombinator(wordName, token.Line)
 		}
@@ -454,45 +838,55 @@ func (c *Compiler) compileToken(token Token) error {
 			return nil
 		}
 		if wordName == "NEGATE" {
-			c.emit(vm.OpPush)
-			c.emit(vm.EncodeInt32(0)...)
+			c.emitPush(0)
 			c.emit(vm.OpSwap, vm.OpSub)
 			return nil
 		}
-		if wordName == "RND" {
-			c.emit(vm.OpPush)
-			c.emit(vm.EncodeInt32(int32(vm.RNGDataAddr))...)
-			c.emit(vm.OpLoadI)
+		if wordName == "ABORT" {
+			c.emitPush(0) // No message
+			c.emitPush(0)
+			c.emit(vm.OpAbort)
 			return nil
 		}
-		if wordName == "SND" {
-			c.emit(vm.OpPush)
-			c.emit(vm.EncodeInt32(int32(vm.AudioSampleBufferAddr))...)
+		if code, ok := deviceWords[wordName]; ok {
+			c.emit(code...)
 			return nil
 		}
+		if wordName == "EXIT" && c.defining == "" {
+			return fmt.Errorf("EXIT outside a word definition at line %d", token.Line)
+		}
+		if kind, ok := transferWords[wordName]; ok && kind != transferExit {
+			// Loop bodies are quotations, so the word's own code is never in one
+			return fmt.Errorf("%s outside a |: or #: loop at line %d", wordName, token.Line)
+		}
 		if opcode, ok := builtins[wordName]; ok {
 			if c.trace {
-				fmt.Fprintf(os.Stderr, "compileToken: Emitting builtin opcode=%s\n", vm.OpcodeName(opcode))
+				c.logf(LevelTrace, "compileToken: Emitting builtin opcode=%s", vm.OpcodeName(opcode))
 			}
 			c.emit(opcode)
 			return nil
 		}
+		if lower, ok := registered(wordName); ok {
+			return c.lower(lower, token, mainCode, nil)
+		}
 		return fmt.Errorf("unknown word '%s' at line %d", token.Value, token.Line)
 	case TokenLBracket:
 		// Use a temporary address that won't conflict with real addresses
 		// We use 0x1000 + quotation index * 0x100 to ensure uniqueness
 		tempAddr := int32(0x1000 + len(c.quotations)*0x100)
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "compileToken: Emitting PUSH for quotation at temp addr=%d\n", tempAddr)
+			c.logf(LevelTrace, "compileToken: Emitting PUSH for quotation at temp addr=%d", tempAddr)
 		}
-		c.quotations = append(c.quotations, Quotation{TempAddr: tempAddr, Code: []byte{}})
+		quotIndex := c.startQuotation(tempAddr, token.Line)
+		c.openQuots = append(c.openQuots, quotIndex)
 		c.emit(vm.OpPush)
-		c.emit(vm.EncodeInt32(tempAddr)...)
+		c.addReloc(mainCode, c.currentOffset(), quotIndex)
+		c.emitInt32(tempAddr)
 	case TokenRBracket:
 		return fmt.Errorf("unexpected ] at line %d", token.Line)
 	default:
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "compileToken: Unexpected token type=%v\n", token.Type)
+			c.logf(LevelTrace, "compileToken: Unexpected token type=%v", token.Type)
 		}
 		return fmt.Errorf("unexpected token type %v at line %d", token.Type, token.Line)
 	}
@@ -506,16 +900,12 @@ func (c *Compiler) compileWordDefinition() error {
 	if nameToken.Type != TokenWord {
 		return fmt.Errorf("expected word name after '@', got %v at line %d", nameToken.Type, nameToken.Line)
 	}
-	baseName := strings.ToUpper(nameToken.Value)
-	var wordName string
-	if c.currentModule != "" && !strings.Contains(baseName, "::") {
-		wordName = c.currentModule + "::" + baseName
-	} else {
-		wordName = baseName
-	}
+	wordName := qualifiedName(c.currentModule, nameToken.Value)
 	// Add to dictionary before compiling body
 	wordAddress := c.currentAddress()
 	c.dictionary[wordName] = Word{Name: wordName, Address: wordAddress, Module: c.currentModule}
+	c.defining, c.definingAddr = wordName, wordAddress
+	c.openQuots = c.openQuots[:0]
 	// Compile the word body
 	for {
 		token := c.peek()
@@ -529,32 +919,16 @@ func (c *Compiler) compileWordDefinition() error {
 		if token.Type == TokenAtSign {
 			return fmt.Errorf("nested word definitions not allowed at line %d", token.Line)
 		}
-		// Special handling for quotations in word definitions
-		switch token.Type {
-		case TokenLBracket:
-			// Create a quotation entry
-			tempAddr := c.currentAddress() + 5 // Address after the PUSH instruction
-			c.quotations = append(c.quotations, Quotation{TempAddr: tempAddr, Code: []byte{}})
-			// Emit PUSH with temporary address
-			c.emit(vm.OpPush)
-			c.emit(vm.EncodeInt32(tempAddr)...)
-			// Skip the [
-			c.advance()
-			// Compile the quotation with context about current word
-			if err := c.compileQuotationInDefinition(wordName, wordAddress); err != nil {
-				return err
-			}
-			// The ] has been consumed by compileQuotationInDefinition
-		case TokenRBracket:
-			return fmt.Errorf("unexpected ] in word definition at line %d", token.Line)
-		default:
-			if err := c.compileToken(token); err != nil {
-				return err
-			}
-			c.advance()
+		if err := c.compileNext(); err != nil {
+			return err
 		}
 	}
+	if err := c.checkTransfers(c.openQuots); err != nil {
+		return err
+	}
+	c.openQuots = c.openQuots[:0]
 	// Emit RET to end the word
+	retAt := c.currentOffset()
 	c.emit(vm.OpRet)
 
 	// Apply TRO if tail call (simple case: CALL followed by RET)
@@ -564,13 +938,69 @@ func (c *Compiler) compileWordDefinition() error {
 		// Only optimize if it's a recursive call
 		if callAddr == wordAddress {
 			c.bytecode[offset-6] = vm.OpJmp
-			c.bytecode = c.bytecode[:offset-1]
+			if c.joinAt != offset-1 {
+				// Keep the RET when inlined branches jump to it
+				c.bytecode = c.bytecode[:offset-1]
+			}
 			if c.trace {
-				fmt.Fprintf(os.Stderr, "compileWordDefinition: Applied simple TRO for recursive call to %s\n", wordName)
+				c.logf(LevelTrace, "compileWordDefinition: Applied simple TRO for recursive call to %s", wordName)
 			}
 		}
 	}
+	c.noteLowered(c.pos-1, mainCode, retAt, c.currentOffset())
+	c.defining, c.definingAddr = "", 0
+	c.layout.add(RegionWord, wordName, wordAddress, c.currentAddress(), nameToken.Line)
+	return nil
+}
+
+// qualifiedName is the dictionary name of a word defined as name in module
+func qualifiedName(module, name string) string {
+	name = strings.ToUpper(name)
+	if module != "" && !strings.Contains(name, "::") {
+		return module + "::" + name
+	}
+	return name
+}
 
+// compileNext compiles the token at c.pos and advances past it. A [ is
+// compiled together with its whole quotation, in the form the enclosing
+// word definition or toplevel code needs.
+func (c *Compiler) compileNext() error {
+	if c.explain {
+		defer c.noteMain(c.pos, c.currentOffset(), c.removed)
+	}
+	token := c.peek()
+	switch token.Type {
+	case TokenLBracket:
+		if c.defining == "" {
+			// Initialize quotation and emit PUSH
+			if err := c.compileToken(token); err != nil {
+				return err
+			}
+			c.advance() // Skip [
+			return c.compileQuotation()
+		}
+		// Create a quotation entry
+		tempAddr := c.currentAddress() + 5 // Address after the PUSH instruction
+		quotIndex := c.startQuotation(tempAddr, token.Line)
+		c.openQuots = append(c.openQuots, quotIndex)
+		// Emit PUSH with temporary address
+		c.emit(vm.OpPush)
+		c.addReloc(mainCode, c.currentOffset(), quotIndex)
+		c.emitInt32(tempAddr)
+		// Skip the [
+		c.advance()
+		// Compile the quotation with context about current word; it consumes the ]
+		return c.compileQuotationInDefinition(c.defining, c.definingAddr)
+	case TokenRBracket:
+		if c.defining != "" {
+			return fmt.Errorf("unexpected ] in word definition at line %d", token.Line)
+		}
+	}
+	if err := c.compileToken(token); err != nil {
+		return err
+	}
+	c.advance()
 	return nil
 }
 
@@ -581,23 +1011,29 @@ func (c *Compiler) compileQuotationInDefinition(currentWordName string, currentW
 		return fmt.Errorf("no quotation started for [ at line %d", c.peek().Line)
 	}
 	quot := &c.quotations[quotIndex]
+	var nested []int // Quotations written in this one, not yet given to a combinator
+	if err := c.enterQuotation(quot.Line); err != nil {
+		return err
+	}
+	defer func() { c.nesting-- }()
 
 	depth := 1
 	for c.pos < len(c.tokens) && depth > 0 && c.peek().Type != TokenEOF {
 		token := c.peek()
+		from, fromPos := int32(len(quot.Code)), c.pos
 
 		if token.Type == TokenLBracket {
-			// Handle nested quotation
-			depth++
+			// Handle nested quotation; the recursive call consumes its ]
 			// Calculate a temporary address for the nested quotation
 			tempAddr := int32(0x1000 + len(c.quotations)*0x100)
 
 			// Emit PUSH instruction in the parent quotation
 			quot.Code = append(quot.Code, vm.OpPush)
-			quot.Code = append(quot.Code, vm.EncodeInt32(tempAddr)...)
+			c.addReloc(quotIndex, int32(len(quot.Code)), len(c.quotations))
+			quot.Code = binary.BigEndian.AppendUint32(quot.Code, uint32(tempAddr))
 
 			// Create new quotation entry
-			c.quotations = append(c.quotations, Quotation{TempAddr: tempAddr, Code: []byte{}})
+			nested = append(nested, c.startQuotation(tempAddr, token.Line))
 
 			// Advance past the [
 			c.advance()
@@ -631,121 +1067,119 @@ func (c *Compiler) compileQuotationInDefinition(currentWordName string, currentW
 				if err != nil {
 					return err
 				}
-				quot.Code = append(quot.Code, vm.OpPush)
-				quot.Code = append(quot.Code, vm.EncodeInt32(num)...)
+				quot.Code = vm.AppendShortPush(quot.Code, num)
 				c.advance()
 
 			case TokenWord:
 				upperVal := strings.ToUpper(token.Value)
 
-				if upperVal == "." {
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(0)...)
+				if format, ok := outputWords[upperVal]; ok {
+					quot.Code = vm.AppendShortPush(quot.Code, format)
 					quot.Code = append(quot.Code, vm.OpOut)
 					c.advance()
-				} else if upperVal == "EMIT" {
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(1)...)
-					quot.Code = append(quot.Code, vm.OpOut)
+				} else if format, ok := fieldWords[upperVal]; ok {
+					quot.Code = appendFieldOutput(quot.Code, format)
 					c.advance()
 				} else if upperVal == ">" {
 					quot.Code = append(quot.Code, vm.OpSwap, vm.OpLt)
 					c.advance()
 				} else if upperVal == "NEGATE" {
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(0)...)
+					quot.Code = vm.AppendShortPush(quot.Code, 0)
 					quot.Code = append(quot.Code, vm.OpSwap, vm.OpSub)
 					c.advance()
+				} else if upperVal == "ABORT" {
+					quot.Code = vm.AppendShortPush(quot.Code, 0)
+					quot.Code = vm.AppendShortPush(quot.Code, 0)
+					quot.Code = append(quot.Code, vm.OpAbort)
+					c.advance()
+				} else if code, ok := deviceWords[upperVal]; ok {
+					quot.Code = append(quot.Code, code...)
+					c.advance()
+				} else if name, ok := hostCall(upperVal); ok {
+					quot.Code = append(quot.Code, vm.HostInstruction(name)...)
+					c.advance()
+				} else if isMessageWord(token) {
+					word, length, op, err := c.messageWord()
+					if err != nil {
+						return err
+					}
+					c.appendDataRef(quotIndex, word)
+					quot.Code = vm.AppendShortPush(quot.Code, length)
+					quot.Code = append(quot.Code, op)
+					c.advance()
+				} else if kind, ok := transferWords[upperVal]; ok {
+					quot.Code = append(quot.Code, quotTransfer(kind)...)
+					quot.transfers |= 1 << kind
+					c.advance()
 				} else if opcode, ok := builtins[upperVal]; ok {
 					quot.Code = append(quot.Code, opcode)
 					c.advance()
 				} else if combinators[upperVal] {
 					c.advance()
-					if err := c.compileQuotationCombinator(upperVal, quot); err != nil {
+					if err := c.compileQuotationCombinator(upperVal, quotIndex, &nested); err != nil {
 						return err
 					}
-				} else if word, ok := c.resolveWord(upperVal); ok {
+				} else if word, ok := c.resolveWord(upperVal); ok && word.Data {
+					c.appendDataRef(quotIndex, word)
+					c.advance()
+				} else if ok {
 					quot.Code = append(quot.Code, vm.OpCall)
-					quot.Code = append(quot.Code, vm.EncodeInt32(word.Address)...)
+					quot.Code = binary.BigEndian.AppendUint32(quot.Code, uint32(word.Address))
+					c.advance()
+				} else if lower, ok := registered(upperVal); ok {
+					if err := c.lower(lower, token, quotIndex, &nested); err != nil {
+						return err
+					}
+					quot = &c.quotations[quotIndex]
 					c.advance()
 				} else {
 					return fmt.Errorf("unknown word '%s' in quotation at line %d", token.Value, token.Line)
 				}
 
 			case TokenString:
+				start := int32(len(quot.Code))
 				for _, ch := range token.Value {
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(int32(ch))...)
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(1)...)
+					quot.Code = vm.AppendShortPush(quot.Code, int32(ch))
+					quot.Code = vm.AppendShortPush(quot.Code, 1)
 					quot.Code = append(quot.Code, vm.OpOut)
 				}
+				c.noteQuotString(quotIndex, token, start, int32(len(quot.Code)))
 				c.advance()
 
 			default:
 				return fmt.Errorf("invalid token %v in quotation at line %d", token.Type, token.Line)
 			}
 		}
+		c.noteLowered(fromPos, quotIndex, from, int32(len(c.quotations[quotIndex].Code)))
 	}
 
 	if c.peek().Type != TokenRBracket {
 		return fmt.Errorf("unclosed quotation at line %d", c.tokens[c.pos-1].Line)
 	}
 
+	if err := c.checkTransfers(nested); err != nil {
+		return err
+	}
+
 	// Append RET to end the quotation
+	retAt := int32(len(quot.Code))
 	quot.Code = append(quot.Code, vm.OpRet)
 
 	// Apply TRO if the quotation ends with a tail call to the current word
 	quotLen := len(quot.Code)
 	if quotLen >= 6 && quot.Code[quotLen-6] == vm.OpCall && quot.Code[quotLen-1] == vm.OpRet {
-		// Get the call address
 		callAddr := int32(binary.BigEndian.Uint32(quot.Code[quotLen-5 : quotLen-1]))
-		if c.trace {
-			fmt.Fprintf(os.Stderr, "  Pattern matched! callAddr=%d, currentWordAddr=%d\n", callAddr, currentWordAddr)
-		}
-		// Check if it's a recursive call to the word being defined
+		// Only a recursive call to the word being defined
 		if callAddr == currentWordAddr {
-			// Add panic recovery to debug any crashes
-			defer func() {
-				if r := recover(); r != nil {
-					fmt.Fprintf(os.Stderr, ">>> PANIC during TRO application: %v\n", r)
-					panic(r) // Re-panic after logging
-				}
-			}()
-
-			if c.trace {
-				fmt.Fprintf(os.Stderr, ">>> About to apply TRO...\n")
-			}
-
-			// This is a tail recursive call, optimize it
 			quot.Code[quotLen-6] = vm.OpJmp
-
-			if c.trace {
-				fmt.Fprintf(os.Stderr, ">>> Converted CALL to JMP\n")
-			}
-
-			// Remove the RET instruction
+			quot.tailJmp = true
 			quot.Code = quot.Code[:quotLen-1]
-
-			if c.trace {
-				fmt.Fprintf(os.Stderr, "compileQuotationInDefinition: ✓ Applied TRO for tail call to %s at addr %d\n", currentWordName, currentWordAddr)
-				fmt.Fprintf(os.Stderr, "  New quotation length: %d, ends with JMP\n", len(quot.Code))
-				fmt.Fprintf(os.Stderr, ">>> TRO APPLIED! Converted CALL to JMP, removed RET\n")
-				fmt.Fprintf(os.Stderr, "    New quotation length: %d\n", len(quot.Code))
-				if len(quot.Code) >= 5 {
-					fmt.Fprintf(os.Stderr, "    New last 5 bytes: %v\n", quot.Code[len(quot.Code)-5:])
-				}
-			}
-		} else {
 			if c.trace {
-				fmt.Fprintf(os.Stderr, "  ✗ Address mismatch - TRO not applied\n")
+				c.logf(LevelTrace, "compileQuotationInDefinition: Applied TRO for tail call to %s at addr %d", currentWordName, currentWordAddr)
 			}
 		}
-	} else {
-		if c.trace {
-			fmt.Fprintf(os.Stderr, "  ✗ Pattern not matched - TRO not applied\n")
-		}
 	}
+	c.noteLowered(c.pos, quotIndex, retAt, int32(len(quot.Code)))
 
 	// Skip the closing ]
 	c.advance()
@@ -779,14 +1213,20 @@ func (c *Compiler) compileQuotation() error {
 		return fmt.Errorf("no quotation started for [ at line %d", c.peek().Line)
 	}
 	quot := &c.quotations[quotIndex]
+	var nested []int // Quotations written in this one, not yet given to a combinator
+	if err := c.enterQuotation(quot.Line); err != nil {
+		return err
+	}
+	defer func() { c.nesting-- }()
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compileQuotation: Compiling quotation %d at temp addr=%d\n", quotIndex, quot.TempAddr)
+		c.logf(LevelTrace, "compileQuotation: Compiling quotation %d at temp addr=%d", quotIndex, quot.TempAddr)
 	}
 	depth := 1
 	for c.pos < len(c.tokens) && depth > 0 && c.peek().Type != TokenEOF {
 		token := c.peek()
+		from, fromPos := int32(len(quot.Code)), c.pos
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "compile: Compiling quotation token %v, depth=%d\n", token, depth)
+			c.logf(LevelTrace, "compile: Compiling quotation token %v, depth=%d", token, depth)
 		}
 
 		if token.Type == TokenLBracket {
@@ -800,10 +1240,11 @@ func (c *Compiler) compileQuotation() error {
 
 			// Emit PUSH instruction in the parent quotation with temp address
 			quot.Code = append(quot.Code, vm.OpPush)
-			quot.Code = append(quot.Code, vm.EncodeInt32(tempAddr)...)
+			c.addReloc(quotIndex, int32(len(quot.Code)), len(c.quotations))
+			quot.Code = binary.BigEndian.AppendUint32(quot.Code, uint32(tempAddr))
 
 			// Create new quotation entry
-			c.quotations = append(c.quotations, Quotation{TempAddr: tempAddr, Code: []byte{}})
+			nested = append(nested, c.startQuotation(tempAddr, token.Line))
 
 			// Advance past the [
 			c.advance()
@@ -834,42 +1275,72 @@ func (c *Compiler) compileQuotation() error {
 				if err != nil {
 					return err
 				}
-				quot.Code = append(quot.Code, vm.OpPush)
-				quot.Code = append(quot.Code, vm.EncodeInt32(num)...)
+				quot.Code = vm.AppendShortPush(quot.Code, num)
 				c.advance()
 
 			case TokenWord:
 				upperVal := strings.ToUpper(token.Value)
 				// Check for special output words
-				if upperVal == "." {
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(0)...)
+				if format, ok := outputWords[upperVal]; ok {
+					quot.Code = vm.AppendShortPush(quot.Code, format)
 					quot.Code = append(quot.Code, vm.OpOut)
 					c.advance()
-				} else if upperVal == "EMIT" {
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(1)...)
-					quot.Code = append(quot.Code, vm.OpOut)
+				} else if format, ok := fieldWords[upperVal]; ok {
+					quot.Code = appendFieldOutput(quot.Code, format)
 					c.advance()
 				} else if upperVal == ">" {
 					quot.Code = append(quot.Code, vm.OpSwap, vm.OpLt)
 					c.advance()
 				} else if upperVal == "NEGATE" {
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(0)...)
+					quot.Code = vm.AppendShortPush(quot.Code, 0)
 					quot.Code = append(quot.Code, vm.OpSwap, vm.OpSub)
 					c.advance()
+				} else if upperVal == "ABORT" {
+					quot.Code = vm.AppendShortPush(quot.Code, 0)
+					quot.Code = vm.AppendShortPush(quot.Code, 0)
+					quot.Code = append(quot.Code, vm.OpAbort)
+					c.advance()
+				} else if code, ok := deviceWords[upperVal]; ok {
+					quot.Code = append(quot.Code, code...)
+					c.advance()
+				} else if name, ok := hostCall(upperVal); ok {
+					quot.Code = append(quot.Code, vm.HostInstruction(name)...)
+					c.advance()
+				} else if isMessageWord(token) {
+					word, length, op, err := c.messageWord()
+					if err != nil {
+						return err
+					}
+					c.appendDataRef(quotIndex, word)
+					quot.Code = vm.AppendShortPush(quot.Code, length)
+					quot.Code = append(quot.Code, op)
+					c.advance()
+				} else if upperVal == "EXIT" {
+					return fmt.Errorf("EXIT outside a word definition at line %d", token.Line)
+				} else if kind, ok := transferWords[upperVal]; ok {
+					quot.Code = append(quot.Code, quotTransfer(kind)...)
+					quot.transfers |= 1 << kind
+					c.advance()
 				} else if opcode, ok := builtins[upperVal]; ok {
 					quot.Code = append(quot.Code, opcode)
 					c.advance()
 				} else if combinators[upperVal] {
 					c.advance()
-					if err := c.compileQuotationCombinator(upperVal, quot); err != nil {
+					if err := c.compileQuotationCombinator(upperVal, quotIndex, &nested); err != nil {
 						return err
 					}
-				} else if word, ok := c.resolveWord(upperVal); ok {
+				} else if word, ok := c.resolveWord(upperVal); ok && word.Data {
+					c.appendDataRef(quotIndex, word)
+					c.advance()
+				} else if ok {
 					quot.Code = append(quot.Code, vm.OpCall)
-					quot.Code = append(quot.Code, vm.EncodeInt32(word.Address)...)
+					quot.Code = binary.BigEndian.AppendUint32(quot.Code, uint32(word.Address))
+					c.advance()
+				} else if lower, ok := registered(upperVal); ok {
+					if err := c.lower(lower, token, quotIndex, &nested); err != nil {
+						return err
+					}
+					quot = &c.quotations[quotIndex]
 					c.advance()
 				} else {
 					return fmt.Errorf("unknown word '%s' in quotation at line %d", token.Value, token.Line)
@@ -877,19 +1348,20 @@ func (c *Compiler) compileQuotation() error {
 
 			case TokenString:
 				// Handle string literals in quotations
+				start := int32(len(quot.Code))
 				for _, ch := range token.Value {
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(int32(ch))...)
-					quot.Code = append(quot.Code, vm.OpPush)
-					quot.Code = append(quot.Code, vm.EncodeInt32(1)...)
+					quot.Code = vm.AppendShortPush(quot.Code, int32(ch))
+					quot.Code = vm.AppendShortPush(quot.Code, 1)
 					quot.Code = append(quot.Code, vm.OpOut)
 				}
+				c.noteQuotString(quotIndex, token, start, int32(len(quot.Code)))
 				c.advance()
 
 			default:
 				return fmt.Errorf("invalid token %v in quotation at line %d", token.Type, token.Line)
 			}
 		}
+		c.noteLowered(fromPos, quotIndex, from, int32(len(c.quotations[quotIndex].Code)))
 	}
 
 	// Check for the closing bracket
@@ -897,25 +1369,51 @@ func (c *Compiler) compileQuotation() error {
 		return fmt.Errorf("unclosed quotation at line %d", c.tokens[c.pos-1].Line)
 	}
 
+	if err := c.checkTransfers(nested); err != nil {
+		return err
+	}
+
 	// Append RET to mark the end of the quotation
+	c.noteLowered(c.pos, quotIndex, int32(len(quot.Code)), int32(len(quot.Code))+1)
 	quot.Code = append(quot.Code, vm.OpRet)
 
 	// Skip the closing ]
 	c.advance()
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compile: Quotation %d compiled, code=%v\n", quotIndex, quot.Code)
+		c.logf(LevelTrace, "compile: Quotation %d compiled, code=%v", quotIndex, quot.Code)
+	}
+	return nil
+}
+
+// enterQuotation counts one more quotation open, which starts at line
+func (c *Compiler) enterQuotation(line int) error {
+	c.nesting++
+	if c.nesting > maxNesting {
+		return fmt.Errorf("quotations nested more than %d deep at line %d", maxNesting, line)
 	}
 	return nil
 }
 
-// compileQuotationCombinator compiles a combinator within a quotation
-func (c *Compiler) compileQuotationCombinator(name string, quot *Quotation) error {
+// compileQuotationCombinator compiles a combinator within a quotation.
+// nested holds the quotations written in it that no combinator has run
+// yet; the ones this combinator runs are taken from the end.
+func (c *Compiler) compileQuotationCombinator(name string, quotIndex int, nested *[]int) error {
+	take := func() uint8 {
+		if len(*nested) == 0 {
+			return 0
+		}
+		ran := (*nested)[len(*nested)-1]
+		*nested = (*nested)[:len(*nested)-1]
+		return c.quotations[ran].transfers
+	}
+	quot := &c.quotations[quotIndex]
 	switch strings.ToUpper(name) {
 	case "DIP":
 		// DIP in a quotation just emits CALLSTACK
 		// At runtime: stack has [... x quotation-addr]
 		// DIP will pop quotation-addr and call it, leaving x on stack
 		quot.Code = append(quot.Code, vm.OpCallStack)
+		c.appendLanding(quotIndex, take())
 
 	case "KEEP":
 		// KEEP: x [ quot ] keep -> x (quot x) x
@@ -923,10 +1421,40 @@ func (c *Compiler) compileQuotationCombinator(name string, quot *Quotation) erro
 		quot.Code = append(quot.Code, vm.OpDup)       // quot x x
 		quot.Code = append(quot.Code, vm.OpRot)       // x x quot
 		quot.Code = append(quot.Code, vm.OpCallStack) // x result
+		c.appendLanding(quotIndex, take())
 
 	case "CALL":
 		// CALL just executes the quotation on top of stack
 		quot.Code = append(quot.Code, vm.OpCallStack)
+		c.appendLanding(quotIndex, take())
+
+	case "?", "!:":
+		// The same code as in a word, with jumps within the quotation
+		transfers := take()
+		quot.Code = append(quot.Code, vm.OpSwap)
+		if name == "!:" {
+			quot.Code = vm.AppendShortPush(quot.Code, 0)
+			quot.Code = append(quot.Code, vm.OpEq)
+		}
+		skip := c.appendJump(quotIndex, vm.OpJz)
+		quot.Code = append(quot.Code, vm.OpCallStack)
+		c.appendLanding(quotIndex, transfers)
+		end := c.appendJump(quotIndex, vm.OpJmp)
+		c.jumpHere(skip)
+		quot.Code = append(quot.Code, vm.OpPop)
+		c.jumpHere(end)
+
+	case "?:":
+		falseTransfers, trueTransfers := take(), take()
+		quot.Code = append(quot.Code, vm.OpSwap, vm.OpRot)
+		elseJump := c.appendJump(quotIndex, vm.OpJz)
+		quot.Code = append(quot.Code, vm.OpSwap, vm.OpPop, vm.OpCallStack)
+		c.appendLanding(quotIndex, trueTransfers)
+		end := c.appendJump(quotIndex, vm.OpJmp)
+		c.jumpHere(elseJump)
+		quot.Code = append(quot.Code, vm.OpPop, vm.OpCallStack)
+		c.appendLanding(quotIndex, falseTransfers)
+		c.jumpHere(end)
 
 	default:
 		// For now, other combinators aren't supported in quotations
@@ -938,27 +1466,53 @@ func (c *Compiler) compileQuotationCombinator(name string, quot *Quotation) erro
 // compileCombinator compiles control flow combinators
 func (c *Compiler) compileCombinator(name string, line int) error {
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compileCombinator: Starting, bytecode length=%d, baseAddr=%d\n", len(c.bytecode), c.baseAddr)
-		fmt.Fprintf(os.Stderr, "compileCombinator: name=%s, line=%d\n", name, line)
+		c.logf(LevelTrace, "compileCombinator: Starting, bytecode length=%d, baseAddr=%d", len(c.bytecode), c.baseAddr)
+		c.logf(LevelTrace, "compileCombinator: name=%s, line=%d", name, line)
 	}
 	switch strings.ToUpper(name) {
-	case "CALL":
+	case "CALL", "DIP":
+		if c.inlineCall() {
+			return nil
+		}
+		transfers, err := c.takeQuotation(false)
+		if err != nil {
+			return err
+		}
 		c.emit(vm.OpCallStack)
+		c.emitExitHandler(transfers)
 		return nil
 	case "?:":
+		if c.inlineIfElse() {
+			return nil
+		}
 		return c.compileIfElse()
 	case "?":
+		if c.inlineIf(false) {
+			return nil
+		}
 		return c.compileIf()
 	case "!:":
+		if c.inlineIf(true) {
+			return nil
+		}
 		return c.compileUnless()
 	case "|:":
+		if c.inlineWhile() {
+			return nil
+		}
 		return c.compileWhile()
 	case "#:":
+		if c.inlineTimes() {
+			return nil
+		}
 		return c.compileTimes()
-	case "DIP":
-		return c.compileDip()
 	case "KEEP":
+		if c.inlineKeep() {
+			return nil
+		}
 		return c.compileKeep()
+	case "CASE":
+		return c.compileCase(line)
 	default:
 		return fmt.Errorf("unknown combinator '%s' at line %d", name, line)
 	}
@@ -967,66 +1521,77 @@ func (c *Compiler) compileCombinator(name string, line int) error {
 // compileIfElse compiles: condition [ true ] [ false ] ?:
 func (c *Compiler) compileIfElse() error {
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compileIfElse: Starting, bytecode length=%d, baseAddr=%d\n", len(c.bytecode), c.baseAddr)
+		c.logf(LevelTrace, "compileIfElse: Starting, bytecode length=%d, baseAddr=%d", len(c.bytecode), c.baseAddr)
 	}
 	if len(c.quotations) < 2 {
 		return fmt.Errorf("if-else requires two quotations at line %d", c.peek().Line)
 	}
 
-	// Check if the false (else) quotation ends with JMP (i.e., was TRO-optimized)
+	// Check if the false (else) quotation ends with JMP (i.e., was TRO-optimized).
+	// The flag is authoritative: with variable-length PUSHes a byte 5 from the
+	// end can be 0x15 without being a JMP.
 	falseQuot := c.quotations[len(c.quotations)-1]
-	isTailRecursive := len(falseQuot.Code) >= 5 &&
-		falseQuot.Code[len(falseQuot.Code)-5] == vm.OpJmp
+	falseTransfers, err := c.takeQuotation(false)
+	if err != nil {
+		return err
+	}
+	trueTransfers, err := c.takeQuotation(false)
+	if err != nil {
+		return err
+	}
+	// Inlined, an EXIT in it would be in the word's frame
+	isTailRecursive := falseQuot.tailJmp && falseTransfers == 0
 
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "compileIfElse: Checking false quotation for TRO\n")
-		fmt.Fprintf(os.Stderr, "  False quot length=%d\n", len(falseQuot.Code))
+		c.logf(LevelTrace, "compileIfElse: Checking false quotation for TRO")
+		c.logf(LevelTrace, "  False quot length=%d", len(falseQuot.Code))
 		if len(falseQuot.Code) >= 5 {
-			fmt.Fprintf(os.Stderr, "  falseQuot.Code[len-5]=0x%02X (OpJmp=0x%02X)\n",
+			c.logf(LevelTrace, "  falseQuot.Code[len-5]=0x%02X (OpJmp=0x%02X)",
 				falseQuot.Code[len(falseQuot.Code)-5], vm.OpJmp)
 		}
-		fmt.Fprintf(os.Stderr, "  isTailRecursive=%v\n", isTailRecursive)
+		c.logf(LevelTrace, "  isTailRecursive=%v", isTailRecursive)
 	}
 
 	c.emit(vm.OpSwap)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Emitted SWAP, bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "Emitted SWAP, bytecode=%v", c.bytecode)
 	}
 	c.emit(vm.OpRot)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Emitted ROT, bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "Emitted ROT, bytecode=%v", c.bytecode)
 	}
 	elseLabel := len(c.bytecode)
 	c.emit(vm.OpJz)
 	c.emit(0, 0, 0, 0)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Emitted JZ, elseLabel=%d (relative), bytecode length=%d\n", elseLabel, len(c.bytecode))
+		c.logf(LevelTrace, "Emitted JZ, elseLabel=%d (relative), bytecode length=%d", elseLabel, len(c.bytecode))
 	}
 	c.emit(vm.OpSwap)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Emitted SWAP (true branch), bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "Emitted SWAP (true branch), bytecode=%v", c.bytecode)
 	}
 	c.emit(vm.OpPop)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Emitted POP (true branch), bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "Emitted POP (true branch), bytecode=%v", c.bytecode)
 	}
 	c.emit(vm.OpCallStack)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Emitted CALLSTACK (true branch), bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "Emitted CALLSTACK (true branch), bytecode=%v", c.bytecode)
 	}
+	c.emitExitHandler(trueTransfers)
 	endLabel := len(c.bytecode)
 	c.emit(vm.OpJmp)
 	c.emit(0, 0, 0, 0)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Emitted JMP, endLabel=%d (relative), bytecode length=%d\n", endLabel, len(c.bytecode))
+		c.logf(LevelTrace, "Emitted JMP, endLabel=%d (relative), bytecode length=%d", endLabel, len(c.bytecode))
 	}
 	elseBranch := c.currentAddress()
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Else branch starts at absolute addr=%d, isTailRecursive=%v\n", elseBranch, isTailRecursive)
+		c.logf(LevelTrace, "Else branch starts at absolute addr=%d, isTailRecursive=%v", elseBranch, isTailRecursive)
 	}
 	c.emit(vm.OpPop)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Emitted POP (else branch), bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "Emitted POP (else branch), bytecode=%v", c.bytecode)
 	}
 
 	if isTailRecursive {
@@ -1043,39 +1608,45 @@ func (c *Compiler) compileIfElse() error {
 		// Inline the quotation code EXCEPT the final JMP
 		// Then emit a direct JMP (not via CALLSTACK)
 		quotCode := falseQuot.Code[:len(falseQuot.Code)-5] // Remove JMP instruction
+		inlineStart := c.currentOffset()
+		falseIndex := len(c.quotations) - 1
+		for _, r := range c.relocs[falseQuot.relocStart:] {
+			if r.owner == falseIndex {
+				c.relocs = append(c.relocs, reloc{owner: mainCode, offset: inlineStart + r.offset, quot: r.quot, data: r.data})
+			}
+		}
 		c.emit(quotCode...)
 		c.emit(vm.OpJmp)
-		c.emit(vm.EncodeInt32(jmpTarget)...)
+		c.emitInt32(jmpTarget)
 
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "Inlined tail-recursive quotation and emitted direct JMP to %d\n", jmpTarget)
+			c.logf(LevelTrace, "Inlined tail-recursive quotation and emitted direct JMP to %d", jmpTarget)
 		}
 	} else {
 		// Normal case: call the quotation
 		c.emit(vm.OpCallStack)
+		c.emitExitHandler(falseTransfers)
 		if c.trace {
-			fmt.Fprintf(os.Stderr, "Emitted CALLSTACK (else branch), bytecode=%v\n", c.bytecode)
+			c.logf(LevelTrace, "Emitted CALLSTACK (else branch), bytecode=%v", c.bytecode)
 		}
 	}
 
 	// Calculate end address AFTER emitting else branch code
 	end := c.currentAddress()
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "End at absolute addr=%d\n", end)
+		c.logf(LevelTrace, "End at absolute addr=%d", end)
 	}
 	// Patch JZ to jump to else branch
-	elseLabelBytes := vm.EncodeInt32(elseBranch)
-	copy(c.bytecode[elseLabel+1:elseLabel+5], elseLabelBytes)
+	c.patchInt32(int32(elseLabel+1), elseBranch)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Patching JZ at %d with addr=%d\n", elseLabel+1, elseBranch)
-		fmt.Fprintf(os.Stderr, "After JZ patch, bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "Patching JZ at %d with addr=%d", elseLabel+1, elseBranch)
+		c.logf(LevelTrace, "After JZ patch, bytecode=%v", c.bytecode)
 	}
 	// Patch JMP to jump to end (after else branch)
-	endLabelBytes := vm.EncodeInt32(end)
-	copy(c.bytecode[endLabel+1:endLabel+5], endLabelBytes)
+	c.patchInt32(int32(endLabel+1), end)
 	if c.trace {
-		fmt.Fprintf(os.Stderr, "Patching JMP at %d with addr=%d\n", endLabel+1, end)
-		fmt.Fprintf(os.Stderr, "After JMP patch, bytecode=%v\n", c.bytecode)
+		c.logf(LevelTrace, "Patching JMP at %d with addr=%d", endLabel+1, end)
+		c.logf(LevelTrace, "After JMP patch, bytecode=%v", c.bytecode)
 	}
 	return nil
 }
@@ -1085,21 +1656,24 @@ func (c *Compiler) compileIf() error {
 	if len(c.quotations) < 1 {
 		return fmt.Errorf("if requires one quotation at line %d", c.peek().Line)
 	}
+	transfers, err := c.takeQuotation(false)
+	if err != nil {
+		return err
+	}
 	c.emit(vm.OpSwap)
 	c.emit(vm.OpJz)
 	skipLabel := c.currentOffset() // Use offset, not address
 	c.emit(0, 0, 0, 0)
 	c.emit(vm.OpCallStack)
+	c.emitExitHandler(transfers)
 	c.emit(vm.OpJmp)
 	endLabel := c.currentOffset() // Use offset, not address
 	c.emit(0, 0, 0, 0)
 	skip := c.currentAddress() // Keep this as address for the jump target
 	c.emit(vm.OpPop)
-	end := c.currentAddress() // Keep this as address for the jump target
-	skipBytes := vm.EncodeInt32(skip)
-	copy(c.bytecode[skipLabel:skipLabel+4], skipBytes) // Now skipLabel is a valid offset
-	endBytes := vm.EncodeInt32(end)
-	copy(c.bytecode[endLabel:endLabel+4], endBytes) // Now endLabel is a valid offset
+	end := c.currentAddress()     // Keep this as address for the jump target
+	c.patchInt32(skipLabel, skip) // Now skipLabel is a valid offset
+	c.patchInt32(endLabel, end)   // Now endLabel is a valid offset
 	return nil
 }
 
@@ -1108,53 +1682,59 @@ func (c *Compiler) compileUnless() error {
 	if len(c.quotations) < 1 {
 		return fmt.Errorf("unless requires one quotation at line %d", c.peek().Line)
 	}
+	transfers, err := c.takeQuotation(false)
+	if err != nil {
+		return err
+	}
 	c.emit(vm.OpSwap)
-	c.emit(vm.OpPush)
-	c.emit(vm.EncodeInt32(0)...)
+	c.emitPush(0)
 	c.emit(vm.OpEq)
 	c.emit(vm.OpJz)
 	skipLabel := c.currentOffset()
 	c.emit(0, 0, 0, 0)
 	c.emit(vm.OpCallStack)
+	c.emitExitHandler(transfers)
 	c.emit(vm.OpJmp)
 	endLabel := c.currentOffset()
 	c.emit(0, 0, 0, 0)
 	skip := c.currentAddress()
 	c.emit(vm.OpPop)
 	end := c.currentAddress()
-	skipBytes := vm.EncodeInt32(skip)
-	copy(c.bytecode[skipLabel:skipLabel+4], skipBytes)
-	endBytes := vm.EncodeInt32(end)
-	copy(c.bytecode[endLabel:endLabel+4], endBytes)
+	c.patchInt32(skipLabel, skip)
+	c.patchInt32(endLabel, end)
 	return nil
 }
 
 // compileWhile compiles: [ condition ] [ body ] |:
+//
+// The quotation addresses live on the return stack for the duration of the
+// loop (condition on top), so a body that calls a word containing its own
+// loop, or recurses back into this one, cannot clobber them.
 func (c *Compiler) compileWhile() error {
 	if len(c.quotations) < 2 {
 		return fmt.Errorf("while requires two quotations at line %d", c.peek().Line)
 	}
-	tempCondAddr, err := c.allocTemp(4)
+
+	bodyTransfers, err := c.takeQuotation(true)
 	if err != nil {
 		return err
 	}
-	tempBodyAddr, err := c.allocTemp(4)
+	condTransfers, err := c.takeQuotation(true)
 	if err != nil {
 		return err
 	}
+	var leaves []int32 // JMPs to the exit, which drops the loop state
 
-	c.emit(vm.OpStore)
-	c.emit(vm.EncodeInt32(tempBodyAddr)...)
-	c.emit(vm.OpStore)
-	c.emit(vm.EncodeInt32(tempCondAddr)...)
+	// Stack: [... value cond body]
+	c.emit(vm.OpToR) // R: [body]
+	c.emit(vm.OpToR) // R: [body cond], condition on top for R@
 
 	loopStart := c.currentAddress()
 
 	c.emit(vm.OpDup)
-
-	c.emit(vm.OpLoad)
-	c.emit(vm.EncodeInt32(tempCondAddr)...)
+	c.emit(vm.OpRFetch)
 	c.emit(vm.OpCallStack)
+	c.emitLoopLanding(condTransfers, nil, &leaves)
 	// Stack: [... original-value result]
 
 	// NO SWAP - result is already on top for JZ
@@ -1164,17 +1744,22 @@ func (c *Compiler) compileWhile() error {
 	c.emit(0, 0, 0, 0)
 	// JZ pops result, leaves original-value
 
-	c.emit(vm.OpLoad)
-	c.emit(vm.EncodeInt32(tempBodyAddr)...)
+	// Fetch body from under the condition: R> R@ SWAP >R
+	c.emit(vm.OpFromR, vm.OpRFetch, vm.OpSwap, vm.OpToR)
 	c.emit(vm.OpCallStack)
+	c.emitLoopLanding(bodyTransfers, nil, &leaves)
 
 	c.emit(vm.OpJmp)
-	c.emit(vm.EncodeInt32(loopStart)...)
+	c.emitInt32(loopStart)
 
 	exit := c.currentAddress()
-	exitBytes := vm.EncodeInt32(exit)
-	copy(c.bytecode[exitLabel:exitLabel+4], exitBytes)
+	c.patchInt32(exitLabel, exit)
+	for _, at := range leaves {
+		c.patchInt32(at, exit)
+	}
 
+	// Drop the loop state from the return stack
+	c.emit(vm.OpFromR, vm.OpPop, vm.OpFromR, vm.OpPop)
 	return nil
 }
 
@@ -1183,20 +1768,14 @@ func (c *Compiler) compileWhile() error {
 // Stack after: [... data'... ] (quotation executed count times on data)
 //
 // The quotation should operate on the data BELOW the loop control variables.
-// We need to temporarily remove quot-addr and count, execute the quotation,
-// then restore them for the next iteration.
+// The counter and quotation address are parked on the return stack while
+// the body runs, so nested and recursive loops each keep their own state.
 func (c *Compiler) compileTimes() error {
-	// Use reserved memory to save loop variables
-	// This is similar to the dip combinator
-	tempQuotAddr, err := c.allocTemp(4)
-	if err != nil {
-		return err
-	}
-	tempCountAddr, err := c.allocTemp(4)
+	transfers, err := c.takeQuotation(true)
 	if err != nil {
 		return err
 	}
-
+	var leaves []int32 // JMPs past the exit, the loop state already dropped
 	loopStart := c.currentAddress()
 
 	// Stack: [... data... quot-addr count]
@@ -1205,35 +1784,32 @@ func (c *Compiler) compileTimes() error {
 	exitLabel := c.currentOffset()
 	c.emit(0, 0, 0, 0)
 
-	// Save count-1 to memory
-	c.emit(vm.OpDec)   // [... data... quot-addr count-1]
-	c.emit(vm.OpStore) // [... data... quot-addr]
-	c.emit(vm.EncodeInt32(tempCountAddr)...)
-
-	// Save quot-addr to memory
-	c.emit(vm.OpStore) // [... data...]
-	c.emit(vm.EncodeInt32(tempQuotAddr)...)
+	// Park count-1 and quot-addr on the return stack
+	c.emit(vm.OpDec) // [... data... quot-addr count-1]
+	c.emit(vm.OpToR) // [... data... quot-addr], R: [count-1]
+	c.emit(vm.OpDup) // [... data... quot-addr quot-addr]
+	c.emit(vm.OpToR) // [... data... quot-addr], R: [count-1 quot-addr]
 
 	// Execute quotation on the data
-	c.emit(vm.OpLoad) // [... data... quot-addr]
-	c.emit(vm.EncodeInt32(tempQuotAddr)...)
 	c.emit(vm.OpCallStack) // [... data'...], quotation executes
+	c.emitLoopLanding(transfers, loopExit, &leaves)
 
 	// Restore loop variables
-	c.emit(vm.OpLoad) // [... data'... quot-addr]
-	c.emit(vm.EncodeInt32(tempQuotAddr)...)
-	c.emit(vm.OpLoad) // [... data'... quot-addr count-1]
-	c.emit(vm.EncodeInt32(tempCountAddr)...)
+	c.emit(vm.OpFromR) // [... data'... quot-addr]
+	c.emit(vm.OpFromR) // [... data'... quot-addr count-1]
 
 	c.emit(vm.OpJmp)
-	c.emit(vm.EncodeInt32(loopStart)...)
+	c.emitInt32(loopStart)
 
 	// Exit: clean up
 	exit := c.currentAddress()
 	c.emit(vm.OpPop) // Pop count (0)
 	c.emit(vm.OpPop) // Pop quot-addr
 
-	copy(c.bytecode[exitLabel:exitLabel+4], vm.EncodeInt32(exit))
+	c.patchInt32(exitLabel, exit)
+	for _, at := range leaves {
+		c.patchInt32(at, c.currentAddress())
+	}
 	return nil
 }
 
@@ -1241,7 +1817,12 @@ func (c *Compiler) compileTimes() error {
 func (c *Compiler) compileDip() error {
 	// Stack: [... x body-addr]
 	// Execute body directly
+	transfers, err := c.takeQuotation(false)
+	if err != nil {
+		return err
+	}
 	c.emit(vm.OpCallStack) // Execute body: [... x']
+	c.emitExitHandler(transfers)
 
 	return nil
 }
@@ -1263,11 +1844,194 @@ func (c *Compiler) compileKeep() error {
 
 	// Step 4: Emit CALLSTACK to pop quot (as the address), push the return address to the return stack, and jump to execute the quotation
 	// The quotation executes on the top x (consumes it and produces result), leaving the original x preserved below
+	transfers, err := c.takeQuotation(false)
+	if err != nil {
+		return err
+	}
 	c.emit(vm.OpCallStack)
+	c.emitExitHandler(transfers)
+
+	return nil
+}
 
+// compileCase compiles: x CASE k1 OF ... ENDOF k2 OF ... ENDOF default... ENDCASE
+//
+// As in Forth, x is dropped before a matching clause runs, while default
+// code sees x on top of the stack and ENDCASE drops it afterwards. Keys must
+// be number literals. When they are dense the dispatch is a single JMPTABLE;
+// otherwise each clause compares and branches in turn. On return c.pos is at
+// the ENDCASE token, which the caller consumes.
+func (c *Compiler) compileCase(line int) error {
+	c.advance() // Skip CASE
+	keys, err := c.scanCaseKeys(line)
+	if err != nil {
+		return err
+	}
+	useTable, low, span := denseCaseKeys(keys)
+	tableOffset := -1
+	if useTable {
+		// Stack: [... x] → [... x x-low], then dispatch on the index
+		c.emit(vm.OpDup)
+		c.emitPush(low)
+		c.emit(vm.OpSub)
+		tableOffset = len(c.bytecode)
+		c.emit(vm.JmpTableInstruction(0, make([]int32, span))...)
+	}
+	targets := make(map[int32]int32)
+	var endJumps []int32
+	defaultAddr := int32(-1)
+	for {
+		token := c.peek()
+		if token.Type == TokenEOF || token.Type == TokenSemicolon {
+			return fmt.Errorf("CASE at line %d has no matching ENDCASE", line)
+		}
+		if token.Type == TokenWord && strings.ToUpper(token.Value) == "ENDCASE" {
+			break
+		}
+		if !c.atCaseClause() {
+			if defaultAddr < 0 {
+				defaultAddr = c.currentAddress()
+			}
+			if err := c.compileNext(); err != nil {
+				return err
+			}
+			continue
+		}
+		if defaultAddr >= 0 {
+			return fmt.Errorf("OF at line %d follows default code in CASE; put the default last", token.Line)
+		}
+		key, _ := ParseNumber(token) // Validated by scanCaseKeys
+		c.advance()
+		c.advance() // Skip OF
+		nextLabel := int32(-1)
+		if useTable {
+			targets[key] = c.currentAddress()
+		} else {
+			c.emit(vm.OpDup)
+			c.emitPush(key)
+			c.emit(vm.OpEq)
+			c.emit(vm.OpJz)
+			nextLabel = c.currentOffset()
+			c.emit(0, 0, 0, 0)
+		}
+		c.emit(vm.OpPop) // Drop x before the clause body
+		for {
+			t := c.peek()
+			if t.Type == TokenWord && strings.ToUpper(t.Value) == "ENDOF" {
+				c.advance()
+				break
+			}
+			if t.Type == TokenEOF || t.Type == TokenSemicolon || (t.Type == TokenWord && strings.ToUpper(t.Value) == "ENDCASE") {
+				return fmt.Errorf("OF at line %d has no matching ENDOF", token.Line)
+			}
+			if err := c.compileNext(); err != nil {
+				return err
+			}
+		}
+		c.emit(vm.OpJmp)
+		endJumps = append(endJumps, c.currentOffset())
+		c.emit(0, 0, 0, 0)
+		if nextLabel >= 0 {
+			c.patchInt32(nextLabel, c.currentAddress())
+		}
+	}
+	if defaultAddr < 0 {
+		defaultAddr = c.currentAddress()
+	}
+	c.emit(vm.OpPop) // ENDCASE drops x after the default code
+	end := c.currentAddress()
+	for _, offset := range endJumps {
+		c.patchInt32(offset, end)
+	}
+	if tableOffset >= 0 {
+		c.patchInt32(int32(tableOffset+3), defaultAddr)
+		for i := int32(0); i < span; i++ {
+			target, ok := targets[low+i]
+			if !ok {
+				target = defaultAddr
+			}
+			entry := tableOffset + 7 + int(i)*4
+			c.patchInt32(int32(entry), target)
+		}
+	}
 	return nil
 }
 
+// atCaseClause reports whether c.pos is at "key OF"
+func (c *Compiler) atCaseClause() bool {
+	if c.pos+1 >= len(c.tokens) {
+		return false
+	}
+	next := c.tokens[c.pos+1]
+	return c.peek().Type == TokenNumber && next.Type == TokenWord && strings.ToUpper(next.Value) == "OF"
+}
+
+// scanCaseKeys collects the keys of the CASE starting at c.pos without
+// compiling anything, so the dispatch strategy can be chosen up front
+func (c *Compiler) scanCaseKeys(line int) ([]int32, error) {
+	var keys []int32
+	seen := make(map[int32]bool)
+	depth := 0
+	for i := c.pos; i < len(c.tokens); i++ {
+		token := c.tokens[i]
+		if token.Type == TokenEOF || token.Type == TokenSemicolon {
+			break
+		}
+		if token.Type != TokenWord {
+			continue
+		}
+		switch strings.ToUpper(token.Value) {
+		case "CASE":
+			depth++
+		case "ENDCASE":
+			if depth == 0 {
+				return keys, nil
+			}
+			depth--
+		case "OF":
+			if depth > 0 {
+				continue
+			}
+			prev := c.tokens[i-1]
+			if i == c.pos || prev.Type != TokenNumber {
+				return nil, fmt.Errorf("OF at line %d must follow a number key", token.Line)
+			}
+			key, err := ParseNumber(prev)
+			if err != nil {
+				return nil, err
+			}
+			if seen[key] {
+				return nil, fmt.Errorf("duplicate CASE key %d at line %d", key, prev.Line)
+			}
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return nil, fmt.Errorf("CASE at line %d has no matching ENDCASE", line)
+}
+
+// denseCaseKeys decides whether a jump table beats a compare chain: at least
+// three keys, filling at least half of the range they span
+func denseCaseKeys(keys []int32) (dense bool, low int32, span int32) {
+	if len(keys) < 3 {
+		return false, 0, 0
+	}
+	low, high := keys[0], keys[0]
+	for _, k := range keys {
+		if k < low {
+			low = k
+		}
+		if k > high {
+			high = k
+		}
+	}
+	width := int64(high) - int64(low) + 1
+	if width > 2*int64(len(keys)) || width > math.MaxUint16 {
+		return false, 0, 0
+	}
+	return true, low, int32(width)
+}
+
 // Helper methods
 func (c *Compiler) peek() Token {
 	if c.pos >= len(c.tokens) {
@@ -1288,6 +2052,21 @@ func (c *Compiler) emit(bytes ...byte) {
 	c.bytecode = append(c.bytecode, bytes...)
 }
 
+// emitPush emits the shortest push of value
+func (c *Compiler) emitPush(value int32) {
+	c.bytecode = vm.AppendShortPush(c.bytecode, value)
+}
+
+// emitInt32 emits a 4-byte operand
+func (c *Compiler) emitInt32(value int32) {
+	c.bytecode = binary.BigEndian.AppendUint32(c.bytecode, uint32(value))
+}
+
+// patchInt32 overwrites the 4-byte operand at offset in the main code
+func (c *Compiler) patchInt32(offset int32, value int32) {
+	binary.BigEndian.PutUint32(c.bytecode[offset:], uint32(value))
+}
+
 // currentOffset returns the current position in the bytecode slice
 func (c *Compiler) currentOffset() int32 {
 	return int32(len(c.bytecode))
@@ -1298,12 +2077,48 @@ func (c *Compiler) currentAddress() int32 {
 	return int32(c.baseAddr + int32(len(c.bytecode)))
 }
 
-// allocTemp allocates space in reserved memory for temporary variables
-func (c *Compiler) allocTemp(size int32) (int32, error) {
-	addr := c.tempAlloc
-	c.tempAlloc += size
-	if c.tempAlloc > vm.ReservedMemorySize {
-		return 0, fmt.Errorf("reserved memory overflow: exceeded %d bytes", vm.ReservedMemorySize)
+// startQuotation adds a quotation for the [ at c.pos and returns its index.
+// Its code is carved from the arena with room for everything up to the
+// matching ], so compiling it rarely reallocates.
+func (c *Compiler) startQuotation(tempAddr int32, line int) int {
+	size := 16
+	if c.pos < len(c.closing) && c.closing[c.pos] > c.pos {
+		size = (c.closing[c.pos]-c.pos)*maxBytesPerToken + 1
+	}
+	if len(c.arena)+size > cap(c.arena) {
+		c.arena = make([]byte, 0, max(size, arenaChunk))
+	}
+	start := len(c.arena)
+	c.arena = c.arena[:start+size]
+	c.quotations = append(c.quotations, Quotation{
+		TempAddr:   tempAddr,
+		Code:       c.arena[start : start : start+size],
+		Line:       line,
+		relocStart: len(c.relocs),
+	})
+	return len(c.quotations) - 1
+}
+
+// addReloc records a quotation address operand at offset in owner's code
+func (c *Compiler) addReloc(owner int, offset int32, quot int) {
+	c.relocs = append(c.relocs, reloc{owner: owner, offset: offset, quot: quot})
+}
+
+// patchQuotRef overwrites a quotation address operand with the quotation's
+// real address, plus offset for a jump within it
+func (c *Compiler) patchQuotRef(operand []byte, quot int, offset int32) {
+	realAddr := c.quotations[quot].Address + offset
+	if c.trace {
+		c.logf(LevelTrace, "compile: Patched PUSH of quotation %d with addr=%d (was %d)",
+			quot, realAddr, int32(binary.BigEndian.Uint32(operand)))
+	}
+	binary.BigEndian.PutUint32(operand, uint32(realAddr))
+}
+
+// noteQuotString records a string literal emitted at [start, end) of a quotation's code
+func (c *Compiler) noteQuotString(quot int, token Token, start, end int32) {
+	if c.layout == nil {
+		return
 	}
-	return addr, nil
+	c.quotStrings = append(c.quotStrings, quotString{quot: quot, start: start, end: end, value: token.Value, line: token.Line})
 }
@@ -2,6 +2,12 @@
 package lux
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/rmay/nuxvm/pkg/vm"
@@ -702,6 +708,103 @@ func TestCompileLargeNumbers(t *testing.T) {
 	}
 }
 
+func TestNumberRange(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string // Expected error, "" if it compiles
+		wrap   bool
+		want   int32
+	}{
+		{source: "2147483647", want: 2147483647},
+		{source: "-2147483648", want: -2147483648},
+		{source: "2147483648", err: "2147483648 exceeds 32-bit range at line 1"},
+		{source: "-2147483649", err: "-2147483649 exceeds 32-bit range at line 1"},
+		{source: "1\n2\n123456789012", err: "123456789012 exceeds 32-bit range at line 3"},
+		{source: "0x80000000", err: "0x80000000 exceeds 32-bit range at line 1 (wrapping hex literals would read it as -2147483648)"},
+		{source: "0xFFFFFFFF", err: "0xFFFFFFFF exceeds 32-bit range at line 1 (wrapping hex literals would read it as -1)"},
+		{source: "0x100000000", err: "0x100000000 exceeds 32-bit range at line 1"},
+		// WrapHex reads hex literals as 32-bit patterns
+		{source: "0xFFFFFFFF", wrap: true, want: -1},
+		{source: "0x80000000", wrap: true, want: -2147483648},
+		{source: "0x7FFFFFFF", wrap: true, want: 2147483647},
+		{source: "DATA t 0xFFFFFFFF , t loadi", wrap: true, want: -1},
+		{source: "0x100000000", wrap: true, err: "0x100000000 exceeds 32-bit range"},
+		{source: "4294967295", wrap: true, err: "4294967295 exceeds 32-bit range"},
+	}
+	for _, tt := range tests {
+		prog, err := CompileProgram(tt.source, CompileOptions{WrapHex: tt.wrap})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: expected error %q, got %v", tt.source, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", tt.source, err)
+		}
+		if _, stack := runOutput(t, prog.Code); len(stack) != 1 || stack[0] != tt.want {
+			t.Errorf("%q: expected [%d], got %v", tt.source, tt.want, stack)
+		}
+	}
+}
+
+func TestNegativeNumbers(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []int32
+		err    string
+	}{
+		{source: "-0x10", want: []int32{-16}},
+		{source: "-0x80000000", want: []int32{-2147483648}},
+		{source: "-0x80000001", err: "-0x80000001 exceeds 32-bit range"},
+		// - on its own, or before anything but a digit, is a word
+		{source: "5 3 -", want: []int32{2}},
+		{source: "5 3-", err: "malformed number '3-'"},
+		{source: "5 -3", want: []int32{5, -3}},
+		{source: "@-x 7 ; -x", want: []int32{7}},
+		// A number ends where a word would
+		{source: "5 [ -3 ] call", want: []int32{5, -3}},
+		{source: "5-3", err: "malformed number '5-3' at line 1, column 1: write 5 3 - to subtract or 5 -3 for two numbers"},
+		{source: "1\n  0x1g", err: "malformed number '0x1g' at line 2, column 3"},
+		{source: "2dup", err: "malformed number '2dup'"},
+		{source: "0x", err: "invalid hex number '0x'"},
+	}
+	for _, tt := range tests {
+		prog, err := CompileProgram(tt.source, CompileOptions{})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: expected error %q, got %v", tt.source, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", tt.source, err)
+		}
+		if _, stack := runOutput(t, prog.Code); !reflect.DeepEqual(stack, tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.source, tt.want, stack)
+		}
+	}
+}
+
+func TestAdjacentNegativeNumberWarning(t *testing.T) {
+	for source, warned := range map[string]bool{
+		"5 -3":       true,
+		"5 3 -":      false,
+		"5\n-3":      false,
+		"5 , -3 , ":  false,
+		"-5 3":       false,
+		"[ 0 -1 ] ;": true,
+	} {
+		log := &recordLogger{min: LevelWarn}
+		if _, err := NewLexer(source).WithLogger(log).Tokenize(); err != nil {
+			t.Fatalf("%q: %v", source, err)
+		}
+		if got := len(log.messages) > 0; got != warned {
+			t.Errorf("%q: warned %v, want %v (%q)", source, got, warned, log.messages)
+		}
+	}
+}
+
 func TestCompileManyWords(t *testing.T) {
 	// Test with many word definitions
 	source := "@w1 1 + ; @w2 2 + ; @w3 3 + ; @w4 4 + ; @w5 5 + ; 10 w1 w2 w3 w4 w5"
@@ -1002,7 +1105,316 @@ func TestCompileStringEdgeCases(t *testing.T) {
 	}
 }
 
+func TestRegressionManyLoops(t *testing.T) {
+	// 600 sequential loops used to need 4800 bytes of reserved memory
+	source := "0"
+	for i := 0; i < 600; i++ {
+		source += " [ 1 + ] 1 #:"
+	}
+	prog, err := CompileProgram(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(prog.Code)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 600 {
+		t.Errorf("Expected [600], got %v", stack)
+	}
+}
+
+func TestRegressionLoopCallingLoopingWord(t *testing.T) {
+	// The inner word's loop must not share slots with the caller's loop
+	source := `
+		@inner [ 1 + ] 2 #: ;
+		0 [ inner ] 3 #:
+	`
+	bytecode, err := Compile(source)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(bytecode)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 6 {
+		t.Errorf("Expected [6], got %v", stack)
+	}
+}
+
+func TestRegressionRecursionThroughTimes(t *testing.T) {
+	// leaves(d) = 1 if d == 0, else 3 * leaves(d-1), with the recursion inside
+	// the #: body; each level's counter must survive the inner loops
+	source := `
+		@leaves dup 0 = swap [ dup 1 - leaves rot + swap ] roll 0 > 3 * #: drop ;
+		3 leaves
+	`
+	bytecode, err := Compile(source)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(bytecode)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 27 {
+		t.Errorf("Expected [27], got %v", stack)
+	}
+	if rs := machine.ReturnStack(); len(rs) != 0 {
+		t.Errorf("Expected loops to leave the return stack empty, got %v", rs)
+	}
+}
+
+func TestRegressionRecursionThroughWhile(t *testing.T) {
+	source := `
+		@count-down [ 0 > ] [ 1 - dup count-down drop ] |: ;
+		4 count-down
+	`
+	bytecode, err := Compile(source)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(bytecode)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 0 {
+		t.Errorf("Expected [0], got %v", stack)
+	}
+	if rs := machine.ReturnStack(); len(rs) != 0 {
+		t.Errorf("Expected loops to leave the return stack empty, got %v", rs)
+	}
+}
+
+func TestEntryWord(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		entry    string
+		noEntry  bool
+		expected []int32
+		wantErr  string
+	}{
+		{"main convention", "@main 1 2 + ; 10", "", false, []int32{10, 3}, ""},
+		{"main case-insensitive", "@MAIN 7 ;", "", false, []int32{7}, ""},
+		{"no main", "@helper 1 ; 5", "", false, []int32{5}, ""},
+		{"explicit entry", "@main 1 ; @demo 2 ;", "demo", false, []int32{2}, ""},
+		{"entry in module", "MODULE GFX @draw 9 ;", "gfx::draw", false, []int32{9}, ""},
+		{"no entry", "@main 1 ; 5", "", true, []int32{5}, ""},
+		{"unknown entry", "@main 1 ;", "start", false, nil, "entry word 'START' is not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := CompileProgram(tt.source, CompileOptions{Entry: tt.entry, NoEntry: tt.noEntry})
+			if tt.wantErr != "" {
+				if err == nil || !contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Compile error: %v", err)
+			}
+			machine := vm.NewVM(prog.Code)
+			if err := machine.Run(); err != nil {
+				t.Fatalf("Runtime error: %v", err)
+			}
+			stack := machine.Stack()
+			if len(stack) != len(tt.expected) {
+				t.Fatalf("Expected %v, got %v", tt.expected, stack)
+			}
+			for i := range stack {
+				if stack[i] != tt.expected[i] {
+					t.Errorf("Expected %v, got %v", tt.expected, stack)
+				}
+			}
+		})
+	}
+}
+
+func TestProgramSymbols(t *testing.T) {
+	prog, err := CompileProgram("@square dup * ; MODULE M @cube dup square * ; 3 cube", CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	img, err := vm.ParseImage(vm.EncodeImage(prog.Image()))
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	cube, ok := img.Lookup("M::CUBE")
+	if !ok || cube.Module != "M" {
+		t.Fatalf("Expected M::CUBE in module M, got %+v (found=%v)", cube, ok)
+	}
+	// Running a word on its own, as nux --entry does
+	machine := vm.NewVM(img.Code)
+	machine.Push(2)
+	if err := machine.CallWord(uint32(cube.Address)); err != nil {
+		t.Fatalf("CallWord error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 8 {
+		t.Errorf("Expected [8], got %v", stack)
+	}
+}
+
+func TestShortPushEncoding(t *testing.T) {
+	tests := []struct {
+		value int32
+		size  int
+	}{
+		{0, 2}, {127, 2}, {-128, 2},
+		{128, 3}, {-129, 3}, {32767, 3}, {-32768, 3},
+		{32768, 5}, {-32769, 5}, {0x7FFFFFFF, 5},
+	}
+	for _, tt := range tests {
+		bytecode, err := Compile(fmt.Sprintf("%d", tt.value))
+		if err != nil {
+			t.Fatalf("Compile error: %v", err)
+		}
+		// JMP main, the push, JMP over quotations, HALT
+		if got := len(bytecode) - 11; got != tt.size {
+			t.Errorf("%d: expected a %d-byte push, got %d bytes", tt.value, tt.size, got)
+		}
+		machine := vm.NewVM(bytecode)
+		if err := machine.Run(); err != nil {
+			t.Fatalf("Runtime error: %v", err)
+		}
+		if stack := machine.Stack(); len(stack) != 1 || stack[0] != tt.value {
+			t.Errorf("Expected [%d], got %v", tt.value, stack)
+		}
+	}
+}
+
+func TestRegressionElseEndingInJmpByte(t *testing.T) {
+	// The else quotation compiles to PUSH8 21, ADD, ADD, ADD, RET; its fifth
+	// byte from the end is 0x15 (JMP), which must not be mistaken for a
+	// tail-call JMP
+	source := `
+		@pick [ 100 ] [ 21 + + + ] ?: ;
+		1 2 3 0 pick
+	`
+	bytecode, err := Compile(source)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(bytecode)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 27 {
+		t.Errorf("Expected [27], got %v", stack)
+	}
+}
+
+func TestCase(t *testing.T) {
+	dense := `@name CASE 1 OF 10 ENDOF 2 OF 20 ENDOF 4 OF 40 ENDOF dup 99 + swap ENDCASE ;`
+	sparse := `@name CASE 1 OF 10 ENDOF 100 OF 20 ENDOF -5 OF 40 ENDOF dup 99 + swap ENDCASE ;`
+	tests := []struct {
+		name     string
+		source   string
+		expected []int32
+	}{
+		{"dense hit", dense + " 2 name", []int32{20}},
+		{"dense last", dense + " 4 name", []int32{40}},
+		{"dense hole", dense + " 3 name", []int32{102}},
+		{"dense below", dense + " 0 name", []int32{99}},
+		{"dense above", dense + " 70000 name", []int32{70099}},
+		{"sparse hit", sparse + " 100 name", []int32{20}},
+		{"sparse negative", sparse + " -5 name", []int32{40}},
+		{"sparse miss", sparse + " 7 name", []int32{106}},
+		{"no default", "3 CASE 1 OF 10 ENDOF ENDCASE", []int32{}},
+		{"toplevel", "2 CASE 1 OF 10 ENDOF 2 OF [ 5 ] call ENDOF ENDCASE", []int32{5}},
+		{"nested", "1 2 CASE 2 OF CASE 1 OF 11 ENDOF ENDCASE ENDOF ENDCASE", []int32{11}},
+		{"quotation in clause", "@f CASE 0 OF [ 1 ] [ 2 ] ?: ENDOF ENDCASE ; 0 0 f", []int32{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bytecode, err := Compile(tt.source)
+			if err != nil {
+				t.Fatalf("Compile error: %v", err)
+			}
+			machine := vm.NewVM(bytecode)
+			if err := machine.Run(); err != nil {
+				t.Fatalf("Runtime error: %v", err)
+			}
+			stack := machine.Stack()
+			if len(stack) != len(tt.expected) {
+				t.Fatalf("Expected %v, got %v", tt.expected, stack)
+			}
+			for i := range stack {
+				if stack[i] != tt.expected[i] {
+					t.Errorf("Expected %v, got %v", tt.expected, stack)
+				}
+			}
+		})
+	}
+}
+
+func TestCaseDispatch(t *testing.T) {
+	// Dense keys dispatch through a jump table: DUP PUSH8 low SUB JMPTABLE
+	tableDispatch := []byte{vm.OpDup, vm.OpPush8, 1, vm.OpSub, vm.OpJmpTable}
+	dense, err := Compile("2 CASE 1 OF 10 ENDOF 2 OF 20 ENDOF 3 OF 30 ENDOF ENDCASE")
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if !bytes.Contains(dense, tableDispatch) {
+		t.Errorf("Expected dense keys to compile to a jump table")
+	}
+	sparse, err := Compile("2 CASE 1 OF 10 ENDOF 2 OF 20 ENDOF 30 OF 30 ENDOF ENDCASE")
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if bytes.Contains(sparse, []byte{vm.OpSub, vm.OpJmpTable}) {
+		t.Errorf("Expected sparse keys to compile to a compare chain")
+	}
+}
+
+func TestCaseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"missing ENDCASE", "1 CASE 1 OF 2 ENDOF", "no matching ENDCASE"},
+		{"missing ENDOF", "1 CASE 1 OF 2 ENDCASE", "no matching ENDOF"},
+		{"duplicate key", "1 CASE 1 OF 2 ENDOF 1 OF 3 ENDOF ENDCASE", "duplicate CASE key 1"},
+		{"non-number key", "1 CASE dup OF 2 ENDOF ENDCASE", "must follow a number key"},
+		{"clause after default", "1 CASE 5 1 OF 2 ENDOF ENDCASE", "follows default code"},
+		{"unterminated in word", "@f CASE 1 OF 2 ENDOF ; 1 f", "no matching ENDCASE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.source)
+			if err == nil || !contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
 // Helper function to check if string contains substring
+func TestHostCall(t *testing.T) {
+	// At toplevel, in a word and in a quotation
+	bytecode, err := Compile("@twice host:double ; 5 twice 1 [ host:double ] call")
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(bytecode)
+	machine.RegisterHost("double", "math", func(m *vm.VM) error {
+		v, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		return m.Push(v * 2)
+	})
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if got := machine.Stack(); len(got) != 2 || got[0] != 10 || got[1] != 2 {
+		t.Errorf("Expected [10 2], got %v", got)
+	}
+}
+
 func contains(s, substr string) bool {
 	for i := 0; i <= len(s)-len(substr); i++ {
 		if s[i:i+len(substr)] == substr {
@@ -1011,3 +1423,516 @@ func contains(s, substr string) bool {
 	}
 	return false
 }
+
+func TestTimers(t *testing.T) {
+	bytecode, err := Compile("0 [ 42 ] after 1")
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(bytecode)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if got := machine.Stack(); len(got) != 2 || got[0] != 42 || got[1] != 1 {
+		t.Errorf("Expected [42 1], got %v", got)
+	}
+}
+
+func TestOnFrame(t *testing.T) {
+	// Each frame counts into address 100; the third halts
+	bytecode, err := Compile("@frame 100 loadi 1 + dup 100 storei 3 = [ halt ] ? ; 0 100 storei [ frame ] on-frame")
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(bytecode)
+	ticks := 0
+	for {
+		running, err := machine.Tick()
+		if err != nil {
+			t.Fatalf("Tick error: %v", err)
+		}
+		if !running {
+			break
+		}
+		ticks++
+	}
+	// The toplevel tick, then two frames that return; the third halts
+	if ticks != 3 {
+		t.Errorf("Expected 3 ticks before the program ended, got %d", ticks)
+	}
+	if got := binary.BigEndian.Uint32(machine.Memory()[100:]); got != 3 {
+		t.Errorf("Expected the counter at 3, got %d", got)
+	}
+}
+
+func TestOnFrameInQuotation(t *testing.T) {
+	// ON-FRAME, RND and SND compile the same in quotations, in and out of
+	// word definitions, as in the main code
+	for _, source := range []string{
+		"1 [ [ 5 snd ] on-frame ] ?",
+		"@setup 1 [ [ 5 snd ] on-frame ] ? ; setup",
+		"1 [ [ rnd drop 5 snd ] on-frame ] ?",
+	} {
+		bytecode, err := Compile(source)
+		if err != nil {
+			t.Fatalf("%s: Compile error: %v", source, err)
+		}
+		machine := vm.NewVM(bytecode)
+		for i := 0; i < 2; i++ {
+			if _, err := machine.Tick(); err != nil {
+				t.Fatalf("%s: Tick error: %v", source, err)
+			}
+		}
+		if got := machine.Stack(); len(got) != 2 || got[0] != 5 || got[1] != int32(vm.AudioSampleBufferAddr) {
+			t.Errorf("%s: Expected the frame to leave [5 %d], got %v", source, vm.AudioSampleBufferAddr, got)
+		}
+	}
+}
+
+// relocSource exercises every kind of address the compiler emits: word
+// calls, tail calls, branches, loops, a jump table and nested quotations
+const relocSource = `@day CASE 0 OF 10 ENDOF 1 OF 11 ENDOF 2 OF 12 ENDOF ENDCASE ;
+@countdown dup 0 > [ dup . dec countdown ] [ drop ] ?: ;
+@twice dup call call ;
+1 day . 3 countdown
+[ [ 7 . ] call ] twice
+[ 1 . ] 3 #:`
+
+// runRebased moves prog to load pad bytes above UserMemoryOffset, behind
+// a JMP over the padding, and returns what it prints
+func runRebased(t *testing.T, prog *Program, pad int32) string {
+	t.Helper()
+	moved, err := prog.Image().Rebase(vm.UserMemoryOffset + pad)
+	if err != nil {
+		t.Fatalf("Rebase failed: %v", err)
+	}
+	code := make([]byte, pad)
+	copy(code, vm.JmpInstruction(vm.UserMemoryOffset+pad))
+	out, _ := runOutput(t, append(code, moved.Program()...))
+	return out
+}
+
+func TestRelocations(t *testing.T) {
+	prog, err := CompileProgram(relocSource, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	want, _ := runOutput(t, prog.Code)
+	if got := runRebased(t, prog, 0x300); got != want {
+		t.Errorf("Rebased program printed %q, expected %q", got, want)
+	}
+}
+
+func TestCompileMemoryLayout(t *testing.T) {
+	code, err := Compile(relocSource)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	want, _ := runOutput(t, code)
+
+	// A larger reserved region moves user memory, and the code with it
+	prog, err := CompileProgram(relocSource, CompileOptions{ReservedSize: 8192})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if prog.Layout.BaseAddr != 8192+vm.DeviceMemorySize {
+		t.Errorf("Expected code at 0x%X, got 0x%X", 8192+vm.DeviceMemorySize, prog.Layout.BaseAddr)
+	}
+	machine, err := vm.NewVMForImage(prog.Image())
+	if err != nil {
+		t.Fatalf("NewVMForImage failed: %v", err)
+	}
+	var out strings.Builder
+	machine.OutputHandler = func(value, format int32) { fmt.Fprintf(&out, "%d ", value) }
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if out.String() != want {
+		t.Errorf("Printed %q, expected %q", out.String(), want)
+	}
+	if err := prog.Image().CheckLayout(vm.NewVM(nil)); err == nil {
+		t.Error("Expected a default VM to refuse the program")
+	}
+
+	// A base above user memory, behind a JMP over the gap
+	prog, err = CompileProgram(relocSource, CompileOptions{BaseAddr: vm.UserMemoryOffset + 0x40})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	code = make([]byte, 0x40)
+	copy(code, vm.JmpInstruction(vm.UserMemoryOffset+0x40))
+	if got, _ := runOutput(t, append(code, prog.Code...)); got != want {
+		t.Errorf("Printed %q, expected %q", got, want)
+	}
+
+	if _, err := CompileProgram("1", CompileOptions{BaseAddr: vm.DeviceMemoryOffset}); err == nil {
+		t.Error("Expected a base address in device memory to be refused")
+	}
+}
+
+// dataSource reads DATA tables from the toplevel, a word and quotations
+const dataSource = `DATA squares 0 , 1 , 4 , 9 , 16 ,
+@square 4 * squares + loadi ;
+DATA greeting "hi!" c, 0 c,
+3 square .
+[ squares 16 + loadi ] call .
+greeting loadi 16777216 / .
+1 [ 2 square ] [ 4 square ] ?: .
+42 squares storei squares loadi .`
+
+func TestData(t *testing.T) {
+	prog, err := CompileProgram(dataSource, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	want := "9 16 104 4 42 "
+	if got, _ := runOutput(t, prog.Code); got != want {
+		t.Errorf("Printed %q, expected %q", got, want)
+	}
+	if prog.DataSize != 24 {
+		t.Errorf("Expected 24 bytes of data, got %d", prog.DataSize)
+	}
+	img := prog.Image()
+	if len(img.Data) != 24 || len(img.Code)+len(img.Data) != len(prog.Code) {
+		t.Errorf("Expected the image to split code and data, got %d+%d bytes", len(img.Code), len(img.Data))
+	}
+	for _, sym := range prog.Symbols {
+		if sym.Name == "SQUARES" {
+			t.Errorf("Expected tables to be left out of the symbols")
+		}
+	}
+	var regions []string
+	for _, r := range prog.Layout.Regions {
+		if r.Kind == RegionData {
+			regions = append(regions, fmt.Sprintf("%s %d", r.Name, r.End-r.Start))
+		}
+	}
+	if got := strings.Join(regions, ", "); got != "SQUARES 20, GREETING 4" {
+		t.Errorf("Expected data regions for both tables, got %q", got)
+	}
+	if got := runRebased(t, prog, 0x200); got != want {
+		t.Errorf("Rebased program printed %q, expected %q", got, want)
+	}
+}
+
+func TestDataErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		entry  string
+		want   string
+	}{
+		{"DATA t", "", "has no values"},
+		{"DATA t 1 2 ,", "", "has no values"},
+		{"DATA t 300 c,", "", "does not fit in a byte"},
+		{"DATA t 1 , DATA t 2 ,", "", "already defined"},
+		{"DATA 5 1 ,", "", "expected table name"},
+		{"DATA t 1 ,", "t", "is a DATA table"},
+	}
+	for _, tt := range tests {
+		_, err := CompileProgram(tt.source, CompileOptions{Entry: tt.entry})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected an error containing %q, got %v", tt.source, tt.want, err)
+		}
+	}
+}
+
+func TestDataSharing(t *testing.T) {
+	prog, err := CompileProgram(`DATA yes "yes" c, 0 c,
+DATA ok "yes" c, 0 c,
+DATA primes 2 , 3 , 5 ,
+DATA odd 2 , 3 , 5 ,
+DATA bytes 2 c, 3 c, 5 c,
+yes ok = . primes odd = . primes bytes = .`, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if got, _ := runOutput(t, prog.Code); got != "1 1 0 " {
+		t.Errorf("Expected identical tables to share an address, printed %q", got)
+	}
+	if prog.DataSize != 4+12+3 {
+		t.Errorf("Expected %d bytes of data, got %d", 4+12+3, prog.DataSize)
+	}
+}
+
+func TestErrorStream(t *testing.T) {
+	code, err := Compile(`1 . 2 .err 65 emit-err [ 3 .err ] call`)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	var stdout, stderr strings.Builder
+	machine := vm.NewVM(code)
+	machine.Stdout, machine.Stderr = &stdout, &stderr
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stdout.String() != "1" || stderr.String() != "2A3" {
+		t.Errorf("Expected \"1\" and \"2A3\", got %q and %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestAcceptToNumber(t *testing.T) {
+	// Sum the numbers on each line until the input ends
+	code, err := Compile(`@line 100 12 accept ;
+@number? line dup -1 = [ drop 0 ] [ 100 swap >number ] ?: ;
+0 [ number? ] [ + ] |: .`)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	var out strings.Builder
+	machine := vm.NewVM(code)
+	machine.Stdin = strings.NewReader("1\n20\n300\n")
+	machine.Stdout = &out
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if out.String() != "321" {
+		t.Errorf("Expected 321, got %q", out.String())
+	}
+}
+
+func TestAssert(t *testing.T) {
+	source := `@small ( n -- ) 10 < ASSERT" n must be under 10" ;
+@check dup small [ 0 = ASSERT" in a quotation" ] call ;
+3 small 0 check 1 .
+N small`
+	tests := []struct {
+		n    string
+		want string
+	}{
+		{"4", ""},
+		{"12", "assertion failed: line 1: n must be under 10"},
+	}
+	for _, tt := range tests {
+		code, err := Compile(strings.Replace(source, "N", tt.n, 1))
+		if err != nil {
+			t.Fatalf("Compile error: %v", err)
+		}
+		err = vm.NewVM(code).Run()
+		if tt.want == "" && err != nil {
+			t.Errorf("With %s, expected every assertion to pass, got %v", tt.n, err)
+		}
+		if tt.want != "" && (err == nil || !strings.HasSuffix(err.Error(), tt.want)) {
+			t.Errorf("With %s, expected %q, got %v", tt.n, tt.want, err)
+		}
+	}
+
+	code, err := Compile(`[ 1 ASSERT" fine" ] call 1 [ 5 ASSERT" also fine" ] [ ] ?:
+0 ASSERT"   keeps  its spaces "`)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	err = vm.NewVM(code).Run()
+	if want := `line 2:   keeps  its spaces `; err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("Expected the failing assertion on line 2, got %v", err)
+	}
+
+	if _, err := Compile(`1 ASSERT" unclosed`); err == nil {
+		t.Error("Expected an unclosed message to fail to compile")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	code, err := Compile(`@check dup 0 < [ ABORT" negative input" ] ? ;
+5 check . -1 check . "not reached"`)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(code)
+	output := machine.CaptureOutput()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if output.Stdout() != "5" || output.Stderr() != "negative input\n" {
+		t.Errorf("Expected %q and %q, got %q and %q", "5", "negative input\n", output.Stdout(), output.Stderr())
+	}
+	if machine.ExitStatus() != vm.ExitAborted {
+		t.Errorf("Expected ExitAborted, got %d", machine.ExitStatus())
+	}
+
+	code, err = Compile(`"a" [ abort ] call "b"`)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine = vm.NewVM(code)
+	output = machine.CaptureOutput()
+	if err := machine.Run(); err != nil || output.Stdout() != "a" || output.Stderr() != "" {
+		t.Errorf("Expected ABORT to stop after %q with no message, got %q, %q (%v)", "a", output.Stdout(), output.Stderr(), err)
+	}
+}
+
+func TestExit(t *testing.T) {
+	tests := []struct {
+		name, source, want string
+	}{
+		{"word", `@sign dup 0 < [ drop -1 exit ] ? drop 1 ; -5 sign . 5 sign .`, "-1 1 "},
+		{"both branches", `@pick 0 = [ 10 exit ] [ 20 exit ] ?: 30 ; 0 pick . 1 pick .`, "10 20 "},
+		{"times", `@first [ 42 exit ] 5 #: 0 ; [ first . ] 3 #:`, "42 42 42 "},
+		{"while body", `@once 0 [ drop 1 ] [ inc exit ] |: 99 ; [ once . ] 2 #:`, "1 1 "},
+		{"while condition", `@never [ drop drop 7 exit ] [ ] |: 9 ; [ 0 never . ] 2 #:`, "7 7 "},
+		{"nested", `@deep [ [ 7 exit ] call 8 ] call 9 ; [ deep . ] 2 #:`, "7 7 "},
+		{"dip and keep", `@d 1 [ 2 exit ] dip 3 ; @k 1 [ exit ] keep 3 ; d . . k . .`, "2 1 1 1 "},
+		{"tail recursion", `@down dup 0 = [ drop 100 exit ] [ dec down ] ?: 5 ; 3 down .`, "100 "},
+	}
+	for _, tt := range tests {
+		code, err := Compile(tt.source)
+		if err != nil {
+			t.Fatalf("%s: compile error: %v", tt.name, err)
+		}
+		out, stack := runOutput(t, code)
+		if out != tt.want || len(stack) != 0 {
+			t.Errorf("%s: printed %q with stack %v, expected %q", tt.name, out, stack, tt.want)
+		}
+	}
+
+	for _, source := range []string{
+		`1 exit`,
+		`[ exit ] call`,
+		`@twice dup call call ; @bad [ exit ] twice ;`,
+	} {
+		if _, err := Compile(source); err == nil || !strings.Contains(err.Error(), "EXIT") && !strings.Contains(err.Error(), "exits") {
+			t.Errorf("Expected %q to be refused, got %v", source, err)
+		}
+	}
+}
+
+func TestLeaveContinue(t *testing.T) {
+	tests := []struct {
+		name, source, want string
+	}{
+		{"times leave", `0 [ dup 3 = [ leave ] ? dup . inc ] 10 #: .`, "0 1 2 3 "},
+		{"times continue", `1 2 3 4 [ dup 2 mod 0 = [ drop continue ] ? . ] 4 #:`, "3 1 "},
+		{"while leave", `0 [ 100 < ] [ inc dup 7 = [ leave ] ? ] |: .`, "7 "},
+		{"while continue", `0 [ 5 < ] [ inc dup 3 = [ continue ] ? dup . ] |: .`, "1 2 4 5 5 "},
+		{"unless", `0 [ dup 4 < [ leave ] !: inc ] 10 #: .`, "4 "},
+		{"if-else", `0 [ dup 2 = [ leave ] [ dup . ] ?: inc ] 10 #: .`, "0 1 2 "},
+		{"nested", `@deep [ [ [ leave ] call ] call 99 . ] 3 #: 5 . ; deep`, "5 "},
+		{"inner loop", `@inner [ leave ] 5 #: 1 . ; [ inner ] 2 #:`, "1 1 "},
+		{"in a word", `@upto [ dup 4 > [ leave ] ? dup . inc ] 10 #: drop ; 1 upto`, "1 2 3 4 "},
+		{"with exit", `@find [ dup 3 = [ exit ] ? dup 8 = [ leave ] ? inc ] 10 #: drop 0 ; 1 find . 5 find .`, "3 0 "},
+	}
+	for _, tt := range tests {
+		code, err := Compile(tt.source)
+		if err != nil {
+			t.Fatalf("%s: compile error: %v", tt.name, err)
+		}
+		out, stack := runOutput(t, code)
+		if out != tt.want || len(stack) != 0 {
+			t.Errorf("%s: printed %q with stack %v, expected %q", tt.name, out, stack, tt.want)
+		}
+	}
+
+	for _, source := range []string{
+		`leave`,
+		`@w continue ;`,
+		`[ leave ] call`,
+		`@w [ continue ] ? ;`,
+		`@twice dup call call ; [ leave ] twice`,
+	} {
+		if _, err := Compile(source); err == nil || !strings.Contains(err.Error(), "LEAVE") && !strings.Contains(err.Error(), "CONTINUE") {
+			t.Errorf("Expected %q to be refused, got %v", source, err)
+		}
+	}
+}
+
+func TestNestingLimits(t *testing.T) {
+	nest := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + strings.Repeat(close, n)
+	}
+	tests := []struct {
+		source string
+		err    string // "" if it compiles
+	}{
+		{nest("[ ", "] ", maxNesting) + "drop", ""},
+		{nest("[ ", "] ", maxNesting+1) + "drop", "quotations nested more than 256 deep at line 1"},
+		{"@deep " + nest("[ ", "] ", maxNesting) + "drop ; deep", ""},
+		{"@deep " + nest("[ ", "] ", maxNesting+1) + "drop ; deep", "quotations nested more than 256 deep at line 1"},
+		{nest("( ", ") ", maxNesting) + "1", ""},
+		{"1\n" + nest("(", ")", maxNesting+1), "comments nested more than 256 deep at line 2, column 257"},
+		// Far past the limits, an error and not a crash
+		{nest("[ ", "] ", 200000), "quotations nested more than 256 deep"},
+		{nest("(", ")", 200000), "comments nested more than 256 deep"},
+		{strings.Repeat("[ ", 200000), "nested more than 256 deep"},
+	}
+	for _, tt := range tests {
+		_, err := CompileProgram(tt.source, CompileOptions{})
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%.40q...: compile error: %v", tt.source, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%.40q...: expected error %q, got %v", tt.source, tt.err, err)
+		}
+	}
+}
+
+func TestFieldOutput(t *testing.T) {
+	tests := []struct{ source, want string }{
+		{"42 5 .r", "   42"},
+		{"-42 6 .z", "-00042"},
+		{"12345 3 .r 7 0 .z", "123457"},
+		{"[ 1 3 .r ] 2 #:", "  1  1"},
+		{"@col 4 .r ; 1 col 22 col", "   1  22"},
+	}
+	for _, tt := range tests {
+		code, err := Compile(tt.source)
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", tt.source, err)
+		}
+		machine := vm.NewVM(code)
+		output := machine.CaptureOutput()
+		if err := machine.Run(); err != nil {
+			t.Fatalf("%q: run failed: %v", tt.source, err)
+		}
+		if got := output.Stdout(); got != tt.want {
+			t.Errorf("%q: printed %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestPrintValues(t *testing.T) {
+	tests := []struct{ source, want string }{
+		{"1 2 3 .s 44 emit 2 .n 44 emit .", "1 2 3,2 3,3"},
+		{".s 5 .", "5"},
+		{"DATA squares 0 , 1 , 4 , 9 ,\nsquares 4 .cells", "0 1 4 9"},
+		{"[ 7 .s ] 2 #:", "77 7"},
+	}
+	for _, tt := range tests {
+		code, err := Compile(tt.source)
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", tt.source, err)
+		}
+		machine := vm.NewVM(code)
+		output := machine.CaptureOutput()
+		if err := machine.Run(); err != nil {
+			t.Fatalf("%q: run failed: %v", tt.source, err)
+		}
+		if got := output.Stdout(); got != tt.want {
+			t.Errorf("%q: printed %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	// A recursive word that stops itself before the return stack runs out:
+	// the first call is 1 deep, so it recurses 99 times
+	source := `
+		@dive ( n -- n ) rdepth 100 < [ 1 + dive ] ? ;
+		0 dive . 32 emit memsize . 32 emit pc@ .
+	`
+	code, err := Compile(source)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(code)
+	output := machine.CaptureOutput()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	fields := strings.Fields(output.Stdout())
+	if len(fields) != 3 || fields[0] != "99" || fields[1] != fmt.Sprint(len(machine.Memory())) {
+		t.Fatalf("Expected 99 and the memory size, got %q", output.Stdout())
+	}
+	pc, _ := strconv.Atoi(fields[2])
+	if pc < vm.UserMemoryOffset || pc >= vm.UserMemoryOffset+len(code) || code[pc-vm.UserMemoryOffset] != vm.OpPCFetch {
+		t.Errorf("Expected the address of the PC@, got %d", pc)
+	}
+}
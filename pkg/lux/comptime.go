@@ -0,0 +1,163 @@
+package lux
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// compileTimeSteps bounds how long a COMPILE-TIME block may run, so a
+// block that never finishes fails the build instead of hanging it
+const compileTimeSteps = 10_000_000
+
+// isCompileTime reports whether token, after a [, makes the bracket a
+// COMPILE-TIME block
+func isCompileTime(token Token) bool {
+	return token.Type == TokenWord && strings.EqualFold(token.Value, "COMPILE-TIME")
+}
+
+// compileTime replaces each [COMPILE-TIME ... ] block in tokens with the
+// numbers it leaves on the stack when run in a VM of its own. A block can
+// use the words, DATA tables and modules defined above it, but not the
+// word it is written in. programStart is where the user's program starts
+// after any library modules; compileTime returns where it starts in the
+// new tokens.
+func compileTime(tokens []Token, programStart int) ([]Token, int, error) {
+	out := make([]Token, 0, len(tokens))
+	newStart := programStart
+	defStart, depth := -1, 0
+	for i := 0; i < len(tokens); i++ {
+		if i == programStart {
+			newStart = len(out)
+		}
+		tok := tokens[i]
+		switch tok.Type {
+		case TokenAtSign:
+			defStart, depth = len(out), 0
+		case TokenSemicolon:
+			if depth == 0 {
+				defStart = -1
+			}
+		case TokenRBracket:
+			depth--
+		case TokenLBracket:
+			if i+1 >= len(tokens) || !isCompileTime(tokens[i+1]) {
+				depth++
+				break
+			}
+			end := matchingBracket(tokens, i)
+			if end < 0 {
+				return nil, 0, fmt.Errorf("unclosed COMPILE-TIME block at line %d", tok.Line)
+			}
+			above := out
+			if defStart >= 0 {
+				above = out[:defStart]
+			}
+			start := -1
+			if i >= programStart {
+				start = min(newStart, len(above))
+			}
+			values, err := evalCompileTime(above, start, tokens[i+2:end])
+			if err != nil {
+				return nil, 0, fmt.Errorf("in the COMPILE-TIME block at line %d: %v", tok.Line, err)
+			}
+			for _, v := range values {
+				out = append(out, Token{Type: TokenNumber, Value: strconv.Itoa(int(v)), Line: tok.Line, Column: tok.Column})
+			}
+			i = end
+			continue
+		}
+		out = append(out, tok)
+	}
+	return out, newStart, nil
+}
+
+// matchingBracket returns the index of the ] closing the [ at open, or -1
+func matchingBracket(tokens []Token, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i].Type {
+		case TokenLBracket:
+			depth++
+		case TokenRBracket:
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// evalCompileTime compiles body after the definitions in above, whose
+// user program starts at programStart (-1 when the block is in a library
+// module), runs it and returns the stack it leaves. What it prints is
+// discarded.
+func evalCompileTime(above []Token, programStart int, body []Token) ([]int32, error) {
+	defs, start := definitionsOf(above, programStart)
+	program := append(append(defs, body...), Token{Type: TokenEOF})
+	program, start, err := compileTime(program, start)
+	if err != nil {
+		return nil, err
+	}
+	c := newCompiler(program, vm.UserMemoryOffset, CompileOptions{NoEntry: true})
+	c.programStart = start
+	code, err := c.compile()
+	if err != nil {
+		return nil, err
+	}
+	machine := vm.NewVM(code)
+	machine.Deterministic = true
+	machine.OutputHandler = func(value, format int32) {}
+	err = machine.RunLimited(vm.Limits{MaxSteps: compileTimeSteps})
+	var limit *vm.LimitError
+	if errors.As(err, &limit) {
+		return nil, fmt.Errorf("did not finish within %d steps", compileTimeSteps)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return machine.Stack(), nil
+}
+
+// definitionsOf keeps the word definitions, DATA tables and MODULE and
+// IMPORT directives of tokens, in order, and drops the code that runs.
+// It returns them with where programStart falls among them.
+func definitionsOf(tokens []Token, programStart int) ([]Token, int) {
+	scan := &Compiler{tokens: tokens, imports: make(map[string]string)}
+	var kept []Token
+	start := -1
+	for scan.pos < len(tokens) {
+		if scan.pos == programStart {
+			start = len(kept)
+		}
+		from := scan.pos
+		token := scan.peek()
+		switch {
+		case token.Type == TokenAtSign:
+			scan.skipWordDefinition()
+		case isData(token):
+			scan.skipData()
+		case token.Type == TokenWord && strings.EqualFold(token.Value, "MODULE"):
+			if scan.handleModuleDirective() != nil {
+				scan.pos = from + 1
+				continue
+			}
+		case token.Type == TokenWord && strings.EqualFold(token.Value, "IMPORT"):
+			if scan.handleImportDirective() != nil {
+				scan.pos = from + 1
+				continue
+			}
+		default:
+			scan.advance()
+			continue
+		}
+		kept = append(kept, tokens[from:scan.pos]...)
+	}
+	if programStart >= 0 && start < 0 {
+		start = len(kept)
+	}
+	return kept, start
+}
@@ -0,0 +1,60 @@
+package lux
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileTime(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []int32
+	}{
+		{"[COMPILE-TIME 6 7 * ]", []int32{42}},
+		{"[COMPILE-TIME ] 1", []int32{1}},
+		{"@square dup * ; [COMPILE-TIME 12 square 1 2 ] [COMPILE-TIME 3 ]", []int32{144, 1, 2, 3}},
+		{"DATA t 5 , 9 , [COMPILE-TIME t 4 + loadi ]", []int32{9}},
+		{"@size [COMPILE-TIME 64 64 * ] ; size size +", []int32{8192}},
+		{"[COMPILE-TIME [COMPILE-TIME 2 3 + ] dup * ]", []int32{25}},
+		// Toplevel code above a block does not run in it
+		{`1000 "x" [COMPILE-TIME 1 [ 2 + ] call "printed" ]`, []int32{1000, 3}},
+	}
+	for _, tt := range tests {
+		prog, err := CompileProgram(tt.source, CompileOptions{})
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", tt.source, err)
+		}
+		if _, stack := runOutput(t, prog.Code); !reflect.DeepEqual(stack, tt.want) {
+			t.Errorf("%q: got stack %v, want %v", tt.source, stack, tt.want)
+		}
+	}
+}
+
+func TestCompileTimeErrors(t *testing.T) {
+	tests := []struct{ source, want string }{
+		{"@later 1 ;\n[COMPILE-TIME later2 ]", "unknown word"},
+		{"[COMPILE-TIME later ] @later 1 ;", "unknown word"},
+		{"@self [COMPILE-TIME self ] ;", "unknown word"},
+		{"1\n[COMPILE-TIME 1 0 / ]", "line 2"},
+		{"@spin spin ; [COMPILE-TIME spin ]", "did not finish"},
+		{"[COMPILE-TIME 1 ", "unclosed COMPILE-TIME"},
+	}
+	for _, tt := range tests {
+		_, err := CompileProgram(tt.source, CompileOptions{})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected an error containing %q, got %v", tt.source, tt.want, err)
+		}
+	}
+}
+
+func TestCompileTimeIncremental(t *testing.T) {
+	source := "@sq dup * ;\n@big [COMPILE-TIME 9 sq ] ;\nbig ."
+	prog, err := NewIncremental(CompileOptions{}).Compile(source)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if out, _ := runOutput(t, prog.Code); out != "81 " {
+		t.Errorf("Expected 81, got %q", out)
+	}
+}
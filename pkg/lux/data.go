@@ -0,0 +1,226 @@
+package lux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// dataTable is a DATA definition, placed at offset in the data section
+type dataTable struct {
+	name   string
+	offset int32
+	size   int32
+	line   int
+	label  string // Shown in the layout instead of name, if set
+}
+
+// dataRef is an operand that holds the address of a data offset
+type dataRef struct {
+	offset uint32 // Operand offset in the compiled code
+	data   int32  // Offset in the data section
+}
+
+// dataTarget is the reloc quot for operands that address the data section
+const dataTarget = -1
+
+// parseData reads the DATA directive at c.pos and returns the table's name
+// and contents. Each value is a number or a string followed by , to store
+// it in 4-byte cells or by c, to store it in bytes; a string stores one
+// character per cell or byte. The table ends at the first value without
+// a separator after it.
+func (c *Compiler) parseData() (string, []byte, error) {
+	directive := c.advance()
+	nameToken := c.advance()
+	if nameToken.Type != TokenWord {
+		return "", nil, fmt.Errorf("expected table name after DATA at line %d", directive.Line)
+	}
+	var data []byte
+	for c.pos+1 < len(c.tokens) {
+		value, sep := c.tokens[c.pos], c.tokens[c.pos+1]
+		if value.Type != TokenNumber && value.Type != TokenString || !isDataSeparator(sep) {
+			break
+		}
+		c.pos += 2
+		var values []int32
+		if value.Type == TokenString {
+			for _, ch := range value.Value {
+				values = append(values, int32(ch))
+			}
+		} else {
+			n, err := ParseNumber(value)
+			if err != nil {
+				return "", nil, err
+			}
+			values = append(values, n)
+		}
+		for _, v := range values {
+			if sep.Value == "," {
+				data = binary.BigEndian.AppendUint32(data, uint32(v))
+				continue
+			}
+			if v < -128 || v > 255 {
+				return "", nil, fmt.Errorf("value %d in DATA %s does not fit in a byte at line %d", v, nameToken.Value, value.Line)
+			}
+			data = append(data, byte(v))
+		}
+	}
+	if len(data) == 0 {
+		return "", nil, fmt.Errorf("DATA %s has no values at line %d", nameToken.Value, directive.Line)
+	}
+	return nameToken.Value, data, nil
+}
+
+// isDataSeparator reports whether token is , or c, after a DATA value
+func isDataSeparator(token Token) bool {
+	return token.Type == TokenWord && (token.Value == "," || strings.EqualFold(token.Value, "c,"))
+}
+
+// isData reports whether token starts a DATA directive
+func isData(token Token) bool {
+	return token.Type == TokenWord && strings.EqualFold(token.Value, "DATA")
+}
+
+// collectData places every DATA table in the tokens before anything is
+// compiled, so code can use a table defined anywhere in the program
+func (c *Compiler) collectData() error {
+	start, module := c.pos, c.currentModule
+	defer func() { c.pos, c.currentModule = start, module }()
+	for c.pos < len(c.tokens) && c.peek().Type != TokenEOF {
+		if c.pos == c.programStart {
+			c.currentModule = ""
+		}
+		token := c.peek()
+		switch {
+		case token.Type == TokenAtSign:
+			c.skipWordDefinition()
+		case token.Type == TokenWord && strings.EqualFold(token.Value, "MODULE"):
+			if err := c.handleModuleDirective(); err != nil {
+				return err
+			}
+		case isData(token):
+			name, data, err := c.parseData()
+			if err != nil {
+				return err
+			}
+			name = qualifiedName(c.currentModule, name)
+			if _, ok := c.dictionary[name]; ok {
+				return fmt.Errorf("'%s' is already defined, at line %d", name, token.Line)
+			}
+			c.addTable(dataTable{name: name, line: token.Line}, data)
+		default:
+			c.advance()
+		}
+	}
+	// Each ASSERT" and ABORT" message is a table too. One a build placed
+	// already, as the toplevel of an incremental build sees, keeps its place.
+	for i, token := range c.tokens[:len(c.tokens)-1] {
+		if !isMessageWord(token) {
+			continue
+		}
+		name, text := messageTable(token, c.tokens[i+1])
+		if _, ok := c.dictionary[name]; !ok {
+			label := fmt.Sprintf("%s %s\"", strings.ToUpper(token.Value), c.tokens[i+1].Value)
+			c.addTable(dataTable{name: name, line: token.Line, label: label}, text)
+		}
+	}
+	return nil
+}
+
+// addTable places data for t in the data section and defines t's name
+func (c *Compiler) addTable(t dataTable, data []byte) {
+	// Tables with the same contents share one copy
+	offset, ok := c.dataPool[string(data)]
+	if !ok {
+		offset = int32(len(c.dataBytes))
+		c.dataBytes = append(c.dataBytes, data...)
+		if c.dataPool == nil {
+			c.dataPool = make(map[string]int32)
+		}
+		c.dataPool[string(data)] = offset
+	}
+	t.offset, t.size = offset, int32(len(data))
+	c.dataTables = append(c.dataTables, t)
+	c.dictionary[t.name] = Word{Name: t.name, Address: offset, Module: c.currentModule, Data: true}
+}
+
+// messageWords are the words that take the string after them as a
+// message, and the instruction each passes it to as an address and length
+var messageWords = map[string]byte{
+	`ASSERT"`: vm.OpAssert,
+	`ABORT"`:  vm.OpAbort,
+}
+
+// isMessageWord reports whether token is one of the messageWords, which
+// the lexer always follows with the message string
+func isMessageWord(token Token) bool {
+	_, ok := messageWords[strings.ToUpper(token.Value)]
+	return token.Type == TokenWord && ok
+}
+
+// messageTable returns the dictionary name of the table holding the
+// message of a message word, and the message as stored: one character per
+// cell. An assertion's message starts with its line, so a failed assertion
+// says where it is.
+func messageTable(token, message Token) (string, []byte) {
+	word := strings.ToUpper(token.Value)
+	name := fmt.Sprintf("%s%d:%d %s", word, token.Line, token.Column, strings.ToUpper(message.Value))
+	value := message.Value
+	if word == `ASSERT"` {
+		value = fmt.Sprintf("line %d: %s", token.Line, value)
+	}
+	var text []byte
+	for _, ch := range []byte(value) {
+		text = binary.BigEndian.AppendUint32(text, uint32(ch))
+	}
+	return name, text
+}
+
+// messageWord returns the table holding the message of the message word
+// at c.pos, the message's length in characters and the instruction that
+// takes it, and advances to the message
+func (c *Compiler) messageWord() (Word, int32, byte, error) {
+	token := c.advance()
+	name, text := messageTable(token, c.peek())
+	word, ok := c.resolveWord(name)
+	if !ok || c.peek().Type != TokenString {
+		return Word{}, 0, 0, fmt.Errorf("expected a message after %s at line %d", token.Value, token.Line)
+	}
+	return word, int32(len(text) / 4), messageWords[strings.ToUpper(token.Value)], nil
+}
+
+// skipData moves past a DATA directive that collectData already placed
+func (c *Compiler) skipData() {
+	c.parseData()
+}
+
+// emitDataRef emits a PUSH of the address of a table, which is patched
+// once the data section is placed after the code
+func (c *Compiler) emitDataRef(word Word) {
+	c.emit(vm.OpPush)
+	c.relocs = append(c.relocs, reloc{owner: mainCode, offset: c.currentOffset(), quot: dataTarget, data: word.Address})
+	c.emitInt32(0)
+}
+
+// appendDataRef appends a PUSH of the address of a table to a quotation
+func (c *Compiler) appendDataRef(quotIndex int, word Word) {
+	quot := &c.quotations[quotIndex]
+	quot.Code = append(quot.Code, vm.OpPush)
+	c.relocs = append(c.relocs, reloc{owner: quotIndex, offset: int32(len(quot.Code)), quot: dataTarget, data: word.Address})
+	quot.Code = binary.BigEndian.AppendUint32(quot.Code, 0)
+}
+
+// placeData appends the data section at the end of the code
+func (c *Compiler) placeData() {
+	start := c.currentAddress()
+	for _, t := range c.dataTables {
+		name := t.name
+		if t.label != "" {
+			name = t.label
+		}
+		c.layout.add(RegionData, name, start+t.offset, start+t.offset+t.size, t.line)
+	}
+	c.bytecode = append(c.bytecode, c.dataBytes...)
+}
@@ -0,0 +1,54 @@
+package lux
+
+import (
+	"slices"
+	"strings"
+)
+
+// StackEffect is what a word's comment says it takes and leaves, as in
+// @square ( n -- n*n ): the names of its inputs and outputs, deepest first
+type StackEffect struct {
+	Inputs  []string
+	Outputs []string
+}
+
+// ParseStackEffect reads a stack effect comment's text, "n -- n*n", and
+// reports whether it is one: it must have exactly one --
+func ParseStackEffect(text string) (StackEffect, bool) {
+	in, out, ok := strings.Cut(text, "--")
+	if !ok || strings.Contains(out, "--") {
+		return StackEffect{}, false
+	}
+	return StackEffect{Inputs: strings.Fields(in), Outputs: strings.Fields(out)}, true
+}
+
+func (e StackEffect) String() string {
+	return "( " + strings.Join(slices.Concat(e.Inputs, []string{"--"}, e.Outputs), " ") + " )"
+}
+
+// StackEffects returns the stack effect each word in source declares with
+// a comment right after its name, by the word's name in upper case. Words
+// without one are left out.
+func StackEffects(source string) (map[string]StackEffect, error) {
+	effects := make(map[string]StackEffect)
+	lexer := NewLexer(source)
+	var last []Token // The two tokens before the current one
+	for {
+		token, err := lexer.NextToken()
+		if err != nil {
+			return nil, err
+		}
+		if token.Type == TokenEOF {
+			return effects, nil
+		}
+		if token.Type == TokenComment && len(last) == 2 && last[0].Type == TokenAtSign && last[1].Type == TokenWord {
+			if effect, ok := ParseStackEffect(token.Value); ok {
+				effects[strings.ToUpper(last[1].Value)] = effect
+			}
+		}
+		last = append(last, token)
+		if len(last) > 2 {
+			last = last[1:]
+		}
+	}
+}
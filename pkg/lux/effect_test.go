@@ -0,0 +1,33 @@
+package lux
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStackEffects(t *testing.T) {
+	source := `
+@square ( n -- n*n ) dup * ;
+@sum (a b -- c) + ;
+@plain dup ;
+@later dup ( n -- n n ) ;
+( not -- a word )
+`
+	effects, err := StackEffects(source)
+	if err != nil {
+		t.Fatalf("StackEffects failed: %v", err)
+	}
+	want := map[string]StackEffect{
+		"SQUARE": {Inputs: []string{"n"}, Outputs: []string{"n*n"}},
+		"SUM":    {Inputs: []string{"a", "b"}, Outputs: []string{"c"}},
+	}
+	if !reflect.DeepEqual(effects, want) {
+		t.Errorf("Expected %v, got %v", want, effects)
+	}
+	if got := effects["SUM"].String(); got != "( a b -- c )" {
+		t.Errorf("Expected ( a b -- c ), got %s", got)
+	}
+	if _, ok := ParseStackEffect("just a comment"); ok {
+		t.Error("Expected a comment without -- not to be a stack effect")
+	}
+}
@@ -0,0 +1,193 @@
+package lux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// EXIT leaves the word it is written in, LEAVE ends the innermost |: or #:
+// loop and CONTINUE goes on with its next pass, wherever they are. In the
+// word's own code EXIT is a RET. In a quotation the return address is the
+// combinator's, not the word's or the loop's, so the quotation instead
+// returns 5, 10 or 15 bytes past it. Every combinator that runs a
+// quotation making such a transfer puts a landing right after its
+// CALLSTACK: a JMP past it for a normal return, then a 5-byte slot for
+// each transfer up to the last one it makes. Each slot is a JMP to the
+// transfer's handler, except the last, which holds the handler itself. A
+// loop's handlers drop its state and return from the word, end the loop or
+// go round again; in the word's own code an exit handler is a RET; in an
+// enclosing quotation each handler makes the same transfer again.
+
+// Transfers out of a quotation besides a normal return, numbered by the
+// slot they land in
+const (
+	transferExit = 1 + iota
+	transferLeave
+	transferContinue
+)
+
+// transferWords are the words that make a transfer
+var transferWords = map[string]int{
+	"EXIT":     transferExit,
+	"LEAVE":    transferLeave,
+	"CONTINUE": transferContinue,
+}
+
+// quotTransfer is what a transfer compiles to in a quotation
+func quotTransfer(kind int) []byte {
+	return []byte{vm.OpFromR, vm.OpPush8, byte(5 * kind), vm.OpAdd, vm.OpToR, vm.OpRet}
+}
+
+// loopExit drops the two return stack cells a |: or #: loop keeps
+var loopExit = []byte{vm.OpFromR, vm.OpPop, vm.OpFromR, vm.OpPop}
+
+// transferName returns the word making the first transfer that is set
+func transferName(transfers uint8) string {
+	for name, kind := range transferWords {
+		if kind == bits.TrailingZeros8(transfers) {
+			return name
+		}
+	}
+	return ""
+}
+
+// takeQuotation removes the last quotation written in the word or toplevel
+// code, which the combinator being compiled runs, and returns the transfers
+// it makes. Only a loop takes a quotation that leaves or continues.
+func (c *Compiler) takeQuotation(loop bool) (uint8, error) {
+	if len(c.openQuots) == 0 {
+		return 0, nil
+	}
+	quot := c.quotations[c.openQuots[len(c.openQuots)-1]]
+	c.openQuots = c.openQuots[:len(c.openQuots)-1]
+	if loops := quot.transfers &^ (1 << transferExit); loops != 0 && !loop {
+		return 0, fmt.Errorf("%s outside a |: or #: loop in the quotation at line %d", transferName(loops), quot.Line)
+	}
+	return quot.transfers, nil
+}
+
+// emitLanding emits the landing for the CALLSTACK just emitted in the main
+// code. handler emits the handler for a transfer, or reports false without
+// emitting anything for one that lands where a normal return goes.
+func (c *Compiler) emitLanding(transfers uint8, handler func(kind int) bool) {
+	if transfers == 0 {
+		return
+	}
+	jump := func() int32 {
+		c.emit(vm.OpJmp)
+		at := c.currentOffset()
+		c.emitInt32(0)
+		return at
+	}
+	last := bits.Len8(transfers) - 1
+	normal := []int32{jump()}
+	slots := make([]int32, last)
+	for kind := 1; kind < last; kind++ {
+		slots[kind] = jump()
+	}
+	if !handler(last) {
+		normal = append(normal, jump())
+	}
+	for kind := 1; kind < last; kind++ {
+		if transfers&(1<<kind) != 0 {
+			start := c.currentAddress()
+			if handler(kind) {
+				c.patchInt32(slots[kind], start)
+				continue
+			}
+		}
+		normal = append(normal, slots[kind])
+	}
+	for _, at := range normal {
+		c.patchInt32(at, c.currentAddress())
+	}
+}
+
+// emitExitHandler emits the landing for a CALLSTACK in the main code of a
+// combinator other than a loop, where only an exit can land
+func (c *Compiler) emitExitHandler(transfers uint8) {
+	c.emitLanding(transfers, func(int) bool {
+		c.emit(vm.OpRet)
+		return true
+	})
+}
+
+// appendJump appends a JMP or JZ to a quotation and returns the reloc
+// that jumpHere points at its target
+func (c *Compiler) appendJump(quotIndex int, op byte) int {
+	quot := &c.quotations[quotIndex]
+	quot.Code = append(quot.Code, op)
+	c.relocs = append(c.relocs, reloc{owner: quotIndex, offset: int32(len(quot.Code)), quot: quotIndex})
+	quot.Code = binary.BigEndian.AppendUint32(quot.Code, 0)
+	return len(c.relocs) - 1
+}
+
+// jumpHere points the jump of reloc r at the end of its quotation's code
+func (c *Compiler) jumpHere(r int) {
+	c.relocs[r].data = int32(len(c.quotations[c.relocs[r].owner].Code))
+}
+
+// appendLanding appends the landing for the CALLSTACK just appended to a
+// quotation, whose handlers carry each transfer on out of the quotation
+func (c *Compiler) appendLanding(quotIndex int, transfers uint8) {
+	if transfers == 0 {
+		return
+	}
+	last := bits.Len8(transfers) - 1
+	normal := []int{c.appendJump(quotIndex, vm.OpJmp)}
+	slots := make([]int, last)
+	for kind := 1; kind < last; kind++ {
+		slots[kind] = c.appendJump(quotIndex, vm.OpJmp)
+	}
+	quot := &c.quotations[quotIndex]
+	quot.Code = append(quot.Code, quotTransfer(last)...)
+	for kind := 1; kind < last; kind++ {
+		if transfers&(1<<kind) == 0 {
+			normal = append(normal, slots[kind])
+			continue
+		}
+		c.jumpHere(slots[kind])
+		quot.Code = append(quot.Code, quotTransfer(kind)...)
+	}
+	for _, r := range normal {
+		c.jumpHere(r)
+	}
+	quot.transfers |= transfers
+}
+
+// checkTransfers reports a quotation making a transfer that no combinator
+// ran. Passed to another word, it would return into code without a
+// landing.
+func (c *Compiler) checkTransfers(quots []int) error {
+	for _, i := range quots {
+		if transfers := c.quotations[i].transfers; transfers != 0 {
+			return fmt.Errorf("the quotation at line %d uses %s but is not given straight to a combinator", c.quotations[i].Line, transferName(transfers))
+		}
+	}
+	return nil
+}
+
+// emitLoopLanding emits the landing for a CALLSTACK of a |: or #: loop. A
+// leave runs cleanup and jumps to the end of the loop, through an operand
+// added to leaves for the caller to patch; a continue lands where a normal
+// return goes.
+func (c *Compiler) emitLoopLanding(transfers uint8, cleanup []byte, leaves *[]int32) {
+	c.emitLanding(transfers, func(kind int) bool {
+		switch kind {
+		case transferExit:
+			c.emit(loopExit...)
+			c.emit(vm.OpRet)
+		case transferLeave:
+			c.emit(cleanup...)
+			c.emit(vm.OpJmp)
+			*leaves = append(*leaves, c.currentOffset())
+			c.emitInt32(0)
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,134 @@
+package lux
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// Lowered is the code one construct of the program compiled to: a number,
+// word, string, [ (the push of its quotation's address), ] (the quotation's
+// RET) or ; (the word's RET). The code of constructs written inside it,
+// such as an inlined quotation's, may lie within [Start, End) and is
+// theirs.
+type Lowered struct {
+	Scope        string // Word it is written in, or "toplevel"
+	Source       string // As written
+	Line, Column int
+	Start, End   int32 // Address range of its code, empty if it compiled to nothing
+}
+
+// lowered is a Lowered whose range is still an offset in the main code or
+// a quotation's code, until they are placed
+type lowered struct {
+	Lowered
+	owner int // mainCode or a quotation index
+}
+
+// noteLowered records that the token at pos compiled to [start, end) of
+// owner's code. Library modules linked into the program are not recorded.
+func (c *Compiler) noteLowered(pos, owner int, start, end int32) {
+	if !c.explain || pos < c.programStart {
+		return
+	}
+	token := c.tokens[pos]
+	source := token.Value
+	if token.Type == TokenString {
+		source = fmt.Sprintf("%q", token.Value)
+	}
+	scope := c.defining
+	if scope == "" {
+		scope = "toplevel"
+	}
+	c.lowered = append(c.lowered, lowered{Lowered{Scope: scope, Source: source, Line: token.Line, Column: token.Column, Start: start, End: end}, owner})
+}
+
+// noteMain records the token at pos, whose main code started at start
+// before removed bytes had been taken out by inlining
+func (c *Compiler) noteMain(pos int, start int32, removed int32) {
+	c.noteLowered(pos, mainCode, start-(c.removed-removed), c.currentOffset())
+}
+
+// placeLowered turns every recorded range into addresses, once the
+// quotations are placed
+func (c *Compiler) placeLowered() []Lowered {
+	if !c.explain {
+		return nil
+	}
+	out := make([]Lowered, len(c.lowered))
+	for i, l := range c.lowered {
+		base := c.baseAddr
+		if l.owner != mainCode {
+			base = c.quotations[l.owner].Address
+		}
+		l.Start += base
+		l.End += base
+		out[i] = l.Lowered
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Line != out[j].Line {
+			return out[i].Line < out[j].Line
+		}
+		return out[i].Column < out[j].Column
+	})
+	return out
+}
+
+// WriteLowering writes, for each construct in Program.Lowered, the
+// instructions it compiled to with their addresses, in source order under
+// the word it is in. Each instruction is listed once, under the innermost
+// construct whose range holds it, so a combinator shows only the jumps it
+// added around the quotations it inlined.
+func (p *Program) WriteLowering(w io.Writer) {
+	names := make(map[uint32]string, len(p.Symbols))
+	for _, sym := range p.Symbols {
+		names[uint32(sym.Address)] = sym.Name
+	}
+	type instruction struct {
+		addr int32
+		text string
+	}
+	code := p.Code[:int32(len(p.Code))-p.DataSize]
+	base := p.Layout.BaseAddr
+	owned := make([][]instruction, len(p.Lowered))
+	for at := 0; at < len(code); {
+		text, size := vm.FormatInstruction(code, at, names)
+		if size == 0 {
+			break
+		}
+		addr := base + int32(at)
+		innermost := -1
+		for i, l := range p.Lowered {
+			if addr >= l.Start && addr < l.End && (innermost < 0 || l.End-l.Start < p.Lowered[innermost].End-p.Lowered[innermost].Start) {
+				innermost = i
+			}
+		}
+		if innermost >= 0 {
+			owned[innermost] = append(owned[innermost], instruction{addr, text})
+		}
+		at += size
+	}
+	scope := ""
+	for i, l := range p.Lowered {
+		if l.Scope != scope {
+			if scope != "" {
+				fmt.Fprintln(w)
+			}
+			scope = l.Scope
+			fmt.Fprintf(w, "%s:\n", scope)
+		}
+		where := fmt.Sprintf("%d:%d", l.Line, l.Column)
+		if len(owned[i]) == 0 {
+			fmt.Fprintf(w, "  %-7s %-12s (no code)\n", where, l.Source)
+			continue
+		}
+		for k, ins := range owned[i] {
+			if k > 0 {
+				where, l.Source = "", ""
+			}
+			fmt.Fprintf(w, "  %-7s %-12s 0x%04X  %s\n", where, l.Source, ins.addr, ins.text)
+		}
+	}
+}
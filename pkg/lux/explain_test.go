@@ -0,0 +1,45 @@
+package lux
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExplainLowering(t *testing.T) {
+	source := "@sq dup * ;\n3 sq .\n1 [ 2 ] [ 3 ] ?: .\n[ [ 7 ] call ] call"
+	prog, err := CompileProgram(source, CompileOptions{ExplainLowering: true})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	var out bytes.Buffer
+	prog.WriteLowering(&out)
+	listing := out.String()
+	for _, want := range []string{
+		"SQ:\n  1:5     dup          0x4005  DUP\n  1:9     *            0x4006  MUL\n  1:11    ;            0x4007  RET\n",
+		"  2:3     sq           0x400A  CALL 0x4005 <SQ>\n",
+		"  2:6     .            0x400F  PUSH8 0\n                       0x4011  OUT\n",
+		// The branches are inlined, so their [ and ] compile to nothing
+		"  3:3     [            (no code)\n  3:5     2            ",
+		"  3:7     ]            (no code)\n",
+		"  3:15    ?:           0x4014  JZ ",
+		// A quotation that is called keeps its push and RET
+		"  4:3     [            0x",
+		"  4:7     ]            0x",
+	} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("Expected %q in:\n%s", want, listing)
+		}
+	}
+	// Every instruction of the toplevel code is listed once
+	if got := strings.Count(listing, "0x4014  JZ"); got != 1 {
+		t.Errorf("Expected the JZ listed once, got %d times:\n%s", got, listing)
+	}
+	plain, err := CompileProgram(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if !bytes.Equal(plain.Code, prog.Code) || plain.Lowered != nil {
+		t.Errorf("Expected explaining to leave the code alone and record nothing otherwise")
+	}
+}
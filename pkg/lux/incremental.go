@@ -0,0 +1,416 @@
+package lux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// Incremental compiles successive versions of one program, as an editor or
+// REPL produces them. Each word definition is compiled into its own chunk of
+// code that stays at a fixed address; a later build reuses every chunk whose
+// definition is unchanged and whose references still resolve to the same
+// addresses, so editing one word recompiles only that word and the words
+// that call it. Changed words are appended after the existing chunks, and
+// the toplevel code, which is cheap, is recompiled at the end each time.
+// Once dead chunks outweigh live ones the program is rebuilt from scratch.
+type Incremental struct {
+	opts   CompileOptions
+	code   []byte            // Entry JMP followed by every chunk, live or dead
+	pushes []uint32          // Offsets in code of quotation address operands
+	chunks map[string]*chunk // Chunks of the last build, by definition key
+	stats  IncrementalStats
+}
+
+// IncrementalStats describes the work done by the last Incremental.Compile
+type IncrementalStats struct {
+	Recompiled []string // Words compiled afresh, in source order
+	Reused     int      // Words whose code was kept from an earlier build
+	Rebuilt    bool     // Every word was recompiled, e.g. to reclaim dead code
+}
+
+// chunk is one compiled word definition
+type chunk struct {
+	addr    int32            // Where the chunk's code starts
+	code    []byte           // Compiled as a definitions-only program at addr
+	pushes  []uint32         // Offsets in code of quotation address operands
+	data    []dataRef        // Table address operands, patched per build
+	word    Word             // The word it defines
+	lookups map[string]int32 // Every word name the definition resolved, and to what
+	imports map[string]string
+	line    int      // Source line of the @, for its regions
+	regions []Region // The word, its quotations and strings
+}
+
+// definition is a word definition found in the source, with the module
+// context it must be compiled in
+type definition struct {
+	tokens  []Token
+	name    string // Qualified dictionary name
+	module  string
+	imports map[string]string
+	key     string // Identifies the definition for reuse
+}
+
+// NewIncremental returns an empty incremental build
+func NewIncremental(opts CompileOptions) *Incremental {
+	inc := &Incremental{opts: opts}
+	inc.reset()
+	return inc
+}
+
+// reset forgets every chunk, so the next build starts from scratch
+func (inc *Incremental) reset() {
+	inc.code = []byte{vm.OpJmp, 0, 0, 0, 0}
+	inc.pushes = nil
+	inc.chunks = make(map[string]*chunk)
+}
+
+// Stats reports what the last successful Compile recompiled
+func (inc *Incremental) Stats() IncrementalStats {
+	return inc.stats
+}
+
+// Compile builds source, reusing the code of unchanged words from earlier
+// builds. A failed build leaves the previous state intact.
+func (inc *Incremental) Compile(source string) (*Program, error) {
+	prog, live, err := inc.build(source)
+	if err != nil {
+		return nil, err
+	}
+	if int32(len(inc.code))-5-live <= live {
+		return prog, nil
+	}
+	// Start over to drop the dead chunks
+	fresh := NewIncremental(inc.opts)
+	if prog, _, err = fresh.build(source); err != nil {
+		return nil, err
+	}
+	fresh.stats.Rebuilt = true
+	*inc = *fresh
+	return prog, nil
+}
+
+// build compiles source against the current chunks and returns the program
+// with the number of bytes of live chunk code
+func (inc *Incremental) build(source string) (*Program, int32, error) {
+	start, reserved, err := inc.opts.memoryLayout()
+	if err != nil {
+		return nil, 0, err
+	}
+	tokens, err := NewLexer(source).WithLogger(inc.opts.logger()).Tokenize()
+	if err != nil {
+		return nil, 0, err
+	}
+	tokens, programStart, err := linkLibraries(tokens, inc.opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if inc.opts.WrapHex {
+		wrapHex(tokens)
+	}
+	tokens, programStart, err = compileTime(tokens, programStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	tokens, programStart, err = rewrite(tokens, programStart, inc.opts.DisabledRules)
+	if err != nil {
+		return nil, 0, err
+	}
+	// DATA tables are placed once for the whole program, after the toplevel
+	tables := newCompiler(tokens, 0, CompileOptions{})
+	tables.programStart = programStart
+	if err := tables.collectData(); err != nil {
+		return nil, 0, err
+	}
+	defs, toplevel, toplevelStart := splitDefinitions(tokens, programStart)
+
+	code := inc.code
+	pushes := inc.pushes
+	chunks := make(map[string]*chunk, len(defs))
+	dictionary := make(map[string]Word, len(defs)+len(tables.dataTables))
+	for _, t := range tables.dataTables {
+		dictionary[t.name] = tables.dictionary[t.name]
+	}
+	var used []*chunk
+	var stats IncrementalStats
+	live := int32(0)
+	for _, def := range defs {
+		ch := inc.chunks[def.key]
+		if ch == nil || !ch.resolvesIn(dictionary, def.module) {
+			base := start + int32(len(code))
+			if ch, err = compileChunk(def, base, dictionary, inc.opts); err != nil {
+				return nil, 0, err
+			}
+			for _, off := range ch.pushes {
+				pushes = append(pushes, uint32(len(code))+off)
+			}
+			code = append(code, ch.code...)
+			stats.Recompiled = append(stats.Recompiled, def.name)
+		} else {
+			stats.Reused++
+		}
+		if _, seen := chunks[def.key]; !seen {
+			live += int32(len(ch.code))
+			used = append(used, ch)
+			ch.shiftLines(def.tokens[0].Line)
+		}
+		chunks[def.key] = ch
+		dictionary[def.name] = ch.word
+	}
+
+	// The toplevel code sees every word, as in a whole-program compile
+	base := start + int32(len(code))
+	main := newCompiler(toplevel, base, CompileOptions{Trace: inc.opts.Trace, Entry: inc.opts.Entry, NoEntry: inc.opts.NoEntry, ReservedSize: reserved})
+	main.programStart = toplevelStart
+	main.dictionary = dictionary
+	main.dataBytes = tables.dataBytes
+	main.dataTables = tables.dataTables
+	mainCode, err := main.compile()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	inc.code = code
+	inc.pushes = pushes
+	inc.chunks = chunks
+	inc.stats = stats
+
+	program := make([]byte, 0, len(code)+len(mainCode))
+	program = append(program, code...)
+	program = append(program, mainCode...)
+	binary.BigEndian.PutUint32(program[1:], uint32(base))
+	dataSize := int32(len(main.dataBytes))
+	dataStart := start + int32(len(program)) - dataSize
+	for _, ch := range used {
+		for _, ref := range ch.data {
+			binary.BigEndian.PutUint32(program[ch.addr-start+int32(ref.offset):], uint32(dataStart+ref.data))
+		}
+	}
+	pushes = slices.Clip(pushes)
+	for _, off := range main.addrPushes {
+		pushes = append(pushes, uint32(len(code))+off)
+	}
+
+	layout := &Layout{BaseAddr: start, CodeSize: int32(len(program)), ReservedSize: reserved}
+	layout.add(RegionEntry, "JMP main", start, start+5, 0)
+	for _, ch := range used {
+		layout.Regions = append(layout.Regions, ch.regions...)
+	}
+	for _, r := range main.layout.Regions {
+		if r.Kind != RegionEntry {
+			layout.Regions = append(layout.Regions, r)
+		}
+	}
+	layout.sort()
+	return &Program{Code: program, Layout: layout, Symbols: main.symbols(),
+		Relocs: relocations(program, dataSize, pushes), DataSize: dataSize, Entry: main.entry}, live, nil
+}
+
+// splitDefinitions separates the word definitions from the rest of the
+// program. The toplevel tokens keep the MODULE and IMPORT directives so
+// they compile in the same context, and drop the DATA directives, which
+// are placed separately; toplevelStart is where programStart falls among
+// them.
+func splitDefinitions(tokens []Token, programStart int) (defs []definition, toplevel []Token, toplevelStart int) {
+	scan := &Compiler{tokens: tokens, imports: make(map[string]string)}
+	toplevelStart = -1
+	for scan.pos < len(tokens) && scan.peek().Type != TokenEOF {
+		if scan.pos == programStart {
+			scan.currentModule = ""
+			toplevelStart = len(toplevel)
+		}
+		token := scan.peek()
+		if isData(token) {
+			scan.skipData()
+			continue
+		}
+		if token.Type != TokenAtSign {
+			if token.Type == TokenWord {
+				switch strings.ToUpper(token.Value) {
+				case "MODULE", "IMPORT":
+					// A malformed directive is left for the toplevel compile to report
+					start := scan.pos
+					handle := scan.handleModuleDirective
+					if strings.EqualFold(token.Value, "IMPORT") {
+						handle = scan.handleImportDirective
+					}
+					if handle() == nil {
+						toplevel = append(toplevel, tokens[start:scan.pos]...)
+						continue
+					}
+					scan.pos = start
+				}
+			}
+			toplevel = append(toplevel, token)
+			scan.advance()
+			continue
+		}
+		start := scan.pos
+		scan.skipWordDefinition()
+		def := definition{
+			tokens:  tokens[start:scan.pos],
+			module:  scan.currentModule,
+			imports: make(map[string]string, len(scan.imports)),
+		}
+		for k, v := range scan.imports {
+			def.imports[k] = v
+		}
+		if len(def.tokens) > 1 {
+			def.name = qualifiedName(def.module, def.tokens[1].Value)
+		}
+		def.key = definitionKey(def)
+		defs = append(defs, def)
+	}
+	toplevel = append(toplevel, Token{Type: TokenEOF})
+	return defs, toplevel, toplevelStart
+}
+
+// SplitSource separates the word definitions and DATA tables of source,
+// with the MODULE and IMPORT directives they depend on, from the code that
+// runs. Both parts
+// keep their text as written. Tools that evaluate a program piece by piece,
+// such as notebooks, keep the definitions and run the rest once.
+func SplitSource(source string) (definitions, toplevel string, err error) {
+	tokens, err := NewLexer(source).Tokenize()
+	if err != nil {
+		return "", "", err
+	}
+	lineStarts := []int{0}
+	for i := 0; i < len(source); i++ {
+		if source[i] == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	offset := func(t Token) int {
+		return lineStarts[t.Line-1] + t.Column - 1
+	}
+
+	var defs, rest strings.Builder
+	scan := &Compiler{tokens: tokens, imports: make(map[string]string)}
+	last := 0
+	for scan.peek().Type != TokenEOF {
+		token := scan.peek()
+		start := offset(token)
+		switch {
+		case token.Type == TokenAtSign:
+			scan.skipWordDefinition()
+		case isData(token):
+			if _, _, err := scan.parseData(); err != nil {
+				continue
+			}
+		case token.Type == TokenWord && strings.EqualFold(token.Value, "MODULE"):
+			if scan.handleModuleDirective() != nil {
+				continue
+			}
+		case token.Type == TokenWord && strings.EqualFold(token.Value, "IMPORT"):
+			if scan.handleImportDirective() != nil {
+				continue
+			}
+		default:
+			scan.advance()
+			continue
+		}
+		end := len(source)
+		if prev := tokens[scan.pos-1]; prev.Type != TokenEOF {
+			end = offset(prev) + len(prev.Value)
+		}
+		rest.WriteString(source[last:start])
+		defs.WriteString(source[start:end])
+		defs.WriteString("\n")
+		last = end
+	}
+	rest.WriteString(source[last:])
+	return defs.String(), rest.String(), nil
+}
+
+// definitionKey identifies a definition by its context and tokens. Lines
+// are kept relative to the @, so moving a definition does not change it.
+func definitionKey(def definition) string {
+	var b strings.Builder
+	b.WriteString(def.module)
+	aliases := make([]string, 0, len(def.imports))
+	for k, v := range def.imports {
+		aliases = append(aliases, k+"="+v)
+	}
+	sort.Strings(aliases)
+	for _, a := range aliases {
+		b.WriteString(" " + a)
+	}
+	first := def.tokens[0].Line
+	for _, tok := range def.tokens {
+		fmt.Fprintf(&b, "\x00%d:%d:%s", tok.Type, tok.Line-first, tok.Value)
+	}
+	return b.String()
+}
+
+// compileChunk compiles one definition as a definitions-only program at
+// base, against the words defined before it
+func compileChunk(def definition, base int32, dictionary map[string]Word, opts CompileOptions) (*chunk, error) {
+	tokens := append(def.tokens[:len(def.tokens):len(def.tokens)], Token{Type: TokenEOF})
+	c := newCompiler(tokens, base, CompileOptions{Trace: opts.Trace, NoEntry: true, ReservedSize: opts.ReservedSize})
+	c.programStart = -1
+	c.currentModule = def.module
+	for k, v := range def.imports {
+		c.imports[k] = v
+	}
+	for name, word := range dictionary {
+		c.dictionary[name] = word
+	}
+	c.lookups = make(map[string]int32)
+	code, err := c.compile()
+	if err != nil {
+		return nil, err
+	}
+	ch := &chunk{
+		addr:    base,
+		code:    code,
+		pushes:  c.addrPushes,
+		data:    c.dataRefs,
+		word:    c.dictionary[def.name],
+		lookups: c.lookups,
+		imports: def.imports,
+		line:    def.tokens[0].Line,
+	}
+	for _, r := range c.layout.Regions {
+		switch r.Kind {
+		case RegionWord, RegionQuotation, RegionString, RegionPad:
+			ch.regions = append(ch.regions, r)
+		}
+	}
+	return ch, nil
+}
+
+// resolvesIn reports whether every word the chunk looked up would resolve
+// the same way against dictionary, so its code is still correct
+func (ch *chunk) resolvesIn(dictionary map[string]Word, module string) bool {
+	c := &Compiler{dictionary: dictionary, currentModule: module, imports: ch.imports}
+	for name, addr := range ch.lookups {
+		if addr == ch.word.Address {
+			continue // The word calling itself
+		}
+		word, ok := c.lookupWord(name)
+		if ok != (addr != -1) || ok && word.Address != addr {
+			return false
+		}
+	}
+	return true
+}
+
+// shiftLines moves the chunk's region lines to a definition now starting at line
+func (ch *chunk) shiftLines(line int) {
+	delta := line - ch.line
+	if delta == 0 {
+		return
+	}
+	for i := range ch.regions {
+		if ch.regions[i].Line > 0 {
+			ch.regions[i].Line += delta
+		}
+	}
+	ch.line = line
+}
@@ -0,0 +1,224 @@
+package lux
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// runOutput runs code and returns what it printed and its final stack
+func runOutput(t *testing.T, code []byte) (string, []int32) {
+	t.Helper()
+	var out strings.Builder
+	machine := vm.NewVM(code)
+	machine.OutputHandler = func(value, format int32) {
+		if format&vm.FormatChar != 0 {
+			out.WriteRune(rune(value))
+		} else {
+			fmt.Fprintf(&out, "%d ", value)
+		}
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	return out.String(), machine.Stack()
+}
+
+// incrementalVersions are successive edits of one program
+var incrementalVersions = []string{
+	`@square dup * ;
+@cube dup square * ;
+@countdown dup 0 > [ dup . dec countdown ] [ drop ] ?: ;
+@shout "hi" 10 emit ;
+3 cube . 4 countdown shout`,
+	// Edit square: cube depends on it, countdown and shout do not
+	`@square dup dup * swap drop ;
+@cube dup square * ;
+@countdown dup 0 > [ dup . dec countdown ] [ drop ] ?: ;
+@shout "hi" 10 emit ;
+3 cube . 4 countdown shout`,
+	// Move a definition down and add lines: nothing needs recompiling
+	`@square dup dup * swap drop ;
+@cube dup square * ;
+
+@shout "hi" 10 emit ;
+@countdown dup 0 > [ dup . dec countdown ] [ drop ] ?: ;
+2 cube . 2 countdown shout`,
+	// Shadow a builtin that cube uses
+	`@square dup dup * swap drop ;
+@* + ;
+@cube dup square * ;
+@shout "hi" 10 emit ;
+@countdown dup 0 > [ dup . dec countdown ] [ drop ] ?: ;
+3 cube . 5 countdown shout`,
+}
+
+func TestIncrementalMatchesFullCompile(t *testing.T) {
+	inc := NewIncremental(CompileOptions{})
+	for i, source := range incrementalVersions {
+		full, err := CompileProgram(source, CompileOptions{})
+		if err != nil {
+			t.Fatalf("version %d: CompileProgram error: %v", i, err)
+		}
+		prog, err := inc.Compile(source)
+		if err != nil {
+			t.Fatalf("version %d: Incremental.Compile error: %v", i, err)
+		}
+		wantOut, wantStack := runOutput(t, full.Code)
+		gotOut, gotStack := runOutput(t, prog.Code)
+		if gotOut != wantOut || !reflect.DeepEqual(gotStack, wantStack) {
+			t.Errorf("version %d: got output %q stack %v, want %q %v", i, gotOut, gotStack, wantOut, wantStack)
+		}
+		if len(prog.Symbols) != len(full.Symbols) {
+			t.Errorf("version %d: got %d symbols, want %d", i, len(prog.Symbols), len(full.Symbols))
+		}
+	}
+}
+
+func TestIncrementalRecompilesDependents(t *testing.T) {
+	inc := NewIncremental(CompileOptions{})
+	want := [][]string{
+		{"SQUARE", "CUBE", "COUNTDOWN", "SHOUT"},
+		{"SQUARE", "CUBE"},
+		nil,
+		{"*", "CUBE"},
+	}
+	for i, source := range incrementalVersions {
+		if _, err := inc.Compile(source); err != nil {
+			t.Fatalf("version %d: %v", i, err)
+		}
+		stats := inc.Stats()
+		if stats.Rebuilt {
+			t.Errorf("version %d: unexpected rebuild", i)
+		}
+		if !reflect.DeepEqual(stats.Recompiled, want[i]) {
+			t.Errorf("version %d: recompiled %v, want %v", i, stats.Recompiled, want[i])
+		}
+	}
+}
+
+func TestIncrementalRebuildsWhenMostlyDead(t *testing.T) {
+	inc := NewIncremental(CompileOptions{})
+	inc.Compile("@a 1 ; @b 2 ; a b")
+	prog, err := inc.Compile("@a 3 ; a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inc.Stats(); !got.Rebuilt || len(got.Recompiled) != 1 {
+		t.Errorf("Expected a rebuild, got %+v", got)
+	}
+	fresh, _ := NewIncremental(CompileOptions{}).Compile("@a 3 ; a")
+	if len(prog.Code) != len(fresh.Code) {
+		t.Errorf("Expected the rebuild to drop dead code, got %d bytes, want %d", len(prog.Code), len(fresh.Code))
+	}
+}
+
+func TestIncrementalKeepsStateOnError(t *testing.T) {
+	inc := NewIncremental(CompileOptions{})
+	if _, err := inc.Compile("@double 2 * ; 21 double"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inc.Compile("@double 2 * ; 21 double nosuchword"); err == nil {
+		t.Fatal("Expected an error for an unknown word")
+	}
+	prog, err := inc.Compile("@double 2 * ; 21 double")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inc.Stats(); got.Reused != 1 || len(got.Recompiled) != 0 {
+		t.Errorf("Expected DOUBLE to be reused after a failed build, got %+v", got)
+	}
+	if _, stack := runOutput(t, prog.Code); !reflect.DeepEqual(stack, []int32{42}) {
+		t.Errorf("Expected [42], got %v", stack)
+	}
+}
+
+func TestIncrementalLayout(t *testing.T) {
+	inc := NewIncremental(CompileOptions{})
+	inc.Compile("@one 1 ;\n@two 2 ;\none two")
+	prog, err := inc.Compile("\n@one 1 ;\n@two 2 ;\none two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(map[string]int)
+	for _, r := range prog.Layout.Regions {
+		if r.Kind == RegionWord {
+			lines[r.Name] = r.Line
+		}
+	}
+	if lines["ONE"] != 2 || lines["TWO"] != 3 {
+		t.Errorf("Expected reused words to follow their source lines, got %v", lines)
+	}
+}
+
+func TestSplitSource(t *testing.T) {
+	source := "MODULE GEO\n@sq dup * ; ( area )\n3 sq .\n@twice [ 2 * ] call ;\n\"done\" IMPORT GEO AS G"
+	defs, rest, err := SplitSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "MODULE GEO\n@sq dup * ;\n@twice [ 2 * ] call ;\nIMPORT GEO AS G\n"; defs != want {
+		t.Errorf("definitions = %q, want %q", defs, want)
+	}
+	if want := "\n ( area )\n3 sq .\n\n\"done\" "; rest != want {
+		t.Errorf("toplevel = %q, want %q", rest, want)
+	}
+}
+
+func TestIncrementalRelocations(t *testing.T) {
+	inc := NewIncremental(CompileOptions{})
+	for i, source := range incrementalVersions {
+		prog, err := inc.Compile(source)
+		if err != nil {
+			t.Fatalf("Version %d: %v", i, err)
+		}
+		want, _ := runOutput(t, prog.Code)
+		if got := runRebased(t, prog, 0x100); got != want {
+			t.Errorf("Version %d: rebased program printed %q, expected %q", i, got, want)
+		}
+	}
+}
+
+func TestIncrementalData(t *testing.T) {
+	inc := NewIncremental(CompileOptions{})
+	versions := []string{dataSource, strings.Replace(dataSource, "16 ,", "25 ,", 1)}
+	for i, source := range versions {
+		prog, err := inc.Compile(source)
+		if err != nil {
+			t.Fatalf("Version %d: %v", i, err)
+		}
+		full, err := Compile(source)
+		if err != nil {
+			t.Fatalf("Version %d: %v", i, err)
+		}
+		want, _ := runOutput(t, full)
+		if got, _ := runOutput(t, prog.Code); got != want {
+			t.Errorf("Version %d printed %q, expected %q", i, got, want)
+		}
+		if got := runRebased(t, prog, 0x100); got != want {
+			t.Errorf("Version %d: rebased program printed %q, expected %q", i, got, want)
+		}
+	}
+	if stats := inc.Stats(); len(stats.Recompiled) != 0 {
+		t.Errorf("Expected a table edit to reuse every word, recompiled %v", stats.Recompiled)
+	}
+}
+
+func TestIncrementalAssert(t *testing.T) {
+	inc := NewIncremental(CompileOptions{})
+	// Moving the word down a line must move the line in its message too
+	versions := []string{"@small 10 < ASSERT\" too big\" ;\n12 small", "\n@small 10 < ASSERT\" too big\" ;\n12 small"}
+	for i, source := range versions {
+		prog, err := inc.Compile(source)
+		if err != nil {
+			t.Fatalf("Version %d: %v", i, err)
+		}
+		err = vm.NewVM(prog.Code).Run()
+		if want := fmt.Sprintf("line %d: too big", i+1); err == nil || !strings.HasSuffix(err.Error(), want) {
+			t.Errorf("Version %d: expected %q, got %v", i, want, err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package lux
+
+import (
+	"fmt"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// A quotation written right before the combinator that runs it, as in
+// x 0 > [ 1 + ] ?, never escapes: nothing else can see its address, so the
+// combinator can run its code in place instead of pushing the address and
+// calling it with CALLSTACK. In a word or the toplevel code, CALL, DIP,
+// KEEP, ?, !:, ?:, |: and #: do so whenever every quotation they take
+// qualifies: its PUSH is the last code emitted (for #:, followed only by
+// the count's literal), and it neither transfers nor ends in a tail call,
+// both of which rely on being called. The inlined quotation's own code is
+// left out of the program. CompileOptions.NoInline turns this off.
+
+// mainTarget is the reloc quot for a jump within an inlined quotation,
+// whose data is then the target's offset in the main code
+const mainTarget = -2
+
+// inlineQuotations takes the last n quotations written in the word or
+// toplevel code, for the combinator being compiled to inline, when they
+// qualify. Their PUSHes are removed; when count is set they may be followed
+// by one literal push, which is kept. Otherwise it changes nothing and
+// reports false.
+func (c *Compiler) inlineQuotations(n int, count bool) ([]int, bool) {
+	if c.noInline || len(c.openQuots) < n {
+		return nil, false
+	}
+	quots := c.openQuots[len(c.openQuots)-n:]
+	first := int32(-1) // Offset of the first PUSH
+	for k, q := range quots {
+		quot := c.quotations[q]
+		if quot.transfers != 0 || quot.tailJmp || quot.relocStart >= len(c.relocs) {
+			return nil, false
+		}
+		push := c.relocs[quot.relocStart]
+		if push.owner != mainCode || push.quot != q || (k > 0 && push.offset != first+int32(5*k)+1) {
+			return nil, false
+		}
+		if k == 0 {
+			first = push.offset - 1
+		}
+	}
+	tail := c.bytecode[first+int32(5*n):]
+	if count != (len(tail) > 0) || count && !literalPush(tail) {
+		return nil, false
+	}
+	taken := append([]int(nil), quots...)
+	c.openQuots = c.openQuots[:len(c.openQuots)-n]
+	c.bytecode = append(c.bytecode[:first], tail...)
+	for k := n - 1; k >= 0; k-- {
+		c.dropReloc(c.quotations[taken[k]].relocStart)
+	}
+	for i := range c.relocs {
+		if r := &c.relocs[i]; r.owner == mainCode && r.offset > first {
+			r.offset -= int32(5 * n)
+		}
+	}
+	for i := range c.lowered {
+		if l := &c.lowered[i]; l.owner == mainCode && l.End > first {
+			// The PUSHes' own records become empty
+			l.Start = max(l.Start-int32(5*n), min(l.Start, first))
+			l.End = max(l.End-int32(5*n), first)
+		}
+	}
+	c.removed += int32(5 * n)
+	return taken, true
+}
+
+// literalPush reports whether code is exactly one push of a number
+func literalPush(code []byte) bool {
+	switch code[0] {
+	case vm.OpPush8:
+		return len(code) == 2
+	case vm.OpPush16:
+		return len(code) == 3
+	case vm.OpPush:
+		return len(code) == 5
+	}
+	return false
+}
+
+// dropReloc removes c.relocs[i], keeping each later quotation's relocStart
+func (c *Compiler) dropReloc(i int) {
+	c.relocs = append(c.relocs[:i], c.relocs[i+1:]...)
+	for q := range c.quotations {
+		if c.quotations[q].relocStart > i {
+			c.quotations[q].relocStart--
+		}
+	}
+}
+
+// emitInlined emits the code of quotation q, which inlineQuotations took,
+// without its RET. Its operands' relocs and its strings move with it, and
+// it no longer takes any room where the quotations are placed.
+func (c *Compiler) emitInlined(q int) {
+	quot := &c.quotations[q]
+	start := c.currentOffset()
+	for i := quot.relocStart; i < len(c.relocs); i++ {
+		r := &c.relocs[i]
+		if r.owner != q {
+			continue
+		}
+		r.owner, r.offset = mainCode, start+r.offset
+		if r.quot == q {
+			r.quot, r.data = mainTarget, start+r.data
+		}
+	}
+	kept := c.quotStrings[:0]
+	for _, qs := range c.quotStrings {
+		if qs.quot != q {
+			kept = append(kept, qs)
+			continue
+		}
+		addr := c.baseAddr + start
+		c.layout.add(RegionString, fmt.Sprintf("%q", qs.value), addr+qs.start, addr+qs.end, qs.line)
+	}
+	c.quotStrings = kept
+	for i := range c.lowered {
+		if l := &c.lowered[i]; l.owner == q {
+			// Its ] loses the RET
+			l.owner = mainCode
+			l.Start = start + min(l.Start, int32(len(quot.Code)-1))
+			l.End = start + min(l.End, int32(len(quot.Code)-1))
+		}
+	}
+	c.emit(quot.Code[:len(quot.Code)-1]...)
+	quot.Code = quot.Code[:0]
+}
+
+// joinHere patches the jump operand at offset to the current address,
+// which branches of inlined code meet at
+func (c *Compiler) joinHere(offset int32) {
+	c.patchInt32(offset, c.currentAddress())
+	c.joinAt = len(c.bytecode)
+}
+
+// emitJump emits op with an operand to patch and returns the operand's offset
+func (c *Compiler) emitJump(op byte) int32 {
+	c.emit(op)
+	at := c.currentOffset()
+	c.emitInt32(0)
+	return at
+}
+
+// inlineCall compiles CALL or DIP, which run the quotation where it is
+func (c *Compiler) inlineCall() bool {
+	quots, ok := c.inlineQuotations(1, false)
+	if ok {
+		c.emitInlined(quots[0])
+	}
+	return ok
+}
+
+// inlineKeep compiles x [ quot ] keep as x DUP quot
+func (c *Compiler) inlineKeep() bool {
+	quots, ok := c.inlineQuotations(1, false)
+	if ok {
+		c.emit(vm.OpDup)
+		c.emitInlined(quots[0])
+	}
+	return ok
+}
+
+// inlineIf compiles condition [ true ] ? as a JZ past the quotation's code,
+// and !: with the condition inverted
+func (c *Compiler) inlineIf(unless bool) bool {
+	quots, ok := c.inlineQuotations(1, false)
+	if !ok {
+		return false
+	}
+	if unless {
+		c.emitPush(0)
+		c.emit(vm.OpEq)
+	}
+	skip := c.emitJump(vm.OpJz)
+	c.emitInlined(quots[0])
+	c.joinHere(skip)
+	return true
+}
+
+// inlineIfElse compiles condition [ true ] [ false ] ?: as two branches
+func (c *Compiler) inlineIfElse() bool {
+	quots, ok := c.inlineQuotations(2, false)
+	if !ok {
+		return false
+	}
+	elseJump := c.emitJump(vm.OpJz)
+	c.emitInlined(quots[0])
+	end := c.emitJump(vm.OpJmp)
+	c.patchInt32(elseJump, c.currentAddress())
+	c.emitInlined(quots[1])
+	c.joinHere(end)
+	return true
+}
+
+// inlineWhile compiles value [ condition ] [ body ] |: as a loop that
+// keeps nothing on the return stack
+func (c *Compiler) inlineWhile() bool {
+	quots, ok := c.inlineQuotations(2, false)
+	if !ok {
+		return false
+	}
+	loopStart := c.currentAddress()
+	c.emit(vm.OpDup)
+	c.emitInlined(quots[0])
+	exit := c.emitJump(vm.OpJz)
+	c.emitInlined(quots[1])
+	c.emit(vm.OpJmp)
+	c.emitInt32(loopStart)
+	c.patchInt32(exit, c.currentAddress())
+	return true
+}
+
+// inlineTimes compiles [ body ] n #:, for a literal n, as a loop that keeps
+// only the count on the return stack while the body runs
+func (c *Compiler) inlineTimes() bool {
+	quots, ok := c.inlineQuotations(1, true)
+	if !ok {
+		return false
+	}
+	loopStart := c.currentAddress()
+	c.emit(vm.OpDup)
+	exit := c.emitJump(vm.OpJz)
+	c.emit(vm.OpDec, vm.OpToR)
+	c.emitInlined(quots[0])
+	c.emit(vm.OpFromR, vm.OpJmp)
+	c.emitInt32(loopStart)
+	c.patchInt32(exit, c.currentAddress())
+	c.emit(vm.OpPop)
+	return true
+}
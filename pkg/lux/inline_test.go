@@ -0,0 +1,78 @@
+package lux
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInliningKeepsMeaning(t *testing.T) {
+	for _, source := range []string{
+		"[ 2 3 + ] call .",
+		"1 [ 2 + ] dip . 5 [ 1 + ] keep . .",
+		"3 0 > [ 1 . ] ? 0 [ 2 . ] ? 0 [ 3 . ] !: 1 [ 4 . ] !:",
+		"1 [ 10 ] [ 20 ] ?: . 0 [ 10 ] [ 20 ] ?: .",
+		"0 [ 5 < ] [ dup . inc ] |: .",
+		"1 [ 2 * ] 10 #: . [ 7 . ] 0 #:",
+		`1 [ "yes" ] [ "no" ] ?: 10 emit`,
+		// Combinators and quotations inside an inlined quotation
+		"1 [ 2 [ 3 ] [ 4 ] ?: . [ 5 . ] call ] call",
+		"1 2 3 4 5 6 [ 2 mod [ 1 . ] [ 0 . ] ?: ] 6 #:",
+		"DATA t 5 , 9 , 1 [ t 4 + loadi . ] ?",
+		// A quotation the combinator is handed is called as before
+		"@apply call ; [ 8 . ] apply",
+		"@n 3 ; [ 1 . ] n #:",
+		// So is one that exits the word
+		"@f 1 [ 6 . exit ] ? 7 . ; f",
+		// A word ending in an inlined branch around a tail call
+		"@down dup 0 > [ dup . dec down ] ? ; 3 down .",
+		"@loop dup [ dec loop ] [ ] ?: ; 5 loop .",
+		"@g [ 2 . ] call ; @main g g ;",
+	} {
+		inlined, err := CompileProgram(source, CompileOptions{})
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", source, err)
+		}
+		called, err := CompileProgram(source, CompileOptions{NoInline: true})
+		if err != nil {
+			t.Fatalf("%q: compile error without inlining: %v", source, err)
+		}
+		wantOut, wantStack := runOutput(t, called.Code)
+		gotOut, gotStack := runOutput(t, inlined.Code)
+		if gotOut != wantOut || !reflect.DeepEqual(gotStack, wantStack) {
+			t.Errorf("%q: got %q %v, want %q %v", source, gotOut, gotStack, wantOut, wantStack)
+		}
+		if got := runRebased(t, inlined, 0x200); got != wantOut {
+			t.Errorf("%q: rebased program printed %q, want %q", source, got, wantOut)
+		}
+	}
+}
+
+func TestInliningRemovesCalls(t *testing.T) {
+	source := "@sum 0 swap [ 0 > ] [ dup rot + swap dec ] |: drop ;\n10 sum . 1 [ 2 . ] [ 3 . ] ?:"
+	inlined, err := CompileProgram(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	called, err := CompileProgram(source, CompileOptions{NoInline: true})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	var listing bytes.Buffer
+	inlined.WriteAsm(&listing)
+	if strings.Contains(listing.String(), "CALLSTACK") {
+		t.Errorf("Expected no CALLSTACK once inlined:\n%s", listing.String())
+	}
+	if len(inlined.Code) >= len(called.Code) {
+		t.Errorf("Expected inlining to shrink %d bytes, got %d", len(called.Code), len(inlined.Code))
+	}
+	for _, r := range inlined.Layout.Regions {
+		if r.Kind == RegionQuotation {
+			t.Errorf("Expected no quotation left to place, got %s at line %d", r.Name, r.Line)
+		}
+	}
+	if got, _ := runOutput(t, inlined.Code); got != "55 2 " {
+		t.Errorf("Printed %q, want \"55 2 \"", got)
+	}
+}
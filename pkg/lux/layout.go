@@ -0,0 +1,146 @@
+package lux
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// RegionKind identifies what a placed region of memory holds
+type RegionKind string
+
+const (
+	RegionEntry     RegionKind = "entry"     // Initial JMP over the word definitions
+	RegionWord      RegionKind = "word"      // A user-defined word body
+	RegionMain      RegionKind = "main"      // Toplevel code
+	RegionQuotation RegionKind = "quotation" // A [ ... ] block
+	RegionString    RegionKind = "string"    // Code emitted for a string literal
+	RegionHalt      RegionKind = "halt"      // Final HALT
+	RegionPad       RegionKind = "pad"       // The pad, in reserved memory
+	RegionData      RegionKind = "data"      // A DATA table, after the code
+)
+
+// Region is one placed item with its half-open address range [Start, End)
+type Region struct {
+	Kind  RegionKind
+	Name  string
+	Start int32
+	End   int32
+	Line  int // Source line, 0 if unknown
+}
+
+// Size returns the number of bytes covered by the region
+func (r Region) Size() int32 {
+	return r.End - r.Start
+}
+
+// Layout records where the compiler placed everything in a program
+type Layout struct {
+	BaseAddr     int32    // Address the code was compiled for
+	CodeSize     int32    // Total bytecode length
+	ReservedSize int32    // Reserved memory the program was compiled for
+	Regions      []Region // Sorted by Start, then by Kind
+}
+
+// add records a region; a nil Layout ignores it
+func (l *Layout) add(kind RegionKind, name string, start, end int32, line int) {
+	if l == nil {
+		return
+	}
+	l.Regions = append(l.Regions, Region{Kind: kind, Name: name, Start: start, End: end, Line: line})
+}
+
+// tables returns the DATA tables, for the image's debug info
+func (l *Layout) tables() []vm.Table {
+	var tables []vm.Table
+	for _, r := range l.Regions {
+		if r.Kind == RegionData {
+			tables = append(tables, vm.Table{Name: r.Name, Address: r.Start, Size: r.Size()})
+		}
+	}
+	return tables
+}
+
+// sort orders regions deterministically so reports diff cleanly
+func (l *Layout) sort() {
+	sort.SliceStable(l.Regions, func(i, j int) bool {
+		a, b := l.Regions[i], l.Regions[j]
+		if a.Start != b.Start {
+			return a.Start < b.Start
+		}
+		if a.End != b.End {
+			return a.End > b.End // Enclosing region first
+		}
+		return a.Kind < b.Kind
+	})
+}
+
+// WriteTo prints a human-readable layout report
+func (l *Layout) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	p := func(format string, args ...interface{}) error {
+		m, err := fmt.Fprintf(w, format, args...)
+		n += int64(m)
+		return err
+	}
+	if err := p("Code: 0x%04X-0x%04X (%d bytes)\n", l.BaseAddr, l.BaseAddr+l.CodeSize, l.CodeSize); err != nil {
+		return n, err
+	}
+	if err := p("Reserved memory: %d bytes\n\n", l.ReservedSize); err != nil {
+		return n, err
+	}
+	if err := p("%-6s  %-6s  %6s  %-9s  %-4s  %s\n", "START", "END", "SIZE", "KIND", "LINE", "NAME"); err != nil {
+		return n, err
+	}
+	for _, r := range l.Regions {
+		line := "-"
+		if r.Line > 0 {
+			line = fmt.Sprintf("%d", r.Line)
+		}
+		if err := p("0x%04X  0x%04X  %6d  %-9s  %-4s  %s\n", r.Start, r.End, r.Size(), r.Kind, line, r.Name); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Locate names the word, quotation or toplevel code at addr, with the line
+// it starts on, for vm.VM.Locate
+func (p *Program) Locate(addr uint32) (word string, line int) {
+	if p.Layout == nil {
+		return "", 0
+	}
+	for _, r := range p.Layout.Regions {
+		if addr < uint32(r.Start) || addr >= uint32(r.End) {
+			continue
+		}
+		switch r.Kind { // The last match is the innermost
+		case RegionWord, RegionMain:
+			word, line = r.Name, r.Line
+		case RegionQuotation:
+			word, line = "quotation "+r.Name, r.Line
+		}
+	}
+	return word, line
+}
+
+// WriteAsm writes the program's code as vm.DisassembleAt lists it, with a
+// label on each word, the toplevel code and each quotation, so a reader can
+// see exactly what every combinator compiled to. vm.Assemble reads the
+// listing back. DATA tables are left out.
+func (p *Program) WriteAsm(w io.Writer) {
+	labels := slices.Clone(p.Symbols)
+	for _, r := range p.Layout.Regions {
+		switch r.Kind {
+		case RegionMain:
+			labels = append(labels, vm.Symbol{Name: r.Name, Address: r.Start})
+		case RegionQuotation:
+			labels = append(labels, vm.Symbol{Name: fmt.Sprintf("[%s line %d]", r.Name, r.Line), Address: r.Start})
+		}
+	}
+	code := p.Code[:int32(len(p.Code))-p.DataSize]
+	vm.DisassembleAt(w, code, uint32(p.Layout.BaseAddr), labels)
+}
@@ -0,0 +1,127 @@
+// pkg/lux/layout_test.go
+package lux
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+func TestLayoutCoversCode(t *testing.T) {
+	source := `
+		@square dup * ;
+		"hi" 3 square [ 1 + ] 2 #:
+	`
+	prog, err := CompileProgram(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	layout := prog.Layout
+	if layout.CodeSize != int32(len(prog.Code)) {
+		t.Errorf("Expected CodeSize %d, got %d", len(prog.Code), layout.CodeSize)
+	}
+
+	// Top-level regions must tile the code exactly, in order
+	next := int32(vm.UserMemoryOffset)
+	for _, r := range layout.Regions {
+		switch r.Kind {
+		case RegionEntry, RegionWord, RegionMain, RegionQuotation, RegionHalt:
+			if r.Start != next {
+				t.Errorf("Region %s %q starts at 0x%X, expected 0x%X", r.Kind, r.Name, r.Start, next)
+			}
+			next = r.End
+		}
+	}
+	if next != layout.BaseAddr+layout.CodeSize {
+		t.Errorf("Regions end at 0x%X, code ends at 0x%X", next, layout.BaseAddr+layout.CodeSize)
+	}
+}
+
+func TestLayoutRecordsStrings(t *testing.T) {
+	source := `[ "a" ] 3 #: "bc"`
+	prog, err := CompileProgram(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	kinds := map[RegionKind]int{}
+	for _, r := range prog.Layout.Regions {
+		kinds[r.Kind]++
+		if r.Kind == RegionString && r.Name == `"bc"` && r.Size() != 10 {
+			t.Errorf("Expected 10 bytes for \"bc\", got %d", r.Size())
+		}
+	}
+	if kinds[RegionString] != 2 {
+		t.Errorf("Expected 2 strings, got %v", kinds)
+	}
+
+	var buf bytes.Buffer
+	if _, err := prog.Layout.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	if !contains(buf.String(), `"bc"`) {
+		t.Errorf("Expected report to mention the \"bc\" string, got:\n%s", buf.String())
+	}
+}
+
+func TestProgramTables(t *testing.T) {
+	source := `DATA squares 0 , 1 , 4 , DATA greeting "hi" c, 0 c,  squares . greeting .`
+	prog, err := CompileProgram(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if len(prog.Tables) != 2 || prog.Tables[0].Name != "SQUARES" || prog.Tables[0].Size != 12 ||
+		prog.Tables[1].Name != "GREETING" || prog.Tables[1].Size != 3 {
+		t.Fatalf("Expected SQUARES of 12 bytes and GREETING of 3, got %+v", prog.Tables)
+	}
+	if table, ok := prog.Image().LookupTable("GREETING"); !ok || table.Address != prog.Tables[0].Address+12 {
+		t.Errorf("Expected GREETING right after SQUARES in the image, got %+v", prog.Image().Tables)
+	}
+}
+
+func TestWriteAsm(t *testing.T) {
+	prog, err := CompileProgram("DATA table 1 , 2 , 3 ,\n@square dup * ;\n@apply call ;\n3 square . [ 1 + ] apply .", CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	var b bytes.Buffer
+	prog.WriteAsm(&b)
+	listing := b.String()
+	for _, label := range []string{"\nSQUARE:\n", "\ntoplevel:\n", "\n[#0 line 4]:\n", "CALL 0x4005 <SQUARE>"} {
+		if !strings.Contains(listing, label) {
+			t.Errorf("Expected %q in the listing:\n%s", label, listing)
+		}
+	}
+	code, err := vm.Assemble(listing)
+	if err != nil {
+		t.Fatalf("Assemble error: %v", err)
+	}
+	if want := prog.Code[:int32(len(prog.Code))-prog.DataSize]; !bytes.Equal(code, want) {
+		t.Errorf("Expected the listing to assemble to\n%v\ngot\n%v", want, code)
+	}
+}
+
+func TestProgramLocate(t *testing.T) {
+	source := "1 2 +\n@square dup * ;\n3 [ square ] call ."
+	prog, err := CompileProgram(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	for _, r := range prog.Layout.Regions {
+		word, line := prog.Locate(uint32(r.Start))
+		switch r.Kind {
+		case RegionWord:
+			if word != "SQUARE" || line != 2 {
+				t.Errorf("Expected SQUARE at line 2, got %q at line %d", word, line)
+			}
+		case RegionQuotation:
+			if word != "quotation "+r.Name || line != 3 {
+				t.Errorf("Expected the quotation at line 3, got %q at line %d", word, line)
+			}
+		}
+	}
+	if word, _ := prog.Locate(0); word != "" {
+		t.Errorf("Expected nothing at 0, got %q", word)
+	}
+}
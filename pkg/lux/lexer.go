@@ -2,7 +2,9 @@
 package lux
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -38,28 +40,29 @@ type Lexer struct {
 	pos    int // Current position in input
 	line   int
 	column int
-	trace  bool // Trace compilation steps, defaults to false
+	trace  bool   // log wants every step
+	log    Logger // Where the trace goes, nil for nowhere
+	quoted bool   // The last word ended in ", so its string comes next
 }
 
-// NewLexer creates a new lexer
+// NewLexer creates a new lexer. With trace set it traces each step to
+// stderr; WithLogger sends the trace elsewhere.
 func NewLexer(input string, trace ...bool) *Lexer {
-	traceEnabled := false
-	if len(trace) > 0 {
-		traceEnabled = trace[0]
-	}
-
-	return &Lexer{
+	l := &Lexer{
 		input:  input,
 		pos:    0,
 		line:   1,
 		column: 1,
-		trace:  traceEnabled,
 	}
+	if len(trace) > 0 && trace[0] {
+		l.WithLogger(NewLogger(os.Stderr, LevelTrace))
+	}
+	return l
 }
 
 // Tokenize returns all tokens from the source
 func (l *Lexer) Tokenize() ([]Token, error) {
-	var tokens []Token
+	tokens := make([]Token, 0, len(l.input)/3+1) // Roughly one token per three bytes of source
 
 	for {
 		token, err := l.NextToken()
@@ -69,6 +72,7 @@ func (l *Lexer) Tokenize() ([]Token, error) {
 
 		// Skip comments, but keep everything else
 		if token.Type != TokenComment {
+			l.checkAdjacent(tokens, token)
 			tokens = append(tokens, token)
 		}
 
@@ -82,67 +86,71 @@ func (l *Lexer) Tokenize() ([]Token, error) {
 
 // NextToken reads and returns the next token
 func (l *Lexer) NextToken() (Token, error) {
+	if l.quoted {
+		l.quoted = false
+		return l.readWordString()
+	}
 	l.skipWhitespace()
 	if l.trace {
-		fmt.Fprintf(os.Stderr, "Lexer: NextToken: pos=%d, line=%d, column=%d\n", l.pos, l.line, l.column)
+		l.logf(LevelTrace, "Lexer: NextToken: pos=%d, line=%d, column=%d", l.pos, l.line, l.column)
 	}
 
 	if l.pos >= len(l.input) {
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reached EOF\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reached EOF")
 		}
 		return Token{Type: TokenEOF, Line: l.line, Column: l.column}, nil
 	}
 
 	ch := l.peek()
 	if l.trace {
-		fmt.Fprintf(os.Stderr, "Lexer: NextToken: Processing char='%c'\n", ch)
+		l.logf(LevelTrace, "Lexer: NextToken: Processing char='%c'", ch)
 	}
 
 	switch {
 	case ch == '(':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading comment\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading comment")
 		}
 		return l.readComment()
 	case ch == '/' && l.pos+1 < len(l.input) && l.input[l.pos+1] == '/':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading line comment\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading line comment")
 		}
 		return l.readLineComment()
 	case ch == '"':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading string\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading string")
 		}
 		return l.readString()
 	case ch == '@':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading @\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading @")
 		}
 		return l.readSingleChar(TokenAtSign), nil
 	case ch == ';':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading ;\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading ;")
 		}
 		return l.readSingleChar(TokenSemicolon), nil
 	case ch == '[':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading [\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading [")
 		}
 		return l.readSingleChar(TokenLBracket), nil
 	case ch == ']':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading ]\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading ]")
 		}
 		return l.readSingleChar(TokenRBracket), nil
 	case l.isNumberStart(ch):
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading number\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading number")
 		}
-		return l.readNumber(), nil
+		return l.readNumber()
 	case ch == '?' && l.pos+1 < len(l.input) && l.input[l.pos+1] == ':':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading ?: combinator\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading ?: combinator")
 		}
 		token := Token{Type: TokenWord, Value: "?:", Line: l.line, Column: l.column}
 		l.pos += 2
@@ -150,7 +158,7 @@ func (l *Lexer) NextToken() (Token, error) {
 		return token, nil
 	case ch == '!' && l.pos+1 < len(l.input) && l.input[l.pos+1] == ':':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading !: combinator\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading !: combinator")
 		}
 		token := Token{Type: TokenWord, Value: "!:", Line: l.line, Column: l.column}
 		l.pos += 2
@@ -158,7 +166,7 @@ func (l *Lexer) NextToken() (Token, error) {
 		return token, nil
 	case ch == '|' && l.pos+1 < len(l.input) && l.input[l.pos+1] == ':':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading |: combinator\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading |: combinator")
 		}
 		token := Token{Type: TokenWord, Value: "|:", Line: l.line, Column: l.column}
 		l.pos += 2
@@ -166,7 +174,7 @@ func (l *Lexer) NextToken() (Token, error) {
 		return token, nil
 	case ch == '#' && l.pos+1 < len(l.input) && l.input[l.pos+1] == ':':
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading #: combinator\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading #: combinator")
 		}
 		token := Token{Type: TokenWord, Value: "#:", Line: l.line, Column: l.column}
 		l.pos += 2
@@ -174,7 +182,7 @@ func (l *Lexer) NextToken() (Token, error) {
 		return token, nil
 	default:
 		if l.trace {
-			fmt.Fprintf(os.Stderr, "Lexer: NextToken: Reading word\n")
+			l.logf(LevelTrace, "Lexer: NextToken: Reading word")
 		}
 		return l.readWord()
 	}
@@ -216,7 +224,22 @@ func (l *Lexer) readString() (Token, error) {
 	startLine := l.line
 	startCol := l.column
 	l.advance() // skip opening "
+	return l.readStringBody(startLine, startCol)
+}
+
+// readWordString reads the string after a word ending in ", as in
+// ASSERT" stack is empty". The space after the word is not part of it.
+func (l *Lexer) readWordString() (Token, error) {
+	startLine := l.line
+	startCol := l.column
+	if l.peek() == ' ' {
+		l.advance()
+	}
+	return l.readStringBody(startLine, startCol)
+}
 
+// readStringBody reads the rest of a string up to its closing "
+func (l *Lexer) readStringBody(startLine, startCol int) (Token, error) {
 	var str strings.Builder
 
 	for l.pos < len(l.input) {
@@ -260,7 +283,7 @@ func (l *Lexer) readString() (Token, error) {
 func (l *Lexer) readSingleChar(tokenType TokenType) Token {
 	token := Token{
 		Type:   tokenType,
-		Value:  string(l.peek()),
+		Value:  l.input[l.pos : l.pos+1],
 		Line:   l.line,
 		Column: l.column,
 	}
@@ -274,21 +297,25 @@ func (l *Lexer) readComment() (Token, error) {
 	startCol := l.column
 	l.advance() // skip '('
 
-	var comment strings.Builder
+	start := l.pos
+	end := start
 	depth := 1 // Support nested comments
 
 	for l.pos < len(l.input) && depth > 0 {
 		ch := l.peek()
 		if ch == '(' {
-			depth++
+			if depth++; depth > maxNesting {
+				return Token{}, fmt.Errorf("comments nested more than %d deep at line %d, column %d", maxNesting, l.line, l.column)
+			}
 		} else if ch == ')' {
 			depth--
 			if depth == 0 {
+				end = l.pos
 				l.advance() // skip closing ')'
 				break
 			}
 		}
-		comment.WriteByte(l.advance())
+		l.advance()
 	}
 
 	if depth > 0 {
@@ -297,7 +324,7 @@ func (l *Lexer) readComment() (Token, error) {
 
 	return Token{
 		Type:   TokenComment,
-		Value:  comment.String(),
+		Value:  l.input[start:end],
 		Line:   startLine,
 		Column: startCol,
 	}, nil
@@ -311,87 +338,109 @@ func (l *Lexer) readLineComment() (Token, error) {
 	l.advance() // Skip first /
 	l.advance() // Skip second /
 
-	var comment strings.Builder
-
+	start := l.pos
 	for l.pos < len(l.input) && l.peek() != '\n' {
-		comment.WriteByte(l.advance())
+		l.advance()
 	}
 
 	return Token{
 		Type:   TokenComment,
-		Value:  comment.String(),
+		Value:  l.input[start:l.pos],
 		Line:   startLine,
 		Column: startCol,
 	}, nil
 }
 
-// readNumber reads numeric literals (decimal or hex)
-func (l *Lexer) readNumber() Token {
+// readNumber reads a numeric literal: an optional - and then decimal
+// digits, or 0x and hex digits. The literal must end where a word would,
+// so 5-3 is an error rather than 5 followed by -3.
+func (l *Lexer) readNumber() (Token, error) {
 	startLine := l.line
 	startCol := l.column
-	var num strings.Builder
+	start := l.pos // Token values slice the input rather than copying it
 
 	// Handle negative sign
 	if l.peek() == '-' {
-		num.WriteByte(l.advance())
+		l.advance()
 	}
 
+	digit := func(ch byte) bool { return unicode.IsDigit(rune(ch)) }
 	// Check for hexadecimal (0x or 0X)
-	if l.peek() == '0' && l.pos+1 < len(l.input) {
-		next := l.input[l.pos+1]
-		if next == 'x' || next == 'X' {
-			num.WriteByte(l.advance()) // 0
-			num.WriteByte(l.advance()) // x
-			for l.pos < len(l.input) && isHexDigit(l.peek()) {
-				num.WriteByte(l.advance())
-			}
-			return Token{
-				Type:   TokenNumber,
-				Value:  num.String(),
-				Line:   startLine,
-				Column: startCol,
-			}
-		}
+	if l.peek() == '0' && l.pos+1 < len(l.input) && (l.input[l.pos+1] == 'x' || l.input[l.pos+1] == 'X') {
+		l.advance() // 0
+		l.advance() // x
+		digit = isHexDigit
+	}
+	for l.pos < len(l.input) && digit(l.peek()) {
+		l.advance()
 	}
 
-	// Read decimal digits
-	for l.pos < len(l.input) && unicode.IsDigit(rune(l.peek())) {
-		num.WriteByte(l.advance())
+	if l.pos < len(l.input) && !endsWord(l.peek()) {
+		end := l.pos
+		for l.pos < len(l.input) && !endsWord(l.peek()) {
+			l.advance()
+		}
+		text := l.input[start:l.pos]
+		if rest := l.input[end:l.pos]; len(rest) > 1 && rest[0] == '-' && unicode.IsDigit(rune(rest[1])) {
+			number := l.input[start:end]
+			return Token{}, fmt.Errorf("malformed number '%s' at line %d, column %d: write %s %s - to subtract or %s %s for two numbers",
+				text, startLine, startCol, number, rest[1:], number, rest)
+		}
+		return Token{}, fmt.Errorf("malformed number '%s' at line %d, column %d", text, startLine, startCol)
 	}
 
 	return Token{
 		Type:   TokenNumber,
-		Value:  num.String(),
+		Value:  l.input[start:l.pos],
 		Line:   startLine,
 		Column: startCol,
+	}, nil
+}
+
+// checkAdjacent warns when token is a negative number right after
+// another number on the same line, as in 5 -3, which pushes 5 and -3 but
+// may have been meant as 5 3 -
+func (l *Lexer) checkAdjacent(tokens []Token, token Token) {
+	if len(tokens) == 0 || token.Type != TokenNumber || !strings.HasPrefix(token.Value, "-") {
+		return
 	}
+	prev := tokens[len(tokens)-1]
+	if prev.Type == TokenNumber && prev.Line == token.Line {
+		l.logf(LevelWarn, "%s %s at line %d, column %d pushes two numbers; write %s %s - to subtract",
+			prev.Value, token.Value, token.Line, prev.Column, prev.Value, token.Value[1:])
+	}
+}
+
+// endsWord reports whether ch ends a word or number
+func endsWord(ch byte) bool {
+	return unicode.IsSpace(rune(ch)) || ch == '(' || ch == ')' ||
+		ch == ';' || ch == '@' || ch == '"' || ch == '[' || ch == ']'
 }
 
 // readWord reads a word (identifier)
 func (l *Lexer) readWord() (Token, error) {
 	startLine := l.line
 	startCol := l.column
-	var word strings.Builder
+	start := l.pos
 
 	for l.pos < len(l.input) {
 		ch := l.peek()
 
 		// Stop at whitespace, brackets, or special characters
-		if unicode.IsSpace(rune(ch)) || ch == '(' || ch == ')' ||
-			ch == ';' || ch == '@' || ch == '"' || ch == '[' || ch == ']' {
+		if endsWord(ch) {
 			break
 		}
 
 		// Allow single colon in words (e.g., for ?:, |:, !:)
 		if ch == ':' && l.pos > startCol {
-			word.WriteByte(l.advance())
+			l.advance()
 			continue
 		}
 
 		// Special handling for :: in module names
 		if ch == ':' && l.pos+1 < len(l.input) && l.input[l.pos+1] == ':' {
-			word.WriteByte(l.advance()) // First :
-			word.WriteByte(l.advance()) // Second :
+			l.advance() // First :
+			l.advance() // Second :
 			continue
 		}
 
@@ -399,19 +448,25 @@ func (l *Lexer) readWord() (Token, error) {
 		if unicode.IsLetter(rune(ch)) || unicode.IsDigit(rune(ch)) || ch == '_' ||
 			ch == '+' || ch == '-' || ch == '*' || ch == '/' || ch == '%' ||
 			ch == '&' || ch == '|' || ch == '^' || ch == '!' || ch == '?' || ch == '>' ||
-			ch == '<' || ch == '.' || ch == '=' {
-			word.WriteByte(l.advance())
+			ch == '<' || ch == '.' || ch == '=' || ch == ',' {
+			l.advance()
 		} else {
 			break
 		}
 	}
 
-	value := word.String()
+	if l.pos > start && l.peek() == '"' {
+		l.advance() // A word like ASSERT" takes the string that follows
+		l.quoted = true
+	} else if l.pos > start && l.peek() == '@' && (l.pos+1 == len(l.input) || endsWord(l.input[l.pos+1])) {
+		l.advance() // A word like PC@ ends in the @, which otherwise starts a definition
+	}
+	value := l.input[start:l.pos]
 	if value == "" {
 		return Token{}, fmt.Errorf("empty word at line %d, column %d", startLine, startCol)
 	}
 	if l.trace {
-		fmt.Fprintf(os.Stderr, "Lexer: readWord: Produced token={Type:%v, Value:%s, Line:%d, Column:%d}\n", TokenWord, value, startLine, startCol)
+		l.logf(LevelTrace, "Lexer: readWord: Produced token={Type:%v, Value:%s, Line:%d, Column:%d}", TokenWord, value, startLine, startCol)
 	}
 	return Token{
 		Type:   TokenWord,
@@ -437,27 +492,53 @@ func isHexDigit(ch byte) bool {
 	return unicode.IsDigit(rune(ch)) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
 }
 
-// ParseNumber converts a number token to int32
+// ParseNumber converts a number token to int32. A number outside the
+// 32-bit range is an error that says so, rather than being cut down to fit;
+// CompileOptions.WrapHex reads hex literals up to 0xFFFFFFFF as the bit
+// patterns they spell.
 func ParseNumber(token Token) (int32, error) {
 	if token.Type != TokenNumber {
 		return 0, fmt.Errorf("expected number token")
 	}
-
-	// Handle hexadecimal
-	if strings.HasPrefix(token.Value, "0x") || strings.HasPrefix(token.Value, "0X") {
-		val, err := strconv.ParseInt(token.Value[2:], 16, 32)
-		if err != nil {
-			return 0, fmt.Errorf("invalid hex number '%s' at line %d: %v",
-				token.Value, token.Line, err)
+	digits, negative := strings.CutPrefix(token.Value, "-")
+	base := 10
+	if isHexLiteral(digits) {
+		digits, base = digits[2:], 16
+	}
+	magnitude, err := strconv.ParseUint(digits, base, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		kind := "number"
+		if base == 16 {
+			kind = "hex number"
 		}
-		return int32(val), nil
+		return 0, fmt.Errorf("invalid %s '%s' at line %d", kind, token.Value, token.Line)
 	}
+	switch {
+	case negative && err == nil && magnitude <= -math.MinInt32:
+		return int32(-int64(magnitude)), nil
+	case !negative && err == nil && magnitude <= math.MaxInt32:
+		return int32(magnitude), nil
+	case !negative && err == nil && base == 16 && magnitude <= math.MaxUint32:
+		return 0, fmt.Errorf("%s exceeds 32-bit range at line %d (wrapping hex literals would read it as %d)",
+			token.Value, token.Line, int32(magnitude))
+	}
+	return 0, fmt.Errorf("%s exceeds 32-bit range at line %d", token.Value, token.Line)
+}
 
-	// Handle decimal
-	val, err := strconv.ParseInt(token.Value, 10, 32)
-	if err != nil {
-		return 0, fmt.Errorf("invalid number '%s' at line %d: %v",
-			token.Value, token.Line, err)
+// isHexLiteral reports whether a number is written in hexadecimal
+func isHexLiteral(value string) bool {
+	return strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X")
+}
+
+// wrapHex rewrites each hex literal from 0x80000000 to 0xFFFFFFFF in
+// tokens as the negative number with the same 32 bits, so 0xFFFFFFFF is -1
+func wrapHex(tokens []Token) {
+	for i, tok := range tokens {
+		if tok.Type != TokenNumber || !isHexLiteral(tok.Value) {
+			continue
+		}
+		if bits, err := strconv.ParseUint(tok.Value[2:], 16, 32); err == nil && bits > math.MaxInt32 {
+			tokens[i].Value = strconv.Itoa(int(int32(bits)))
+		}
 	}
-	return int32(val), nil
 }
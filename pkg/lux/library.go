@@ -0,0 +1,306 @@
+package lux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// LibraryMagic marks a .nuxlib archive
+const LibraryMagic = "NUXL"
+
+// LibraryFormatVersion is the archive layout written by EncodeLibrary
+const LibraryFormatVersion = 1
+
+// LibraryModule is one module in a library archive. The source travels with
+// the compiled image because programs link a module by compiling its source
+// at their own addresses; the image and its symbol table describe the module
+// without recompiling it.
+type LibraryModule struct {
+	Name   string
+	Source string
+	Image  *vm.Image // nil for a module found as a .lux source on the library path
+}
+
+// Library is a bundle of compiled modules
+type Library struct {
+	Modules []LibraryModule
+}
+
+// LibrarySource is one input file for BuildLibrary
+type LibrarySource struct {
+	Path   string // For error messages
+	Source string
+}
+
+// Module returns the named module, if the library contains it
+func (lib *Library) Module(name string) (*LibraryModule, bool) {
+	for i := range lib.Modules {
+		if lib.Modules[i].Name == name {
+			return &lib.Modules[i], true
+		}
+	}
+	return nil, false
+}
+
+// BuildLibrary compiles each source into a module. Every source must declare
+// exactly one MODULE and contain only definitions, since library code is
+// linked into programs that never run its toplevel. A source may IMPORT
+// modules from earlier sources in the same call.
+func BuildLibrary(sources []LibrarySource, opts CompileOptions) (*Library, error) {
+	lib := &Library{}
+	opts.NoEntry = true
+	opts.Libraries = append([]*Library{lib}, opts.Libraries...)
+	for _, src := range sources {
+		name, err := moduleName(src)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := lib.Module(name); dup {
+			return nil, fmt.Errorf("%s: module %s is already in the library", src.Path, name)
+		}
+		prog, err := CompileProgram(src.Source, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", src.Path, err)
+		}
+		for _, r := range prog.Layout.Regions {
+			// The toplevel region of a definitions-only file is just the JMP over the quotations
+			if r.Kind == RegionMain && r.Size() > 5 {
+				return nil, fmt.Errorf("%s: library module %s has toplevel code", src.Path, name)
+			}
+		}
+		var symbols []vm.Symbol
+		for _, sym := range prog.Symbols {
+			if sym.Module == name {
+				symbols = append(symbols, sym)
+			}
+		}
+		image := prog.Image()
+		image.Symbols = symbols
+		lib.Modules = append(lib.Modules, LibraryModule{Name: name, Source: src.Source, Image: image})
+	}
+	return lib, nil
+}
+
+// moduleName returns the single module a library source declares
+func moduleName(src LibrarySource) (string, error) {
+	tokens, err := NewLexer(src.Source).Tokenize()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", src.Path, err)
+	}
+	name := ""
+	for _, declared := range directiveArgs(tokens, "MODULE") {
+		if name != "" && declared != name {
+			return "", fmt.Errorf("%s: library sources must declare a single module, found %s and %s", src.Path, name, declared)
+		}
+		name = declared
+	}
+	if name == "" {
+		return "", fmt.Errorf("%s: library source has no MODULE directive", src.Path)
+	}
+	return name, nil
+}
+
+// EncodeLibrary serializes a library:
+//
+//	magic "NUXL" | version uint16 | module count uint16
+//	then per module: name (uint16 length) | source (uint32 length) | image (uint32 length)
+func EncodeLibrary(lib *Library) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(LibraryMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(LibraryFormatVersion))
+	binary.Write(&buf, binary.BigEndian, uint16(len(lib.Modules)))
+	for _, mod := range lib.Modules {
+		binary.Write(&buf, binary.BigEndian, uint16(len(mod.Name)))
+		buf.WriteString(mod.Name)
+		binary.Write(&buf, binary.BigEndian, uint32(len(mod.Source)))
+		buf.WriteString(mod.Source)
+		image := vm.EncodeImage(mod.Image)
+		binary.Write(&buf, binary.BigEndian, uint32(len(image)))
+		buf.Write(image)
+	}
+	return buf.Bytes()
+}
+
+// ParseLibrary decodes a .nuxlib archive
+func ParseLibrary(data []byte) (*Library, error) {
+	if len(data) < len(LibraryMagic) || string(data[:len(LibraryMagic)]) != LibraryMagic {
+		return nil, fmt.Errorf("not a library archive")
+	}
+	r := bytes.NewReader(data[len(LibraryMagic):])
+	var version, count uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, fmt.Errorf("library header truncated")
+	}
+	if version > LibraryFormatVersion {
+		return nil, fmt.Errorf("library format version %d is newer than supported version %d", version, LibraryFormatVersion)
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("library header truncated")
+	}
+	lib := &Library{}
+	for i := 0; i < int(count); i++ {
+		name, err := readChunk(r, 2)
+		if err != nil {
+			return nil, fmt.Errorf("library module %d name: %v", i, err)
+		}
+		source, err := readChunk(r, 4)
+		if err != nil {
+			return nil, fmt.Errorf("library module %s source: %v", name, err)
+		}
+		imageData, err := readChunk(r, 4)
+		if err != nil {
+			return nil, fmt.Errorf("library module %s image: %v", name, err)
+		}
+		image, err := vm.ParseImage(imageData)
+		if err != nil {
+			return nil, fmt.Errorf("library module %s image: %v", name, err)
+		}
+		lib.Modules = append(lib.Modules, LibraryModule{Name: string(name), Source: string(source), Image: image})
+	}
+	return lib, nil
+}
+
+// readChunk reads a length-prefixed byte string with a 2 or 4 byte length
+func readChunk(r *bytes.Reader, lengthSize int) ([]byte, error) {
+	var n uint32
+	if lengthSize == 2 {
+		var n16 uint16
+		if err := binary.Read(r, binary.BigEndian, &n16); err != nil {
+			return nil, fmt.Errorf("truncated")
+		}
+		n = uint32(n16)
+	} else if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("truncated")
+	}
+	if int64(n) > int64(r.Len()) {
+		return nil, fmt.Errorf("length %d exceeds archive size", n)
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b, nil
+}
+
+// PackagesDir is where `lux get` installs packages, relative to the project
+const PackagesDir = "lux_packages"
+
+// DefaultLibPath returns the directories listed in LUXPATH, followed by
+// PackagesDir when it exists in the working directory
+func DefaultLibPath() []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("LUXPATH")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	if info, err := os.Stat(PackagesDir); err == nil && info.IsDir() {
+		dirs = append(dirs, PackagesDir)
+	}
+	return dirs
+}
+
+// findModule searches the loaded libraries, then each directory of the
+// library path in order: first a <module>.lux source (lower-case file
+// name), then the .nuxlib archives sorted by name
+func findModule(name string, opts CompileOptions) (*LibraryModule, error) {
+	for _, lib := range opts.Libraries {
+		if mod, ok := lib.Module(name); ok {
+			return mod, nil
+		}
+	}
+	for _, dir := range opts.LibPath {
+		path := filepath.Join(dir, strings.ToLower(name)+".lux")
+		if source, err := os.ReadFile(path); err == nil {
+			src := LibrarySource{Path: path, Source: string(source)}
+			declared, err := moduleName(src)
+			if err != nil {
+				return nil, err
+			}
+			if declared != name {
+				return nil, fmt.Errorf("%s: declares module %s, expected %s", path, declared, name)
+			}
+			return &LibraryModule{Name: name, Source: src.Source}, nil
+		}
+		archives, _ := filepath.Glob(filepath.Join(dir, "*.nuxlib"))
+		sort.Strings(archives)
+		for _, path := range archives {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			lib, err := ParseLibrary(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			if mod, ok := lib.Module(name); ok {
+				return mod, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("module %s is not defined and was not found in the library path %v", name, opts.LibPath)
+}
+
+// linkLibraries prepends the tokens of every IMPORTed module that the
+// program does not define itself, dependencies first. It returns the new
+// token stream and the position where the program's own tokens begin.
+func linkLibraries(tokens []Token, opts CompileOptions) ([]Token, int, error) {
+	defined := make(map[string]bool)
+	for _, name := range directiveArgs(tokens, "MODULE") {
+		defined[name] = true
+	}
+	var linked []Token
+	visiting := make(map[string]bool)
+	var link func(name string) error
+	link = func(name string) error {
+		if defined[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("library modules import each other in a cycle through %s", name)
+		}
+		visiting[name] = true
+		mod, err := findModule(name, opts)
+		if err != nil {
+			return err
+		}
+		modTokens, err := NewLexer(mod.Source).Tokenize()
+		if err != nil {
+			return fmt.Errorf("library module %s: %v", name, err)
+		}
+		modTokens = modTokens[:len(modTokens)-1] // Drop EOF
+		for _, dep := range directiveArgs(modTokens, "IMPORT") {
+			if err := link(dep); err != nil {
+				return err
+			}
+		}
+		linked = append(linked, modTokens...)
+		defined[name] = true
+		return nil
+	}
+	for _, name := range directiveArgs(tokens, "IMPORT") {
+		if err := link(name); err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(linked) == 0 {
+		return tokens, 0, nil
+	}
+	return append(linked, tokens...), len(linked), nil
+}
+
+// directiveArgs lists the names following each occurrence of a directive
+func directiveArgs(tokens []Token, directive string) []string {
+	var names []string
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i].Type == TokenWord && strings.EqualFold(tokens[i].Value, directive) && tokens[i+1].Type == TokenWord {
+			names = append(names, strings.ToUpper(tokens[i+1].Value))
+		}
+	}
+	return names
+}
@@ -0,0 +1,129 @@
+package lux
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// writeLibrary builds an archive from sources into a temp dir and returns the dir
+func writeLibrary(t *testing.T, name string, sources ...string) string {
+	t.Helper()
+	var srcs []LibrarySource
+	for i, s := range sources {
+		srcs = append(srcs, LibrarySource{Path: filepath.Join("src", string(rune('a'+i))+".lux"), Source: s})
+	}
+	lib, err := BuildLibrary(srcs, CompileOptions{})
+	if err != nil {
+		t.Fatalf("BuildLibrary error: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), EncodeLibrary(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLibraryRoundTrip(t *testing.T) {
+	lib, err := BuildLibrary([]LibrarySource{
+		{Path: "math.lux", Source: "MODULE MATH @square dup * ; @cube dup square * ;"},
+		{Path: "str.lux", Source: "MODULE STR @nl 10 emit ;"},
+	}, CompileOptions{})
+	if err != nil {
+		t.Fatalf("BuildLibrary error: %v", err)
+	}
+	got, err := ParseLibrary(EncodeLibrary(lib))
+	if err != nil {
+		t.Fatalf("ParseLibrary error: %v", err)
+	}
+	if len(got.Modules) != 2 {
+		t.Fatalf("Expected 2 modules, got %d", len(got.Modules))
+	}
+	math, ok := got.Module("MATH")
+	if !ok {
+		t.Fatal("Expected module MATH")
+	}
+	if len(math.Image.Symbols) != 2 || math.Image.Symbols[0].Name != "MATH::SQUARE" {
+		t.Errorf("Expected MATH::SQUARE and MATH::CUBE, got %+v", math.Image.Symbols)
+	}
+}
+
+func TestBuildLibraryErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"no module", "@square dup * ;", "no MODULE directive"},
+		{"two modules", "MODULE A @x 1 ; MODULE B @y 2 ;", "single module"},
+		{"toplevel code", "MODULE A @x 1 ; 5 x", "has toplevel code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := BuildLibrary([]LibrarySource{{Path: "a.lux", Source: tt.source}}, CompileOptions{})
+			if err == nil || !contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestImportFromLibPath(t *testing.T) {
+	dir := writeLibrary(t, "core.nuxlib",
+		"MODULE MATH @square dup * ;",
+		"MODULE GEO IMPORT MATH @area math::square ;",
+	)
+	source := `
+		IMPORT GEO AS G
+		@double 2 * ;
+		4 G::area double
+	`
+	prog, err := CompileProgram(source, CompileOptions{LibPath: []string{dir}})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(prog.Code)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 32 {
+		t.Errorf("Expected [32], got %v", stack)
+	}
+	// The program's own words must not land in the last linked module
+	found := false
+	for _, sym := range prog.Symbols {
+		if sym.Name == "DOUBLE" && sym.Module == "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected DOUBLE outside any module, got %+v", prog.Symbols)
+	}
+}
+
+func TestImportMissingModule(t *testing.T) {
+	_, err := CompileProgram("IMPORT NOPE 1", CompileOptions{LibPath: []string{t.TempDir()}})
+	if err == nil || !contains(err.Error(), "module NOPE is not defined") {
+		t.Errorf("Expected missing module error, got %v", err)
+	}
+}
+
+func TestImportSourceFromLibPath(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "math.lux"), []byte("MODULE MATH @square dup * ;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prog, err := CompileProgram("IMPORT MATH 6 math::square", CompileOptions{LibPath: []string{dir}})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(prog.Code)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Runtime error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 36 {
+		t.Errorf("Expected [36], got %v", stack)
+	}
+}
@@ -0,0 +1,30 @@
+package lux
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// LoadImage reads a program for the tools that run one: a .lux file is
+// compiled with opts, anything else is parsed as a .nux image (or a raw
+// .bin program) and checked against the VM's ISA version.
+func LoadImage(file string, opts CompileOptions) (*vm.Image, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(file, ".lux") {
+		prog, err := CompileProgram(string(data), opts)
+		if err != nil {
+			return nil, err
+		}
+		return prog.Image(), nil
+	}
+	image, err := vm.ParseImage(data)
+	if err != nil {
+		return nil, err
+	}
+	return image, image.CheckISA()
+}
@@ -0,0 +1,45 @@
+package lux
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+func TestLoadImage(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "square.lux")
+	if err := os.WriteFile(source, []byte("@square dup * ; 7 square"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := LoadImage(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("LoadImage(.lux) error: %v", err)
+	}
+	if _, ok := compiled.Lookup("SQUARE"); !ok {
+		t.Errorf("compiled image has no SQUARE symbol: %v", compiled.Symbols)
+	}
+
+	image := filepath.Join(dir, "square.nux")
+	if err := os.WriteFile(image, vm.EncodeImage(compiled), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := LoadImage(image, CompileOptions{})
+	if err != nil {
+		t.Fatalf("LoadImage(.nux) error: %v", err)
+	}
+	if !bytes.Equal(parsed.Code, compiled.Code) {
+		t.Errorf("parsed code = %x, want %x", parsed.Code, compiled.Code)
+	}
+
+	compiled.ISAVersion = vm.ISAVersion + 1
+	if err := os.WriteFile(image, vm.EncodeImage(compiled), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadImage(image, CompileOptions{}); err == nil {
+		t.Error("LoadImage accepted an image built for a newer ISA")
+	}
+}
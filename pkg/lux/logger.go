@@ -0,0 +1,108 @@
+package lux
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Level is how much detail a compiler diagnostic goes into
+type Level int
+
+const (
+	LevelTrace Level = iota // Each character, token and instruction, for debugging the compiler
+	LevelDebug              // Each phase and where quotations are placed
+	LevelInfo               // What an optimization did to the program
+	LevelWarn               // Code that compiles but is probably not what was meant
+)
+
+var levelNames = []string{"trace", "debug", "info", "warn"}
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel returns the level named trace, debug, info or warn
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (want trace, debug, info or warn)", name)
+}
+
+// Logger receives the diagnostics of the lexer and compiler, so a program
+// embedding them, such as the REPL or an editor's language server, can
+// capture, filter or silence them. Errors are not logged; they are
+// returned.
+type Logger interface {
+	// Enabled reports whether messages at level are wanted, so the
+	// compiler can skip formatting the ones that are not
+	Enabled(level Level) bool
+	// Logf records one message, formatted as by fmt.Sprintf
+	Logf(level Level, format string, args ...any)
+}
+
+// NewLogger returns a Logger that writes each message at min or above to
+// w as one line, prefixed with its level. It is safe for concurrent use.
+func NewLogger(w io.Writer, min Level) Logger {
+	return &writerLogger{w: w, min: min}
+}
+
+type writerLogger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	min Level
+}
+
+func (l *writerLogger) Enabled(level Level) bool {
+	return level >= l.min
+}
+
+func (l *writerLogger) Logf(level Level, format string, args ...any) {
+	if level < l.min {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%s: %s\n", level, fmt.Sprintf(format, args...))
+}
+
+// logger returns where a compilation's diagnostics go: opts.Logger, or
+// stderr with every trace message when only Trace is set
+func (opts CompileOptions) logger() Logger {
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+	if opts.Trace {
+		return NewLogger(os.Stderr, LevelTrace)
+	}
+	return nil
+}
+
+// logf passes a message to the compiler's Logger, if it has one
+func (c *Compiler) logf(level Level, format string, args ...any) {
+	if c.log != nil && c.log.Enabled(level) {
+		c.log.Logf(level, format, args...)
+	}
+}
+
+// WithLogger sends the lexer's trace to log and returns the lexer
+func (l *Lexer) WithLogger(log Logger) *Lexer {
+	l.log = log
+	l.trace = log != nil && log.Enabled(LevelTrace)
+	return l
+}
+
+// logf passes a message to the lexer's Logger, if it has one
+func (l *Lexer) logf(level Level, format string, args ...any) {
+	if l.log != nil && l.log.Enabled(level) {
+		l.log.Logf(level, format, args...)
+	}
+}
@@ -0,0 +1,58 @@
+package lux
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// recordLogger keeps every message at or above min
+type recordLogger struct {
+	min      Level
+	messages []string
+}
+
+func (r *recordLogger) Enabled(level Level) bool { return level >= r.min }
+
+func (r *recordLogger) Logf(level Level, format string, args ...any) {
+	r.messages = append(r.messages, level.String()+" "+format)
+}
+
+func TestCompilerLogger(t *testing.T) {
+	source := "@unused 1 ; @sq dup * ; 3 sq ."
+	trace := &recordLogger{min: LevelTrace}
+	if _, err := CompileProgram(source, CompileOptions{Logger: trace, DropUnused: true}); err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	all := strings.Join(trace.messages, "\n")
+	for _, want := range []string{"trace Lexer: NextToken", "trace compileToken: Processing", "debug compile: Main code starts", "info dropped %d unused words"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("Expected a message starting %q, got:\n%s", want, all)
+		}
+	}
+	info := &recordLogger{min: LevelInfo}
+	if _, err := CompileProgram(source, CompileOptions{Logger: info, DropUnused: true}); err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if len(info.messages) != 1 {
+		t.Errorf("Expected only the info message, got %q", info.messages)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	log := NewLogger(&out, LevelInfo)
+	log.Logf(LevelDebug, "hidden")
+	log.Logf(LevelWarn, "shown %d", 1)
+	if got := out.String(); got != "warn: shown 1\n" {
+		t.Errorf("Logged %q", got)
+	}
+	for _, name := range []string{"trace", "Debug", "INFO", "warn"} {
+		if _, err := ParseLevel(name); err != nil {
+			t.Errorf("ParseLevel(%q): %v", name, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
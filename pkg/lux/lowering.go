@@ -0,0 +1,186 @@
+package lux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// Lowering compiles one use of a word added with Register, emitting its
+// code through b
+type Lowering func(b *Builder) error
+
+var (
+	loweringsMu sync.RWMutex
+	lowerings   = make(map[string]Lowering)
+)
+
+// expandedWords are the built-in words that compile to more than one
+// instruction, besides the builtins, combinators and output words
+var expandedWords = []string{">", "NEGATE", "ABORT", "RND", "ON-FRAME", "SND"}
+
+// Register adds name as a word every program can use, compiled by lower,
+// so a package can give LUX domain-specific words, such as a game engine's
+// calls, without changing the compiler. It is meant to be called from an
+// init function. A word the program defines with the same name takes
+// precedence. Register panics if name is a built-in word or already
+// registered.
+func Register(name string, lower Lowering) {
+	name = strings.ToUpper(name)
+	_, builtin := builtins[name]
+	_, output := outputWords[name]
+	_, field := fieldWords[name]
+	_, transfer := transferWords[name]
+	_, message := messageWords[name]
+	if _, host := hostCall(name); builtin || output || field || transfer || message || host || combinators[name] || slices.Contains(expandedWords, name) {
+		panic(fmt.Sprintf("lux: Register of built-in word %s", name))
+	}
+	loweringsMu.Lock()
+	defer loweringsMu.Unlock()
+	if _, dup := lowerings[name]; dup {
+		panic(fmt.Sprintf("lux: Register called twice for %s", name))
+	}
+	lowerings[name] = lower
+}
+
+// registered returns the lowering of a word added with Register
+func registered(name string) (Lowering, bool) {
+	loweringsMu.RLock()
+	defer loweringsMu.RUnlock()
+	lower, ok := lowerings[strings.ToUpper(name)]
+	return lower, ok
+}
+
+// Builder emits code where a registered word is written: in a word, the
+// toplevel code or a quotation. Jumps are made with Forward and Land, or
+// Here and JumpTo, so they stay right wherever that code is placed.
+type Builder struct {
+	c      *Compiler
+	quot   int    // Quotation being compiled, or mainCode
+	nested *[]int // Its quotations not yet given to a combinator
+	line   int
+}
+
+// Jump is a forward jump Builder.Land points at where the code has got to
+type Jump struct{ at int32 } // Operand offset in the main code, or reloc index
+
+// Label is a place Builder.JumpTo jumps back to
+type Label struct{ at int32 } // Address in the main code, or offset in the quotation
+
+// lower compiles token, a use of a registered word, into the quotation
+// quot, or the main code when quot is mainCode
+func (c *Compiler) lower(lower Lowering, token Token, quot int, nested *[]int) error {
+	if err := lower(&Builder{c: c, quot: quot, nested: nested, line: token.Line}); err != nil {
+		return fmt.Errorf("%s at line %d: %v", strings.ToUpper(token.Value), token.Line, err)
+	}
+	return nil
+}
+
+// Line returns the source line of the word being compiled
+func (b *Builder) Line() int {
+	return b.line
+}
+
+// Emit appends instructions as they are. Jumps and calls within them are
+// not relocated, so use Forward, JumpTo and Call for those.
+func (b *Builder) Emit(code ...byte) {
+	if b.quot == mainCode {
+		b.c.emit(code...)
+		return
+	}
+	q := &b.c.quotations[b.quot]
+	q.Code = append(q.Code, code...)
+}
+
+// Push emits the shortest push of value
+func (b *Builder) Push(value int32) {
+	b.Emit(vm.AppendShortPush(nil, value)...)
+}
+
+// Host emits a call to the host function name, as HOST:NAME does
+func (b *Builder) Host(name string) {
+	b.Emit(vm.HostInstruction(strings.ToUpper(name))...)
+}
+
+// Call emits a call to a word the program defines, or a push of a DATA
+// table's address
+func (b *Builder) Call(name string) error {
+	word, ok := b.c.resolveWord(strings.ToUpper(name))
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown word '%s'", name)
+	case !word.Data:
+		b.Emit(binary.BigEndian.AppendUint32([]byte{vm.OpCall}, uint32(word.Address))...)
+	case b.quot == mainCode:
+		b.c.emitDataRef(word)
+	default:
+		b.c.appendDataRef(b.quot, word)
+	}
+	return nil
+}
+
+// RunQuotation emits a call to the quotation on top of the stack, as CALL
+// does, so the word can work as a combinator. A quotation written before
+// the word may use EXIT.
+func (b *Builder) RunQuotation() error {
+	if b.quot != mainCode {
+		var transfers uint8
+		if n := len(*b.nested); n > 0 {
+			transfers = b.c.quotations[(*b.nested)[n-1]].transfers
+			*b.nested = (*b.nested)[:n-1]
+		}
+		b.Emit(vm.OpCallStack)
+		b.c.appendLanding(b.quot, transfers)
+		return nil
+	}
+	transfers, err := b.c.takeQuotation(false)
+	if err != nil {
+		return err
+	}
+	b.c.emit(vm.OpCallStack)
+	b.c.emitExitHandler(transfers)
+	return nil
+}
+
+// Forward emits a JMP or JZ whose target is set later with Land
+func (b *Builder) Forward(op byte) Jump {
+	if b.quot != mainCode {
+		return Jump{int32(b.c.appendJump(b.quot, op))}
+	}
+	b.c.emit(op)
+	at := b.c.currentOffset()
+	b.c.emitInt32(0)
+	return Jump{at}
+}
+
+// Land points j at the code emitted next
+func (b *Builder) Land(j Jump) {
+	if b.quot != mainCode {
+		b.c.jumpHere(int(j.at))
+		return
+	}
+	b.c.patchInt32(j.at, b.c.currentAddress())
+}
+
+// Here returns a label on the code emitted next, for JumpTo
+func (b *Builder) Here() Label {
+	if b.quot != mainCode {
+		return Label{int32(len(b.c.quotations[b.quot].Code))}
+	}
+	return Label{b.c.currentAddress()}
+}
+
+// JumpTo emits a JMP or JZ back to l
+func (b *Builder) JumpTo(op byte, l Label) {
+	if b.quot == mainCode {
+		b.c.emit(op)
+		b.c.emitInt32(l.at)
+		return
+	}
+	r := b.c.appendJump(b.quot, op)
+	b.c.relocs[r].data = l.at
+}
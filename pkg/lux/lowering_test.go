@@ -0,0 +1,121 @@
+package lux
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+func init() {
+	// Clamp a negative number to zero, with a forward jump
+	Register("test-clamp", func(b *Builder) error {
+		b.Emit(vm.OpDup)
+		b.Push(0)
+		b.Emit(vm.OpLt)
+		skip := b.Forward(vm.OpJz)
+		b.Emit(vm.OpPop)
+		b.Push(0)
+		b.Land(skip)
+		return nil
+	})
+	// Print n down to 1, with a backward jump
+	Register("test-countdown", func(b *Builder) error {
+		loop := b.Here()
+		b.Emit(vm.OpDup)
+		end := b.Forward(vm.OpJz)
+		b.Emit(vm.OpDup)
+		b.Push(vm.FormatNumber)
+		b.Emit(vm.OpOut, vm.OpDec)
+		b.JumpTo(vm.OpJmp, loop)
+		b.Land(end)
+		b.Emit(vm.OpPop)
+		return nil
+	})
+	// Run a quotation twice
+	Register("test-twice", func(b *Builder) error {
+		b.Emit(vm.OpDup, vm.OpToR)
+		if err := b.RunQuotation(); err != nil {
+			return err
+		}
+		b.Emit(vm.OpFromR)
+		return b.RunQuotation()
+	})
+	Register("test-square", func(b *Builder) error { return b.Call("square") })
+	Register("test-draw", func(b *Builder) error {
+		b.Host("draw")
+		return nil
+	})
+	Register("test-broken", func(b *Builder) error {
+		return errors.New("not in this engine")
+	})
+}
+
+func TestRegisteredWords(t *testing.T) {
+	tests := []struct{ source, want string }{
+		{"-5 test-clamp . 7 test-clamp .", "0 7 "},
+		{"3 test-countdown", "3 2 1 "},
+		{"[ 1 . ] test-twice", "1 1 "},
+		{"@square dup * ; 4 test-square .", "16 "},
+		// In quotations, at the toplevel and in a word
+		{"1 [ -2 test-clamp . 2 test-countdown ] ?", "0 2 1 "},
+		{"@go 1 [ -2 test-clamp . 2 test-countdown [ 3 . ] test-twice ] ? ; go", "0 2 1 3 3 "},
+		{"@square dup * ; [ 5 test-square . ] call", "25 "},
+		// A word the program defines wins
+		{"@test-clamp 99 ; test-clamp .", "99 "},
+	}
+	for _, tt := range tests {
+		prog, err := CompileProgram(tt.source, CompileOptions{})
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", tt.source, err)
+		}
+		if got, _ := runOutput(t, prog.Code); got != tt.want {
+			t.Errorf("%q: printed %q, want %q", tt.source, got, tt.want)
+		}
+		if got := runRebased(t, prog, 0x200); got != tt.want {
+			t.Errorf("%q: rebased program printed %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestRegisteredHostWord(t *testing.T) {
+	prog, err := CompileProgram("6 test-draw", CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	machine := vm.NewVM(prog.Code)
+	var drawn int32
+	machine.RegisterHost("DRAW", "", func(m *vm.VM) error {
+		v, err := m.Pop()
+		drawn = v
+		return err
+	})
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if drawn != 6 {
+		t.Errorf("Expected the host function to get 6, got %d", drawn)
+	}
+}
+
+func TestRegisteredWordErrors(t *testing.T) {
+	_, err := CompileProgram("1\ntest-broken", CompileOptions{})
+	if err == nil || !strings.Contains(err.Error(), "TEST-BROKEN at line 2: not in this engine") {
+		t.Errorf("Expected the lowering's error with its line, got %v", err)
+	}
+	_, err = CompileProgram("test-square", CompileOptions{})
+	if err == nil || !strings.Contains(err.Error(), "unknown word 'square'") {
+		t.Errorf("Expected an unknown word error, got %v", err)
+	}
+	for _, name := range []string{"dup", "call", ".", "exit", "negate", "host:draw", "test-clamp"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected Register(%q) to panic", name)
+				}
+			}()
+			Register(name, func(*Builder) error { return nil })
+		}()
+	}
+}
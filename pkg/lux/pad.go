@@ -0,0 +1,141 @@
+package lux
+
+import (
+	"fmt"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// The pad is a string buffer in reserved memory that APPEND-CHAR and
+// APPEND-NUMBER add to and PAD-TYPE prints and empties, so a program can
+// build a line while it computes and print it at once. Its first cell
+// holds the length, the characters follow one per cell, and it sits just
+// under the service vector. Appending to a full pad prints and empties it
+// first, so no text is lost.
+const (
+	PadCells = 80                                     // Characters the pad holds
+	PadAddr  = int32(vm.ServiceVectorAddr) - PadBytes // Its length cell
+	PadBytes = 4 * (PadCells + 1)                     // The length and the characters
+	padChars = PadAddr + 4
+)
+
+func init() {
+	Register("APPEND-CHAR", func(b *Builder) error { // ( c -- )
+		if err := b.c.usePad(b.Line()); err != nil {
+			return err
+		}
+		appendChar(b)
+		return nil
+	})
+	Register("APPEND-NUMBER", func(b *Builder) error { // ( n -- )
+		if err := b.c.usePad(b.Line()); err != nil {
+			return err
+		}
+		appendNumber(b)
+		return nil
+	})
+	Register("PAD-TYPE", func(b *Builder) error { // ( -- )
+		if err := b.c.usePad(b.Line()); err != nil {
+			return err
+		}
+		padType(b)
+		return nil
+	})
+}
+
+// usePad checks the pad fits in the reserved memory the program is
+// compiled for, and records it in the layout
+func (c *Compiler) usePad(line int) error {
+	if c.reservedSize < PadAddr+PadBytes {
+		return fmt.Errorf("the pad needs %d bytes of reserved memory, this program is compiled for %d",
+			PadAddr+PadBytes, c.reservedSize)
+	}
+	if !c.padUsed {
+		c.layout.add(RegionPad, "pad", PadAddr, PadAddr+PadBytes, line)
+	}
+	c.padUsed = true
+	return nil
+}
+
+// padType emits ( -- ): print the pad's characters and empty it
+func padType(b *Builder) {
+	b.Push(padChars)
+	b.Emit(vm.LoadInstruction(PadAddr)...) // addr len
+	loop := b.Here()
+	b.Emit(vm.OpDup)
+	done := b.Forward(vm.OpJz)
+	b.Emit(vm.OpSwap, vm.OpDup, vm.OpLoadI)
+	b.Push(vm.FormatChar)
+	b.Emit(vm.OpOut)
+	b.Push(4)
+	b.Emit(vm.OpAdd, vm.OpSwap, vm.OpDec)
+	b.JumpTo(vm.OpJmp, loop)
+	b.Land(done)
+	b.Emit(vm.OpPop, vm.OpPop)
+	b.Push(0)
+	b.Emit(vm.StoreInstruction(PadAddr)...)
+}
+
+// appendChar emits ( c -- ): add a character to the pad, printing the pad
+// first if it is full
+func appendChar(b *Builder) {
+	b.Emit(vm.LoadInstruction(PadAddr)...)
+	b.Push(PadCells)
+	b.Emit(vm.OpEq)
+	room := b.Forward(vm.OpJz)
+	padType(b)
+	b.Land(room)
+	b.Emit(vm.LoadInstruction(PadAddr)...) // c len
+	b.Emit(vm.OpDup, vm.OpInc)
+	b.Emit(vm.StoreInstruction(PadAddr)...)
+	b.Push(2)
+	b.Emit(vm.OpShl)
+	b.Push(padChars)
+	b.Emit(vm.OpAdd, vm.OpStoreI)
+}
+
+// appendNumber emits ( n -- ): add n's decimal digits to the pad, as .
+// prints them. The digits are worked out from the
+// negative of a positive n, which unlike the positive of a negative one
+// always exists, and pushed above a -1 that marks where they end.
+func appendNumber(b *Builder) {
+	b.Emit(vm.OpDup)
+	b.Push(0)
+	b.Emit(vm.OpLt, vm.OpDup, vm.OpToR) // n negative, R: negative
+	positive := b.Forward(vm.OpJz)
+	negative := b.Forward(vm.OpJmp)
+	b.Land(positive)
+	b.Push(0)
+	b.Emit(vm.OpSwap, vm.OpSub)
+	b.Land(negative)
+
+	b.Push(-1)
+	b.Emit(vm.OpSwap) // -1 m, with m <= 0
+	digits := b.Here()
+	b.Emit(vm.OpDup)
+	b.Push(10)
+	b.Emit(vm.OpMod) // m r, with -9 <= r <= 0
+	b.Push('0')
+	b.Emit(vm.OpSwap, vm.OpSub, vm.OpSwap)
+	b.Push(10)
+	b.Emit(vm.OpDiv, vm.OpDup)
+	b.Push(0)
+	b.Emit(vm.OpEq)
+	b.JumpTo(vm.OpJz, digits)
+	b.Emit(vm.OpPop, vm.OpFromR) // -1 digits... negative, the first digit on top
+	unsigned := b.Forward(vm.OpJz)
+	b.Push('-')
+	b.Land(unsigned)
+
+	next := b.Here()
+	b.Emit(vm.OpDup)
+	b.Push(0)
+	b.Emit(vm.OpLt)
+	more := b.Forward(vm.OpJz)
+	b.Emit(vm.OpPop)
+	done := b.Forward(vm.OpJmp)
+	b.Land(more)
+	appendChar(b)
+	b.JumpTo(vm.OpJmp, next)
+	b.Land(done)
+}
@@ -0,0 +1,42 @@
+package lux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPad(t *testing.T) {
+	tests := []struct{ source, want string }{
+		{"72 append-char 105 append-char pad-type", "Hi"},
+		{"0 append-number 32 append-char -42 append-number 32 append-char 2147483647 append-number pad-type", "0 -42 2147483647"},
+		{"-2147483648 append-number pad-type", "-2147483648"},
+		{"pad-type 7 append-number 1 . pad-type", "1 7"},
+		// In a word and in quotations
+		{"@cell append-number 44 append-char ; 1 cell 2 cell pad-type", "1,2,"},
+		{"1 [ 9 append-number ] ? [ 8 append-number ] 2 #: pad-type", "988"},
+		// A full pad is printed before it takes more
+		{"[ 65 append-char ] 81 #: 1 . pad-type", strings.Repeat("A", 80) + "1 A"},
+	}
+	for _, tt := range tests {
+		prog, err := CompileProgram(tt.source, CompileOptions{})
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", tt.source, err)
+		}
+		if got, stack := runOutput(t, prog.Code); got != tt.want || len(stack) != 0 {
+			t.Errorf("%q: printed %q leaving %v, want %q", tt.source, got, stack, tt.want)
+		}
+		if got := runRebased(t, prog, 0x200); got != tt.want {
+			t.Errorf("%q: rebased program printed %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestPadNeedsReservedMemory(t *testing.T) {
+	_, err := CompileProgram("1 append-number", CompileOptions{ReservedSize: 1024})
+	if err == nil || !strings.Contains(err.Error(), "the pad needs") {
+		t.Errorf("Expected the pad not to fit, got %v", err)
+	}
+	if _, err := CompileProgram("1 .", CompileOptions{ReservedSize: 1024}); err != nil {
+		t.Errorf("Expected a program without the pad to compile, got %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+package lux
+
+import "github.com/rmay/nuxvm/pkg/vm"
+
+func init() {
+	// .S ( -- ) prints the whole stack, leaving it as it is
+	Register(".S", func(b *Builder) error {
+		b.Push(-1)
+		b.Emit(vm.OpOutN)
+		return nil
+	})
+}
@@ -0,0 +1,80 @@
+package lux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// Redefinition is one word compiled on its own to replace the word of the
+// same name in a running program, through vm.Redefine
+type Redefinition struct {
+	Name    string   // Qualified, upper case
+	Old     int32    // The address of the word it replaces
+	Address int32    // Where the new word starts, in Code
+	Code    []byte   // Compiled to load at the base CompileRedefinition was given
+	Relocs  []uint32 // Offsets in Code of its absolute code and table addresses
+}
+
+// CompileRedefinition compiles the definition of the word called name in
+// source, typically the program's edited source, to run at base. It is
+// compiled as Incremental compiles a changed word, against the words and
+// DATA tables of img's debug info rather than source's, so it calls the
+// code already loaded; the rest of source is only read for the module the
+// word is in and what it imports. img must have been compiled with symbols
+// and define the word.
+func CompileRedefinition(source, name string, img *vm.Image, base int32, opts CompileOptions) (*Redefinition, error) {
+	tokens, err := NewLexer(source).WithLogger(opts.logger()).Tokenize()
+	if err != nil {
+		return nil, err
+	}
+	programStart := 0
+	if opts.WrapHex {
+		wrapHex(tokens)
+	}
+	if tokens, programStart, err = compileTime(tokens, programStart); err != nil {
+		return nil, err
+	}
+	if tokens, programStart, err = rewrite(tokens, programStart, opts.DisabledRules); err != nil {
+		return nil, err
+	}
+	defs, _, _ := splitDefinitions(tokens, programStart)
+	var def *definition
+	for i := range defs {
+		if defs[i].name == strings.ToUpper(name) || strings.HasSuffix(defs[i].name, "::"+strings.ToUpper(name)) {
+			def = &defs[i]
+			break
+		}
+	}
+	if def == nil {
+		return nil, fmt.Errorf("the source has no definition of %s", name)
+	}
+	old, ok := img.Lookup(def.name)
+	if !ok {
+		if len(img.Symbols) == 0 {
+			return nil, fmt.Errorf("the program has no symbol table (compile it with luxc -g)")
+		}
+		return nil, fmt.Errorf("the program has no word named %s to redefine", def.name)
+	}
+
+	// Tables push the address they already have, patched in below
+	dictionary := make(map[string]Word, len(img.Symbols)+len(img.Tables))
+	for _, sym := range img.Symbols {
+		dictionary[sym.Name] = Word{Name: sym.Name, Address: sym.Address, Module: sym.Module}
+	}
+	for _, t := range img.Tables {
+		dictionary[t.Name] = Word{Name: t.Name, Address: t.Address, Data: true}
+	}
+	opts.ReservedSize = int32(img.ReservedSize)
+	ch, err := compileChunk(*def, base, dictionary, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range ch.data {
+		binary.BigEndian.PutUint32(ch.code[ref.offset:], uint32(ref.data))
+	}
+	return &Redefinition{Name: def.name, Old: old.Address, Address: ch.word.Address, Code: ch.code,
+		Relocs: relocations(ch.code, 0, ch.pushes)}, nil
+}
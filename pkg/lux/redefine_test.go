@@ -0,0 +1,65 @@
+package lux
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+func TestCompileRedefinition(t *testing.T) {
+	source := `
+		DATA base 5 ,
+		@f base loadi ;
+		@g f f + ;
+		g .
+	`
+	prog, err := CompileProgram(source, CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	img := prog.Image()
+	machine, err := vm.NewVMForImage(img)
+	if err != nil {
+		t.Fatalf("NewVMForImage error: %v", err)
+	}
+	output := machine.CaptureOutput()
+
+	// Stop inside G, after its first call of F, and give F a new body
+	g, _ := img.Lookup("G")
+	for machine.PC() != uint32(g.Address)+5 {
+		if _, err := machine.Step(); err != nil {
+			t.Fatalf("Step error: %v", err)
+		}
+	}
+	edited := strings.Replace(source, "@f base loadi ;", "@f base loadi 10 * ;", 1)
+	at := int32(len(machine.Memory()))
+	redef, err := CompileRedefinition(edited, "f", img, at, CompileOptions{})
+	if err != nil {
+		t.Fatalf("CompileRedefinition error: %v", err)
+	}
+	if f, _ := img.Lookup("F"); redef.Name != "F" || redef.Old != f.Address {
+		t.Errorf("Expected F at 0x%X, got %s at 0x%X", f.Address, redef.Name, redef.Old)
+	}
+	patched, err := machine.Redefine(uint32(redef.Old), uint32(redef.Address), redef.Code, img.RelocAddresses())
+	if err != nil {
+		t.Fatalf("Redefine error: %v", err)
+	}
+	if patched != 2 {
+		t.Errorf("Expected both calls of F patched, got %d", patched)
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	if out := output.Stdout(); out != "55" {
+		t.Errorf("Expected the old F's 5 plus the new F's 50, got %q", out)
+	}
+
+	if _, err := CompileRedefinition(source, "h", img, at, CompileOptions{}); err == nil || !strings.Contains(err.Error(), "no definition of h") {
+		t.Errorf("Expected an error for a word the source lacks, got %v", err)
+	}
+	img.Symbols = nil
+	if _, err := CompileRedefinition(source, "f", img, at, CompileOptions{}); err == nil || !strings.Contains(err.Error(), "luxc -g") {
+		t.Errorf("Expected an error without symbols, got %v", err)
+	}
+}
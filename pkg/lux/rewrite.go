@@ -0,0 +1,215 @@
+package lux
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Rule is a peephole rewrite applied to the tokens before they are
+// compiled: a run of tokens matching Pattern is replaced by Replace. In
+// both, $a and $b stand for number literals and everything else is a word.
+// When, if set, must also accept the numbers. Fold, if set, replaces the
+// run with the single number it returns instead of Replace. Rewritten
+// tokens are matched again, so constants fold through a chain.
+//
+// Rules only see words and numbers, never brackets, so a run cannot cross
+// a quotation or definition boundary, and none applies to a word the
+// program defines for itself.
+type Rule struct {
+	Name    string
+	Pattern string
+	Replace string
+	When    func(a, b int32) bool
+	Fold    func(a, b int32) int32
+}
+
+// Rules are the rewrites the compiler makes unless CompileOptions turns
+// them off. Each saves code or time and keeps the program's meaning,
+// including 32-bit wraparound.
+var Rules = []Rule{
+	{Name: "swap-swap", Pattern: "SWAP SWAP"},
+	{Name: "dup-drop", Pattern: "DUP DROP"},
+	{Name: "push-drop", Pattern: "$a DROP"},
+	{Name: "swap-literals", Pattern: "$a $b SWAP", Replace: "$b $a"},
+	{Name: "swap-gt", Pattern: "SWAP >", Replace: "<"},
+	{Name: "swap-lt", Pattern: "SWAP <", Replace: ">"},
+	{Name: "add-zero", Pattern: "0 +"},
+	{Name: "sub-zero", Pattern: "0 -"},
+	{Name: "mul-one", Pattern: "1 *"},
+	{Name: "div-one", Pattern: "1 /"},
+	{Name: "or-zero", Pattern: "0 OR"},
+	{Name: "xor-zero", Pattern: "0 XOR"},
+	{Name: "add-one", Pattern: "1 +", Replace: "INC"},
+	{Name: "sub-one", Pattern: "1 -", Replace: "DEC"},
+	{Name: "fold-add", Pattern: "$a $b +", Fold: func(a, b int32) int32 { return a + b }},
+	{Name: "fold-sub", Pattern: "$a $b -", Fold: func(a, b int32) int32 { return a - b }},
+	{Name: "fold-mul", Pattern: "$a $b *", Fold: func(a, b int32) int32 { return a * b }},
+	{Name: "fold-div", Pattern: "$a $b /", When: safeDivision, Fold: func(a, b int32) int32 { return a / b }},
+	{Name: "fold-mod", Pattern: "$a $b MOD", When: safeDivision, Fold: func(a, b int32) int32 { return a % b }},
+	{Name: "fold-and", Pattern: "$a $b AND", Fold: func(a, b int32) int32 { return a & b }},
+	{Name: "fold-or", Pattern: "$a $b OR", Fold: func(a, b int32) int32 { return a | b }},
+	{Name: "fold-xor", Pattern: "$a $b XOR", Fold: func(a, b int32) int32 { return a ^ b }},
+}
+
+// safeDivision leaves division by zero, and the one quotient that
+// overflows, for the VM to report when the program runs
+func safeDivision(a, b int32) bool {
+	return b != 0 && (a != math.MinInt32 || b != -1)
+}
+
+// RuleNames lists the names of Rules, in order
+func RuleNames() []string {
+	names := make([]string, len(Rules))
+	for i, r := range Rules {
+		names[i] = r.Name
+	}
+	return names
+}
+
+// rewriter applies the enabled rules to a token stream
+type rewriter struct {
+	rules []Rule
+	out   []Token
+	fixed int // Rules may not rewrite out[:fixed]
+}
+
+// rewrite applies the rules not named in disabled ("all" disables every
+// one) to tokens, whose user program starts at start after any library
+// code, and returns the new tokens and start. A rule may not span the two.
+func rewrite(tokens []Token, start int, disabled []string) ([]Token, int, error) {
+	off := make(map[string]bool, len(disabled))
+	for _, name := range disabled {
+		off[strings.ToLower(name)] = true
+	}
+	for name := range off {
+		if name != "all" && !slices.Contains(RuleNames(), name) {
+			return nil, 0, fmt.Errorf("unknown rewrite rule %q", name)
+		}
+	}
+	defined := make(map[string]bool)
+	for i, tok := range tokens[:len(tokens)-1] {
+		if tok.Type == TokenAtSign {
+			defined[strings.ToUpper(tokens[i+1].Value)] = true
+		}
+	}
+	r := &rewriter{out: make([]Token, 0, len(tokens))}
+rules:
+	for _, rule := range Rules {
+		if off["all"] || off[rule.Name] {
+			continue
+		}
+		for _, field := range strings.Fields(rule.Pattern + " " + rule.Replace) {
+			if defined[field] {
+				continue rules
+			}
+		}
+		r.rules = append(r.rules, rule)
+	}
+	newStart := start
+	for i := 0; i < len(tokens); i++ {
+		if i == start {
+			newStart, r.fixed = len(r.out), len(r.out)
+		}
+		tok := tokens[i]
+		r.out = append(r.out, tok)
+		switch {
+		case tok.Type == TokenAtSign && i+1 < len(tokens):
+			// The name being defined is not a use of the word
+			r.out = append(r.out, tokens[i+1])
+			i++
+			r.fixed = len(r.out)
+		case tok.Type == TokenWord && strings.EqualFold(tok.Value, "DATA"):
+			i = r.copyData(tokens, i)
+		case tok.Type == TokenNumber || tok.Type == TokenWord:
+			if err := r.match(); err != nil {
+				return nil, 0, err
+			}
+		default:
+			r.fixed = len(r.out)
+		}
+	}
+	return r.out, newStart, nil
+}
+
+// copyData copies the DATA table whose directive is tokens[i] untouched
+// and returns the index of its last token
+func (r *rewriter) copyData(tokens []Token, i int) int {
+	end := i + 1 // The table's name
+	for end+2 < len(tokens) && (tokens[end+2].Value == "," || strings.EqualFold(tokens[end+2].Value, "C,")) {
+		end += 2
+	}
+	r.out = append(r.out, tokens[i+1:end+1]...)
+	r.fixed = len(r.out)
+	return end
+}
+
+// match rewrites the end of the output while a rule matches it
+func (r *rewriter) match() error {
+	for again := true; again; {
+		again = false
+		for _, rule := range r.rules {
+			pattern := strings.Fields(rule.Pattern)
+			at := len(r.out) - len(pattern)
+			if at < r.fixed {
+				continue
+			}
+			nums, ok, err := bind(pattern, r.out[at:])
+			if err != nil {
+				return err
+			}
+			if !ok || (rule.When != nil && !rule.When(nums["$a"], nums["$b"])) {
+				continue
+			}
+			first := r.out[at]
+			r.out = r.out[:at]
+			if rule.Fold != nil {
+				v := rule.Fold(nums["$a"], nums["$b"])
+				r.out = append(r.out, Token{Type: TokenNumber, Value: strconv.Itoa(int(v)), Line: first.Line, Column: first.Column})
+			} else {
+				for _, field := range strings.Fields(rule.Replace) {
+					tok := Token{Type: TokenWord, Value: field, Line: first.Line, Column: first.Column}
+					if v, ok := nums[field]; ok {
+						tok.Type, tok.Value = TokenNumber, strconv.Itoa(int(v))
+					}
+					r.out = append(r.out, tok)
+				}
+			}
+			again = len(r.out) > r.fixed
+			break
+		}
+	}
+	return nil
+}
+
+// bind matches pattern against tokens and returns the numbers the $
+// placeholders stand for
+func bind(pattern []string, tokens []Token) (map[string]int32, bool, error) {
+	nums := make(map[string]int32, 2)
+	for i, p := range pattern {
+		tok := tokens[i]
+		if strings.HasPrefix(p, "$") || tok.Type == TokenNumber {
+			if tok.Type != TokenNumber {
+				return nil, false, nil
+			}
+			v, err := ParseNumber(tok)
+			if err != nil {
+				return nil, false, err
+			}
+			if strings.HasPrefix(p, "$") {
+				nums[p] = v
+				continue
+			}
+			if want, err := strconv.ParseInt(p, 10, 32); err != nil || int32(want) != v {
+				return nil, false, nil
+			}
+			continue
+		}
+		if tok.Type != TokenWord || !strings.EqualFold(tok.Value, p) {
+			return nil, false, nil
+		}
+	}
+	return nums, true, nil
+}
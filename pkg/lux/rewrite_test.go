@@ -0,0 +1,88 @@
+package lux
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRulesKeepMeaning(t *testing.T) {
+	for _, source := range []string{
+		"1 2 swap swap - .",
+		"7 dup drop 3 drop .",
+		"1 2 swap - .",
+		"3 4 swap > . 3 4 swap < .",
+		"9 0 + 0 - 1 * 1 / 0 or 0 xor .",
+		"5 1 + . 5 1 - .",
+		"2 3 + 4 * 10 - 3 / 4 mod 12 and 1 or 6 xor .",
+		"2147483647 1 + .",
+		"[ 2 3 + ] call .",
+	} {
+		optimized, err := CompileProgram(source, CompileOptions{})
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", source, err)
+		}
+		plain, err := CompileProgram(source, CompileOptions{DisabledRules: []string{"all"}})
+		if err != nil {
+			t.Fatalf("%q: compile error without rules: %v", source, err)
+		}
+		wantOut, wantStack := runOutput(t, plain.Code)
+		gotOut, gotStack := runOutput(t, optimized.Code)
+		if gotOut != wantOut || !reflect.DeepEqual(gotStack, wantStack) {
+			t.Errorf("%q: got %q %v, want %q %v", source, gotOut, gotStack, wantOut, wantStack)
+		}
+		if len(optimized.Code) >= len(plain.Code) {
+			t.Errorf("%q: expected the rules to shrink %d bytes, got %d", source, len(plain.Code), len(optimized.Code))
+		}
+	}
+}
+
+func TestRewriteTokens(t *testing.T) {
+	tests := []struct {
+		source, want string
+		disabled     []string
+	}{
+		{"1 2 + 3 *", "9", nil},
+		{"x 0 + y", "X Y", nil},
+		{"1 0 / 5 0 mod", "1 0 / 5 0 MOD", nil},
+		{"-2147483648 -1 /", "-2147483648 -1 /", nil},
+		{"swap swap", "", nil},
+		{"swap swap 1 2 +", "SWAP SWAP 3", []string{"swap-swap"}},
+		{"1 2 +", "1 2 +", []string{"all"}},
+		// A word the program defines is left alone
+		{"@swap drop ; 1 2 swap swap", "@ SWAP DROP ; 1 2 SWAP SWAP", nil},
+		// As are DATA tables and the name being defined
+		{"DATA t 1 , 2 , 3 +", "DATA T 1 , 2 , 3 +", nil},
+		{"@dup-drop 1 ; 2 drop", "@ DUP-DROP 1 ;", nil},
+		// Runs do not cross quotations
+		{"1 [ 2 + ] 0 [ drop ]", "1 [ 2 + ] 0 [ DROP ]", nil},
+	}
+	for _, tt := range tests {
+		tokens, err := NewLexer(tt.source).Tokenize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens, _, err = rewrite(tokens, 0, tt.disabled)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.source, err)
+		}
+		var got []string
+		for _, tok := range tokens {
+			if tok.Type == TokenAtSign {
+				got = append(got, "@")
+			} else if tok.Type != TokenEOF {
+				got = append(got, strings.ToUpper(tok.Value))
+			}
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.source, strings.Join(got, " "), tt.want)
+		}
+	}
+}
+
+func TestUnknownRule(t *testing.T) {
+	_, err := CompileProgram("1", CompileOptions{DisabledRules: []string{"no-such-rule"}})
+	if err == nil || !strings.Contains(err.Error(), "no-such-rule") {
+		t.Errorf("Expected an unknown rule error, got %v", err)
+	}
+}
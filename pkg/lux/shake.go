@@ -0,0 +1,84 @@
+package lux
+
+import "strings"
+
+// Tree shaking leaves out the words a program can never run, such as most
+// of a large library module it imports. A word is kept when the toplevel
+// code or the entry word names it, or a kept word does. Names are compared
+// without their module, so a word is only dropped when nothing kept could
+// possibly mean it. The program is compiled whole first, so an error in a
+// dropped word is still reported.
+
+// wordRange is where a word definition is in the tokens
+type wordRange struct {
+	name       string // As written after the @, upper case
+	start, end int    // Token range, from the @ to past the ;
+}
+
+// shortName is a word's name without any module qualifier
+func shortName(name string) string {
+	name = strings.ToUpper(name)
+	if i := strings.LastIndex(name, "::"); i >= 0 {
+		return name[i+2:]
+	}
+	return name
+}
+
+// dropUnused removes from tokens the definitions of words unreachable from
+// the toplevel code and entry, and returns the new tokens, where start
+// (the user program's start, after any library code) now falls and the
+// names of the dropped words, in order
+func dropUnused(tokens []Token, start int, entry string) ([]Token, int, []string) {
+	scan := &Compiler{tokens: tokens}
+	var defs []wordRange
+	used := map[string]bool{shortName(entry): true}
+	var pending []string
+	mention := func(ts []Token) {
+		for _, tok := range ts {
+			if name := shortName(tok.Value); tok.Type == TokenWord && !used[name] {
+				used[name] = true
+				pending = append(pending, name)
+			}
+		}
+	}
+	pending = append(pending, shortName(entry))
+	for scan.pos < len(tokens) {
+		from := scan.pos
+		switch token := scan.peek(); {
+		case token.Type == TokenAtSign && from+1 < len(tokens):
+			scan.skipWordDefinition()
+			defs = append(defs, wordRange{name: shortName(tokens[from+1].Value), start: from, end: scan.pos})
+		case isData(token):
+			scan.skipData()
+		default:
+			scan.advance()
+			mention(tokens[from:scan.pos])
+		}
+	}
+	byName := make(map[string][]wordRange)
+	for _, d := range defs {
+		byName[d.name] = append(byName[d.name], d)
+	}
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, d := range byName[name] {
+			mention(tokens[d.start+2 : d.end])
+		}
+	}
+	kept := make([]Token, 0, len(tokens))
+	var dropped []string
+	newStart, next := start, 0
+	for _, d := range defs {
+		if used[d.name] {
+			continue
+		}
+		kept = append(kept, tokens[next:d.start]...)
+		if d.start < start {
+			newStart -= d.end - d.start
+		}
+		dropped = append(dropped, strings.ToUpper(tokens[d.start+1].Value))
+		next = d.end
+	}
+	return append(kept, tokens[next:]...), newStart, dropped
+}
@@ -0,0 +1,79 @@
+package lux
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDropUnused(t *testing.T) {
+	lib, err := BuildLibrary([]LibrarySource{
+		{Path: "math.lux", Source: "MODULE MATH @square dup * ; @cube dup square * ; @half 2 / ; @twice [ 2 * ] call ;"},
+	}, CompileOptions{})
+	if err != nil {
+		t.Fatalf("BuildLibrary error: %v", err)
+	}
+	source := "IMPORT MATH\n@unused 1 2 + ;\n@also-unused unused ;\n@shout \"hi\" ;\n@main 3 math::cube . shout ;"
+	full, err := CompileProgram(source, CompileOptions{Libraries: []*Library{lib}})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	shaken, err := CompileProgram(source, CompileOptions{Libraries: []*Library{lib}, DropUnused: true})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	if want := []string{"HALF", "TWICE", "UNUSED", "ALSO-UNUSED"}; !reflect.DeepEqual(shaken.Dropped, want) {
+		t.Errorf("Expected %v dropped, got %v", want, shaken.Dropped)
+	}
+	var names []string
+	for _, sym := range shaken.Symbols {
+		names = append(names, sym.Name)
+	}
+	if got := strings.Join(names, " "); got != "MATH::SQUARE MATH::CUBE SHOUT MAIN" {
+		t.Errorf("Expected the reachable words to be kept, got %s", got)
+	}
+	if len(shaken.Code) >= len(full.Code) {
+		t.Errorf("Expected fewer than %d bytes, got %d", len(full.Code), len(shaken.Code))
+	}
+	want, _ := runOutput(t, full.Code)
+	if got, _ := runOutput(t, shaken.Code); got != want {
+		t.Errorf("Printed %q, expected %q", got, want)
+	}
+	if got := runRebased(t, shaken, 0x200); got != want {
+		t.Errorf("Rebased program printed %q, expected %q", got, want)
+	}
+}
+
+func TestDropUnusedRoots(t *testing.T) {
+	tests := []struct {
+		source  string
+		opts    CompileOptions
+		dropped []string
+	}{
+		// The toplevel code, the entry word and what they name are kept
+		{"@a 1 ; @b 2 ; a", CompileOptions{}, []string{"B"}},
+		{"@a 1 ; @b 2 ; @c b ;", CompileOptions{Entry: "c"}, []string{"A"}},
+		{"@a 1 ; @main a ;", CompileOptions{NoEntry: true}, []string{"A", "MAIN"}},
+		// Words named in quotations and recursive words
+		{"@a 1 ; @b [ a ] call ; @r r ; b", CompileOptions{}, []string{"R"}},
+		// Nothing to drop
+		{"@a 1 ; a", CompileOptions{}, nil},
+	}
+	for _, tt := range tests {
+		tt.opts.DropUnused = true
+		prog, err := CompileProgram(tt.source, tt.opts)
+		if err != nil {
+			t.Fatalf("%q: compile error: %v", tt.source, err)
+		}
+		if !reflect.DeepEqual(prog.Dropped, tt.dropped) {
+			t.Errorf("%q: expected %v dropped, got %v", tt.source, tt.dropped, prog.Dropped)
+		}
+	}
+}
+
+func TestDropUnusedReportsErrors(t *testing.T) {
+	_, err := CompileProgram("@unused nosuchword ; 1 .", CompileOptions{DropUnused: true})
+	if err == nil || !strings.Contains(err.Error(), "nosuchword") {
+		t.Errorf("Expected the error in the unused word, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package lux
+
+// Position is a place in the source: a byte offset and the line and
+// column, both counted from 1, it falls on
+type Position struct {
+	Offset, Line, Column int
+}
+
+// Span is the source a token was read from, [Start, End)
+type Span struct {
+	Start, End Position
+}
+
+// Attachment says which token a comment documents, so a formatter can
+// keep it in place and a doc generator can find a word's description
+type Attachment int
+
+const (
+	AttachNone     Attachment = iota // Not a comment, or one set apart by a blank line or the end of the source
+	AttachNext                       // A comment ending on the line before the next token, or before another such comment
+	AttachPrevious                   // A comment starting on the line the previous token ends on, as in @sq ( n -- n*n )
+)
+
+// Lexeme is a token as a tool working on the source sees it: where it is,
+// the text it was read from and, for a comment, what it belongs to
+type Lexeme struct {
+	Token
+	Span   Span
+	Text   string // As written: a string with its quotes and escapes, a comment with its ( ) or //
+	Attach Attachment
+}
+
+// TokenStream reads the tokens of a source one at a time, comments
+// included, with the same rules the compiler's lexer uses
+type TokenStream struct {
+	lexer   *Lexer
+	pending []Lexeme // Read ahead to find what comments attach to
+	prev    Lexeme   // Last token returned that is not a comment
+	started bool
+	err     error
+}
+
+// NewTokenStream returns a stream over source
+func NewTokenStream(source string) *TokenStream {
+	return &TokenStream{lexer: NewLexer(source)}
+}
+
+// Next returns the next token. After the last one it returns a TokenEOF
+// lexeme at every call; after an error, the same error.
+func (s *TokenStream) Next() (Lexeme, error) {
+	if len(s.pending) == 0 {
+		if s.err != nil {
+			return Lexeme{}, s.err
+		}
+		lx, err := s.lex()
+		if err != nil {
+			s.err = err
+			return Lexeme{}, err
+		}
+		s.pending = append(s.pending, lx)
+		if lx.Type == TokenComment {
+			s.attach(lx)
+		}
+	}
+	lx := s.pending[0]
+	s.pending = s.pending[1:]
+	if lx.Type != TokenComment {
+		s.prev, s.started = lx, true
+	}
+	return lx, nil
+}
+
+// attach decides what the comment lx, just read, documents. A comment
+// after a token on the same line belongs to that token; otherwise the
+// stream reads on to the next token to see whether the comment, and those
+// after it, lead up to it.
+func (s *TokenStream) attach(lx Lexeme) {
+	if s.started && lx.Span.Start.Line == s.prev.Span.End.Line {
+		s.pending[0].Attach = AttachPrevious
+		return
+	}
+	for s.pending[len(s.pending)-1].Type == TokenComment {
+		next, err := s.lex()
+		if err != nil {
+			// Reported when the comments before it have been returned
+			s.err = err
+			return
+		}
+		s.pending = append(s.pending, next)
+	}
+	// Walk back from the token, through the comments just before it
+	next := s.pending[len(s.pending)-1]
+	if next.Type == TokenEOF {
+		return
+	}
+	for i := len(s.pending) - 2; i >= 0; i-- {
+		c := &s.pending[i]
+		if next.Span.Start.Line-c.Span.End.Line > 1 {
+			break
+		}
+		c.Attach, next = AttachNext, *c
+	}
+}
+
+// lex reads one token and records where it came from
+func (s *TokenStream) lex() (Lexeme, error) {
+	l := s.lexer
+	if !l.quoted {
+		l.skipWhitespace()
+	}
+	start := Position{Offset: l.pos, Line: l.line, Column: l.column}
+	token, err := l.NextToken()
+	if err != nil {
+		return Lexeme{}, err
+	}
+	end := Position{Offset: l.pos, Line: l.line, Column: l.column}
+	return Lexeme{Token: token, Span: Span{Start: start, End: end}, Text: l.input[start.Offset:end.Offset]}, nil
+}
@@ -0,0 +1,58 @@
+package lux
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTokenStream(t *testing.T) {
+	source := "( Squares )\n// a number\n@sq ( n -- n*n ) dup * ;\n\n( unused )\n\n\"hi\\n\" 0x10 ( the end )"
+	stream := NewTokenStream(source)
+	var got []string
+	for {
+		lx, err := stream.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if lx.Type == TokenEOF {
+			break
+		}
+		if source[lx.Span.Start.Offset:lx.Span.End.Offset] != lx.Text {
+			t.Errorf("%q: span %v does not cover its text", lx.Text, lx.Span)
+		}
+		got = append(got, fmt.Sprintf("%d:%d-%d:%d %s %d", lx.Span.Start.Line, lx.Span.Start.Column, lx.Span.End.Line, lx.Span.End.Column, lx.Text, lx.Attach))
+	}
+	want := []string{
+		"1:1-1:12 ( Squares ) 1", // Leads, with the next comment, up to @
+		"2:1-2:12 // a number 1",
+		"3:1-3:2 @ 0",
+		"3:2-3:4 sq 0",
+		"3:5-3:17 ( n -- n*n ) 2", // Belongs to SQ
+		"3:18-3:21 dup 0",
+		"3:22-3:23 * 0",
+		"3:24-3:25 ; 0",
+		"5:1-5:11 ( unused ) 0", // Blank lines on both sides
+		"7:1-7:7 \"hi\\n\" 0",
+		"7:8-7:12 0x10 0",
+		"7:13-7:24 ( the end ) 2",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// The end and errors repeat
+	if lx, err := stream.Next(); err != nil || lx.Type != TokenEOF {
+		t.Errorf("Expected EOF again, got %v, %v", lx, err)
+	}
+	bad := NewTokenStream("1 ( leads\n) 5-3")
+	for _, want := range []string{"1", "( leads\n)"} {
+		if lx, err := bad.Next(); err != nil || lx.Text != want {
+			t.Errorf("Expected %q before the error, got %q, %v", want, lx.Text, err)
+		}
+	}
+	for range 2 {
+		if _, err := bad.Next(); err == nil || !strings.Contains(err.Error(), "malformed number") {
+			t.Errorf("Expected the lexer's error, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package lux
+
+import "strings"
+
+// Whole-program mode inlines small words across module boundaries once the
+// library modules are linked in, before the peephole rules run. A word
+// whose body, after inlining what it calls, is at most inlineTokens numbers
+// and built-in words is pasted at every call that follows it, so a
+// module-level constant such as @WIDTH 320 ; becomes a literal the rules
+// fold into the arithmetic around it. Built-ins that work on the return
+// stack, exit or report their line keep the word a call, as does any name
+// the program defines for itself.
+
+// inlineTokens bounds the body of a word whole-program mode inlines
+const inlineTokens = 12
+
+// leafWords are the built-ins an inlined body may use: each compiles to
+// the same code wherever it is written
+var leafWords = func() map[string]bool {
+	leaf := map[string]bool{">": true, "NEGATE": true}
+	for name := range builtins {
+		leaf[name] = true
+	}
+	for name := range outputWords {
+		leaf[name] = true
+	}
+	for name := range fieldWords {
+		leaf[name] = true
+	}
+	for _, name := range []string{"EXIT", ">R", "R>", "ASSERT", "RDEPTH", "PC@"} {
+		delete(leaf, name)
+	}
+	return leaf
+}()
+
+// inlineWords pastes the body of each small word over the calls to it in
+// tokens, whose user program starts at start after any library modules,
+// and returns the new tokens, where start now falls and how many calls it
+// replaced
+func inlineWords(tokens []Token, start int) ([]Token, int, int) {
+	defined := make(map[string]bool)
+	for i, tok := range tokens[:len(tokens)-1] {
+		if tok.Type == TokenAtSign || isData(tok) {
+			defined[shortName(tokens[i+1].Value)] = true
+		}
+	}
+	scan := &Compiler{tokens: tokens, dictionary: make(map[string]Word), imports: make(map[string]string)}
+	var bodies [][]Token // Body of each inlinable word, by its Word.Address
+	out := make([]Token, 0, len(tokens))
+	newStart, inlined := start, 0
+	// expand appends tok, or the body of the word it calls
+	expand := func(tok Token) {
+		name := strings.ToUpper(tok.Value)
+		if _, output := outputWords[name]; tok.Type == TokenWord && !output && !isMessageWord(tok) {
+			if word, ok := scan.lookupWord(name); ok && !word.Data && word.Address >= 0 {
+				for _, b := range bodies[word.Address] {
+					b.Line, b.Column = tok.Line, tok.Column
+					out = append(out, b)
+				}
+				inlined++
+				return
+			}
+		}
+		out = append(out, tok)
+	}
+	for scan.pos < len(tokens) {
+		if scan.pos == start {
+			newStart = len(out)
+			scan.currentModule = "" // As in compile
+		}
+		from := scan.pos
+		token := scan.peek()
+		switch {
+		case token.Type == TokenWord && strings.EqualFold(token.Value, "MODULE"):
+			if scan.handleModuleDirective() != nil {
+				scan.pos = from + 1
+			}
+			out = append(out, tokens[from:scan.pos]...)
+		case token.Type == TokenWord && strings.EqualFold(token.Value, "IMPORT"):
+			if scan.handleImportDirective() != nil {
+				scan.pos = from + 1
+			}
+			out = append(out, tokens[from:scan.pos]...)
+		case isData(token):
+			scan.skipData()
+			scan.dictionary[qualifiedName(scan.currentModule, tokens[from+1].Value)] = Word{Data: true}
+			out = append(out, tokens[from:scan.pos]...)
+		case token.Type == TokenAtSign && from+1 < len(tokens):
+			scan.skipWordDefinition()
+			end := scan.pos
+			if tokens[end-1].Type == TokenSemicolon {
+				end--
+			}
+			out = append(out, tokens[from], tokens[from+1])
+			bodyStart := len(out)
+			for _, tok := range tokens[from+2 : end] {
+				expand(tok)
+			}
+			body := out[bodyStart:]
+			word := Word{Name: qualifiedName(scan.currentModule, tokens[from+1].Value), Address: -1}
+			if leafBody(body, defined) {
+				word.Address = int32(len(bodies))
+				bodies = append(bodies, append([]Token(nil), body...))
+			}
+			scan.dictionary[word.Name] = word
+			out = append(out, tokens[end:scan.pos]...)
+		default:
+			scan.advance()
+			expand(token)
+		}
+	}
+	return out, newStart, inlined
+}
+
+// leafBody reports whether a word with body can be inlined
+func leafBody(body []Token, defined map[string]bool) bool {
+	if len(body) > inlineTokens {
+		return false
+	}
+	for _, tok := range body {
+		switch tok.Type {
+		case TokenNumber:
+		case TokenWord:
+			name := strings.ToUpper(tok.Value)
+			if !leafWords[name] || defined[name] {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
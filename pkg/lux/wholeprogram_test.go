@@ -0,0 +1,74 @@
+package lux
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWholeProgram(t *testing.T) {
+	lib, err := BuildLibrary([]LibrarySource{
+		{Path: "gfx.lux", Source: "MODULE GFX @width 320 ; @height 200 ; @area width height * ; @rec dup [ dec rec ] ? ;"},
+	}, CompileOptions{})
+	if err != nil {
+		t.Fatalf("BuildLibrary error: %v", err)
+	}
+	source := "IMPORT GFX AS G\n@sq dup * ;\nG::area . 5 sq . 1 [ G::width . ] ? 3 G::rec ."
+	plain, err := CompileProgram(source, CompileOptions{Libraries: []*Library{lib}})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	whole, err := CompileProgram(source, CompileOptions{Libraries: []*Library{lib}, WholeProgram: true})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	// width and height into area, then area, sq and width
+	if whole.Inlined != 5 {
+		t.Errorf("Expected 5 calls inlined, got %d", whole.Inlined)
+	}
+	want, _ := runOutput(t, plain.Code)
+	if got, _ := runOutput(t, whole.Code); got != want {
+		t.Errorf("Printed %q, expected %q", got, want)
+	}
+	var listing bytes.Buffer
+	whole.WriteAsm(&listing)
+	if !strings.Contains(listing.String(), "PUSH 64000") {
+		t.Errorf("Expected width height * to fold to 64000:\n%s", listing.String())
+	}
+}
+
+func TestInlineWords(t *testing.T) {
+	tests := []struct {
+		source, want string
+		inlined      int
+	}{
+		{"@k 3 ; k k +", "@ K 3 ; 3 3 +", 2},
+		// Only calls after the definition
+		{"k @k 3 ; k", "K @ K 3 ; 3", 1},
+		// Words that recurse, work on the return stack, exit, call a
+		// combinator or are too long stay calls
+		{"@r dup [ r ] ? ; r", "@ R DUP [ R ] ? ; R", 0},
+		{"@rd r> drop ; rd", "@ RD R> DROP ; RD", 0},
+		{"@e 1 exit ; e", "@ E 1 EXIT ; E", 0},
+		{"@c [ 1 ] call ; c", "@ C [ 1 ] CALL ; C", 0},
+		{"@big 1 2 3 4 5 6 7 8 9 10 11 12 13 ; big", "@ BIG 1 2 3 4 5 6 7 8 9 10 11 12 13 ; BIG", 0},
+		// A built-in the program redefines is not one
+		{"@dup 1 ; @two dup dup ; two", "@ DUP 1 ; @ TWO 1 1 ; 1 1", 3},
+		// Module-qualified calls, and names seen from inside the module
+		{"MODULE M @k 3 ; @j k 1 + ; MODULE N IMPORT M AS A A::j", "MODULE M @ K 3 ; @ J 3 1 + ; MODULE N IMPORT M AS A 3 1 +", 2},
+	}
+	for _, tt := range tests {
+		tokens, err := NewLexer(tt.source).Tokenize()
+		if err != nil {
+			t.Fatalf("%q: %v", tt.source, err)
+		}
+		got, _, inlined := inlineWords(tokens, 0)
+		var words []string
+		for _, tok := range got[:len(got)-1] {
+			words = append(words, strings.ToUpper(tok.Value))
+		}
+		if strings.Join(words, " ") != tt.want || inlined != tt.inlined {
+			t.Errorf("%q: got %q with %d inlined, want %q with %d", tt.source, strings.Join(words, " "), inlined, tt.want, tt.inlined)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package luxgen
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// ExploreOptions bound the search Explore makes. Zero fields take the
+// defaults.
+type ExploreOptions struct {
+	Seed     int64
+	Runs     int   // Input stacks to try (default 2000)
+	MaxSteps int64 // Instructions each run may take (default 100000)
+}
+
+func (o ExploreOptions) withDefaults() ExploreOptions {
+	if o.Runs == 0 {
+		o.Runs = 2000
+	}
+	if o.MaxSteps == 0 {
+		o.MaxSteps = 100_000
+	}
+	return o
+}
+
+// Branch is one way a conditional jump in a word can go: for JZ, Way 0
+// falls through and Way 1 jumps; for JMPTABLE, Way 0 is the default and
+// Way i+1 is entry i
+type Branch struct {
+	PC  uint32
+	Way int
+}
+
+func (b Branch) String() string {
+	return fmt.Sprintf("0x%04X/%d", b.PC, b.Way)
+}
+
+// Case is an input stack Explore found and what the word did with it
+type Case struct {
+	Inputs  []int32  // Deepest first
+	Outputs []int32  // The stack the word left, deepest first
+	Printed string   // What it printed
+	Err     string   // Why it failed, "" if it returned
+	New     []Branch // The branches it was the first to take
+}
+
+// Exploration is what Explore learned about a word
+type Exploration struct {
+	Word     string
+	Effect   lux.StackEffect
+	Branches []Branch // Every way the word's own jumps can go, in address order
+	Covered  int      // How many of them the cases take
+	Runs     int      // Input stacks tried
+	Cases    []Case   // Each input stack that took a branch no earlier one did, in the order found
+}
+
+// interesting are the values edge cases hide behind
+var interesting = []int32{0, 1, -1, 2, -2, 7, 10, -10, 100, 255, 256, 1000, -1000, math.MaxInt32, math.MinInt32, math.MaxInt32 - 1, math.MinInt32 + 1}
+
+// Explore runs word, from the compiled prog, on input stacks of the size
+// its effect declares, searching for ones that take every way its JZ and
+// JMPTABLE instructions can go. It starts from the values edge cases hide
+// behind, 0, ±1, the extremes, and then tries random stacks and mutations
+// of the ones that reached something new, keeping each stack that takes a
+// branch no earlier one did. The same seed gives the same cases.
+func Explore(prog *lux.Program, word string, effect lux.StackEffect, opts ExploreOptions) (*Exploration, error) {
+	opts = opts.withDefaults()
+	region, ok := wordRegion(prog, strings.ToUpper(word))
+	if !ok {
+		return nil, fmt.Errorf("the program has no word named %s", word)
+	}
+	base, err := vm.NewVMForImage(prog.Image())
+	if err != nil {
+		return nil, err
+	}
+	code := withQuotations(prog, region)
+	ex := &Exploration{Word: region.Name, Effect: effect}
+	for _, r := range code {
+		ex.Branches = append(ex.Branches, branches(prog, r)...)
+	}
+	slices.SortFunc(ex.Branches, func(a, b Branch) int { return int(a.PC) - int(b.PC) })
+
+	covered := make(map[Branch]bool)
+	try := func(inputs []int32) bool {
+		c := runCase(base, code, inputs, opts.MaxSteps, covered)
+		ex.Runs++
+		if len(c.New) == 0 && len(ex.Cases) > 0 {
+			return false
+		}
+		ex.Cases = append(ex.Cases, c)
+		return true
+	}
+	done := func() bool {
+		return ex.Runs >= opts.Runs || len(covered) == len(ex.Branches) && len(ex.Cases) > 0
+	}
+
+	n := len(effect.Inputs)
+	rng := rand.New(rand.NewSource(opts.Seed))
+	// Every input at each interesting value, the others at 0
+	try(make([]int32, n))
+	for i := 0; i < n && !done(); i++ {
+		for _, v := range interesting[1:] {
+			if done() {
+				break
+			}
+			inputs := make([]int32, n)
+			inputs[i] = v
+			try(inputs)
+		}
+	}
+	for !done() {
+		var inputs []int32
+		if rng.Intn(2) == 0 {
+			inputs = make([]int32, n)
+			for i := range inputs {
+				inputs[i] = randomValue(rng)
+			}
+		} else {
+			inputs = mutate(rng, ex.Cases[rng.Intn(len(ex.Cases))].Inputs)
+		}
+		try(inputs)
+	}
+	ex.Covered = len(covered)
+	return ex, nil
+}
+
+// wordRegion finds the word named name in prog's layout
+func wordRegion(prog *lux.Program, name string) (lux.Region, bool) {
+	for _, r := range prog.Layout.Regions {
+		if r.Kind == lux.RegionWord && (r.Name == name || strings.HasSuffix(r.Name, "::"+name)) {
+			return r, true
+		}
+	}
+	return lux.Region{}, false
+}
+
+// withQuotations returns region and then the regions of the quotations its
+// code pushes, and the ones theirs push: the quotations
+// a word hands to ?: and the combinators are compiled outside it
+func withQuotations(prog *lux.Program, region lux.Region) []lux.Region {
+	quotations := make(map[int32]lux.Region)
+	for _, r := range prog.Layout.Regions {
+		if r.Kind == lux.RegionQuotation {
+			quotations[r.Start] = r
+		}
+	}
+	found := []lux.Region{region}
+	for i := 0; i < len(found); i++ {
+		r := found[i]
+		for _, off := range prog.Relocs {
+			at := prog.Layout.BaseAddr + int32(off)
+			if at < r.Start || at >= r.End {
+				continue
+			}
+			target := int32(binary.BigEndian.Uint32(prog.Code[off:]))
+			if q, ok := quotations[target]; ok && !slices.Contains(found, q) {
+				found = append(found, q)
+			}
+		}
+	}
+	return found
+}
+
+// branches lists the ways the JZ and JMPTABLE instructions in region can go
+func branches(prog *lux.Program, region lux.Region) []Branch {
+	var list []Branch
+	code := prog.Code
+	for at := int(region.Start - prog.Layout.BaseAddr); at < int(region.End-prog.Layout.BaseAddr); {
+		_, size := vm.FormatInstruction(code, at, nil)
+		if size == 0 {
+			break
+		}
+		pc := uint32(prog.Layout.BaseAddr) + uint32(at)
+		switch code[at] {
+		case vm.OpJz:
+			list = append(list, Branch{pc, 0}, Branch{pc, 1})
+		case vm.OpJmpTable:
+			for way := 0; way <= int(binary.BigEndian.Uint16(code[at+1:])); way++ {
+				list = append(list, Branch{pc, way})
+			}
+		}
+		at += size
+	}
+	return list
+}
+
+// errSteps stops a run that takes too long
+var errSteps = errors.New("too many instructions")
+
+// runCase calls the word whose code is the first of regions, with its
+// quotations, on a fork of base holding inputs, and records the branches
+// it takes in covered
+func runCase(base *vm.VM, regions []lux.Region, inputs []int32, maxSteps int64, covered map[Branch]bool) Case {
+	c := Case{Inputs: inputs}
+	machine := base.Fork()
+	output := machine.CaptureOutput()
+	for _, v := range inputs {
+		machine.Push(v)
+	}
+	steps := int64(0)
+	machine.Hook = func(m *vm.VM, ins vm.Instruction) error {
+		if steps++; steps > maxSteps {
+			return errSteps
+		}
+		if ins.Opcode != vm.OpJz && ins.Opcode != vm.OpJmpTable || !slices.ContainsFunc(regions, func(r lux.Region) bool {
+			return int32(ins.PC) >= r.Start && int32(ins.PC) < r.End
+		}) {
+			return nil
+		}
+		stack := m.Stack()
+		if len(stack) == 0 {
+			return nil
+		}
+		top := stack[len(stack)-1]
+		b := Branch{PC: ins.PC}
+		if ins.Opcode == vm.OpJz && top == 0 {
+			b.Way = 1
+		}
+		if ins.Opcode == vm.OpJmpTable {
+			count := int32(binary.BigEndian.Uint16(m.Memory()[ins.PC+1:]))
+			if top >= 0 && top < count {
+				b.Way = int(top) + 1
+			}
+		}
+		if !covered[b] {
+			covered[b] = true
+			c.New = append(c.New, b)
+		}
+		return nil
+	}
+	if err := machine.CallWord(uint32(regions[0].Start)); err != nil {
+		c.Err = err.Error()
+		if errors.Is(err, errSteps) {
+			c.Err = fmt.Sprintf("ran over %d instructions", maxSteps)
+		}
+	}
+	c.Outputs = machine.Stack()
+	c.Printed = output.Stdout()
+	return c
+}
+
+// randomValue picks an interesting value, a small one or any at all
+func randomValue(rng *rand.Rand) int32 {
+	switch rng.Intn(3) {
+	case 0:
+		return interesting[rng.Intn(len(interesting))]
+	case 1:
+		return int32(rng.Intn(201) - 100)
+	}
+	return int32(rng.Uint32())
+}
+
+// mutate returns a copy of inputs with one value nudged, negated, swapped
+// for another or with a bit flipped
+func mutate(rng *rand.Rand, inputs []int32) []int32 {
+	out := slices.Clone(inputs)
+	if len(out) == 0 {
+		return out
+	}
+	i := rng.Intn(len(out))
+	switch rng.Intn(5) {
+	case 0:
+		out[i] += int32(rng.Intn(5) - 2)
+	case 1:
+		out[i] = -out[i]
+	case 2:
+		out[i] = randomValue(rng)
+	case 3:
+		out[i] ^= 1 << rng.Intn(32)
+	case 4:
+		j := rng.Intn(len(out))
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// WriteTable writes the cases as a table, one row each, headed by the
+// inputs and outputs the effect names
+func (ex *Exploration) WriteTable(w io.Writer) error {
+	fmt.Fprintf(w, "%s %s: %d of %d branches taken in %d runs\n\n", ex.Word, ex.Effect, ex.Covered, len(ex.Branches), ex.Runs)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := slices.Clone(ex.Effect.Inputs)
+	header = append(header, "→", strings.Join(ex.Effect.Outputs, " "), "printed", "new branches")
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, c := range ex.Cases {
+		row := make([]string, 0, len(c.Inputs)+4)
+		for _, v := range c.Inputs {
+			row = append(row, fmt.Sprint(v))
+		}
+		result := vm.FormatValues(c.Outputs)
+		if c.Err != "" {
+			result = "error: " + c.Err
+		}
+		var taken []string
+		for _, b := range c.New {
+			taken = append(taken, b.String())
+		}
+		printed := ""
+		if c.Printed != "" {
+			printed = fmt.Sprintf("%q", c.Printed)
+		}
+		row = append(row, "→", result, printed, strings.Join(taken, " "))
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,82 @@
+package luxgen
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+)
+
+const exploreSource = `
+@sign ( n -- s ) dup 0 < [ drop -1 ] [ 0 > [ 1 ] [ 0 ] ?: ] ?: ;
+@kind ( n -- ) CASE 1 OF "one" ENDOF 2 OF "two" ENDOF "other" ENDCASE ;
+@safe-div ( a b -- q ) dup 0 = [ drop drop 0 ] [ / ] ?: ;
+`
+
+func explore(t *testing.T, word string, opts ExploreOptions) *Exploration {
+	t.Helper()
+	prog, err := lux.CompileProgram(exploreSource, lux.CompileOptions{})
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	effects, err := lux.StackEffects(exploreSource)
+	if err != nil {
+		t.Fatalf("StackEffects failed: %v", err)
+	}
+	ex, err := Explore(prog, word, effects[strings.ToUpper(word)], opts)
+	if err != nil {
+		t.Fatalf("Explore failed: %v", err)
+	}
+	return ex
+}
+
+func TestExploreCoversEveryBranch(t *testing.T) {
+	for _, word := range []string{"sign", "kind", "safe-div"} {
+		ex := explore(t, word, ExploreOptions{})
+		if len(ex.Branches) == 0 || ex.Covered != len(ex.Branches) {
+			t.Errorf("%s: took %d of %d branches", word, ex.Covered, len(ex.Branches))
+		}
+	}
+}
+
+func TestExploreCases(t *testing.T) {
+	ex := explore(t, "sign", ExploreOptions{})
+	results := make(map[int32]int32)
+	for _, c := range ex.Cases {
+		if len(c.Inputs) != 1 || len(c.Outputs) != 1 || c.Err != "" {
+			t.Fatalf("Expected one input and one output, got %+v", c)
+		}
+		results[c.Inputs[0]] = c.Outputs[0]
+	}
+	if want := map[int32]int32{0: 0, 1: 1, -1: -1}; !reflect.DeepEqual(results, want) {
+		t.Errorf("Expected the cases %v, got %v", want, results)
+	}
+
+	var table strings.Builder
+	if err := ex.WriteTable(&table); err != nil {
+		t.Fatalf("WriteTable failed: %v", err)
+	}
+	if !strings.HasPrefix(table.String(), "SIGN ( n -- s ): 4 of 4 branches taken") {
+		t.Errorf("Unexpected table:\n%s", table.String())
+	}
+}
+
+func TestExploreIsDeterministic(t *testing.T) {
+	a := explore(t, "kind", ExploreOptions{Seed: 3})
+	b := explore(t, "kind", ExploreOptions{Seed: 3})
+	if !reflect.DeepEqual(a, b) {
+		t.Error("Expected the same cases from the same seed")
+	}
+}
+
+func TestExploreReportsErrors(t *testing.T) {
+	ex := explore(t, "safe-div", ExploreOptions{Runs: 1})
+	if ex.Runs != 1 || len(ex.Cases) != 1 || ex.Cases[0].Err != "" {
+		t.Fatalf("Expected one clean run, got %+v", ex)
+	}
+	prog, _ := lux.CompileProgram(exploreSource, lux.CompileOptions{})
+	if _, err := Explore(prog, "nope", lux.StackEffect{}, ExploreOptions{}); err == nil {
+		t.Error("Expected exploring an unknown word to fail")
+	}
+}
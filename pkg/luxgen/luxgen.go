@@ -0,0 +1,254 @@
+// Package luxgen generates random LUX programs that compile and run to
+// completion, for fuzzing the compiler, differential testing of its
+// optimizations and benchmarks that need more code than the examples have.
+//
+// A program is a number of modules of word definitions, each word taking
+// up to two numbers and leaving one, followed by toplevel statements that
+// print what expressions of those words compute. Expressions mix
+// arithmetic, quotations and every combinator. The same seed and options
+// give the same program.
+//
+// Every generated program halts without an error and leaves the stack
+// empty: words only call words defined before them, loops run a bounded
+// number of times, and division is only by a nonzero literal. Arithmetic
+// may wrap, as 32-bit arithmetic does.
+//
+// Explore goes the other way, generating inputs rather than programs: it
+// searches for input stacks that take every branch of an existing word.
+package luxgen
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Options shape a generated program. Zero fields take the defaults.
+type Options struct {
+	Modules    int // Modules of words, besides the toplevel (default 2, negative for none)
+	Words      int // Words in each module (default 4)
+	Statements int // Toplevel statements, each printing a number (default 8)
+	Depth      int // How deep expressions and quotations nest (default 3)
+}
+
+func (o Options) withDefaults() Options {
+	if o.Modules == 0 {
+		o.Modules = 2
+	}
+	if o.Words == 0 {
+		o.Words = 4
+	}
+	if o.Statements == 0 {
+		o.Statements = 8
+	}
+	if o.Depth == 0 {
+		o.Depth = 3
+	}
+	return o
+}
+
+// word is a definition a later one may call
+type word struct {
+	module string
+	name   string
+	arity  int // Numbers it takes; it always leaves one
+}
+
+type generator struct {
+	rng    *rand.Rand
+	depth  int
+	words  []word
+	module string // The module being written, "" for the toplevel
+	b      strings.Builder
+}
+
+// Generate returns the program for seed
+func Generate(seed int64, opts Options) string {
+	opts = opts.withDefaults()
+	g := &generator{rng: rand.New(rand.NewSource(seed)), depth: opts.Depth}
+	fmt.Fprintf(&g.b, "( luxgen seed %d )\n", seed)
+	for m := range opts.Modules {
+		g.module = fmt.Sprintf("M%d", m)
+		fmt.Fprintf(&g.b, "\nMODULE %s\n\n", g.module)
+		for w := range opts.Words {
+			g.define(word{module: g.module, name: fmt.Sprintf("w%d", w), arity: g.rng.Intn(3)})
+		}
+	}
+	g.module = ""
+	if opts.Modules > 0 {
+		g.b.WriteString("\nMODULE MAIN\n")
+		for m := range opts.Modules {
+			fmt.Fprintf(&g.b, "IMPORT M%d AS A%d\n", m, m)
+		}
+	}
+	g.b.WriteString("\n")
+	for range opts.Statements {
+		g.b.WriteString(g.expr(g.depth, false))
+		if g.rng.Intn(3) == 0 {
+			g.b.WriteString(" . 10 emit\n")
+		} else {
+			g.b.WriteString(" . 32 emit\n")
+		}
+	}
+	return g.b.String()
+}
+
+// define writes a definition of w and makes it available to later code
+func (g *generator) define(w word) {
+	var body string
+	switch w.arity {
+	case 0:
+		body = g.expr(g.depth, false)
+	case 1:
+		body = g.xform(g.depth, false)
+	case 2:
+		// a b: change b, then a, and combine them
+		body = fmt.Sprintf("%s swap %s %s", g.xform(g.depth-1, false), g.xform(g.depth-1, false), g.binop())
+	}
+	fmt.Fprintf(&g.b, "@%s %s ;\n", w.name, body)
+	g.words = append(g.words, w)
+}
+
+// ref returns how the code being written names w
+func (g *generator) ref(w word) string {
+	switch {
+	case w.module == g.module:
+		return w.name
+	case g.module == "":
+		return fmt.Sprintf("A%s::%s", strings.TrimPrefix(w.module, "M"), w.name)
+	}
+	return w.module + "::" + w.name
+}
+
+// expr returns code that pushes one number. inQuot says the code is in a
+// quotation, where the compiler does not take loops.
+func (g *generator) expr(depth int, inQuot bool) string {
+	if depth <= 0 {
+		return g.literal()
+	}
+	switch g.rng.Intn(6) {
+	case 0:
+		return g.literal()
+	case 1:
+		return fmt.Sprintf("%s %s %s", g.expr(depth-1, inQuot), g.expr(depth-1, inQuot), g.binop())
+	case 2:
+		if w, ok := g.pick(); ok {
+			args := make([]string, 0, w.arity+1)
+			for range w.arity {
+				args = append(args, g.expr(depth-1, inQuot))
+			}
+			return strings.Join(append(args, g.ref(w)), " ")
+		}
+		return g.literal()
+	case 3:
+		// keep runs the quotation on a copy, leaving its result under the original
+		return fmt.Sprintf("%s [ %s ] keep %s", g.expr(depth-1, inQuot), g.xform(depth-1, true), g.binop())
+	case 4:
+		if !inQuot {
+			// Fold a bounded count down to 0, changing the number under it each pass
+			return fmt.Sprintf("%s %s 7 and [ 0 > ] [ swap %s swap dec ] |: drop",
+				g.expr(depth-1, inQuot), g.expr(depth-1, inQuot), g.xform(depth-1, true))
+		}
+	}
+	return fmt.Sprintf("%s %s", g.expr(depth-1, inQuot), g.xform(depth-1, inQuot))
+}
+
+// xform returns code that replaces the number on top of the stack with
+// another, touching nothing under it
+func (g *generator) xform(depth int, inQuot bool) string {
+	if depth <= 0 {
+		return g.unop()
+	}
+	switch g.rng.Intn(9) {
+	case 0:
+		return g.unop()
+	case 1:
+		return fmt.Sprintf("%s %s", g.expr(depth-1, inQuot), g.binop())
+	case 2:
+		return fmt.Sprintf("dup %s", g.binop())
+	case 3:
+		if w, ok := g.pickArity(1); ok {
+			return g.ref(w)
+		}
+		return g.unop()
+	case 4:
+		return fmt.Sprintf("[ %s ] call", g.xform(depth-1, true))
+	case 5:
+		return fmt.Sprintf("dup %d < [ %s ] [ %s ] ?:", g.small(), g.xform(depth-1, true), g.xform(depth-1, true))
+	case 6:
+		combinator := "?"
+		if g.rng.Intn(2) == 0 {
+			combinator = "!:"
+		}
+		return fmt.Sprintf("dup %d = [ %s ] %s", g.small(), g.xform(depth-1, true), combinator)
+	case 7:
+		if !inQuot {
+			return fmt.Sprintf("[ %s ] %d #:", g.xform(depth-1, true), g.rng.Intn(5))
+		}
+	}
+	return fmt.Sprintf("%s %s", g.xform(depth-1, inQuot), g.xform(depth-1, inQuot))
+}
+
+// pick returns a word defined so far, if there is one
+func (g *generator) pick() (word, bool) {
+	if len(g.words) == 0 {
+		return word{}, false
+	}
+	return g.words[g.rng.Intn(len(g.words))], true
+}
+
+// pickArity returns a word defined so far that takes n numbers
+func (g *generator) pickArity(n int) (word, bool) {
+	var fit []word
+	for _, w := range g.words {
+		if w.arity == n {
+			fit = append(fit, w)
+		}
+	}
+	if len(fit) == 0 {
+		return word{}, false
+	}
+	return fit[g.rng.Intn(len(fit))], true
+}
+
+func (g *generator) literal() string {
+	switch g.rng.Intn(4) {
+	case 0:
+		return fmt.Sprint(g.rng.Int31() - 1<<30)
+	case 1:
+		return fmt.Sprint(-g.small())
+	}
+	return fmt.Sprint(g.small())
+}
+
+// small returns a number from 0 to 99
+func (g *generator) small() int {
+	return g.rng.Intn(100)
+}
+
+// binop returns code that combines the two numbers on top of the stack
+// into one
+func (g *generator) binop() string {
+	switch n := g.rng.Intn(11); n {
+	case 0, 1, 2, 3, 4, 5, 6, 7:
+		return []string{"+", "-", "*", "and", "or", "xor", "=", "<"}[n]
+	case 8:
+		return fmt.Sprintf("drop %d /", g.rng.Intn(9)+1)
+	case 9:
+		return fmt.Sprintf("drop %d mod", g.rng.Intn(9)+1)
+	}
+	return "swap drop"
+}
+
+// unop returns code that replaces the number on top of the stack
+func (g *generator) unop() string {
+	switch n := g.rng.Intn(6); n {
+	case 0, 1, 2:
+		return []string{"inc", "dec", "not"}[n]
+	case 3:
+		return fmt.Sprintf("%d lshift", g.rng.Intn(8))
+	case 4:
+		return fmt.Sprintf("%d /", g.rng.Intn(9)+1)
+	}
+	return fmt.Sprintf("%d mod", g.rng.Intn(9)+1)
+}
@@ -0,0 +1,80 @@
+package luxgen
+
+import (
+	"testing"
+
+	"github.com/rmay/nuxvm/pkg/lux"
+	"github.com/rmay/nuxvm/pkg/vm"
+)
+
+// run compiles source with opts and runs it, returning what it printed
+func run(t *testing.T, source string, opts lux.CompileOptions) string {
+	t.Helper()
+	prog, err := lux.CompileProgram(source, opts)
+	if err != nil {
+		t.Fatalf("Compile error: %v\n%s", err, source)
+	}
+	machine, err := vm.NewVMForImage(prog.Image())
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	output := machine.CaptureOutput()
+	if err := machine.RunLimited(vm.Limits{MaxSteps: 10_000_000}); err != nil {
+		t.Fatalf("Run error: %v\n%s", err, source)
+	}
+	if stack := machine.Stack(); len(stack) != 0 {
+		t.Fatalf("Expected an empty stack, got %v\n%s", stack, source)
+	}
+	return output.Stdout()
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	if Generate(7, Options{}) != Generate(7, Options{}) {
+		t.Error("Expected the same program from the same seed")
+	}
+	if Generate(7, Options{}) == Generate(8, Options{}) {
+		t.Error("Expected different programs from different seeds")
+	}
+}
+
+// Each program runs cleanly, and prints the same with the compiler's
+// inlining and peephole rules turned off
+func TestGeneratedProgramsRun(t *testing.T) {
+	for seed := int64(1); seed <= 100; seed++ {
+		source := Generate(seed, Options{})
+		optimized := run(t, source, lux.CompileOptions{})
+		plain := run(t, source, lux.CompileOptions{NoInline: true, DisabledRules: []string{"all"}})
+		if optimized != plain {
+			t.Errorf("Seed %d: optimized program printed %q, unoptimized %q\n%s", seed, optimized, plain, source)
+		}
+	}
+}
+
+func TestGenerateWithoutModules(t *testing.T) {
+	source := Generate(3, Options{Modules: -1, Statements: 3})
+	run(t, source, lux.CompileOptions{})
+}
+
+// FuzzGenerated compiles and runs the program for each seed, with and
+// without optimization
+func FuzzGenerated(f *testing.F) {
+	f.Add(int64(1), uint8(3))
+	f.Fuzz(func(t *testing.T, seed int64, depth uint8) {
+		source := Generate(seed, Options{Depth: int(depth%5) + 1})
+		optimized := run(t, source, lux.CompileOptions{})
+		if plain := run(t, source, lux.CompileOptions{NoInline: true, DisabledRules: []string{"all"}}); optimized != plain {
+			t.Errorf("Optimized program printed %q, unoptimized %q\n%s", optimized, plain, source)
+		}
+	})
+}
+
+func BenchmarkCompileGenerated(b *testing.B) {
+	source := Generate(1, Options{Modules: 8, Words: 16, Statements: 32, Depth: 4})
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := lux.CompileProgram(source, lux.CompileOptions{}); err != nil {
+			b.Fatalf("Compile failed: %v", err)
+		}
+	}
+}
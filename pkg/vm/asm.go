@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// annotation matches the <NAME> Disassemble puts after an address
+var annotation = regexp.MustCompile(`<[^>]*>`)
+
+// Assemble reads a listing in the form Disassemble writes and returns the
+// code it lists, so a listing can be kept in a test, attached to a bug
+// report or edited by hand and run. Label lines, the address at the start
+// of each line, <NAME> annotations and anything after a ; are ignored.
+// Operands are as written: jump targets and pushed addresses are absolute,
+// so an edit that moves code must fix them. UNKNOWN(0xNN) stands for a
+// byte that is not an opcode.
+func Assemble(listing string) ([]byte, error) {
+	var code []byte
+	for n, line := range strings.Split(listing, "\n") {
+		line, _, _ = strings.Cut(line, ";")
+		line = strings.TrimSpace(annotation.ReplaceAllString(line, ""))
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		fields := strings.Fields(strings.ReplaceAll(line, ",", " "))
+		if len(fields) > 1 && strings.HasPrefix(fields[0], "0x") {
+			fields = fields[1:]
+		}
+		ins, err := assembleInstruction(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		code = append(code, ins...)
+	}
+	return code, nil
+}
+
+// assembleInstruction encodes one instruction: the opcode's name, then its
+// operands
+func assembleInstruction(fields []string) ([]byte, error) {
+	name, args := strings.ToUpper(fields[0]), fields[1:]
+	if hex, ok := strings.CutPrefix(name, "UNKNOWN(0X"); ok && len(args) == 0 {
+		b, err := strconv.ParseUint(strings.TrimSuffix(hex, ")"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad byte %s", fields[0])
+		}
+		return []byte{byte(b)}, nil
+	}
+	op, ok := OpcodeByName(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown opcode %s", fields[0])
+	}
+	number := func(arg string, bits int) (uint64, error) {
+		v, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil || v < -(1<<(bits-1)) || v >= 1<<bits {
+			return 0, fmt.Errorf("bad %d-bit operand %s for %s", bits, arg, name)
+		}
+		return uint64(v), nil
+	}
+	info, _ := LookupOpcode(op)
+	want := 0
+	switch info.Operand {
+	case OperandNone:
+	case OperandTable:
+		if len(args) < 2 || strings.ToLower(args[0]) != "default" {
+			return nil, fmt.Errorf("JMPTABLE wants default ADDR, then a target for each key")
+		}
+		args = args[1:]
+		want = len(args)
+	default:
+		want = 1
+	}
+	if len(args) != want {
+		return nil, fmt.Errorf("%s takes %d operands, not %d", name, want, len(args))
+	}
+	ins := []byte{op}
+	switch info.Operand {
+	case OperandInt8:
+		v, err := number(args[0], 8)
+		if err != nil {
+			return nil, err
+		}
+		return append(ins, byte(v)), nil
+	case OperandInt16:
+		v, err := number(args[0], 16)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint16(ins, uint16(v)), nil
+	case OperandTable:
+		ins = binary.BigEndian.AppendUint16(ins, uint16(len(args)-1))
+	}
+	for _, arg := range args {
+		v, err := number(arg, 32)
+		if err != nil {
+			return nil, err
+		}
+		ins = binary.BigEndian.AppendUint32(ins, uint32(v))
+	}
+	return ins, nil
+}
@@ -0,0 +1,52 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAssembleRoundTrip(t *testing.T) {
+	code := []byte{OpPush8, 0xEB}
+	code = append(code, CallInstruction(0x4013)...)
+	code = append(code, OpPush16, 0x12, 0x34, 0xFE, OpOut, OpHalt)
+	code = append(code, PushInstruction(-7)...)
+	code = append(code, OpJmpTable, 0, 2, 0, 0, 0x40, 0, 0, 0, 0x40, 0x05, 0, 0, 0x40, 0x0A)
+	code = append(code, OpMul, OpRet)
+	symbols := []Symbol{{Name: "DOUBLE", Address: 0x4013}}
+
+	var b strings.Builder
+	Disassemble(&b, code, symbols)
+	got, err := Assemble(b.String())
+	if err != nil {
+		t.Fatalf("Assemble error: %v\n%s", err, b.String())
+	}
+	if !bytes.Equal(got, code) {
+		t.Errorf("Expected %v, got %v from\n%s", code, got, b.String())
+	}
+}
+
+func TestAssembleByHand(t *testing.T) {
+	got, err := Assemble(`
+		push8 2   ; a comment
+		DUP
+		CALL 0x4009 <SQUARE>
+	SQUARE:
+		MUL
+	`)
+	if err != nil {
+		t.Fatalf("Assemble error: %v", err)
+	}
+	want := append([]byte{OpPush8, 2, OpDup}, CallInstruction(0x4009)...)
+	if want = append(want, OpMul); !bytes.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for _, listing := range []string{"FROB", "PUSH8 300", "PUSH", "DUP 1", "JMPTABLE 1, 2", "0x4000  PUSH (truncated)"} {
+		if _, err := Assemble(listing); err == nil {
+			t.Errorf("Expected an error assembling %q", listing)
+		}
+	}
+}
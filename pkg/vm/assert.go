@@ -0,0 +1,56 @@
+package vm
+
+import "fmt"
+
+// Assert pops a flag and a message stored one character per cell
+// ( flag addr len -- ) and fails with the message if the flag is zero
+func (vm *VM) Assert() error {
+	if len(vm.stack) < 3 {
+		return fmt.Errorf("stack underflow: need 3 values for ASSERT")
+	}
+	length, _ := vm.Pop()
+	addr, _ := vm.Pop()
+	flag, _ := vm.Pop()
+	message, err := vm.readCells(addr, length)
+	if err != nil {
+		return err
+	}
+	if flag == 0 {
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
+
+// Exit statuses reported by ExitStatus
+const (
+	ExitOK      = 0 // Still running, or halted
+	ExitAborted = 2 // Stopped by ABORT
+)
+
+// ExitStatus reports how the program ended: ExitAborted if it stopped
+// with ABORT, otherwise ExitOK. A program that failed with an error has
+// no exit status of its own; the error is the result.
+func (vm *VM) ExitStatus() int {
+	return vm.exitStatus
+}
+
+// Abort pops a message stored one character per cell ( addr len -- ),
+// writes it and a newline to the error stream, and stops the program with
+// ExitAborted. Unlike HALT, it does not wait for pending timers.
+func (vm *VM) Abort() error {
+	if len(vm.stack) < 2 {
+		return fmt.Errorf("stack underflow: need 2 values for ABORT")
+	}
+	length, _ := vm.Pop()
+	addr, _ := vm.Pop()
+	message, err := vm.readCells(addr, length)
+	if err != nil {
+		return err
+	}
+	vm.running = false
+	vm.exitStatus = ExitAborted
+	if len(message) > 0 {
+		vm.print(string(message)+"\n", FormatChar|FormatError)
+	}
+	return nil
+}
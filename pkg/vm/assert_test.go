@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssert(t *testing.T) {
+	machine := NewVM(nil)
+	machine.writeCells(16, []byte("bad n"))
+	for _, flag := range []int32{1, -1} {
+		pushAll(machine, flag, 16, 5)
+		if err := machine.Assert(); err != nil {
+			t.Errorf("Expected flag %d to pass, got %v", flag, err)
+		}
+	}
+	pushAll(machine, 0, 16, 5)
+	err := machine.Assert()
+	if err == nil || err.Error() != "bad n" {
+		t.Errorf("Expected the message as the error, got %v", err)
+	}
+	if len(machine.Stack()) != 0 {
+		t.Errorf("Expected ASSERT to pop its arguments, stack is %v", machine.Stack())
+	}
+
+	pushAll(machine, 1, int32(len(machine.Memory())), 5)
+	if err := machine.Assert(); err == nil {
+		t.Error("Expected a message past the end of memory to fail, even when the flag is set")
+	}
+	pushAll(machine, 16, 5)
+	if err := machine.Assert(); err == nil || !strings.Contains(err.Error(), "underflow") {
+		t.Errorf("Expected a stack underflow, got %v", err)
+	}
+}
+
+func TestAssertOpcode(t *testing.T) {
+	machine := NewVM([]byte{OpPush8, 0, OpPush8, 16, OpPush8, 3, OpAssert, OpHalt})
+	machine.writeCells(16, []byte("odd"))
+	err := machine.Run()
+	if err == nil || !strings.Contains(err.Error(), "assertion failed: odd") {
+		t.Errorf("Expected the assertion to fail with its message, got %v", err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	code := []byte{OpPush8, 'a', OpPush8, 1, OpOut, OpPush8, 16, OpPush8, 4, OpAbort, OpPush8, 'b', OpPush8, 1, OpOut, OpHalt}
+	machine := NewVM(code)
+	machine.writeCells(16, []byte("stop"))
+	output := machine.CaptureOutput()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Expected ABORT to stop the program cleanly, got %v", err)
+	}
+	if output.Stdout() != "a" || output.Stderr() != "stop\n" {
+		t.Errorf("Expected %q and %q, got %q and %q", "a", "stop\n", output.Stdout(), output.Stderr())
+	}
+	if machine.ExitStatus() != ExitAborted || machine.Running() {
+		t.Errorf("Expected a stopped VM with ExitAborted, got status %d", machine.ExitStatus())
+	}
+
+	halted := NewVM([]byte{OpHalt})
+	if err := halted.Run(); err != nil || halted.ExitStatus() != ExitOK {
+		t.Errorf("Expected HALT to end with ExitOK, got %d (%v)", halted.ExitStatus(), err)
+	}
+
+	quiet := NewVM([]byte{OpPush8, 0, OpPush8, 0, OpAbort, OpHalt})
+	output = quiet.CaptureOutput()
+	if err := quiet.Run(); err != nil || output.Stderr() != "" || quiet.ExitStatus() != ExitAborted {
+		t.Errorf("Expected an empty message to abort silently, got %q (%v)", output.Stderr(), err)
+	}
+}
+
+func TestAbortFrame(t *testing.T) {
+	// The toplevel sets a frame vector, then aborts: no frame may run
+	code := []byte{OpPush, 0, 0, 0x40, 0x20, OpPush, 0, 0, byte(FrameVectorAddr >> 8), byte(FrameVectorAddr & 0xFF), OpStoreI,
+		OpPush8, 0, OpPush8, 0, OpAbort}
+	for len(code) < 0x20 {
+		code = append(code, OpHalt)
+	}
+	code = append(code, OpPush8, 'f', OpPush8, 1, OpOut, OpRet)
+	machine := NewVM(code)
+	output := machine.CaptureOutput()
+	for i := 0; i < 3; i++ {
+		if running, err := machine.Tick(); running || err != nil {
+			t.Fatalf("Tick %d: expected the aborted program to be over, got %v (%v)", i, running, err)
+		}
+	}
+	if output.Stdout() != "" {
+		t.Errorf("Expected no frame to run, got %q", output.Stdout())
+	}
+}
@@ -0,0 +1,154 @@
+package vm
+
+import "testing"
+
+// benchIterations is the loop count of each benchmark program. ns/op is per
+// program run; ns/iter is the cost of one iteration.
+const benchIterations = 10000
+
+// benchLoop builds a program that runs body benchIterations times:
+//
+//	setup | PUSH n | loop: body DEC DUP JZ end JMP loop | end: HALT | tail
+//
+// body sees the loop counter on top of the stack and must leave it there.
+// Both body and tail are given the address where tail starts, for calls
+// and data.
+func benchLoop(setup []byte, body, tail func(tailAddr int32) []byte) []byte {
+	loop := int32(UserMemoryOffset) + int32(len(setup)) + 5
+	tailAddr := loop + int32(len(body(0))) + 12 + 1
+	var code []byte
+	code = append(code, setup...)
+	code = append(code, PushInstruction(benchIterations)...)
+	code = append(code, body(tailAddr)...)
+	code = append(code, OpDec, OpDup)
+	code = append(code, JzInstruction(tailAddr-1)...)
+	code = append(code, JmpInstruction(loop)...)
+	code = append(code, OpHalt)
+	if tail != nil {
+		code = append(code, tail(tailAddr)...)
+	}
+	return code
+}
+
+func runBench(b *testing.B, code []byte, setup func(*VM)) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		machine := NewVM(code)
+		if setup != nil {
+			setup(machine)
+		}
+		if err := machine.Run(); err != nil {
+			b.Fatalf("Run failed: %v", err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchIterations), "ns/iter")
+}
+
+// BenchmarkArithmetic is dispatch-bound: an accumulator updated with
+// MUL and ADD under a counted loop
+func BenchmarkArithmetic(b *testing.B) {
+	code := benchLoop(ShortPushInstruction(0), func(int32) []byte {
+		var body []byte
+		body = append(body, OpSwap)
+		body = append(body, ShortPushInstruction(3)...)
+		body = append(body, OpMul)
+		body = append(body, ShortPushInstruction(7)...)
+		body = append(body, OpAdd, OpSwap)
+		return body
+	}, nil)
+	runBench(b, code, nil)
+}
+
+// BenchmarkCalls makes two nested CALLs and RETs per iteration
+func BenchmarkCalls(b *testing.B) {
+	code := benchLoop(nil, func(tailAddr int32) []byte {
+		return CallInstruction(tailAddr)
+	}, func(tailAddr int32) []byte {
+		var tail []byte
+		tail = append(tail, CallInstruction(tailAddr+6)...) // outer: CALL inner RET
+		tail = append(tail, OpRet)
+		tail = append(tail, OpInc, OpDec, OpRet) // inner
+		return tail
+	})
+	runBench(b, code, nil)
+}
+
+// BenchmarkMemory mixes absolute LOAD/STORE with computed LOADI/STOREI
+// over a 64-cell buffer
+func BenchmarkMemory(b *testing.B) {
+	index := func(data int32) []byte { // counter → address of cell (counter & 63)
+		var code []byte
+		code = append(code, OpDup)
+		code = append(code, ShortPushInstruction(63)...)
+		code = append(code, OpAnd)
+		code = append(code, ShortPushInstruction(4)...)
+		code = append(code, OpMul)
+		code = append(code, PushInstruction(data)...)
+		code = append(code, OpAdd)
+		return code
+	}
+	code := benchLoop(nil, func(data int32) []byte {
+		var body []byte
+		body = append(body, OpDup)
+		body = append(body, StoreInstruction(data)...)
+		body = append(body, LoadInstruction(data)...)
+		body = append(body, LoadInstruction(data+4)...)
+		body = append(body, OpAdd)
+		body = append(body, StoreInstruction(data+4)...)
+		body = append(body, OpDup)
+		body = append(body, index(data)...)
+		body = append(body, OpStoreI)
+		body = append(body, index(data)...)
+		body = append(body, OpLoadI, OpPop)
+		return body
+	}, func(int32) []byte {
+		return make([]byte, 64*4)
+	})
+	runBench(b, code, nil)
+}
+
+// BenchmarkOutput prints a character per iteration through OutputHandler
+func BenchmarkOutput(b *testing.B) {
+	code := benchLoop(nil, func(int32) []byte {
+		var body []byte
+		body = append(body, ShortPushInstruction('A')...)
+		body = append(body, OutCharacter()...)
+		return body
+	}, nil)
+	var written int
+	runBench(b, code, func(machine *VM) {
+		machine.OutputHandler = func(value, format int32) { written++ }
+	})
+	if written == 0 {
+		b.Fatal("OutputHandler was never called")
+	}
+}
+
+// BenchmarkOutputWriter prints a character per iteration to Stdout, through
+// the output buffer
+func BenchmarkOutputWriter(b *testing.B) {
+	code := benchLoop(nil, func(int32) []byte {
+		var body []byte
+		body = append(body, ShortPushInstruction('A')...)
+		body = append(body, OutCharacter()...)
+		return body
+	}, nil)
+	var out countingWriter
+	runBench(b, code, func(machine *VM) {
+		machine.Stdout = &out
+	})
+	if out.n == 0 {
+		b.Fatal("Nothing was written to Stdout")
+	}
+}
+
+// countingWriter counts the bytes and writes it receives
+type countingWriter struct {
+	n, writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	w.writes++
+	return len(p), nil
+}
@@ -0,0 +1,34 @@
+package vm
+
+import "strings"
+
+// Capture holds what a program wrote to its output and error streams, for
+// Go code that embeds the VM and wants the text rather than a terminal
+type Capture struct {
+	vm     *VM
+	stdout strings.Builder
+	stderr strings.Builder
+}
+
+// CaptureOutput sends everything the program writes from now on to the
+// returned Capture instead of Stdout and Stderr. Output the VM buffered
+// before the call goes to the old Stdout, and an OutputHandler still takes
+// precedence. Limits.MaxOutput bounds how much a run may write, and so how
+// large the capture grows.
+func (vm *VM) CaptureOutput() *Capture {
+	vm.Flush()
+	c := &Capture{vm: vm}
+	vm.Stdout, vm.Stderr = &c.stdout, &c.stderr
+	return c
+}
+
+// Stdout returns the normal output written so far
+func (c *Capture) Stdout() string {
+	c.vm.Flush()
+	return c.stdout.String()
+}
+
+// Stderr returns the error output written so far
+func (c *Capture) Stderr() string {
+	return c.stderr.String()
+}
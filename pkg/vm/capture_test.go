@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCaptureOutput(t *testing.T) {
+	var code []byte
+	code = append(code, ShortPushInstruction(72)...)
+	code = append(code, OutCharacter()...)
+	code = append(code, ShortPushInstruction(7)...)
+	code = append(code, ErrNumber()...)
+	code = append(code, ShortPushInstruction(42)...)
+	code = append(code, OutNumber()...)
+	code = append(code, OpHalt)
+
+	machine := NewVM(code)
+	output := machine.CaptureOutput()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if output.Stdout() != "H42" || output.Stderr() != "7" {
+		t.Errorf("Expected \"H42\" and \"7\", got %q and %q", output.Stdout(), output.Stderr())
+	}
+}
+
+func TestCaptureSeesBufferedOutput(t *testing.T) {
+	machine := NewVM(nil)
+	output := machine.CaptureOutput()
+	machine.Push(5)
+	machine.Push(FormatNumber)
+	machine.Out()
+	if output.Stdout() != "5" {
+		t.Errorf("Expected output still in the VM's buffer, got %q", output.Stdout())
+	}
+}
+
+func TestMaxOutput(t *testing.T) {
+	// Print 'A' forever: PUSH8 65, PUSH8 1, OUT, JMP back
+	code := append(ShortPushInstruction('A'), ShortPushInstruction(FormatChar)...)
+	code = append(code, OpOut)
+	code = append(code, JmpInstruction(UserMemoryOffset)...)
+
+	machine := NewVM(code)
+	output := machine.CaptureOutput()
+	err := machine.RunLimited(Limits{MaxOutput: 100})
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Reason != LimitOutput {
+		t.Fatalf("Expected the output limit to stop the run, got %v", err)
+	}
+	if got := output.Stdout(); got != strings.Repeat("A", 100) {
+		t.Errorf("Expected 100 bytes of output, got %d", len(got))
+	}
+}
@@ -0,0 +1,31 @@
+package vm
+
+// CostTable weighs each opcode for metered execution, indexed by opcode.
+// Limits.MaxCost is a budget in these units.
+type CostTable [256]int64
+
+// DefaultCosts returns the standard schedule: stack and arithmetic
+// instructions cost 1, control flow 2, memory access 3, input, output and
+// yields 10, and host calls, which can do anything, 100
+func DefaultCosts() *CostTable {
+	var t CostTable
+	for op := range t {
+		t[op] = 1
+	}
+	for _, op := range []byte{OpJmp, OpJz, OpJmpTable, OpCall, OpCallStack, OpRet} {
+		t[op] = 2
+	}
+	for _, op := range []byte{OpLoad, OpStore, OpLoadI, OpStoreI} {
+		t[op] = 3
+	}
+	t[OpOut] = 10
+	t[OpFlush] = 10
+	t[OpAccept] = 10
+	t[OpDump] = 10
+	t[OpAbort] = 10
+	t[OpOutN] = 10
+	t[OpOutCells] = 10
+	t[OpYield] = 10
+	t[OpHost] = 100
+	return &t
+}
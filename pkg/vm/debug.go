@@ -0,0 +1,127 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DebugOptions choose how a DebugState shows numbers
+type DebugOptions struct {
+	Hex      bool     // Values in hex instead of decimal
+	Unsigned bool     // Values as unsigned 32-bit numbers
+	Symbols  []Symbol // Names for word addresses; the image's symbols when nil
+}
+
+// FormatValue shows a stack value as the options ask
+func (o DebugOptions) FormatValue(v int32) string {
+	switch {
+	case o.Hex && o.Unsigned:
+		return fmt.Sprintf("0x%X", uint32(v))
+	case o.Hex && v < 0:
+		return fmt.Sprintf("-0x%X", -int64(v))
+	case o.Hex:
+		return fmt.Sprintf("0x%X", v)
+	case o.Unsigned:
+		return fmt.Sprint(uint32(v))
+	}
+	return fmt.Sprint(v)
+}
+
+// FormatStack shows a stack as the options ask, bottom first, with the
+// name of each value that is the address of a word
+func (o DebugOptions) FormatStack(stack []int32) string {
+	items := make([]string, len(stack))
+	for i, v := range stack {
+		items[i] = o.FormatValue(v)
+		for _, sym := range o.Symbols {
+			if sym.Address == v {
+				items[i] += "<" + sym.Name + ">"
+				break
+			}
+		}
+	}
+	return "[" + strings.Join(items, " ") + "]"
+}
+
+// wordAt returns the symbol of the word containing addr: the last one
+// starting at or before it
+func (o DebugOptions) wordAt(addr uint32) (Symbol, bool) {
+	var found Symbol
+	ok := false
+	for _, sym := range o.Symbols {
+		if uint32(sym.Address) <= addr && (!ok || sym.Address > found.Address) {
+			found, ok = sym, true
+		}
+	}
+	return found, ok
+}
+
+// DebugState is the VM's State and the code around its PC, for error
+// reports, which String renders
+type DebugState struct {
+	DebugOptions
+	State
+	MemoryMap   []MemoryRegion
+	Nearby      []byte // Bytecode around PC, starting at NearbyStart
+	NearbyStart uint32
+}
+
+// DebugState returns a snapshot of the VM, shown as opts ask
+func (vm *VM) DebugState(opts DebugOptions) DebugState {
+	if opts.Symbols == nil {
+		opts.Symbols = vm.symbols
+	}
+	s := DebugState{DebugOptions: opts, State: vm.State(), MemoryMap: vm.MemoryMap()}
+	s.NearbyStart = vm.pc - min(vm.pc, 5)
+	for addr := s.NearbyStart; addr < vm.pc+10; addr++ {
+		code, ok := vm.span(addr, 1)
+		if !ok {
+			break
+		}
+		s.Nearby = append(s.Nearby, code[0])
+	}
+	return s
+}
+
+// String renders the state for a person reading an error report
+func (s DebugState) String() string {
+	var b strings.Builder
+	user := s.MemorySegments[2]
+	fmt.Fprintf(&b, "PC: %d (0x%X)", s.PC-min(s.PC, user.Start), s.PC)
+	if sym, ok := s.wordAt(s.PC); ok {
+		fmt.Fprintf(&b, " in %s", sym.Name)
+	}
+	fmt.Fprintf(&b, "\nStack: %s\n", s.FormatStack(s.Stack))
+	fmt.Fprintf(&b, "Return Stack: %s\n", s.FormatStack(s.ReturnStack))
+	fmt.Fprintf(&b, "Stack Depth: %d/%d\n", len(s.Stack), s.Limits.Stack)
+	fmt.Fprintf(&b, "Return Stack Depth: %d/%d\n", len(s.ReturnStack), s.Limits.ReturnStack)
+	for _, seg := range s.MemorySegments {
+		name := strings.ToUpper(seg.Name[:1]) + seg.Name[1:]
+		fmt.Fprintf(&b, "%s Memory: 0x%X-0x%X (%d bytes)\n", name, seg.Start, seg.End, seg.End-seg.Start)
+	}
+	if s.CurrentOpcode >= 0 {
+		fmt.Fprintf(&b, "Current Instruction: %s (0x%02X)\n", OpcodeName(byte(s.CurrentOpcode)), s.CurrentOpcode)
+	}
+	if len(s.MemoryMap) > 0 {
+		b.WriteString("\nMemory Map:\n")
+		WriteMemoryMap(&b, s.MemoryMap)
+	}
+	if len(s.Nearby) > 0 {
+		b.WriteString("\nBytecode around PC:\n")
+		for i, op := range s.Nearby {
+			addr := s.NearbyStart + uint32(i)
+			marker := " "
+			if addr == s.PC {
+				marker = ">"
+			}
+			fmt.Fprintf(&b, "%s 0x%04X: 0x%02X  %s\n", marker, addr, op, OpcodeName(op))
+		}
+	}
+	return b.String()
+}
+
+// DebugInfo returns detailed state for error reporting, in decimal. Tools
+// that want the state as data use State.
+func (vm *VM) DebugInfo() string {
+	return vm.DebugState(DebugOptions{}).String()
+}
@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeterministicStubsHostInput(t *testing.T) {
+	code := append(LoadInstruction(KeyboardStatusAddr), OpYield, OpHalt)
+	machine := NewVM(code)
+	machine.Deterministic = true
+	called := false
+	machine.KeyboardHandler = func() int32 { called = true; return 1 }
+	machine.YieldHandler = func() { called = true }
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if called {
+		t.Error("a deterministic VM called a host handler")
+	}
+	if got := machine.Stack(); len(got) != 1 || got[0] != 0 {
+		t.Errorf("expected the keyboard to read 0, got %v", got)
+	}
+}
+
+func TestDeterministicHostFunctions(t *testing.T) {
+	machine := NewVM(hostProgram("double"))
+	machine.Deterministic = true
+	machine.RegisterHost("double", "math", double)
+	if err := machine.Run(); err == nil || !strings.Contains(err.Error(), "not deterministic") {
+		t.Errorf("expected a nondeterministic host function to be refused, got %v", err)
+	}
+
+	machine = NewVM(hostProgram("double"))
+	machine.Deterministic = true
+	machine.RegisterDeterministicHost("double", "math", double)
+	if err := machine.Run(); err != nil {
+		t.Errorf("expected a deterministic host function to run, got %v", err)
+	}
+}
+
+func TestDeterministicRefusesClockLimits(t *testing.T) {
+	machine := NewVM(spinProgram())
+	machine.Deterministic = true
+	if err := machine.RunLimited(Limits{MaxTime: time.Second}); err == nil {
+		t.Error("expected a time limit to be refused")
+	}
+	if err := machine.RunLimited(Limits{MaxSteps: 1000}); err == nil || !strings.Contains(err.Error(), LimitSteps) {
+		t.Errorf("expected the step limit to stop the run, got %v", err)
+	}
+}
+
+func TestStateHash(t *testing.T) {
+	run := func() [32]byte {
+		machine := NewVM(countProgram())
+		machine.Deterministic = true
+		machine.RunLimited(Limits{MaxSteps: 15})
+		return machine.StateHash()
+	}
+	if run() != run() {
+		t.Error("expected identical runs to reach the same state hash")
+	}
+	if run() == NewVM(countProgram()).StateHash() {
+		t.Error("expected the state hash to change as the program runs")
+	}
+}
+
+func TestHashEvery(t *testing.T) {
+	run := func(n int64) map[int64]uint64 {
+		digests := make(map[int64]uint64)
+		machine := NewVM(countProgram())
+		machine.Hook = HashEvery(n, func(step int64, digest uint64) {
+			digests[step] = digest
+		})
+		if err := machine.Run(); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		return digests
+	}
+	first, second := run(5), run(5)
+	// 31 instructions: digests before the 5th, 10th ... 30th
+	if len(first) != 6 {
+		t.Errorf("Expected 6 digests, got %v", first)
+	}
+	for step, digest := range first {
+		if second[step] != digest {
+			t.Errorf("Replicas disagree at step %d", step)
+		}
+	}
+	if first[5] == first[10] {
+		t.Error("Expected the digest to change as the program runs")
+	}
+	if every := run(1); every[5] != first[5] {
+		t.Error("Expected the digest at a step not to depend on the interval")
+	}
+}
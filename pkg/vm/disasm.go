@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// operandSize returns how many operand bytes follow op at code[at], or -1
+// if they run past the end of code
+func operandSize(code []byte, at int) int {
+	n := 0
+	if info := opcodeInfo[code[at]]; info != nil {
+		n = info.Operand.OperandBytes()
+	}
+	if n < 0 {
+		if at+3 > len(code) {
+			return -1
+		}
+		n = 6 + 4*int(binary.BigEndian.Uint16(code[at+1:]))
+	}
+	if at+1+n > len(code) {
+		return -1
+	}
+	return n
+}
+
+// Disassemble writes one line per instruction of code, which is loaded at
+// UserMemoryOffset, as DisassembleAt does
+func Disassemble(w io.Writer, code []byte, symbols []Symbol) {
+	DisassembleAt(w, code, UserMemoryOffset, symbols)
+}
+
+// DisassembleAt writes one line per instruction of code, which is loaded
+// at base. Each word in symbols gets a label line, and calls,
+// jumps and pushes of a word's address are annotated with its name.
+// Strings and other data the compiler places between words are shown as
+// the instructions their bytes happen to spell.
+func DisassembleAt(w io.Writer, code []byte, base uint32, symbols []Symbol) {
+	names := make(map[uint32]string, len(symbols))
+	for _, sym := range symbols {
+		names[uint32(sym.Address)] = sym.Name
+	}
+	for at := 0; at < len(code); {
+		addr := base + uint32(at)
+		if name, ok := names[addr]; ok {
+			fmt.Fprintf(w, "\n%s:\n", name)
+		}
+		text, size := FormatInstruction(code, at, names)
+		if size == 0 {
+			fmt.Fprintf(w, "0x%04X  %s (truncated)\n", addr, text)
+			return
+		}
+		fmt.Fprintf(w, "0x%04X  %s\n", addr, text)
+		at += size
+	}
+}
+
+// FormatInstruction returns the instruction at code[at] as DisassembleAt
+// lists it, without its address, and its length in bytes, which is 0 when
+// its operands run past the end of code. Addresses in names are annotated
+// with the name.
+func FormatInstruction(code []byte, at int, names map[uint32]string) (string, int) {
+	target := func(addr uint32) string {
+		if name, ok := names[addr]; ok {
+			return fmt.Sprintf("0x%04X <%s>", addr, name)
+		}
+		return fmt.Sprintf("0x%04X", addr)
+	}
+	op := code[at]
+	n := operandSize(code, at)
+	if n < 0 {
+		return OpcodeName(op), 0
+	}
+	operand := code[at+1 : at+1+n]
+	text := OpcodeName(op)
+	info, _ := LookupOpcode(op)
+	switch info.Operand {
+	case OperandInt32:
+		value := int32(binary.BigEndian.Uint32(operand))
+		if name, ok := names[uint32(value)]; ok {
+			text += fmt.Sprintf(" %d <%s>", value, name)
+		} else {
+			text += fmt.Sprintf(" %d", value)
+		}
+	case OperandInt8:
+		text += fmt.Sprintf(" %d", int8(operand[0]))
+	case OperandInt16:
+		text += fmt.Sprintf(" %d", int16(binary.BigEndian.Uint16(operand)))
+	case OperandTarget:
+		text += " " + target(binary.BigEndian.Uint32(operand))
+	case OperandAddress:
+		text += fmt.Sprintf(" %d", binary.BigEndian.Uint32(operand))
+	case OperandHostID:
+		text += fmt.Sprintf(" 0x%08X", binary.BigEndian.Uint32(operand))
+	case OperandTable:
+		text += " default " + target(binary.BigEndian.Uint32(operand[2:]))
+		for i := 6; i < n; i += 4 {
+			text += ", " + target(binary.BigEndian.Uint32(operand[i:]))
+		}
+	}
+	return text, 1 + n
+}
@@ -0,0 +1,48 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	// Toplevel calls DOUBLE at 0x4009 and halts
+	code := []byte{OpPush8, 21}
+	code = append(code, CallInstruction(0x4009)...)
+	code = append(code, OpOut, OpHalt)
+	code = append(code, PushInstruction(2)...)
+	code = append(code, OpMul, OpRet)
+	symbols := []Symbol{{Name: "DOUBLE", Address: 0x4009}}
+
+	var b strings.Builder
+	Disassemble(&b, code, symbols)
+	want := `0x4000  PUSH8 21
+0x4002  CALL 0x4009 <DOUBLE>
+0x4007  OUT
+0x4008  HALT
+
+DOUBLE:
+0x4009  PUSH 2
+0x400E  MUL
+0x400F  RET
+`
+	if got := b.String(); got != want {
+		t.Errorf("Expected listing:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestDisassembleWithoutSymbols(t *testing.T) {
+	var b strings.Builder
+	Disassemble(&b, append(JmpInstruction(0x4005), OpHalt), nil)
+	if got := b.String(); got != "0x4000  JMP 0x4005\n0x4005  HALT\n" {
+		t.Errorf("Unexpected listing:\n%s", got)
+	}
+}
+
+func TestDisassembleTruncated(t *testing.T) {
+	var b strings.Builder
+	Disassemble(&b, []byte{OpPush, 0, 0}, nil)
+	if got := b.String(); got != "0x4000  PUSH (truncated)\n" {
+		t.Errorf("Unexpected listing:\n%s", got)
+	}
+}
@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// HexDump writes data, which starts at address addr, as a canonical hex and
+// ASCII dump: sixteen bytes a line, each line led by its address and ended
+// by the bytes as text, with a dot for anything unprintable
+func HexDump(w io.Writer, addr uint32, data []byte) {
+	var line strings.Builder
+	for at := 0; at < len(data); at += 16 {
+		row := data[at:min(at+16, len(data))]
+		line.Reset()
+		fmt.Fprintf(&line, "%08x ", addr+uint32(at))
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				line.WriteByte(' ')
+			}
+			if i < len(row) {
+				fmt.Fprintf(&line, " %02x", row[i])
+			} else {
+				line.WriteString("   ")
+			}
+		}
+		line.WriteString("  |")
+		for _, b := range row {
+			if b < 0x20 || b > 0x7E {
+				b = '.'
+			}
+			line.WriteByte(b)
+		}
+		line.WriteString("|\n")
+		io.WriteString(w, line.String())
+	}
+}
+
+// Dump pops a length and an address and prints a hex dump of that much
+// memory on the output stream
+func (vm *VM) Dump() error {
+	if len(vm.stack) < 2 {
+		return fmt.Errorf("stack underflow: need 2 values for DUMP")
+	}
+	count, _ := vm.Pop()
+	addr, _ := vm.Pop()
+	if addr < 0 || count < 0 || int64(addr)+int64(count) > int64(vm.memSize()) {
+		return fmt.Errorf("dump of %d bytes at %d is out of bounds", count, addr)
+	}
+	data := make([]byte, count)
+	for i := range data {
+		data[i], _ = vm.byteAt(uint32(addr) + uint32(i)) // The range may run into a shared segment
+	}
+	var text strings.Builder
+	HexDump(&text, uint32(addr), data)
+	return vm.print(text.String(), FormatChar)
+}
+
+// print writes text as a run of characters from OUT in format, which is
+// FormatChar, plus FormatError for the error stream
+func (vm *VM) print(text string, format int32) error {
+	vm.written += int64(len(text))
+	for _, ch := range []byte(text) {
+		if vm.Journal != nil {
+			vm.Journal.out(int32(ch), format)
+		}
+		if vm.OutputHandler != nil {
+			vm.OutputHandler(int32(ch), format)
+		}
+	}
+	if vm.OutputHandler != nil {
+		return nil
+	}
+	if format&FormatError != 0 {
+		vm.Flush()
+		w := vm.Stderr
+		if w == nil {
+			w = os.Stderr
+		}
+		_, err := io.WriteString(w, text)
+		return err
+	}
+	vm.outBuf = append(vm.outBuf, text...)
+	if len(vm.outBuf) >= OutputBufferSize {
+		return vm.Flush()
+	}
+	return nil
+}
+
+// FormatValues returns values as OUTN and OUTCELLS print them: as numbers,
+// separated by spaces
+func FormatValues(values []int32) string {
+	var b []byte
+	for i, v := range values {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = appendOutput(b, v, FormatNumber)
+	}
+	return string(b)
+}
+
+// Cells returns the count cells stored from addr
+func (vm *VM) Cells(addr, count int32) ([]int32, error) {
+	if err := vm.checkCells(addr, count); err != nil {
+		return nil, err
+	}
+	values := make([]int32, count)
+	for i := range values {
+		cell, _ := vm.span(uint32(addr)+uint32(i)*4, 4)
+		values[i] = int32(binary.BigEndian.Uint32(cell))
+	}
+	return values, nil
+}
+
+// OutN pops a count and prints that many values from the top of the
+// stack, deepest first, leaving them there. A negative count prints the
+// whole stack.
+func (vm *VM) OutN() error {
+	if len(vm.stack) < 1 {
+		return fmt.Errorf("stack underflow: need 1 value for OUTN")
+	}
+	n, _ := vm.Pop()
+	if n < 0 {
+		n = int32(len(vm.stack))
+	}
+	if int(n) > len(vm.stack) {
+		return fmt.Errorf("stack underflow: need %d values to print, the stack holds %d", n, len(vm.stack))
+	}
+	return vm.print(FormatValues(vm.stack[len(vm.stack)-int(n):]), FormatChar)
+}
+
+// OutCells pops a length and an address and prints the cells stored there
+func (vm *VM) OutCells() error {
+	if len(vm.stack) < 2 {
+		return fmt.Errorf("stack underflow: need 2 values for OUTCELLS")
+	}
+	count, _ := vm.Pop()
+	addr, _ := vm.Pop()
+	values, err := vm.Cells(addr, count)
+	if err != nil {
+		return err
+	}
+	return vm.print(FormatValues(values), FormatChar)
+}
@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHexDump(t *testing.T) {
+	var out strings.Builder
+	HexDump(&out, 0x4000, []byte("Hello, NUX!\x00\x01\x7f\x80 and more"))
+	want := "00004000  48 65 6c 6c 6f 2c 20 4e  55 58 21 00 01 7f 80 20  |Hello, NUX!.... |\n" +
+		"00004010  61 6e 64 20 6d 6f 72 65                           |and more|\n"
+	if out.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestDump(t *testing.T) {
+	machine := NewVM(nil)
+	copy(machine.Memory()[16:], "abc")
+	output := machine.CaptureOutput()
+	machine.Push(16)
+	machine.Push(3)
+	if err := machine.Dump(); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	want := "00000010  61 62 63" + strings.Repeat(" ", 42) + "|abc|\n"
+	if output.Stdout() != want {
+		t.Errorf("Expected %q, got %q", want, output.Stdout())
+	}
+
+	machine.Push(0)
+	machine.Push(int32(len(machine.Memory()) + 1))
+	if err := machine.Dump(); err == nil {
+		t.Error("Expected a dump past the end of memory to fail")
+	}
+}
+
+func TestOutN(t *testing.T) {
+	tests := []struct {
+		n    int32
+		want string
+	}{
+		{2, "-2 3"},
+		{0, ""},
+		{-1, "1 -2 3"},
+	}
+	for _, tt := range tests {
+		machine := NewVM(nil)
+		output := machine.CaptureOutput()
+		for _, v := range []int32{1, -2, 3, tt.n} {
+			machine.Push(v)
+		}
+		if err := machine.OutN(); err != nil {
+			t.Fatalf("OutN(%d) failed: %v", tt.n, err)
+		}
+		machine.Flush()
+		if output.Stdout() != tt.want {
+			t.Errorf("OutN(%d): expected %q, got %q", tt.n, tt.want, output.Stdout())
+		}
+		if stack := machine.Stack(); len(stack) != 3 {
+			t.Errorf("OutN(%d): expected the values to stay, got %v", tt.n, stack)
+		}
+	}
+
+	machine := NewVM(nil)
+	machine.Push(7)
+	machine.Push(2)
+	if err := machine.OutN(); err == nil || !strings.Contains(err.Error(), "stack underflow") {
+		t.Errorf("Expected printing more values than the stack holds to fail, got %v", err)
+	}
+}
+
+func TestOutCells(t *testing.T) {
+	machine := NewVM(nil)
+	copy(machine.Memory()[16:], []byte{0, 0, 0, 7, 0xFF, 0xFF, 0xFF, 0xFE, 0, 0, 1, 0})
+	output := machine.CaptureOutput()
+	machine.Push(16)
+	machine.Push(3)
+	if err := machine.OutCells(); err != nil {
+		t.Fatalf("OutCells failed: %v", err)
+	}
+	machine.Flush()
+	if want := "7 -2 256"; output.Stdout() != want {
+		t.Errorf("Expected %q, got %q", want, output.Stdout())
+	}
+
+	machine.Push(-4)
+	machine.Push(1)
+	if err := machine.OutCells(); err == nil {
+		t.Error("Expected cells before the start of memory to fail")
+	}
+}
@@ -0,0 +1,235 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// OpcodeDescription returns a one-line English description of an opcode,
+// for teaching output alongside OpcodeName
+func OpcodeDescription(op byte) string {
+	if info := opcodeInfo[op]; info != nil {
+		return info.Description
+	}
+	return "is not a NUXVM instruction"
+}
+
+// Explain describes the instruction at PC with the values it is about to
+// work on, e.g. "DUP: copies the top of the stack (5)". Call targets are
+// named from symbols. It does not change the VM.
+func (vm *VM) Explain(symbols []Symbol) string {
+	op, ok := vm.byteAt(vm.pc)
+	if !ok {
+		return "PC is past the end of memory"
+	}
+	name := OpcodeName(op)
+	text := vm.explain(op, symbols)
+	if text == "" {
+		text = OpcodeDescription(op) // Too few values or operand bytes to say more
+	}
+	return name + ": " + text
+}
+
+// explainArity is how many stack values explain reads for each opcode
+var explainArity = map[byte]int{
+	OpPop: 1, OpDup: 1, OpSwap: 2, OpRoll: 2, OpRot: 3,
+	OpAdd: 2, OpSub: 2, OpMul: 2, OpDiv: 2, OpMod: 2, OpInc: 1, OpDec: 1,
+	OpAnd: 2, OpOr: 2, OpXor: 2, OpNot: 1, OpShl: 2, OpEq: 2, OpLt: 2,
+	OpCallStack: 1, OpJz: 1, OpJmpTable: 1, OpStore: 1, OpOut: 2,
+	OpLoadI: 1, OpStoreI: 2, OpToR: 1, OpAfter: 2, OpEvery: 2, OpAccept: 2,
+	OpToNumber: 2, OpDump: 2, OpAssert: 3, OpAbort: 2,
+	OpOutN: 1, OpOutCells: 2,
+}
+
+func (vm *VM) explain(op byte, symbols []Symbol) string {
+	s := vm.stack
+	n := len(s)
+	if n < explainArity[op] {
+		return ""
+	}
+	var a, b int32 // Second and top of the stack
+	if n >= 2 {
+		a = s[n-2]
+	}
+	if n >= 1 {
+		b = s[n-1]
+	}
+	var operand int32
+	raw, hasOperand := vm.span(vm.pc+1, 4)
+	if hasOperand {
+		operand = int32(binary.BigEndian.Uint32(raw))
+	}
+
+	switch op {
+	case OpPush:
+		if hasOperand {
+			return fmt.Sprintf("pushes %d", operand)
+		}
+	case OpPush8:
+		if raw, ok := vm.byteAt(vm.pc + 1); ok {
+			return fmt.Sprintf("pushes %d", int8(raw))
+		}
+	case OpPush16:
+		if raw, ok := vm.span(vm.pc+1, 2); ok {
+			return fmt.Sprintf("pushes %d", int16(binary.BigEndian.Uint16(raw)))
+		}
+	case OpPop:
+		return fmt.Sprintf("drops the top of the stack (%d)", b)
+	case OpDup:
+		return fmt.Sprintf("copies the top of the stack (%d)", b)
+	case OpSwap:
+		return fmt.Sprintf("swaps the top two values (%d and %d)", a, b)
+	case OpRoll:
+		return fmt.Sprintf("copies the second value (%d) onto the top", a)
+	case OpRot:
+		return fmt.Sprintf("moves the third value (%d) to the top", s[n-3])
+	case OpAdd:
+		return fmt.Sprintf("adds %d and %d, giving %d", a, b, a+b)
+	case OpSub:
+		return fmt.Sprintf("subtracts %d from %d, giving %d", b, a, a-b)
+	case OpMul:
+		return fmt.Sprintf("multiplies %d by %d, giving %d", a, b, a*b)
+	case OpDiv, OpMod:
+		if b == 0 {
+			return fmt.Sprintf("divides %d by zero, which is an error", a)
+		}
+		if op == OpDiv {
+			return fmt.Sprintf("divides %d by %d, giving %d", a, b, a/b)
+		}
+		return fmt.Sprintf("takes the remainder of %d divided by %d, giving %d", a, b, a%b)
+	case OpInc:
+		return fmt.Sprintf("adds 1 to %d, giving %d", b, b+1)
+	case OpDec:
+		return fmt.Sprintf("subtracts 1 from %d, giving %d", b, b-1)
+	case OpAnd:
+		return fmt.Sprintf("bitwise AND of %d and %d, giving %d", a, b, a&b)
+	case OpOr:
+		return fmt.Sprintf("bitwise OR of %d and %d, giving %d", a, b, a|b)
+	case OpXor:
+		return fmt.Sprintf("bitwise XOR of %d and %d, giving %d", a, b, a^b)
+	case OpNot:
+		return fmt.Sprintf("flips every bit of %d, giving %d", b, ^b)
+	case OpShl:
+		return fmt.Sprintf("shifts %d left by %d bits, giving %d", a, b%32, a<<uint32(b%32))
+	case OpEq:
+		return fmt.Sprintf("tests whether %d equals %d: %s", a, b, yesNo(a == b))
+	case OpLt:
+		return fmt.Sprintf("tests whether %d is less than %d: %s", a, b, yesNo(a < b))
+	case OpCallStack:
+		return "calls the quotation at " + describeAddress(uint32(b), symbols)
+	case OpJmp:
+		if hasOperand {
+			return "jumps to " + describeAddress(uint32(operand), symbols)
+		}
+	case OpJz:
+		if !hasOperand {
+			return ""
+		}
+		if b == 0 {
+			return fmt.Sprintf("pops 0, which is zero, so jumps to 0x%X", operand)
+		}
+		return fmt.Sprintf("pops %d, which is not zero, so carries on", b)
+	case OpJmpTable:
+		return fmt.Sprintf("pops index %d and jumps to that entry of its table", b)
+	case OpCall:
+		if hasOperand {
+			return "calls " + describeAddress(uint32(operand), symbols)
+		}
+	case OpHost:
+		if hasOperand {
+			return "calls host function " + vm.hostName(uint32(operand))
+		}
+	case OpRet:
+		if len(vm.returnStack) > 0 {
+			return fmt.Sprintf("returns to 0x%X", vm.returnStack[len(vm.returnStack)-1])
+		}
+	case OpLoad:
+		if hasOperand {
+			return fmt.Sprintf("pushes the value stored at address %d", operand)
+		}
+	case OpStore:
+		if hasOperand {
+			return fmt.Sprintf("stores %d at address %d", b, operand)
+		}
+	case OpOut:
+		stream := ""
+		if b&FormatError != 0 {
+			stream = " to the error stream"
+		}
+		if width := b >> 8; width > 0 {
+			fill := "spaces"
+			if b&(FormatZero|FormatChar) == FormatZero {
+				fill = "zeros"
+			}
+			stream = fmt.Sprintf(", padded with %s to %d characters%s", fill, width, stream)
+		}
+		if b&FormatChar != 0 {
+			return fmt.Sprintf("prints %q as a character%s", rune(a), stream)
+		}
+		return fmt.Sprintf("prints %d as a number%s", a, stream)
+	case OpHalt, OpYield:
+		return OpcodeDescription(op)
+	case OpRDepth:
+		return fmt.Sprintf("pushes %d, the depth of the return stack", len(vm.returnStack))
+	case OpPCFetch:
+		return fmt.Sprintf("pushes its own address, %d", vm.pc)
+	case OpMemSize:
+		return fmt.Sprintf("pushes %d, the size of memory", vm.memSize())
+	case OpLoadI:
+		return fmt.Sprintf("pops address %d and pushes the value stored there", b)
+	case OpStoreI:
+		return fmt.Sprintf("stores %d at address %d", a, b)
+	case OpToR:
+		return fmt.Sprintf("moves %d to the return stack", b)
+	case OpAfter:
+		return fmt.Sprintf("runs the quotation at %s once in %d ms", describeAddress(uint32(b), symbols), a)
+	case OpEvery:
+		return fmt.Sprintf("runs the quotation at %s every %d ms", describeAddress(uint32(b), symbols), a)
+	case OpAccept:
+		return fmt.Sprintf("reads a line of up to %d characters into address %d", b, a)
+	case OpToNumber:
+		return fmt.Sprintf("parses the %d characters at address %d as a number", b, a)
+	case OpDump:
+		return fmt.Sprintf("prints a hex dump of %d bytes at address %d", b, a)
+	case OpOutN:
+		if b < 0 {
+			return "prints the whole stack"
+		}
+		return fmt.Sprintf("prints the top %d values", b)
+	case OpOutCells:
+		return fmt.Sprintf("prints the %d cells at address %d", b, a)
+	case OpAssert:
+		if flag := s[n-3]; flag != 0 {
+			return fmt.Sprintf("checks %d, which is true", flag)
+		}
+		return fmt.Sprintf("fails with the %d-character message at address %d, since the flag is 0", b, a)
+	case OpAbort:
+		return fmt.Sprintf("stops the program with the %d-character message at address %d", b, a)
+	case OpFromR, OpRFetch:
+		if r := len(vm.returnStack); r > 0 {
+			verb := "moves"
+			if op == OpRFetch {
+				verb = "copies"
+			}
+			return fmt.Sprintf("%s %d from the return stack", verb, vm.returnStack[r-1])
+		}
+	}
+	return ""
+}
+
+// describeAddress names the word at addr, if there is one
+func describeAddress(addr uint32, symbols []Symbol) string {
+	for _, sym := range symbols {
+		if uint32(sym.Address) == addr {
+			return fmt.Sprintf("%s (0x%X)", sym.Name, addr)
+		}
+	}
+	return fmt.Sprintf("0x%X", addr)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes (1)"
+	}
+	return "no (0)"
+}
@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"maps"
+	"slices"
+)
+
+// Fork returns an independent copy of the VM that carries on from the same
+// state, for speculative execution, backtracking search or trying out what
+// a change would do. Stacks, pending timers and the reserved, device and
+// data memory are copied. The code segment, which a VM from NewVMForImage
+// knows the end of, is shared instead: the first store into it, or a call
+// to Memory, gives that VM its own copy. A shared program stays shared, so
+// forking a VM from NewSharedVM copies only its reserved and device
+// memory. Handlers, host functions and capabilities carry over. The
+// network functions of RegisterNetwork keep one connection map, unlocked,
+// which the fork shares with the original, so they must not make network
+// calls at the same time; only the original's Close closes the
+// connections. The fork has no Journal, and output still buffered is left
+// to the original.
+func (vm *VM) Fork() *VM {
+	f := *vm
+	start, end := vm.userMemoryStart, vm.codeEnd
+	if vm.forkCode == nil && vm.shared == nil && end > start && int(end) <= len(vm.memory) {
+		vm.forkCode = vm.memory[start:end:end]
+		f.forkCode = vm.forkCode
+	}
+	if f.forkCode != nil {
+		f.memory = make([]byte, len(vm.memory))
+		copy(f.memory, vm.memory[:start])
+		copy(f.memory[end:], vm.memory[end:])
+	} else {
+		f.memory = append([]byte(nil), vm.memory...)
+	}
+	f.stack = append(make([]int32, 0, MaxStackSize), vm.stack...)
+	f.returnStack = append(make([]int32, 0, MaxStackSize), vm.returnStack...)
+	f.hostFuncs = maps.Clone(vm.hostFuncs)
+	f.reservedCode = slices.Clone(vm.reservedCode)
+	f.redefined = slices.Clone(vm.redefined)
+	f.timers = make(timerQueue, len(vm.timers))
+	for i, t := range vm.timers {
+		copied := *t
+		f.timers[i] = &copied
+	}
+	f.closers = nil
+	f.Journal = nil
+	f.outBuf = nil
+	return &f
+}
+
+// ownCode gives the VM its own copy of a code segment it shares with its
+// forks. The original's memory still holds the shared bytes, so it is
+// copied whole rather than written in place.
+func (vm *VM) ownCode() {
+	if vm.forkCode == nil {
+		return
+	}
+	memory := slices.Clone(vm.memory)
+	copy(memory[vm.userMemoryStart:], vm.forkCode)
+	vm.memory = memory
+	vm.forkCode = nil
+}
+
+// writing prepares memory for a store of n bytes at addr
+func (vm *VM) writing(addr, n uint32) {
+	if vm.forkCode != nil && addr < vm.codeEnd && uint64(addr)+uint64(n) > uint64(vm.userMemoryStart) {
+		vm.ownCode()
+	}
+}
+
+// memoryCopy returns a copy of memory with a shared code segment in place
+func (vm *VM) memoryCopy() []byte {
+	memory := append([]byte{}, vm.memory...)
+	copy(memory[vm.userMemoryStart:], vm.forkCode)
+	return memory
+}
@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFork(t *testing.T) {
+	machine := NewVM(spinProgram())
+	machine.RunLimited(Limits{MaxSteps: 21}) // PUSH8 then 10 rounds of INC JMP
+
+	fork := machine.Fork()
+	fork.Memory()[0x100] = 7
+	fork.RunLimited(Limits{MaxSteps: 10})
+	if got := fork.Stack(); got[0] != 15 {
+		t.Errorf("Expected the fork to carry on to 15, got %v", got)
+	}
+	if got := machine.Stack(); got[0] != 10 {
+		t.Errorf("Expected the original to stay at 10, got %v", got)
+	}
+	if machine.Memory()[0x100] != 0 {
+		t.Error("A write to the fork's memory changed the original")
+	}
+
+	// Backtracking: the original carries on from where it was forked
+	machine.RunLimited(Limits{MaxSteps: 2})
+	if got := machine.Stack(); got[0] != 11 {
+		t.Errorf("Expected the original to carry on to 11, got %v", got)
+	}
+}
+
+func TestForkShared(t *testing.T) {
+	program := NewSharedProgram(spinProgram(), nil)
+	machine := NewSharedVM(program)
+	fork := machine.Fork()
+	if len(fork.Memory()) != UserMemoryOffset {
+		t.Errorf("Expected the fork to copy only private memory, got %d bytes", len(fork.Memory()))
+	}
+	fork.RunLimited(Limits{MaxSteps: 3})
+	if got := fork.Stack(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("Expected the fork to run the shared code, got %v", got)
+	}
+}
+
+func TestForkSharesCode(t *testing.T) {
+	code := spinProgram()
+	machine, err := NewVMForImage(&Image{Code: code, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.RunLimited(Limits{MaxSteps: 21})
+	start, end := machine.CodeSegment()
+
+	fork := machine.Fork()
+	if &fork.forkCode[0] != &machine.memory[start] {
+		t.Fatal("Expected the fork to share the original's code segment")
+	}
+	if fork.StateDigest() != machine.StateDigest() {
+		t.Error("Expected the fork to start in the original's state")
+	}
+	if got := fork.Snapshot().Memory[start:end]; !bytes.Equal(got, code) {
+		t.Errorf("Expected the fork's snapshot to hold the code, got %x", got)
+	}
+	if got, _ := fork.span(end-2, 4); !bytes.Equal(got, append(code[len(code)-2:], 1, 2)) {
+		t.Errorf("Expected a read across the end of the code to see code then data, got %x", got)
+	}
+
+	// Data stores leave the code shared; a store into the code copies it
+	fork.writeCells(int32(end), []byte{9})
+	if fork.forkCode == nil {
+		t.Error("A store into data copied the code")
+	}
+	if got, _ := machine.span(end, 4); !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Errorf("A store into the fork's data changed the original's: %x", got)
+	}
+	fork.writeCells(int32(start), []byte{OpHalt})
+	if fork.forkCode != nil {
+		t.Error("A store into the code left it shared")
+	}
+	if !bytes.Equal(machine.memory[start:end], code) {
+		t.Errorf("A store into the fork's code changed the original's: %x", machine.memory[start:end])
+	}
+
+	machine.RunLimited(Limits{MaxSteps: 10})
+	if got := machine.Stack(); got[0] != 15 {
+		t.Errorf("Expected the original to carry on to 15, got %v", got)
+	}
+}
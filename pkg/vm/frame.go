@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DefaultFrameSteps is the step budget of a Tick when VM.FrameSteps is 0
+const DefaultFrameSteps = 100000
+
+// Tick runs one frame of a program written as a game loop: the embedder
+// calls it once per frame, and the VM sits suspended in between. Until the
+// toplevel code halts, each Tick continues it. After that, each Tick runs
+// the quotation the program stored in the frame vector with ON-FRAME, until
+// it returns.
+//
+// A Tick stops after VM.FrameSteps instructions with a *LimitError, and the
+// next Tick carries on with the same frame. running is false once the
+// program is over: a frame halted, or the toplevel code halted without
+// setting a frame vector, or the program aborted.
+func (vm *VM) Tick() (running bool, err error) {
+	if !vm.running {
+		addr := vm.frameVector()
+		if vm.frameEnded || addr == 0 || vm.exitStatus != ExitOK {
+			return false, nil
+		}
+		if len(vm.returnStack) >= MaxReturnStackSize {
+			return false, fmt.Errorf("frame failed: return stack overflow")
+		}
+		if int(addr) >= vm.memSize() {
+			return false, fmt.Errorf("frame failed: frame vector %d out of bounds", addr)
+		}
+		if err := vm.checkTarget(addr); err != nil {
+			return false, fmt.Errorf("frame failed: %v", err)
+		}
+		vm.returnStack = append(vm.returnStack, int32(vm.pc))
+		vm.frameDepth = len(vm.returnStack)
+		vm.pc = addr
+		vm.running = true
+	}
+
+	defer vm.Flush()
+	defer vm.recoverPanic(&err)
+	budget := vm.FrameSteps
+	if budget <= 0 {
+		budget = DefaultFrameSteps
+	}
+	meter := Limits{MaxSteps: budget}.Start()
+	for vm.running {
+		if vm.frameDepth > 0 && len(vm.returnStack) < vm.frameDepth {
+			// The frame returned: suspend until the next Tick
+			vm.frameDepth = 0
+			vm.running = false
+			return true, nil
+		}
+		if err := meter.Tick(); err != nil {
+			return true, err
+		}
+		if _, err := vm.Step(); err != nil {
+			return false, fmt.Errorf("error at PC=%d: %w", vm.pc, err)
+		}
+	}
+	if vm.frameDepth > 0 {
+		vm.frameEnded = true
+		return false, nil
+	}
+	return vm.frameVector() != 0 && vm.exitStatus == ExitOK, nil
+}
+
+// frameVector returns the address of the ON-FRAME quotation, or 0. A VM
+// with less reserved memory may end before the register, and has none.
+func (vm *VM) frameVector() uint32 {
+	if len(vm.memory) < FrameVectorAddr+4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(vm.memory[FrameVectorAddr : FrameVectorAddr+4])
+}
@@ -0,0 +1,39 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTickBudget(t *testing.T) {
+	// The toplevel sets the frame vector to a quotation that spins forever
+	quot := int32(UserMemoryOffset) + 12
+	code := append(PushInstruction(quot), PushInstruction(int32(FrameVectorAddr))...)
+	code = append(code, OpStoreI, OpHalt)
+	code = append(code, OpInc) // The quotation
+	code = append(code, JmpInstruction(quot)...)
+
+	machine := NewVM(code)
+	machine.FrameSteps = 50
+	if running, err := machine.Tick(); !running || err != nil {
+		t.Fatalf("Expected the toplevel tick to finish, got %v, %v", running, err)
+	}
+	machine.Push(0)
+	running, err := machine.Tick()
+	var limit *LimitError
+	if !running || !errors.As(err, &limit) || limit.Steps != 50 {
+		t.Fatalf("Expected the frame to stop after 50 steps, got %v, %v", running, err)
+	}
+	// The next tick carries on with the same frame
+	machine.Tick()
+	if stack := machine.Stack(); stack[0] != 50 {
+		t.Errorf("Expected 50 INCs over two ticks, got %v", stack)
+	}
+}
+
+func TestTickWithoutFrame(t *testing.T) {
+	machine := NewVM(append(ShortPushInstruction(1), OpHalt))
+	if running, err := machine.Tick(); running || err != nil {
+		t.Errorf("Expected a program without ON-FRAME to end after one tick, got %v, %v", running, err)
+	}
+}
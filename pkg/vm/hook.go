@@ -0,0 +1,48 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Instruction is a decoded instruction, as an InstructionHook sees it
+type Instruction struct {
+	PC      uint32
+	Opcode  byte
+	Operand int32 // PUSH, PUSH8, PUSH16, JMP, JZ, CALL, LOAD, STORE and HOST's operand, as executed; 0 for the rest
+}
+
+// InstructionHook is called before each instruction. Returning an error
+// blocks the instruction: it has no effect, and the run fails with the
+// error wrapped. The hook sees the VM as the instruction would, so a policy
+// on STOREI can read the address from the stack.
+type InstructionHook func(vm *VM, ins Instruction) error
+
+// decode returns the instruction op at pc
+func (vm *VM) decode(pc uint32, op byte) Instruction {
+	ins := Instruction{PC: pc, Opcode: op}
+	info, _ := LookupOpcode(op)
+	switch info.Operand {
+	case OperandInt32, OperandTarget, OperandAddress, OperandHostID:
+		if raw, ok := vm.span(pc+1, 4); ok {
+			ins.Operand = int32(binary.BigEndian.Uint32(raw))
+		}
+	case OperandInt8:
+		if b, ok := vm.byteAt(pc + 1); ok {
+			ins.Operand = int32(int8(b))
+		}
+	case OperandInt16:
+		if raw, ok := vm.span(pc+1, 2); ok {
+			ins.Operand = int32(int16(binary.BigEndian.Uint16(raw)))
+		}
+	}
+	return ins
+}
+
+// vet runs the hook on the instruction op at pc
+func (vm *VM) vet(pc uint32, op byte) error {
+	if err := vm.Hook(vm, vm.decode(pc, op)); err != nil {
+		return fmt.Errorf("%s at 0x%X blocked: %w", OpcodeName(op), pc, err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInstructionHook(t *testing.T) {
+	errForbidden := errors.New("store to reserved memory")
+	code := append(ShortPushInstruction(-3), StoreInstruction(UserMemoryOffset+64)...)
+	code = append(code, ShortPushInstruction(7)...)
+	code = append(code, StoreInstruction(0x10)...)
+	code = append(code, OpHalt)
+	code = append(code, make([]byte, 68)...)
+
+	machine := NewVM(code)
+	var seen []Instruction
+	machine.Hook = func(vm *VM, ins Instruction) error {
+		seen = append(seen, ins)
+		if ins.Opcode == OpStore && uint32(ins.Operand) < vm.ReservedMemorySize() {
+			return errForbidden
+		}
+		return nil
+	}
+	err := machine.Run()
+	if !errors.Is(err, errForbidden) {
+		t.Fatalf("Expected the second STORE to be blocked, got %v", err)
+	}
+	want := []Instruction{
+		{UserMemoryOffset, OpPush8, -3},
+		{UserMemoryOffset + 2, OpStore, UserMemoryOffset + 64},
+		{UserMemoryOffset + 7, OpPush8, 7},
+		{UserMemoryOffset + 9, OpStore, 0x10},
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("Expected the hook to see %v, saw %v", want, seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("Instruction %d: expected %+v, got %+v", i, want[i], seen[i])
+		}
+	}
+	// The blocked instruction did nothing
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 7 {
+		t.Errorf("Expected [7] left by the blocked STORE, got %v", stack)
+	}
+	if machine.PC() != UserMemoryOffset+9 {
+		t.Errorf("Expected PC at the blocked STORE, got 0x%X", machine.PC())
+	}
+}
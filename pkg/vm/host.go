@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// HostFunc is a Go function a program calls with HOST. It works on the
+// VM's stack and memory directly; an error stops the run.
+type HostFunc func(vm *VM) error
+
+// HostFunction is a host function registered on a VM
+type HostFunction struct {
+	Name          string
+	Capability    string // The VM must be granted this to call it
+	Fn            HostFunc
+	Deterministic bool // Depends only on the VM's state, so it may run in a Deterministic VM
+}
+
+// PermissionError reports a call to a host function whose capability the
+// VM was not granted
+type PermissionError struct {
+	Function   string
+	Capability string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("host function %s needs the %q capability, which this VM was not granted", e.Function, e.Capability)
+}
+
+// HostID is the operand HOST carries for a function name: the FNV-1a hash
+// of its upper-case form, so compiled programs need no shared table
+func HostID(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToUpper(name)))
+	return h.Sum32()
+}
+
+// NewVMWithCapabilities creates a VM that may only call host functions
+// whose capability is among granted. A VM from NewVM is trusted: it may
+// call every host function registered on it.
+func NewVMWithCapabilities(program []byte, granted ...string) *VM {
+	vm := NewVM(program)
+	vm.granted = make(map[string]bool, len(granted))
+	for _, c := range granted {
+		vm.granted[c] = true
+	}
+	return vm
+}
+
+// RegisterHost makes fn callable as HOST:name, provided the VM is granted
+// capability. Registering a name again replaces the function.
+func (vm *VM) RegisterHost(name, capability string, fn HostFunc) {
+	if vm.hostFuncs == nil {
+		vm.hostFuncs = make(map[uint32]*HostFunction)
+	}
+	vm.hostFuncs[HostID(name)] = &HostFunction{Name: strings.ToUpper(name), Capability: capability, Fn: fn}
+}
+
+// RegisterDeterministicHost registers a host function whose effect depends
+// only on the VM's stack and memory, which a Deterministic VM may call
+func (vm *VM) RegisterDeterministicHost(name, capability string, fn HostFunc) {
+	vm.RegisterHost(name, capability, fn)
+	vm.hostFuncs[HostID(name)].Deterministic = true
+}
+
+// HostFunctions lists the registered host functions by name
+func (vm *VM) HostFunctions() []HostFunction {
+	funcs := make([]HostFunction, 0, len(vm.hostFuncs))
+	for _, f := range vm.hostFuncs {
+		funcs = append(funcs, *f)
+	}
+	sort.Slice(funcs, func(a, b int) bool { return funcs[a].Name < funcs[b].Name })
+	return funcs
+}
+
+// Granted reports whether the VM may use capability
+func (vm *VM) Granted(capability string) bool {
+	return vm.granted == nil || vm.granted[capability]
+}
+
+// callHost runs the host function with the given id
+func (vm *VM) callHost(id uint32) error {
+	f, ok := vm.hostFuncs[id]
+	if !ok {
+		return fmt.Errorf("no host function registered for id 0x%08X", id)
+	}
+	if !vm.Granted(f.Capability) {
+		return &PermissionError{Function: f.Name, Capability: f.Capability}
+	}
+	if vm.Deterministic && !f.Deterministic {
+		return fmt.Errorf("host function %s is not deterministic and cannot run in deterministic mode", f.Name)
+	}
+	if vm.Journal != nil {
+		vm.Journal.host("host:"+f.Name, 0)
+	}
+	return f.Fn(vm)
+}
+
+// hostName names the function with id for explanations
+func (vm *VM) hostName(id uint32) string {
+	if f, ok := vm.hostFuncs[id]; ok {
+		return f.Name
+	}
+	return fmt.Sprintf("0x%08X", id)
+}
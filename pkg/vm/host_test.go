@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// double is a host function that doubles the top of the stack
+func double(vm *VM) error {
+	v, err := vm.Pop()
+	if err != nil {
+		return err
+	}
+	return vm.Push(v * 2)
+}
+
+func hostProgram(name string) []byte {
+	code := append(ShortPushInstruction(21), HostInstruction(name)...)
+	return append(code, OpHalt)
+}
+
+func TestHostCall(t *testing.T) {
+	machine := NewVM(hostProgram("double"))
+	machine.RegisterHost("DOUBLE", "math", double)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := machine.Stack(); len(got) != 1 || got[0] != 42 {
+		t.Errorf("expected [42], got %v", got)
+	}
+
+	machine = NewVM(hostProgram("missing"))
+	if err := machine.Run(); err == nil || !strings.Contains(err.Error(), "no host function") {
+		t.Errorf("expected an unknown host function error, got %v", err)
+	}
+}
+
+func TestHostCapabilities(t *testing.T) {
+	machine := NewVMWithCapabilities(hostProgram("double"), "output")
+	machine.RegisterHost("double", "math", double)
+	err := machine.Run()
+	var perm *PermissionError
+	if !errors.As(err, &perm) || perm.Function != "DOUBLE" || perm.Capability != "math" {
+		t.Fatalf("expected a PermissionError for DOUBLE, got %v", err)
+	}
+
+	machine = NewVMWithCapabilities(hostProgram("double"), "math")
+	machine.RegisterHost("double", "math", double)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run with the capability granted failed: %v", err)
+	}
+	if !machine.Granted("math") || machine.Granted("network") {
+		t.Error("Granted does not match the capabilities the VM was created with")
+	}
+}
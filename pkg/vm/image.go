@@ -0,0 +1,503 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ImageMagic marks a NUX container file. Files without it are treated as
+// bare bytecode, so older .bin programs keep working.
+const ImageMagic = "NUXI"
+
+// ImageFormatVersion is the container layout written by EncodeImage.
+// Version 1 had no toolchain fields in the header and no checksum; every
+// version 2 image must carry one.
+const ImageFormatVersion = 2
+
+// Section kinds in a NUX container
+const (
+	SectionCode      = 0x01 // Bytecode loaded at UserMemoryOffset
+	SectionSymbols   = 0x02 // Word name → address table
+	SectionChecksum  = 0x03 // SHA-256 of every byte before this section
+	SectionSignature = 0x04 // Ed25519 signature of every byte before this section
+	SectionRelocs    = 0x05 // Offsets of the code's absolute address operands
+	SectionMemory    = 0x06 // Load address and reserved size the code was compiled for
+	SectionData      = 0x07 // Initialized memory loaded right after the code
+	SectionTables    = 0x08 // DATA table name → address and size
+)
+
+// SectionName returns the name nux inspect shows for a section kind
+func SectionName(kind byte) string {
+	switch kind {
+	case SectionCode:
+		return "code"
+	case SectionSymbols:
+		return "symbols"
+	case SectionChecksum:
+		return "checksum"
+	case SectionSignature:
+		return "signature"
+	case SectionRelocs:
+		return "relocs"
+	case SectionMemory:
+		return "memory"
+	case SectionData:
+		return "data"
+	case SectionTables:
+		return "tables"
+	}
+	return fmt.Sprintf("unknown(0x%02X)", kind)
+}
+
+// SectionInfo is where one section of a container lies in the file
+type SectionInfo struct {
+	Kind   byte
+	Offset uint32 // Of the section's kind byte
+	Size   uint32 // Of the payload
+}
+
+// Symbol names a word in a compiled program
+type Symbol struct {
+	Name    string
+	Address int32
+	Module  string
+}
+
+// Table names a DATA table in a compiled program, for a debugger to show
+// and watch it by name
+type Table struct {
+	Name    string
+	Address int32
+	Size    int32 // In bytes
+}
+
+// Image is a compiled program plus the metadata stored alongside it
+type Image struct {
+	Code    []byte
+	Data    []byte   // Loaded right after Code; never executed
+	Symbols []Symbol // Sorted by address
+	Tables  []Table  // DATA tables, sorted by address; kept and stripped with Symbols
+	Relocs  []uint32 // Offsets in Code of 4-byte absolute addresses, nil if unknown
+
+	// The memory layout the code was compiled for
+	BaseAddr     uint32 // Where the code loads; 0 means UserMemoryOffset
+	ReservedSize uint32 // Reserved memory it needs; 0 means ReservedMemorySize
+
+	// Toolchain metadata from the header
+	ISAVersion      uint16 // Instruction set the code targets, 0 if unknown
+	CompilerVersion string // e.g. "300K"
+	BuildTime       int64  // Unix seconds, 0 if unknown
+
+	Signature []byte // Ed25519 signature, nil if the image is unsigned
+	signed    []byte // The bytes the signature covers
+
+	// The container as read by ParseImage; 0 and nil for bare bytecode
+	FormatVersion uint16
+	Sections      []SectionInfo // In file order, unknown kinds included
+}
+
+// Verify checks that the image was signed by the holder of key
+func (img *Image) Verify(key ed25519.PublicKey) error {
+	if img.Signature == nil {
+		return fmt.Errorf("image is not signed")
+	}
+	if !ed25519.Verify(key, img.signed, img.Signature) {
+		return fmt.Errorf("image signature does not match the trusted key")
+	}
+	return nil
+}
+
+// CheckISA reports whether this VM can run the image's instruction set
+func (img *Image) CheckISA() error {
+	if img.ISAVersion > ISAVersion {
+		compiler := ""
+		if img.CompilerVersion != "" {
+			compiler = " (compiled by luxc " + img.CompilerVersion + ")"
+		}
+		return fmt.Errorf("program targets ISA version %d%s but this VM supports up to version %d; recompile it with a matching toolchain or upgrade nux",
+			img.ISAVersion, compiler, ISAVersion)
+	}
+	return nil
+}
+
+// memoryLayout returns where the image's code loads and the reserved
+// memory it needs, filling in the defaults
+func (img *Image) memoryLayout() (base, reserved uint32) {
+	base, reserved = img.BaseAddr, img.ReservedSize
+	if base == 0 {
+		base = UserMemoryOffset
+	}
+	if reserved == 0 {
+		reserved = ReservedMemorySize
+	}
+	return base, reserved
+}
+
+// CheckLayout reports whether the image's code was compiled for machine's
+// memory layout: to load where its user memory starts, with no more
+// reserved memory than it has
+func (img *Image) CheckLayout(machine *VM) error {
+	base, reserved := img.memoryLayout()
+	if base != machine.UserMemoryStart() {
+		return fmt.Errorf("program was compiled to load at 0x%X but this VM loads code at 0x%X; recompile it for this layout or rebase it",
+			base, machine.UserMemoryStart())
+	}
+	if reserved > machine.ReservedMemorySize() {
+		return fmt.Errorf("program was compiled for %d bytes of reserved memory but this VM has %d",
+			reserved, machine.ReservedMemorySize())
+	}
+	return nil
+}
+
+// Program returns the code followed by the data, as loaded into memory
+func (img *Image) Program() []byte {
+	if len(img.Data) == 0 {
+		return img.Code
+	}
+	return append(img.Code[:len(img.Code):len(img.Code)], img.Data...)
+}
+
+// NewVMForImage creates a VM with the reserved memory the image was
+// compiled for and loads its code and data, checking they belong there.
+// The code segment ends where the data starts.
+func NewVMForImage(img *Image) (*VM, error) {
+	base, reserved := img.memoryLayout()
+	machine := NewVM(img.Program())
+	if reserved != ReservedMemorySize {
+		machine = NewVMWithReservedMemory(img.Program(), reserved)
+	}
+	if err := img.CheckLayout(machine); err != nil {
+		return nil, err
+	}
+	machine.SetCodeEnd(base + uint32(len(img.Code)))
+	machine.symbols = img.Symbols
+	return machine, nil
+}
+
+// IsImage reports whether data starts with the container magic
+func IsImage(data []byte) bool {
+	return len(data) >= len(ImageMagic) && string(data[:len(ImageMagic)]) == ImageMagic
+}
+
+// Lookup returns the symbol with the given name. Names are stored upper-case,
+// as the compiler produces them.
+func (img *Image) Lookup(name string) (Symbol, bool) {
+	for _, sym := range img.Symbols {
+		if sym.Name == name {
+			return sym, true
+		}
+	}
+	return Symbol{}, false
+}
+
+// LookupTable returns the DATA table with the given name, upper-case as
+// Lookup's
+func (img *Image) LookupTable(name string) (Table, bool) {
+	for _, t := range img.Tables {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Table{}, false
+}
+
+// SymbolAt returns the symbol whose word starts at addr
+func (img *Image) SymbolAt(addr int32) (Symbol, bool) {
+	for _, sym := range img.Symbols {
+		if sym.Address == addr {
+			return sym, true
+		}
+	}
+	return Symbol{}, false
+}
+
+type imageSection struct {
+	kind    byte
+	payload []byte
+}
+
+// EncodeImage serializes an image:
+//
+//	magic "NUXI" | version uint16
+//	ISA version uint16 | build time int64 | compiler version (uint16 length + bytes)
+//	section count uint16, then per section: kind uint8 | length uint32 | payload
+//
+// The checksum section always follows the content sections; a signature,
+// when present, comes last.
+func EncodeImage(img *Image) []byte {
+	return encodeImage(img, nil)
+}
+
+// EncodeSignedImage serializes an image and signs it with key
+func EncodeSignedImage(img *Image, key ed25519.PrivateKey) []byte {
+	return encodeImage(img, key)
+}
+
+func encodeImage(img *Image, key ed25519.PrivateKey) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(ImageMagic)
+	sections := []imageSection{{SectionCode, img.Code}}
+	if len(img.Data) > 0 {
+		sections = append(sections, imageSection{SectionData, img.Data})
+	}
+	if len(img.Symbols) > 0 {
+		sections = append(sections, imageSection{SectionSymbols, encodeSymbols(img.Symbols)})
+	}
+	if len(img.Tables) > 0 {
+		sections = append(sections, imageSection{SectionTables, encodeTables(img.Tables)})
+	}
+	if len(img.Relocs) > 0 {
+		sections = append(sections, imageSection{SectionRelocs, encodeRelocs(img.Relocs)})
+	}
+	if img.BaseAddr != 0 || img.ReservedSize != 0 {
+		payload := binary.BigEndian.AppendUint32(nil, img.BaseAddr)
+		sections = append(sections, imageSection{SectionMemory, binary.BigEndian.AppendUint32(payload, img.ReservedSize)})
+	}
+	count := len(sections) + 1 // Checksum
+	if key != nil {
+		count++
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(ImageFormatVersion))
+	binary.Write(&buf, binary.BigEndian, img.ISAVersion)
+	binary.Write(&buf, binary.BigEndian, img.BuildTime)
+	writeString(&buf, img.CompilerVersion)
+	binary.Write(&buf, binary.BigEndian, uint16(count))
+	for _, s := range sections {
+		writeSection(&buf, s)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	writeSection(&buf, imageSection{SectionChecksum, sum[:]})
+	if key != nil {
+		writeSection(&buf, imageSection{SectionSignature, ed25519.Sign(key, buf.Bytes())})
+	}
+	return buf.Bytes()
+}
+
+func writeSection(buf *bytes.Buffer, s imageSection) {
+	buf.WriteByte(s.kind)
+	binary.Write(buf, binary.BigEndian, uint32(len(s.payload)))
+	buf.Write(s.payload)
+}
+
+// ParseImage decodes a container, or wraps bare bytecode in an Image
+func ParseImage(data []byte) (*Image, error) {
+	if !IsImage(data) {
+		return &Image{Code: data}, nil
+	}
+	r := bytes.NewReader(data[len(ImageMagic):])
+	var version, count uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, fmt.Errorf("image header truncated")
+	}
+	if version > ImageFormatVersion {
+		return nil, fmt.Errorf("image format version %d is newer than supported version %d", version, ImageFormatVersion)
+	}
+	img := &Image{FormatVersion: version}
+	if version >= 2 {
+		if err := binary.Read(r, binary.BigEndian, &img.ISAVersion); err != nil {
+			return nil, fmt.Errorf("image header truncated")
+		}
+		if err := binary.Read(r, binary.BigEndian, &img.BuildTime); err != nil {
+			return nil, fmt.Errorf("image header truncated")
+		}
+		var err error
+		if img.CompilerVersion, err = readString(r); err != nil {
+			return nil, fmt.Errorf("image header truncated")
+		}
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("image header truncated")
+	}
+	haveCode, haveChecksum := false, false
+	for i := 0; i < int(count); i++ {
+		start := len(data) - r.Len() // Offset of this section in data
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("image section %d truncated", i)
+		}
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("image section %d truncated", i)
+		}
+		if int64(length) > int64(r.Len()) {
+			return nil, fmt.Errorf("image section %d length %d exceeds file size", i, length)
+		}
+		payload := make([]byte, length)
+		r.Read(payload)
+		img.Sections = append(img.Sections, SectionInfo{Kind: kind, Offset: uint32(start), Size: length})
+		switch kind {
+		case SectionCode:
+			img.Code = payload
+			haveCode = true
+		case SectionData:
+			img.Data = payload
+		case SectionSymbols:
+			if img.Symbols, err = decodeSymbols(payload); err != nil {
+				return nil, err
+			}
+		case SectionTables:
+			if img.Tables, err = decodeTables(payload); err != nil {
+				return nil, err
+			}
+		case SectionRelocs:
+			if img.Relocs, err = decodeRelocs(payload); err != nil {
+				return nil, err
+			}
+		case SectionMemory:
+			if len(payload) != 8 {
+				return nil, fmt.Errorf("memory section has length %d, expected 8", len(payload))
+			}
+			img.BaseAddr = binary.BigEndian.Uint32(payload)
+			img.ReservedSize = binary.BigEndian.Uint32(payload[4:])
+		case SectionChecksum:
+			sum := sha256.Sum256(data[:start])
+			if !bytes.Equal(payload, sum[:]) {
+				return nil, fmt.Errorf("image checksum mismatch: the file is corrupt or was modified")
+			}
+			haveChecksum = true
+		case SectionSignature:
+			if len(payload) != ed25519.SignatureSize {
+				return nil, fmt.Errorf("image signature has length %d, expected %d", len(payload), ed25519.SignatureSize)
+			}
+			img.Signature = payload
+			img.signed = data[:start]
+		default:
+			// Unknown sections are skipped so newer optional metadata does not break older loaders
+		}
+	}
+	if !haveCode {
+		return nil, fmt.Errorf("image has no code section")
+	}
+	if version >= 2 && !haveChecksum {
+		return nil, fmt.Errorf("image has no checksum section: the file is corrupt or was modified")
+	}
+	return img, nil
+}
+
+// encodeSymbols writes: count uint32, then address int32 | name | module,
+// with each string as a uint16 length followed by its bytes
+func encodeSymbols(symbols []Symbol) []byte {
+	sorted := append([]Symbol{}, symbols...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Address < sorted[j].Address })
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(sorted)))
+	for _, sym := range sorted {
+		binary.Write(&buf, binary.BigEndian, sym.Address)
+		writeString(&buf, sym.Name)
+		writeString(&buf, sym.Module)
+	}
+	return buf.Bytes()
+}
+
+func decodeSymbols(payload []byte) ([]Symbol, error) {
+	r := bytes.NewReader(payload)
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("symbol section truncated")
+	}
+	var symbols []Symbol
+	for i := uint32(0); i < count; i++ {
+		var sym Symbol
+		if err := binary.Read(r, binary.BigEndian, &sym.Address); err != nil {
+			return nil, fmt.Errorf("symbol %d truncated", i)
+		}
+		var err error
+		if sym.Name, err = readString(r); err != nil {
+			return nil, fmt.Errorf("symbol %d: %v", i, err)
+		}
+		if sym.Module, err = readString(r); err != nil {
+			return nil, fmt.Errorf("symbol %d: %v", i, err)
+		}
+		symbols = append(symbols, sym)
+	}
+	return symbols, nil
+}
+
+// encodeTables writes: count uint32, then address int32 | size int32 |
+// name, with the name as a uint16 length followed by its bytes
+func encodeTables(tables []Table) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(tables)))
+	for _, t := range tables {
+		binary.Write(&buf, binary.BigEndian, t.Address)
+		binary.Write(&buf, binary.BigEndian, t.Size)
+		writeString(&buf, t.Name)
+	}
+	return buf.Bytes()
+}
+
+func decodeTables(payload []byte) ([]Table, error) {
+	r := bytes.NewReader(payload)
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("table section truncated")
+	}
+	var tables []Table
+	for i := uint32(0); i < count; i++ {
+		var t Table
+		if err := binary.Read(r, binary.BigEndian, &t.Address); err != nil {
+			return nil, fmt.Errorf("table %d truncated", i)
+		}
+		if err := binary.Read(r, binary.BigEndian, &t.Size); err != nil {
+			return nil, fmt.Errorf("table %d truncated", i)
+		}
+		var err error
+		if t.Name, err = readString(r); err != nil {
+			return nil, fmt.Errorf("table %d: %v", i, err)
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", fmt.Errorf("string length truncated")
+	}
+	if int(n) > r.Len() {
+		return "", fmt.Errorf("string of length %d truncated", n)
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
+
+// GenerateSigningKey returns a new key pair in the hex text form read by
+// ParsePrivateKey and ParsePublicKey
+func GenerateSigningKey() (private, public string, err error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(priv.Seed()) + "\n", hex.EncodeToString(pub) + "\n", nil
+}
+
+// ParsePrivateKey reads a hex-encoded Ed25519 seed
+func ParsePrivateKey(text string) (ed25519.PrivateKey, error) {
+	seed, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("private key must be %d hex-encoded bytes", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParsePublicKey reads a hex-encoded Ed25519 public key
+func ParsePublicKey(text string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d hex-encoded bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
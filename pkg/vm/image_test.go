@@ -0,0 +1,250 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestImageRoundTrip(t *testing.T) {
+	img := &Image{
+		Code: []byte{OpPush, 0, 0, 0, 1, OpHalt},
+		Data: []byte{0, 0, 0, 7},
+		Symbols: []Symbol{
+			{Name: "GFX::DRAW", Address: 0x4010, Module: "GFX"},
+			{Name: "MAIN", Address: 0x4005},
+		},
+		Tables:          []Table{{Name: "SQUARES", Address: 0x4006, Size: 20}},
+		ISAVersion:      ISAVersion,
+		CompilerVersion: "300K",
+		BuildTime:       1760000000,
+	}
+	got, err := ParseImage(EncodeImage(img))
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	if !bytes.Equal(got.Code, img.Code) {
+		t.Errorf("Expected code %v, got %v", img.Code, got.Code)
+	}
+	if want := append(img.Code, img.Data...); !bytes.Equal(got.Program(), want) {
+		t.Errorf("Expected program %v, got %v", want, got.Program())
+	}
+	if len(got.Symbols) != 2 || got.Symbols[0].Name != "MAIN" || got.Symbols[1].Module != "GFX" {
+		t.Errorf("Expected symbols sorted by address, got %+v", got.Symbols)
+	}
+	if sym, ok := got.SymbolAt(0x4010); !ok || sym.Name != "GFX::DRAW" {
+		t.Errorf("Expected GFX::DRAW at 0x4010, got %+v", sym)
+	}
+	if table, ok := got.LookupTable("SQUARES"); !ok || table.Address != 0x4006 || table.Size != 20 {
+		t.Errorf("Expected SQUARES at 0x4006, 20 bytes, got %+v", got.Tables)
+	}
+	if got.ISAVersion != ISAVersion || got.CompilerVersion != "300K" || got.BuildTime != 1760000000 {
+		t.Errorf("Expected toolchain metadata to round-trip, got ISA=%d compiler=%q time=%d",
+			got.ISAVersion, got.CompilerVersion, got.BuildTime)
+	}
+}
+
+func TestImageSections(t *testing.T) {
+	img := &Image{Code: []byte{OpHalt}, Data: []byte{1, 2}, Symbols: []Symbol{{Name: "MAIN", Address: 0x4000}}}
+	data := EncodeImage(img)
+	got, err := ParseImage(data)
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	if got.FormatVersion != ImageFormatVersion {
+		t.Errorf("Expected format version %d, got %d", ImageFormatVersion, got.FormatVersion)
+	}
+	var names []string
+	for _, s := range got.Sections {
+		names = append(names, SectionName(s.Kind))
+	}
+	if strings.Join(names, " ") != "code data symbols checksum" {
+		t.Fatalf("Expected code, data, symbols and checksum sections, got %v", names)
+	}
+	if s := got.Sections[1]; data[s.Offset] != SectionData || s.Size != 2 {
+		t.Errorf("Expected the data section's offset and size, got %+v", s)
+	}
+	if s := got.Sections[3]; int(s.Offset+5+s.Size) != len(data) {
+		t.Errorf("Expected the checksum to end the file, got %+v in %d bytes", s, len(data))
+	}
+	if bare, _ := ParseImage([]byte{OpHalt}); bare.FormatVersion != 0 || bare.Sections != nil {
+		t.Errorf("Expected bare bytecode to have no container, got %+v", bare)
+	}
+	if name := SectionName(0x7F); name != "unknown(0x7F)" {
+		t.Errorf("Expected an unknown kind to be named by number, got %q", name)
+	}
+}
+
+func TestImageVersion1(t *testing.T) {
+	// A version 1 header has no toolchain fields
+	data := []byte("NUXI\x00\x01\x00\x01\x01\x00\x00\x00\x01\x1C")
+	img, err := ParseImage(data)
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	if !bytes.Equal(img.Code, []byte{OpHalt}) || img.ISAVersion != 0 {
+		t.Errorf("Expected HALT with unknown ISA, got %+v", img)
+	}
+}
+
+func TestCheckISA(t *testing.T) {
+	if err := (&Image{ISAVersion: ISAVersion}).CheckISA(); err != nil {
+		t.Errorf("Expected current ISA to be accepted, got %v", err)
+	}
+	if err := (&Image{}).CheckISA(); err != nil {
+		t.Errorf("Expected unknown ISA to be accepted, got %v", err)
+	}
+	err := (&Image{ISAVersion: ISAVersion + 1, CompilerVersion: "299K"}).CheckISA()
+	if err == nil || !bytes.Contains([]byte(err.Error()), []byte("recompile")) {
+		t.Errorf("Expected a recompile hint for a newer ISA, got %v", err)
+	}
+}
+
+func TestParseImageRawBytecode(t *testing.T) {
+	code := []byte{OpPush, 0, 0, 0, 1, OpHalt}
+	img, err := ParseImage(code)
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	if !bytes.Equal(img.Code, code) || len(img.Symbols) != 0 {
+		t.Errorf("Expected bare bytecode to load unchanged, got %+v", img)
+	}
+}
+
+func TestParseImageErrors(t *testing.T) {
+	valid := EncodeImage(&Image{Code: []byte{OpHalt}})
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"truncated header", []byte("NUXI\x00"), "header truncated"},
+		{"newer version", []byte("NUXI\x00\x63\x00\x00"), "newer than supported"},
+		{"no code", []byte("NUXI\x00\x01\x00\x00"), "no code section"},
+		{"truncated toolchain fields", []byte("NUXI\x00\x02\x00\x02"), "header truncated"},
+		{"short section", valid[:len(valid)-1], "exceeds file size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseImage(tt.data)
+			if err == nil || !bytes.Contains([]byte(err.Error()), []byte(tt.want)) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestCallWordStopsAtReturn(t *testing.T) {
+	// 0x4000: PUSH 1, HALT; 0x4006: PUSH 2, RET
+	program := []byte{OpPush, 0, 0, 0, 1, OpHalt, OpPush, 0, 0, 0, 2, OpRet}
+	machine := NewVM(program)
+	if err := machine.CallWord(UserMemoryOffset + 6); err != nil {
+		t.Fatalf("CallWord error: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 2 {
+		t.Errorf("Expected [2], got %v", stack)
+	}
+	if machine.PC() != UserMemoryOffset {
+		t.Errorf("Expected PC restored to %d, got %d", UserMemoryOffset, machine.PC())
+	}
+}
+
+func TestImageChecksum(t *testing.T) {
+	data := EncodeImage(&Image{Code: []byte{OpPush, 0, 0, 0, 1, OpHalt}})
+	if _, err := ParseImage(data); err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	// Flip a bit in the code payload
+	corrupt := append([]byte{}, data...)
+	corrupt[bytes.IndexByte(corrupt, OpHalt)] ^= 0x01
+	if _, err := ParseImage(corrupt); err == nil || !bytes.Contains([]byte(err.Error()), []byte("checksum mismatch")) {
+		t.Errorf("Expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestImageChecksumRequired(t *testing.T) {
+	data := EncodeImage(&Image{Code: []byte{OpPush, 0, 0, 0, 1, OpHalt}})
+	img, err := ParseImage(data)
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	// Cut the checksum section off the end and drop it from the count
+	last := img.Sections[len(img.Sections)-1]
+	if last.Kind != SectionChecksum {
+		t.Fatalf("Last section is %s, want checksum", SectionName(last.Kind))
+	}
+	stripped := append([]byte{}, data[:last.Offset]...)
+	countAt := img.Sections[0].Offset - 2
+	binary.BigEndian.PutUint16(stripped[countAt:], uint16(len(img.Sections)-1))
+	if _, err := ParseImage(stripped); err == nil || !strings.Contains(err.Error(), "no checksum section") {
+		t.Errorf("Expected a missing checksum error, got %v", err)
+	}
+}
+
+func TestImageSignature(t *testing.T) {
+	privText, pubText, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ParsePrivateKey(privText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParsePublicKey(pubText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := &Image{Code: []byte{OpHalt}, Symbols: []Symbol{{Name: "MAIN", Address: 0x4000}}}
+
+	signed, err := ParseImage(EncodeSignedImage(img, priv))
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	if err := signed.Verify(pub); err != nil {
+		t.Errorf("Expected signature to verify, got %v", err)
+	}
+
+	_, otherText, _ := GenerateSigningKey()
+	other, _ := ParsePublicKey(otherText)
+	if err := signed.Verify(other); err == nil {
+		t.Error("Expected verification with another key to fail")
+	}
+
+	unsigned, err := ParseImage(EncodeImage(img))
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	if err := unsigned.Verify(pub); err == nil || !bytes.Contains([]byte(err.Error()), []byte("not signed")) {
+		t.Errorf("Expected unsigned image to be rejected, got %v", err)
+	}
+}
+
+func TestImageMemoryLayout(t *testing.T) {
+	img := &Image{Code: []byte{OpHalt}, BaseAddr: 0x5000, ReservedSize: 8192}
+	got, err := ParseImage(EncodeImage(img))
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	if got.BaseAddr != 0x5000 || got.ReservedSize != 8192 {
+		t.Fatalf("Expected the layout to round-trip, got base 0x%X reserved %d", got.BaseAddr, got.ReservedSize)
+	}
+	if err := got.CheckLayout(NewVM(nil)); err == nil {
+		t.Error("Expected a default VM to refuse code compiled for 0x5000")
+	}
+	machine, err := NewVMForImage(got)
+	if err != nil {
+		t.Fatalf("NewVMForImage failed: %v", err)
+	}
+	if machine.ReservedMemorySize() != 8192 || machine.PC() != 0x5000 {
+		t.Errorf("Expected 8192 bytes reserved and PC at 0x5000, got %d and 0x%X", machine.ReservedMemorySize(), machine.PC())
+	}
+
+	// Without the section the defaults apply
+	if err := (&Image{Code: []byte{OpHalt}}).CheckLayout(NewVM(nil)); err != nil {
+		t.Errorf("Expected a bare image to suit a default VM, got %v", err)
+	}
+	if err := (&Image{Code: []byte{OpHalt}}).CheckLayout(NewVMWithReservedMemory(nil, 8192)); err == nil {
+		t.Error("Expected code compiled for 0x4000 to be refused by a VM that loads at 0x5000")
+	}
+}
@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Accept pops a buffer address and the most cells it may receive, reads a
+// line from Stdin into it one character per cell, and pushes how many cells
+// it wrote, or -1 at the end of the input. Backspace and DEL erase the
+// character before them, so input typed through a raw terminal or piped
+// from a recording comes out as edited. Characters beyond the buffer are
+// read and dropped with the rest of the line.
+func (vm *VM) Accept() error {
+	if len(vm.stack) < 2 {
+		return fmt.Errorf("stack underflow: need 2 values for ACCEPT")
+	}
+	max, _ := vm.Pop()
+	addr, _ := vm.Pop()
+	if err := vm.checkCells(addr, max); err != nil {
+		return err
+	}
+	in, err := vm.input()
+	if err != nil {
+		return err
+	}
+	vm.Flush() // Show the prompt before waiting for the answer
+	line, err := in.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		if vm.Journal != nil {
+			vm.Journal.host("accept", -1)
+		}
+		if err != io.EOF {
+			return fmt.Errorf("reading input: %v", err)
+		}
+		return vm.Push(-1)
+	}
+	text := make([]byte, 0, len(line))
+	for _, ch := range line {
+		switch ch {
+		case '\n', '\r':
+		case '\b', 0x7F:
+			if len(text) > 0 {
+				text = text[:len(text)-1]
+			}
+		default:
+			text = append(text, ch)
+		}
+	}
+	if len(text) > int(max) {
+		text = text[:max]
+	}
+	n := vm.writeCells(addr, text)
+	if vm.Journal != nil {
+		vm.Journal.host("accept", n)
+	}
+	return vm.Push(n)
+}
+
+// input returns the reader ACCEPT reads lines from, buffering Stdin on
+// first use
+func (vm *VM) input() (*bufio.Reader, error) {
+	src := vm.Stdin
+	if src == nil {
+		if vm.Deterministic {
+			return nil, fmt.Errorf("input depends on the terminal; a deterministic VM needs VM.Stdin set")
+		}
+		src = os.Stdin
+	}
+	if vm.in == nil || vm.inSrc != src {
+		vm.in, vm.inSrc = bufio.NewReader(src), src
+	}
+	return vm.in, nil
+}
+
+// ToNumber pops the address and length of a string stored one character
+// per cell and pushes the decimal number it spells and 1, or 0 and 0 if it
+// is not an int32. Surrounding spaces are ignored, so it accepts what OUT
+// prints and what ACCEPT reads.
+func (vm *VM) ToNumber() error {
+	if len(vm.stack) < 2 {
+		return fmt.Errorf("stack underflow: need 2 values for >NUMBER")
+	}
+	count, _ := vm.Pop()
+	addr, _ := vm.Pop()
+	text, err := vm.readCells(addr, count)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(text)), 10, 32)
+	if err != nil {
+		return pushAll(vm, 0, 0)
+	}
+	return pushAll(vm, int32(n), 1)
+}
@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// acceptProgram reads lines into a 4-cell buffer at address 0 until the
+// input ends, pushing each line's length
+func acceptProgram() []byte {
+	var code []byte
+	code = append(code, ShortPushInstruction(0)...)
+	code = append(code, ShortPushInstruction(4)...)
+	code = append(code, OpAccept, OpDup)
+	code = append(code, ShortPushInstruction(-1)...)
+	code = append(code, OpEq)
+	code = append(code, JzInstruction(UserMemoryOffset)...)
+	return append(code, OpHalt)
+}
+
+func TestAccept(t *testing.T) {
+	machine := NewVM(acceptProgram())
+	machine.Stdin = strings.NewReader("hi\r\nabcdefg\nab\bc\n\nlast")
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := machine.Stack(); !reflect.DeepEqual(got, []int32{2, 4, 2, 0, 4, -1}) {
+		t.Errorf("Expected line lengths [2 4 2 0 4 -1], got %v", got)
+	}
+	text, _ := machine.readCells(0, 4)
+	if string(text) != "last" {
+		t.Errorf("Expected the buffer to hold \"last\", got %q", text)
+	}
+}
+
+func TestAcceptErrors(t *testing.T) {
+	machine := NewVM(nil)
+	machine.Stdin = strings.NewReader("x\n")
+	machine.Push(DeviceMemoryOffset)
+	machine.Push(4)
+	if err := machine.Accept(); err == nil {
+		t.Error("Expected a buffer in device memory to be refused")
+	}
+
+	machine = NewVM(nil)
+	machine.Deterministic = true
+	machine.Push(0)
+	machine.Push(4)
+	if err := machine.Accept(); err == nil {
+		t.Error("Expected a deterministic VM without Stdin to refuse ACCEPT")
+	}
+}
+
+func TestToNumber(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int32
+		ok   int32
+	}{
+		{"42", 42, 1},
+		{" -17 ", -17, 1},
+		{"+5", 5, 1},
+		{"2147483647", 2147483647, 1},
+		{"2147483648", 0, 0},
+		{"12a", 0, 0},
+		{"0x10", 0, 0},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		machine := NewVM(nil)
+		machine.writeCells(0, []byte(tt.text))
+		machine.Push(0)
+		machine.Push(int32(len(tt.text)))
+		if err := machine.ToNumber(); err != nil {
+			t.Fatalf("%q: %v", tt.text, err)
+		}
+		if got := machine.Stack(); !reflect.DeepEqual(got, []int32{tt.n, tt.ok}) {
+			t.Errorf("%q: expected [%d %d], got %v", tt.text, tt.n, tt.ok, got)
+		}
+	}
+
+	machine := NewVM(nil)
+	machine.Push(DeviceMemoryOffset)
+	machine.Push(2)
+	if err := machine.ToNumber(); err == nil {
+		t.Error("Expected a string in device memory to be refused")
+	}
+}
@@ -0,0 +1,349 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// OperandKind is what follows an opcode in the code
+type OperandKind int
+
+const (
+	OperandNone    OperandKind = iota
+	OperandInt8                // 1 byte, sign-extended
+	OperandInt16               // 2 bytes, big-endian, sign-extended
+	OperandInt32               // 4 bytes, big-endian
+	OperandTarget              // A 4-byte code address to jump or call to
+	OperandAddress             // A 4-byte memory address to load or store
+	OperandHostID              // The 4-byte HostID of a host function
+	OperandTable               // count:uint16, default:int32, then count int32 targets
+)
+
+// OpcodeInfo describes an instruction. The table of them is the one
+// definition of the instruction set that OpcodeName, OpcodeDescription,
+// the disassembler, the assembler and docs/opcodes.md are all made from.
+type OpcodeInfo struct {
+	Opcode      byte
+	Name        string
+	Operand     OperandKind
+	Group       string         // The section of the reference it is listed under
+	Effect      string         // On the stack, top on the right, e.g. [a, b] → [a + b]
+	Description string         // Completes "NAME: ...", as Explain shows it
+	Notes       string         // More for the reference: errors, uses, caveats
+	Since       int            // The ISAVersion that added it
+	Changed     map[int]string // Later ISAVersions that changed what it does, and how
+
+	// Example is a listing that shows the instruction at work, which
+	// leaves Result on the stack and prints Output. A test runs each one.
+	Example []string
+	Result  string
+	Output  string
+}
+
+// isa lists every instruction, in opcode order
+var isa = []OpcodeInfo{
+	{Opcode: OpPush, Name: "PUSH", Operand: OperandInt32, Group: "Stack", Since: 1,
+		Effect: "[] → [value]", Description: "pushes a number onto the stack",
+		Notes:   "The compiler picks the smallest of PUSH8, PUSH16 and PUSH for each literal; quotation addresses, which are patched after placement, always use PUSH.",
+		Example: []string{"PUSH 100000"}, Result: "[100000]"},
+	{Opcode: OpPop, Name: "POP", Group: "Stack", Since: 1,
+		Effect: "[a] → []", Description: "drops the top of the stack",
+		Example: []string{"PUSH8 1", "PUSH8 2", "POP"}, Result: "[1]"},
+	{Opcode: OpDup, Name: "DUP", Group: "Stack", Since: 1,
+		Effect: "[a] → [a, a]", Description: "copies the top of the stack",
+		Example: []string{"PUSH8 5", "DUP"}, Result: "[5 5]"},
+	{Opcode: OpSwap, Name: "SWAP", Group: "Stack", Since: 1,
+		Effect: "[a, b] → [b, a]", Description: "swaps the top two values",
+		Example: []string{"PUSH8 1", "PUSH8 2", "SWAP"}, Result: "[2 1]"},
+	{Opcode: OpRoll, Name: "ROLL", Group: "Stack", Since: 1,
+		Effect: "[a, b] → [a, b, a]", Description: "copies the second value onto the top",
+		Notes:   "Forth calls this OVER.",
+		Example: []string{"PUSH8 1", "PUSH8 2", "ROLL"}, Result: "[1 2 1]"},
+	{Opcode: OpRot, Name: "ROT", Group: "Stack", Since: 1,
+		Effect: "[a, b, c] → [b, c, a]", Description: "moves the third value to the top",
+		Example: []string{"PUSH8 1", "PUSH8 2", "PUSH8 3", "ROT"}, Result: "[2 3 1]"},
+	{Opcode: OpAdd, Name: "ADD", Group: "Arithmetic", Since: 1,
+		Effect: "[a, b] → [a + b]", Description: "adds the top two values",
+		Notes:   "Arithmetic is 32-bit and wraps on overflow.",
+		Example: []string{"PUSH8 7", "PUSH8 2", "ADD"}, Result: "[9]"},
+	{Opcode: OpSub, Name: "SUB", Group: "Arithmetic", Since: 1,
+		Effect: "[a, b] → [a - b]", Description: "subtracts the top value from the one below it",
+		Example: []string{"PUSH8 7", "PUSH8 2", "SUB"}, Result: "[5]"},
+	{Opcode: OpMul, Name: "MUL", Group: "Arithmetic", Since: 1,
+		Effect: "[a, b] → [a * b]", Description: "multiplies the top two values",
+		Example: []string{"PUSH8 7", "PUSH8 2", "MUL"}, Result: "[14]"},
+	{Opcode: OpDiv, Name: "DIV", Group: "Arithmetic", Since: 1,
+		Effect: "[a, b] → [a / b]", Description: "divides the second value by the top value",
+		Notes:   "The quotient is truncated toward zero. Division by zero is an error.",
+		Example: []string{"PUSH8 -7", "PUSH8 2", "DIV"}, Result: "[-3]"},
+	{Opcode: OpMod, Name: "MOD", Group: "Arithmetic", Since: 1,
+		Effect: "[a, b] → [a % b]", Description: "takes the remainder of the second value divided by the top value",
+		Notes:   "The remainder has the sign of a. Modulus by zero is an error.",
+		Example: []string{"PUSH8 -7", "PUSH8 2", "MOD"}, Result: "[-1]"},
+	{Opcode: OpInc, Name: "INC", Group: "Arithmetic", Since: 1,
+		Effect: "[a] → [a + 1]", Description: "adds 1 to the top of the stack",
+		Example: []string{"PUSH8 7", "INC"}, Result: "[8]"},
+	{Opcode: OpDec, Name: "DEC", Group: "Arithmetic", Since: 1,
+		Effect: "[a] → [a - 1]", Description: "subtracts 1 from the top of the stack",
+		Example: []string{"PUSH8 7", "DEC"}, Result: "[6]"},
+	{Opcode: OpAnd, Name: "AND", Group: "Bitwise", Since: 1,
+		Effect: "[a, b] → [a & b]", Description: "bitwise AND of the top two values",
+		Example: []string{"PUSH8 12", "PUSH8 10", "AND"}, Result: "[8]"},
+	{Opcode: OpOr, Name: "OR", Group: "Bitwise", Since: 1,
+		Effect: "[a, b] → [a | b]", Description: "bitwise OR of the top two values",
+		Example: []string{"PUSH8 12", "PUSH8 10", "OR"}, Result: "[14]"},
+	{Opcode: OpXor, Name: "XOR", Group: "Bitwise", Since: 1,
+		Effect: "[a, b] → [a ^ b]", Description: "bitwise XOR of the top two values",
+		Example: []string{"PUSH8 12", "PUSH8 10", "XOR"}, Result: "[6]"},
+	{Opcode: OpNot, Name: "NOT", Group: "Bitwise", Since: 1,
+		Effect: "[a] → [~a]", Description: "flips every bit of the top of the stack",
+		Example: []string{"PUSH8 0", "NOT"}, Result: "[-1]"},
+	{Opcode: OpShl, Name: "SHL", Group: "Bitwise", Since: 1,
+		Effect: "[a, b] → [a << (b % 32)]", Description: "shifts the second value left by the top value",
+		Example: []string{"PUSH8 3", "PUSH8 4", "SHL"}, Result: "[48]"},
+	{Opcode: OpEq, Name: "EQ", Group: "Comparison", Since: 1,
+		Effect: "[a, b] → [a == b ? 1 : 0]", Description: "tests whether the top two values are equal (1 = yes, 0 = no)",
+		Notes:   "There is no JNZ opcode: to jump if a value is not zero, the compiler emits PUSH8 0, EQ, JZ.",
+		Example: []string{"PUSH8 4", "PUSH8 4", "EQ"}, Result: "[1]"},
+	{Opcode: OpLt, Name: "LT", Group: "Comparison", Since: 1,
+		Effect: "[a, b] → [a < b ? 1 : 0]", Description: "tests whether the second value is less than the top value (1 = yes, 0 = no)",
+		Notes:   "The comparison is signed. There is no GT opcode: the compiler turns > into SWAP, LT.",
+		Example: []string{"PUSH8 -1", "PUSH8 4", "LT"}, Result: "[1]"},
+	{Opcode: OpCallStack, Name: "CALLSTACK", Group: "Control flow", Since: 1,
+		Effect: "[addr] → []", Description: "calls the quotation whose address is on top of the stack",
+		Notes:   "The return address goes on the return stack, as with CALL. Quotations are called this way.",
+		Example: []string{"PUSH 0x4009", "CALLSTACK", "PUSH8 2", "HALT", "PUSH8 1", "RET"}, Result: "[1 2]"},
+	{Opcode: OpJmp, Name: "JMP", Operand: OperandTarget, Group: "Control flow", Since: 1,
+		Effect: "[] → []", Description: "jumps to an address",
+		Example: []string{"JMP 0x4007", "PUSH8 1", "PUSH8 2"}, Result: "[2]"},
+	{Opcode: OpJz, Name: "JZ", Operand: OperandTarget, Group: "Control flow", Since: 1,
+		Effect: "[cond] → []", Description: "pops a value and jumps if it is zero",
+		Example: []string{"PUSH8 0", "JZ 0x4009", "PUSH8 1", "PUSH8 2"}, Result: "[2]"},
+	{Opcode: OpCall, Name: "CALL", Operand: OperandTarget, Group: "Control flow", Since: 1,
+		Effect: "[] → []", Description: "calls a word, remembering where to return to",
+		Notes:   "The address after the CALL goes on the return stack for RET.",
+		Example: []string{"CALL 0x4008", "PUSH8 2", "HALT", "PUSH8 1", "RET"}, Result: "[1 2]"},
+	{Opcode: OpRet, Name: "RET", Group: "Control flow", Since: 1,
+		Effect: "[] → []", Description: "returns to the caller",
+		Notes: "RET with an empty return stack is an error."},
+	{Opcode: OpLoad, Name: "LOAD", Operand: OperandAddress, Group: "Memory", Since: 1,
+		Effect: "[] → [mem[addr]]", Description: "pushes the value stored at an address",
+		Notes:   "Memory is byte-addressed; LOAD and STORE move 4-byte big-endian cells.",
+		Example: []string{"PUSH8 42", "STORE 0x0100", "LOAD 0x0100"}, Result: "[42]"},
+	{Opcode: OpStore, Name: "STORE", Operand: OperandAddress, Group: "Memory", Since: 1,
+		Effect: "[value] → []", Description: "pops a value and stores it at an address",
+		Example: []string{"PUSH8 42", "STORE 0x0100"}, Result: "[]"},
+	{Opcode: OpOut, Name: "OUT", Group: "Input and output", Since: 1, Changed: map[int]string{15: "the error stream", 16: "field widths"},
+		Effect: "[value, format] → []", Description: "prints a value as a number or a character, to the output or error stream",
+		Notes:   "format is 0 for a number, 1 for a character, plus 2 for the error stream (ISA version 15). Bits 8 to 15 give a field width, up to 255, to pad to on the left with spaces, or with zeros after the sign for a number plus 4 (ISA version 16). Output is buffered until FLUSH, HALT or a full buffer; the error stream is not.",
+		Example: []string{"PUSH8 72", "PUSH8 1", "OUT", "PUSH8 42", "PUSH8 0", "OUT"}, Result: "[]", Output: "H42"},
+	{Opcode: OpHalt, Name: "HALT", Group: "System", Since: 1,
+		Effect: "[] → []", Description: "stops the program",
+		Example: []string{"PUSH8 1", "HALT", "PUSH8 2"}, Result: "[1]"},
+	{Opcode: OpYield, Name: "YIELD", Group: "System", Since: 1,
+		Effect: "[] → []", Description: "hands control to the host for a moment",
+		Notes: "Calls the VM's YieldHandler, if it has one, so the host can render a frame, sleep or read input. A deterministic VM does not call it."},
+	{Opcode: OpLoadI, Name: "LOADI", Group: "Memory", Since: 1,
+		Effect: "[addr] → [mem[addr]]", Description: "pops an address and pushes the value stored there",
+		Notes:   "Used for device registers and memory whose address is computed at run time.",
+		Example: []string{"PUSH8 42", "STORE 0x0100", "PUSH 0x0100", "LOADI"}, Result: "[42]"},
+	{Opcode: OpStoreI, Name: "STOREI", Group: "Memory", Since: 1,
+		Effect: "[value, addr] → []", Description: "pops an address and a value and stores the value there",
+		Example: []string{"PUSH8 42", "PUSH 0x0100", "STOREI", "LOAD 0x0100"}, Result: "[42]"},
+	{Opcode: OpToR, Name: ">R", Group: "Return stack", Since: 2,
+		Effect: "[a] → [], R: [] → [a]", Description: "moves the top of the stack to the return stack",
+		Notes:   "The compiler parks loop state this way while a |: or #: body runs.",
+		Example: []string{"PUSH8 1", "PUSH8 2", ">R", "PUSH8 3", "R>"}, Result: "[1 3 2]"},
+	{Opcode: OpFromR, Name: "R>", Group: "Return stack", Since: 2,
+		Effect: "[] → [a], R: [a] → []", Description: "moves the top of the return stack to the stack",
+		Example: []string{"PUSH8 2", ">R", "R>"}, Result: "[2]"},
+	{Opcode: OpRFetch, Name: "R@", Group: "Return stack", Since: 2,
+		Effect: "[] → [a], R unchanged", Description: "copies the top of the return stack to the stack",
+		Example: []string{"PUSH8 2", ">R", "R@", "R>"}, Result: "[2 2]"},
+	{Opcode: OpPush8, Name: "PUSH8", Operand: OperandInt8, Group: "Stack", Since: 3,
+		Effect: "[] → [value]", Description: "pushes a number onto the stack",
+		Notes:   "The value, from -128 to 127, is sign-extended to 32 bits.",
+		Example: []string{"PUSH8 -5"}, Result: "[-5]"},
+	{Opcode: OpPush16, Name: "PUSH16", Operand: OperandInt16, Group: "Stack", Since: 3,
+		Effect: "[] → [value]", Description: "pushes a number onto the stack",
+		Notes:   "The value, from -32768 to 32767, is sign-extended to 32 bits.",
+		Example: []string{"PUSH16 1000"}, Result: "[1000]"},
+	{Opcode: OpJmpTable, Name: "JMPTABLE", Operand: OperandTable, Group: "Control flow", Since: 4,
+		Effect: "[index] → []", Description: "pops an index and jumps to that entry of a table",
+		Notes:   "A negative index, or one past the table, jumps to the default. LUX CASE compiles to this when its keys are dense.",
+		Example: []string{"PUSH8 1", "JMPTABLE default 0x4015, 0x4011, 0x4013", "PUSH8 1", "PUSH8 2", "PUSH8 3"}, Result: "[2 3]"},
+	{Opcode: OpHost, Name: "HOST", Operand: OperandHostID, Group: "System", Since: 5,
+		Effect: "depends on the function", Description: "calls a function provided by the host program",
+		Notes: "The operand is the HostID of the name the host registered the function under. A call to one not registered, or whose capability is not granted, is an error."},
+	{Opcode: OpAfter, Name: "AFTER", Group: "Timers", Since: 6,
+		Effect: "[ms, quot] → []", Description: "pops a quotation and a delay in ms and runs the quotation once after the delay",
+		Notes: "The quotation runs between instructions once the delay has passed. A program that halts with timers pending waits for them."},
+	{Opcode: OpEvery, Name: "EVERY", Group: "Timers", Since: 6,
+		Effect: "[ms, quot] → []", Description: "pops a quotation and a period in ms and runs the quotation every period",
+		Notes: "A period of 0 is an error."},
+	{Opcode: OpFlush, Name: "FLUSH", Group: "Input and output", Since: 7,
+		Effect: "[] → []", Description: "writes out the buffered output",
+		Example: []string{"PUSH8 42", "PUSH8 0", "OUT", "FLUSH"}, Result: "[]", Output: "42"},
+	{Opcode: OpAccept, Name: "ACCEPT", Group: "Input and output", Since: 8,
+		Effect: "[addr, max] → [n]", Description: "pops a buffer and its size and reads a line of input into it",
+		Notes: "The line is stored one character per cell, without its newline, and cut at max characters. n is its length, or -1 at the end of input."},
+	{Opcode: OpToNumber, Name: ">NUMBER", Group: "Input and output", Since: 9,
+		Effect: "[addr, len] → [n, flag]", Description: "pops a string and pushes the number it spells and whether it is one",
+		Notes: "The string is one character per cell, as ACCEPT stores it. flag is 0, with n 0, if it is not a decimal number."},
+	{Opcode: OpDump, Name: "DUMP", Group: "Input and output", Since: 10,
+		Effect: "[addr, len] → []", Description: "pops an address and a length and prints a hex dump of that memory",
+		Notes: "Each line shows 16 bytes in hex and as ASCII."},
+	{Opcode: OpAssert, Name: "ASSERT", Group: "System", Since: 11,
+		Effect: "[flag, addr, len] → []", Description: "pops a flag and a message and fails with the message if the flag is 0",
+		Notes: "The message is one character per cell."},
+	{Opcode: OpAbort, Name: "ABORT", Group: "System", Since: 12,
+		Effect: "[addr, len] → []", Description: "pops a message, prints it to the error stream and stops the program",
+		Notes: "The program stops with ExitAborted, which nux exits with as its status."},
+	{Opcode: OpOutN, Name: "OUTN", Group: "Input and output", Since: 13,
+		Effect: "[n] → []", Description: "pops a count and prints that many values from the top of the stack, leaving them there",
+		Notes:   "The values are printed as numbers, deepest first, separated by spaces. A negative n prints the whole stack.",
+		Example: []string{"PUSH8 1", "PUSH8 2", "PUSH8 3", "PUSH8 2", "OUTN"}, Result: "[1 2 3]", Output: "2 3"},
+	{Opcode: OpOutCells, Name: "OUTCELLS", Group: "Input and output", Since: 13,
+		Effect: "[addr, len] → []", Description: "pops an address and a length and prints the cells stored there",
+		Notes:   "The cells are printed as numbers separated by spaces.",
+		Example: []string{"PUSH8 7", "STORE 0x0100", "PUSH8 9", "STORE 0x0104", "PUSH16 0x0100", "PUSH8 2", "OUTCELLS"}, Result: "[]", Output: "7 9"},
+	{Opcode: OpRDepth, Name: "RDEPTH", Group: "Return stack", Since: 14,
+		Effect: "[] → [n]", Description: "pushes how many values the return stack holds",
+		Notes:   "Each call under way holds one and >R one more. The return stack holds at most 1024, so a recursive word can stop short of overflowing it.",
+		Example: []string{"PUSH8 2", ">R", "RDEPTH", "R>"}, Result: "[1 2]"},
+	{Opcode: OpPCFetch, Name: "PC@", Group: "System", Since: 14,
+		Effect: "[] → [addr]", Description: "pushes the address of the PC@ instruction itself",
+		Notes: "A program can compare it with the addresses of its words, or report where it is."},
+	{Opcode: OpMemSize, Name: "MEMSIZE", Group: "System", Since: 14,
+		Effect: "[] → [n]", Description: "pushes the size of the address space in bytes",
+		Notes: "Every address below it can be loaded; the VM keeps no heap, so a program's memory ends with its data. A program checks an address it computes against it before storing there."},
+}
+
+// isaGroups is the order the reference lists the groups in
+var isaGroups = []string{"Stack", "Arithmetic", "Bitwise", "Comparison", "Control flow", "Memory", "Return stack", "Input and output", "Timers", "System"}
+
+var (
+	opcodeInfo   [256]*OpcodeInfo
+	opcodeByName = make(map[string]byte, len(isa))
+)
+
+func init() {
+	for i := range isa {
+		opcodeInfo[isa[i].Opcode] = &isa[i]
+		opcodeByName[isa[i].Name] = isa[i].Opcode
+	}
+}
+
+// Opcodes returns every instruction of the instruction set, in opcode order
+func Opcodes() []OpcodeInfo {
+	return append([]OpcodeInfo(nil), isa...)
+}
+
+// LookupOpcode returns what op is, and whether it is an instruction
+func LookupOpcode(op byte) (OpcodeInfo, bool) {
+	if info := opcodeInfo[op]; info != nil {
+		return *info, true
+	}
+	return OpcodeInfo{}, false
+}
+
+// OperandBytes is how many bytes the operand takes, or -1 for a jump
+// table, whose size depends on its count
+func (k OperandKind) OperandBytes() int {
+	switch k {
+	case OperandNone:
+		return 0
+	case OperandInt8:
+		return 1
+	case OperandInt16:
+		return 2
+	case OperandTable:
+		return -1
+	}
+	return 4
+}
+
+// encoding describes an instruction's bytes, as the reference shows them
+func (info OpcodeInfo) encoding() (format, size string) {
+	switch info.Operand {
+	case OperandNone:
+		return info.Name, "1 byte"
+	case OperandInt8:
+		return info.Name + " value", "2 bytes: opcode, 1-byte value"
+	case OperandInt16:
+		return info.Name + " value", "3 bytes: opcode, 2-byte value"
+	case OperandInt32:
+		return info.Name + " value", "5 bytes: opcode, 4-byte value"
+	case OperandTarget:
+		return info.Name + " target", "5 bytes: opcode, 4-byte code address"
+	case OperandAddress:
+		return info.Name + " addr", "5 bytes: opcode, 4-byte memory address"
+	case OperandHostID:
+		return info.Name + " id", "5 bytes: opcode, 4-byte host function ID"
+	}
+	return info.Name + " default t0 … t(count-1)", "7 + 4×count bytes: opcode, 2-byte count, 4-byte default, 4-byte targets"
+}
+
+// WriteOpcodeReference writes the reference to the instruction set in
+// Markdown: a table of the opcodes each ISA version added or changed, then each
+// instruction by group with its encoding, stack effect, description and
+// example, then a table of them all. It makes up most of docs/opcodes.md.
+func WriteOpcodeReference(w io.Writer) {
+	fmt.Fprintln(w, "| Version | Adds or changes |")
+	fmt.Fprintln(w, "|---------|-----------------|")
+	for v := 1; v <= ISAVersion; v++ {
+		var names []string
+		for _, info := range isa {
+			if info.Since == v {
+				names = append(names, fmt.Sprintf("`%s` (0x%02X)", info.Name, info.Opcode))
+			}
+			if change, ok := info.Changed[v]; ok {
+				names = append(names, fmt.Sprintf("`%s` (0x%02X): %s", info.Name, info.Opcode, change))
+			}
+		}
+		fmt.Fprintf(w, "| %d | %s |\n", v, strings.Join(names, ", "))
+	}
+
+	fmt.Fprintln(w, "\n## Opcodes")
+	for _, group := range isaGroups {
+		fmt.Fprintf(w, "\n### %s\n", group)
+		for _, info := range isa {
+			if info.Group != group {
+				continue
+			}
+			format, size := info.encoding()
+			fmt.Fprintf(w, "\n#### 0x%02X - %s\n", info.Opcode, info.Name)
+			fmt.Fprintf(w, "**Format**: `%s` (%s)  \n", format, size)
+			fmt.Fprintf(w, "**Action**: `%s`  \n", info.Effect)
+			fmt.Fprintf(w, "**Description**: %s%s.", strings.ToUpper(info.Description[:1]), info.Description[1:])
+			if info.Notes != "" {
+				fmt.Fprintf(w, " %s", info.Notes)
+			}
+			fmt.Fprintln(w)
+			if len(info.Example) > 0 {
+				fmt.Fprintf(w, "\n```\n%s\n```\n", strings.Join(info.Example, "\n"))
+				fmt.Fprintf(w, "Leaves `%s` on the stack", info.Result)
+				if info.Output != "" {
+					fmt.Fprintf(w, " and prints `%s`", info.Output)
+				}
+				fmt.Fprintln(w, ".")
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "\n## Complete Opcode Table")
+	fmt.Fprintln(w, "\n| Hex  | Name | Bytes | Stack Effect | Since |")
+	fmt.Fprintln(w, "|------|------|-------|--------------|-------|")
+	for _, info := range isa {
+		size := fmt.Sprint(1 + info.Operand.OperandBytes())
+		if info.Operand == OperandTable {
+			size = "7+4n"
+		}
+		effect := strings.ReplaceAll(info.Effect, "|", `\|`)
+		if strings.HasPrefix(effect, "[") {
+			effect = "`" + effect + "`"
+		}
+		fmt.Fprintf(w, "| 0x%02X | %s | %s | %s | %d |\n", info.Opcode, info.Name, size, effect, info.Since)
+	}
+}
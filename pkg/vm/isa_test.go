@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var updateDocs = flag.Bool("update", false, "Rewrite the generated part of docs/opcodes.md")
+
+func TestOpcodeTable(t *testing.T) {
+	latest := 0
+	for i, info := range isa {
+		if i > 0 && info.Opcode <= isa[i-1].Opcode {
+			t.Errorf("%s: opcodes are out of order", info.Name)
+		}
+		if op, ok := OpcodeByName(info.Name); !ok || op != info.Opcode {
+			t.Errorf("%s: OpcodeByName gives 0x%02X, %v", info.Name, op, ok)
+		}
+		if info.Effect == "" || info.Description == "" || !slices.Contains(isaGroups, info.Group) {
+			t.Errorf("%s: missing its effect, description or group", info.Name)
+		}
+		latest = max(latest, info.Since)
+		for v := range info.Changed {
+			if v <= info.Since {
+				t.Errorf("%s: changed in ISA version %d, before it was added", info.Name, v)
+			}
+			latest = max(latest, v)
+		}
+	}
+	if latest != ISAVersion {
+		t.Errorf("Expected the newest opcode or change to be from ISA version %d, got %d", ISAVersion, latest)
+	}
+	if _, ok := LookupOpcode(0xFF); ok || OpcodeName(0xFF) != "UNKNOWN(0xFF)" {
+		t.Error("Expected 0xFF not to be an opcode")
+	}
+}
+
+// Each example in the reference does what it says
+func TestOpcodeExamples(t *testing.T) {
+	for _, info := range isa {
+		if len(info.Example) == 0 {
+			continue
+		}
+		code, err := Assemble(strings.Join(info.Example, "\n") + "\nHALT")
+		if err != nil {
+			t.Errorf("%s: %v", info.Name, err)
+			continue
+		}
+		machine := NewVM(code)
+		output := machine.CaptureOutput()
+		if err := machine.Run(); err != nil {
+			t.Errorf("%s: %v", info.Name, err)
+			continue
+		}
+		if stack := fmt.Sprint(machine.Stack()); stack != info.Result {
+			t.Errorf("%s: expected the example to leave %s, got %s", info.Name, info.Result, stack)
+		}
+		if output.Stdout() != info.Output {
+			t.Errorf("%s: expected the example to print %q, got %q", info.Name, info.Output, output.Stdout())
+		}
+	}
+}
+
+// docs/opcodes.md has the reference WriteOpcodeReference writes. Run with
+// -update to rewrite it after changing the table.
+func TestOpcodeReference(t *testing.T) {
+	const path = "../../docs/opcodes.md"
+	const begin, end = "<!-- BEGIN GENERATED", "<!-- END GENERATED -->"
+	doc, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(doc)
+	from, to := strings.Index(text, begin), strings.Index(text, end)
+	if from < 0 || to < from {
+		t.Fatalf("%s has no generated section", path)
+	}
+	from += strings.Index(text[from:], "\n") + 1
+	var b bytes.Buffer
+	b.WriteString("\n")
+	WriteOpcodeReference(&b)
+	b.WriteString("\n")
+	if text[from:to] == b.String() {
+		return
+	}
+	if *updateDocs {
+		if err := os.WriteFile(path, []byte(text[:from]+b.String()+text[to:]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Errorf("%s is out of date with the opcode table; run go test ./pkg/vm -run TestOpcodeReference -update", path)
+}
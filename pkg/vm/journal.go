@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Journal records the side effects of a run, for reviewing what an
+// untrusted program did: everything OUT printed, every memory word it
+// wrote, every call it made into the host and any limit it hit. Set
+// VM.Journal before running; a nil Journal records nothing.
+type Journal struct {
+	Output    []OutputEvent
+	HostCalls []HostCall
+	Limit     *LimitError // Set by RunLimited when a limit stopped the run
+
+	writes map[uint32]int // Stores to each address
+	pc     uint32         // Address of the instruction being executed
+}
+
+// OutputEvent is one OUT instruction
+type OutputEvent struct {
+	PC     uint32 `json:"pc"`
+	Value  int32  `json:"value"`
+	Format int32  `json:"format"` // 0 = number, 1 = character, plus FormatError
+}
+
+// HostCall is one call from the program into the host: a YIELD, a read of
+// the keyboard or random number register, a sound or a new random seed
+type HostCall struct {
+	PC    uint32 `json:"pc"`
+	Call  string `json:"call"` // "yield", "keyboard", "rng", "rng-seed" or "sound"
+	Value int32  `json:"value"`
+}
+
+// WriteRange is a run of memory words the program stored to
+type WriteRange struct {
+	Start  uint32 `json:"start"`
+	End    uint32 `json:"end"`    // Exclusive
+	Writes int    `json:"writes"` // Stores into the range
+	Region string `json:"region"` // "reserved", "device" or "program"
+}
+
+// EffectsReport summarizes a Journal
+type EffectsReport struct {
+	Output    string       `json:"output"`               // What OUT printed, as the terminal would show it
+	ErrOutput string       `json:"err_output,omitempty"` // What OUT printed to the error stream
+	OutCount  int          `json:"out_count"`
+	Writes    []WriteRange `json:"writes"`
+	HostCalls []HostCall   `json:"host_calls"`
+	Limit     string       `json:"limit,omitempty"` // The limit that stopped the run, if any
+}
+
+// NewJournal returns an empty journal
+func NewJournal() *Journal {
+	return &Journal{writes: make(map[uint32]int)}
+}
+
+func (j *Journal) out(value, format int32) {
+	j.Output = append(j.Output, OutputEvent{PC: j.pc, Value: value, Format: format})
+}
+
+func (j *Journal) write(addr uint32) {
+	if j.writes == nil {
+		j.writes = make(map[uint32]int)
+	}
+	j.writes[addr]++
+}
+
+func (j *Journal) host(call string, value int32) {
+	j.HostCalls = append(j.HostCalls, HostCall{PC: j.pc, Call: call, Value: value})
+}
+
+// Report summarizes the journal. Stores to neighbouring or overlapping
+// words are merged into one range.
+func (j *Journal) Report() *EffectsReport {
+	r := &EffectsReport{OutCount: len(j.Output), Writes: []WriteRange{}, HostCalls: j.HostCalls}
+	if r.HostCalls == nil {
+		r.HostCalls = []HostCall{}
+	}
+	var out, errOut strings.Builder
+	for _, e := range j.Output {
+		w := &out
+		if e.Format&FormatError != 0 {
+			w = &errOut
+		}
+		w.Write(appendOutput(nil, e.Value, e.Format))
+	}
+	r.Output, r.ErrOutput = out.String(), errOut.String()
+
+	addrs := make([]uint32, 0, len(j.writes))
+	for addr := range j.writes {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(a, b int) bool { return addrs[a] < addrs[b] })
+	for _, addr := range addrs {
+		n := len(r.Writes)
+		region := memoryRegion(addr)
+		if n > 0 && addr <= r.Writes[n-1].End && r.Writes[n-1].Region == region {
+			r.Writes[n-1].End = max(r.Writes[n-1].End, addr+4)
+			r.Writes[n-1].Writes += j.writes[addr]
+			continue
+		}
+		r.Writes = append(r.Writes, WriteRange{Start: addr, End: addr + 4, Writes: j.writes[addr], Region: region})
+	}
+	if j.Limit != nil {
+		r.Limit = j.Limit.Error()
+	}
+	return r
+}
+
+// memoryRegion names the part of memory an address is in
+func memoryRegion(addr uint32) string {
+	switch {
+	case addr < DeviceMemoryOffset:
+		return "reserved"
+	case addr < UserMemoryOffset:
+		return "device"
+	default:
+		return "program"
+	}
+}
+
+// WriteReport prints the report for a reader reviewing the run
+func (r *EffectsReport) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "Output: %d OUT instructions, %d bytes\n", r.OutCount, len(r.Output)+len(r.ErrOutput))
+	if r.Output != "" {
+		fmt.Fprintf(w, "  %q\n", r.Output)
+	}
+	if r.ErrOutput != "" {
+		fmt.Fprintf(w, "  stderr %q\n", r.ErrOutput)
+	}
+	fmt.Fprintf(w, "Memory written: %d ranges\n", len(r.Writes))
+	for _, wr := range r.Writes {
+		fmt.Fprintf(w, "  0x%04X-0x%04X  %-8s %d stores\n", wr.Start, wr.End-1, wr.Region, wr.Writes)
+	}
+	fmt.Fprintf(w, "Host calls: %d\n", len(r.HostCalls))
+	for _, c := range r.HostCalls {
+		fmt.Fprintf(w, "  0x%04X  %-8s %d\n", c.PC, c.Call, c.Value)
+	}
+	if r.Limit != "" {
+		fmt.Fprintf(w, "Limit: %s\n", r.Limit)
+	} else {
+		fmt.Fprintln(w, "Limit: none hit")
+	}
+}
@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJournalRecordsEffects(t *testing.T) {
+	var code []byte
+	code = append(code, ShortPushInstruction(1)...)
+	code = append(code, StoreInstruction(0)...)
+	code = append(code, ShortPushInstruction(2)...)
+	code = append(code, StoreInstruction(4)...)
+	code = append(code, ShortPushInstruction(3)...)
+	code = append(code, StoreInstruction(AudioControlAddr)...)
+	code = append(code, ShortPushInstruction(72)...)
+	code = append(code, OutCharacter()...)
+	code = append(code, ShortPushInstruction(42)...)
+	code = append(code, OutNumber()...)
+	code = append(code, OpYield, OpHalt)
+
+	machine := NewVM(code)
+	machine.OutputHandler = func(value, format int32) {}
+	machine.Journal = NewJournal()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	report := machine.Journal.Report()
+	if report.Output != "H42" || report.OutCount != 2 {
+		t.Errorf("expected output \"H42\" from 2 OUTs, got %q from %d", report.Output, report.OutCount)
+	}
+	wantWrites := []WriteRange{
+		{Start: 0, End: 8, Writes: 2, Region: "reserved"},
+		{Start: AudioControlAddr, End: AudioControlAddr + 4, Writes: 1, Region: "device"},
+	}
+	if !reflect.DeepEqual(report.Writes, wantWrites) {
+		t.Errorf("expected writes %+v, got %+v", wantWrites, report.Writes)
+	}
+	if len(report.HostCalls) != 2 || report.HostCalls[0].Call != "sound" || report.HostCalls[0].Value != 3 ||
+		report.HostCalls[1].Call != "yield" {
+		t.Errorf("expected a sound then a yield, got %+v", report.HostCalls)
+	}
+	if pc := report.HostCalls[0].PC; pc != UserMemoryOffset+16 {
+		t.Errorf("expected the sound at the STORE at 0x%X, got 0x%X", UserMemoryOffset+16, pc)
+	}
+
+	var text bytes.Buffer
+	report.WriteReport(&text)
+	if !strings.Contains(text.String(), "Limit: none hit") {
+		t.Errorf("unexpected report:\n%s", text.String())
+	}
+}
+
+func TestJournalRecordsLimit(t *testing.T) {
+	machine := NewVM(spinProgram())
+	machine.Journal = NewJournal()
+	machine.RunLimited(Limits{MaxSteps: 100})
+	if report := machine.Journal.Report(); report.Limit == "" || !strings.Contains(report.Limit, LimitSteps) {
+		t.Errorf("expected the step limit in the report, got %q", report.Limit)
+	}
+}
@@ -0,0 +1,224 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Limits bounds a run. The zero value imposes none.
+type Limits struct {
+	MaxSteps  int64           // Instructions to execute before stopping; 0 means no limit
+	MaxTime   time.Duration   // Wall-clock time before stopping; 0 means no limit
+	Interrupt <-chan struct{} // A value (or a close) stops the run, e.g. on Ctrl-C
+	MaxCost   int64           // Budget in Costs units; 0 means no limit
+	Costs     *CostTable      // Weight of each opcode; nil uses DefaultCosts when MaxCost is set
+	MaxOutput int64           // Bytes OUT may write, to either stream, before stopping; 0 means no limit
+}
+
+// WithTimeout returns l with a wall-clock limit of d, however long each
+// instruction takes
+func (l Limits) WithTimeout(d time.Duration) Limits {
+	l.MaxTime = d
+	return l
+}
+
+// ErrTimeout matches, with errors.Is, the LimitError of a run stopped by
+// its time limit
+var ErrTimeout = errors.New("time limit exceeded")
+
+// Reasons a LimitError gives for stopping a run
+const (
+	LimitSteps     = "step limit"
+	LimitTime      = "time limit"
+	LimitInterrupt = "interrupt"
+	LimitCost      = "cost budget"
+	LimitOutput    = "output limit"
+)
+
+// LimitError reports a run stopped by its Limits. The VM is left at the
+// instruction it would have executed next, so the run can be resumed.
+type LimitError struct {
+	Reason  string // LimitSteps, LimitTime, LimitInterrupt, LimitCost or LimitOutput
+	Steps   int64  // Instructions executed before the run stopped
+	Elapsed time.Duration
+	Cost    int64 // Cost charged before the run stopped, when costs were metered
+}
+
+// Is reports whether target is ErrTimeout and e is a time limit
+func (e *LimitError) Is(target error) bool {
+	return target == ErrTimeout && e.Reason == LimitTime
+}
+
+func (e *LimitError) Error() string {
+	if e.Reason == LimitCost {
+		return fmt.Sprintf("stopped by %s after %d instructions costing %d", e.Reason, e.Steps, e.Cost)
+	}
+	return fmt.Sprintf("stopped by %s after %d instructions", e.Reason, e.Steps)
+}
+
+// limitCheckInterval is how many instructions run between checks of the
+// interrupt channel, which costs far more than a step
+const limitCheckInterval = 1024
+
+// Meter counts the instructions of one run against its Limits, for callers
+// that step the VM themselves
+type Meter struct {
+	limits Limits
+	steps  int64
+	start  time.Time
+	costs  *CostTable // nil when costs are not metered
+	cost   int64
+
+	// expired is set by a timer when MaxTime has passed, so every step can
+	// check it cheaply and a slow host call delays the stop by no more than
+	// itself. The timer also closes deadline, to wake a program waiting for
+	// AFTER or EVERY.
+	expired  atomic.Bool
+	deadline chan struct{}
+	timer    *time.Timer
+}
+
+// Start begins metering a run
+func (l Limits) Start() *Meter {
+	m := &Meter{limits: l, start: time.Now(), costs: l.Costs}
+	if m.costs == nil && l.MaxCost > 0 {
+		m.costs = DefaultCosts()
+	}
+	if l.MaxTime > 0 {
+		m.deadline = make(chan struct{})
+		m.timer = time.AfterFunc(l.MaxTime, func() {
+			m.expired.Store(true)
+			close(m.deadline)
+		})
+	}
+	return m
+}
+
+// Stop releases the timer of a MaxTime limit. RunMetered calls it when the
+// run ends; callers stepping the VM themselves call it when they are done.
+func (m *Meter) Stop() {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
+
+// sleep waits d on clock for a program's next timer, or returns a
+// *LimitError if the time limit passes or an interrupt arrives first. A
+// simulated clock is not woken early: it moves time forward at once.
+func (m *Meter) sleep(clock Clock, d time.Duration) error {
+	_, wall := clock.(wallClock)
+	if m == nil || !wall || (m.deadline == nil && m.limits.Interrupt == nil) {
+		clock.Sleep(d)
+		return nil
+	}
+	wake := time.NewTimer(d)
+	defer wake.Stop()
+	select {
+	case <-wake.C:
+		return nil
+	case <-m.deadline:
+		return m.stop(LimitTime)
+	case <-m.limits.Interrupt:
+		return m.stop(LimitInterrupt)
+	}
+}
+
+// Steps returns the instructions counted so far
+func (m *Meter) Steps() int64 {
+	return m.steps
+}
+
+// Cost returns the cost charged so far, 0 unless Limits set MaxCost or Costs
+func (m *Meter) Cost() int64 {
+	return m.cost
+}
+
+// Tick is called before each instruction. It counts the instruction, or
+// returns a *LimitError if the run must stop first.
+func (m *Meter) Tick() error {
+	if m.limits.MaxSteps > 0 && m.steps >= m.limits.MaxSteps {
+		return m.stop(LimitSteps)
+	}
+	if m.expired.Load() {
+		return m.stop(LimitTime)
+	}
+	if m.steps%limitCheckInterval == 0 && m.limits.Interrupt != nil {
+		select {
+		case <-m.limits.Interrupt:
+			return m.stop(LimitInterrupt)
+		default:
+		}
+	}
+	m.steps++
+	return nil
+}
+
+// TickOp is Tick for an instruction with opcode op, which also charges
+// the instruction's cost against the budget
+func (m *Meter) TickOp(op byte) error {
+	if m.costs == nil {
+		return m.Tick()
+	}
+	c := m.costs[op]
+	if m.limits.MaxCost > 0 && m.cost+c > m.limits.MaxCost {
+		return m.stop(LimitCost)
+	}
+	if err := m.Tick(); err != nil {
+		return err
+	}
+	m.cost += c
+	return nil
+}
+
+// TickVM is TickOp for the instruction at the VM's PC, which also stops
+// the run once the program has written Limits.MaxOutput bytes
+func (m *Meter) TickVM(vm *VM) error {
+	if m.limits.MaxOutput > 0 && vm.written >= m.limits.MaxOutput {
+		return m.stop(LimitOutput)
+	}
+	op, _ := vm.byteAt(vm.pc)
+	return m.TickOp(op)
+}
+
+func (m *Meter) stop(reason string) error {
+	return &LimitError{Reason: reason, Steps: m.steps, Elapsed: time.Since(m.start), Cost: m.cost}
+}
+
+// RunLimited runs the VM until it halts, fails, or reaches one of limits
+func (vm *VM) RunLimited(limits Limits) error {
+	return vm.RunMetered(limits.Start())
+}
+
+// RunMetered is RunLimited with a meter the caller keeps, to read the
+// steps and cost of the run afterwards
+func (vm *VM) RunMetered(meter *Meter) (err error) {
+	if vm.Deterministic && (meter.limits.MaxTime > 0 || meter.limits.Interrupt != nil) {
+		return fmt.Errorf("a deterministic run cannot have a time limit or an interrupt, which depend on the clock; limit its steps instead")
+	}
+	defer meter.Stop()
+	defer vm.Flush()
+	defer vm.recoverPanic(&err)
+	for vm.running || vm.PendingTimers() > 0 {
+		if !vm.running {
+			resumed, err := vm.awaitTimer(meter)
+			if limit, ok := err.(*LimitError); ok && vm.Journal != nil {
+				vm.Journal.Limit = limit
+			}
+			if !resumed || err != nil {
+				return err
+			}
+		}
+		if err := meter.TickVM(vm); err != nil {
+			if vm.Journal != nil {
+				vm.Journal.Limit = err.(*LimitError)
+			}
+			return err
+		}
+		if _, err := vm.Step(); err != nil {
+			return fmt.Errorf("error at PC=%d: %w", vm.pc, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// spinProgram loops forever: INC then JMP back to the INC
+func spinProgram() []byte {
+	code := append(ShortPushInstruction(0), OpInc)
+	return append(code, JmpInstruction(int32(UserMemoryOffset)+2)...)
+}
+
+func TestRunLimitedSteps(t *testing.T) {
+	machine := NewVM(spinProgram())
+	err := machine.RunLimited(Limits{MaxSteps: 101})
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Reason != LimitSteps {
+		t.Fatalf("Expected a step limit error, got %v", err)
+	}
+	if limit.Steps != 101 {
+		t.Errorf("Expected 101 steps, got %d", limit.Steps)
+	}
+	// PUSH8, then 50 rounds of INC JMP
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 50 {
+		t.Errorf("Expected [50], got %v", stack)
+	}
+
+	// The run resumes where it stopped
+	machine.RunLimited(Limits{MaxSteps: 2})
+	if stack := machine.Stack(); stack[0] != 51 {
+		t.Errorf("Expected 51 after resuming, got %v", stack)
+	}
+}
+
+func TestRunLimitedTime(t *testing.T) {
+	machine := NewVM(spinProgram())
+	err := machine.RunLimited(Limits{MaxTime: 20 * time.Millisecond})
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Reason != LimitTime {
+		t.Fatalf("Expected a time limit error, got %v", err)
+	}
+	if limit.Elapsed < 20*time.Millisecond {
+		t.Errorf("Stopped after %v, before the limit", limit.Elapsed)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	// Each step is a slow host call, so a check every so many steps would
+	// come far too late
+	code := append(HostInstruction("slow"), JmpInstruction(int32(UserMemoryOffset))...)
+	machine := NewVM(code)
+	machine.RegisterHost("slow", "test", func(*VM) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	start := time.Now()
+	err := machine.RunLimited(Limits{}.WithTimeout(30 * time.Millisecond))
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stopped after %v, long past the limit", elapsed)
+	}
+	if errors.Is(&LimitError{Reason: LimitSteps}, ErrTimeout) {
+		t.Error("Expected a step limit not to be a timeout")
+	}
+}
+
+func TestRunLimitedInterrupt(t *testing.T) {
+	interrupt := make(chan struct{}, 1)
+	interrupt <- struct{}{}
+	machine := NewVM(spinProgram())
+	err := machine.RunLimited(Limits{Interrupt: interrupt})
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Reason != LimitInterrupt {
+		t.Fatalf("Expected an interrupt, got %v", err)
+	}
+}
+
+func TestRunLimitedFinishes(t *testing.T) {
+	machine := NewVM(append(ShortPushInstruction(7), OpHalt))
+	if err := machine.RunLimited(Limits{MaxSteps: 2}); err != nil {
+		t.Fatalf("Expected the program to finish within its limit, got %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 7 {
+		t.Errorf("Expected [7], got %v", stack)
+	}
+}
+
+func TestRunLimitedCost(t *testing.T) {
+	machine := NewVM(spinProgram())
+	meter := Limits{MaxCost: 100}.Start()
+	err := machine.RunMetered(meter)
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Reason != LimitCost {
+		t.Fatalf("Expected a cost budget error, got %v", err)
+	}
+	// PUSH8 costs 1, then each round of INC (1) and JMP (2) costs 3:
+	// 33 rounds fit in 100, and the next INC would make 101
+	if limit.Cost != 100 || meter.Cost() != 100 {
+		t.Errorf("Expected a cost of 100, got %d (meter %d)", limit.Cost, meter.Cost())
+	}
+	if limit.Steps != 67 {
+		t.Errorf("Expected 67 steps, got %d", limit.Steps)
+	}
+	if stack := machine.Stack(); stack[0] != 33 {
+		t.Errorf("Expected 33, got %v", stack)
+	}
+}
+
+func TestRunLimitedCustomCosts(t *testing.T) {
+	costs := DefaultCosts()
+	costs[OpStore] = 50
+	program := append(ShortPushInstruction(1), StoreInstruction(0x100)...)
+	program = append(program, OpHalt)
+
+	meter := Limits{Costs: costs}.Start()
+	if err := NewVM(program).RunMetered(meter); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if meter.Cost() != 52 {
+		t.Errorf("Expected PUSH8 + STORE + HALT to cost 52, got %d", meter.Cost())
+	}
+
+	// Without a budget or a table, nothing is charged
+	meter = Limits{MaxSteps: 10}.Start()
+	NewVM(program).RunMetered(meter)
+	if meter.Cost() != 0 {
+		t.Errorf("Expected no cost without a table, got %d", meter.Cost())
+	}
+}
+
+func TestDefaultCosts(t *testing.T) {
+	costs := DefaultCosts()
+	if !(costs[OpAdd] < costs[OpStore] && costs[OpStore] < costs[OpHost]) {
+		t.Errorf("Expected ADD < STORE < HOST, got %d, %d, %d", costs[OpAdd], costs[OpStore], costs[OpHost])
+	}
+}
@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Perm is what a program may do with a region of memory
+type Perm uint8
+
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+	PermExec // Only enforced by a Strict VM
+)
+
+// String shows the permissions as rwx, with - for each one missing
+func (p Perm) String() string {
+	b := []byte("---")
+	for i, c := range "rwx" {
+		if p&(1<<i) != 0 {
+			b[i] = byte(c)
+		}
+	}
+	return string(b)
+}
+
+// MemoryRegion is a named range of the address space, from Start up to End
+type MemoryRegion struct {
+	Name  string
+	Start uint32
+	End   uint32
+	Perm  Perm
+}
+
+// deviceWindows are the device registers and buffers in device memory
+var deviceWindows = []MemoryRegion{
+	{"video", VideoFramebufferStart, VideoFramebufferEnd, PermRead | PermWrite},
+	{"keyboard", KeyboardStatusAddr, KeyboardStatusAddr + 1, PermRead},
+	{"audio", AudioControlAddr, AudioControlAddr + 1, PermRead | PermWrite},
+	{"rng", RNGDataAddr, RNGDataAddr + 4, PermRead | PermWrite},
+	{"frame vector", FrameVectorAddr, FrameVectorAddr + 4, PermRead | PermWrite},
+	{"audio samples", AudioSampleBufferAddr, AudioSampleBufferAddr + AudioSampleBufferByteSize, PermRead | PermWrite},
+}
+
+// MemoryMap describes the address space in address order: reserved
+// memory, with the routines a Strict VM may run split out of it, the
+// device windows, the code segment, the program's data and the word bodies
+// Redefine appended after it. The VM keeps no heap. Gaps between device
+// windows are not listed.
+func (vm *VM) MemoryMap() []MemoryRegion {
+	var regions []MemoryRegion
+	at := uint32(0)
+	routines := slices.Clone(vm.reservedCode)
+	slices.SortFunc(routines, func(a, b [2]uint32) int { return int(a[0]) - int(b[0]) })
+	for _, r := range routines {
+		if r[0] > at {
+			regions = append(regions, MemoryRegion{"reserved", at, r[0], PermRead | PermWrite})
+		}
+		regions = append(regions, MemoryRegion{"routine", r[0], r[1], PermRead | PermWrite | PermExec})
+		at = r[1]
+	}
+	if at < vm.reservedMemorySize {
+		regions = append(regions, MemoryRegion{"reserved", at, vm.reservedMemorySize, PermRead | PermWrite})
+	}
+	for _, w := range deviceWindows {
+		if w.Start >= vm.reservedMemorySize {
+			regions = append(regions, w)
+		}
+	}
+	// A shared program's code and data are in its read-only segment
+	code, data := PermRead|PermWrite|PermExec, PermRead|PermWrite
+	if len(vm.shared) > 0 {
+		code, data = PermRead|PermExec, PermRead
+	}
+	start, end := vm.CodeSegment()
+	regions = append(regions, MemoryRegion{"code", start, end, code})
+	dataEnd := uint32(vm.memSize())
+	if len(vm.redefined) > 0 {
+		dataEnd = vm.redefined[0][0]
+	}
+	if end < dataEnd {
+		regions = append(regions, MemoryRegion{"data", end, dataEnd, data})
+	}
+	for _, r := range vm.redefined {
+		regions = append(regions, MemoryRegion{"redefined", r[0], r[1], PermRead | PermWrite | PermExec})
+	}
+	return regions
+}
+
+// RegionAt returns the region of the memory map holding addr
+func (vm *VM) RegionAt(addr uint32) (MemoryRegion, bool) {
+	for _, r := range vm.MemoryMap() {
+		if addr >= r.Start && addr < r.End {
+			return r, true
+		}
+	}
+	return MemoryRegion{}, false
+}
+
+// WriteMemoryMap writes regions as a table, one a line
+func WriteMemoryMap(w io.Writer, regions []MemoryRegion) {
+	for _, r := range regions {
+		fmt.Fprintf(w, "0x%06X-0x%06X %s %8d %s\n", r.Start, r.End, r.Perm, r.End-r.Start, r.Name)
+	}
+}
@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryMap(t *testing.T) {
+	img := &Image{Code: []byte{OpHalt}, Data: []byte{1, 2, 3, 4}}
+	machine, err := NewVMForImage(img)
+	if err != nil {
+		t.Fatalf("NewVMForImage failed: %v", err)
+	}
+	if err := machine.InstallRoutine(0x100, []byte{OpRet}); err != nil {
+		t.Fatalf("InstallRoutine failed: %v", err)
+	}
+	regions := machine.MemoryMap()
+	for i := 1; i < len(regions); i++ {
+		if regions[i].Start < regions[i-1].End {
+			t.Errorf("Regions %v and %v overlap or are out of order", regions[i-1], regions[i])
+		}
+	}
+
+	tests := []struct {
+		addr uint32
+		name string
+		perm string
+	}{
+		{0, "reserved", "rw-"},
+		{0x100, "routine", "rwx"},
+		{0x101, "reserved", "rw-"},
+		{KeyboardStatusAddr, "keyboard", "r--"},
+		{UserMemoryOffset, "code", "rwx"},
+		{UserMemoryOffset + 1, "data", "rw-"},
+	}
+	for _, tt := range tests {
+		r, ok := machine.RegionAt(tt.addr)
+		if !ok || r.Name != tt.name || r.Perm.String() != tt.perm {
+			t.Errorf("At 0x%X expected %s %s, got %+v (%v)", tt.addr, tt.name, tt.perm, r, ok)
+		}
+	}
+	if _, ok := machine.RegionAt(UserMemoryOffset + 5); ok {
+		t.Error("Expected no region past the end of memory")
+	}
+
+	var out strings.Builder
+	WriteMemoryMap(&out, regions)
+	if !strings.Contains(out.String(), "0x004000-0x004001 rwx        1 code\n") {
+		t.Errorf("Unexpected memory map:\n%s", out.String())
+	}
+	if !strings.Contains(machine.DebugInfo(), "Memory Map:\n") {
+		t.Error("Expected DebugInfo to show the memory map")
+	}
+}
+
+func TestMemoryMapShared(t *testing.T) {
+	machine := NewSharedVM(NewSharedProgram([]byte{OpHalt}, []byte{0, 0, 0, 1}))
+	regions := machine.MemoryMap()
+	last := regions[len(regions)-2:]
+	want := []MemoryRegion{
+		{"code", UserMemoryOffset, UserMemoryOffset + 1, PermRead | PermExec},
+		{"data", UserMemoryOffset + 1, UserMemoryOffset + 5, PermRead},
+	}
+	if last[0] != want[0] || last[1] != want[1] {
+		t.Errorf("Expected a read-only shared program %v, got %v", want, last)
+	}
+}
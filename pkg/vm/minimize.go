@@ -0,0 +1,163 @@
+package vm
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// Minimize shrinks img's code for as long as keep still reports true for
+// the result, to turn a program that fails into a small reproducer of the
+// failure. It removes runs of instructions, halving their length down to
+// single instructions, and replaces pushed numbers with 0, until neither
+// finds anything more to take out. Jump targets, relocated addresses and
+// symbols after a removal move with the code; those into it point at what
+// follows, and a word removed whole loses its symbol. The image's relocations, or without them the addresses
+// AddressOperands finds, say which operands are addresses. keep should run
+// the program deterministically and under limits, since a removal can turn
+// a loop endless. The result is unsigned.
+func Minimize(img *Image, keep func(*Image) bool) *Image {
+	m := &minimizer{img: img, relocs: img.Relocs, keep: keep}
+	if m.relocs == nil {
+		m.relocs = AddressOperands(img.Code)
+	}
+	for m.remove() || m.simplify() {
+	}
+	small := *m.img
+	small.Signature, small.signed = nil, nil
+	if img.Relocs != nil {
+		small.Relocs = m.relocs
+	}
+	return &small
+}
+
+type minimizer struct {
+	img    *Image
+	relocs []uint32 // Offsets of the code's address operands
+	keep   func(*Image) bool
+}
+
+// remove takes out runs of instructions that keep allows, and reports
+// whether it took any
+func (m *minimizer) remove() bool {
+	removed := false
+	for size := max(len(instructionStarts(m.img.Code))/2, 1); size > 0; size /= 2 {
+		starts := instructionStarts(m.img.Code)
+		for i := 0; i < len(starts); {
+			end := len(m.img.Code)
+			if i+size < len(starts) {
+				end = starts[i+size]
+			}
+			if m.try(starts[i], end, nil) {
+				removed = true
+				starts = instructionStarts(m.img.Code)
+				continue
+			}
+			i += size
+		}
+	}
+	return removed
+}
+
+// simplify replaces pushes of numbers other than 0 with PUSH8 0, and
+// reports whether keep allowed any
+func (m *minimizer) simplify() bool {
+	simplified := false
+	starts := instructionStarts(m.img.Code)
+	for i := 0; i < len(starts); i++ {
+		at, code := starts[i], m.img.Code
+		end := len(code)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		switch code[at] {
+		case OpPush, OpPush8, OpPush16:
+		default:
+			continue
+		}
+		if slices.Contains(m.relocs, uint32(at+1)) || (code[at] == OpPush8 && code[at+1] == 0) {
+			continue
+		}
+		if m.try(at, end, []byte{OpPush8, 0}) {
+			simplified = true
+			starts = instructionStarts(m.img.Code)
+		}
+	}
+	return simplified
+}
+
+// try replaces code[start:end] with with, and keeps the change if keep
+// allows it
+func (m *minimizer) try(start, end int, with []byte) bool {
+	img, relocs := m.splice(start, end, with)
+	if !m.keep(img) {
+		return false
+	}
+	m.img, m.relocs = img, relocs
+	return true
+}
+
+// splice returns a copy of the image with code[start:end] replaced, and
+// the offsets of its address operands. Addresses past the replaced bytes
+// move with them and those into them point at start; operands in them are
+// gone.
+func (m *minimizer) splice(start, end int, with []byte) (*Image, []uint32) {
+	old := m.img.Code
+	delta := len(with) - (end - start)
+	code := slices.Concat(old[:start], with, old[end:])
+	base, _ := m.img.memoryLayout()
+	move := func(addr int32) int32 {
+		switch {
+		case addr >= int32(base)+int32(end):
+			return addr + int32(delta)
+		case addr >= int32(base)+int32(start):
+			return int32(base) + int32(start)
+		}
+		return addr
+	}
+	var relocs []uint32
+	for _, off := range m.relocs {
+		switch {
+		case int(off) >= start && int(off) < end:
+			continue
+		case int(off) >= end:
+			off = uint32(int(off) + delta)
+		}
+		if int(off)+4 > len(code) {
+			continue
+		}
+		addr := move(int32(binary.BigEndian.Uint32(code[off:])))
+		binary.BigEndian.PutUint32(code[off:], uint32(addr))
+		relocs = append(relocs, off)
+	}
+	img := *m.img
+	img.Code = code
+	img.Symbols = nil
+	for i, sym := range m.img.Symbols {
+		sym.Address = move(sym.Address)
+		// A word removed whole lands on the next one, which keeps the name
+		if i+1 < len(m.img.Symbols) && move(m.img.Symbols[i+1].Address) == sym.Address {
+			continue
+		}
+		img.Symbols = append(img.Symbols, sym)
+	}
+	img.Tables = slices.Clone(m.img.Tables)
+	for i := range img.Tables {
+		img.Tables[i].Address = move(img.Tables[i].Address)
+	}
+	return &img, relocs
+}
+
+// instructionStarts returns the offset of each instruction in code. Bytes
+// left over when an instruction's operands run past the end count as one.
+func instructionStarts(code []byte) []int {
+	var starts []int
+	for at := 0; at < len(code); {
+		starts = append(starts, at)
+		n := operandSize(code, at)
+		if n < 0 {
+			break
+		}
+		at += 1 + n
+	}
+	return starts
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// divides reports whether img still fails with a division by zero
+func divides(img *Image) bool {
+	machine, err := NewVMForImage(img)
+	if err != nil {
+		return false
+	}
+	machine.Deterministic = true
+	err = machine.RunLimited(Limits{MaxSteps: 1000})
+	return err != nil && strings.Contains(err.Error(), "division by zero")
+}
+
+func TestMinimize(t *testing.T) {
+	// PUSH 1, POP, CALL F, HALT, F: PUSH8 5, PUSH8 0, DIV, RET
+	code := append(PushInstruction(1), OpPop)
+	code = append(code, CallInstruction(int32(UserMemoryOffset)+12)...)
+	code = append(code, OpHalt, OpPush8, 5, OpPush8, 0, OpDiv, OpRet)
+	img := &Image{Code: code, Symbols: []Symbol{{Name: "F", Address: int32(UserMemoryOffset) + 12}}}
+	if !divides(img) {
+		t.Fatal("Expected the program to divide by zero")
+	}
+
+	small := Minimize(img, divides)
+	if want := []byte{OpPush8, 0, OpPush8, 0, OpDiv}; !bytes.Equal(small.Code, want) {
+		t.Errorf("Expected %v, got %v", want, small.Code)
+	}
+	if !divides(small) {
+		t.Error("Expected the minimized program to still divide by zero")
+	}
+	if small.Symbols[0].Address != int32(UserMemoryOffset) {
+		t.Errorf("Expected F to move to 0x%X, got 0x%X", UserMemoryOffset, small.Symbols[0].Address)
+	}
+}
+
+func TestMinimizeMovesTargets(t *testing.T) {
+	// PUSH8 1, POP, CALL F, HALT, F: RET; removing PUSH8 1 moves F
+	code := []byte{OpPush8, 1, OpPop}
+	code = append(code, CallInstruction(int32(UserMemoryOffset)+9)...)
+	code = append(code, OpHalt, OpRet)
+	m := &minimizer{img: &Image{Code: code}, relocs: AddressOperands(code)}
+	img, relocs := m.splice(0, 2, nil)
+	want := append([]byte{OpPop}, CallInstruction(int32(UserMemoryOffset)+7)...)
+	if want = append(want, OpHalt, OpRet); !bytes.Equal(img.Code, want) {
+		t.Errorf("Expected %v, got %v", want, img.Code)
+	}
+	if len(relocs) != 1 || relocs[0] != 2 {
+		t.Errorf("Expected the CALL's operand at offset 2, got %v", relocs)
+	}
+}
@@ -0,0 +1,236 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// CapabilityNetwork is the capability the HTTP and TCP host functions need
+const CapabilityNetwork = "network"
+
+// NetworkOptions configures the network host functions
+type NetworkOptions struct {
+	Timeout time.Duration // Per request or connection; 0 means 10 seconds
+	Client  *http.Client  // Used for HTTP; nil means one with Timeout
+}
+
+// RegisterNetwork offers HTTP and TCP clients to LUX code, under the network
+// capability. Nothing is reachable until a host calls this, and a VM from
+// NewVMWithCapabilities must also be granted "network".
+//
+// Text passes through memory one character per cell, so LUX code can build
+// and read it with storei and loadi. A string is an address and a count of
+// cells; a buffer is an address and the most cells it may receive.
+//
+//	HTTP-GET  ( url len buf max -- n status )
+//	HTTP-POST ( url len body blen buf max -- n status )
+//	TCP-OPEN  ( addr len -- handle )     addr is "host:port"; handle is -1 on failure
+//	TCP-SEND  ( handle addr len -- n )   n is -1 on failure
+//	TCP-RECV  ( handle buf max -- n )    n is 0 at end of stream, -1 on failure
+//	TCP-CLOSE ( handle -- )
+//
+// The HTTP functions write up to max cells of the response body into buf
+// and push how many they wrote and the status code, which is 0 when no
+// response arrived. Network failures are reported on the stack, not as
+// errors, so scripts can retry; bad addresses and counts stop the run.
+// Connections still open when the run ends stay open until Close.
+func (vm *VM) RegisterNetwork(opts NetworkOptions) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: opts.Timeout}
+	}
+	conns := make(map[int32]net.Conn)
+	var nextHandle int32
+	vm.closers = append(vm.closers, func() {
+		for handle, conn := range conns {
+			conn.Close()
+			delete(conns, handle)
+		}
+	})
+
+	request := func(m *VM, method, url string, body []byte, buf, max int32) error {
+		if err := m.checkCells(buf, max); err != nil {
+			return err
+		}
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return pushAll(m, 0, 0)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return pushAll(m, 0, 0)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(io.LimitReader(resp.Body, int64(max)))
+		if err != nil {
+			return pushAll(m, 0, 0)
+		}
+		n := m.writeCells(buf, data)
+		return pushAll(m, n, int32(resp.StatusCode))
+	}
+
+	vm.RegisterHost("HTTP-GET", CapabilityNetwork, func(m *VM) error {
+		args, err := popArgs(m, 4)
+		if err != nil {
+			return err
+		}
+		url, err := m.readCells(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return request(m, http.MethodGet, string(url), nil, args[2], args[3])
+	})
+	vm.RegisterHost("HTTP-POST", CapabilityNetwork, func(m *VM) error {
+		args, err := popArgs(m, 6)
+		if err != nil {
+			return err
+		}
+		url, err := m.readCells(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		body, err := m.readCells(args[2], args[3])
+		if err != nil {
+			return err
+		}
+		return request(m, http.MethodPost, string(url), body, args[4], args[5])
+	})
+	vm.RegisterHost("TCP-OPEN", CapabilityNetwork, func(m *VM) error {
+		args, err := popArgs(m, 2)
+		if err != nil {
+			return err
+		}
+		addr, err := m.readCells(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		conn, err := net.DialTimeout("tcp", string(addr), opts.Timeout)
+		if err != nil {
+			return m.Push(-1)
+		}
+		nextHandle++
+		conns[nextHandle] = conn
+		return m.Push(nextHandle)
+	})
+	vm.RegisterHost("TCP-SEND", CapabilityNetwork, func(m *VM) error {
+		args, err := popArgs(m, 3)
+		if err != nil {
+			return err
+		}
+		conn, ok := conns[args[0]]
+		if !ok {
+			return fmt.Errorf("no open connection with handle %d", args[0])
+		}
+		data, err := m.readCells(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		conn.SetWriteDeadline(time.Now().Add(opts.Timeout))
+		n, err := conn.Write(data)
+		if err != nil {
+			return m.Push(-1)
+		}
+		return m.Push(int32(n))
+	})
+	vm.RegisterHost("TCP-RECV", CapabilityNetwork, func(m *VM) error {
+		args, err := popArgs(m, 3)
+		if err != nil {
+			return err
+		}
+		conn, ok := conns[args[0]]
+		if !ok {
+			return fmt.Errorf("no open connection with handle %d", args[0])
+		}
+		if err := m.checkCells(args[1], args[2]); err != nil {
+			return err
+		}
+		data := make([]byte, args[2])
+		conn.SetReadDeadline(time.Now().Add(opts.Timeout))
+		n, err := conn.Read(data)
+		if err == io.EOF {
+			return m.Push(0)
+		}
+		if err != nil {
+			return m.Push(-1)
+		}
+		return m.Push(m.writeCells(args[1], data[:n]))
+	})
+	vm.RegisterHost("TCP-CLOSE", CapabilityNetwork, func(m *VM) error {
+		handle, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		if conn, ok := conns[handle]; ok {
+			conn.Close()
+			delete(conns, handle)
+		}
+		return nil
+	})
+}
+
+// popArgs pops n values and returns them in the order they were pushed
+func popArgs(vm *VM, n int) ([]int32, error) {
+	if len(vm.stack) < n {
+		return nil, fmt.Errorf("stack underflow: need %d values", n)
+	}
+	args := make([]int32, n)
+	for i := n - 1; i >= 0; i-- {
+		args[i], _ = vm.Pop()
+	}
+	return args, nil
+}
+
+func pushAll(vm *VM, values ...int32) error {
+	for _, v := range values {
+		if err := vm.Push(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCells checks that count cells from addr lie in memory outside the
+// device region
+func (vm *VM) checkCells(addr, count int32) error {
+	end := int64(addr) + 4*int64(count)
+	if addr < 0 || count < 0 || end > int64(len(vm.memory)) {
+		return fmt.Errorf("buffer of %d cells at %d is out of bounds", count, addr)
+	}
+	if int64(addr) < UserMemoryOffset && end > DeviceMemoryOffset {
+		return fmt.Errorf("buffer of %d cells at %d overlaps device memory", count, addr)
+	}
+	return nil
+}
+
+// readCells reads a string stored one character per cell
+func (vm *VM) readCells(addr, count int32) ([]byte, error) {
+	if err := vm.checkCells(addr, count); err != nil {
+		return nil, err
+	}
+	data := make([]byte, count)
+	for i := range data {
+		cell, _ := vm.span(uint32(addr)+uint32(i)*4, 4)
+		data[i] = byte(binary.BigEndian.Uint32(cell))
+	}
+	return data, nil
+}
+
+// writeCells stores data one byte per cell from addr, which checkCells has
+// checked has room, and returns the number of cells written
+func (vm *VM) writeCells(addr int32, data []byte) int32 {
+	vm.writing(uint32(addr), uint32(len(data))*4)
+	for i, b := range data {
+		at := uint32(addr) + uint32(i)*4
+		binary.BigEndian.PutUint32(vm.memory[at:at+4], uint32(b))
+		vm.wrote(at)
+	}
+	return int32(len(data))
+}
@@ -0,0 +1,180 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// putCells stores s one character per cell at addr
+func putCells(vm *VM, addr int32, s string) {
+	for i := 0; i < len(s); i++ {
+		vm.memory[int(addr)+i*4+3] = s[i]
+	}
+}
+
+// networkProgram pushes args, calls the host function name and halts
+func networkProgram(name string, args ...int32) []byte {
+	var code []byte
+	for _, a := range args {
+		code = append(code, PushInstruction(a)...)
+	}
+	code = append(code, HostInstruction(name)...)
+	return append(code, OpHalt)
+}
+
+func TestHTTPGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Method)
+	}))
+	defer server.Close()
+
+	url := server.URL
+	machine := NewVMWithCapabilities(networkProgram("http-get", 0x100, int32(len(url)), 0x400, 5), CapabilityNetwork)
+	putCells(machine, 0x100, url)
+	machine.RegisterNetwork(NetworkOptions{})
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := machine.Stack(); len(got) != 2 || got[0] != 5 || got[1] != 200 {
+		t.Fatalf("Expected [5 200], got %v", got)
+	}
+	body, _ := machine.readCells(0x400, 5)
+	if string(body) != "hello" {
+		t.Errorf("Expected the body truncated to \"hello\", got %q", body)
+	}
+
+	machine = NewVMWithCapabilities(networkProgram("http-get", 0x100, int32(len(url)), 0x400, 5))
+	machine.RegisterNetwork(NetworkOptions{})
+	var perm *PermissionError
+	if err := machine.Run(); !errors.As(err, &perm) {
+		t.Errorf("Expected a PermissionError without the network capability, got %v", err)
+	}
+}
+
+func TestHTTPPost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	url := server.URL
+	machine := NewVM(networkProgram("http-post", 0x100, int32(len(url)), 0x300, 2, 0x400, 10))
+	putCells(machine, 0x100, url)
+	putCells(machine, 0x300, "hi")
+	machine.RegisterNetwork(NetworkOptions{})
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := machine.Stack(); len(got) != 2 || got[0] != 2 || got[1] != 201 {
+		t.Fatalf("Expected [2 201], got %v", got)
+	}
+	if body, _ := machine.readCells(0x400, 2); string(body) != "hi" {
+		t.Errorf("Expected the echoed body, got %q", body)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 16)
+		n, _ := conn.Read(buf)
+		conn.Write(buf[:n])
+	}()
+
+	addr := listener.Addr().String()
+	var code []byte
+	code = append(code, PushInstruction(0x100)...)
+	code = append(code, PushInstruction(int32(len(addr)))...)
+	code = append(code, HostInstruction("tcp-open")...) // handle
+	code = append(code, OpDup)
+	code = append(code, PushInstruction(0x300)...)
+	code = append(code, PushInstruction(4)...)
+	code = append(code, HostInstruction("tcp-send")...) // handle sent
+	code = append(code, OpSwap, OpDup)
+	code = append(code, PushInstruction(0x400)...)
+	code = append(code, PushInstruction(16)...)
+	code = append(code, HostInstruction("tcp-recv")...) // sent handle received
+	code = append(code, OpSwap)
+	code = append(code, HostInstruction("tcp-close")...) // sent received
+	code = append(code, OpHalt)
+
+	machine := NewVM(code)
+	putCells(machine, 0x100, addr)
+	putCells(machine, 0x300, "ping")
+	machine.RegisterNetwork(NetworkOptions{})
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := machine.Stack(); len(got) != 2 || got[0] != 4 || got[1] != 4 {
+		t.Fatalf("Expected [4 4], got %v", got)
+	}
+	if reply, _ := machine.readCells(0x400, 4); string(reply) != "ping" {
+		t.Errorf("Expected the echo \"ping\", got %q", reply)
+	}
+}
+
+func TestCloseAfterHaltWithConnectionOpen(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	closed := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			closed <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+
+	addr := listener.Addr().String()
+	code := networkProgram("tcp-open", 0x100, int32(len(addr)))
+	machine := NewVM(code)
+	putCells(machine, 0x100, addr)
+	machine.RegisterNetwork(NetworkOptions{})
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := machine.Stack(); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("Expected handle [1], got %v", got)
+	}
+	select {
+	case err := <-closed:
+		t.Fatalf("Connection ended before Close: %v", err)
+	default:
+	}
+
+	machine.Close()
+	if err := <-closed; err != io.EOF {
+		t.Errorf("Expected the server to see EOF after Close, got %v", err)
+	}
+}
+
+func TestNetworkBounds(t *testing.T) {
+	machine := NewVM(networkProgram("http-get", 0x100, 4, int32(DeviceMemoryOffset), 4))
+	machine.RegisterNetwork(NetworkOptions{})
+	if err := machine.Run(); err == nil {
+		t.Error("Expected a buffer in device memory to be refused")
+	}
+}
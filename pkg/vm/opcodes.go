@@ -3,9 +3,31 @@ package vm
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
-// Opcode constants — 32 opcodes, 0x00–0x1F.
+// ISAVersion identifies the instruction set this VM implements. Bump it
+// whenever an opcode is added or changes meaning.
+//
+//	1: core set 0x00–0x1F
+//	2: return stack transfer (>R, R>, R@)
+//	3: short pushes (PUSH8, PUSH16)
+//	4: jump tables (JMPTABLE)
+//	5: host function calls (HOST)
+//	6: timers (AFTER, EVERY)
+//	7: buffered output (FLUSH)
+//	8: line input (ACCEPT)
+//	9: number parsing (>NUMBER)
+//	10: memory dumps (DUMP)
+//	11: assertions (ASSERT)
+//	12: aborting with a message (ABORT)
+//	13: printing several values (OUTN, OUTCELLS)
+//	14: introspection (RDEPTH, PC@, MEMSIZE)
+//	15: OUT's error stream (FormatError)
+//	16: OUT's field widths (FormatWidth, FormatZero)
+const ISAVersion = 16
+
+// Opcode constants — 0x00–0x1F are the core set, 0x20 onward are extensions.
 const (
 	OpPush      = 0x00
 	OpPop       = 0x01
@@ -39,78 +61,58 @@ const (
 	OpYield     = 0x1D // Yield to host; triggers YieldHandler if set
 	OpLoadI     = 0x1E // Pop addr from stack, push memory[addr]
 	OpStoreI    = 0x1F // Pop addr from stack, pop value, store value at addr
+	OpToR       = 0x20 // Pop data stack, push onto return stack
+	OpFromR     = 0x21 // Pop return stack, push onto data stack
+	OpRFetch    = 0x22 // Copy top of return stack onto data stack
+	OpPush8     = 0x23 // PUSH8 value: 1-byte operand, sign-extended
+	OpPush16    = 0x24 // PUSH16 value: 2-byte big-endian operand, sign-extended
+	OpJmpTable  = 0x25 // JMPTABLE count:uint16 default:int32 targets:int32*count; pops an index
+	OpHost      = 0x26 // HOST id:uint32; calls the host function registered under HostID(name)
+	OpAfter     = 0x27 // Pop quotation address, pop ms; run the quotation once after ms
+	OpEvery     = 0x28 // Pop quotation address, pop ms; run the quotation every ms
+	OpFlush     = 0x29 // Write buffered output to Stdout
+	OpAccept    = 0x2A // Pop max, pop addr; read a line into addr, push its length or -1
+	OpToNumber  = 0x2B // Pop len, pop addr; push the number the string spells and a success flag
+	OpDump      = 0x2C // Pop len, pop addr; print a hex dump of the memory
+	OpAssert    = 0x2D // Pop len, pop addr, pop flag; fail with the message at addr if flag is 0
+	OpAbort     = 0x2E // Pop len, pop addr; print the message at addr to stderr and stop with ExitAborted
+	OpOutN      = 0x2F // Pop n; print the top n values, or the whole stack if n is negative
+	OpOutCells  = 0x30 // Pop len, pop addr; print the len cells at addr
+	OpRDepth    = 0x31 // Push the depth of the return stack
+	OpPCFetch   = 0x32 // Push the address of this instruction
+	OpMemSize   = 0x33 // Push the size of the address space in bytes
+)
+
+// OUT formats. FormatError is added to either to write to the error stream.
+// A field width from FormatWidth pads what is printed on the left to that
+// many characters, with spaces, or for a number with FormatZero with zeros
+// after its sign.
+const (
+	FormatNumber   = 0
+	FormatChar     = 1
+	FormatError    = 2
+	FormatZero     = 4
+	MaxOutputWidth = 255 // The widest field FormatWidth takes
 )
 
+// FormatWidth returns the bits of an OUT format that ask for a field of
+// width characters
+func FormatWidth(width int) int32 {
+	return int32(width) << 8
+}
+
 // OpcodeName returns the human-readable name for an opcode.
 func OpcodeName(op byte) string {
-	switch op {
-	case OpPush:
-		return "PUSH"
-	case OpPop:
-		return "POP"
-	case OpDup:
-		return "DUP"
-	case OpSwap:
-		return "SWAP"
-	case OpRoll:
-		return "ROLL"
-	case OpRot:
-		return "ROT"
-	case OpAdd:
-		return "ADD"
-	case OpSub:
-		return "SUB"
-	case OpMul:
-		return "MUL"
-	case OpDiv:
-		return "DIV"
-	case OpMod:
-		return "MOD"
-	case OpInc:
-		return "INC"
-	case OpDec:
-		return "DEC"
-	case OpAnd:
-		return "AND"
-	case OpOr:
-		return "OR"
-	case OpXor:
-		return "XOR"
-	case OpNot:
-		return "NOT"
-	case OpShl:
-		return "SHL"
-	case OpEq:
-		return "EQ"
-	case OpLt:
-		return "LT"
-	case OpCallStack:
-		return "CALLSTACK"
-	case OpJmp:
-		return "JMP"
-	case OpJz:
-		return "JZ"
-	case OpCall:
-		return "CALL"
-	case OpRet:
-		return "RET"
-	case OpLoad:
-		return "LOAD"
-	case OpStore:
-		return "STORE"
-	case OpOut:
-		return "OUT"
-	case OpHalt:
-		return "HALT"
-	case OpYield:
-		return "YIELD"
-	case OpLoadI:
-		return "LOADI"
-	case OpStoreI:
-		return "STOREI"
-	default:
-		return fmt.Sprintf("UNKNOWN(0x%02X)", op)
+	if info := opcodeInfo[op]; info != nil {
+		return info.Name
 	}
+	return fmt.Sprintf("UNKNOWN(0x%02X)", op)
+}
+
+// OpcodeByName is the inverse of OpcodeName for the defined opcodes
+func OpcodeByName(name string) (byte, bool) {
+	op, ok := opcodeByName[name]
+	return op, ok
 }
 
 // Helper functions for building programs
@@ -127,6 +129,25 @@ func PushInstruction(value int32) []byte {
 	return append([]byte{OpPush}, EncodeInt32(value)...)
 }
 
+// ShortPushInstruction creates the smallest PUSH, PUSH16 or PUSH8 that
+// encodes value. Use PushInstruction where the operand is patched later.
+func ShortPushInstruction(value int32) []byte {
+	return AppendShortPush(nil, value)
+}
+
+// AppendShortPush appends the instruction ShortPushInstruction would
+// create to dst, without allocating a separate slice
+func AppendShortPush(dst []byte, value int32) []byte {
+	switch {
+	case value >= math.MinInt8 && value <= math.MaxInt8:
+		return append(dst, OpPush8, byte(int8(value)))
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(dst, OpPush16), uint16(int16(value)))
+	default:
+		return binary.BigEndian.AppendUint32(append(dst, OpPush), uint32(value))
+	}
+}
+
 // JmpInstruction creates a JMP instruction to the given address.
 func JmpInstruction(addr int32) []byte {
 	return append([]byte{OpJmp}, EncodeInt32(addr)...)
@@ -137,6 +158,23 @@ func JzInstruction(addr int32) []byte {
 	return append([]byte{OpJz}, EncodeInt32(addr)...)
 }
 
+// JmpTableInstruction creates a JMPTABLE that jumps to targets[index], or to
+// def when the popped index is out of range.
+func JmpTableInstruction(def int32, targets []int32) []byte {
+	buf := []byte{OpJmpTable, 0, 0}
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(targets)))
+	buf = append(buf, EncodeInt32(def)...)
+	for _, t := range targets {
+		buf = append(buf, EncodeInt32(t)...)
+	}
+	return buf
+}
+
+// HostInstruction creates a HOST instruction calling the named host function.
+func HostInstruction(name string) []byte {
+	return append([]byte{OpHost}, EncodeInt32(int32(HostID(name)))...)
+}
+
 // CallInstruction creates a CALL instruction to the given address.
 func CallInstruction(addr int32) []byte {
 	return append([]byte{OpCall}, EncodeInt32(addr)...)
@@ -161,3 +199,13 @@ func OutNumber() []byte {
 func OutCharacter() []byte {
 	return append(PushInstruction(1), OpOut)
 }
+
+// ErrNumber emits bytecode to output top of stack as a number on the error stream.
+func ErrNumber() []byte {
+	return append(PushInstruction(FormatNumber|FormatError), OpOut)
+}
+
+// ErrCharacter emits bytecode to output top of stack as a character on the error stream.
+func ErrCharacter() []byte {
+	return append(PushInstruction(FormatChar|FormatError), OpOut)
+}
@@ -0,0 +1,176 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+)
+
+// PoisonError reports a poison value, one of Tracer.Poison, reaching an
+// arithmetic instruction, and where the value came from
+type PoisonError struct {
+	Value      int32
+	PC         uint32 // The arithmetic instruction that took it
+	Opcode     byte
+	Word       string // The word PC is in, "" if unknown
+	Origin     uint32 // The instruction that produced it
+	OriginOp   byte
+	OriginWord string
+	Known      bool // Whether Origin is known; a value already on the stack when tracing began has none
+}
+
+func (e *PoisonError) Error() string {
+	at := func(op byte, pc uint32, word string) string {
+		if word != "" {
+			return fmt.Sprintf("%s at 0x%X in %s", OpcodeName(op), pc, word)
+		}
+		return fmt.Sprintf("%s at 0x%X", OpcodeName(op), pc)
+	}
+	msg := fmt.Sprintf("poison value %d reached %s", e.Value, at(e.Opcode, e.PC, e.Word))
+	if !e.Known {
+		return msg + ", from before tracing began"
+	}
+	return msg + ", produced by " + at(e.OriginOp, e.Origin, e.OriginWord)
+}
+
+// noOrigin marks a value whose producer the tracer did not see
+const noOrigin = ^uint32(0)
+
+// poisonMoves are the opcodes that move or copy a value without computing
+// a new one, so a poison value they push keeps its origin
+var poisonMoves = map[byte]bool{OpDup: true, OpSwap: true, OpRoll: true, OpRot: true}
+
+// checkPoison fails if the instruction op at pc is arithmetic and takes a
+// poison value
+func (t *Tracer) checkPoison(machine *VM, pc uint32, op byte) error {
+	if info, ok := LookupOpcode(op); !ok || info.Group != "Arithmetic" {
+		return nil
+	}
+	s := machine.stack
+	for i := max(len(s)-len(stackInputs(op)), 0); i < len(s); i++ {
+		if !slices.Contains(t.Poison, s[i]) {
+			continue
+		}
+		e := &PoisonError{Value: s[i], PC: pc, Opcode: op}
+		symbols := DebugOptions{Symbols: t.Symbols}
+		if sym, ok := symbols.wordAt(pc); ok {
+			e.Word = sym.Name
+		}
+		if origin := t.origins[i]; origin != noOrigin {
+			e.Origin, e.Known = origin, true
+			e.OriginOp, _ = machine.byteAt(origin)
+			if sym, ok := symbols.wordAt(origin); ok {
+				e.OriginWord = sym.Name
+			}
+		}
+		return e
+	}
+	return nil
+}
+
+// stepPoison executes the instruction at PC through step, failing first if
+// it is arithmetic on a poison value, and then notes the PC that produced
+// each poison value it leaves on the stacks or in memory
+func (t *Tracer) stepPoison(machine *VM, step func() (bool, error)) (bool, error) {
+	pc := machine.pc
+	op, _ := machine.byteAt(pc)
+	t.origins = fitOrigins(t.origins, len(machine.stack))
+	t.rOrigins = fitOrigins(t.rOrigins, len(machine.returnStack))
+	if t.memOrigins == nil {
+		t.memOrigins = make(map[uint32]uint32)
+	}
+	if err := t.checkPoison(machine, pc, op); err != nil {
+		return false, err
+	}
+
+	before := slices.Clone(machine.stack)
+	rBefore := slices.Clone(machine.returnStack)
+	ins := machine.decode(pc, op)
+	var addr uint32 // The cell LOADI, STOREI, LOAD or STORE uses
+	switch op {
+	case OpLoad, OpStore:
+		addr = uint32(ins.Operand)
+	case OpLoadI, OpStoreI:
+		if len(before) > 0 {
+			addr = uint32(before[len(before)-1])
+		}
+	}
+
+	cont, err := step()
+	if err != nil {
+		return cont, err
+	}
+
+	// The origin of a value op pushed: the poison value it moved or loaded,
+	// or else op itself
+	origin := func(v int32) uint32 {
+		switch {
+		case poisonMoves[op]:
+			for i := len(before) - 1; i >= 0; i-- {
+				if before[i] == v {
+					return t.origins[i]
+				}
+			}
+		case op == OpFromR || op == OpRFetch:
+			if n := len(t.rOrigins); n > 0 {
+				return t.rOrigins[n-1]
+			}
+		case op == OpLoad || op == OpLoadI:
+			if from, ok := t.memOrigins[addr]; ok {
+				return from
+			}
+		}
+		return pc
+	}
+
+	switch op {
+	case OpStore, OpStoreI:
+		at := len(before) - 1
+		if op == OpStoreI {
+			at--
+		}
+		if at >= 0 && slices.Contains(t.Poison, before[at]) {
+			t.memOrigins[addr] = t.origins[at]
+		} else {
+			delete(t.memOrigins, addr)
+		}
+	}
+
+	rKept := commonPrefix(rBefore, machine.returnStack)
+	rOrigins := slices.Clone(t.rOrigins[:rKept])
+	for range machine.returnStack[rKept:] {
+		from := noOrigin
+		if op == OpToR && len(t.origins) > 0 {
+			from = t.origins[len(t.origins)-1]
+		}
+		rOrigins = append(rOrigins, from)
+	}
+
+	kept := commonPrefix(before, machine.stack)
+	origins := slices.Clone(t.origins[:kept])
+	for _, v := range machine.stack[kept:] {
+		from := noOrigin
+		if slices.Contains(t.Poison, v) {
+			from = origin(v)
+		}
+		origins = append(origins, from)
+	}
+	t.origins, t.rOrigins = origins, rOrigins
+	return cont, nil
+}
+
+// fitOrigins returns origins with n entries, keeping those it has
+func fitOrigins(origins []uint32, n int) []uint32 {
+	for len(origins) < n {
+		origins = append(origins, noOrigin)
+	}
+	return origins[:n]
+}
+
+// commonPrefix returns how many values a and b start with in common
+func commonPrefix(a, b []int32) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+// runPoisoned assembles listing and runs it under a Tracer watching for
+// math.MinInt32
+func runPoisoned(t *testing.T, listing string) error {
+	t.Helper()
+	code, err := Assemble(listing)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	tracer := NewTracer(io.Discard)
+	tracer.Ops = map[byte]bool{}
+	tracer.Poison = []int32{math.MinInt32}
+	return tracer.Run(NewVM(append(code, OpHalt)))
+}
+
+func TestPoisonOrigin(t *testing.T) {
+	tests := []struct{ name, listing, origin string }{
+		{"pushed", "PUSH -2147483648\nPUSH8 1\nADD", "PUSH at 0x4000"},
+		{"moved", "PUSH8 1\nPUSH -2147483648\nDUP\nSWAP\nPOP\nINC", "PUSH at 0x4002"},
+		{"stored", "PUSH -2147483648\nSTORE 0x0100\nPUSH8 3\nLOAD 0x0100\nMUL", "PUSH at 0x4000"},
+		{"return stack", "PUSH -2147483648\n>R\nPUSH8 2\nR>\nSUB", "PUSH at 0x4000"},
+		{"computed", "PUSH 2147483647\nINC\nDEC", "INC at 0x4005"},
+	}
+	for _, tt := range tests {
+		err := runPoisoned(t, tt.listing)
+		var poison *PoisonError
+		if !errors.As(err, &poison) {
+			t.Errorf("%s: expected a *PoisonError, got %v", tt.name, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), "produced by "+tt.origin) {
+			t.Errorf("%s: expected the value to come from %s, got %v", tt.name, tt.origin, err)
+		}
+	}
+}
+
+func TestPoisonIgnoresComparisons(t *testing.T) {
+	if err := runPoisoned(t, "PUSH -2147483648\nDUP\nPUSH -2147483648\nEQ\nPOP\nSTORE 0x0100"); err != nil {
+		t.Errorf("Expected comparing and storing a poison value to be allowed, got %v", err)
+	}
+}
+
+func TestPoisonBeforeTracing(t *testing.T) {
+	machine := NewVM([]byte{OpInc, OpHalt})
+	machine.Push(math.MinInt32)
+	tracer := NewTracer(io.Discard)
+	tracer.Poison = []int32{math.MinInt32}
+	err := tracer.Run(machine)
+	if err == nil || !strings.Contains(err.Error(), "from before tracing began") {
+		t.Errorf("Expected a poison value without an origin, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// WritePprof writes the profile as a gzipped pprof protobuf, so `go tool
+// pprof` can show LUX words. Each word is a function and each stack a
+// sample whose value is the instructions executed in its leaf word.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	strs := []string{""}
+	strIndex := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		if i, ok := strIndex[s]; ok {
+			return i
+		}
+		strIndex[s] = int64(len(strs))
+		strs = append(strs, s)
+		return strIndex[s]
+	}
+
+	var out protoBuffer
+	sampleType := func(field int, typ, unit string) {
+		var vt protoBuffer
+		vt.int(1, str(typ))
+		vt.int(2, str(unit))
+		out.message(field, &vt)
+	}
+	sampleType(1, "instructions", "count")
+	sampleType(11, "instructions", "count") // period_type
+	out.int(12, 1)                          // period
+
+	// One function and one location per distinct frame, keyed by entry address
+	ids := make(map[string]uint64)
+	var functions, locations protoBuffer
+	frameID := func(n *profileNode) uint64 {
+		name := p.frameName(n)
+		if id, ok := ids[name]; ok {
+			return id
+		}
+		id := uint64(len(ids) + 1)
+		ids[name] = id
+
+		var fn protoBuffer
+		fn.uint(1, id)
+		fn.int(2, str(name))
+		fn.int(3, str(name))
+		functions.message(5, &fn)
+
+		var line, loc protoBuffer
+		line.uint(1, id)
+		loc.uint(1, id)
+		loc.uint(3, uint64(n.addr))
+		loc.message(4, &line)
+		locations.message(4, &loc)
+		return id
+	}
+
+	p.walk(func(stack []*profileNode) {
+		leaf := stack[len(stack)-1]
+		if leaf.self == 0 {
+			return
+		}
+		// pprof lists a sample's locations leaf first
+		locs := make([]uint64, len(stack))
+		for i, n := range stack {
+			locs[len(stack)-1-i] = frameID(n)
+		}
+		var sample protoBuffer
+		sample.packed(1, locs)
+		sample.packed(2, []uint64{uint64(leaf.self)})
+		out.message(2, &sample)
+	})
+	out.buf.Write(locations.buf.Bytes())
+	out.buf.Write(functions.buf.Bytes())
+	for _, s := range strs {
+		out.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(out.buf.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// protoBuffer encodes the few protobuf wire types profile.proto needs
+type protoBuffer struct {
+	buf bytes.Buffer
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.buf.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.buf.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint(field int, x uint64) {
+	b.key(field, 0)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int(field int, x int64) {
+	b.uint(field, uint64(x))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.buf.Write(data)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.buf.Bytes())
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(field, p.buf.Bytes())
+}
@@ -0,0 +1,209 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ProfileRoot names the bottom frame of every profiled stack: the code that
+// runs outside any CALLed word
+const ProfileRoot = "(toplevel)"
+
+// Profiler runs a VM while keeping a shadow call stack, and counts the
+// instructions executed under each distinct stack. Every instruction is
+// counted, so the profile is exact rather than sampled.
+type Profiler struct {
+	Symbols []Symbol // Names frames; words without a symbol show as addresses
+
+	root *profileNode
+	cur  *profileNode
+	base int // Return stack depth when profiling started
+}
+
+// profileNode is one call path in the profile's call tree
+type profileNode struct {
+	addr     uint32 // Entry address of the word, 0 for the root
+	depth    int    // Return stack depth while this call runs
+	calls    int64
+	self     int64 // Instructions executed in this call path, excluding callees
+	parent   *profileNode
+	children []*profileNode
+}
+
+// child returns the node for a call to addr from n, creating it on first use
+func (n *profileNode) child(addr uint32, depth int) *profileNode {
+	for _, c := range n.children {
+		if c.addr == addr {
+			return c
+		}
+	}
+	c := &profileNode{addr: addr, depth: depth, parent: n}
+	n.children = append(n.children, c)
+	return c
+}
+
+// NewProfiler returns a Profiler that names frames with symbols
+func NewProfiler(symbols []Symbol) *Profiler {
+	root := &profileNode{calls: 1}
+	return &Profiler{Symbols: symbols, root: root, cur: root, base: -1}
+}
+
+// Step counts the instruction at PC against the current stack and executes it
+func (p *Profiler) Step(machine *VM) (bool, error) {
+	if p.base < 0 {
+		p.base = len(machine.returnStack)
+	}
+	op, _ := machine.byteAt(machine.pc)
+	p.cur.self++
+	cont, err := machine.Step()
+	if err != nil {
+		return cont, err
+	}
+	// Follow the return stack rather than matching RETs, so >R and R> in a
+	// word cannot leave the shadow stack out of step
+	depth := len(machine.returnStack) - p.base
+	for p.cur != p.root && p.cur.depth > depth {
+		p.cur = p.cur.parent
+	}
+	if op == OpCall || op == OpCallStack {
+		p.cur = p.cur.child(machine.pc, depth)
+		p.cur.calls++
+	}
+	return cont, nil
+}
+
+// Run profiles machine until it halts
+func (p *Profiler) Run(machine *VM) error {
+	defer machine.Flush()
+	for machine.Running() {
+		if _, err := p.Step(machine); err != nil {
+			return fmt.Errorf("error at PC=%d: %v", machine.PC(), err)
+		}
+	}
+	return nil
+}
+
+// frameName returns the symbol for a frame's entry address, or the address
+func (p *Profiler) frameName(n *profileNode) string {
+	if n == p.root {
+		return ProfileRoot
+	}
+	for _, sym := range p.Symbols {
+		if uint32(sym.Address) == n.addr {
+			return sym.Name
+		}
+	}
+	return fmt.Sprintf("0x%X", n.addr)
+}
+
+// walk visits every node of the call tree with its stack, root first
+func (p *Profiler) walk(visit func(stack []*profileNode)) {
+	var rec func(n *profileNode, stack []*profileNode)
+	rec = func(n *profileNode, stack []*profileNode) {
+		stack = append(stack, n)
+		visit(stack)
+		for _, c := range n.children {
+			rec(c, stack)
+		}
+	}
+	rec(p.root, nil)
+}
+
+// WriteFolded writes the profile in the folded-stack format read by
+// flamegraph.pl and speedscope: one "ROOT;CALLER;WORD count" line per stack,
+// where count is the instructions executed in WORD itself on that stack
+func (p *Profiler) WriteFolded(w io.Writer) error {
+	var lines []string
+	p.walk(func(stack []*profileNode) {
+		leaf := stack[len(stack)-1]
+		if leaf.self == 0 {
+			return
+		}
+		names := make([]string, len(stack))
+		for i, n := range stack {
+			names[i] = p.frameName(n)
+		}
+		lines = append(lines, fmt.Sprintf("%s %d", strings.Join(names, ";"), leaf.self))
+	})
+	sort.Strings(lines)
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WordStats is the profile of one word, summed over every stack it ran on
+type WordStats struct {
+	Name  string
+	Calls int64
+	Self  int64 // Instructions executed in the word itself
+	Cum   int64 // Instructions executed in the word and everything it called
+}
+
+// Stats aggregates the call tree by word, ordered by self count with the
+// busiest word first. A recursive word's cumulative count includes each
+// instruction once, however deep the recursion.
+func (p *Profiler) Stats() []WordStats {
+	byName := make(map[string]*WordStats)
+	var order []*WordStats
+	stats := func(name string) *WordStats {
+		if s, ok := byName[name]; ok {
+			return s
+		}
+		s := &WordStats{Name: name}
+		byName[name] = s
+		order = append(order, s)
+		return s
+	}
+	p.walk(func(stack []*profileNode) {
+		leaf := stack[len(stack)-1]
+		s := stats(p.frameName(leaf))
+		s.Calls += leaf.calls
+		s.Self += leaf.self
+		seen := make(map[string]bool)
+		for _, n := range stack {
+			name := p.frameName(n)
+			if !seen[name] {
+				seen[name] = true
+				stats(name).Cum += leaf.self
+			}
+		}
+	})
+	result := make([]WordStats, len(order))
+	for i, s := range order {
+		result[i] = *s
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Self > result[j].Self })
+	return result
+}
+
+// WriteReport prints Stats as a table
+func (p *Profiler) WriteReport(w io.Writer) error {
+	stats := p.Stats()
+	total := int64(0)
+	for _, s := range stats {
+		total += s.Self
+	}
+	if _, err := fmt.Fprintf(w, "%-24s %10s %12s %7s %12s %7s\n", "WORD", "CALLS", "SELF", "SELF%", "CUM", "CUM%"); err != nil {
+		return err
+	}
+	for _, s := range stats {
+		if _, err := fmt.Fprintf(w, "%-24s %10d %12d %6.2f%% %12d %6.2f%%\n",
+			s.Name, s.Calls, s.Self, percent(s.Self, total), s.Cum, percent(s.Cum, total)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d instructions\n", total)
+	return err
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestProfilerFolded(t *testing.T) {
+	profiler := NewProfiler([]Symbol{{Name: "BUMP", Address: 0x400F}})
+	if err := profiler.Run(NewVM(traceProgram())); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var out bytes.Buffer
+	if err := profiler.WriteFolded(&out); err != nil {
+		t.Fatalf("WriteFolded failed: %v", err)
+	}
+	want := "(toplevel) 4\n(toplevel);BUMP 4\n"
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestProfilerFollowsReturnStack(t *testing.T) {
+	// A word that moves a value through the return stack must not confuse the shadow stack
+	var code []byte
+	code = append(code, ShortPushInstruction(7)...) // 0x4000
+	code = append(code, CallInstruction(0x4009)...) // 0x4002
+	code = append(code, OpHalt, 0)                  // 0x4007 HALT, padding
+	code = append(code, OpToR, OpFromR, OpRet)      // 0x4009
+	profiler := NewProfiler(nil)
+	if err := profiler.Run(NewVM(code)); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var out bytes.Buffer
+	profiler.WriteFolded(&out)
+	want := "(toplevel) 3\n(toplevel);0x4009 3\n"
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestProfilerPprof(t *testing.T) {
+	profiler := NewProfiler([]Symbol{{Name: "BUMP", Address: 0x400F}})
+	if err := profiler.Run(NewVM(traceProgram())); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var out bytes.Buffer
+	if err := profiler.WritePprof(&out); err != nil {
+		t.Fatalf("WritePprof failed: %v", err)
+	}
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatalf("pprof output is not gzipped: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("reading pprof output: %v", err)
+	}
+	for _, s := range []string{"BUMP", "(toplevel)", "instructions"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Errorf("pprof string table is missing %q", s)
+		}
+	}
+}
+
+func TestProfilerStats(t *testing.T) {
+	// COUNTDOWN recurses until the top of the stack is zero
+	var code []byte
+	code = append(code, ShortPushInstruction(2)...) // 0x4000
+	code = append(code, CallInstruction(0x4008)...) // 0x4002
+	code = append(code, OpHalt)                     // 0x4007
+	code = append(code, OpDup)                      // 0x4008 COUNTDOWN
+	code = append(code, JzInstruction(0x4014)...)   // 0x4009
+	code = append(code, OpDec)                      // 0x400E
+	code = append(code, CallInstruction(0x4008)...) // 0x400F
+	code = append(code, OpRet)                      // 0x4014
+
+	profiler := NewProfiler([]Symbol{{Name: "COUNTDOWN", Address: 0x4008}})
+	if err := profiler.Run(NewVM(code)); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := []WordStats{
+		{Name: "COUNTDOWN", Calls: 3, Self: 13, Cum: 13},
+		{Name: ProfileRoot, Calls: 1, Self: 3, Cum: 16},
+	}
+	got := profiler.Stats()
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("row %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+
+	var out bytes.Buffer
+	if err := profiler.WriteReport(&out); err != nil {
+		t.Fatalf("WriteReport failed: %v", err)
+	}
+	if !contains(out.String(), "COUNTDOWN") || !contains(out.String(), "16 instructions") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+}
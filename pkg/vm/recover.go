@@ -0,0 +1,28 @@
+package vm
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// RuntimeError reports a Go panic during a run, such as one from a host
+// function or a bug in an instruction. Run, RunMetered, CallWord and Tick
+// recover it, so a program cannot crash the host that embeds the VM.
+type RuntimeError struct {
+	PC    uint32
+	Value any    // What was passed to panic
+	Stack string // Go stack trace where it panicked
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("internal error at PC=%d: %v", e.PC, e.Value)
+}
+
+// recoverPanic, deferred by a run loop, turns a panic into a *RuntimeError
+// in *err and stops the VM
+func (vm *VM) recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		vm.running = false
+		*err = &RuntimeError{PC: vm.pc, Value: r, Stack: string(debug.Stack())}
+	}
+}
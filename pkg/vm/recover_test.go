@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// FuzzStep runs arbitrary bytecode on an arbitrary stack, in a VM with any
+// amount of reserved memory. Whatever the program, an instruction may fail
+// but must never panic.
+func FuzzStep(f *testing.F) {
+	f.Add([]byte{OpPush8, 5, OpDup, OpAdd, OpHalt}, int32(0), int32(0), int32(0), uint16(ReservedMemorySize))
+	f.Add([]byte{OpLoadI}, int32(0), int32(0), int32(-4), uint16(ReservedMemorySize))
+	f.Add([]byte{OpStoreI}, int32(0), int32(7), int32(1<<30), uint16(ReservedMemorySize))
+	f.Add([]byte{OpJmpTable, 0xFF, 0xFF}, int32(0), int32(0), int32(3), uint16(ReservedMemorySize))
+	f.Add([]byte{OpPush}, int32(0), int32(0), int32(0), uint16(ReservedMemorySize))
+	f.Add([]byte{OpDump}, int32(0), int32(-1), int32(16), uint16(ReservedMemorySize))
+	f.Add([]byte{OpLoad, 0, 0, 0x30, 0x06}, int32(0), int32(0), int32(0), uint16(0))
+	f.Fuzz(func(t *testing.T, code []byte, a, b, c int32, reserved uint16) {
+		machine := NewVMWithReservedMemory(code, uint32(reserved))
+		machine.Stdout, machine.Stderr, machine.Stdin = io.Discard, io.Discard, strings.NewReader("line\n")
+		machine.Clock = &fakeClock{}
+		pushAll(machine, a, b, c)
+		machine.FrameSteps = 1000
+		for i := 0; i < 1000; i++ {
+			if running, err := machine.Step(); !running || err != nil {
+				break
+			}
+		}
+		var internal *RuntimeError
+		if _, err := machine.Tick(); errors.As(err, &internal) {
+			t.Fatalf("Tick panicked: %v\n%s", err, internal.Stack)
+		}
+	})
+}
+
+func TestRunRecoversPanic(t *testing.T) {
+	code := append(HostInstruction("explode"), OpPush8, 1, OpHalt)
+	run := map[string]func(*VM) error{
+		"Run":      (*VM).Run,
+		"CallWord": func(m *VM) error { return m.CallWord(UserMemoryOffset) },
+		"RunMetered": func(m *VM) error {
+			return m.RunMetered(Limits{MaxSteps: 100}.Start())
+		},
+		"Tick": func(m *VM) error {
+			_, err := m.Tick()
+			return err
+		},
+	}
+	for name, fn := range run {
+		machine := NewVM(code)
+		machine.RegisterHost("explode", "", func(*VM) error { panic("boom") })
+		err := fn(machine)
+		var internal *RuntimeError
+		if !errors.As(err, &internal) || internal.Value != "boom" || internal.PC != UserMemoryOffset+5 {
+			t.Errorf("%s: expected a RuntimeError for the panic, got %#v", name, err)
+			continue
+		}
+		if machine.Running() || !strings.Contains(internal.Stack, "TestRunRecoversPanic") {
+			t.Errorf("%s: expected a stopped VM and the panic's stack, got running=%v", name, machine.Running())
+		}
+	}
+}
+
+func TestReservedMemoryOverflow(t *testing.T) {
+	machine := NewVM(nil)
+	if _, err := machine.ReadReservedMemory(16, 0xFFFFFFF8); err == nil {
+		t.Error("Expected a read whose end wraps around to fail")
+	}
+	if err := machine.WriteReservedMemory(16, make([]byte, 8)); err != nil {
+		t.Errorf("Expected a write inside reserved memory to work, got %v", err)
+	}
+}
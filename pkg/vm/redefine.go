@@ -0,0 +1,42 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Redefine gives the word at old a new body while the program is paused,
+// for fix-and-continue debugging. code holds the new body, starting at
+// addr, and is compiled to run at the end of memory, len(Memory()), where
+// Redefine appends it and lets a Strict VM run it. refs are the addresses
+// of the operands that may hold code addresses, an image's relocations as
+// RelocAddresses gives them, and each one holding old is pointed at addr,
+// so later calls, jumps and pushes of the word run the new body. A call
+// already under way finishes in the old one, as does an address the
+// program copied to the stack or memory. Redefine returns how many
+// operands it patched.
+func (vm *VM) Redefine(old, addr uint32, code []byte, refs []uint32) (int, error) {
+	if vm.shared != nil {
+		return 0, fmt.Errorf("cannot redefine a word of a shared program")
+	}
+	at := uint32(len(vm.memory))
+	if addr < at || uint64(addr) >= uint64(at)+uint64(len(code)) {
+		return 0, fmt.Errorf("the new body at 0x%X is not in the %d bytes of code for the end of memory (0x%X)", addr, len(code), at)
+	}
+	for _, ref := range refs {
+		if uint64(ref)+4 > uint64(at) {
+			return 0, fmt.Errorf("address operand at 0x%X is past the end of memory (0x%X)", ref, at)
+		}
+	}
+	vm.ownCode()
+	vm.memory = append(vm.memory, code...)
+	vm.redefined = append(vm.redefined, [2]uint32{at, uint32(len(vm.memory))})
+	patched := 0
+	for _, ref := range refs {
+		if binary.BigEndian.Uint32(vm.memory[ref:]) == old {
+			binary.BigEndian.PutUint32(vm.memory[ref:], addr)
+			patched++
+		}
+	}
+	return patched, nil
+}
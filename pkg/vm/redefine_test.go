@@ -0,0 +1,44 @@
+package vm
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRedefine(t *testing.T) {
+	// CALL seven, CALL seven, HALT, seven: PUSH8 7 RET
+	code := append(CallInstruction(0x400B), CallInstruction(0x400B)...)
+	code = append(code, OpHalt, OpPush8, 7, OpRet)
+	machine := NewVM(code)
+	machine.SetCodeEnd(0x400E)
+	if _, err := machine.Step(); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	// The new body pushes 8; the first call, under way, finishes with 7
+	at := uint32(len(machine.Memory()))
+	refs := []uint32{0x4001, 0x4006}
+	patched, err := machine.Redefine(0x400B, at, []byte{OpPush8, 8, OpRet}, refs)
+	if err != nil {
+		t.Fatalf("Redefine failed: %v", err)
+	}
+	if patched != 2 {
+		t.Errorf("Expected both CALLs patched, got %d", patched)
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stack := machine.Stack(); !slices.Equal(stack, []int32{7, 8}) {
+		t.Errorf("Expected [7 8], got %v", stack)
+	}
+	if region, ok := machine.RegionAt(at); !ok || region.Name != "redefined" || region.Perm != PermRead|PermWrite|PermExec {
+		t.Errorf("Expected the new body in a redefined region, got %+v", region)
+	}
+
+	if _, err := machine.Redefine(0x400B, at, []byte{OpRet}, refs); err == nil {
+		t.Error("Expected an error for code not at the end of memory")
+	}
+	if _, err := NewSharedVM(NewSharedProgram(code, nil)).Redefine(0x400B, at, []byte{OpRet}, nil); err == nil {
+		t.Error("Expected an error redefining a word of a shared program")
+	}
+}
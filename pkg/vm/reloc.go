@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// AddressOperands returns the offset in code of every operand that is a
+// code address by definition: the targets of JMP, JZ and CALL and each
+// JMPTABLE entry. To the VM a PUSH operand is just a number, so a compiler
+// adds the ones it knows hold addresses to make the full relocation list.
+func AddressOperands(code []byte) []uint32 {
+	var offsets []uint32
+	for at := 0; at < len(code); {
+		n := operandSize(code, at)
+		if n < 0 {
+			break
+		}
+		info, _ := LookupOpcode(code[at])
+		switch info.Operand {
+		case OperandTarget:
+			offsets = append(offsets, uint32(at+1))
+		case OperandTable:
+			for i := 3; i <= n; i += 4 {
+				offsets = append(offsets, uint32(at+i))
+			}
+		}
+		at += 1 + n
+	}
+	return offsets
+}
+
+// Relocate returns a copy of code with delta added to the 4-byte address
+// at each offset in relocs
+func Relocate(code []byte, relocs []uint32, delta int32) ([]byte, error) {
+	moved := append([]byte(nil), code...)
+	for _, off := range relocs {
+		if int64(off)+4 > int64(len(moved)) {
+			return nil, fmt.Errorf("relocation at offset %d is past the end of %d bytes of code", off, len(moved))
+		}
+		addr := int32(binary.BigEndian.Uint32(moved[off:]))
+		binary.BigEndian.PutUint32(moved[off:], uint32(addr+delta))
+	}
+	return moved, nil
+}
+
+// RelocAddresses returns the address each relocation's operand loads at,
+// as Redefine takes them
+func (img *Image) RelocAddresses() []uint32 {
+	base, _ := img.memoryLayout()
+	addrs := make([]uint32, len(img.Relocs))
+	for i, off := range img.Relocs {
+		addrs[i] = base + off
+	}
+	return addrs
+}
+
+// Rebase returns a copy of the image whose code, symbols and tables are
+// moved to load at base. The image must carry relocations; the copy is
+// unsigned.
+func (img *Image) Rebase(base int32) (*Image, error) {
+	if img.Relocs == nil {
+		return nil, fmt.Errorf("image has no relocation section; recompile it with this toolchain")
+	}
+	from, _ := img.memoryLayout()
+	delta := base - int32(from)
+	code, err := Relocate(img.Code, img.Relocs, delta)
+	if err != nil {
+		return nil, err
+	}
+	moved := *img
+	moved.Code = code
+	moved.Symbols = make([]Symbol, len(img.Symbols))
+	for i, sym := range img.Symbols {
+		sym.Address += delta
+		moved.Symbols[i] = sym
+	}
+	moved.Tables = make([]Table, len(img.Tables))
+	for i, t := range img.Tables {
+		t.Address += delta
+		moved.Tables[i] = t
+	}
+	moved.BaseAddr = uint32(base)
+	moved.Signature, moved.signed = nil, nil
+	return &moved, nil
+}
+
+// encodeRelocs writes: count uint32, then each offset as a uint32
+func encodeRelocs(relocs []uint32) []byte {
+	sorted := append([]uint32{}, relocs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(sorted)))
+	binary.Write(&buf, binary.BigEndian, sorted)
+	return buf.Bytes()
+}
+
+func decodeRelocs(payload []byte) ([]uint32, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("relocation section truncated")
+	}
+	count := binary.BigEndian.Uint32(payload)
+	if int64(count)*4 != int64(len(payload)-4) {
+		return nil, fmt.Errorf("relocation section has %d bytes for %d offsets", len(payload)-4, count)
+	}
+	relocs := make([]uint32, count)
+	for i := range relocs {
+		relocs[i] = binary.BigEndian.Uint32(payload[4+4*i:])
+	}
+	return relocs, nil
+}
@@ -0,0 +1,70 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAddressOperands(t *testing.T) {
+	code := JmpInstruction(0x4010)                     // Operand at 1
+	code = append(code, PushInstruction(0x4010)...)    // A PUSH is not an address
+	code = append(code, CallInstruction(0x4020)...)    // Operand at 11
+	code = append(code, OpJmpTable, 0, 2)              // Two entries
+	code = append(code, EncodeInt32(0x4030)...)        // Default at 18
+	code = append(code, EncodeInt32(0x4031)...)        // 22
+	code = append(code, EncodeInt32(0x4032)...)        // 26
+	code = append(code, OpLoad, 0, 0, 0x10, 0, OpHalt) // Reserved memory, not code
+	if got, want := AddressOperands(code), []uint32{1, 11, 18, 22, 26}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected operands at %v, got %v", want, got)
+	}
+}
+
+func TestRebase(t *testing.T) {
+	code := append(CallInstruction(0x4006), OpHalt, OpPush8, 7, OpRet)
+	img := &Image{Code: code, Symbols: []Symbol{{Name: "SEVEN", Address: 0x4006}}, Relocs: []uint32{1},
+		Tables: []Table{{Name: "ONE", Address: 0x4009, Size: 4}}}
+	got, err := ParseImage(EncodeImage(img))
+	if err != nil {
+		t.Fatalf("ParseImage error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Relocs, []uint32{1}) {
+		t.Fatalf("Expected relocations to round-trip, got %v", got.Relocs)
+	}
+	moved, err := got.Rebase(0x4100)
+	if err != nil {
+		t.Fatalf("Rebase failed: %v", err)
+	}
+	if want := append(CallInstruction(0x4106), OpHalt, OpPush8, 7, OpRet); !bytes.Equal(moved.Code, want) {
+		t.Errorf("Expected code %v, got %v", want, moved.Code)
+	}
+	if moved.Symbols[0].Address != 0x4106 || img.Symbols[0].Address != 0x4006 {
+		t.Errorf("Expected only the copy's symbol to move, got %+v and %+v", moved.Symbols, img.Symbols)
+	}
+	if moved.Tables[0].Address != 0x4109 || img.Tables[0].Address != 0x4009 {
+		t.Errorf("Expected only the copy's table to move, got %+v and %+v", moved.Tables, img.Tables)
+	}
+
+	// Place it behind a JMP over the gap and run it there
+	program := make([]byte, 0x100)
+	copy(program, JmpInstruction(0x4100))
+	machine := NewVM(append(program, moved.Code...))
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 7 {
+		t.Errorf("Expected [7], got %v", stack)
+	}
+}
+
+func TestRebaseErrors(t *testing.T) {
+	if _, err := (&Image{Code: []byte{OpHalt}}).Rebase(0x4100); err == nil {
+		t.Error("Expected an image without relocations to be refused")
+	}
+	if _, err := (&Image{Code: []byte{OpHalt}, Relocs: []uint32{0}}).Rebase(0x4100); err == nil {
+		t.Error("Expected a relocation past the end of the code to be refused")
+	}
+	if _, err := decodeRelocs([]byte{0, 0, 0, 2, 0, 0, 0, 1}); err == nil {
+		t.Error("Expected a truncated relocation section to be refused")
+	}
+}
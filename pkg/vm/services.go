@@ -0,0 +1,73 @@
+package vm
+
+import "fmt"
+
+// The service vector is a table of standard routines a host installs at
+// the top of the default reserved memory with InstallServices. Each entry
+// is a JMP to its routine, so the entry addresses stay the same whatever
+// the routines become, and programs CALL them or CALLSTACK their address
+// without knowing how the host implements them. Strings are one character
+// per cell, as everywhere else.
+const (
+	ServiceVectorAddr = ReservedMemorySize - ServiceAreaSize // 0x0F00
+	ServiceAreaSize   = 256                                  // Table and routines
+	ServiceEntrySize  = 5                                    // One JMP
+)
+
+// Service entries, in table order
+const (
+	ServicePrintString = ServiceVectorAddr + iota*ServiceEntrySize // ( addr len -- ) print a string
+	ServicePrintNumber                                             // ( n -- ) print a number
+	ServiceNewline                                                 // ( -- ) print a newline
+	ServiceReadLine                                                // ( addr max -- len ) read a line, -1 at end of input
+	ServiceRandom                                                  // ( -- n ) next random number
+	ServiceFlush                                                   // ( -- ) write buffered output
+	serviceCount       = iota
+)
+
+// serviceRoutine returns the body of the service at entry, assembled to
+// load at addr
+func serviceRoutine(entry, addr uint32) []byte {
+	switch entry {
+	case ServicePrintString:
+		// Loop over the cells: ( addr len )
+		code := append([]byte{OpDup}, JzInstruction(0)...)
+		code = append(code, OpSwap, OpDup, OpLoadI)
+		code = append(code, OutCharacter()...)
+		code = append(code, OpPush8, 4, OpAdd, OpSwap, OpDec)
+		code = append(code, JmpInstruction(int32(addr))...)
+		copy(code[2:], EncodeInt32(int32(addr)+int32(len(code))))
+		return append(code, OpPop, OpPop, OpRet)
+	case ServicePrintNumber:
+		return append(OutNumber(), OpRet)
+	case ServiceNewline:
+		return append(append(PushInstruction('\n'), OutCharacter()...), OpRet)
+	case ServiceReadLine:
+		return []byte{OpAccept, OpRet}
+	case ServiceRandom:
+		return append(LoadInstruction(RNGDataAddr), OpRet)
+	default:
+		return []byte{OpFlush, OpRet}
+	}
+}
+
+// assembleServices returns the service vector and the routines after it
+func assembleServices() []byte {
+	code := make([]byte, serviceCount*ServiceEntrySize)
+	for i := range serviceCount {
+		addr := ServiceVectorAddr + uint32(len(code))
+		copy(code[i*ServiceEntrySize:], JmpInstruction(int32(addr)))
+		code = append(code, serviceRoutine(ServiceVectorAddr+uint32(i*ServiceEntrySize), addr)...)
+	}
+	return code
+}
+
+// InstallServices installs the service vector and its routines in reserved
+// memory
+func (vm *VM) InstallServices() error {
+	if vm.reservedMemorySize < ServiceVectorAddr+ServiceAreaSize {
+		return fmt.Errorf("the service vector needs %d bytes of reserved memory, this VM has %d",
+			ServiceVectorAddr+ServiceAreaSize, vm.reservedMemorySize)
+	}
+	return vm.InstallRoutine(ServiceVectorAddr, assembleServices())
+}
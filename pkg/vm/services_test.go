@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServices(t *testing.T) {
+	// Read a line into cells at 0, print it back, then a number, a
+	// newline and a random number's sign
+	var code []byte
+	code = append(code, ShortPushInstruction(0)...)
+	code = append(code, ShortPushInstruction(8)...)
+	code = append(code, CallInstruction(ServiceReadLine)...)
+	code = append(code, ShortPushInstruction(0)...)
+	code = append(code, OpSwap)
+	code = append(code, CallInstruction(ServicePrintString)...)
+	code = append(code, ShortPushInstruction(42)...)
+	code = append(code, CallInstruction(ServicePrintNumber)...)
+	code = append(code, CallInstruction(ServiceNewline)...)
+	code = append(code, ShortPushInstruction(ServiceRandom)...)
+	code = append(code, OpCallStack)
+	code = append(code, CallInstruction(ServiceFlush)...)
+	code = append(code, OpHalt)
+
+	machine := NewVM(code)
+	var out bytes.Buffer
+	machine.Stdout = &out
+	machine.Stdin = strings.NewReader("hello\n")
+	if err := machine.InstallServices(); err != nil {
+		t.Fatalf("InstallServices failed: %v", err)
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if out.String() != "hello42\n" {
+		t.Errorf("Expected \"hello42\\n\", got %q", out.String())
+	}
+	if stack := machine.Stack(); len(stack) != 1 {
+		t.Errorf("Expected the random number on the stack, got %v", stack)
+	}
+}
+
+func TestServicesLayout(t *testing.T) {
+	code := assembleServices()
+	if len(code) > ServiceAreaSize {
+		t.Errorf("Expected the services to fit in %d bytes, they take %d", ServiceAreaSize, len(code))
+	}
+	entries := []int{ServicePrintString, ServicePrintNumber, ServiceNewline, ServiceReadLine, ServiceRandom, ServiceFlush}
+	want := []int{0xF00, 0xF05, 0xF0A, 0xF0F, 0xF14, 0xF19}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Expected the entries at %v, got %v", want, entries)
+	}
+	if err := NewVMWithReservedMemory(nil, 1024).InstallServices(); err == nil {
+		t.Error("Expected a VM with 1KB of reserved memory to refuse the services")
+	}
+}
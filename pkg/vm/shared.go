@@ -0,0 +1,95 @@
+package vm
+
+import "encoding/binary"
+
+// SharedProgram is a program loaded once for many VMs. Its code, and an
+// optional read-only data segment placed right after the code, are shared
+// by every VM made from it rather than copied into each, which then owns
+// only its reserved and device memory. Stores into the shared segment fail.
+type SharedProgram struct {
+	segment  []byte
+	dataAddr uint32
+}
+
+// NewSharedProgram copies code and rodata into one read-only segment
+func NewSharedProgram(code, rodata []byte) *SharedProgram {
+	segment := make([]byte, 0, len(code)+len(rodata))
+	segment = append(append(segment, code...), rodata...)
+	return &SharedProgram{segment: segment, dataAddr: UserMemoryOffset + uint32(len(code))}
+}
+
+// DataAddr returns the address of the read-only data segment
+func (p *SharedProgram) DataAddr() uint32 {
+	return p.dataAddr
+}
+
+// Size returns the bytes of code and data every VM shares
+func (p *SharedProgram) Size() int {
+	return len(p.segment)
+}
+
+// NewSharedVM creates a VM running p. Its memory is the reserved and device
+// regions; Memory and snapshots cover only those, since the rest never
+// changes.
+func NewSharedVM(p *SharedProgram) *VM {
+	vm := NewVM(nil)
+	vm.shared = p.segment
+	vm.codeEnd = p.dataAddr
+	return vm
+}
+
+// memSize is the end of the address space
+func (vm *VM) memSize() int {
+	return len(vm.memory) + len(vm.shared)
+}
+
+// span returns the n bytes of the address space at addr, from the VM's own
+// memory, the code segment it shares with forks or the shared segment that
+// follows it; ok is false past the end
+func (vm *VM) span(addr, n uint32) ([]byte, bool) {
+	end := uint64(addr) + uint64(n)
+	if vm.forkCode != nil && addr < vm.codeEnd && end > uint64(vm.userMemoryStart) {
+		start := vm.userMemoryStart
+		if addr >= start && end <= uint64(vm.codeEnd) {
+			return vm.forkCode[addr-start : end-uint64(start)], true
+		}
+		if end > uint64(len(vm.memory)) {
+			return nil, false
+		}
+		b := append([]byte(nil), vm.memory[addr:end]...) // Straddles the end of the code
+		lo, hi := max(addr, start), min(end, uint64(vm.codeEnd))
+		copy(b[lo-addr:], vm.forkCode[lo-start:hi-uint64(start)])
+		return b, true
+	}
+	if end <= uint64(len(vm.memory)) {
+		return vm.memory[addr:end], true
+	}
+	base := uint32(len(vm.memory))
+	if addr >= base && end <= uint64(vm.memSize()) {
+		return vm.shared[addr-base : end-uint64(base)], true
+	}
+	return nil, false
+}
+
+// byteAt returns the byte at addr
+func (vm *VM) byteAt(addr uint32) (byte, bool) {
+	b, ok := vm.span(addr, 1)
+	if !ok {
+		return 0, false
+	}
+	return b[0], true
+}
+
+// operand reads the 4-byte operand at PC
+func (vm *VM) operand() (uint32, bool) {
+	b, ok := vm.span(vm.pc, 4)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
+
+// readOnly reports whether addr lies in the shared segment
+func (vm *VM) readOnly(addr uint32) bool {
+	return vm.shared != nil && int(addr) >= len(vm.memory) && int(addr) < vm.memSize()
+}
@@ -0,0 +1,45 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSharedProgram(t *testing.T) {
+	// Load the first word of the read-only data, add the instance's own
+	// input from reserved memory, and store the sum there
+	rodata := EncodeInt32(40)
+	var code []byte
+	code = append(code, PushInstruction(0)...) // The data address, patched below
+	code = append(code, OpLoadI)
+	code = append(code, LoadInstruction(0x100)...)
+	code = append(code, OpAdd)
+	code = append(code, StoreInstruction(0x100)...)
+	code = append(code, OpHalt)
+	program := NewSharedProgram(code, rodata)
+	copy(program.segment[1:], EncodeInt32(int32(program.DataAddr())))
+
+	for _, input := range []int32{1, 2} {
+		machine := NewSharedVM(program)
+		if len(machine.Memory()) != UserMemoryOffset {
+			t.Fatalf("Expected only %d bytes of private memory, got %d", UserMemoryOffset, len(machine.Memory()))
+		}
+		copy(machine.Memory()[0x100:], EncodeInt32(input))
+		if err := machine.Run(); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		got, _ := machine.ReadReservedMemory(0x100, 4)
+		if want := EncodeInt32(40 + input); string(got) != string(want) {
+			t.Errorf("Instance with input %d stored %v, expected %v", input, got, want)
+		}
+	}
+}
+
+func TestSharedProgramReadOnly(t *testing.T) {
+	code := append(ShortPushInstruction(1), StoreInstruction(int32(UserMemoryOffset))...)
+	code = append(code, OpHalt)
+	machine := NewSharedVM(NewSharedProgram(code, nil))
+	if err := machine.Run(); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("Expected a store into shared code to fail as read-only, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+)
+
+// SnapshotMagic marks a saved VM state
+const SnapshotMagic = "NUXS"
+
+// SnapshotFormatVersion is the layout written by EncodeSnapshot
+const SnapshotFormatVersion = 1
+
+// Snapshot is the state of a VM's machine, from which it can carry on
+// where it was. Host handlers and pending AFTER and EVERY timers are not
+// part of it: timers are due on a clock a restored VM may not share, so
+// Restore cancels them.
+type Snapshot struct {
+	Memory       []byte // All of memory: reserved, device and user regions (not a shared program)
+	Stack        []int32
+	ReturnStack  []int32
+	PC           uint32
+	Running      bool
+	ReservedSize uint32 // Size of the reserved region, as set by NewVMWithReservedMemory
+	RNGState     uint32
+	LastOpcode   byte
+}
+
+// Snapshot copies the VM's state
+func (vm *VM) Snapshot() *Snapshot {
+	return &Snapshot{
+		Memory:       vm.memoryCopy(),
+		Stack:        vm.Stack(),
+		ReturnStack:  vm.ReturnStack(),
+		PC:           vm.pc,
+		Running:      vm.running,
+		ReservedSize: vm.reservedMemorySize,
+		RNGState:     vm.rngState,
+		LastOpcode:   vm.lastOpcode,
+	}
+}
+
+// Restore replaces the VM's state with a copy of s, keeping its handlers
+// and cancelling its timers
+func (vm *VM) Restore(s *Snapshot) {
+	vm.memory = append([]byte{}, s.Memory...)
+	vm.forkCode = nil
+	vm.stack = append(make([]int32, 0, MaxStackSize), s.Stack...)
+	vm.returnStack = append(make([]int32, 0, MaxStackSize), s.ReturnStack...)
+	vm.pc = s.PC
+	vm.running = s.Running
+	vm.reservedMemorySize = s.ReservedSize
+	vm.userMemoryStart = s.ReservedSize + DeviceMemorySize
+	vm.rngState = s.RNGState
+	vm.lastOpcode = s.LastOpcode
+	vm.timers = nil
+	vm.timerDepth = 0
+}
+
+// StateHash identifies the VM's whole state, so replicas running in
+// lock-step can check they agree. It is the SHA-256 EncodeSnapshot ends with.
+func (vm *VM) StateHash() [sha256.Size]byte {
+	data := EncodeSnapshot(vm.Snapshot())
+	return [sha256.Size]byte(data[len(data)-sha256.Size:])
+}
+
+// StateDigest is a fast 64-bit FNV-1a digest of the PC, RNG state, both
+// stacks and memory, which unlike StateHash copies nothing, so replicas
+// can compare it often. It is the same on every platform.
+func (vm *VM) StateDigest() uint64 {
+	h := fnv.New64a()
+	var buf [4]byte
+	word := func(v uint32) {
+		binary.BigEndian.PutUint32(buf[:], v)
+		h.Write(buf[:])
+	}
+	word(vm.pc)
+	word(vm.rngState)
+	for _, stack := range [][]int32{vm.stack, vm.returnStack} {
+		word(uint32(len(stack)))
+		for _, v := range stack {
+			word(uint32(v))
+		}
+	}
+	if vm.forkCode != nil {
+		h.Write(vm.memory[:vm.userMemoryStart])
+		h.Write(vm.forkCode)
+		h.Write(vm.memory[vm.codeEnd:])
+	} else {
+		h.Write(vm.memory)
+	}
+	return h.Sum64()
+}
+
+// HashEvery returns an InstructionHook that calls emit with the
+// StateDigest before every n-th instruction, counting from 1, so two
+// replicas, or a rewrite and the interpreter it replaces, can check they
+// stay in step and find where they part
+func HashEvery(n int64, emit func(step int64, digest uint64)) InstructionHook {
+	var steps int64
+	return func(vm *VM, _ Instruction) error {
+		steps++
+		if steps%n == 0 {
+			emit(steps, vm.StateDigest())
+		}
+		return nil
+	}
+}
+
+// EncodeSnapshot serializes a snapshot:
+//
+//	magic "NUXS" | version uint16
+//	pc uint32 | running uint8 | reserved size uint32 | rng state uint32 | last opcode uint8
+//	stack (uint32 count + int32 values) | return stack (the same)
+//	memory (uint32 length + bytes) | SHA-256 of every byte before it
+func EncodeSnapshot(s *Snapshot) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(SnapshotMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(SnapshotFormatVersion))
+	binary.Write(&buf, binary.BigEndian, s.PC)
+	running := byte(0)
+	if s.Running {
+		running = 1
+	}
+	buf.WriteByte(running)
+	binary.Write(&buf, binary.BigEndian, s.ReservedSize)
+	binary.Write(&buf, binary.BigEndian, s.RNGState)
+	buf.WriteByte(s.LastOpcode)
+	for _, stack := range [][]int32{s.Stack, s.ReturnStack} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(stack)))
+		binary.Write(&buf, binary.BigEndian, stack)
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(s.Memory)))
+	buf.Write(s.Memory)
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// ParseSnapshot decodes a snapshot written by EncodeSnapshot
+func ParseSnapshot(data []byte) (*Snapshot, error) {
+	if len(data) < len(SnapshotMagic) || string(data[:len(SnapshotMagic)]) != SnapshotMagic {
+		return nil, fmt.Errorf("not a VM snapshot")
+	}
+	if len(data) < len(SnapshotMagic)+sha256.Size {
+		return nil, fmt.Errorf("snapshot truncated")
+	}
+	body := data[:len(data)-sha256.Size]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], data[len(body):]) {
+		return nil, fmt.Errorf("snapshot checksum mismatch: the file is corrupt or was modified")
+	}
+	r := bytes.NewReader(body[len(SnapshotMagic):])
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, fmt.Errorf("snapshot header truncated")
+	}
+	if version > SnapshotFormatVersion {
+		return nil, fmt.Errorf("snapshot format version %d is newer than supported version %d", version, SnapshotFormatVersion)
+	}
+	s := &Snapshot{}
+	var running byte
+	for _, field := range []any{&s.PC, &running, &s.ReservedSize, &s.RNGState, &s.LastOpcode} {
+		if err := binary.Read(r, binary.BigEndian, field); err != nil {
+			return nil, fmt.Errorf("snapshot header truncated")
+		}
+	}
+	s.Running = running != 0
+	for _, stack := range []*[]int32{&s.Stack, &s.ReturnStack} {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, fmt.Errorf("snapshot stack truncated")
+		}
+		if int64(n)*4 > int64(r.Len()) || n > MaxStackSize {
+			return nil, fmt.Errorf("snapshot stack of %d values is too large", n)
+		}
+		*stack = make([]int32, n)
+		binary.Read(r, binary.BigEndian, *stack)
+	}
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, fmt.Errorf("snapshot memory truncated")
+	}
+	if int64(size) != int64(r.Len()) {
+		return nil, fmt.Errorf("snapshot memory length %d does not match the %d bytes stored", size, r.Len())
+	}
+	if uint64(size) < uint64(s.ReservedSize)+DeviceMemorySize {
+		return nil, fmt.Errorf("snapshot memory of %d bytes is smaller than its reserved and device regions", size)
+	}
+	s.Memory = make([]byte, size)
+	r.Read(s.Memory)
+	return s, nil
+}
@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// countProgram stores 1..10 into reserved memory, leaving each on the stack
+func countProgram() []byte {
+	var code []byte
+	for i := int32(1); i <= 10; i++ {
+		code = append(code, ShortPushInstruction(i)...)
+		code = append(code, OpDup)
+		code = append(code, StoreInstruction(i*4)...)
+	}
+	return append(code, OpHalt)
+}
+
+func TestSnapshotResumes(t *testing.T) {
+	machine := NewVM(countProgram())
+	machine.RunLimited(Limits{MaxSteps: 15})
+	snap, err := ParseSnapshot(EncodeSnapshot(machine.Snapshot()))
+	if err != nil {
+		t.Fatalf("ParseSnapshot error: %v", err)
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := NewVM(nil)
+	resumed.Restore(snap)
+	if len(resumed.Stack()) != 5 {
+		t.Errorf("Expected 5 values on the restored stack, got %v", resumed.Stack())
+	}
+	if err := resumed.Run(); err != nil {
+		t.Fatalf("Run after Restore failed: %v", err)
+	}
+	if !reflect.DeepEqual(resumed.Stack(), machine.Stack()) {
+		t.Errorf("Expected stack %v, got %v", machine.Stack(), resumed.Stack())
+	}
+	if !reflect.DeepEqual(resumed.Memory(), machine.Memory()) {
+		t.Error("Expected memory to match the uninterrupted run")
+	}
+}
+
+func TestSnapshotIsACopy(t *testing.T) {
+	machine := NewVM(countProgram())
+	snap := machine.Snapshot()
+	machine.Run()
+	if len(snap.Stack) != 0 || snap.Memory[4] != 0 {
+		t.Error("Expected the snapshot to be unaffected by the run that followed")
+	}
+}
+
+func TestParseSnapshotRejectsCorruption(t *testing.T) {
+	data := EncodeSnapshot(NewVM(countProgram()).Snapshot())
+	data[len(SnapshotMagic)+10] ^= 0xFF
+	if _, err := ParseSnapshot(data); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+	if _, err := ParseSnapshot([]byte("NUXI")); err == nil {
+		t.Error("Expected an error for data that is not a snapshot")
+	}
+}
@@ -0,0 +1,75 @@
+package vm
+
+// State is the VM's state as plain data, for tools that inspect it:
+// debuggers, visualizers and tests. It shares nothing with the VM.
+type State struct {
+	PC             uint32
+	Stack          []int32 // Bottom first
+	ReturnStack    []int32 // Bottom first
+	MemorySegments []MemorySegment
+	CurrentOpcode  int // Instruction at PC, -1 when PC is past the end of memory
+	Limits         StackLimits
+	Stats          Stats
+}
+
+// MemorySegment is a region of the address space, from Start up to End
+type MemorySegment struct {
+	Name  string // "reserved", "device", "user" or "shared"
+	Start uint32
+	End   uint32
+}
+
+// StackLimits are the most cells each stack may hold
+type StackLimits struct {
+	Stack       int
+	ReturnStack int
+}
+
+// Stats describe the run so far
+type Stats struct {
+	Running       bool  // Not halted
+	ExitStatus    int   // As ExitStatus returns
+	PendingTimers int   // Timers still to fire
+	OutputBytes   int64 // Bytes OUT has written, to either stream
+
+	// Counted by Step, so a program run by calling ExecuteInstruction
+	// directly shows none
+	Steps           int64  // Instructions run
+	MaxStackDepth   int    // Most values on the data stack after an instruction
+	MaxReturnDepth  int    // Most addresses on the return stack after an instruction
+	MemoryHighWater uint32 // End of the highest word stored to, 0 if none
+}
+
+// State returns a copy of the VM's state
+func (vm *VM) State() State {
+	s := State{
+		PC:          vm.pc,
+		Stack:       vm.Stack(),
+		ReturnStack: vm.ReturnStack(),
+		MemorySegments: []MemorySegment{
+			{"reserved", 0, vm.reservedMemorySize},
+			{"device", vm.reservedMemorySize, vm.userMemoryStart},
+			{"user", vm.userMemoryStart, uint32(len(vm.memory))},
+		},
+		CurrentOpcode: -1,
+		Limits:        StackLimits{Stack: MaxStackSize, ReturnStack: MaxReturnStackSize},
+		Stats: Stats{
+			Running:       vm.running,
+			ExitStatus:    vm.ExitStatus(),
+			PendingTimers: vm.PendingTimers(),
+			OutputBytes:   vm.written,
+
+			Steps:           vm.steps,
+			MaxStackDepth:   vm.maxDepth,
+			MaxReturnDepth:  vm.maxReturnDepth,
+			MemoryHighWater: vm.memoryHigh,
+		},
+	}
+	if len(vm.shared) > 0 {
+		s.MemorySegments = append(s.MemorySegments, MemorySegment{"shared", uint32(len(vm.memory)), uint32(vm.memSize())})
+	}
+	if code, ok := vm.span(vm.pc, 1); ok {
+		s.CurrentOpcode = int(code[0])
+	}
+	return s
+}
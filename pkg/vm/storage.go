@@ -0,0 +1,198 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// CapabilityStorage is the capability the KV-GET, KV-PUT and KV-DEL host
+// functions need
+const CapabilityStorage = "storage"
+
+// Store keeps a program's key-value state between runs. Keys and values
+// are cells, so a script can persist counters, scores and settings.
+type Store interface {
+	Get(key int32) (value int32, ok bool, err error)
+	Put(key, value int32) error
+	Delete(key int32) error
+	Len() int
+}
+
+// QuotaError reports a KV-PUT that would store more keys than the quota
+type QuotaError struct {
+	MaxKeys int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("storage quota of %d keys exceeded", e.MaxKeys)
+}
+
+// MemoryStore is a Store that lasts as long as the Go program
+type MemoryStore struct {
+	values map[int32]int32
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[int32]int32)}
+}
+
+func (s *MemoryStore) Get(key int32) (int32, bool, error) {
+	value, ok := s.values[key]
+	return value, ok, nil
+}
+
+func (s *MemoryStore) Put(key, value int32) error {
+	s.values[key] = value
+	return nil
+}
+
+func (s *MemoryStore) Delete(key int32) error {
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryStore) Len() int {
+	return len(s.values)
+}
+
+// FileStore is a Store saved to a JSON file after every change. The file
+// is replaced by renaming, so a crash leaves the old or the new state, and
+// a change that cannot be saved is undone in memory too.
+type FileStore struct {
+	MemoryStore
+	path string
+}
+
+// OpenFileStore loads the store at path; a missing file is an empty store
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{MemoryStore: *NewMemoryStore(), path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]int32
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for k, v := range values {
+		key, err := strconv.ParseInt(k, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad key %q", path, k)
+		}
+		s.values[int32(key)] = v
+	}
+	return s, nil
+}
+
+func (s *FileStore) Put(key, value int32) error {
+	old, had := s.values[key]
+	s.values[key] = value
+	if err := s.save(); err != nil {
+		if had {
+			s.values[key] = old
+		} else {
+			delete(s.values, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Delete(key int32) error {
+	old, ok := s.values[key]
+	if !ok {
+		return nil
+	}
+	delete(s.values, key)
+	if err := s.save(); err != nil {
+		s.values[key] = old
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) save() error {
+	values := make(map[string]int32, len(s.values))
+	for k, v := range s.values {
+		values[strconv.Itoa(int(k))] = v
+	}
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// RegisterStorage offers store to LUX code, under the storage capability:
+//
+//	KV-GET ( key -- value found )   found is 1, or 0 with a value of 0
+//	KV-PUT ( value key -- )
+//	KV-DEL ( key -- )
+//
+// A KV-PUT of a new key when the store already holds maxKeys keys stops
+// the run with a *QuotaError; maxKeys of 0 means no quota.
+func (vm *VM) RegisterStorage(store Store, maxKeys int) {
+	vm.RegisterHost("KV-GET", CapabilityStorage, func(m *VM) error {
+		key, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		value, ok, err := store.Get(key)
+		if err != nil {
+			return err
+		}
+		if err := m.Push(value); err != nil {
+			return err
+		}
+		if ok {
+			return m.Push(1)
+		}
+		return m.Push(0)
+	})
+	vm.RegisterHost("KV-PUT", CapabilityStorage, func(m *VM) error {
+		key, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		value, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		if maxKeys > 0 && store.Len() >= maxKeys {
+			if _, ok, err := store.Get(key); err != nil {
+				return err
+			} else if !ok {
+				return &QuotaError{MaxKeys: maxKeys}
+			}
+		}
+		return store.Put(key, value)
+	})
+	vm.RegisterHost("KV-DEL", CapabilityStorage, func(m *VM) error {
+		key, err := m.Pop()
+		if err != nil {
+			return err
+		}
+		return store.Delete(key)
+	})
+}
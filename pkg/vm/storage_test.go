@@ -0,0 +1,127 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storageProgram puts 7 at key 1, then gets keys 1 and 2
+func storageProgram() []byte {
+	var code []byte
+	code = append(code, ShortPushInstruction(7)...)
+	code = append(code, ShortPushInstruction(1)...)
+	code = append(code, HostInstruction("kv-put")...)
+	code = append(code, ShortPushInstruction(1)...)
+	code = append(code, HostInstruction("kv-get")...)
+	code = append(code, ShortPushInstruction(2)...)
+	code = append(code, HostInstruction("kv-get")...)
+	return append(code, OpHalt)
+}
+
+func TestStorage(t *testing.T) {
+	machine := NewVMWithCapabilities(storageProgram(), CapabilityStorage)
+	machine.RegisterStorage(NewMemoryStore(), 0)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := []int32{7, 1, 0, 0}
+	got := machine.Stack()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+
+	machine = NewVMWithCapabilities(storageProgram())
+	machine.RegisterStorage(NewMemoryStore(), 0)
+	var perm *PermissionError
+	if err := machine.Run(); !errors.As(err, &perm) {
+		t.Errorf("Expected a PermissionError without the storage capability, got %v", err)
+	}
+}
+
+func TestStorageQuota(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(5, 5)
+	machine := NewVM(storageProgram())
+	machine.RegisterStorage(store, 1)
+	var quota *QuotaError
+	if err := machine.Run(); !errors.As(err, &quota) || quota.MaxKeys != 1 {
+		t.Fatalf("Expected a QuotaError, got %v", err)
+	}
+
+	// Replacing an existing key is within the quota
+	store = NewMemoryStore()
+	store.Put(1, 0)
+	machine = NewVM(storageProgram())
+	machine.RegisterStorage(store, 1)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Expected an overwrite to fit the quota, got %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore on a missing file failed: %v", err)
+	}
+	machine := NewVM(storageProgram())
+	machine.RegisterStorage(store, 0)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// A later run sees the value
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Reopening failed: %v", err)
+	}
+	if v, ok, _ := store.Get(1); !ok || v != 7 {
+		t.Errorf("Expected key 1 to hold 7 after reopening, got %d, %v", v, ok)
+	}
+	store.Delete(1)
+	store, _ = OpenFileStore(path)
+	if store.Len() != 0 {
+		t.Errorf("Expected an empty store after KV-DEL, got %d keys", store.Len())
+	}
+}
+
+func TestFileStoreFailedSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenFileStore(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(1, 7); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// With the directory gone nothing can be saved, and nothing changes
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(1, 8); err == nil {
+		t.Error("Expected Put to fail when the file cannot be written")
+	}
+	if err := store.Put(2, 9); err == nil {
+		t.Error("Expected Put of a new key to fail when the file cannot be written")
+	}
+	if err := store.Delete(1); err == nil {
+		t.Error("Expected Delete to fail when the file cannot be written")
+	}
+	if v, ok, _ := store.Get(1); !ok || v != 7 {
+		t.Errorf("Expected key 1 to still hold 7, got %d, %v", v, ok)
+	}
+	if store.Len() != 1 {
+		t.Errorf("Expected 1 key after the failed changes, got %d", store.Len())
+	}
+}
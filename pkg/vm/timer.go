@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+)
+
+// Clock is the time source for AFTER and EVERY. Now is the time since any
+// fixed start; Sleep waits, or for a simulated clock, moves time forward.
+type Clock interface {
+	Now() time.Duration
+	Sleep(d time.Duration)
+}
+
+// wallClock is the real time since the VM first scheduled a timer
+type wallClock struct {
+	start time.Time
+}
+
+func (c wallClock) Now() time.Duration    { return time.Since(c.start) }
+func (c wallClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// timer is a quotation waiting to run
+type timer struct {
+	due   time.Duration
+	every time.Duration // 0 for AFTER
+	quot  uint32
+	seq   uint64 // Timers due at the same moment run in the order scheduled
+}
+
+// timerQueue is a min-heap of timers by due time
+type timerQueue []*timer
+
+func (q timerQueue) Len() int { return len(q) }
+func (q timerQueue) Less(a, b int) bool {
+	if q[a].due != q[b].due {
+		return q[a].due < q[b].due
+	}
+	return q[a].seq < q[b].seq
+}
+func (q timerQueue) Swap(a, b int) { q[a], q[b] = q[b], q[a] }
+func (q *timerQueue) Push(x any)   { *q = append(*q, x.(*timer)) }
+func (q *timerQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
+}
+
+// PendingTimers returns how many AFTER and EVERY quotations are waiting
+func (vm *VM) PendingTimers() int {
+	return len(vm.timers)
+}
+
+// clock returns the VM's Clock, starting the wall clock on first use
+func (vm *VM) clock() (Clock, error) {
+	if vm.Clock == nil {
+		if vm.Deterministic {
+			return nil, fmt.Errorf("timers depend on the clock; a deterministic VM needs VM.Clock set")
+		}
+		vm.Clock = wallClock{start: time.Now()}
+	}
+	return vm.Clock, nil
+}
+
+// schedule pops a quotation address and a delay in milliseconds and
+// queues the quotation, to run once or, with repeat, every delay
+func (vm *VM) schedule(repeat bool) error {
+	if len(vm.stack) < 2 {
+		return fmt.Errorf("stack underflow: need 2 values")
+	}
+	quot, _ := vm.Pop()
+	ms, _ := vm.Pop()
+	if quot < 0 || int(quot) >= vm.memSize() {
+		return fmt.Errorf("quotation address %d out of bounds", quot)
+	}
+	if err := vm.checkTarget(uint32(quot)); err != nil {
+		return err
+	}
+	if ms < 0 || (repeat && ms == 0) {
+		return fmt.Errorf("bad delay of %d ms", ms)
+	}
+	clock, err := vm.clock()
+	if err != nil {
+		return err
+	}
+	delay := time.Duration(ms) * time.Millisecond
+	t := &timer{due: clock.Now() + delay, quot: uint32(quot), seq: vm.timerSeq}
+	if repeat {
+		t.every = delay
+	}
+	vm.timerSeq++
+	heap.Push(&vm.timers, t)
+	return nil
+}
+
+// fireTimer starts the earliest timer's quotation if it is due, as if the
+// instruction at PC had called it. Timers do not interrupt each other: one
+// that comes due while another's quotation runs waits for it to return.
+func (vm *VM) fireTimer() error {
+	if vm.timerDepth > 0 {
+		if len(vm.returnStack) >= vm.timerDepth {
+			return nil
+		}
+		vm.timerDepth = 0 // The running quotation returned
+	}
+	if len(vm.timers) == 0 || vm.timers[0].due > vm.Clock.Now() {
+		return nil
+	}
+	return vm.startTimer(vm.pc)
+}
+
+// startTimer pops the earliest timer, requeues it if it repeats, and
+// calls its quotation to return to ret
+func (vm *VM) startTimer(ret uint32) error {
+	if len(vm.returnStack) >= MaxReturnStackSize {
+		return fmt.Errorf("timer failed: return stack overflow")
+	}
+	t := vm.timers[0]
+	if t.every > 0 {
+		t.due += t.every
+		if now := vm.Clock.Now(); t.due < now {
+			t.due = now + t.every // A run that fell behind skips the ticks it missed
+		}
+		t.seq = vm.timerSeq
+		vm.timerSeq++
+		heap.Fix(&vm.timers, 0)
+	} else {
+		heap.Pop(&vm.timers)
+	}
+	vm.returnStack = append(vm.returnStack, int32(ret))
+	vm.timerDepth = len(vm.returnStack)
+	vm.pc = t.quot
+	return nil
+}
+
+// timerWaiting reports whether a program that has stopped running waits
+// for its timers. HALT in the main code waits for the pending timers; HALT
+// inside a timer's quotation ends the program and drops the remaining
+// timers.
+func (vm *VM) timerWaiting() bool {
+	if vm.lastOpcode != OpHalt || len(vm.timers) == 0 {
+		return false
+	}
+	if vm.timerDepth > 0 {
+		vm.timers = nil
+		vm.timerDepth = 0
+		return false
+	}
+	return true
+}
+
+// awaitTimer is called when the program has halted. A program waiting for
+// its timers sleeps until the next one is due and runs it, returning to
+// the HALT so the program waits again. The wait stops early, with a
+// *LimitError, at meter's time limit or interrupt; meter may be nil.
+func (vm *VM) awaitTimer(meter *Meter) (bool, error) {
+	if !vm.timerWaiting() {
+		return false, nil
+	}
+	if wait := vm.timers[0].due - vm.Clock.Now(); wait > 0 {
+		if err := meter.sleep(vm.Clock, wait); err != nil {
+			return false, err
+		}
+	}
+	return true, vm.resumeTimer()
+}
+
+// resumeTimer runs the earliest timer of a program waiting at its HALT
+func (vm *VM) resumeTimer() error {
+	vm.running = true
+	return vm.startTimer(vm.pc - 1)
+}
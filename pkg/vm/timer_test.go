@@ -0,0 +1,186 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a simulated clock: Sleep moves it forward instantly
+type fakeClock struct {
+	now time.Duration
+}
+
+func (c *fakeClock) Now() time.Duration    { return c.now }
+func (c *fakeClock) Sleep(d time.Duration) { c.now += d }
+
+// timerProgram schedules a quotation that prints 1 with op after ms, then
+// halts; the quotation follows the HALT
+func timerProgram(op byte, ms int32, quotEnd byte) []byte {
+	quot := int32(UserMemoryOffset) + 9 // After PUSH8 ms, PUSH quot, op, HALT
+	code := append(ShortPushInstruction(ms), PushInstruction(quot)...)
+	code = append(code, op, OpHalt)
+	code = append(code, ShortPushInstruction(1)...)
+	code = append(code, ShortPushInstruction(0)...)
+	return append(code, OpOut, quotEnd)
+}
+
+func TestAfter(t *testing.T) {
+	clock := &fakeClock{}
+	machine := NewVM(timerProgram(OpAfter, 50, OpRet))
+	machine.Clock = clock
+	runs := 0
+	machine.OutputHandler = func(value, format int32) { runs++ }
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("Expected the quotation to run once, ran %d times", runs)
+	}
+	if clock.now != 50*time.Millisecond {
+		t.Errorf("Expected the run to wait 50ms, waited %v", clock.now)
+	}
+	if machine.PendingTimers() != 0 {
+		t.Errorf("Expected no timers left, got %d", machine.PendingTimers())
+	}
+}
+
+func TestEvery(t *testing.T) {
+	// The quotation halts on its third run, which ends the program
+	clock := &fakeClock{}
+	code := timerProgram(OpEvery, 20, OpRet)
+	machine := NewVM(code)
+	machine.Clock = clock
+	runs := 0
+	machine.OutputHandler = func(value, format int32) {
+		runs++
+		if runs == 3 {
+			machine.Memory()[len(machine.Memory())-1] = OpHalt
+		}
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if runs != 3 || clock.now != 60*time.Millisecond {
+		t.Errorf("Expected 3 runs by 60ms, got %d by %v", runs, clock.now)
+	}
+	if machine.PendingTimers() != 0 {
+		t.Errorf("Expected HALT in a timer to drop the timers, %d left", machine.PendingTimers())
+	}
+}
+
+func TestTimerRunsBetweenInstructions(t *testing.T) {
+	// A timer due now runs before the next instruction, and the main code
+	// then carries on where it left off
+	quot := int32(UserMemoryOffset) + 11
+	code := append(ShortPushInstruction(0), PushInstruction(quot)...)
+	code = append(code, OpAfter)
+	code = append(code, ShortPushInstruction(5)...)
+	code = append(code, OpHalt)
+	code = append(code, ShortPushInstruction(7)...)
+	code = append(code, OpRet)
+	machine := NewVM(code)
+	machine.Clock = &fakeClock{}
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := machine.Stack(); len(got) != 2 || got[0] != 7 || got[1] != 5 {
+		t.Errorf("Expected [7 5], got %v", got)
+	}
+}
+
+func TestDeterministicTimers(t *testing.T) {
+	machine := NewVM(timerProgram(OpAfter, 5, OpRet))
+	machine.Deterministic = true
+	if err := machine.Run(); err == nil {
+		t.Error("Expected AFTER to fail in a deterministic VM without a Clock")
+	}
+	machine = NewVM(timerProgram(OpAfter, 5, OpRet))
+	machine.Deterministic = true
+	machine.Clock = &fakeClock{}
+	machine.OutputHandler = func(value, format int32) {}
+	if err := machine.Run(); err != nil {
+		t.Errorf("Expected AFTER to run with a simulated clock, got %v", err)
+	}
+}
+
+func TestRunSliceTimers(t *testing.T) {
+	clock := &fakeClock{}
+	machine := NewVM(timerProgram(OpAfter, 50, OpRet))
+	machine.Clock = clock
+	runs := 0
+	machine.OutputHandler = func(value, format int32) { runs++ }
+	// The slice never sleeps: waiting for the timer pauses
+	if status, err := machine.RunSlice(100); status != SlicePaused || err != nil {
+		t.Fatalf("Expected to pause for the timer, got %v, %v", status, err)
+	}
+	if runs != 0 || clock.now != 0 {
+		t.Errorf("Expected no run and no sleep yet, ran %d times at %v", runs, clock.now)
+	}
+	clock.now = 50 * time.Millisecond
+	if status, err := machine.RunSlice(100); status != SliceHalted || err != nil {
+		t.Fatalf("Expected to halt after the timer, got %v, %v", status, err)
+	}
+	if runs != 1 {
+		t.Errorf("Expected the quotation to run once, ran %d times", runs)
+	}
+}
+
+// Restoring a snapshot taken before a timer was set cancels it, so a
+// restarted program does not run it as well as its own
+func TestRestoreCancelsTimers(t *testing.T) {
+	machine := NewVM(timerProgram(OpAfter, 50, OpRet))
+	machine.Clock = &fakeClock{}
+	runs := 0
+	machine.OutputHandler = func(value, format int32) { runs++ }
+	initial := machine.Snapshot()
+	for machine.PendingTimers() == 0 {
+		if _, err := machine.Step(); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+	machine.Restore(initial)
+	if machine.PendingTimers() != 0 {
+		t.Errorf("Expected Restore to cancel the timer, %d pending", machine.PendingTimers())
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Run after Restore failed: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("Expected the quotation to run once, ran %d times", runs)
+	}
+}
+
+// longTimerProgram sets a 5 second AFTER, then halts to wait for it
+func longTimerProgram() []byte {
+	quot := int32(UserMemoryOffset) + 12 // After PUSH ms, PUSH quot, AFTER, HALT
+	code := append(PushInstruction(5000), PushInstruction(quot)...)
+	return append(code, OpAfter, OpHalt, OpRet)
+}
+
+func TestTimerWaitStopsAtLimits(t *testing.T) {
+	machine := NewVM(longTimerProgram())
+	start := time.Now()
+	err := machine.RunLimited(Limits{MaxTime: 30 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stopped after %v, waiting for the timer past the limit", elapsed)
+	}
+	if machine.PendingTimers() != 1 {
+		t.Errorf("Expected the timer still pending, got %d", machine.PendingTimers())
+	}
+
+	interrupt := make(chan struct{})
+	time.AfterFunc(30*time.Millisecond, func() { close(interrupt) })
+	start = time.Now()
+	err = machine.RunLimited(Limits{Interrupt: interrupt})
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Reason != LimitInterrupt {
+		t.Fatalf("Expected an interrupt, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stopped after %v, waiting for the timer past the interrupt", elapsed)
+	}
+}
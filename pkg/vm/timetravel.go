@@ -0,0 +1,389 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// TimeTraceMagic marks a saved time-travel trace
+const TimeTraceMagic = "NUXT"
+
+// TimeTraceFormatVersion is the layout written by EncodeTimeTrace
+const TimeTraceFormatVersion = 1
+
+// DefaultCheckpointInterval is how many steps a Recorder runs between
+// snapshots unless told otherwise
+const DefaultCheckpointInterval = 16384
+
+// TimeTrace is a recorded run that can be queried afterwards: the state
+// before any step, or the last store to an address. Each step is kept as
+// a small delta (the PC, the cells it popped and pushed on each stack, the
+// words it stored and any new RNG state), varint encoded, with a snapshot
+// every Interval steps as an index, so a query replays at most Interval
+// deltas.
+type TimeTrace struct {
+	Interval int64
+
+	steps       int64
+	data        []byte       // The encoded deltas
+	checkpoints []checkpoint // One before every Interval-th step
+	end         []byte       // Snapshot after the last step
+}
+
+// checkpoint is the state before a step and where the step's delta starts
+type checkpoint struct {
+	offset   int
+	snapshot []byte // As EncodeSnapshot writes it
+}
+
+// TraceStep is one recorded step
+type TraceStep struct {
+	Step   int64
+	PC     uint32 // PC before the step
+	Op     byte   // Instruction at PC
+	Writes []MemoryWrite
+
+	pop, returnPop   int
+	push, returnPush []int32
+	rng              uint32
+	rngSet           bool
+}
+
+// Delta flags, saying which parts follow a step's PC and opcode
+const (
+	deltaStack = 1 << iota
+	deltaReturnStack
+	deltaWrites
+	deltaRNG
+)
+
+// Recorder runs a VM and records a TimeTrace of everything it does
+type Recorder struct {
+	trace       TimeTrace
+	stack       []int32 // The stacks as the last step left them
+	returnStack []int32
+	stored      []uint32 // Words the step being recorded stored to
+}
+
+// NewRecorder returns a Recorder that takes a snapshot every interval
+// steps, or every DefaultCheckpointInterval when interval is not positive
+func NewRecorder(interval int64) *Recorder {
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	return &Recorder{trace: TimeTrace{Interval: interval}}
+}
+
+// Step executes one instruction and records what it changed. A step that
+// fails is recorded too, with whatever it changed before failing.
+func (r *Recorder) Step(machine *VM) (bool, error) {
+	t := &r.trace
+	if t.steps%t.Interval == 0 {
+		t.checkpoints = append(t.checkpoints, checkpoint{offset: len(t.data), snapshot: EncodeSnapshot(machine.Snapshot())})
+		r.stack, r.returnStack = machine.Stack(), machine.ReturnStack()
+	}
+	pc, rng := machine.pc, machine.rngState
+	op, _ := machine.byteAt(pc)
+	r.stored = r.stored[:0]
+	machine.recorder = r
+	cont, err := machine.Step()
+	machine.recorder = nil
+
+	var flags byte
+	var body []byte
+	stackDelta := func(prev *[]int32, now []int32, flag byte) {
+		same := 0
+		for same < len(*prev) && same < len(now) && (*prev)[same] == now[same] {
+			same++
+		}
+		if same == len(*prev) && same == len(now) {
+			return
+		}
+		flags |= flag
+		body = binary.AppendUvarint(body, uint64(len(*prev)-same))
+		body = binary.AppendUvarint(body, uint64(len(now)-same))
+		for _, v := range now[same:] {
+			body = binary.AppendVarint(body, int64(v))
+		}
+		*prev = append((*prev)[:same], now[same:]...)
+	}
+	stackDelta(&r.stack, machine.stack, deltaStack)
+	stackDelta(&r.returnStack, machine.returnStack, deltaReturnStack)
+	if len(r.stored) > 0 {
+		flags |= deltaWrites
+		body = binary.AppendUvarint(body, uint64(len(r.stored)))
+		for _, addr := range r.stored {
+			body = binary.AppendUvarint(body, uint64(addr))
+			body = binary.AppendVarint(body, int64(int32(binary.BigEndian.Uint32(machine.memory[addr:]))))
+		}
+	}
+	if machine.rngState != rng {
+		flags |= deltaRNG
+		body = binary.AppendUvarint(body, uint64(machine.rngState))
+	}
+	t.data = binary.AppendUvarint(t.data, uint64(pc))
+	t.data = append(t.data, op, flags)
+	t.data = append(t.data, body...)
+	t.steps++
+	return cont, err
+}
+
+// Run records machine until it halts or fails
+func (r *Recorder) Run(machine *VM) error {
+	defer machine.Flush()
+	for machine.Running() {
+		if _, err := r.Step(machine); err != nil {
+			return fmt.Errorf("error at PC=%d: %v", machine.PC(), err)
+		}
+	}
+	return nil
+}
+
+// Trace returns the trace recorded so far, ending in machine's state
+func (r *Recorder) Trace(machine *VM) *TimeTrace {
+	t := r.trace
+	t.end = EncodeSnapshot(machine.Snapshot())
+	return &t
+}
+
+// Steps returns the number of steps recorded
+func (t *TimeTrace) Steps() int64 {
+	return t.steps
+}
+
+// decode reads the step whose delta starts at off and returns where the
+// next one starts
+func (t *TimeTrace) decode(step int64, off int) (TraceStep, int, error) {
+	s := TraceStep{Step: step}
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(t.data[min(off, len(t.data)):])
+		if n <= 0 {
+			off = len(t.data) + 1
+			return 0
+		}
+		off += n
+		return v
+	}
+	varint := func() int32 {
+		v, n := binary.Varint(t.data[min(off, len(t.data)):])
+		if n <= 0 {
+			off = len(t.data) + 1
+			return 0
+		}
+		off += n
+		return int32(v)
+	}
+	s.PC = uint32(uvarint())
+	if off+2 > len(t.data) {
+		return s, off, fmt.Errorf("time-travel trace step %d is corrupt", step)
+	}
+	flags := t.data[off+1]
+	s.Op = t.data[off]
+	off += 2
+	stack := func(flag byte) (int, []int32) {
+		if flags&flag == 0 {
+			return 0, nil
+		}
+		pop, n := int(uvarint()), int(uvarint())
+		if n > len(t.data) {
+			return 0, nil
+		}
+		push := make([]int32, n)
+		for i := range push {
+			push[i] = varint()
+		}
+		return pop, push
+	}
+	s.pop, s.push = stack(deltaStack)
+	s.returnPop, s.returnPush = stack(deltaReturnStack)
+	if flags&deltaWrites != 0 {
+		n := int(uvarint())
+		for i := 0; i < n && off <= len(t.data); i++ {
+			s.Writes = append(s.Writes, MemoryWrite{Addr: uint32(uvarint()), Value: varint()})
+		}
+	}
+	if flags&deltaRNG != 0 {
+		s.rng, s.rngSet = uint32(uvarint()), true
+	}
+	if off > len(t.data) {
+		return s, off, fmt.Errorf("time-travel trace step %d is corrupt", step)
+	}
+	return s, off, nil
+}
+
+// apply changes s as the step did
+func (step TraceStep) apply(s *Snapshot) error {
+	if step.pop < 0 || step.pop > len(s.Stack) || step.returnPop < 0 || step.returnPop > len(s.ReturnStack) {
+		return fmt.Errorf("time-travel trace step %d pops more than the stack holds", step.Step)
+	}
+	s.Stack = append(s.Stack[:len(s.Stack)-step.pop], step.push...)
+	s.ReturnStack = append(s.ReturnStack[:len(s.ReturnStack)-step.returnPop], step.returnPush...)
+	for _, w := range step.Writes {
+		if int(w.Addr)+4 <= len(s.Memory) {
+			binary.BigEndian.PutUint32(s.Memory[w.Addr:], uint32(w.Value))
+		}
+	}
+	if step.rngSet {
+		s.RNGState = step.rng
+	}
+	s.LastOpcode = step.Op
+	return nil
+}
+
+// checkStep reports a step outside the trace; the last valid one is limit
+func (t *TimeTrace) checkStep(step, limit int64) error {
+	if step < 0 || step > limit {
+		return fmt.Errorf("step %d is outside the trace, which has %d steps", step, t.steps)
+	}
+	return nil
+}
+
+// StateAt returns the VM's state before the given step ran, counting from
+// 0; step Steps() is the state the recording ended in. A VM restored from
+// it carries on from there.
+func (t *TimeTrace) StateAt(step int64) (*Snapshot, error) {
+	if err := t.checkStep(step, t.steps); err != nil {
+		return nil, err
+	}
+	if step == t.steps {
+		return ParseSnapshot(t.end)
+	}
+	i := step / t.Interval
+	s, err := ParseSnapshot(t.checkpoints[i].snapshot)
+	if err != nil {
+		return nil, err
+	}
+	off := t.checkpoints[i].offset
+	for n := i * t.Interval; ; n++ {
+		var d TraceStep
+		if d, off, err = t.decode(n, off); err != nil {
+			return nil, err
+		}
+		if n == step {
+			s.PC = d.PC
+			return s, nil
+		}
+		if err := d.apply(s); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// StepAt returns the given step
+func (t *TimeTrace) StepAt(step int64) (TraceStep, error) {
+	if err := t.checkStep(step, t.steps-1); err != nil {
+		return TraceStep{}, err
+	}
+	i := step / t.Interval
+	off := t.checkpoints[i].offset
+	for n := i * t.Interval; ; n++ {
+		d, next, err := t.decode(n, off)
+		if err != nil || n == step {
+			return d, err
+		}
+		off = next
+	}
+}
+
+// LastWrite returns the last step before the given one that stored to the
+// word holding addr, searching back one checkpoint at a time
+func (t *TimeTrace) LastWrite(addr uint32, before int64) (TraceStep, bool, error) {
+	before = min(before, t.steps)
+	for i := (before - 1) / t.Interval; before > 0 && i >= 0; i-- {
+		var last TraceStep
+		found := false
+		off := t.checkpoints[i].offset
+		for n := i * t.Interval; n < min(before, (i+1)*t.Interval); n++ {
+			d, next, err := t.decode(n, off)
+			if err != nil {
+				return TraceStep{}, false, err
+			}
+			for _, w := range d.Writes {
+				if addr >= w.Addr && addr-w.Addr < 4 {
+					last, found = d, true
+				}
+			}
+			off = next
+		}
+		if found {
+			return last, true, nil
+		}
+	}
+	return TraceStep{}, false, nil
+}
+
+// EncodeTimeTrace serializes a trace: magic, version, the interval and
+// step count, the deltas, then the checkpoints as an index of delta
+// offsets and snapshots, and the final snapshot
+func EncodeTimeTrace(t *TimeTrace) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(TimeTraceMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(TimeTraceFormatVersion))
+	chunk := func(data []byte) {
+		buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+		buf.Write(data)
+	}
+	buf.Write(binary.AppendUvarint(nil, uint64(t.Interval)))
+	buf.Write(binary.AppendUvarint(nil, uint64(t.steps)))
+	chunk(t.data)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(t.checkpoints))))
+	for _, c := range t.checkpoints {
+		buf.Write(binary.AppendUvarint(nil, uint64(c.offset)))
+		chunk(c.snapshot)
+	}
+	chunk(t.end)
+	return buf.Bytes()
+}
+
+// ParseTimeTrace decodes a trace written by EncodeTimeTrace. The deltas are
+// decoded as queries reach them.
+func ParseTimeTrace(data []byte) (*TimeTrace, error) {
+	if len(data) < len(TimeTraceMagic)+2 || string(data[:len(TimeTraceMagic)]) != TimeTraceMagic {
+		return nil, fmt.Errorf("not a time-travel trace")
+	}
+	if v := binary.BigEndian.Uint16(data[len(TimeTraceMagic):]); v != TimeTraceFormatVersion {
+		return nil, fmt.Errorf("unsupported time-travel trace version %d", v)
+	}
+	off := len(TimeTraceMagic) + 2
+	truncated := false
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(data[off:])
+		if n <= 0 {
+			truncated = true
+			return 0
+		}
+		off += n
+		return v
+	}
+	chunk := func() []byte {
+		n := uvarint()
+		if truncated || n > uint64(len(data)-off) {
+			truncated = true
+			return nil
+		}
+		off += int(n)
+		return data[off-int(n) : off]
+	}
+	t := &TimeTrace{Interval: int64(uvarint()), steps: int64(uvarint())}
+	t.data = chunk()
+	count := uvarint()
+	for i := uint64(0); i < count && !truncated; i++ {
+		c := checkpoint{offset: int(uvarint())}
+		c.snapshot = chunk()
+		t.checkpoints = append(t.checkpoints, c)
+	}
+	t.end = chunk()
+	switch {
+	case truncated:
+		return nil, fmt.Errorf("time-travel trace truncated")
+	case t.Interval <= 0 || t.steps < 0 || int64(len(t.checkpoints)) != (t.steps+t.Interval-1)/t.Interval:
+		return nil, fmt.Errorf("time-travel trace index does not match its %d steps", t.steps)
+	}
+	for _, c := range t.checkpoints {
+		if c.offset > len(t.data) {
+			return nil, fmt.Errorf("time-travel trace index points past its deltas")
+		}
+	}
+	return t, nil
+}
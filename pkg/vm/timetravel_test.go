@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func recordCount(t *testing.T, interval int64) *TimeTrace {
+	t.Helper()
+	machine := NewVM(countProgram())
+	recorder := NewRecorder(interval)
+	if err := recorder.Run(machine); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	trace, err := ParseTimeTrace(EncodeTimeTrace(recorder.Trace(machine)))
+	if err != nil {
+		t.Fatalf("ParseTimeTrace error: %v", err)
+	}
+	return trace
+}
+
+func TestTimeTraceStateAt(t *testing.T) {
+	trace := recordCount(t, 4)
+	if trace.Steps() != 31 {
+		t.Fatalf("Expected 31 steps, got %d", trace.Steps())
+	}
+	for step := int64(0); step <= trace.Steps(); step++ {
+		machine := NewVM(countProgram())
+		if step > 0 {
+			machine.RunLimited(Limits{MaxSteps: step})
+		}
+		want := machine.Snapshot()
+		got, err := trace.StateAt(step)
+		if err != nil {
+			t.Fatalf("StateAt(%d) error: %v", step, err)
+		}
+		if got.PC != want.PC || !reflect.DeepEqual(got.Stack, want.Stack) || !reflect.DeepEqual(got.Memory, want.Memory) {
+			t.Errorf("StateAt(%d): got PC %d stack %v, want PC %d stack %v", step, got.PC, got.Stack, want.PC, want.Stack)
+		}
+	}
+	if _, err := trace.StateAt(32); err == nil {
+		t.Error("Expected an error for a step past the end")
+	}
+}
+
+func TestTimeTraceLastWrite(t *testing.T) {
+	trace := recordCount(t, 4)
+	// Each value takes PUSH, DUP, STORE; 2 is stored to 8 by step 5
+	step, ok, err := trace.LastWrite(10, trace.Steps())
+	if err != nil || !ok {
+		t.Fatalf("Expected a store to the word at 8, got %v %v", ok, err)
+	}
+	if step.Step != 5 || step.Op != OpStore || step.Writes[0] != (MemoryWrite{Addr: 8, Value: 2}) {
+		t.Errorf("Expected step 5 to store 2 at 8, got %+v", step)
+	}
+	if _, ok, _ := trace.LastWrite(8, 5); ok {
+		t.Error("Expected no store to 8 before step 5")
+	}
+	if got, err := trace.StepAt(5); err != nil || !reflect.DeepEqual(got, step) {
+		t.Errorf("StepAt(5) = %+v, %v", got, err)
+	}
+}
+
+func TestParseTimeTraceRejects(t *testing.T) {
+	machine := NewVM(countProgram())
+	recorder := NewRecorder(4)
+	recorder.Run(machine)
+	data := EncodeTimeTrace(recorder.Trace(machine))
+	if _, err := ParseTimeTrace(data[:len(data)/2]); err == nil {
+		t.Error("Expected an error for a truncated trace")
+	}
+	if _, err := ParseTimeTrace([]byte("NUXS")); err == nil {
+		t.Error("Expected an error for a snapshot")
+	}
+}
@@ -0,0 +1,231 @@
+package vm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// TraceLevel selects how much a Tracer records
+type TraceLevel int
+
+const (
+	TraceAll     TraceLevel = iota // Every instruction with the data stack
+	TraceCalls                     // Only CALL, CALLSTACK and RET, indented as a call tree
+	TraceExplain                   // Every instruction as an English sentence, for teaching
+	TraceJSON                      // One Frame per instruction as a line of JSON, for visualizers
+)
+
+// Frame is the VM's state after one instruction, as written at TraceJSON
+type Frame struct {
+	Step        int           `json:"step"`
+	PC          uint32        `json:"pc"` // Address of the instruction
+	Op          string        `json:"op"`
+	Explain     string        `json:"explain"`
+	Stack       []int32       `json:"stack"`
+	ReturnStack []int32       `json:"rstack"`
+	Writes      []MemoryWrite `json:"writes,omitempty"`
+	Output      string        `json:"out,omitempty"` // What OUT printed
+}
+
+// MemoryWrite is a word stored by STORE or STOREI
+type MemoryWrite struct {
+	Addr  uint32 `json:"addr"`
+	Value int32  `json:"value"`
+}
+
+// ParseTraceLevel reads a level name: "all", "calls", "explain" or "json"
+func ParseTraceLevel(name string) (TraceLevel, error) {
+	switch strings.ToLower(name) {
+	case "all":
+		return TraceAll, nil
+	case "calls":
+		return TraceCalls, nil
+	case "explain":
+		return TraceExplain, nil
+	case "json":
+		return TraceJSON, nil
+	}
+	return 0, fmt.Errorf("unknown trace level %q (want all, calls, explain or json)", name)
+}
+
+// Tracer runs a VM and writes a line for each instruction it executes.
+// The filters keep traces of large programs small enough to read.
+type Tracer struct {
+	Out     io.Writer
+	Level   TraceLevel
+	Symbols []Symbol // Names call targets at TraceCalls and TraceExplain
+
+	Ops  map[byte]bool // Record only these opcodes; nil records all of them
+	From uint32        // Start recording the first time PC reaches this address; 0 starts at once
+	Max  int           // Stop recording after this many lines; 0 means no limit
+
+	// Poison values, such as math.MinInt32 kept for "missing", fail the
+	// run with a *PoisonError when an arithmetic instruction takes one.
+	// The error names the instruction that produced the value, which the
+	// tracer follows through the stacks and memory.
+	Poison []int32
+
+	lines      int
+	started    bool
+	baseDepth  int               // Return stack depth when recording started
+	frames     []uint32          // Entry address of each call still running, for TraceCalls
+	origins    []uint32          // The PC that produced each stack value, for Poison
+	rOrigins   []uint32          // The same for the return stack
+	memOrigins map[uint32]uint32 // The same for each cell holding a poison value
+}
+
+// NewTracer returns a Tracer that records every instruction to out
+func NewTracer(out io.Writer) *Tracer {
+	return &Tracer{Out: out}
+}
+
+// ParseTraceOps turns a comma-separated list of opcode names such as
+// "CALL,RET" into a filter for Tracer.Ops
+func ParseTraceOps(list string) (map[byte]bool, error) {
+	ops := make(map[byte]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		op, ok := OpcodeByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown opcode %q in trace filter", name)
+		}
+		ops[op] = true
+	}
+	return ops, nil
+}
+
+// Done reports whether the tracer has written its Max lines
+func (t *Tracer) Done() bool {
+	return t.Max > 0 && t.lines >= t.Max
+}
+
+// Step records the instruction at PC if it passes the filters, then executes it
+func (t *Tracer) Step(machine *VM) (bool, error) {
+	if len(t.Poison) > 0 {
+		return t.stepPoison(machine, func() (bool, error) { return t.record(machine) })
+	}
+	return t.record(machine)
+}
+
+// record is Step without the poison check
+func (t *Tracer) record(machine *VM) (bool, error) {
+	pc := machine.PC()
+	if !t.started && (t.From == 0 || pc == t.From) {
+		t.started = true
+		t.baseDepth = len(machine.returnStack)
+	}
+	op, ok := machine.byteAt(pc)
+	if !t.started || t.Done() || !ok {
+		return machine.Step()
+	}
+	if t.Ops != nil && !t.Ops[op] {
+		return machine.Step()
+	}
+	if t.Level == TraceAll {
+		fmt.Fprintf(t.Out, "PC=%d %s Stack=%v\n", pc, OpcodeName(op), machine.stack)
+		t.lines++
+		return machine.Step()
+	}
+	if t.Level == TraceJSON {
+		return t.stepJSON(machine)
+	}
+	if t.Level == TraceExplain {
+		text := machine.Explain(t.Symbols)
+		cont, err := machine.Step()
+		if err != nil {
+			fmt.Fprintln(t.Out, text)
+		} else {
+			fmt.Fprintf(t.Out, "%s → stack is now %v\n", text, machine.stack)
+		}
+		t.lines++
+		return cont, err
+	}
+
+	if op != OpCall && op != OpCallStack && op != OpRet {
+		return machine.Step()
+	}
+	indent := strings.Repeat("  ", max(len(machine.returnStack)-t.baseDepth, 0))
+	cont, err := machine.Step()
+	if err != nil {
+		return cont, err
+	}
+	if op == OpRet {
+		if len(t.frames) > 0 {
+			t.frames = t.frames[:len(t.frames)-1]
+		}
+		caller := ""
+		if len(t.frames) > 0 {
+			if sym, ok := t.symbolAt(t.frames[len(t.frames)-1]); ok {
+				caller = " in " + sym
+			}
+		}
+		fmt.Fprintf(t.Out, "%sRET to 0x%X%s\n", indent, machine.pc, caller)
+	} else {
+		t.frames = append(t.frames, machine.pc)
+		target := fmt.Sprintf("0x%X", machine.pc)
+		if sym, ok := t.symbolAt(machine.pc); ok {
+			target = sym + " (" + target + ")"
+		}
+		fmt.Fprintf(t.Out, "%s%s %s\n", indent, OpcodeName(op), target)
+	}
+	t.lines++
+	return cont, nil
+}
+
+// stepJSON executes one instruction and writes the Frame it leaves
+func (t *Tracer) stepJSON(machine *VM) (bool, error) {
+	pc := machine.pc
+	op, _ := machine.byteAt(pc)
+	frame := Frame{Step: t.lines, PC: pc, Op: OpcodeName(op), Explain: machine.Explain(t.Symbols)}
+	s := machine.stack
+	n := len(s)
+	switch {
+	case op == OpStore && n >= 1 && int(pc)+5 <= machine.memSize():
+		raw, _ := machine.span(pc+1, 4)
+		addr := binary.BigEndian.Uint32(raw)
+		frame.Writes = []MemoryWrite{{Addr: addr, Value: s[n-1]}}
+	case op == OpStoreI && n >= 2:
+		frame.Writes = []MemoryWrite{{Addr: uint32(s[n-1]), Value: s[n-2]}}
+	case op == OpOut && n >= 2:
+		frame.Output = FormatOutput(s[n-2], s[n-1])
+	}
+	cont, err := machine.Step()
+	if err != nil {
+		return cont, err
+	}
+	frame.Stack = machine.Stack()
+	frame.ReturnStack = machine.ReturnStack()
+	t.lines++
+	return cont, json.NewEncoder(t.Out).Encode(frame)
+}
+
+// symbolAt names the word that starts at addr
+func (t *Tracer) symbolAt(addr uint32) (string, bool) {
+	for _, sym := range t.Symbols {
+		if uint32(sym.Address) == addr {
+			return sym.Name, true
+		}
+	}
+	return "", false
+}
+
+// Run traces machine until it halts. Once Max lines have been written the
+// rest of the program runs untraced, though still checked for Poison.
+func (t *Tracer) Run(machine *VM) error {
+	defer machine.Flush()
+	for machine.Running() {
+		if t.Done() && len(t.Poison) == 0 {
+			return machine.Run()
+		}
+		if _, err := t.Step(machine); err != nil {
+			return fmt.Errorf("error at PC=%d: %w", machine.PC(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// traceProgram calls a word twice: CALL 0x400F / CALL 0x400F / HALT, then INC / RET at 0x400F
+func traceProgram() []byte {
+	var code []byte
+	code = append(code, ShortPushInstruction(1)...) // 0x4000
+	code = append(code, CallInstruction(0x400F)...) // 0x4002
+	code = append(code, CallInstruction(0x400F)...) // 0x4007
+	code = append(code, OpHalt)                     // 0x400C
+	code = append(code, OpHalt, OpHalt)             // padding
+	code = append(code, OpInc, OpRet)               // 0x400F
+	return code
+}
+
+func TestTracerRecordsEveryInstruction(t *testing.T) {
+	var out bytes.Buffer
+	machine := NewVM(traceProgram())
+	if err := NewTracer(&out).Run(machine); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("expected 8 trace lines, got %d:\n%s", len(lines), out.String())
+	}
+	if lines[0] != "PC=16384 PUSH8 Stack=[]" {
+		t.Errorf("unexpected first line %q", lines[0])
+	}
+	if got := machine.Stack(); len(got) != 1 || got[0] != 3 {
+		t.Errorf("expected [3], got %v", got)
+	}
+}
+
+func TestTracerFilters(t *testing.T) {
+	ops, err := ParseTraceOps("call, ret")
+	if err != nil {
+		t.Fatalf("ParseTraceOps failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	tracer := NewTracer(&out)
+	tracer.Ops = ops
+	if err := tracer.Run(NewVM(traceProgram())); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := strings.Count(out.String(), "\n"); got != 4 {
+		t.Errorf("ops filter: expected 4 lines, got %d:\n%s", got, out.String())
+	}
+	if strings.Contains(out.String(), "INC") {
+		t.Errorf("ops filter let INC through:\n%s", out.String())
+	}
+
+	out.Reset()
+	tracer = NewTracer(&out)
+	tracer.From = 0x4007
+	tracer.Max = 2
+	machine := NewVM(traceProgram())
+	if err := tracer.Run(machine); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := "PC=16391 CALL Stack=[2]\nPC=16399 INC Stack=[2]\n"
+	if out.String() != want {
+		t.Errorf("from/max: expected\n%s\ngot\n%s", want, out.String())
+	}
+	if got := machine.Stack(); len(got) != 1 || got[0] != 3 {
+		t.Errorf("program should run to completion after the trace ends, got %v", got)
+	}
+
+	if _, err := ParseTraceOps("CALL,BOGUS"); err == nil || !contains(err.Error(), "BOGUS") {
+		t.Errorf("expected unknown opcode error, got %v", err)
+	}
+}
+
+func TestTracerCallLevel(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewTracer(&out)
+	tracer.Level = TraceCalls
+	tracer.Symbols = []Symbol{{Name: "BUMP", Address: 0x400F}}
+	if err := tracer.Run(NewVM(traceProgram())); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := "CALL BUMP (0x400F)\n" +
+		"  RET to 0x4007\n" +
+		"CALL BUMP (0x400F)\n" +
+		"  RET to 0x400C\n"
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+
+	// Without symbols, targets are bare addresses
+	out.Reset()
+	tracer = NewTracer(&out)
+	tracer.Level = TraceCalls
+	tracer.Max = 1
+	if err := tracer.Run(NewVM(traceProgram())); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if out.String() != "CALL 0x400F\n" {
+		t.Errorf("expected a bare address, got %q", out.String())
+	}
+
+	if _, err := ParseTraceLevel("verbose"); err == nil {
+		t.Error("expected an error for an unknown trace level")
+	}
+}
+
+func TestTracerExplain(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewTracer(&out)
+	tracer.Level = TraceExplain
+	tracer.Symbols = []Symbol{{Name: "BUMP", Address: 0x400F}}
+	tracer.Max = 3
+	if err := tracer.Run(NewVM(traceProgram())); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := "PUSH8: pushes 1 → stack is now [1]\n" +
+		"CALL: calls BUMP (0x400F) → stack is now [1]\n" +
+		"INC: adds 1 to 1, giving 2 → stack is now [2]\n"
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+
+	// Without enough values to describe, the generic description is used
+	machine := NewVM([]byte{OpSwap})
+	if got := machine.Explain(nil); got != "SWAP: "+OpcodeDescription(OpSwap) {
+		t.Errorf("unexpected explanation %q", got)
+	}
+	unknown := OpcodeDescription(0xFF)
+	for op := 0; op < 256; op++ {
+		if !strings.HasPrefix(OpcodeName(byte(op)), "UNKNOWN") && OpcodeDescription(byte(op)) == unknown {
+			t.Errorf("%s has no description", OpcodeName(byte(op)))
+		}
+	}
+}
+
+func TestTracerJSON(t *testing.T) {
+	code := append(ShortPushInstruction(7), StoreInstruction(8)...)
+	code = append(code, ShortPushInstruction(65)...)
+	code = append(code, ShortPushInstruction(1)...)
+	code = append(code, OpOut, OpHalt)
+	var out bytes.Buffer
+	tracer := NewTracer(&out)
+	tracer.Level = TraceJSON
+	if err := tracer.Run(NewVM(code)); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var frames []Frame
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var frame Frame
+		if err := json.Unmarshal([]byte(line), &frame); err != nil {
+			t.Fatalf("bad frame %q: %v", line, err)
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) != 6 {
+		t.Fatalf("expected 6 frames, got %d:\n%s", len(frames), out.String())
+	}
+	if f := frames[0]; f.Op != "PUSH8" || !reflect.DeepEqual(f.Stack, []int32{7}) || f.Explain != "PUSH8: pushes 7" {
+		t.Errorf("unexpected first frame %+v", f)
+	}
+	if w := frames[1].Writes; len(w) != 1 || w[0] != (MemoryWrite{Addr: 8, Value: 7}) {
+		t.Errorf("expected STORE to record a write of 7 to 8, got %+v", w)
+	}
+	if frames[4].Output != "A" || frames[4].Step != 4 {
+		t.Errorf("expected OUT to record \"A\" at step 4, got %+v", frames[4])
+	}
+}
@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// StackUnderflowError reports an instruction that needed more values than
+// the stack held. Its message is the instruction's own error followed by a
+// diagram of the values it takes against what was there:
+//
+//	add failed: stack underflow: need 2 values for ADD
+//	  ADD   [a, b] → [a + b]
+//	  stack [?, 7]
+//	  in square, line 12
+type StackUnderflowError struct {
+	PC     uint32
+	Opcode byte
+	Inputs []string // Names of the values the opcode takes, deepest first
+	Stack  []int32  // The stack when it failed, bottom first
+	Word   string   // The word being run, "" if unknown
+	Line   int      // Its source line, 0 if unknown
+	Err    error    // The instruction's error
+}
+
+func (e *StackUnderflowError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Err.Error())
+
+	// The effect's inputs over the values that were there, column by column
+	missing := len(e.Inputs) - len(e.Stack)
+	takes := make([]string, len(e.Inputs))
+	has := make([]string, len(e.Inputs))
+	for i, name := range e.Inputs {
+		value := "?"
+		if i >= missing {
+			value = fmt.Sprint(e.Stack[i-missing])
+		}
+		width := max(len(name), len(value))
+		takes[i], has[i] = fmt.Sprintf("%-*s", width, name), fmt.Sprintf("%-*s", width, value)
+	}
+	info, _ := LookupOpcode(e.Opcode)
+	_, rest, _ := strings.Cut(info.Effect, "]")
+	label := max(len(info.Name), len("stack"))
+	fmt.Fprintf(&b, "\n  %-*s [%s]%s", label, info.Name, strings.TrimRight(strings.Join(takes, ", "), " "), rest)
+	fmt.Fprintf(&b, "\n  %-*s [%s]", label, "stack", strings.TrimRight(strings.Join(has, ", "), " "))
+
+	switch {
+	case e.Word != "" && e.Line > 0:
+		fmt.Fprintf(&b, "\n  in %s, line %d", e.Word, e.Line)
+	case e.Word != "":
+		fmt.Fprintf(&b, "\n  in %s", e.Word)
+	case e.Line > 0:
+		fmt.Fprintf(&b, "\n  at line %d", e.Line)
+	}
+	return b.String()
+}
+
+func (e *StackUnderflowError) Unwrap() error {
+	return e.Err
+}
+
+// underflow turns err, from the instruction at pc, into a
+// *StackUnderflowError when the instruction took more values than stack,
+// the stack it started with, held. Other errors are returned as they are.
+func (vm *VM) underflow(pc uint32, stack []int32, err error) error {
+	if !strings.Contains(err.Error(), "stack underflow") || strings.Contains(err.Error(), "return stack underflow") {
+		return err
+	}
+	code, ok := vm.span(pc, 1)
+	if !ok {
+		return err
+	}
+	inputs := stackInputs(code[0])
+	if len(stack) >= len(inputs) {
+		return err
+	}
+	var already *StackUnderflowError
+	if errors.As(err, &already) {
+		return err
+	}
+	e := &StackUnderflowError{PC: pc, Opcode: code[0], Inputs: inputs, Stack: slices.Clone(stack), Err: err}
+	if vm.Locate != nil {
+		e.Word, e.Line = vm.Locate(pc)
+	} else if sym, ok := (DebugOptions{Symbols: vm.symbols}).wordAt(pc); ok {
+		e.Word = sym.Name
+	}
+	return e
+}
+
+// stackInputs returns the names of the values op takes from the data
+// stack, from its stack effect: "[a, b] → [a + b]" takes a and b
+func stackInputs(op byte) []string {
+	info, ok := LookupOpcode(op)
+	if !ok || !strings.HasPrefix(info.Effect, "[") {
+		return nil
+	}
+	list, _, _ := strings.Cut(info.Effect[1:], "]")
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ", ")
+}
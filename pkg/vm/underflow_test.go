@@ -0,0 +1,52 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStackUnderflowError(t *testing.T) {
+	machine, err := NewVMForImage(&Image{
+		Code:    []byte{OpPush8, 7, OpCall, 0, 0, 0x40, 0x08, OpHalt, OpAdd, OpRet},
+		Symbols: []Symbol{{Name: "bad", Address: UserMemoryOffset + 8}},
+	})
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	err = machine.Run()
+	var underflow *StackUnderflowError
+	if !errors.As(err, &underflow) {
+		t.Fatalf("Expected a StackUnderflowError, got %v", err)
+	}
+	if underflow.Opcode != OpAdd || underflow.Word != "bad" || len(underflow.Inputs) != 2 {
+		t.Errorf("Expected ADD in bad taking 2 values, got %+v", underflow)
+	}
+	want := "add failed: stack underflow: need 2 values for ADD\n" +
+		"  ADD   [a, b] → [a + b]\n" +
+		"  stack [?, 7]\n" +
+		"  in bad"
+	if !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("Expected the error to end\n%s\ngot\n%s", want, err)
+	}
+}
+
+func TestStackUnderflowLocate(t *testing.T) {
+	machine := NewVM([]byte{OpRot})
+	machine.Push(1)
+	machine.Locate = func(addr uint32) (string, int) { return "spin", 4 }
+	_, err := machine.Step()
+	if err == nil || !strings.HasSuffix(err.Error(), "  ROT   [a, b, c] → [b, c, a]\n  stack [?, ?, 1]\n  in spin, line 4") {
+		t.Errorf("Expected a diagram located in spin, got %v", err)
+	}
+}
+
+// Errors that are not a short data stack are left as they are
+func TestStackUnderflowOnlyForTheDataStack(t *testing.T) {
+	machine := NewVM([]byte{OpFromR})
+	_, err := machine.Step()
+	var underflow *StackUnderflowError
+	if err == nil || errors.As(err, &underflow) {
+		t.Errorf("Expected a plain return stack error, got %v", err)
+	}
+}
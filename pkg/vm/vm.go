@@ -1,12 +1,20 @@
-// Package vm implements a simple stack-based virtual machine with 32 opcodes.
+// Package vm implements a simple stack-based virtual machine.
 package vm
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"unicode/utf8"
 )
 
+// OutputBufferSize is how many bytes of output the VM holds before writing
+// them to Stdout
+const OutputBufferSize = 4096
+
 // MaxStackSize defines the maximum number of elements in the stack.
 const MaxStackSize = 8192
 const MaxReturnStackSize = 1024
@@ -36,8 +44,11 @@ const (
 	// RNG register: read returns next pseudo-random int32 (LCG); write sets seed.
 	RNGDataAddr = AudioControlAddr + 1
 
+	// Frame vector: the address of the ON-FRAME quotation Tick runs, 0 for none.
+	FrameVectorAddr = RNGDataAddr + 4 // 0x3006
+
 	// Audio Sample Buffer: 512 int32 samples (2048 bytes) for Mac Plus/SE-style looping PCM.
-	// Starts at 0x3010, leaving 0x3006–0x300F for future control registers.
+	// Starts at 0x3010, leaving 0x300A–0x300F for future control registers.
 	// Each sample is an int32 in [-128, 127]; JS reads and plays on a continuous loop.
 	AudioSampleBufferAddr     = RNGDataAddr + 14 // 0x3010
 	AudioSampleBufferSize     = 512              // sample count
@@ -69,12 +80,92 @@ type VM struct {
 	// SoundHandler is called when a sound ID is written to AudioControlAddr.
 	SoundHandler func(soundID int32)
 
-	// OutputHandler is called by OpOut instead of writing to stdout.
-	// format: 0 = print as number, 1 = print as character.
+	// OutputHandler is called by OpOut instead of writing to Stdout or
+	// Stderr. format: 0 = print as number, 1 = print as character, plus
+	// FormatError for the error stream, FormatZero and a FormatWidth.
+	// Test its bits with a mask, such as format&FormatChar, rather than
+	// comparing it, or pass both values to FormatOutput to get the text
+	// OpOut would print.
 	OutputHandler func(value int32, format int32)
 
+	// Stdout and Stderr receive OpOut's normal and error output; nil
+	// means os.Stdout and os.Stderr. Normal output is buffered until Flush.
+	Stdout  io.Writer
+	Stderr  io.Writer
+	outBuf  []byte
+	written int64 // Bytes OUT has produced, for Limits.MaxOutput
+
+	// Stdin is where ACCEPT reads lines; nil means os.Stdin
+	Stdin io.Reader
+	in    *bufio.Reader // Buffers inSrc
+	inSrc io.Reader
+
+	// Deterministic makes every run of a program from the same state do
+	// exactly the same thing, for replicated and lock-step use: keyboard
+	// reads return 0 without calling KeyboardHandler, YieldHandler is not
+	// called, only host functions registered with RegisterDeterministicHost
+	// may run, and RunLimited refuses time limits and interrupts. The VM
+	// has no other source of nondeterminism: arithmetic is 32-bit integer
+	// and the RNG register is seeded with a constant.
+	Deterministic bool
+
+	// Journal, when set, records the run's output, memory writes, host
+	// calls and limits for review afterwards.
+	Journal *Journal
+
+	// Hook, when set, sees each instruction before it runs and may block
+	// it, for policies the VM does not enforce itself
+	Hook InstructionHook
+
+	// Clock times AFTER and EVERY; nil means the wall clock. A
+	// Deterministic VM must set it to use timers.
+	Clock Clock
+
+	// Locate, when set, names the word and source line of the code at an
+	// address, for StackUnderflowError; nil names the word from the
+	// image's symbols, without a line
+	Locate func(addr uint32) (word string, line int)
+
 	lastOpcode byte
 	rngState   uint32 // LCG state for RNGDataAddr reads
+
+	hostFuncs map[uint32]*HostFunction // By HostID
+	granted   map[string]bool          // Capabilities the program may use; nil grants all
+	closers   []func()                 // Release what host functions hold open, for Close
+
+	timers     timerQueue
+	timerSeq   uint64
+	timerDepth int // Return stack depth inside a timer's quotation, 0 outside
+
+	// FrameSteps is the most instructions one Tick may run; 0 means
+	// DefaultFrameSteps.
+	FrameSteps int64
+
+	frameDepth int  // Return stack depth inside the ON-FRAME quotation, 0 outside
+	frameEnded bool // HALT ran inside a frame
+
+	exitStatus int // ExitAborted once ABORT ran
+
+	// For Stats: instructions Step has run, the deepest each stack got
+	// after one, and the end of the highest word stored to
+	steps          int64
+	maxDepth       int
+	maxReturnDepth int
+	memoryHigh     uint32
+
+	// Strict stops CALL, CALLSTACK, JMP, JZ and JMPTABLE, and the timer
+	// and frame quotations, from going anywhere but the code segment, so a
+	// bad address fails at the jump instead of running reserved memory,
+	// device registers or data as code. On by default.
+	Strict       bool
+	codeEnd      uint32      // End of the code segment; 0 means the end of memory
+	reservedCode [][2]uint32 // Reserved memory ranges a Strict VM may also run
+	redefined    [][2]uint32 // New word bodies Redefine appended, which it may also run
+	symbols      []Symbol    // The image's symbol table, naming addresses in DebugState
+	recorder     *Recorder   // Recording the instruction being executed, if any
+
+	shared   []byte // Read-only segment from the end of memory, for NewSharedVM
+	forkCode []byte // The code segment while shared with forks; memory's copy may be missing
 }
 
 // NewVM initializes a new VM with the given program.
@@ -101,6 +192,7 @@ func NewVM(program []byte, trace ...bool) *VM {
 		userMemoryStart:    UserMemoryOffset,
 		trace:              traceEnabled,
 		rngState:           1,
+		Strict:             true,
 	}
 }
 
@@ -128,6 +220,8 @@ func NewVMWithReservedMemory(program []byte, reservedSize uint32, trace ...bool)
 		reservedMemorySize: reservedSize,
 		userMemoryStart:    userStart,
 		trace:              traceEnabled,
+		rngState:           1,
+		Strict:             true,
 	}
 }
 
@@ -136,7 +230,7 @@ func (vm *VM) WriteReservedMemory(offset uint32, data []byte) error {
 	if offset >= vm.reservedMemorySize {
 		return fmt.Errorf("reserved memory offset %d out of bounds (max %d)", offset, vm.reservedMemorySize)
 	}
-	if offset+uint32(len(data)) > vm.reservedMemorySize {
+	if uint64(offset)+uint64(len(data)) > uint64(vm.reservedMemorySize) {
 		return fmt.Errorf("reserved memory write would overflow (offset %d + size %d > %d)",
 			offset, len(data), vm.reservedMemorySize)
 	}
@@ -144,12 +238,31 @@ func (vm *VM) WriteReservedMemory(offset uint32, data []byte) error {
 	return nil
 }
 
+// InstallRoutine writes code to reserved memory at offset and lets a Strict
+// VM run it, so programs can CALL it or CALLSTACK its address
+func (vm *VM) InstallRoutine(offset uint32, code []byte) error {
+	if err := vm.WriteReservedMemory(offset, code); err != nil {
+		return err
+	}
+	return vm.MarkReservedExecutable(offset, uint32(len(code)))
+}
+
+// MarkReservedExecutable lets a Strict VM run the size bytes of reserved
+// memory at offset, for routines written there with WriteReservedMemory
+func (vm *VM) MarkReservedExecutable(offset, size uint32) error {
+	if uint64(offset)+uint64(size) > uint64(vm.reservedMemorySize) {
+		return fmt.Errorf("reserved memory range %d+%d out of bounds (max %d)", offset, size, vm.reservedMemorySize)
+	}
+	vm.reservedCode = append(vm.reservedCode, [2]uint32{offset, offset + size})
+	return nil
+}
+
 // ReadReservedMemory reads data from reserved memory region
 func (vm *VM) ReadReservedMemory(offset uint32, size uint32) ([]byte, error) {
 	if offset >= vm.reservedMemorySize {
 		return nil, fmt.Errorf("reserved memory offset %d out of bounds (max %d)", offset, vm.reservedMemorySize)
 	}
-	if offset+size > vm.reservedMemorySize {
+	if uint64(offset)+uint64(size) > uint64(vm.reservedMemorySize) {
 		return nil, fmt.Errorf("reserved memory read would overflow (offset %d + size %d > %d)",
 			offset, size, vm.reservedMemorySize)
 	}
@@ -168,9 +281,53 @@ func (vm *VM) UserMemoryStart() uint32 {
 	return vm.userMemoryStart
 }
 
+// CodeSegment returns the addresses a Strict VM may run, from the start of
+// user memory to the end of the code. Without SetCodeEnd the code runs to
+// the end of memory. Routines marked with MarkReservedExecutable, and the
+// word bodies Redefine appends, may run too.
+func (vm *VM) CodeSegment() (start, end uint32) {
+	end = vm.codeEnd
+	if end == 0 {
+		end = uint32(vm.memSize())
+	}
+	return vm.userMemoryStart, end
+}
+
+// SetCodeEnd marks where the program's code ends and its data begins
+func (vm *VM) SetCodeEnd(addr uint32) {
+	vm.ownCode()
+	vm.codeEnd = addr
+}
+
+// checkTarget reports whether a Strict VM may jump to or call addr
+func (vm *VM) checkTarget(addr uint32) error {
+	if !vm.Strict {
+		return nil
+	}
+	start, end := vm.CodeSegment()
+	if addr < start || addr >= end {
+		for _, r := range vm.reservedCode {
+			if addr >= r[0] && addr < r[1] {
+				return nil
+			}
+		}
+		for _, r := range vm.redefined {
+			if addr >= r[0] && addr < r[1] {
+				return nil
+			}
+		}
+		return fmt.Errorf("target 0x%X is outside the code segment 0x%X-0x%X", addr, start, end)
+	}
+	return nil
+}
+
 // Memory returns a direct slice of the VM's memory.
 // The device framebuffer lives at [VideoFramebufferStart : VideoFramebufferEnd].
+// For a VM from NewSharedVM it ends where the shared program begins. A VM
+// sharing its code segment with a fork gets its own copy first, since the
+// slice may be written.
 func (vm *VM) Memory() []byte {
+	vm.ownCode()
 	return vm.memory
 }
 
@@ -520,9 +677,12 @@ func (vm *VM) CallStack() error {
 		return err
 	}
 
-	if addr < 0 || int(addr) >= len(vm.memory) {
+	if addr < 0 || int(addr) >= vm.memSize() {
 		return fmt.Errorf("invalid call address: %d", addr)
 	}
+	if err := vm.checkTarget(uint32(addr)); err != nil {
+		return err
+	}
 
 	if len(vm.returnStack) >= MaxReturnStackSize {
 		return fmt.Errorf("return stack overflow")
@@ -535,10 +695,14 @@ func (vm *VM) CallStack() error {
 
 // Jmp jumps to the specified address.
 func (vm *VM) Jmp() error {
-	if int(vm.pc+3) >= len(vm.memory) {
+	raw, ok := vm.operand()
+	if !ok {
 		return fmt.Errorf("jmp failed: program counter out of bounds")
 	}
-	addr := int32(binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4]))
+	addr := int32(raw)
+	if err := vm.checkTarget(raw); err != nil {
+		return fmt.Errorf("jmp failed: %v", err)
+	}
 	if vm.trace {
 		fmt.Fprintf(os.Stderr, "VM: OpJmp: Jumping to %d", addr)
 	}
@@ -548,16 +712,20 @@ func (vm *VM) Jmp() error {
 
 // Jz pops a value and jumps if it's zero.
 func (vm *VM) Jz() error {
-	if int(vm.pc+3) >= len(vm.memory) {
+	raw, ok := vm.operand()
+	if !ok {
 		return fmt.Errorf("jz failed: program counter out of bounds")
 	}
-	addr := int32(binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4]))
+	addr := int32(raw)
 	if len(vm.stack) < 1 {
 		return fmt.Errorf("jz failed: stack underflow")
 	}
 	cond := vm.stack[len(vm.stack)-1]
 	vm.stack = vm.stack[:len(vm.stack)-1]
 	if cond == 0 {
+		if err := vm.checkTarget(raw); err != nil {
+			return fmt.Errorf("jz failed: %v", err)
+		}
 		if vm.trace {
 			fmt.Fprintf(os.Stderr, "VM: OpJz: Condition false, jumping to %d", addr)
 		}
@@ -573,10 +741,11 @@ func (vm *VM) Jz() error {
 
 // Jnz pops a value and jumps if it's non-zero.
 func (vm *VM) Jnz() error {
-	if int(vm.pc+3) >= len(vm.memory) {
+	raw, ok := vm.operand()
+	if !ok {
 		return fmt.Errorf("jnz failed: program counter out of bounds")
 	}
-	addr := int32(binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4]))
+	addr := int32(raw)
 	if len(vm.stack) < 1 {
 		return fmt.Errorf("jnz failed: stack underflow")
 	}
@@ -598,13 +767,17 @@ func (vm *VM) Jnz() error {
 
 // Call pushes return address to RETURN STACK and jumps to subroutine.
 func (vm *VM) Call() error {
-	if int(vm.pc+3) >= len(vm.memory) {
+	raw, ok := vm.operand()
+	if !ok {
 		return fmt.Errorf("call failed: program counter out of bounds")
 	}
-	addr := int32(binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4]))
+	addr := int32(raw)
 	if len(vm.returnStack) >= MaxReturnStackSize {
 		return fmt.Errorf("return stack overflow")
 	}
+	if err := vm.checkTarget(raw); err != nil {
+		return fmt.Errorf("call failed: %v", err)
+	}
 	vm.returnStack = append(vm.returnStack, int32(vm.pc+4))
 	if vm.trace {
 		fmt.Fprintf(os.Stderr, "VM: OpCall: Pushing return addr=%d, jumping to %d", vm.pc+4, addr)
@@ -628,10 +801,11 @@ func (vm *VM) Ret() error {
 
 // Load reads a value from memory and pushes it.
 func (vm *VM) Load() error {
-	if int(vm.pc+3) >= len(vm.memory) {
+	raw, ok := vm.operand()
+	if !ok {
 		return fmt.Errorf("load failed: program counter out of bounds")
 	}
-	address := binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4])
+	address := raw
 	vm.pc += 4
 
 	// Check if the address is within the device memory region
@@ -645,10 +819,11 @@ func (vm *VM) Load() error {
 	}
 
 	// Standard memory access
-	if int(address)+4 > len(vm.memory) {
+	data, ok := vm.span(address, 4)
+	if !ok {
 		return fmt.Errorf("load address out of bounds: %d", address)
 	}
-	value := int32(binary.BigEndian.Uint32(vm.memory[address : address+4]))
+	value := int32(binary.BigEndian.Uint32(data))
 	return vm.Push(value)
 }
 
@@ -661,10 +836,11 @@ func (vm *VM) Store() error {
 	if err != nil {
 		return err
 	}
-	if int(vm.pc+3) >= len(vm.memory) {
+	raw, ok := vm.operand()
+	if !ok {
 		return fmt.Errorf("store failed: program counter out of bounds")
 	}
-	address := binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4])
+	address := raw
 	vm.pc += 4
 
 	// Check if the address is within the device memory region
@@ -682,51 +858,158 @@ func (vm *VM) Store() error {
 
 	// Standard memory access OR device access that didn't return an error
 	if int(address)+4 > len(vm.memory) {
+		if vm.readOnly(address) {
+			return fmt.Errorf("store address %d is in read-only shared memory", address)
+		}
 		return fmt.Errorf("store address out of bounds: %d", address)
 	}
+	vm.writing(address, 4)
 	binary.BigEndian.PutUint32(vm.memory[address:address+4], uint32(value))
+	vm.wrote(address)
 	return nil
 }
 
+// wrote tells the Journal and any Recorder about a store to the word at addr
+func (vm *VM) wrote(addr uint32) {
+	vm.memoryHigh = max(vm.memoryHigh, addr+4)
+	if vm.Journal != nil {
+		vm.Journal.write(addr)
+	}
+	if vm.recorder != nil {
+		vm.recorder.stored = append(vm.recorder.stored, addr)
+	}
+}
+
 // Out pops a value and outputs it.
 func (vm *VM) Out() error {
 	if len(vm.stack) < 2 {
 		return fmt.Errorf("stack underflow: need 2 values for OUT")
 	}
 
-	format, _ := vm.Pop() // 0 = number, 1 = character
+	format, _ := vm.Pop() // FormatNumber or FormatChar, plus FormatError, FormatZero and a width
 	value, err := vm.Pop()
 	if err != nil {
 		return err
 	}
+	if width := format >> 8; width < 0 || width > MaxOutputWidth {
+		return fmt.Errorf("field width %d is outside 0 to %d", width, MaxOutputWidth)
+	}
 
+	if vm.Journal != nil {
+		vm.Journal.out(value, format)
+	}
 	if vm.OutputHandler != nil {
+		var buf [16]byte
+		vm.written += int64(len(appendOutput(buf[:0], value, format)))
 		vm.OutputHandler(value, format)
 		return nil
 	}
-	if format == 1 {
-		fmt.Printf("%c", value)
-	} else {
-		fmt.Printf("%d", value)
+	if format&FormatError != 0 {
+		// The error stream is unbuffered, and follows what was printed before it
+		vm.Flush()
+		w := vm.Stderr
+		if w == nil {
+			w = os.Stderr
+		}
+		var buf [16]byte
+		text := appendOutput(buf[:0], value, format)
+		vm.written += int64(len(text))
+		w.Write(text)
+		return nil
+	}
+	n := len(vm.outBuf)
+	vm.outBuf = appendOutput(vm.outBuf, value, format)
+	vm.written += int64(len(vm.outBuf) - n)
+	if len(vm.outBuf) >= OutputBufferSize {
+		return vm.Flush()
 	}
 	return nil
 }
 
+// FormatOutput returns value as OpOut prints it in format, for an
+// OutputHandler
+func FormatOutput(value, format int32) string {
+	return string(appendOutput(nil, value, format))
+}
+
+// appendOutput appends value as OpOut prints it in format. Digits are
+// always ASCII, whatever the host's locale.
+func appendOutput(b []byte, value, format int32) []byte {
+	start := len(b)
+	if format&FormatChar != 0 {
+		b = utf8.AppendRune(b, rune(value))
+	} else {
+		b = strconv.AppendInt(b, int64(value), 10)
+	}
+	width := int(format>>8) & MaxOutputWidth
+	pad := width - utf8.RuneCount(b[start:])
+	if pad <= 0 {
+		return b
+	}
+	fill, at := byte(' '), start
+	if format&(FormatZero|FormatChar) == FormatZero {
+		fill = '0'
+		if value < 0 {
+			at++ // After the sign
+		}
+	}
+	b = append(b, make([]byte, pad)...)
+	copy(b[at+pad:], b[at:len(b)-pad])
+	for i := at; i < at+pad; i++ {
+		b[i] = fill
+	}
+	return b
+}
+
+// Flush writes the output buffered by OpOut to Stdout. The VM flushes by
+// itself when the buffer fills, on FLUSH, HALT and YIELD, before writing to
+// the error stream, and when Run, RunLimited or Tick returns.
+func (vm *VM) Flush() error {
+	if len(vm.outBuf) == 0 {
+		return nil
+	}
+	w := vm.Stdout
+	if w == nil {
+		w = os.Stdout
+	}
+	_, err := w.Write(vm.outBuf)
+	vm.outBuf = vm.outBuf[:0]
+	return err
+}
+
 // Halt stops the VM.
 func (vm *VM) Halt() error {
 	vm.running = false
 	return nil
 }
 
+// Close releases what host functions hold open, such as connections
+// TCP-OPEN made that the program never closed. Call it once the run is
+// over, however it ended.
+func (vm *VM) Close() {
+	for _, release := range vm.closers {
+		release()
+	}
+}
+
 // ExecuteInstruction executes a single instruction.
 func (vm *VM) ExecuteInstruction() (uint32, error) {
 	currentPC := vm.pc
-	if int(vm.pc) >= len(vm.memory) {
+	code, ok := vm.span(vm.pc, 1)
+	if !ok {
 		return currentPC, fmt.Errorf("program counter out of bounds")
 	}
-	opcode := vm.memory[vm.pc]
+	opcode := code[0]
+	if vm.Hook != nil {
+		if err := vm.vet(currentPC, opcode); err != nil {
+			return currentPC, err
+		}
+	}
 	vm.lastOpcode = opcode
 	vm.pc++
+	if vm.Journal != nil {
+		vm.Journal.pc = currentPC
+	}
 
 	if vm.trace {
 		fmt.Fprintf(os.Stderr, "VM: PC=%d, Instruction=%s, Stack=%v, ReturnStack=%v", currentPC, OpcodeName(opcode), vm.stack, vm.returnStack)
@@ -734,15 +1017,30 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 
 	switch opcode {
 	case OpPush:
-		if int(vm.pc+3) >= len(vm.memory) {
+		raw, ok := vm.operand()
+		if !ok {
 			return currentPC, fmt.Errorf("push failed: program counter out of bounds")
 		}
-		value := int32(binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4]))
+		value := int32(raw)
 		if vm.trace {
 			fmt.Fprintf(os.Stderr, "VM: OpPush: Pushing value=%d", value)
 		}
 		vm.stack = append(vm.stack, value)
 		vm.pc += 4
+	case OpPush8:
+		raw, ok := vm.span(vm.pc, 1)
+		if !ok {
+			return currentPC, fmt.Errorf("push8 failed: program counter out of bounds")
+		}
+		vm.stack = append(vm.stack, int32(int8(raw[0])))
+		vm.pc++
+	case OpPush16:
+		raw, ok := vm.span(vm.pc, 2)
+		if !ok {
+			return currentPC, fmt.Errorf("push16 failed: program counter out of bounds")
+		}
+		vm.stack = append(vm.stack, int32(int16(binary.BigEndian.Uint16(raw))))
+		vm.pc += 2
 	case OpPop:
 		if _, err := vm.Pop(); err != nil {
 			return currentPC, fmt.Errorf("pop failed: %v", err)
@@ -830,9 +1128,12 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 		if err != nil {
 			return currentPC, fmt.Errorf("callstack failed: %v", err)
 		}
-		if addr < 0 || int(addr) >= len(vm.memory) {
+		if addr < 0 || int(addr) >= vm.memSize() {
 			return currentPC, fmt.Errorf("callstack failed: address %d out of bounds", addr)
 		}
+		if err := vm.checkTarget(uint32(addr)); err != nil {
+			return currentPC, fmt.Errorf("callstack failed: %v", err)
+		}
 		returnAddr := int32(vm.pc)
 		vm.returnStack = append(vm.returnStack, returnAddr)
 		if vm.trace {
@@ -840,25 +1141,33 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 		}
 		vm.pc = uint32(addr)
 	case OpJmp:
-		if int(vm.pc+3) >= len(vm.memory) {
+		raw, ok := vm.operand()
+		if !ok {
 			return currentPC, fmt.Errorf("jmp failed: program counter out of bounds")
 		}
-		addr := int32(binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4]))
+		addr := int32(raw)
+		if err := vm.checkTarget(raw); err != nil {
+			return currentPC, fmt.Errorf("jmp failed: %v", err)
+		}
 		if vm.trace {
 			fmt.Fprintf(os.Stderr, "VM: OpJmp: Jumping to %d", addr)
 		}
 		vm.pc = uint32(addr)
 	case OpJz:
-		if int(vm.pc+3) >= len(vm.memory) {
+		raw, ok := vm.operand()
+		if !ok {
 			return currentPC, fmt.Errorf("jz failed: program counter out of bounds")
 		}
-		addr := int32(binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4]))
+		addr := int32(raw)
 		if len(vm.stack) < 1 {
 			return currentPC, fmt.Errorf("jz failed: stack underflow")
 		}
 		cond := vm.stack[len(vm.stack)-1]
 		vm.stack = vm.stack[:len(vm.stack)-1]
 		if cond == 0 {
+			if err := vm.checkTarget(raw); err != nil {
+				return currentPC, fmt.Errorf("jz failed: %v", err)
+			}
 			if vm.trace {
 				fmt.Fprintf(os.Stderr, "VM: OpJz: Condition false, jumping to %d", addr)
 			}
@@ -869,19 +1178,67 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 			}
 			vm.pc += 4
 		}
+	case OpJmpTable:
+		// JMPTABLE count:uint16 default:int32 targets:int32*count
+		header, ok := vm.span(vm.pc, 6)
+		if !ok {
+			return currentPC, fmt.Errorf("jmptable failed: program counter out of bounds")
+		}
+		count := uint32(binary.BigEndian.Uint16(header))
+		tableStart := vm.pc + 6
+		if _, ok := vm.span(tableStart, count*4); !ok {
+			return currentPC, fmt.Errorf("jmptable failed: table of %d targets runs past end of memory", count)
+		}
+		if len(vm.stack) < 1 {
+			return currentPC, fmt.Errorf("jmptable failed: stack underflow")
+		}
+		index := vm.stack[len(vm.stack)-1]
+		vm.stack = vm.stack[:len(vm.stack)-1]
+		entry := vm.pc + 2 // Default target
+		if index >= 0 && uint32(index) < count {
+			entry = tableStart + uint32(index)*4
+		}
+		target, _ := vm.span(entry, 4)
+		addr := binary.BigEndian.Uint32(target)
+		if err := vm.checkTarget(addr); err != nil {
+			return currentPC, fmt.Errorf("jmptable failed: %v", err)
+		}
+		vm.pc = addr
 	case OpCall:
-		if int(vm.pc+3) >= len(vm.memory) {
+		raw, ok := vm.operand()
+		if !ok {
 			return currentPC, fmt.Errorf("call failed: program counter out of bounds")
 		}
-		addr := int32(binary.BigEndian.Uint32(vm.memory[vm.pc : vm.pc+4]))
+		addr := int32(raw)
 		if len(vm.returnStack) >= MaxReturnStackSize {
 			return currentPC, fmt.Errorf("return stack overflow")
 		}
+		if err := vm.checkTarget(raw); err != nil {
+			return currentPC, fmt.Errorf("call failed: %v", err)
+		}
 		vm.returnStack = append(vm.returnStack, int32(vm.pc+4))
 		if vm.trace {
 			fmt.Fprintf(os.Stderr, "VM: OpCall: Pushing return addr=%d, jumping to %d", vm.pc+4, addr)
 		}
 		vm.pc = uint32(addr)
+	case OpAfter:
+		if err := vm.schedule(false); err != nil {
+			return currentPC, fmt.Errorf("after failed: %v", err)
+		}
+	case OpEvery:
+		if err := vm.schedule(true); err != nil {
+			return currentPC, fmt.Errorf("every failed: %v", err)
+		}
+	case OpHost:
+		raw, ok := vm.operand()
+		if !ok {
+			return currentPC, fmt.Errorf("host failed: program counter out of bounds")
+		}
+		id := raw
+		vm.pc += 4
+		if err := vm.callHost(id); err != nil {
+			return currentPC, fmt.Errorf("host failed: %w", err)
+		}
 	case OpRet:
 		if len(vm.returnStack) == 0 {
 			return currentPC, fmt.Errorf("ret failed: return stack underflow")
@@ -903,13 +1260,50 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 		if err := vm.Out(); err != nil {
 			return currentPC, fmt.Errorf("out failed: %v", err)
 		}
+	case OpFlush:
+		if err := vm.Flush(); err != nil {
+			return currentPC, fmt.Errorf("flush failed: %v", err)
+		}
+	case OpAccept:
+		if err := vm.Accept(); err != nil {
+			return currentPC, fmt.Errorf("accept failed: %v", err)
+		}
+	case OpToNumber:
+		if err := vm.ToNumber(); err != nil {
+			return currentPC, fmt.Errorf(">number failed: %v", err)
+		}
+	case OpDump:
+		if err := vm.Dump(); err != nil {
+			return currentPC, fmt.Errorf("dump failed: %v", err)
+		}
+	case OpOutN:
+		if err := vm.OutN(); err != nil {
+			return currentPC, fmt.Errorf("outn failed: %v", err)
+		}
+	case OpOutCells:
+		if err := vm.OutCells(); err != nil {
+			return currentPC, fmt.Errorf("outcells failed: %v", err)
+		}
+	case OpAssert:
+		if err := vm.Assert(); err != nil {
+			return currentPC, fmt.Errorf("assertion failed: %v", err)
+		}
+	case OpAbort:
+		if err := vm.Abort(); err != nil {
+			return currentPC, fmt.Errorf("abort failed: %v", err)
+		}
 	case OpHalt:
 		vm.running = false
+		vm.Flush()
 		if vm.trace {
 			fmt.Fprintf(os.Stderr, "VM: OpHalt: Stopping execution")
 		}
 	case OpYield:
-		if vm.YieldHandler != nil {
+		vm.Flush()
+		if vm.Journal != nil {
+			vm.Journal.host("yield", 0)
+		}
+		if vm.YieldHandler != nil && !vm.Deterministic {
 			vm.YieldHandler()
 		}
 	case OpLoadI:
@@ -917,7 +1311,8 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 		if err != nil {
 			return currentPC, fmt.Errorf("loadi failed: %v", err)
 		}
-		if addr < 0 || int(addr)+4 > len(vm.memory) {
+		data, ok := vm.span(uint32(addr), 4)
+		if addr < 0 || !ok {
 			return currentPC, fmt.Errorf("loadi failed: address %d out of bounds", addr)
 		}
 		if uint32(addr) >= DeviceMemoryOffset && uint32(addr) < UserMemoryOffset {
@@ -927,7 +1322,7 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 			}
 			vm.stack = append(vm.stack, val)
 		} else {
-			vm.stack = append(vm.stack, int32(binary.BigEndian.Uint32(vm.memory[addr:addr+4])))
+			vm.stack = append(vm.stack, int32(binary.BigEndian.Uint32(data)))
 		}
 	case OpStoreI:
 		addr, err := vm.Pop()
@@ -939,6 +1334,9 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 			return currentPC, fmt.Errorf("storei failed: %v", err)
 		}
 		if addr < 0 || int(addr)+4 > len(vm.memory) {
+			if addr >= 0 && vm.readOnly(uint32(addr)) {
+				return currentPC, fmt.Errorf("storei failed: address %d is in read-only shared memory", addr)
+			}
 			return currentPC, fmt.Errorf("storei failed: address %d out of bounds", addr)
 		}
 		if uint32(addr) >= DeviceMemoryOffset && uint32(addr) < UserMemoryOffset {
@@ -946,7 +1344,46 @@ func (vm *VM) ExecuteInstruction() (uint32, error) {
 				return currentPC, fmt.Errorf("storei device write failed: %v", err)
 			}
 		}
+		vm.writing(uint32(addr), 4)
 		binary.BigEndian.PutUint32(vm.memory[addr:addr+4], uint32(value))
+		vm.wrote(uint32(addr))
+	case OpToR:
+		value, err := vm.Pop()
+		if err != nil {
+			return currentPC, fmt.Errorf(">r failed: %v", err)
+		}
+		if len(vm.returnStack) >= MaxReturnStackSize {
+			return currentPC, fmt.Errorf(">r failed: return stack overflow")
+		}
+		vm.returnStack = append(vm.returnStack, value)
+	case OpFromR:
+		if len(vm.returnStack) == 0 {
+			return currentPC, fmt.Errorf("r> failed: return stack underflow")
+		}
+		value := vm.returnStack[len(vm.returnStack)-1]
+		vm.returnStack = vm.returnStack[:len(vm.returnStack)-1]
+		if err := vm.Push(value); err != nil {
+			return currentPC, fmt.Errorf("r> failed: %v", err)
+		}
+	case OpRFetch:
+		if len(vm.returnStack) == 0 {
+			return currentPC, fmt.Errorf("r@ failed: return stack underflow")
+		}
+		if err := vm.Push(vm.returnStack[len(vm.returnStack)-1]); err != nil {
+			return currentPC, fmt.Errorf("r@ failed: %v", err)
+		}
+	case OpRDepth:
+		if err := vm.Push(int32(len(vm.returnStack))); err != nil {
+			return currentPC, fmt.Errorf("rdepth failed: %v", err)
+		}
+	case OpPCFetch:
+		if err := vm.Push(int32(currentPC)); err != nil {
+			return currentPC, fmt.Errorf("pc@ failed: %v", err)
+		}
+	case OpMemSize:
+		if err := vm.Push(int32(vm.memSize())); err != nil {
+			return currentPC, fmt.Errorf("memsize failed: %v", err)
+		}
 	default:
 		return currentPC, fmt.Errorf("unknown opcode 0x%02X at PC=%d", opcode, currentPC)
 	}
@@ -958,79 +1395,86 @@ func (vm *VM) Step() (bool, error) {
 	if !vm.running {
 		return false, nil
 	}
-	if int(vm.pc) >= len(vm.memory) {
+	if len(vm.timers) > 0 || vm.timerDepth > 0 {
+		if err := vm.fireTimer(); err != nil {
+			return false, err
+		}
+	}
+	if int(vm.pc) >= vm.memSize() {
 		return false, fmt.Errorf("program counter out of bounds")
 	}
-	_, err := vm.ExecuteInstruction()
+	before := vm.stack
+	pc, err := vm.ExecuteInstruction()
+	vm.steps++
+	vm.maxDepth = max(vm.maxDepth, len(vm.stack))
+	vm.maxReturnDepth = max(vm.maxReturnDepth, len(vm.returnStack))
 	if err != nil {
-		return false, err
+		vm.Flush()
+		return false, vm.underflow(pc, before, err)
 	}
 	return vm.running, nil
 }
 
-func (vm *VM) Run() error {
-	for vm.running {
-		_, err := vm.Step()
+// SliceStatus says why RunSlice returned
+type SliceStatus int
+
+const (
+	SlicePaused SliceStatus = iota // Ran its steps, or waits for a timer not yet due; run another slice
+	SliceHalted                    // The program has finished
+	SliceErred                     // An instruction failed
+)
+
+// RunSlice runs up to maxSteps instructions and returns, so a host with a
+// single thread (a game, a GUI, the browser) can run a program between its
+// own events without a goroutine. It never sleeps: a program waiting for a
+// timer that is not due yet pauses, and a later slice runs the timer.
+func (vm *VM) RunSlice(maxSteps int64) (status SliceStatus, err error) {
+	defer vm.Flush()
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("error at PC=%d: %v", vm.pc, err)
+			status = SliceErred // A panic too
+		}
+	}()
+	defer vm.recoverPanic(&err)
+	for steps := int64(0); steps < maxSteps; steps++ {
+		if !vm.running {
+			if !vm.timerWaiting() {
+				return SliceHalted, nil
+			}
+			if vm.timers[0].due > vm.Clock.Now() {
+				return SlicePaused, nil
+			}
+			if err := vm.resumeTimer(); err != nil {
+				return SliceErred, err
+			}
+		}
+		if _, err := vm.Step(); err != nil {
+			return SliceErred, fmt.Errorf("error at PC=%d: %w", vm.pc, err)
 		}
 	}
-	return nil
+	if !vm.running && !vm.timerWaiting() {
+		return SliceHalted, nil
+	}
+	return SlicePaused, nil
 }
 
-// DebugInfo returns detailed state for error reporting
-func (vm *VM) DebugInfo() string {
-	info := fmt.Sprintf("PC: %d (0x%X)\n", vm.pc-vm.userMemoryStart, vm.pc)
-	// Convert stack values to relative if they look like addresses
-	adjustedStack := make([]int32, len(vm.stack))
-	for i, val := range vm.stack {
-		if uint32(val) >= vm.userMemoryStart {
-			adjustedStack[i] = val - int32(vm.userMemoryStart)
-		} else {
-			adjustedStack[i] = val
-		}
-	}
-	info += fmt.Sprintf("Stack: %v\n", adjustedStack)
-	info += fmt.Sprintf("Stack: %v\n", vm.Stack())
-	info += fmt.Sprintf("Return Stack: %v\n", vm.ReturnStack())
-	info += fmt.Sprintf("Stack Depth: %d/%d", len(vm.stack), MaxStackSize)
-	info += fmt.Sprintf("Return Stack Depth: %d/%d\\n", len(vm.returnStack), MaxReturnStackSize) // Corrected to MaxReturnStackSize
-	info += fmt.Sprintf("Reserved Memory: 0x0-0x%X (%d bytes)", vm.reservedMemorySize, vm.reservedMemorySize)
-	info += fmt.Sprintf("User Memory: 0x%X-0x%X", vm.userMemoryStart, len(vm.memory))
-
-	// Show current opcode if available
-	if int(vm.pc) < len(vm.memory) {
-		currentOpcode := vm.memory[vm.pc]
-		info += fmt.Sprintf("\\nCurrent Instruction: %s (0x%02X)\n",
-			OpcodeName(currentOpcode), currentOpcode)
-	}
-
-	// Show nearby bytecode
-	if int(vm.pc) < len(vm.memory) {
-		start := int(vm.pc)
-		if start > 5 {
-			start -= 5
-		}
-		end := int(vm.pc) + 10
-		if end > len(vm.memory) {
-			end = len(vm.memory)
-		}
-		info += "\\nBytecode around PC:\n"
-		for i := start; i < end; i++ {
-			marker := " "
-			if i == int(vm.pc) {
-				marker = ">"
+// Run runs the program until it halts with no timers pending, or fails
+func (vm *VM) Run() (err error) {
+	defer vm.Flush()
+	defer vm.recoverPanic(&err)
+	for {
+		for vm.running {
+			_, err := vm.Step()
+			if err != nil {
+				return fmt.Errorf("error at PC=%d: %w", vm.pc, err)
 			}
-			opcode := vm.memory[i]
-			info += fmt.Sprintf("%s %04d: 0x%02X  %s\\n",
-				marker, i, opcode, OpcodeName(opcode))
+		}
+		if resumed, err := vm.awaitTimer(nil); !resumed || err != nil {
+			return err
 		}
 	}
-
-	return info
 }
 
-
 // handleDeviceRead simulates reading from a device memory address.
 func (vm *VM) handleDeviceRead(address uint32) (int32, error) {
 	// Video Framebuffer read: data lives in vm.memory (written there by Store).
@@ -1048,9 +1492,14 @@ func (vm *VM) handleDeviceRead(address uint32) (int32, error) {
 	// Keyboard Status read:
 	if address == KeyboardStatusAddr {
 		var val int32 = 1 // default: simulate key always pressed
-		if vm.KeyboardHandler != nil {
+		if vm.Deterministic {
+			val = 0
+		} else if vm.KeyboardHandler != nil {
 			val = vm.KeyboardHandler()
 		}
+		if vm.Journal != nil {
+			vm.Journal.host("keyboard", val)
+		}
 		if vm.trace {
 			fmt.Fprintf(os.Stderr, "VM: Device Read: Keyboard Status read at %d = %d", address, val)
 		}
@@ -1076,6 +1525,9 @@ func (vm *VM) handleDeviceRead(address uint32) (int32, error) {
 		x ^= x >> 17
 		x ^= x << 5
 		vm.rngState = x
+		if vm.Journal != nil {
+			vm.Journal.host("rng", int32(x))
+		}
 		return int32(x), nil
 	}
 
@@ -1085,6 +1537,11 @@ func (vm *VM) handleDeviceRead(address uint32) (int32, error) {
 		return int32(vm.rngState), nil
 	}
 
+	// Frame vector read: the last value written, in vm.memory.
+	if address == FrameVectorAddr {
+		return int32(vm.frameVector()), nil
+	}
+
 	// Audio Sample Buffer read: data lives in vm.memory.
 	if address >= AudioSampleBufferAddr && address < AudioSampleBufferAddr+AudioSampleBufferByteSize {
 		if int(address)+4 > len(vm.memory) {
@@ -1116,6 +1573,9 @@ func (vm *VM) handleDeviceWrite(address uint32, value int32) error {
 
 	// Audio Control write: trigger sound event.
 	if address == AudioControlAddr {
+		if vm.Journal != nil {
+			vm.Journal.host("sound", value)
+		}
 		if vm.SoundHandler != nil {
 			vm.SoundHandler(value)
 		}
@@ -1124,10 +1584,18 @@ func (vm *VM) handleDeviceWrite(address uint32, value int32) error {
 
 	// RNG register write: seed the LCG.
 	if address == RNGDataAddr {
+		if vm.Journal != nil {
+			vm.Journal.host("rng-seed", value)
+		}
 		vm.rngState = uint32(value)
 		return nil
 	}
 
+	// Frame vector write: passes through to vm.memory, where Tick reads it.
+	if address == FrameVectorAddr {
+		return nil
+	}
+
 	// Audio Sample Buffer write: passes through to vm.memory.
 	if address >= AudioSampleBufferAddr && address < AudioSampleBufferAddr+AudioSampleBufferByteSize {
 		return nil
@@ -1136,3 +1604,26 @@ func (vm *VM) handleDeviceWrite(address uint32, value int32) error {
 	// Unhandled device address
 	return fmt.Errorf("unhandled device write at address %d with value %d", address, value)
 }
+
+// CallWord runs the word at addr until it returns, as if it had been CALLed
+// from the current PC. Execution stops early if the word halts.
+func (vm *VM) CallWord(addr uint32) (err error) {
+	if int(addr) >= vm.memSize() {
+		return fmt.Errorf("call failed: address %d out of bounds", addr)
+	}
+	if len(vm.returnStack) >= MaxReturnStackSize {
+		return fmt.Errorf("call failed: return stack overflow")
+	}
+	defer vm.Flush()
+	defer vm.recoverPanic(&err)
+	depth := len(vm.returnStack)
+	vm.returnStack = append(vm.returnStack, int32(vm.pc))
+	vm.pc = addr
+	vm.running = true
+	for vm.running && len(vm.returnStack) > depth {
+		if _, err := vm.Step(); err != nil {
+			return fmt.Errorf("error at PC=%d: %w", vm.pc, err)
+		}
+	}
+	return nil
+}
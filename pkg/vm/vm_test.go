@@ -3,6 +3,8 @@ package vm
 import (
 	"encoding/binary"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -854,6 +856,83 @@ func TestRetUnderflow(t *testing.T) {
 	}
 }
 
+func TestReturnStackTransfer(t *testing.T) {
+	program := []byte{}
+	program = append(program, pushInstruction(7)...)
+	program = append(program, OpToR, OpRFetch, OpFromR, OpAdd, OpHalt)
+	vm := NewVM(program)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stack := vm.Stack(); len(stack) != 1 || stack[0] != 14 {
+		t.Errorf("Expected [14], got %v", stack)
+	}
+	if len(vm.ReturnStack()) != 0 {
+		t.Errorf("Expected empty return stack, got %v", vm.ReturnStack())
+	}
+
+	for _, op := range []byte{OpFromR, OpRFetch} {
+		vm = NewVM([]byte{op})
+		if _, err := vm.ExecuteInstruction(); err == nil || !contains(err.Error(), "return stack underflow") {
+			t.Errorf("Expected return stack underflow for %s, got %v", OpcodeName(op), err)
+		}
+	}
+	vm = NewVM([]byte{OpToR})
+	if _, err := vm.ExecuteInstruction(); err == nil || !contains(err.Error(), "stack underflow") {
+		t.Errorf("Expected stack underflow for >R, got %v", err)
+	}
+}
+
+func TestShortPush(t *testing.T) {
+	program := []byte{OpPush8, 0xFF, OpPush16, 0x80, 0x00, OpPush8, 0x7F, OpHalt}
+	vm := NewVM(program)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stack := vm.Stack(); len(stack) != 3 || stack[0] != -1 || stack[1] != -32768 || stack[2] != 127 {
+		t.Errorf("Expected [-1 -32768 127], got %v", stack)
+	}
+
+	for _, value := range []int32{0, -1, 127, -128, 128, -32768, 32767, 40000, -40000} {
+		vm = NewVM(append(ShortPushInstruction(value), OpHalt))
+		if err := vm.Run(); err != nil {
+			t.Fatalf("Run failed for %d: %v", value, err)
+		}
+		if stack := vm.Stack(); len(stack) != 1 || stack[0] != value {
+			t.Errorf("Expected [%d], got %v", value, stack)
+		}
+	}
+}
+
+func TestJmpTable(t *testing.T) {
+	// 0x4000: PUSH index, JMPTABLE (2 targets) at 0x4005, 15 bytes long
+	// 0x4014: PUSH8 10, HALT; 0x4017: PUSH8 20, HALT; 0x401A: PUSH8 99, HALT
+	build := func(index int32) []byte {
+		program := PushInstruction(index)
+		program = append(program, JmpTableInstruction(0x401A, []int32{0x4014, 0x4017})...)
+		return append(program, OpPush8, 10, OpHalt, OpPush8, 20, OpHalt, OpPush8, 99, OpHalt)
+	}
+	for index, want := range map[int32]int32{0: 10, 1: 20, 2: 99, -1: 99, 1 << 20: 99} {
+		vm := NewVM(build(index))
+		if err := vm.Run(); err != nil {
+			t.Fatalf("Run failed for index %d: %v", index, err)
+		}
+		if stack := vm.Stack(); len(stack) != 1 || stack[0] != want {
+			t.Errorf("Index %d: expected [%d], got %v", index, want, stack)
+		}
+	}
+
+	vm := NewVM(JmpTableInstruction(0, []int32{0}))
+	if _, err := vm.ExecuteInstruction(); err == nil || !contains(err.Error(), "stack underflow") {
+		t.Errorf("Expected stack underflow, got %v", err)
+	}
+	vm = NewVM([]byte{OpJmpTable, 0xFF, 0xFF, 0, 0, 0, 0})
+	vm.Push(0)
+	if _, err := vm.ExecuteInstruction(); err == nil || !contains(err.Error(), "past end of memory") {
+		t.Errorf("Expected truncated table error, got %v", err)
+	}
+}
+
 func TestLoadStore(t *testing.T) {
 	// Create a program with some data space
 	program := make([]byte, 256)
@@ -960,6 +1039,109 @@ func TestOut(t *testing.T) {
 	}
 }
 
+func TestOutStreams(t *testing.T) {
+	var code []byte
+	code = append(code, ShortPushInstruction(72)...)
+	code = append(code, OutCharacter()...)
+	code = append(code, ShortPushInstruction(7)...)
+	code = append(code, ErrNumber()...)
+	code = append(code, ShortPushInstruction(33)...)
+	code = append(code, ErrCharacter()...)
+	code = append(code, ShortPushInstruction(42)...)
+	code = append(code, OutNumber()...)
+	code = append(code, OpHalt)
+
+	var stdout, stderr strings.Builder
+	vm := NewVM(code)
+	vm.Stdout, vm.Stderr = &stdout, &stderr
+	vm.Journal = NewJournal()
+	if err := vm.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stdout.String() != "H42" || stderr.String() != "7!" {
+		t.Errorf("Expected \"H42\" and \"7!\", got %q and %q", stdout.String(), stderr.String())
+	}
+	if report := vm.Journal.Report(); report.Output != "H42" || report.ErrOutput != "7!" {
+		t.Errorf("Expected the journal to split the streams, got %q and %q", report.Output, report.ErrOutput)
+	}
+}
+
+func TestOutFieldWidth(t *testing.T) {
+	tests := []struct {
+		value, format int32
+		want          string
+	}{
+		{42, FormatNumber | FormatWidth(5), "   42"},
+		{-42, FormatNumber | FormatZero | FormatWidth(6), "-00042"},
+		{123456, FormatNumber | FormatWidth(3), "123456"},
+		{'x', FormatChar | FormatZero | FormatWidth(3), "  x"},
+		{'é', FormatChar | FormatWidth(2), " é"},
+	}
+	for _, tt := range tests {
+		code := append(PushInstruction(tt.value), PushInstruction(tt.format)...)
+		vm := NewVM(append(code, OpOut, OpHalt))
+		output := vm.CaptureOutput()
+		if err := vm.Run(); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if got := output.Stdout(); got != tt.want {
+			t.Errorf("%d in format %#x: printed %q, want %q", tt.value, tt.format, got, tt.want)
+		}
+		if got := FormatOutput(tt.value, tt.format); got != tt.want {
+			t.Errorf("FormatOutput(%d, %#x) = %q, want %q", tt.value, tt.format, got, tt.want)
+		}
+	}
+
+	code := append(PushInstruction(1), PushInstruction(FormatWidth(MaxOutputWidth+1))...)
+	vm := NewVM(append(code, OpOut, OpHalt))
+	if err := vm.Run(); err == nil || !strings.Contains(err.Error(), "field width 256") {
+		t.Errorf("Expected a field width error, got %v", err)
+	}
+}
+
+func TestOutBuffering(t *testing.T) {
+	var code []byte
+	for i := 0; i < 3; i++ {
+		code = append(code, ShortPushInstruction('A')...)
+		code = append(code, OutCharacter()...)
+	}
+	code = append(code, OpFlush)
+	code = append(code, ShortPushInstruction('B')...)
+	code = append(code, OutCharacter()...)
+	code = append(code, OpHalt)
+
+	var out countingWriter
+	vm := NewVM(code)
+	vm.Stdout = &out
+	for vm.Running() {
+		if _, err := vm.Step(); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+		if vm.LastOpcode() == "OUT" && out.n != 0 && out.n != 3 {
+			t.Fatalf("Expected OUT to buffer, but %d bytes were written", out.n)
+		}
+		if vm.LastOpcode() == "FLUSH" && out.n != 3 {
+			t.Fatalf("Expected FLUSH to write 3 bytes, got %d", out.n)
+		}
+	}
+	if out.n != 4 || out.writes != 2 {
+		t.Errorf("Expected 4 bytes in 2 writes, got %d in %d", out.n, out.writes)
+	}
+
+	// A full buffer is written out without waiting for HALT
+	vm = NewVM(nil)
+	vm.Stdout = &out
+	out = countingWriter{}
+	for i := 0; i < OutputBufferSize; i++ {
+		vm.Push('x')
+		vm.Push(FormatChar)
+		vm.Out()
+	}
+	if out.n != OutputBufferSize {
+		t.Errorf("Expected a full buffer to be written, got %d bytes", out.n)
+	}
+}
+
 func TestOutUnderflow(t *testing.T) {
 	vm := createVMWithProgram([]byte{})
 
@@ -1035,6 +1217,7 @@ func TestPCOutOfBounds(t *testing.T) {
 	binary.BigEndian.PutUint32(programJmp[1:], 99999) // Jump to address well beyond memory
 
 	vmJmp := createVMWithProgram(programJmp)
+	vmJmp.Strict = false // Strict would stop the jump itself
 	err = vmJmp.Run()
 	if err == nil {
 		t.Error("Expected error for PC out of bounds after JMP")
@@ -1436,6 +1619,82 @@ func TestReservedMemoryInDebugInfo(t *testing.T) {
 	}
 }
 
+func TestDebugState(t *testing.T) {
+	program := append(pushInstruction(-1), OpHalt)
+	vm := createVMWithProgram(program)
+	pushValue(t, vm, -1)
+	pushValue(t, vm, int32(UserMemoryOffset))
+	symbols := []Symbol{{Name: "START", Address: int32(UserMemoryOffset)}}
+
+	tests := []struct {
+		opts DebugOptions
+		want string
+	}{
+		{DebugOptions{}, "Stack: [-1 16384]"},
+		{DebugOptions{Unsigned: true}, "Stack: [4294967295 16384]"},
+		{DebugOptions{Hex: true}, "Stack: [-0x1 0x4000]"},
+		{DebugOptions{Hex: true, Unsigned: true}, "Stack: [0xFFFFFFFF 0x4000]"},
+		{DebugOptions{Symbols: symbols}, "Stack: [-1 16384<START>]"},
+	}
+	for _, tt := range tests {
+		info := vm.DebugState(tt.opts).String()
+		if !contains(info, tt.want+"\n") {
+			t.Errorf("With %+v expected %q in:\n%s", tt.opts, tt.want, info)
+		}
+		if strings.Count(info, "Stack: ") != 2 {
+			t.Errorf("Expected the stack once and the return stack once, got:\n%s", info)
+		}
+	}
+	if info := vm.DebugState(DebugOptions{Symbols: symbols}).String(); !contains(info, "PC: 0 (0x4000) in START\n") {
+		t.Errorf("Expected the PC named by its word, got:\n%s", info)
+	}
+}
+
+func TestState(t *testing.T) {
+	program := append(pushInstruction(7), OpHalt)
+	vm := createVMWithProgram(program)
+	if _, err := vm.Step(); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+	state := vm.State()
+	if state.PC != vm.PC() || !reflect.DeepEqual(state.Stack, []int32{7}) || len(state.ReturnStack) != 0 {
+		t.Errorf("Expected PC %d and stack [7], got %+v", vm.PC(), state)
+	}
+	if state.CurrentOpcode != OpHalt || !state.Stats.Running {
+		t.Errorf("Expected to be running and at HALT, got %+v", state)
+	}
+	want := []MemorySegment{
+		{"reserved", 0, ReservedMemorySize},
+		{"device", ReservedMemorySize, UserMemoryOffset},
+		{"user", UserMemoryOffset, UserMemoryOffset + uint32(len(program))},
+	}
+	if !reflect.DeepEqual(state.MemorySegments, want) {
+		t.Errorf("Expected segments %v, got %v", want, state.MemorySegments)
+	}
+	if state.Limits != (StackLimits{MaxStackSize, MaxReturnStackSize}) {
+		t.Errorf("Expected the stack limits, got %+v", state.Limits)
+	}
+
+	// The state is a copy
+	state.Stack[0] = 99
+	if vm.Stack()[0] != 7 {
+		t.Error("Changing the state changed the VM")
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	program := append(pushInstruction(1), pushInstruction(2)...)
+	program = append(program, OpStore, 0, 0, 0, 100, OpHalt)
+	vm := createVMWithProgram(program)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	stats := vm.State().Stats
+	if stats.Steps != 4 || stats.MaxStackDepth != 2 || stats.MaxReturnDepth != 0 || stats.MemoryHighWater != 104 {
+		t.Errorf("Expected 4 steps, depth 2 and memory used to 104, got %+v", stats)
+	}
+}
+
 func TestReservedMemoryWithCode(t *testing.T) {
 	// Create a VM
 	program := []byte{}
@@ -1445,6 +1704,7 @@ func TestReservedMemoryWithCode(t *testing.T) {
 	program = append(program, OpHalt)                // HALT
 
 	vm := createVMWithProgram(program)
+	vm.Strict = false // Strict only runs the code segment
 
 	// Write a simple subroutine to reserved memory
 	// The subroutine will: PUSH 42, RET
@@ -1477,6 +1737,33 @@ func TestReservedMemoryWithCode(t *testing.T) {
 	}
 }
 
+func TestInstallRoutine(t *testing.T) {
+	// CALL the routine at 100, then CALLSTACK it by address
+	program := append(CallInstruction(100), pushInstruction(100)...)
+	program = append(program, OpCallStack, OpHalt)
+	vm := createVMWithProgram(program)
+	routine := append(pushInstruction(42), OpRet)
+	if err := vm.InstallRoutine(100, routine); err != nil {
+		t.Fatalf("InstallRoutine failed: %v", err)
+	}
+	if err := vm.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stack := vm.Stack(); len(stack) != 2 || stack[0] != 42 || stack[1] != 42 {
+		t.Errorf("Expected stack [42 42], got %v", stack)
+	}
+
+	// The rest of reserved memory stays off limits
+	vm = createVMWithProgram(append(pushInstruction(100+int32(len(routine))), OpCallStack, OpHalt))
+	vm.InstallRoutine(100, routine)
+	if err := vm.Run(); err == nil || !contains(err.Error(), "outside the code segment") {
+		t.Errorf("Expected a call past the routine to fail, got %v", err)
+	}
+	if err := vm.MarkReservedExecutable(ReservedMemorySize-4, 8); err == nil {
+		t.Error("Expected a range past the end of reserved memory to be refused")
+	}
+}
+
 func TestExecuteInstructionErrors(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -1931,3 +2218,92 @@ func TestLoadStoreBoundaries(t *testing.T) {
 		t.Error("Expected error for store out of bounds")
 	}
 }
+
+func TestStrictTargets(t *testing.T) {
+	// JMP into the data after the code, which happens to hold a HALT
+	code := JmpInstruction(UserMemoryOffset + 5)
+	img := &Image{Code: code, Data: []byte{OpHalt}}
+	machine, err := NewVMForImage(img)
+	if err != nil {
+		t.Fatalf("NewVMForImage failed: %v", err)
+	}
+	if start, end := machine.CodeSegment(); start != UserMemoryOffset || end != UserMemoryOffset+5 {
+		t.Errorf("Expected the code segment 0x4000-0x4005, got 0x%X-0x%X", start, end)
+	}
+	err = machine.Run()
+	if err == nil || !contains(err.Error(), "outside the code segment") {
+		t.Errorf("Expected the jump into data to fail, got %v", err)
+	}
+	machine, _ = NewVMForImage(img)
+	machine.Strict = false
+	if err := machine.Run(); err != nil {
+		t.Errorf("Expected a non-strict VM to run the data, got %v", err)
+	}
+
+	// Calls into reserved memory and device registers, from code and
+	// from the stack, and timer quotations
+	tests := []struct {
+		name    string
+		program []byte
+	}{
+		{"call reserved", CallInstruction(100)},
+		{"jz device", append(pushInstruction(0), JzInstruction(KeyboardStatusAddr)...)},
+		{"callstack reserved", append(pushInstruction(100), OpCallStack)},
+		{"after reserved", append(append(pushInstruction(10), pushInstruction(100)...), OpAfter)},
+	}
+	for _, tt := range tests {
+		vm := createVMWithProgram(append(tt.program, OpHalt))
+		if err := vm.Run(); err == nil || !contains(err.Error(), "outside the code segment") {
+			t.Errorf("%s: expected a strict VM to refuse the target, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestRunSlice(t *testing.T) {
+	// Count to 10, then halt
+	code := append(ShortPushInstruction(0), OpInc, OpDup)
+	code = append(code, ShortPushInstruction(10)...)
+	code = append(code, OpEq)
+	code = append(code, JzInstruction(int32(UserMemoryOffset)+2)...)
+	code = append(code, OpHalt)
+	machine := NewVM(code)
+	slices := 0
+	for {
+		status, err := machine.RunSlice(7)
+		slices++
+		if err != nil || status == SliceErred {
+			t.Fatalf("RunSlice failed: %v", err)
+		}
+		if status == SliceHalted {
+			break
+		}
+	}
+	if stack := machine.Stack(); len(stack) != 1 || stack[0] != 10 {
+		t.Errorf("Expected [10], got %v", stack)
+	}
+	// PUSH8, then 10 rounds of five instructions, then HALT
+	if slices != 8 {
+		t.Errorf("Expected 52 instructions to take 8 slices of 7, took %d", slices)
+	}
+	if status, _ := machine.RunSlice(7); status != SliceHalted {
+		t.Errorf("Expected a halted program to stay halted, got %v", status)
+	}
+
+	machine = NewVM([]byte{OpPop})
+	if status, err := machine.RunSlice(10); status != SliceErred || err == nil {
+		t.Errorf("Expected an error, got %v, %v", status, err)
+	}
+}
+
+func TestIntrospectionOpcodes(t *testing.T) {
+	// CALL word, HALT; word: PC@ RDEPTH MEMSIZE RET
+	code := append(CallInstruction(0x4006), OpHalt, OpPCFetch, OpRDepth, OpMemSize, OpRet)
+	vm := NewVM(code)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := []int32{0x4006, 1, int32(UserMemoryOffset + len(code))}
+	if stack := vm.Stack(); !reflect.DeepEqual(stack, want) {
+		t.Errorf("Expected %v, got %v", want, stack)
+	}
+}
@@ -373,11 +373,7 @@ func replEval(line string) (stack []int32, output string, errStr string) {
 	m := vm.NewVM(bytecode)
 	copy(m.Memory()[vm.VideoFramebufferStart:vm.VideoFramebufferStart+vm.VideoBufferSize], repl.framebuffer)
 	m.OutputHandler = func(value int32, format int32) {
-		if format == 1 {
-			outBuf.WriteRune(rune(value))
-		} else {
-			outBuf.WriteString(fmt.Sprintf("%d", value))
-		}
+		outBuf.WriteString(vm.FormatOutput(value, format))
 	}
 	if err := m.Run(); err != nil {
 		return repl.stack, "", err.Error()
@@ -398,6 +394,7 @@ func runWASM() {
 			return false
 		}
 		_, err := machine.Step()
+		machine.Flush()
 		if err != nil {
 			fmt.Printf("VM Error: %v", err)
 			return false